@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Path activation starts a service when there is something for it to do,
+// like a systemd .path unit paired with a service:
+//
+//	"start_on_path": ["/var/spool/incoming"]
+//
+// A service with ActivatePaths is not started at boot unless one of its
+// paths already has content (a file exists, or a directory is non-empty).
+// Afterwards:
+//   - a change to a path while waiting starts the service
+//   - a clean exit (code 0) puts it back to waiting, or starts it again
+//     right away if StopWhenEmpty is set and there is still work queued
+//   - a crash goes through the normal restart policy
+//   - with StopWhenEmpty, the service is stopped once its paths are empty
+
+// pathsHaveContent reports whether any activation path exists and, for
+// directories, contains at least one entry
+func pathsHaveContent(paths []string) bool {
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !fi.IsDir() {
+			return true
+		}
+		entries, err := os.ReadDir(path)
+		if err == nil && len(entries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pathEvent is the watcher callback for activation paths
+func (s *Supervisor) pathEvent(p *Process) {
+	hasWork := pathsHaveContent(p.ActivatePaths)
+
+	p.mu.Lock()
+	state := p.state
+	if state == StateRunning && p.StopWhenEmpty && !hasWork {
+		p.deactivating = true
+	}
+	deactivate := p.deactivating
+	p.mu.Unlock()
+
+	switch {
+	case state == StateWaiting && hasWork:
+		logInfo("%s activated by path change", p.Name)
+		s.RestartProcess(p)
+	case state == StateRunning && deactivate:
+		logInfo("%s: queue is empty, stopping", p.Name)
+		p.kill(syscall.SIGTERM)
+	}
+}
+
+// settleActivation decides what happens to a stopped path-activated
+// process. Returns true if it was handled (put back to waiting, or
+// restarted because more work is queued). Caller must hold p.mu.
+func (p *Process) settleActivation() bool {
+	if len(p.ActivatePaths) == 0 || p.state != StateStopped || p.pendingRestart {
+		return false
+	}
+
+	if !p.deactivating && p.exitCode != 0 {
+		return false // Crashed: normal restart policy
+	}
+	p.deactivating = false
+
+	if p.StopWhenEmpty && pathsHaveContent(p.ActivatePaths) {
+		p.pendingRestart = true // More work queued - go again
+		return false
+	}
+
+	logInfo("%s finished, waiting for path activation", p.Name)
+	p.state = StateWaiting
+	p.restarts = 0
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// adoptRunning makes p supervise the process its pid file names, if that
+// process runs p's command, instead of starting another one. It reports
+// whether it did; if not, p is started as usual. Caller must hold p.mu.
+//
+// KEY CONCEPT: Adopting a process
+// Moving a host from init scripts to a supervisor normally means stopping
+// every daemon and starting it again under the supervisor - a restart
+// per service, at a time of the migration's choosing rather than the
+// service's. With adopt, gosv takes over what already runs: the pid file
+// the init script left says which process it is, and a pidfd (see
+// watchPID) tells gosv when it exits. gosv didn't start it, so it can't
+// wait4() for it and never learns its exit code, but everything after
+// that exit is gosv's: the restart is a normal start of the command, as
+// gosv's own child. A pid file can outlive its process and its pid be
+// reused by an unrelated one, so the process must be running the
+// service's command to be adopted.
+func (p *Process) adoptRunning() bool {
+	pid, err := readPIDFile(p.PIDFile)
+	if err != nil {
+		logInfo("%s: nothing to adopt (%v), starting it", p.Name, err)
+		return false
+	}
+	wait, err := watchPID(pid, func() error { return p.runsCommand(pid) })
+	if err != nil {
+		logWarn("%s: not adopting pid %d from %s: %v; starting it", p.Name, pid, p.PIDFile, err)
+		return false
+	}
+
+	p.pid = pid
+	// Its group is only its own if it leads it: a daemon started from a
+	// shell script may share one with processes that aren't the service
+	p.pgid = 0
+	if pgid, err := syscall.Getpgid(pid); err == nil && pgid == pid {
+		p.pgid = pgid
+	}
+	p.state = StateRunning
+	p.adopted = true
+	p.exhausted = false
+	p.startTime = p.now()
+	if p.needsCgroup() {
+		p.adoptIntoCgroup()
+	}
+	p.trackPeak()
+	logInfo("adopted %s (pid=%d, pgid=%d, from %s)", p.Name, pid, p.pgid, p.PIDFile)
+
+	go func() {
+		wait()
+		if p.watchedExit != nil {
+			p.watchedExit(pid)
+		}
+	}()
+	return true
+}
+
+// adoptIntoCgroup moves the adopted process of p and its descendants into
+// a cgroup of p's own, with p's limits. Caller must hold p.mu.
+func (p *Process) adoptIntoCgroup() {
+	cg, err := NewCgroup(p.cgroupName())
+	if err != nil {
+		logWarn("failed to create cgroup for %s: %v", p.Name, err)
+		return
+	}
+	p.cgroup = cg
+	p.applyLimits(cg)
+	moved := 0
+	for _, pid := range append([]int{p.pid}, descendants(p.pid)...) {
+		if err := cg.AddProcess(pid); err != nil {
+			logWarn("failed to add pid %d of %s to cgroup: %v", pid, p.Name, err)
+			continue
+		}
+		moved++
+	}
+	logInfo("moved %d process(es) of %s into %s", moved, p.Name, cg.path)
+}
+
+// errNotCommand is why a process that runs something else isn't adopted
+func errNotCommand(command string) error {
+	return fmt.Errorf("it isn't running %s (a stale pid file?)", command)
+}
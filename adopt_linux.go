@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// runsCommand checks that pid runs p's command: its executable is the
+// command, or the command is one of its first two arguments (a script
+// run by its interpreter)
+func (p *Process) runsCommand(pid int) error {
+	command, err := exec.LookPath(p.Command)
+	if err != nil {
+		return err
+	}
+	if want, err := os.Stat(command); err == nil {
+		if exe, err := os.Stat(fmt.Sprintf("/proc/%d/exe", pid)); err == nil && os.SameFile(want, exe) {
+			return nil
+		}
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return err
+	}
+	args := bytes.Split(cmdline, []byte{0})
+	for i := 0; i < len(args) && i < 2; i++ {
+		arg := string(args[i])
+		if arg == p.Command || arg == command || filepath.Base(arg) == filepath.Base(command) {
+			return nil
+		}
+	}
+	return errNotCommand(p.Command)
+}
+
+// descendants returns the pids of the descendants of pid, from /proc
+func descendants(pid int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	children := make(map[int][]int)
+	for _, e := range entries {
+		child, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if ppid, err := readPPid(child); err == nil {
+			children[ppid] = append(children[ppid], child)
+		}
+	}
+	var pids []int
+	queue := children[pid]
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		pids = append(pids, next)
+		queue = append(queue, children[next]...)
+	}
+	return pids
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAgentStatusSec is how often the agent sends the status of the
+// services when status_sec is not configured
+const DefaultAgentStatusSec = 10
+
+// agentBackoff is the wait before reconnecting to the controller, which
+// doubles up to agentMaxBackoff while it stays unreachable
+const (
+	agentBackoff    = time.Second
+	agentMaxBackoff = time.Minute
+)
+
+// agentEventQueue is how many events can wait for the controller before
+// new ones are dropped
+const agentEventQueue = 256
+
+// agentCommands are the commands a controller can send
+var agentCommands = []string{"status", "start", "stop", "restart", "cancel", "deploy"}
+
+// agentRunning is the running agent (nil without an "agent" config).
+// Events reach it through recordEvent, so it's not reached through s.
+var agentRunning atomic.Pointer[agent]
+
+// AgentConfig connects gosv to a central controller (the top-level
+// "agent" config object)
+type AgentConfig struct {
+	Controller string `json:"controller"` // host:port of the controller's gRPC endpoint
+	Name       string `json:"name"`       // How the controller knows this gosv (default: the host name)
+	TokenFile  string `json:"token_file"` // Bearer token sent to the controller
+	CA         string `json:"ca"`         // PEM CAs the controller's certificate must chain to (default: the system's)
+	CertFile   string `json:"tls_cert"`   // PEM client certificate, for a controller that asks for one
+	KeyFile    string `json:"tls_key"`    // Its PEM private key
+	Plaintext  bool   `json:"plaintext"`  // No TLS, for a controller on loopback
+	StatusSec  int    `json:"status_sec"` // How often the status is sent
+}
+
+// validate checks the agent config
+func (c *AgentConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.Controller); err != nil {
+		return fmt.Errorf("agent: controller must be host:port: %w", err)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("agent: tls_cert and tls_key go together")
+	}
+	if c.StatusSec < 0 {
+		return fmt.Errorf("agent: status_sec must not be negative")
+	}
+	if c.Plaintext && (c.CA != "" || c.CertFile != "") {
+		return fmt.Errorf("agent: plaintext can't be combined with ca, tls_cert or tls_key")
+	}
+	// The controller's commands run here, and the token goes with them:
+	// neither may cross a network in the clear
+	if c.Plaintext && !isLoopback(c.Controller) {
+		return fmt.Errorf("agent: controller %s is not a loopback address, and needs TLS", c.Controller)
+	}
+	return nil
+}
+
+// name returns Name or its default
+func (c AgentConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// statusInterval returns how often the status is sent
+func (c AgentConfig) statusInterval() time.Duration {
+	if c.StatusSec == 0 {
+		return DefaultAgentStatusSec * time.Second
+	}
+	return time.Duration(c.StatusSec) * time.Second
+}
+
+// agentMessage is what the agent sends the controller, one field set in
+// each: a hello first, then status, events and the replies to commands
+type agentMessage struct {
+	Hello  *agentHello   `json:"hello,omitempty"`
+	Status *statusReport `json:"status,omitempty"`
+	Event  *Event        `json:"event,omitempty"`
+	Reply  *agentReply   `json:"reply,omitempty"`
+}
+
+// agentHello tells the controller which gosv connected
+type agentHello struct {
+	Name     string    `json:"name"`
+	Host     string    `json:"host"`
+	Instance string    `json:"instance"` // Named after the config, as for Loki
+	PID      int       `json:"pid"`
+	Time     time.Time `json:"time"`
+	Commands []string  `json:"commands"` // Those it accepts
+}
+
+// agentCommand is a command from the controller
+type agentCommand struct {
+	ID       string         `json:"id"`      // Sent back in the replies
+	Command  string         `json:"command"` // One of agentCommands
+	Args     []string       `json:"args"`    // Services and @groups
+	Selector string         `json:"selector,omitempty"`
+	Rolling  bool           `json:"rolling,omitempty"` // For restart (see RollingRestart)
+	Deploy   *deployRequest `json:"deploy,omitempty"`  // For deploy, with its service
+}
+
+// agentReply answers an agentCommand: the progress of a deploy or a
+// rolling restart, and a last reply with Done set
+type agentReply struct {
+	ID     string `json:"id"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// agentStream is the agent's end of a connection to the controller.
+// send may be called from several goroutines at once.
+type agentStream interface {
+	send(agentMessage) error
+	recv() (agentCommand, error) // io.EOF once the controller ends it
+	close()
+}
+
+// agentTransport opens a connection to the controller
+type agentTransport func(ctx context.Context) (agentStream, error)
+
+// newAgentTransport returns the transport to the controller of cfg, which
+// sends token to it. It's nil in a gosv built without the agent (see
+// agent_grpc.go).
+var newAgentTransport func(cfg AgentConfig, token string) (agentTransport, error)
+
+// errNoAgent is returned when an agent is asked of a gosv built without
+// one
+var errNoAgent = errors.New("this gosv is built without the agent (build it with -tags agent)")
+
+// agent keeps gosv connected to its controller
+//
+// KEY CONCEPT: Agents and a central controller
+// One gosv per host answers for that host only: with a hundred hosts,
+// "which of them run an old build of the api" means a hundred ctl
+// sessions, and a deploy means a loop of ssh. A controller that every
+// gosv reports to sees the whole fleet and can act on it. The agent
+// dials out, instead of listening for the controller: hosts behind NAT
+// or a firewall can still be reached, the controller needs no list of
+// hosts (whoever connects is there), and nothing on the host listens
+// for commands from the network. One long-lived gRPC stream each way
+// carries everything: status every status_sec and events as they happen
+// up, commands down. When the stream breaks, the agent dials again with
+// backoff. Events wait in a bounded queue meanwhile, and the services
+// never wait for the controller: what doesn't fit in the queue is
+// dropped and counted.
+type agent struct {
+	s      *Supervisor
+	cfg    AgentConfig
+	name   string
+	dial   agentTransport
+	events chan Event
+
+	dropped atomic.Uint64 // Events lost to a full queue
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// newAgent prepares an agent for cfg
+func (s *Supervisor) newAgent(cfg AgentConfig) (*agent, error) {
+	if newAgentTransport == nil {
+		return nil, errNoAgent
+	}
+	token := ""
+	if cfg.TokenFile != "" {
+		data, err := os.ReadFile(cfg.TokenFile)
+		if token = strings.TrimSpace(string(data)); err != nil || token == "" {
+			return nil, fmt.Errorf("token_file %s is unreadable or empty: %v", cfg.TokenFile, err)
+		}
+	}
+	dial, err := newAgentTransport(cfg, token)
+	if err != nil {
+		return nil, err
+	}
+	a := &agent{s: s, cfg: cfg, name: cfg.name(), dial: dial, events: make(chan Event, agentEventQueue), done: make(chan struct{})}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	return a, nil
+}
+
+// startAgent connects to the configured controller, or disconnects or
+// reconnects when a reload changed the config. Called at start and after
+// every reload.
+func (s *Supervisor) startAgent() {
+	s.mu.RLock()
+	cfg := s.agentConfig
+	s.mu.RUnlock()
+	old := agentRunning.Load()
+	if old != nil && cfg != nil && reflect.DeepEqual(old.cfg, *cfg) {
+		return
+	}
+	var a *agent
+	if cfg != nil {
+		var err error
+		if a, err = s.newAgent(*cfg); err != nil {
+			logWarn("agent: not connecting to %s: %v", cfg.Controller, err)
+		}
+	}
+	agentRunning.Store(a)
+	if old != nil {
+		old.close()
+	}
+	if a != nil {
+		logInfo("agent: connecting to controller %s as %s", cfg.Controller, a.name)
+		go a.run()
+	}
+}
+
+// stopAgent disconnects from the controller at shutdown
+func stopAgent() {
+	if a := agentRunning.Swap(nil); a != nil {
+		a.close()
+	}
+}
+
+// close ends the stream and waits for run to return. Commands still
+// running go on, but their replies are lost.
+func (a *agent) close() {
+	a.cancel()
+	<-a.done
+}
+
+// event queues ev for the controller, or drops it if the queue is full
+func (a *agent) event(ev Event) {
+	select {
+	case a.events <- ev:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// run connects to the controller, and connects again whenever the stream
+// breaks, until the agent is closed
+func (a *agent) run() {
+	defer close(a.done)
+	backoff := agentBackoff
+	for {
+		connected, err := a.connect()
+		if a.ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = agentBackoff
+		}
+		logWarn("agent: controller %s: %v, trying again in %v", a.cfg.Controller, err, backoff)
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, agentMaxBackoff)
+	}
+}
+
+// connect opens the stream and serves it until it breaks. It reports
+// whether the controller took the hello, and why the stream ended.
+func (a *agent) connect() (bool, error) {
+	ctx, cancel := context.WithCancel(a.ctx)
+	defer cancel()
+	stream, err := a.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer stream.close()
+	host, _ := os.Hostname()
+	hello := &agentHello{Name: a.name, Host: host, Instance: configName(a.s.configSource), PID: os.Getpid(),
+		Time: a.s.clock.Now(), Commands: agentCommands}
+	if err := stream.send(agentMessage{Hello: hello}); err != nil {
+		return false, err
+	}
+	logInfo("agent: connected to controller %s", a.cfg.Controller)
+
+	errs := make(chan error, 2)
+	go func() { errs <- a.report(ctx, stream) }()
+	go func() { errs <- a.serve(stream) }()
+	return true, <-errs
+}
+
+// report sends the status now and every status_sec, and the events as
+// they come
+func (a *agent) report(ctx context.Context, out agentStream) error {
+	tick := time.NewTicker(a.cfg.statusInterval())
+	defer tick.Stop()
+	if err := out.send(agentMessage{Status: a.status()}); err != nil {
+		return err
+	}
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+			if n := a.dropped.Swap(0); n > 0 {
+				logWarn("agent: dropped %d events the controller didn't take in time", n)
+			}
+			err = out.send(agentMessage{Status: a.status()})
+		case ev := <-a.events:
+			err = out.send(agentMessage{Event: &ev})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// status is the status the agent reports: that of the status page, with
+// all of its fields, for all services
+func (a *agent) status() *statusReport {
+	report := a.s.statusReport(StatusPageConfig{Title: a.name, Fields: statusFields})
+	return &report
+}
+
+// serve runs the commands of the controller until the stream breaks.
+// Each runs on a goroutine of its own, so a deploy doesn't hold up the
+// commands behind it.
+func (a *agent) serve(stream agentStream) error {
+	for {
+		cmd, err := stream.recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("the controller ended the stream")
+			}
+			return err
+		}
+		go a.handle(cmd, stream)
+	}
+}
+
+// handle runs cmd and sends its replies. start, stop, restart and cancel
+// go through the main loop, as from the control socket.
+func (a *agent) handle(cmd agentCommand, out agentStream) {
+	progress := func(line string) {
+		out.send(agentMessage{Reply: &agentReply{ID: cmd.ID, Output: line}})
+	}
+	done := func(output string, err error) {
+		reply := &agentReply{ID: cmd.ID, Output: output, Done: true}
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		out.send(agentMessage{Reply: reply})
+	}
+	what := strings.Join(cmd.Args, " ")
+	if cmd.Deploy != nil {
+		what = cmd.Deploy.Command + " to " + cmd.Deploy.Service
+	}
+	logInfo("agent: %s %s requested by the controller", cmd.Command, what)
+	switch cmd.Command {
+	case "status":
+		done("", out.send(agentMessage{Status: a.status()}))
+	case "restart", "start", "stop", "cancel":
+		if cmd.Command == "restart" && cmd.Rolling {
+			targets, err := a.s.rollingTargets(cmd.Args, cmd.Selector)
+			if err == nil {
+				err = a.s.RollingRestart(targets, progress)
+			}
+			done("", err)
+			return
+		}
+		reply := a.s.callMain(ctlRequest{Command: cmd.Command, Args: cmd.Args, Selector: cmd.Selector})
+		var err error
+		if reply.Error != "" {
+			err = errors.New(reply.Error)
+		}
+		done(reply.Output, err)
+	case "deploy":
+		d := cmd.Deploy
+		if d == nil || d.Service == "" || d.Command == "" {
+			done("", fmt.Errorf("deploy: service and command are required"))
+			return
+		}
+		done("", a.s.Deploy(d.Service, d.Command, d.Args, progress))
+	default:
+		done("", fmt.Errorf("unknown command %q (have %s)", cmd.Command, strings.Join(agentCommands, ", ")))
+	}
+}
@@ -0,0 +1,122 @@
+//go:build agent
+
+package main
+
+// The agent's connection to its controller, a gRPC stream (see agent.go).
+// gRPC is a dependency of its own, so the default build leaves it out.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+)
+
+// agentMethod is the controller's method the agent calls: a stream each
+// way, open for as long as the agent is connected
+const agentMethod = "/gosv.agent.v1.Controller/Connect"
+
+var agentStreamDesc = grpc.StreamDesc{StreamName: "Connect", ClientStreams: true, ServerStreams: true}
+
+func init() {
+	encoding.RegisterCodec(agentCodec{})
+	newAgentTransport = grpcAgentTransport
+}
+
+// agentCodec encodes the messages of the stream as JSON, like those of
+// the control socket, so that a controller needs no generated code: it
+// registers a codec named "json", and gets application/grpc+json
+type agentCodec struct{}
+
+func (agentCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (agentCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (agentCodec) Name() string                       { return "json" }
+
+// grpcAgentTransport dials the controller of cfg over gRPC, with the
+// token in the authorization metadata of the stream
+func grpcAgentTransport(cfg AgentConfig, token string) (agentTransport, error) {
+	creds, err := agentCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) (agentStream, error) {
+		conn, err := grpc.NewClient(cfg.Controller, grpc.WithTransportCredentials(creds),
+			grpc.WithDefaultCallOptions(grpc.CallContentSubtype(agentCodec{}.Name())))
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		}
+		stream, err := conn.NewStream(ctx, &agentStreamDesc, agentMethod)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &grpcAgentStream{conn: conn, stream: stream}, nil
+	}, nil
+}
+
+// agentCredentials returns the transport credentials of the connection to
+// the controller. A client certificate is loaded again when its file
+// changes, as a listener's is.
+func agentCredentials(cfg AgentConfig) (credentials.TransportCredentials, error) {
+	if cfg.Plaintext {
+		return insecure.NewCredentials(), nil
+	}
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CA != "" {
+		data, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("tls: no certificates in ca %s", cfg.CA)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		loader := &certLoader{certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+		if _, err := loader.get(nil); err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return loader.get(nil)
+		}
+	}
+	return credentials.NewTLS(tlsCfg), nil
+}
+
+// grpcAgentStream is a stream to the controller. gRPC allows only one
+// goroutine at a time to send on it.
+type grpcAgentStream struct {
+	conn   *grpc.ClientConn
+	stream grpc.ClientStream
+	mu     sync.Mutex
+}
+
+func (g *grpcAgentStream) send(m agentMessage) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stream.SendMsg(&m)
+}
+
+func (g *grpcAgentStream) recv() (agentCommand, error) {
+	var cmd agentCommand
+	err := g.stream.RecvMsg(&cmd)
+	return cmd, err
+}
+
+func (g *grpcAgentStream) close() {
+	g.conn.Close()
+}
@@ -0,0 +1,121 @@
+//go:build agent
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// testController serves the controller's end of the agent stream on
+// loopback, and hands over each stream that connects
+func testController(t *testing.T) (string, <-chan grpc.ServerStream) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := make(chan grpc.ServerStream)
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "gosv.agent.v1.Controller",
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Connect",
+			ClientStreams: true,
+			ServerStreams: true,
+			Handler: func(_ any, stream grpc.ServerStream) error {
+				streams <- stream
+				<-stream.Context().Done()
+				return nil
+			},
+		}},
+	}, nil)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l.Addr().String(), streams
+}
+
+// recvAgent returns the next message of the agent that want takes,
+// skipping the others
+func recvAgent(t *testing.T, stream grpc.ServerStream, want func(agentMessage) bool) agentMessage {
+	t.Helper()
+	for {
+		var msg agentMessage
+		if err := stream.RecvMsg(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if want(msg) {
+			return msg
+		}
+	}
+}
+
+func TestAgent(t *testing.T) {
+	addr, streams := testController(t)
+	s, _ := newTestSupervisor(t, testProcess("web"))
+	token := t.TempDir() + "/token"
+	if err := os.WriteFile(token, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.newAgent(AgentConfig{Controller: addr, Name: "host-a", TokenFile: token, Plaintext: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.run()
+	defer a.close()
+
+	var stream grpc.ServerStream
+	select {
+	case stream = <-streams:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the agent didn't connect")
+	}
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if got := md.Get("authorization"); len(got) != 1 || got[0] != "Bearer s3cret" {
+		t.Errorf("authorization = %q, want the token", got)
+	}
+	hello := recvAgent(t, stream, func(m agentMessage) bool { return true })
+	if hello.Hello == nil || hello.Hello.Name != "host-a" {
+		t.Fatalf("first message = %+v, want a hello from host-a", hello)
+	}
+	status := recvAgent(t, stream, func(m agentMessage) bool { return m.Status != nil })
+	if status.Status.Title != "host-a" || status.Status.Total != 1 || status.Status.Services[0]["name"] != "web" {
+		t.Errorf("status = %+v, want web on host-a", status.Status)
+	}
+
+	a.event(Event{Time: testEpoch, Service: "web", Kind: EventExit, Msg: "exited with code 1"})
+	ev := recvAgent(t, stream, func(m agentMessage) bool { return m.Event != nil })
+	if ev.Event.Service != "web" || ev.Event.Kind != EventExit {
+		t.Errorf("event = %+v, want the exit of web", ev.Event)
+	}
+
+	tests := []struct {
+		cmd       agentCommand
+		wantError string
+	}{
+		{agentCommand{ID: "1", Command: "status"}, ""},
+		{agentCommand{ID: "2", Command: "exec", Args: []string{"web"}}, `unknown command "exec"`},
+		{agentCommand{ID: "3", Command: "deploy", Deploy: &deployRequest{Service: "web"}}, "service and command are required"},
+		{agentCommand{ID: "4", Command: "restart", Rolling: true}, "no service given"},
+	}
+	for _, tt := range tests {
+		if err := stream.SendMsg(&tt.cmd); err != nil {
+			t.Fatal(err)
+		}
+		reply := recvAgent(t, stream, func(m agentMessage) bool { return m.Reply != nil && m.Reply.Done })
+		if reply.Reply.ID != tt.cmd.ID {
+			t.Errorf("%s: reply to %q, want %q", tt.cmd.Command, reply.Reply.ID, tt.cmd.ID)
+		}
+		switch {
+		case tt.wantError == "" && reply.Reply.Error != "",
+			tt.wantError != "" && !strings.Contains(reply.Reply.Error, tt.wantError):
+			t.Errorf("%s: error %q, want %q", tt.cmd.Command, reply.Reply.Error, tt.wantError)
+		}
+	}
+}
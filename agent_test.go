@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAgentConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     AgentConfig
+		wantErr string
+	}{
+		{"tls", AgentConfig{Controller: "ctl.example.com:7443"}, ""},
+		{"plaintext on loopback", AgentConfig{Controller: "127.0.0.1:7443", Plaintext: true}, ""},
+		{"plaintext off loopback", AgentConfig{Controller: "ctl.example.com:7443", Plaintext: true}, "needs TLS"},
+		{"no port", AgentConfig{Controller: "ctl.example.com"}, "host:port"},
+		{"cert without key", AgentConfig{Controller: "ctl.example.com:7443", CertFile: "agent.pem"}, "go together"},
+		{"plaintext with ca", AgentConfig{Controller: "localhost:7443", Plaintext: true, CA: "ca.pem"}, "can't be combined"},
+		{"negative status_sec", AgentConfig{Controller: "ctl.example.com:7443", StatusSec: -1}, "negative"},
+	}
+	for _, tt := range tests {
+		err := tt.cfg.validate()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want one about %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
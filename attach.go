@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// openStdin makes a new pipe for an attachable process's stdin, keeps its
+// write end and returns the read end for the child. Caller must hold p.mu.
+//
+// KEY CONCEPT: Attaching to a running service
+// Some services read commands from stdin: a game server's console, a
+// REPL, an installer that asks a question. Under a supervisor nobody sits
+// at their terminal, so the usual answer is to run them in tmux or
+// screen. gosv gives such a service a pipe instead, and keeps the write
+// end: `gosv ctl attach` copies what the operator types over the control
+// socket into it, and shows the service's output as `ctl logs -f` would.
+// Detaching closes nothing, so the service never sees EOF, and the next
+// operator can attach later. A restart gets a fresh pipe.
+func (p *Process) openStdin() (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.closeStdin()
+	p.stdin = w
+	return r, nil
+}
+
+// closeStdin closes the write end of p's stdin, once its process is gone.
+// Caller must hold p.mu.
+func (p *Process) closeStdin() {
+	if p.stdin != nil {
+		p.stdin.Close()
+		p.stdin = nil
+	}
+}
+
+// serveAttach answers `gosv ctl attach`: a reply naming the service, its
+// recent lines, and then its output as it comes, while what the client
+// sends (in) goes to the service's stdin. It ends when the client hangs
+// up, the service is removed or gosv stops. One operator at a time.
+func (s *Supervisor) serveAttach(conn net.Conn, in io.Reader, req ctlRequest) {
+	enc := json.NewEncoder(conn)
+	if len(req.Args) != 1 {
+		enc.Encode(ctlReply{Error: "attach: usage: attach <service>"})
+		return
+	}
+	p, err := s.lookup(req.Args[0])
+	if err != nil {
+		enc.Encode(ctlReply{Error: err.Error()})
+		return
+	}
+	p.mu.Lock()
+	switch {
+	case !p.Attachable:
+		err = fmt.Errorf("%s: stdin is not attachable (see stdin)", p.Name)
+	case p.attached:
+		err = fmt.Errorf("%s: someone else is attached", p.Name)
+	}
+	if err != nil {
+		p.mu.Unlock()
+		enc.Encode(ctlReply{Error: err.Error()})
+		return
+	}
+	p.attached = true
+	p.ensureLogs()
+	lp := p.logs
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.attached = false
+		p.mu.Unlock()
+	}()
+
+	req.Lines = min(max(req.Lines, 0), logTailLines)
+	lines, f := lp.follow(req.Lines, true)
+	if f != nil {
+		defer lp.unfollow(f)
+	}
+	var mu sync.Mutex // Serializes writes to conn
+	send := func(v any) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return enc.Encode(v) == nil
+	}
+	if !send(ctlReply{Services: []string{p.Name}}) {
+		return
+	}
+	for _, l := range lines {
+		if !send(ctlLogLine{Service: p.Name, Stream: l.stream, Time: l.time, Line: string(l.text)}) {
+			return
+		}
+	}
+	if f == nil {
+		send(ctlLogLine{Service: p.Name, Note: "no more output (service removed or changed)"})
+		return
+	}
+
+	// Input: to whichever process runs now, dropped while none does
+	detached := make(chan struct{})
+	go func() {
+		defer close(detached)
+		buf := make([]byte, 4096)
+		dropping, first := false, true
+		for {
+			n, err := in.Read(buf)
+			chunk := buf[:n]
+			if first && n > 0 {
+				// The newline that ends the request isn't input
+				if chunk[0] == '\n' {
+					chunk = chunk[1:]
+				}
+				first = false
+			}
+			if len(chunk) > 0 {
+				p.mu.Lock()
+				w := p.stdin
+				p.mu.Unlock()
+				failed := w == nil
+				if !failed {
+					_, werr := w.Write(chunk)
+					failed = werr != nil
+				}
+				if failed && !dropping {
+					send(ctlLogLine{Service: p.Name, Note: "not running, input dropped"})
+				}
+				dropping = failed
+			}
+			if err != nil {
+				return // The client detached
+			}
+		}
+	}()
+
+	for {
+		select {
+		case l, ok := <-f.lines:
+			if !ok {
+				send(ctlLogLine{Service: p.Name, Note: "no more output (service removed or changed)"})
+				return
+			}
+			if n := f.lost.Swap(0); n > 0 {
+				if !send(ctlLogLine{Service: p.Name, Note: fmt.Sprintf("%d lines skipped, ctl attach fell behind", n)}) {
+					return
+				}
+			}
+			if !send(ctlLogLine{Service: p.Name, Stream: l.stream, Time: l.time, Line: string(l.text)}) {
+				return
+			}
+		case <-detached:
+			return
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+// ctlAttach is `gosv ctl attach [-n lines] <service>`: it shows the
+// service's recent output and follows it, and sends what is typed to the
+// service's stdin, until Ctrl-D (end of input) detaches
+func ctlAttach(conn net.Conn, args []string) error {
+	req := ctlRequest{Command: "attach", Lines: 10}
+	for ; len(args) > 0; args = args[1:] {
+		switch arg := args[0]; {
+		case (arg == "-n" || arg == "--lines") && len(args) > 1:
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 0 {
+				return fmt.Errorf("attach: %s: not a count: %q", arg, args[1])
+			}
+			req.Lines = min(n, logTailLines)
+			args = args[1:]
+		default:
+			req.Args = append(req.Args, arg)
+		}
+	}
+	if len(req.Args) != 1 {
+		return fmt.Errorf("attach: usage: attach [-n lines] <service>")
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	var reply ctlReply
+	if err := dec.Decode(&reply); err != nil {
+		return fmt.Errorf("no reply: %w", err)
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("%s", reply.Error)
+	}
+	fmt.Fprintf(os.Stderr, "gosv: attached to %s, Ctrl-D to detach\n", req.Args[0])
+
+	var detached atomic.Bool
+	go func() {
+		io.Copy(conn, os.Stdin)
+		detached.Store(true)
+		conn.Close()
+	}()
+	for {
+		var l ctlLogLine
+		if err := dec.Decode(&l); err != nil {
+			if err == io.EOF || detached.Load() {
+				return nil
+			}
+			return fmt.Errorf("attach: %w", err)
+		}
+		switch {
+		case l.Note != "":
+			fmt.Fprintf(os.Stderr, "gosv: %s\n", l.Note)
+		case l.Stream == "stderr":
+			fmt.Fprintln(os.Stderr, l.Line)
+		default:
+			fmt.Fprintln(os.Stdout, l.Line)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BootReadyTimeout is how long the boot report waits for a service to
+// daemonize and its health URL and ready_check to answer before recording
+// it as never ready
+const BootReadyTimeout = 2 * time.Minute
+
+// BootRecord is how one service started at boot
+type BootRecord struct {
+	Name    string    `json:"name"`
+	Queued  time.Time `json:"queued"`  // Start called
+	Started time.Time `json:"started"` // Process spawned (cgroup, exec setup done)
+	Ready   time.Time `json:"ready"`   // Daemonized and health checks answered, or = Started without any (zero: never)
+	Note    string    `json:"note,omitempty"`
+}
+
+// BootReport is the startup timeline of one gosv run, in start order
+type BootReport struct {
+	Boot     time.Time    `json:"boot"`
+	Services []BootRecord `json:"services"`
+}
+
+// bootTracker collects the boot report while services start and become
+// ready, and writes it out once every service is accounted for
+//
+// KEY CONCEPT: Where startup time goes
+// "Startup is slow" has two very different causes. Spawn time - creating
+// the cgroup, credentials, the exec helper's mounts - is spent by gosv,
+// and since gosv starts services one after another it adds up: the last
+// service waits for every spawn before it. Readiness time is spent by the
+// service itself (opening databases, warming caches) and overlaps with
+// everything else. systemd-analyze blame ranks units by the second kind;
+// the critical path shows which spawns were in line before the slowest.
+type bootTracker struct {
+	path  string
+	clock Clock
+
+	mu     sync.Mutex
+	report BootReport
+	wg     sync.WaitGroup
+}
+
+func newBootTracker(path string, clock Clock) *bootTracker {
+	return &bootTracker{path: path, clock: clock, report: BootReport{Boot: clock.Now()}}
+}
+
+// skipped records a service not started at boot
+func (b *bootTracker) skipped(name, why string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.report.Services = append(b.report.Services, BootRecord{Name: name, Note: why})
+}
+
+// record records the outcome of a successful p.Start called at queued
+func (b *bootTracker) record(p *Process, queued time.Time) {
+	p.mu.Lock()
+	skipReason, state := p.skipReason, p.state
+	p.mu.Unlock()
+	switch {
+	case skipReason != "":
+		b.skipped(p.Name, "skipped: "+skipReason)
+	case state != StateRunning:
+		b.skipped(p.Name, "stopped before it started")
+	case !p.Forking && p.HealthURL == "" && p.ReadyCheck == nil:
+		b.started(p.Name, queued, nil)
+	default:
+		// A forking service is ready once it daemonized (see forking.go)
+		b.started(p.Name, queued, func() bool {
+			return p.daemonized() && (p.HealthURL == "" || healthy(p.HealthURL)) &&
+				(p.ReadyCheck == nil || p.ReadyCheck.probe() == nil)
+		})
+	}
+}
+
+// started records a service spawned between queued and now, and waits
+// in the background for ready to report it ready (nil: it is already)
+func (b *bootTracker) started(name string, queued time.Time, ready func() bool) {
+	now := b.clock.Now()
+	b.mu.Lock()
+	i := len(b.report.Services)
+	b.report.Services = append(b.report.Services, BootRecord{Name: name, Queued: queued, Started: now})
+	if ready == nil {
+		b.report.Services[i].Ready = now
+		b.mu.Unlock()
+		return
+	}
+	b.mu.Unlock()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		deadline := now.Add(BootReadyTimeout)
+		for !ready() {
+			if b.clock.Now().After(deadline) {
+				b.mu.Lock()
+				b.report.Services[i].Note = fmt.Sprintf("not ready after %v", BootReadyTimeout)
+				b.mu.Unlock()
+				return
+			}
+			<-b.clock.After(100 * time.Millisecond)
+		}
+		b.mu.Lock()
+		b.report.Services[i].Ready = b.clock.Now()
+		b.mu.Unlock()
+	}()
+}
+
+// finish waits for readiness in the background, then logs the total and
+// records the report for `gosv analyze`
+func (b *bootTracker) finish() {
+	go func() {
+		b.wg.Wait()
+		b.mu.Lock()
+		report := b.report
+		b.mu.Unlock()
+
+		if last := report.lastReady(); last >= 0 {
+			logInfo("startup finished in %v (%s ready last)",
+				report.Services[last].Ready.Sub(report.Boot).Round(time.Millisecond), report.Services[last].Name)
+		}
+		// Into the state store if there is one, instead of a file
+		if storeBoot(report) || b.path == "" {
+			return
+		}
+		data, _ := json.MarshalIndent(report, "", "  ")
+		os.MkdirAll(filepath.Dir(b.path), 0755)
+		if err := os.WriteFile(b.path, append(data, '\n'), 0644); err != nil {
+			logWarn("write boot report: %v", err)
+		}
+	}()
+}
+
+// lastReady returns the index of the service that became ready last, or -1
+func (r BootReport) lastReady() int {
+	last := -1
+	for i, s := range r.Services {
+		if !s.Ready.IsZero() && (last < 0 || s.Ready.After(r.Services[last].Ready)) {
+			last = i
+		}
+	}
+	return last
+}
+
+// bootReportPath returns where a gosv with this pidfile keeps its boot
+// report
+func bootReportPath(pidfile string) string {
+	return strings.TrimSuffix(pidfile, ".pid") + ".boot.json"
+}
+
+// analyze implements `gosv analyze`: it prints the boot report of the
+// gosv running (or last run) with the given config, from its state_db if
+// it has one
+func analyze(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	configPath := fs.String("config", "", "Config of the gosv to analyze")
+	pidfilePath := fs.String("pidfile", "", "Pidfile of the gosv to analyze (default: from --config)")
+	fs.Parse(args)
+
+	db, err := configStateDB(*configPath)
+	if err != nil {
+		return err
+	}
+	if db != "" && *pidfilePath == "" {
+		report, err := latestBoot(db)
+		if err != nil {
+			return fmt.Errorf("no boot report: %w", err)
+		}
+		report.print(os.Stdout)
+		return nil
+	}
+	if *pidfilePath == "" {
+		*pidfilePath = defaultPidfile(*configPath)
+	}
+	path := bootReportPath(*pidfilePath)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("no boot report: %w", err)
+	}
+	var report BootReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	report.print(os.Stdout)
+	return nil
+}
+
+// print writes the blame list and the critical path
+func (r BootReport) print(w io.Writer) {
+	since := func(t time.Time) string {
+		return fmt.Sprintf("%.3fs", t.Sub(r.Boot).Seconds())
+	}
+	dur := func(d time.Duration) string {
+		return fmt.Sprintf("%.3fs", d.Seconds())
+	}
+
+	last := r.lastReady()
+	if last < 0 {
+		fmt.Fprintln(w, "No service became ready.")
+	} else {
+		fmt.Fprintf(w, "Startup finished in %s (booted %s)\n\n", since(r.Services[last].Ready),
+			r.Boot.Format("2006-01-02 15:04:05"))
+	}
+
+	// Blame: slowest first, by spawn plus readiness
+	blame := append([]BootRecord(nil), r.Services...)
+	total := func(s BootRecord) time.Duration {
+		if s.Ready.IsZero() {
+			return 1<<63 - 1 // Never ready sorts first
+		}
+		return s.Ready.Sub(s.Queued)
+	}
+	sort.SliceStable(blame, func(i, j int) bool { return total(blame[i]) > total(blame[j]) })
+	for _, s := range blame {
+		switch {
+		case s.Started.IsZero():
+			fmt.Fprintf(w, "%10s  %s (%s)\n", "-", s.Name, s.Note)
+		case s.Ready.IsZero():
+			fmt.Fprintf(w, "%10s  %s (spawn %s, %s)\n", "never", s.Name, dur(s.Started.Sub(s.Queued)), s.Note)
+		default:
+			fmt.Fprintf(w, "%10s  %s (spawn %s, ready after %s)\n", dur(s.Ready.Sub(s.Queued)), s.Name,
+				dur(s.Started.Sub(s.Queued)), dur(s.Ready.Sub(s.Started)))
+		}
+	}
+
+	if last < 0 {
+		return
+	}
+	// Services are spawned one at a time, so everything spawned before
+	// the last one to become ready delayed it
+	fmt.Fprintf(w, "\nCritical path:\n")
+	for i, s := range r.Services {
+		if s.Started.IsZero() || s.Started.After(r.Services[last].Started) {
+			continue
+		}
+		if i == last {
+			fmt.Fprintf(w, "  %-20s @%s  spawn %s, ready after %s\n", s.Name, since(s.Queued),
+				dur(s.Started.Sub(s.Queued)), dur(s.Ready.Sub(s.Started)))
+		} else {
+			fmt.Fprintf(w, "  %-20s @%s  spawn %s\n", s.Name, since(s.Queued), dur(s.Started.Sub(s.Queued)))
+		}
+	}
+}
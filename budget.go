@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// RestartBudget is the restart_budget of a group: restarts its members
+// share, as a token bucket
+type RestartBudget struct {
+	Burst     int     `json:"burst"`      // Restarts the bucket holds
+	PerMinute float64 `json:"per_minute"` // Restarts it gets back per minute
+}
+
+func (b RestartBudget) validate(group string) error {
+	if b.Burst < 1 || b.PerMinute <= 0 {
+		return fmt.Errorf("groups: %s: restart_budget needs a burst of at least 1 and a positive per_minute", group)
+	}
+	return nil
+}
+
+// groupRestartBudgets returns the restart_budget of each group that has
+// one. It's a setting of the group itself, not a default for its members.
+func groupRestartBudgets(groups map[string]json.RawMessage) (map[string]RestartBudget, error) {
+	budgets := make(map[string]RestartBudget)
+	for name, defaults := range groups {
+		var g struct {
+			RestartBudget *RestartBudget `json:"restart_budget"`
+		}
+		if err := json.Unmarshal(defaults, &g); err != nil {
+			return nil, fmt.Errorf("groups: %s: %w", name, err)
+		}
+		if g.RestartBudget == nil {
+			continue
+		}
+		if err := g.RestartBudget.validate(name); err != nil {
+			return nil, err
+		}
+		budgets[name] = *g.RestartBudget
+	}
+	return budgets, nil
+}
+
+// restartBudget is the token bucket of a group's restart_budget
+//
+// KEY CONCEPT: Shared restart budgets
+// When a dependency that a whole group of services uses flaps - the
+// database behind twenty workers - every worker crash-loops on its own:
+// each has its own backoff, so together they still hit the dependency
+// twenty times per round, and the journal fills with twenty restart
+// stories that are really one. A token bucket shared by the group turns
+// that into one policy: each restart of a member takes a token, the
+// bucket holds burst of them and gets per_minute back, and a restart that
+// finds it empty waits for the next token - on top of the member's own
+// backoff. A few crashes go through as before; a storm is spread out to
+// the rate the group may restart at, however many members it has. The
+// group is reported unstable once, when it first runs dry, and stable
+// again once the bucket is full, instead of once per restart.
+type restartBudget struct {
+	group    string
+	cfg      RestartBudget
+	tokens   float64   // May go negative: restarts already promised
+	at       time.Time // When tokens was right
+	unstable bool
+	held     int // Restarts held back while unstable
+}
+
+// refill adds the tokens the bucket got back until t
+func (b *restartBudget) refill(t time.Time) {
+	if t.After(b.at) {
+		b.tokens = math.Min(float64(b.cfg.Burst), b.tokens+t.Sub(b.at).Minutes()*b.cfg.PerMinute)
+		b.at = t
+	}
+}
+
+// reserve takes a token for a restart due at t, and returns when the
+// restart may happen: t, or later if the bucket is empty by then
+func (b *restartBudget) reserve(t time.Time) time.Time {
+	b.refill(t)
+	b.tokens--
+	if b.tokens >= 0 {
+		return t
+	}
+	wait := time.Duration(-b.tokens / b.cfg.PerMinute * float64(time.Minute))
+	return t.Add(wait)
+}
+
+// SetRestartBudgets sets the restart budgets of groups. A budget whose
+// config didn't change keeps its state.
+func (s *Supervisor) SetRestartBudgets(cfgs map[string]RestartBudget) {
+	budgets := make(map[string]*restartBudget, len(cfgs))
+	now := s.clock.Now()
+	for group, cfg := range cfgs {
+		if b := s.restartBudgets[group]; b != nil && reflect.DeepEqual(b.cfg, cfg) {
+			budgets[group] = b
+			continue
+		}
+		budgets[group] = &restartBudget{group: group, cfg: cfg, tokens: float64(cfg.Burst), at: now}
+	}
+	s.restartBudgets = budgets
+}
+
+// budgetRestart returns how long p's restart, due in delay, must wait in
+// all: longer than delay if the restart budget of one of its groups is
+// spent. It takes a token of each. Caller must hold p.mu.
+func (s *Supervisor) budgetRestart(p *Process, delay time.Duration) time.Duration {
+	now := s.clock.Now()
+	due := now.Add(delay)
+	at := due
+	for _, g := range p.Groups {
+		b := s.restartBudgets[g]
+		if b == nil {
+			continue
+		}
+		t := b.reserve(due)
+		if !t.After(due) {
+			continue
+		}
+		b.held++
+		if !b.unstable {
+			b.unstable = true
+			logWarn("group %s is unstable: its restart budget (%d, then %g per minute) is spent, holding restarts back",
+				g, b.cfg.Burst, b.cfg.PerMinute)
+			s.noteEvent(EventUnstable, "group %s unstable: restart budget spent, %s restarts next in %v",
+				g, p.Name, t.Sub(now).Round(time.Second))
+		}
+		if t.After(at) {
+			at = t
+		}
+	}
+	return at.Sub(now).Round(time.Millisecond)
+}
+
+// settleRestartBudgets reports the groups whose budget is full again as
+// stable. It runs in the main loop, like everything that touches the
+// budgets.
+func (s *Supervisor) settleRestartBudgets() {
+	groups := make([]string, 0, len(s.restartBudgets))
+	for g := range s.restartBudgets {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	now := s.clock.Now()
+	for _, g := range groups {
+		b := s.restartBudgets[g]
+		if !b.unstable {
+			continue
+		}
+		b.refill(now)
+		if b.tokens < float64(b.cfg.Burst) {
+			continue
+		}
+		logInfo("group %s is stable again, %d restarts were held back", g, b.held)
+		s.noteEvent(EventStable, "group %s stable again: %d restarts were held back", g, b.held)
+		b.unstable, b.held = false, 0
+	}
+}
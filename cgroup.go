@@ -1,12 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 // Cgroup manages a cgroup v2 for resource limits
@@ -52,95 +56,194 @@ func getSelfCgroup() (string, error) {
 	}
 
 	// Format for cgroup v2: "0::/user.slice/user-1000.slice/..."
-	line := strings.TrimSpace(string(data))
-	parts := strings.SplitN(line, "::", 2)
-	if len(parts) != 2 {
-		return "", fmt.Errorf("unexpected cgroup format: %s", line)
+	// A hybrid hierarchy lists the v1 controllers before it
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path, nil
+		}
 	}
-
-	return parts[1], nil
+	return "", fmt.Errorf("no cgroup v2 entry in /proc/self/cgroup")
 }
 
 // hasCgroupDelegation checks if the current cgroup has delegation enabled
-// by testing if we can create a child cgroup and enable controllers
+// by testing if we can create a child cgroup and manage the current one
+//
+// Enabling a controller here would fail with EBUSY (we are still in the
+// cgroup, see findWritableCgroupBase), so it's enough that the control
+// file is ours to write: systemd hands it to the user with Delegate=yes.
 func hasCgroupDelegation() bool {
-	selfCgroup, err := getSelfCgroup()
+	m, err := readCgroupMount()
+	if err != nil || m.readOnly {
+		return false
+	}
+	parentPath, err := selfCgroupDir(m)
 	if err != nil {
 		return false
 	}
 
 	// Try to create test cgroup
-	testPath := filepath.Join(cgroupRoot, selfCgroup, ".gosv-test")
+	testPath := filepath.Join(parentPath, ".gosv-test")
 	if err := os.Mkdir(testPath, 0755); err != nil {
 		return false
 	}
 	defer os.Remove(testPath)
 
 	// Check if subtree_control exists and is writable in parent
-	parentPath := filepath.Join(cgroupRoot, selfCgroup)
 	controlPath := filepath.Join(parentPath, "cgroup.subtree_control")
+	return syscall.Access(controlPath, wOK) == nil
+}
 
-	// Try enabling a controller
-	if err := os.WriteFile(controlPath, []byte("+memory"), 0644); err != nil {
-		return false
+// wOK is W_OK from <unistd.h> (the syscall package lacks it)
+const wOK = 2
+
+// Values of --delegate
+const (
+	DelegateAuto    = "auto"  // ask systemd when we have no cgroup to manage
+	DelegateRequire = "true"  // the same, but fail if it can't be done
+	DelegateOff     = "false" // never ask
+)
+
+// delegatedEnv names the variable that tells the re-executed gosv it runs
+// in a delegated scope. Its value is a file for it to remove: proof for
+// the parent that systemd-run started it.
+const delegatedEnv = "GOSV_DELEGATED"
+
+// RunWithDelegation re-executes the current process with systemd-run for cgroup delegation,
+// waits for it and exits with its exit code. It returns if no re-exec is needed, or if
+// delegation isn't possible and mode doesn't require it.
+//
+// KEY CONCEPT: Delegated scopes
+// An unprivileged user can't create cgroups where its processes run: the
+// tree belongs to systemd. `systemd-run --user --scope -p Delegate=yes
+// cmd` asks the user's systemd to put cmd in a new scope unit whose
+// cgroup is handed over to the user. The scope runs cmd in place (no
+// fork), so it is still our child, in our session and process group:
+// stdin and the terminal are shared, Ctrl+C reaches it directly, and its
+// exit status is ours to pass on.
+func RunWithDelegation(mode string) error {
+	// The re-executed gosv: don't do it again
+	if marker, ok := os.LookupEnv(delegatedEnv); ok {
+		os.Unsetenv(delegatedEnv)
+		os.Remove(marker)
+		if !hasCgroupDelegation() {
+			logWarn("started in a systemd scope, but its cgroup is not delegated to us")
+		}
+		return nil
 	}
 
-	return true
-}
+	if mode == DelegateOff || hasCgroupDelegation() {
+		return nil
+	}
 
-// RunWithDelegation re-executes the current process with systemd-run for cgroup delegation
-// Returns true if re-exec happened (caller should exit), false if not needed or failed
-func RunWithDelegation() bool {
-	// Check if we already have delegation
-	if hasCgroupDelegation() {
-		return false
+	systemdRun, why := findSystemdRun()
+	if why != "" {
+		if mode == DelegateRequire {
+			return fmt.Errorf("cannot get a delegated cgroup: %s", why)
+		}
+		logInfo("%s, continuing without cgroup delegation", why)
+		return nil
 	}
 
-	// Check if systemd-run is available
-	systemdRun, err := exec.LookPath("systemd-run")
+	logInfo("requesting cgroup delegation via systemd-run...")
+	code, err := runDelegated(systemdRun)
 	if err != nil {
-		fmt.Println("[gosv] systemd-run not found, continuing without cgroup delegation")
-		return false
+		if mode == DelegateRequire {
+			return fmt.Errorf("cannot get a delegated cgroup: %w", err)
+		}
+		logWarn("%v, continuing without cgroup delegation", err)
+		return nil
 	}
+	os.Exit(code)
+	return nil // Never reached
+}
 
-	// Check if we're already in a delegated scope (avoid infinite loop)
-	if os.Getenv("GOSV_DELEGATED") == "1" {
-		fmt.Println("[gosv] already in delegated scope but delegation failed")
-		return false
+// findSystemdRun returns the path of systemd-run, or why it can't give
+// us a delegated scope
+func findSystemdRun() (path, why string) {
+	if runtime := containerRuntime(); runtime != "" {
+		return "", fmt.Sprintf("running in a %s container, there is no systemd to ask", runtime)
+	}
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return "", "systemd is not the init system"
 	}
+	path, err := exec.LookPath("systemd-run")
+	if err != nil {
+		return "", "systemd-run not found"
+	}
+	if os.Geteuid() != 0 && os.Getenv("XDG_RUNTIME_DIR") == "" {
+		return "", "no systemd user session (XDG_RUNTIME_DIR is not set)"
+	}
+	return path, ""
+}
 
-	fmt.Println("[gosv] requesting cgroup delegation via systemd-run...")
+// runDelegated runs gosv again under systemdRun in a delegated scope and
+// returns its exit code. It fails if systemd-run didn't get as far as
+// starting it (no user manager, D-Bus down, scope refused).
+func runDelegated(systemdRun string) (int, error) {
+	marker, err := os.CreateTemp("", "gosv-delegate-*")
+	if err != nil {
+		return 0, err
+	}
+	marker.Close()
+	defer os.Remove(marker.Name())
 
 	// Build command to re-exec ourselves
 	args := []string{
-		"--user",           // User scope
-		"--scope",          // Transient scope (not service)
+		"--scope",            // Transient scope (not service)
+		"--quiet",            // No "Running scope as unit" line
 		"-p", "Delegate=yes", // Enable delegation
-		"--",
 	}
+	if os.Geteuid() != 0 {
+		args = append([]string{"--user"}, args...) // User scope
+	}
+	args = append(args, "--")
 	args = append(args, os.Args...)
 
 	cmd := exec.Command(systemdRun, args...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Env = append(os.Environ(), "GOSV_DELEGATED=1")
-
-	if err := cmd.Run(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			os.Exit(exitErr.ExitCode())
-		}
-		fmt.Printf("[gosv] systemd-run failed: %v\n", err)
-		return false
+	cmd.Env = append(os.Environ(), delegatedEnv+"="+marker.Name())
+
+	// Signals the terminal sends to its foreground process group reach
+	// the child directly. Everything else sent to us is passed on.
+	forwarded := []os.Signal{syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1}
+	fromTerminal := []os.Signal{syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTSTP, syscall.SIGWINCH}
+	sigs := make(chan os.Signal, 8)
+	signal.Notify(sigs, append(forwarded, fromTerminal...)...)
+	defer signal.Stop(sigs)
+	tty := isTerminal(os.Stdin)
+
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("systemd-run: %w", err)
 	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				if tty && slices.Contains(fromTerminal, sig) {
+					continue
+				}
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+	cmd.Wait()
+	close(done)
 
-	os.Exit(0)
-	return true // Never reached
+	if _, err := os.Stat(marker.Name()); err == nil {
+		return 0, fmt.Errorf("systemd-run could not start gosv in a delegated scope (%v)", cmd.ProcessState)
+	}
+	return exitStatus(cmd.ProcessState), nil
 }
 
 // findWritableCgroupBase finds a cgroup path where we can create children
 // Tries in order:
-// 1. Current process's cgroup (for systemd user sessions with delegation)
+// 1. Current process's cgroup (for systemd user sessions with delegation,
+//    and containers with a cgroup namespace, see selfCgroupDir)
 // 2. /sys/fs/cgroup directly (for root or non-systemd systems)
 //
 // KEY CONCEPT: cgroup v2 "no internal processes" rule
@@ -148,11 +251,20 @@ func RunWithDelegation() bool {
 // To enable controllers for children, we must first move all processes
 // from the parent to a leaf cgroup.
 func findWritableCgroupBase() (string, error) {
-	// Try 1: Use our current cgroup (works with systemd delegation)
-	selfCgroup, err := getSelfCgroup()
-	if err == nil && selfCgroup != "" {
-		parentPath := filepath.Join(cgroupRoot, selfCgroup)
+	runtime := containerRuntime()
+	m, err := readCgroupMount()
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrCgroupUnavailable, err)
+	}
+	if m.readOnly {
+		return "", fmt.Errorf("%w: %s is mounted read-only - %s", ErrCgroupUnavailable, cgroupRoot, cgroupHint(runtime))
+	}
 
+	// Try 1: Use our current cgroup (works with systemd delegation)
+	parentPath, err := selfCgroupDir(m)
+	if err != nil {
+		logDebug("cannot use our own cgroup: %v", err)
+	} else {
 		// KEY CONCEPT: To enable controllers in subtree_control, the cgroup
 		// must have no processes. We need to:
 		// 1. Create a "supervisor" leaf cgroup for ourselves
@@ -165,9 +277,19 @@ func findWritableCgroupBase() (string, error) {
 			// Move ourselves to the supervisor cgroup
 			procsPath := filepath.Join(supervisorPath, "cgroup.procs")
 			if err := os.WriteFile(procsPath, []byte(strconv.Itoa(os.Getpid())), 0644); err == nil {
+				supervisorCgroupPath = supervisorPath
 				// Now enable controllers in the parent (which is now empty)
 				controlPath := filepath.Join(parentPath, "cgroup.subtree_control")
-				if err := os.WriteFile(controlPath, []byte("+cpu +memory +pids"), 0644); err == nil {
+				err := os.WriteFile(controlPath, []byte("+cpu +memory +pids"), 0644)
+				if errors.Is(err, syscall.EBUSY) && runtime != "" {
+					// Not empty: other processes of the container are there too
+					if err := adoptProcesses(parentPath, supervisorPath); err != nil {
+						logWarn("cannot move the %s container's other processes out of %s: %v", runtime, parentPath, err)
+					} else {
+						err = os.WriteFile(controlPath, []byte("+cpu +memory +pids"), 0644)
+					}
+				}
+				if err == nil {
 					// Success! Return the parent as the base for service cgroups
 					return parentPath, nil
 				}
@@ -187,13 +309,13 @@ func findWritableCgroupBase() (string, error) {
 		return path, nil
 	}
 
-	return "", fmt.Errorf("no writable cgroup location found - try running with: systemd-run --user --scope -p Delegate=yes ./gosv")
+	return "", fmt.Errorf("%w: no writable cgroup location found - %s", ErrCgroupUnavailable, cgroupHint(runtime))
 }
 
 // NewCgroup creates a new cgroup for a process
 func NewCgroup(name string) (*Cgroup, error) {
 	if baseCgroupPath == "" {
-		return nil, fmt.Errorf("cgroups not initialized - call EnsureControllers first")
+		return nil, fmt.Errorf("%w: not initialized - call EnsureControllers first", ErrCgroupUnavailable)
 	}
 
 	path := filepath.Join(baseCgroupPath, name)
@@ -262,6 +384,52 @@ func (c *Cgroup) SetPidsLimit(max int) error {
 	return os.WriteFile(pidsPath, []byte(strconv.Itoa(max)), 0644)
 }
 
+// SetHugeTLBMax limits the huge pages of one size (e.g. "2MB", "1GB")
+// the cgroup may use, in bytes
+func (c *Cgroup) SetHugeTLBMax(pageSize string, bytes int64) error {
+	if bytes <= 0 {
+		return nil
+	}
+
+	// KEY CONCEPT: hugetlb is accounted separately from memory
+	// Explicit huge pages (hugetlbfs, MAP_HUGETLB, SHM_HUGETLB) come from
+	// a pool reserved at boot or via /proc/sys/vm/nr_hugepages, not from
+	// regular memory, so memory.max doesn't limit them. Each page size has
+	// its own counter: hugetlb.<size>.max. Past it, allocations fail
+	// (mmap returns ENOMEM or the fault gets SIGBUS) - no OOM killer.
+	limitPath := filepath.Join(c.path, "hugetlb."+pageSize+".max")
+	return os.WriteFile(limitPath, []byte(strconv.FormatInt(bytes, 10)), 0644)
+}
+
+// SetCPUs confines the cgroup to cpus, a CPU list ("2-5,8")
+func (c *Cgroup) SetCPUs(cpus string) error {
+	// KEY CONCEPT: cpuset.cpus bounds the affinity
+	// Writing it moves the cgroup's processes onto those CPUs, and
+	// sched_setaffinity() inside the cgroup can only pick among them, so
+	// a service can't move itself onto the cores it was kept off
+	return os.WriteFile(filepath.Join(c.path, "cpuset.cpus"), []byte(cpus), 0644)
+}
+
+// SetMems confines the cgroup's memory to the NUMA nodes mems, a list
+// like cpuset.cpus ("0", "0-1")
+func (c *Cgroup) SetMems(mems string) error {
+	return os.WriteFile(filepath.Join(c.path, "cpuset.mems"), []byte(mems), 0644)
+}
+
+// parseHugePageSize parses a hugetlb page size as the kernel names it
+// ("64KB", "2MB", "1GB") and returns it in bytes
+func parseHugePageSize(size string) (int64, error) {
+	units := map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30}
+	if len(size) > 2 {
+		if unit, ok := units[size[len(size)-2:]]; ok {
+			if n, err := strconv.ParseInt(size[:len(size)-2], 10, 64); err == nil && n > 0 {
+				return n * unit, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("invalid huge page size %q (want e.g. 2MB or 1GB)", size)
+}
+
 // GetMemoryUsage returns current memory usage in bytes
 func (c *Cgroup) GetMemoryUsage() (int64, error) {
 	data, err := os.ReadFile(filepath.Join(c.path, "memory.current"))
@@ -271,11 +439,29 @@ func (c *Cgroup) GetMemoryUsage() (int64, error) {
 	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
 }
 
+// Stats returns the cgroup's memory, CPU and pids counters as text.
+// They survive the processes, so they're still there after a crash.
+func (c *Cgroup) Stats() string {
+	var sb strings.Builder
+	for _, name := range []string{"memory.current", "memory.peak", "memory.max",
+		"memory.events", "cpu.stat", "pids.current", "pids.max"} {
+		data, err := os.ReadFile(filepath.Join(c.path, name))
+		if err != nil {
+			continue
+		}
+		sb.WriteString("== " + name + "\n")
+		sb.Write(data)
+	}
+	return sb.String()
+}
+
 // Destroy removes the cgroup
 func (c *Cgroup) Destroy() error {
 	// KEY CONCEPT: Can only remove empty cgroups
 	// All processes must exit or move to another cgroup first
-	// rmdir on the cgroup directory removes it
+	// rmdir on the cgroup directory removes it, after any cgroups a
+	// delegated service created below it
+	c.removeChildren()
 	return os.Remove(c.path)
 }
 
@@ -298,10 +484,22 @@ func EnsureControllers() error {
 	// Enable controllers for our child cgroups
 	if err := os.WriteFile(controlPath, []byte(content), 0644); err != nil {
 		// Not fatal - controllers might already be enabled or not available
-		fmt.Printf("[gosv] note: could not enable all controllers: %v\n", err)
+		// (readControllers says which)
+		logDebug("could not enable all controllers: %v", err)
+	}
+
+	// hugetlb is optional: only services with hugetlb limits need it, and
+	// not every kernel (or parent cgroup) has it
+	if err := os.WriteFile(controlPath, []byte("+hugetlb"), 0644); err != nil {
+		logDebug("hugetlb controller not enabled: %v", err)
+	}
+	// So is cpuset, for services pinned with cpus
+	if err := os.WriteFile(controlPath, []byte("+cpuset"), 0644); err != nil {
+		logDebug("cpuset controller not enabled: %v", err)
 	}
+	readControllers(baseCgroupPath)
 
-	fmt.Printf("[gosv] using cgroup path: %s\n", baseCgroupPath)
+	logInfo("using cgroup path: %s", baseCgroupPath)
 	return nil
 }
 
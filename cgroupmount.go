@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cgroupMount is what is mounted on cgroupRoot, from /proc/self/mountinfo
+type cgroupMount struct {
+	root     string // the cgroup shown at cgroupRoot: "/" for a whole tree
+	readOnly bool
+}
+
+// readCgroupMount finds the cgroup2 mount on cgroupRoot
+func readCgroupMount() (*cgroupMount, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	var m *cgroupMount
+	fstype := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		// "36 25 0:31 / /sys/fs/cgroup rw,nosuid shared:9 - cgroup2 cgroup2 rw,nsdelegate"
+		pre, post, ok := strings.Cut(line, " - ")
+		fields, super := strings.Fields(pre), strings.Fields(post)
+		if !ok || len(fields) < 6 || len(super) < 3 || fields[4] != cgroupRoot {
+			continue
+		}
+		// Of several mounts on the same point, the last one is visible
+		fstype = super[0]
+		m = &cgroupMount{
+			root:     fields[3],
+			readOnly: hasMountOption(fields[5], "ro") || hasMountOption(super[2], "ro"),
+		}
+	}
+	if m == nil {
+		return nil, fmt.Errorf("nothing is mounted on %s", cgroupRoot)
+	}
+	if fstype != "cgroup2" {
+		return nil, fmt.Errorf("%s is %s, not cgroup2 (a cgroup v1 or hybrid hierarchy)", cgroupRoot, fstype)
+	}
+	return m, nil
+}
+
+func hasMountOption(options, option string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// selfCgroupDir returns the directory of gosv's own cgroup below
+// cgroupRoot
+//
+// KEY CONCEPT: Where "my cgroup" is
+// /proc/self/cgroup names our cgroup from the root of our cgroup
+// namespace; cgroupRoot shows the tree from whichever cgroup was mounted
+// there. On a host both are the real root, and "0::/user.slice/x" is
+// /sys/fs/cgroup/user.slice/x. In a container they often differ:
+//   - With a cgroup namespace of its own (Docker's and Podman's default
+//     on cgroup v2), the container's cgroup is the root of both: "0::/"
+//     is /sys/fs/cgroup itself.
+//   - With the host's namespace (--cgroupns=host, older Kubernetes),
+//     /proc/self/cgroup has the full "/kubepods/pod.../<id>", but the
+//     runtime mounted only that cgroup on /sys/fs/cgroup. mountinfo's
+//     root field names it, and our directory is what is left below it.
+//   - A mount from outside the namespace shows a root of "/..": the tree
+//     on /sys/fs/cgroup isn't one we can locate ourselves in.
+func selfCgroupDir(m *cgroupMount) (string, error) {
+	self, err := getSelfCgroup()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(m.root, "/..") {
+		return "", fmt.Errorf("the cgroup mounted on %s is outside our cgroup namespace", cgroupRoot)
+	}
+	rel, err := filepath.Rel(m.root, self)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("our cgroup %s is not below the cgroup %s mounted on %s", self, m.root, cgroupRoot)
+	}
+	return filepath.Join(cgroupRoot, rel), nil
+}
+
+// containerRuntime names the container runtime gosv runs under, or ""
+// on a host. Runtimes leave a marker file, or set $container for the
+// container's init.
+func containerRuntime() string {
+	if name := os.Getenv("container"); name != "" {
+		return name
+	}
+	if _, err := os.Stat("/run/.containerenv"); err == nil {
+		return "podman"
+	}
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return "docker"
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return "kubernetes"
+	}
+	return ""
+}
+
+// cgroupHint says how to give gosv a cgroup it can manage
+func cgroupHint(runtime string) string {
+	switch runtime {
+	case "":
+		return "try running with: systemd-run --user --scope -p Delegate=yes ./gosv"
+	case "kubernetes":
+		return "in Kubernetes, run gosv in a privileged container on a cgroup v2 node"
+	default:
+		return fmt.Sprintf("run the %s container with its own cgroup namespace and a writable %s (--cgroupns=private --privileged)", runtime, cgroupRoot)
+	}
+}
+
+// adoptProcesses moves every process left in the cgroup at dir into the
+// cgroup at leaf
+//
+// In a container gosv is usually its init: whatever else is in the
+// container's cgroup (processes of the entrypoint script, docker exec
+// sessions) belongs with gosv, and keeps the cgroup from enabling
+// controllers for its children until it moves.
+func adoptProcesses(dir, leaf string) error {
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	for _, pid := range strings.Fields(string(data)) {
+		if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0644); err != nil {
+			return fmt.Errorf("move pid %s: %w", pid, err)
+		}
+	}
+	return nil
+}
+
+// enabledControllers are the controllers EnsureControllers got enabled
+// for service cgroups (nil until it ran)
+var enabledControllers map[string]bool
+
+// controllerLimits says what goes missing without a controller
+var controllerLimits = map[string]string{
+	"cpu":    "cpu_percent is not enforced",
+	"memory": "memory_mb is not enforced and memory use is not reported",
+	"pids":   "the supervisor's pids_max is not enforced",
+}
+
+// readControllers records which controllers service cgroups get, and
+// warns about each one that is missing
+func readControllers(base string) {
+	data, err := os.ReadFile(filepath.Join(base, "cgroup.subtree_control"))
+	if err != nil {
+		logDebug("cannot read enabled controllers: %v", err)
+		return
+	}
+	enabledControllers = make(map[string]bool)
+	for _, c := range strings.Fields(string(data)) {
+		enabledControllers[c] = true
+	}
+	for _, c := range []string{"cpu", "memory", "pids"} {
+		if !enabledControllers[c] {
+			logWarn("no %s controller for service cgroups in %s: %s", c, base, controllerLimits[c])
+		}
+	}
+}
+
+// controllerMissing reports whether the service cgroups lack controller
+func controllerMissing(controller string) bool {
+	return enabledControllers != nil && !enabledControllers[controller]
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the supervisor's source of time. Restart backoff, the
+// StableAfter check, shutdown/drain deadlines, leak sampling and
+// maintenance windows all go through it, so time can be simulated with a
+// ManualClock instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Ticker is the subset of *time.Ticker we use
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer is the subset of *time.Timer we use
+type Timer interface {
+	Stop() bool
+}
+
+// realClock is the default Clock backed by package time
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+type realTicker struct{ t *time.Ticker }
+
+func (r realTicker) C() <-chan time.Time { return r.t.C }
+func (r realTicker) Stop()               { r.t.Stop() }
+
+// ManualClock is a Clock that only moves when Advance is called.
+// Channels and callbacks due at or before the new time fire in order.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	waiter []*manualWaiter
+}
+
+type manualWaiter struct {
+	at     time.Time
+	period time.Duration // > 0 for tickers
+	ch     chan time.Time
+	fn     func()
+	clock  *ManualClock
+}
+
+// NewManualClock returns a ManualClock set to start
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	w := &manualWaiter{ch: make(chan time.Time, 1), clock: c}
+	c.add(w, d)
+	return w.ch
+}
+
+// NewTicker panics if d is not positive, like time.NewTicker: a ticker
+// that never moves on would keep Advance firing it forever
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for ManualClock.NewTicker")
+	}
+	w := &manualWaiter{ch: make(chan time.Time, 1), period: d, clock: c}
+	c.add(w, d)
+	return manualTicker{w}
+}
+
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	w := &manualWaiter{fn: f, clock: c}
+	c.add(w, d)
+	return w
+}
+
+func (c *ManualClock) add(w *manualWaiter, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.at = c.now.Add(d)
+	c.waiter = append(c.waiter, w)
+}
+
+// Advance moves the clock forward by d, firing everything that comes due.
+// Advance(0) fires what is due now; time can't go backwards, so a negative
+// d panics.
+func (c *ManualClock) Advance(d time.Duration) {
+	if d < 0 {
+		panic("negative duration for ManualClock.Advance")
+	}
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.Slice(c.waiter, func(i, j int) bool { return c.waiter[i].at.Before(c.waiter[j].at) })
+		if len(c.waiter) == 0 || c.waiter[0].at.After(end) {
+			break
+		}
+
+		w := c.waiter[0]
+		c.now = w.at
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			c.waiter = c.waiter[1:]
+		}
+
+		// Fire without the lock: callbacks may use the clock
+		c.mu.Unlock()
+		if w.fn != nil {
+			w.fn()
+		} else {
+			select {
+			case w.ch <- c.Now():
+			default: // Like time.Ticker, drop ticks nobody read
+			}
+		}
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// Stop cancels a pending After/AfterFunc (manualWaiter is the Timer)
+func (w *manualWaiter) Stop() bool {
+	c := w.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.waiter {
+		if other == w {
+			c.waiter = append(c.waiter[:i], c.waiter[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type manualTicker struct{ w *manualWaiter }
+
+func (t manualTicker) C() <-chan time.Time { return t.w.ch }
+func (t manualTicker) Stop()               { t.w.Stop() }
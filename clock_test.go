@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var testEpoch = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestManualClockFiresInOrder(t *testing.T) {
+	c := NewManualClock(testEpoch)
+	var fired []string
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, "b") })
+	c.AfterFunc(time.Second, func() { fired = append(fired, "a") })
+	late := c.AfterFunc(3*time.Second, func() { fired = append(fired, "c") })
+
+	c.Advance(2 * time.Second)
+	if len(fired) != 2 || fired[0] != "a" || fired[1] != "b" {
+		t.Fatalf("fired %v after 2s, want [a b]", fired)
+	}
+	if !late.Stop() {
+		t.Fatal("Stop of a pending timer reported false")
+	}
+	c.Advance(time.Hour)
+	if len(fired) != 2 {
+		t.Fatalf("a stopped timer fired: %v", fired)
+	}
+	if got := c.Now(); !got.Equal(testEpoch.Add(time.Hour + 2*time.Second)) {
+		t.Fatalf("Now() = %v", got)
+	}
+}
+
+func TestManualClockTicker(t *testing.T) {
+	c := NewManualClock(testEpoch)
+	tk := c.NewTicker(time.Second)
+	defer tk.Stop()
+
+	c.Advance(500 * time.Millisecond)
+	select {
+	case <-tk.C():
+		t.Fatal("ticked before its period")
+	default:
+	}
+	c.Advance(500 * time.Millisecond)
+	select {
+	case at := <-tk.C():
+		if !at.Equal(testEpoch.Add(time.Second)) {
+			t.Fatalf("tick at %v", at)
+		}
+	default:
+		t.Fatal("no tick after its period")
+	}
+}
+
+func TestManualClockAdvanceZero(t *testing.T) {
+	c := NewManualClock(testEpoch)
+	ch := c.After(0)
+	c.Advance(0)
+	select {
+	case <-ch:
+	default:
+		t.Fatal("After(0) didn't fire on Advance(0)")
+	}
+}
+
+func TestManualClockRejectsBadDurations(t *testing.T) {
+	c := NewManualClock(testEpoch)
+	for name, f := range map[string]func(){
+		"NewTicker(0)":  func() { c.NewTicker(0) },
+		"NewTicker(-1)": func() { c.NewTicker(-time.Second) },
+		"Advance(-1)":   func() { c.Advance(-time.Second) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s didn't panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
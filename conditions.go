@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Conditions are checked before every start of a service. If one isn't
+// met the service is skipped, not failed.
+//
+// KEY CONCEPT: Conditions vs failures
+// A service that can't work on this host - its config file isn't
+// deployed, the GPU tool isn't installed, there's no network yet - fails
+// the same way every time. Starting it anyway means a crash loop, a
+// "restarts exhausted" alert and a diagnostics bundle, all for something
+// expected. systemd's ConditionPathExists= and friends check first and
+// skip the unit quietly; an explicit `gosv ctl start` checks again.
+type Conditions struct {
+	PathExists    []string         `json:"path_exists"`      // "!/path" must not exist
+	EnvSet        []string         `json:"env_set"`          // Non-empty in gosv's environment
+	Executable    []string         `json:"executable"`       // Found in $PATH (or an absolute path)
+	MinFreeDiskMB map[string]int64 `json:"min_free_disk_mb"` // Path -> MB free for unprivileged users
+	NetworkRoute  []string         `json:"network_route"`    // "default", or an IPv4 address that has a route
+}
+
+// validate checks the conditions from the config
+func (c *Conditions) validate() error {
+	for path, mb := range c.MinFreeDiskMB {
+		if mb <= 0 {
+			return fmt.Errorf("min_free_disk_mb: %s: must be positive", path)
+		}
+	}
+	for _, r := range c.NetworkRoute {
+		if r != "default" && net.ParseIP(r).To4() == nil {
+			return fmt.Errorf("network_route: %q is neither \"default\" nor an IPv4 address", r)
+		}
+	}
+	return nil
+}
+
+// check returns why the first unmet condition isn't met, or ""
+func (c *Conditions) check() string {
+	for _, path := range c.PathExists {
+		negate := strings.HasPrefix(path, "!")
+		path = strings.TrimPrefix(path, "!")
+		_, err := os.Stat(path)
+		if !negate && err != nil {
+			return fmt.Sprintf("%s does not exist", path)
+		}
+		if negate && err == nil {
+			return fmt.Sprintf("%s exists", path)
+		}
+	}
+	for _, name := range c.EnvSet {
+		if os.Getenv(name) == "" {
+			return fmt.Sprintf("$%s is not set", name)
+		}
+	}
+	for _, name := range c.Executable {
+		if _, err := exec.LookPath(name); err != nil {
+			return fmt.Sprintf("%s is not installed", name)
+		}
+	}
+	for path, mb := range c.MinFreeDiskMB {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(path, &st); err != nil {
+			return fmt.Sprintf("free space on %s: %v", path, err)
+		}
+		free := int64(st.Bavail) * int64(st.Bsize) / (1024 * 1024)
+		if free < mb {
+			return fmt.Sprintf("%d MB free on %s, need %d", free, path, mb)
+		}
+	}
+	for _, r := range c.NetworkRoute {
+		if !hasRoute(r) {
+			return fmt.Sprintf("no route to %s", r)
+		}
+	}
+	return ""
+}
+
+// hasRoute reports whether the main routing table has a usable route to
+// ip, or a default route for "default". IPv6 default routes count too.
+func hasRoute(target string) bool {
+	if target == "default" && hasIPv6Default() {
+		return true
+	}
+	ip := net.ParseIP(target).To4()
+
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Header
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...,
+		// addresses in hex, in host (little-endian) byte order
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		flags, _ := strconv.ParseUint(fields[3], 16, 32)
+		if flags&0x1 == 0 { // RTF_UP
+			continue
+		}
+		dest, mask := routeAddr(fields[1]), routeAddr(fields[7])
+		if dest == nil || mask == nil {
+			continue
+		}
+		if target == "default" {
+			if net.IP(mask).Equal(net.IPv4zero.To4()) {
+				return true
+			}
+			continue
+		}
+		if ip.Mask(net.IPMask(mask)).Equal(dest) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeAddr decodes an address column of /proc/net/route
+func routeAddr(s string) net.IP {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+	return ip
+}
+
+// hasIPv6Default reports whether there is an IPv6 default route
+func hasIPv6Default() bool {
+	f, err := os.Open("/proc/net/ipv6_route")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// dest destlen src srclen nexthop metric refcnt use flags iface
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 10 && fields[0] == strings.Repeat("0", 32) && fields[1] == "00" &&
+			fields[9] != "lo" {
+			return true
+		}
+	}
+	return false
+}
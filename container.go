@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// ContainerSpawner runs an OCI bundle with an OCI runtime (runc, crun)
+//
+// KEY CONCEPT: OCI runtime bundles
+// A bundle is a directory with a config.json (process, mounts, namespaces,
+// cgroup resources) and a root filesystem. `runc run <id>` in the
+// foreground creates the container and stays around as its parent: it
+// passes stdio through, forwards the signals it receives to the
+// container's init, and exits with the container's exit code. To gosv it
+// looks like any other child process.
+//
+// To put the container under gosv's limits we don't hand the runtime the
+// user's bundle directly. Instead we write a derived config.json that
+// points back at the original rootfs and sets linux.cgroupsPath to the
+// service's cgroup, with memory/CPU limits in linux.resources.
+type ContainerSpawner struct {
+	Runtime string // "runc" (default) or "crun", or a path
+	Bundle  string // Directory containing config.json
+}
+
+// containerID is the runtime's name for the service's container
+func containerID(p *Process) string {
+	return "gosv-" + p.Name
+}
+
+func (c ContainerSpawner) Command(p *Process) (*exec.Cmd, error) {
+	runtime := c.Runtime
+	if runtime == "" {
+		runtime = "runc"
+	}
+	runtimePath, err := exec.LookPath(runtime)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, err := c.deriveBundle(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// A container left over from a crash (or from a previous gosv) would
+	// make `run` fail with "container already exists". Usually there is
+	// none, and delete fails.
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	if out, err := p.pids.run(ctx, "", runtimePath, "delete", "--force", containerID(p)); err != nil {
+		logDebug("%s: %s delete: %v: %s", p.Name, runtime, err, bytes.TrimSpace(out))
+	}
+
+	return exec.Command(runtimePath, "run", "--bundle", bundle, containerID(p)), nil
+}
+
+// deriveBundle writes a copy of the bundle's config.json wired to gosv's
+// cgroup and limits, and returns the directory containing it
+func (c ContainerSpawner) deriveBundle(p *Process) (string, error) {
+	src, err := filepath.Abs(c.Bundle)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Join(src, "config.json"))
+	if err != nil {
+		return "", err
+	}
+
+	// Edit as a generic map so fields we don't know about survive
+	var spec map[string]any
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return "", fmt.Errorf("parse %s/config.json: %w", src, err)
+	}
+
+	// root.path is relative to the bundle - make it absolute
+	root, _ := spec["root"].(map[string]any)
+	if root == nil {
+		return "", fmt.Errorf("%s/config.json has no root", src)
+	}
+	if rootPath, _ := root["path"].(string); !filepath.IsAbs(rootPath) {
+		root["path"] = filepath.Join(src, rootPath)
+	}
+
+	// Output must be plain stdio: a terminal would require a console socket
+	if process, _ := spec["process"].(map[string]any); process != nil {
+		process["terminal"] = false
+	}
+
+	linux, _ := spec["linux"].(map[string]any)
+	if linux == nil {
+		linux = map[string]any{}
+		spec["linux"] = linux
+	}
+	if baseCgroupPath != "" {
+		// cgroupsPath is relative to the cgroup root. Members of a pool go
+		// below its cgroup, like native services, to count against it.
+		rel, err := filepath.Rel(cgroupRoot, filepath.Join(baseCgroupPath, p.cgroupName()))
+		if err == nil {
+			linux["cgroupsPath"] = "/" + rel
+		}
+	}
+	resources, _ := linux["resources"].(map[string]any)
+	if resources == nil {
+		resources = map[string]any{}
+		linux["resources"] = resources
+	}
+	if p.MemoryLimit > 0 {
+		resources["memory"] = map[string]any{"limit": p.MemoryLimit}
+	}
+	if p.CPUQuota > 0 {
+		period := 100000
+		resources["cpu"] = map[string]any{"quota": p.CPUQuota * period / 100, "period": period}
+	}
+
+	dir := filepath.Join(os.TempDir(), "gosv-bundles", p.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	out, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), out, 0600); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Kill stops the container if it outlived the runtime process (SIGKILL
+// can't be forwarded, so killing `runc run` leaves the container running)
+func (c ContainerSpawner) Kill(p *Process) {
+	runtime := c.Runtime
+	if runtime == "" {
+		runtime = "runc"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	if out, err := p.pids.run(ctx, "", runtime, "delete", "--force", containerID(p)); err != nil {
+		logWarn("%s: %s delete --force %s: %v: %s", p.Name, runtime, containerID(p), err, bytes.TrimSpace(out))
+	}
+}
+
+// EngineSpawner supervises an existing podman or docker container
+//
+// `<engine> start --attach NAME` starts the container, streams its
+// stdout/stderr, proxies the signals it receives (--sig-proxy defaults to
+// on when attached), and exits with the container's exit code once the
+// container stops - i.e. the engine's wait API, wrapped in a child process
+// gosv can supervise like any other.
+type EngineSpawner struct {
+	Engine    string // "podman" or "docker"
+	Container string // Name or ID of an existing container
+}
+
+func (e EngineSpawner) Command(p *Process) (*exec.Cmd, error) {
+	enginePath, err := exec.LookPath(e.Engine)
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(enginePath, "start", "--attach", e.Container), nil
+}
+
+// Kill stops the container when its attached client had to be SIGKILLed
+func (e EngineSpawner) Kill(p *Process) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	if out, err := p.pids.run(ctx, "", e.Engine, "kill", e.Container); err != nil {
+		logWarn("%s: %s kill %s: %v: %s", p.Name, e.Engine, e.Container, err, bytes.TrimSpace(out))
+	}
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// ctlRequest is a command sent to the control socket, one JSON line
+type ctlRequest struct {
+	Command  string   `json:"command"`
+	Args     []string `json:"args"`
+	Selector string   `json:"selector,omitempty"` // Also act on services matching this
+
+	// For logs
+	Follow bool   `json:"follow,omitempty"`
+	Lines  int    `json:"lines,omitempty"`
+	Grep   string `json:"grep,omitempty"`
+
+	// For events: RFC 3339 times and event kinds
+	Since string   `json:"since,omitempty"`
+	Until string   `json:"until,omitempty"`
+	Kinds []string `json:"kinds,omitempty"`
+
+	// For restore
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+	DryRun   bool      `json:"dry_run,omitempty"`
+
+	// For set-limit: bytes and percent, 0 for none, nil to keep
+	Memory *int64 `json:"memory,omitempty"`
+	CPU    *int   `json:"cpu,omitempty"`
+
+	// For run: the job, a service config, and its pool
+	Job  json.RawMessage `json:"job,omitempty"`
+	Pool string          `json:"pool,omitempty"`
+
+	// For restart: one service at a time (see RollingRestart)
+	Rolling bool `json:"rolling,omitempty"`
+
+	// For status: the states as data, not a table (see gosv graph)
+	JSON bool `json:"json,omitempty"`
+
+	// For deploy: the new command (nil to show the current one)
+	Deploy *deployRequest `json:"deploy,omitempty"`
+
+	// For rollback: the revision (0 for the one before the running one),
+	// and its config once read from the store (see revisions.go)
+	Revision int             `json:"revision,omitempty"`
+	Service  json.RawMessage `json:"service,omitempty"`
+}
+
+// ctlReply is the answer to a ctlRequest, one JSON line
+type ctlReply struct {
+	Output string      `json:"output,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Target *execTarget `json:"target,omitempty"` // For exec
+
+	// For logs: the services whose lines follow the reply
+	Services []string `json:"services,omitempty"`
+
+	// For events
+	Events []Event `json:"events,omitempty"`
+
+	// For snapshot
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+
+	// For status with JSON set: all services, as the status page has them
+	Status *statusReport `json:"status,omitempty"`
+
+	// For deploy: set on the last reply, after the progress lines
+	Done bool `json:"done,omitempty"`
+}
+
+// ctlCall is a request waiting for the main loop to handle it
+type ctlCall struct {
+	req   ctlRequest
+	reply chan ctlReply
+}
+
+// ctlSocketPath returns where a gosv with this pidfile listens for
+// `gosv ctl`
+func ctlSocketPath(pidfile string) string {
+	return strings.TrimSuffix(pidfile, ".pid") + ".sock"
+}
+
+// listenControl opens the control socket at s.ControlSocket
+//
+// KEY CONCEPT: Unix domain control sockets
+// Signals carry no arguments: SIGHUP can mean "reload", but not "restart
+// the batch workers". A Unix socket is the usual next step (docker.sock,
+// supervisord's supervisor.sock): a file in the filesystem that clients
+// connect to like a TCP port, with access controlled by the file's mode.
+// The socket is 0600, so only gosv's own user (root, typically) can send
+// commands. A leftover socket file from a crashed gosv refuses
+// connections, which is how a stale one is told from a live one.
+func (s *Supervisor) listenControl() error {
+	path := s.ControlSocket
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %s: another gosv is listening", path)
+	}
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Create it with no access for others before anyone can connect
+	old := syscall.Umask(0077)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	if err != nil {
+		return fmt.Errorf("control socket: %w", err)
+	}
+	s.ctl = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return // Closed at shutdown
+			}
+			go s.serveControl(conn)
+		}
+	}()
+	return nil
+}
+
+// closeControl stops accepting commands and removes the socket
+func (s *Supervisor) closeControl() {
+	if s.ctl != nil {
+		s.ctl.Close() // Also removes the socket file
+		s.ctl = nil
+	}
+}
+
+// serveControl reads one request from conn, has the main loop handle it
+// and writes the reply
+func (s *Supervisor) serveControl(conn net.Conn) {
+	defer conn.Close()
+	var req ctlRequest
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(ctlReply{Error: "bad request: " + err.Error()})
+		return
+	}
+	// These only read, and may take a while: not in the main loop
+	switch req.Command {
+	case "logs":
+		s.serveLogs(conn, req)
+		return
+	case "events":
+		events, err := s.ctlEvents(req)
+		if err != nil {
+			json.NewEncoder(conn).Encode(ctlReply{Error: err.Error()})
+		} else {
+			json.NewEncoder(conn).Encode(ctlReply{Events: events})
+		}
+		return
+	case "run":
+		s.serveJob(conn, req)
+		return
+	case "deploy":
+		s.serveDeploy(conn, req)
+		return
+	case "restart":
+		if req.Rolling {
+			s.serveRollingRestart(conn, req)
+			return
+		}
+	case "revisions", "rollback":
+		s.serveRevisions(conn, req)
+		return
+	case "attach":
+		// The operator's input follows the request
+		s.serveAttach(conn, io.MultiReader(dec.Buffered(), conn), req)
+		return
+	}
+	json.NewEncoder(conn).Encode(s.callMain(req))
+}
+
+// callMain has the main loop handle req and returns its reply
+func (s *Supervisor) callMain(req ctlRequest) ctlReply {
+	call := ctlCall{req: req, reply: make(chan ctlReply, 1)}
+	select {
+	case s.ctlCh <- call:
+	case <-s.stopped:
+		return ctlReply{Error: "gosv is shutting down"}
+	}
+	select {
+	case reply := <-call.reply:
+		return reply
+	case <-s.stopped:
+		return ctlReply{Error: "gosv is shutting down"}
+	}
+}
+
+// handleControl runs a control command in the main loop
+func (s *Supervisor) handleControl(req ctlRequest) ctlReply {
+	if req.Selector != "" {
+		names, err := s.Select(req.Selector)
+		if err != nil {
+			return ctlReply{Error: err.Error()}
+		}
+		if len(names) == 0 {
+			return ctlReply{Error: fmt.Sprintf("no service matches %q", req.Selector)}
+		}
+		req.Args = append(req.Args, names...)
+	}
+
+	var err error
+	switch req.Command {
+	case "status":
+		if req.JSON {
+			report := s.statusReport(StatusPageConfig{Fields: statusFields})
+			return ctlReply{Status: &report}
+		}
+		return ctlReply{Output: s.statusTable(req.Args)}
+	case "metrics":
+		return ctlReply{Output: s.metricsText()}
+	case "pools":
+		return ctlReply{Output: s.poolsTable()}
+	case "placement":
+		return ctlReply{Output: s.placementTable()}
+	case "reload":
+		// Applied by the main loop once read, as for SIGHUP
+		go s.reloadConfig()
+	case "drain":
+		// As for SIGTSTP: the main loop drains the services, then shuts
+		// down, once it has replied
+		select {
+		case s.sigChan <- syscall.SIGTSTP:
+		default:
+			return ctlReply{Error: "drain: too many signals pending, try again"}
+		}
+		return ctlReply{Output: "draining, then shutting down\n"}
+	case "rollback":
+		// From serveRevisions, with the revision read
+		if len(req.Args) != 1 || req.Service == nil {
+			return ctlReply{Error: "rollback: no revision given"}
+		}
+		err = s.restoreRevision(req.Args[0], req.Revision, req.Service)
+	case "run":
+		p, err := s.addJob(req.Job, req.Pool)
+		if err != nil {
+			return ctlReply{Error: err.Error()}
+		}
+		return ctlReply{Services: []string{p.Name}}
+	case "snapshot":
+		snap := s.Snapshot()
+		return ctlReply{Snapshot: &snap}
+	case "restore":
+		if req.Snapshot == nil {
+			return ctlReply{Error: "restore: no snapshot given"}
+		}
+		changes, err := s.Restore(*req.Snapshot, req.DryRun)
+		reply := ctlReply{Output: restoreOutput(req.Snapshot, changes, req.DryRun)}
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		return reply
+	case "start", "stop", "restart", "cancel":
+		if len(req.Args) == 0 {
+			return ctlReply{Error: req.Command + ": no service given"}
+		}
+		op := map[string]func(string) error{"start": s.Start, "stop": s.Stop, "restart": s.Restart,
+			"cancel": s.CancelRestart}[req.Command]
+		for _, target := range req.Args {
+			if err = op(target); err != nil {
+				break
+			}
+		}
+	case "set-limit":
+		if len(req.Args) == 0 {
+			return ctlReply{Error: "set-limit: no service given"}
+		}
+		var out strings.Builder
+		for _, target := range req.Args {
+			var lines string
+			if lines, err = s.SetLimits(target, req.Memory, req.CPU); err != nil {
+				break
+			}
+			out.WriteString(lines)
+		}
+		if err != nil {
+			return ctlReply{Output: out.String(), Error: err.Error()}
+		}
+		return ctlReply{Output: out.String()}
+	case "exec":
+		if len(req.Args) != 1 {
+			return ctlReply{Error: "exec: usage: exec <service> -- <command> [args]"}
+		}
+		target, err := s.execTarget(req.Args[0])
+		if err != nil {
+			return ctlReply{Error: err.Error()}
+		}
+		return ctlReply{Target: target}
+	case "signal":
+		if len(req.Args) < 2 {
+			return ctlReply{Error: "signal: usage: signal <signal> <service|@group>..."}
+		}
+		sig, perr := parseSignal(req.Args[0])
+		if perr != nil {
+			return ctlReply{Error: perr.Error()}
+		}
+		for _, target := range req.Args[1:] {
+			if err = s.SignalService(target, sig); err != nil {
+				break
+			}
+		}
+	default:
+		return ctlReply{Error: fmt.Sprintf("unknown command %q", req.Command)}
+	}
+	if err != nil {
+		return ctlReply{Error: err.Error()}
+	}
+	return ctlReply{}
+}
+
+// statusTable lists the target services (all if none), like:
+//
+//	NAME     STATE    PID   UPTIME  RESTARTS  GROUPS  LABELS
+//	worker   running  4242  3m12s   0         batch   tier=jobs
+func (s *Supervisor) statusTable(targets []string) string {
+	var procs []*Process
+	if len(targets) == 0 {
+		targets = []string{"*"}
+	}
+	for _, t := range targets {
+		if t == "*" {
+			s.mu.RLock()
+			for _, p := range s.processes {
+				procs = append(procs, p)
+			}
+			s.mu.RUnlock()
+			continue
+		}
+		found, err := s.resolve(t)
+		if err != nil {
+			return err.Error() + "\n"
+		}
+		procs = append(procs, found...)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Name < procs[j].Name })
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	s.mu.RLock()
+	throttle, network := s.throttle, s.networkAccounting
+	s.mu.RUnlock()
+	if network {
+		fmt.Fprintln(w, "NAME\tSTATE\tPID\tUPTIME\tRESTARTS\tNETWORK\tGROUPS\tLABELS")
+	} else {
+		fmt.Fprintln(w, "NAME\tSTATE\tPID\tUPTIME\tRESTARTS\tGROUPS\tLABELS")
+	}
+	now := s.clock.Now()
+	for _, p := range procs {
+		p.mu.Lock()
+		pid, uptime := "-", "-"
+		if p.state == StateRunning {
+			if p.pid != 0 {
+				pid = fmt.Sprint(p.pid)
+			}
+			uptime = now.Sub(p.startTime).Round(time.Second).String()
+		}
+		state := p.statusState(now, throttle)
+		groups, labels := strings.Join(p.Groups, ","), formatLabels(p.Labels)
+		if groups == "" {
+			groups = "-"
+		}
+		if labels == "" {
+			labels = "-"
+		}
+		if network {
+			net := "-"
+			if p.net != nil {
+				net = p.net.String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", p.Name, state, pid, uptime, p.restarts, net, groups, labels)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", p.Name, state, pid, uptime, p.restarts, groups, labels)
+		}
+		p.mu.Unlock()
+	}
+	w.Flush()
+	return b.String()
+}
+
+// healthy reports whether p is up, or down on purpose: not crashing,
+// failed, given up, failing readiness, evicted or frozen. Caller must
+// hold p.mu.
+func (p *Process) healthy() bool {
+	return !p.exhausted && p.state != StateFailed && p.restartAt.IsZero() && !p.failingReadiness() &&
+		!p.evicted && !p.frozen
+}
+
+// statusState describes the state of p for ctl status and the status
+// page: its state, and why it's in it when that's not plain. Caller must
+// hold p.mu.
+func (p *Process) statusState(now time.Time, throttle *restartThrottle) string {
+	state := p.state.String()
+	if p.daemonizing {
+		state += " (daemonizing)"
+	} else if p.adopted && p.state == StateRunning {
+		state += " (adopted)"
+	} else if p.manualStop {
+		state += " (on request)"
+	} else if p.frozen {
+		state = "frozen (memory pressure)"
+	} else if p.evicted {
+		state += " (evicted)"
+	} else if p.boundDown {
+		state += " (bound)"
+	} else if !p.restartAt.IsZero() {
+		state = fmt.Sprintf("restarting in %v", p.restartAt.Sub(now).Round(time.Second))
+	} else if !p.delayedUntil.IsZero() {
+		state = fmt.Sprintf("delayed (%v)", p.delayedUntil.Sub(now).Round(time.Second))
+	} else if p.waitingFor != "" {
+		state = "waiting for " + p.waitingFor
+	} else if p.state == StateSkipped {
+		state += " (" + p.skipReason + ")"
+	} else if p.exhausted {
+		state += " (gave up)"
+	} else if pos := 0; p.job != nil && p.job.pool != nil && p.state == StateStopped {
+		if pos = p.job.pool.position(p); pos > 0 {
+			state = fmt.Sprintf("queued in %s (%d)", p.job.pool.name, pos)
+		}
+	} else if throttle != nil && p.state == StateStarting {
+		if pos = throttle.position(p); pos > 0 {
+			state = fmt.Sprintf("queued (%d)", pos)
+		}
+	}
+	if p.failingReadiness() {
+		state += " (failing readiness)"
+	}
+	return state
+}
+
+// ctlMain implements `gosv ctl`: it sends one command to a running gosv
+func ctlMain(args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	configPath := fs.String("config", "", "Config of the gosv to control")
+	pidfilePath := fs.String("pidfile", "", "Pidfile of the gosv to control (default: from --config)")
+	socket := fs.String("socket", "", "Control socket (default: next to the pidfile)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: gosv ctl [--config <file>] <command> [args]
+
+Commands:
+  status [service|@group]...     Show services
+  start <service|@group>...      Start services that are down
+  stop <service|@group>...       Stop services and keep them down
+  restart [--rolling] <service|@group>...
+                                 Restart services; --rolling one at a
+                                 time, each once the one before is ready
+  cancel <service|@group>...     Cancel scheduled restarts, keep services down
+  reload                         Reload the config, as SIGHUP does
+  drain                          Drain the services, then shut down, as
+                                 SIGTSTP does
+  signal <signal> <service|@group>...
+  attach <service>               Connect the terminal to a service with
+                                 stdin "attachable": type to its stdin,
+                                 see its output; Ctrl-D detaches
+  exec <service> [-- <command> [args]]
+                                 Run a command (default: a shell) in the
+                                 service's namespaces and cgroup
+  logs [-f] [-n lines] [--grep regexp] [service|@group]...
+                                 Show recent output (default: all services),
+                                 -f to follow it
+  events [--since time] [--until time] [--kind kind]... [service|@group]...
+                                 Show journaled events (see event_journal)
+  metrics                        Show counters in the Prometheus text format
+  run [--name name] [--pool pool] [--group group]... [--memory size]
+      [--cpu percent] [--user user] [--env NAME=value]... -- <command> [args]
+                                 Run a one-off job under gosv, show its
+                                 output and exit with its exit code
+  pools                          Show pools: their services, running and
+                                 queued jobs, and memory use
+  placement                      Show the NUMA nodes, their free memory and
+                                 the services pinned to their CPUs
+  set-limit <service|@group>... [--memory size] [--cpu percent]
+                                 Change memory_mb and cpu_percent of running
+                                 services (e.g. --memory 512M --cpu 150,
+                                 none to lift), or show them
+  deploy <service|@group> [--command path] [-- args]
+                                 Restart services with a new command, one
+                                 at a time, and roll back if one doesn't
+                                 get ready; without --command show what
+                                 they run
+  revisions <service>            Show the revisions of the service's config
+                                 kept in the state store (see state_db)
+  rollback <service> [revision]  Restart the service with an earlier
+                                 revision (default: the one before the
+                                 running one)
+  snapshot [file]                Save which services are enabled and their
+                                 limits (default: print them)
+  restore [-n] <file>            Reapply a snapshot, -n to only show what
+                                 would change
+
+Commands also take "-l <selector>" to act on the services whose labels
+match, e.g. -l tier=web,env!=staging
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *socket == "" {
+		if *pidfilePath == "" {
+			*pidfilePath = defaultPidfile(*configPath)
+		}
+		*socket = ctlSocketPath(*pidfilePath)
+	}
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		return fmt.Errorf("is gosv running? %w", err)
+	}
+	defer conn.Close()
+
+	switch fs.Arg(0) {
+	case "exec":
+		return ctlExec(conn, fs.Args()[1:])
+	case "logs":
+		return ctlLogs(conn, fs.Args()[1:])
+	case "events":
+		return ctlEventsMain(conn, fs.Args()[1:])
+	case "snapshot":
+		return ctlSnapshot(conn, fs.Args()[1:])
+	case "restore":
+		return ctlRestore(conn, fs.Args()[1:])
+	case "set-limit":
+		return ctlSetLimit(conn, fs.Args()[1:])
+	case "run":
+		return ctlRun(conn, fs.Args()[1:])
+	case "deploy":
+		return ctlDeploy(conn, fs.Args()[1:])
+	case "revisions", "rollback":
+		return ctlRollback(conn, fs.Arg(0), fs.Args()[1:])
+	case "attach":
+		return ctlAttach(conn, fs.Args()[1:])
+	}
+	req := ctlRequest{Command: fs.Arg(0)}
+	for rest := fs.Args()[1:]; len(rest) > 0; rest = rest[1:] {
+		if (rest[0] == "-l" || rest[0] == "--selector") && len(rest) > 1 {
+			req.Selector = rest[1]
+			rest = rest[1:]
+			continue
+		}
+		if rest[0] == "--rolling" && req.Command == "restart" {
+			req.Rolling = true
+			continue
+		}
+		req.Args = append(req.Args, rest[0])
+	}
+	if req.Rolling {
+		return ctlRollingRestart(conn, req)
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	var reply ctlReply
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&reply); err != nil {
+		return fmt.Errorf("no reply: %w", err)
+	}
+	fmt.Print(reply.Output)
+	if reply.Error != "" {
+		return fmt.Errorf("%s", reply.Error)
+	}
+	return nil
+}
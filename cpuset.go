@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The kernel's CPU lists
+const (
+	onlineCPUsPath   = "/sys/devices/system/cpu/online"
+	isolatedCPUsPath = "/sys/devices/system/cpu/isolated"  // isolcpus=
+	nohzFullCPUsPath = "/sys/devices/system/cpu/nohz_full" // nohz_full=
+)
+
+// cpuPresets are the names cpus takes besides CPU lists
+var cpuPresets = []string{"isolated", "nohz_full", "housekeeping"}
+
+// parseCPUList parses a CPU list as the kernel writes them, "0-3,8"
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	list = strings.TrimSpace(list)
+	if list == "" || list == "(null)" {
+		return nil, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		lo, err := strconv.Atoi(first)
+		hi := lo
+		if err == nil && isRange {
+			hi, err = strconv.Atoi(last)
+		}
+		if err != nil || lo < 0 || hi < lo {
+			return nil, fmt.Errorf("invalid CPU list %q (want e.g. 2-5,8)", list)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	slices.Sort(cpus)
+	return slices.Compact(cpus), nil
+}
+
+// formatCPUList writes sorted cpus as a CPU list, with ranges
+func formatCPUList(cpus []int) string {
+	var parts []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		} else {
+			parts = append(parts, strconv.Itoa(cpus[i]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// readCPUList reads one of the kernel's CPU lists
+func readCPUList(path string) ([]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUList(string(data))
+}
+
+// resolveCPUs returns the CPUs a service with cpus and isolate_from runs
+// on: those cpus names (all online CPUs if "") but isolateFrom. Every CPU
+// named must be online, and some must be left.
+//
+// KEY CONCEPT: Pinning and housekeeping cores
+// Latency-sensitive services - a packet processor, an RT control loop -
+// are pinned to CPUs of their own, away from the "housekeeping" cores
+// where the kernel steers device interrupts and runs its own threads. The
+// kernel can set CPUs aside at boot: isolcpus= takes them out of the
+// scheduler's load balancing, nohz_full= stops the timer tick on them.
+// Pinning by hand goes wrong in quiet ways: a list naming a CPU that
+// isn't online (another machine's list) fails at start or pins to fewer
+// CPUs than meant, and a service started by a supervisor that was itself
+// pinned to the housekeeping cores inherits that affinity, and runs
+// there. So the list is checked against the machine's online CPUs when
+// the config loads, presets name the kernel's own lists, and the affinity
+// is set for each start rather than inherited.
+func resolveCPUs(cpus string, isolateFrom []int) ([]int, error) {
+	online, err := readCPUList(onlineCPUsPath)
+	if err != nil {
+		return nil, fmt.Errorf("online CPUs: %w", err)
+	}
+	var set []int
+	switch cpus {
+	case "":
+		set = online
+	case "isolated", "nohz_full":
+		path, param := isolatedCPUsPath, "isolcpus"
+		if cpus == "nohz_full" {
+			path, param = nohzFullCPUsPath, "nohz_full"
+		}
+		// Kernels without nohz_full support have no file
+		if set, err = readCPUList(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(set) == 0 {
+			return nil, fmt.Errorf("no %s CPUs: the kernel was booted without %s=", cpus, param)
+		}
+		set = slices.DeleteFunc(set, func(cpu int) bool { return !slices.Contains(online, cpu) })
+	case "housekeeping":
+		isolated, _ := readCPUList(isolatedCPUsPath)
+		nohzFull, _ := readCPUList(nohzFullCPUsPath)
+		set = slices.DeleteFunc(slices.Clone(online), func(cpu int) bool {
+			return slices.Contains(isolated, cpu) || slices.Contains(nohzFull, cpu)
+		})
+	default:
+		if set, err = parseCPUList(cpus); err != nil {
+			return nil, fmt.Errorf("%w, or one of %s", err, strings.Join(cpuPresets, ", "))
+		}
+		for _, cpu := range set {
+			if !slices.Contains(online, cpu) {
+				return nil, fmt.Errorf("CPU %d is not online (online: %s)", cpu, formatCPUList(online))
+			}
+		}
+	}
+	for _, cpu := range isolateFrom {
+		if !slices.Contains(online, cpu) {
+			return nil, fmt.Errorf("isolate_from: CPU %d is not online (online: %s)", cpu, formatCPUList(online))
+		}
+	}
+	set = slices.DeleteFunc(slices.Clone(set), func(cpu int) bool { return slices.Contains(isolateFrom, cpu) })
+	if len(set) == 0 {
+		return nil, fmt.Errorf("no CPUs left to run on")
+	}
+	return set, nil
+}
+
+// describeCPUs describes p's CPUs for --dry-run
+func (p *Process) describeCPUs() string {
+	s := formatCPUList(p.cpuList)
+	var from []string
+	if p.CPUs != "" {
+		from = append(from, "cpus "+p.CPUs)
+	}
+	if len(p.IsolateFrom) > 0 {
+		from = append(from, "isolate_from "+formatCPUList(slices.Sorted(slices.Values(p.IsolateFrom))))
+	}
+	if p.Placement != "" {
+		from = append(from, "placement "+p.Placement)
+	}
+	return s + " (" + strings.Join(from, ", ") + ")"
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// tmpfsMagic is the f_type statfs reports for tmpfs
+const tmpfsMagic = 0x01021994
+
+// credentialsRoot returns the directory holding per-service credential
+// directories, in gosv's runtime dir (a tmpfs on systemd systems)
+func credentialsRoot() string {
+	return filepath.Join(runtimeDir(), "credentials")
+}
+
+// setupCredentials populates p's credentials directory from
+// p.Credentials and returns its path ("" if p has no credentials).
+// Caller must hold p.mu.
+//
+// KEY CONCEPT: Credentials vs environment variables
+// Secrets in environment variables leak easily: they're inherited by every
+// child, readable in /proc/<pid>/environ, and end up in crash reports and
+// debug dumps. Like systemd's LoadCredential=, we copy each secret into a
+// file in a private directory and only pass its location, in
+// $CREDENTIALS_DIRECTORY. The directory is a tmpfs of its own when we can
+// mount one (secrets never touch disk), mode 0700, with 0400 files. It is
+// rebuilt on every start, so rotated secrets are picked up by a restart.
+func (p *Process) setupCredentials() (string, error) {
+	if len(p.Credentials) == 0 {
+		return "", nil
+	}
+
+	dir := filepath.Join(credentialsRoot(), p.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if !p.credMounted && credentialsMounted(dir) {
+		// The tmpfs of the process this one replaced (a reload): reuse it
+		// rather than stack another on top
+		p.credMounted = true
+	}
+	if !p.credMounted {
+		// A tmpfs per service: size-limited, and gone with its mount
+		err := mountCredentials(dir)
+		if err == nil {
+			p.credMounted = true
+		} else {
+			var st syscall.Statfs_t
+			if syscall.Statfs(dir, &st) == nil && st.Type != tmpfsMagic {
+				logWarn("%s: credentials are stored on disk in %s (can't mount a tmpfs: %v)", p.Name, dir, err)
+			}
+		}
+	}
+
+	// Start from an empty directory so removed credentials disappear
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		os.RemoveAll(filepath.Join(dir, e.Name()))
+	}
+	os.Chmod(dir, 0700)
+
+	for id, src := range p.Credentials {
+		var data []byte
+		if name, ok := strings.CutPrefix(src, "env:"); ok {
+			value, set := os.LookupEnv(name)
+			if !set {
+				return "", fmt.Errorf("credential %s: $%s is not set", id, name)
+			}
+			data = []byte(value)
+		} else if data, err = os.ReadFile(src); err != nil {
+			return "", fmt.Errorf("credential %s: %w", id, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, id), data, 0400); err != nil {
+			return "", fmt.Errorf("credential %s: %w", id, err)
+		}
+		if p.RunAs != nil {
+			os.Chown(filepath.Join(dir, id), int(p.RunAs.Uid), int(p.RunAs.Gid))
+		}
+	}
+	if p.RunAs != nil {
+		// The service's user must get through the directories above, but
+		// not list them
+		os.Chmod(runtimeDir(), 0711)
+		os.Chmod(credentialsRoot(), 0711)
+		os.Chown(dir, int(p.RunAs.Uid), int(p.RunAs.Gid))
+	}
+	return dir, nil
+}
+
+// removeCredentials deletes p's credentials directory
+func (p *Process) removeCredentials() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.Credentials) == 0 {
+		return
+	}
+	dir := filepath.Join(credentialsRoot(), p.Name)
+	if p.credMounted {
+		syscall.Unmount(dir, 0)
+		p.credMounted = false
+	}
+	os.RemoveAll(dir)
+}
+
+// credentialsMounted reports whether dir is a tmpfs mounted on its own,
+// i.e. not on the same filesystem as its parent
+func credentialsMounted(dir string) bool {
+	var st syscall.Statfs_t
+	if syscall.Statfs(dir, &st) != nil || st.Type != tmpfsMagic {
+		return false
+	}
+	var fi, parent syscall.Stat_t
+	if syscall.Stat(dir, &fi) != nil || syscall.Stat(filepath.Dir(dir), &parent) != nil {
+		return false
+	}
+	return fi.Dev != parent.Dev
+}
+
+// validCredentialID reports whether id can be used as a file name in the
+// credentials directory
+func validCredentialID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsRune(id, '/')
+}
@@ -0,0 +1,10 @@
+package main
+
+import "syscall"
+
+// mountCredentials mounts a small tmpfs of its own on a credentials
+// directory
+func mountCredentials(dir string) error {
+	return syscall.Mount("tmpfs", dir, "tmpfs",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=0700,size=1m")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// execTarget is where `gosv ctl exec` runs a command: next to the main
+// process of a running service
+type execTarget struct {
+	Service string `json:"service"`
+	Pid     int    `json:"pid"`
+	Cgroup  string `json:"cgroup,omitempty"`
+}
+
+// execTarget returns the running process and cgroup of the named service
+func (s *Supervisor) execTarget(name string) (*execTarget, error) {
+	p, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := p.Spawner.(ContainerSpawner); ok {
+		runtime := c.Runtime
+		if runtime == "" {
+			runtime = "runc"
+		}
+		// Our child is the runtime, not a process in the container
+		return nil, fmt.Errorf("%s runs in an OCI container, use: %s exec %s <command>", name, runtime, containerID(p))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != StateRunning || p.pid == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotRunning, name)
+	}
+	t := &execTarget{Service: name, Pid: p.pid}
+	if p.cgroup != nil {
+		t.Cgroup = p.cgroup.path
+	}
+	return t, nil
+}
+
+// ctlExec is `gosv ctl exec <service> [--] [command [args]]`: it asks the
+// gosv on conn where the service runs, runs the command there (a shell
+// if none is given) on our terminal, and exits with its exit code
+func ctlExec(conn net.Conn, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("exec: usage: exec <service> -- <command> [args]")
+	}
+	name, argv := args[0], args[1:]
+	if len(argv) > 0 && argv[0] == "--" {
+		argv = argv[1:]
+	}
+	if len(argv) == 0 {
+		argv = []string{"/bin/sh"}
+	}
+
+	if err := json.NewEncoder(conn).Encode(ctlRequest{Command: "exec", Args: []string{name}}); err != nil {
+		return err
+	}
+	var reply ctlReply
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&reply); err != nil {
+		return fmt.Errorf("no reply: %w", err)
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("%s", reply.Error)
+	}
+	if reply.Target == nil {
+		return fmt.Errorf("exec: not supported by this gosv")
+	}
+	conn.Close()
+
+	code, err := reply.Target.run(argv)
+	if err != nil {
+		return fmt.Errorf("exec in %s: %w", name, err)
+	}
+	os.Exit(code)
+	return nil
+}
+
+// exitStatus returns the exit code a shell would report for a process
+// that ended in state: its exit code, or 128 + the signal that killed it
+func exitStatus(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+)
+
+// sysSetns is the number of the setns(2) system call, which the syscall
+// package lacks on most architectures
+var sysSetns = map[string]uintptr{
+	"386":     346,
+	"amd64":   308,
+	"arm":     375,
+	"arm64":   268,
+	"loong64": 268,
+	"ppc64le": 350,
+	"riscv64": 268,
+	"s390x":   339,
+}[runtime.GOARCH]
+
+// execNamespaces are the namespaces a command joins, in order: the mount
+// namespace last, since /proc/<pid>/ns is looked up in the current one
+var execNamespaces = []string{"ipc", "uts", "net", "pid", "cgroup", "mnt"}
+
+// run runs argv in the namespaces and cgroup of t.Pid, attached to our
+// stdio, and returns its exit status
+//
+// KEY CONCEPT: setns(2)
+// Each namespace a process is in shows up as a file in /proc/<pid>/ns.
+// Opening one and calling setns() on it moves the calling thread into
+// that namespace - what nsenter(1) and `docker exec` do. Most namespaces
+// take effect for the thread right away; a PID namespace only for the
+// children it creates next, so the command is forked after joining.
+// Go runs on several threads, which limits what can be joined:
+//   - The mount namespace is refused to a thread that shares its
+//     filesystem state (root, cwd) with other threads. unshare(CLONE_FS)
+//     gives this thread its own first.
+//   - A user namespace can only be joined by a single-threaded process,
+//     so the command keeps our user namespace (root stays root). Our
+//     capabilities cover every namespace a service's user namespace owns.
+//
+// The thread stays locked and is thrown away when the command is done:
+// it belongs to the service now, not to gosv.
+func (t *execTarget) run(argv []string) (int, error) {
+	runtime.LockOSThread()
+
+	var fds []int
+	defer func() {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+	}()
+	for _, ns := range execNamespaces {
+		theirs := fmt.Sprintf("/proc/%d/ns/%s", t.Pid, ns)
+		if sameFile(theirs, "/proc/self/ns/"+ns) {
+			continue
+		}
+		fd, err := syscall.Open(theirs, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return 0, fmt.Errorf("open %s namespace: %w", ns, err)
+		}
+		fds = append(fds, fd)
+	}
+	if sysSetns == 0 {
+		return 0, syscall.ENOSYS
+	}
+	if err := syscall.Unshare(syscall.CLONE_FS); err != nil {
+		return 0, fmt.Errorf("unshare filesystem state: %w", err)
+	}
+	for _, fd := range fds {
+		if _, _, errno := syscall.RawSyscall(sysSetns, uintptr(fd), 0, 0); errno != 0 {
+			return 0, fmt.Errorf("setns: %w", errno)
+		}
+	}
+
+	// Paths resolve in the service's mount namespace from here on
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Dir = "/"
+	if cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", t.Pid)); err == nil {
+		cmd.Dir = cwd
+	}
+	if t.Cgroup != "" {
+		// Started inside the service's cgroup, under its limits
+		dir, err := os.Open(t.Cgroup)
+		if err != nil {
+			return 0, fmt.Errorf("open cgroup: %w", err)
+		}
+		defer dir.Close()
+		cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(dir.Fd())}
+	}
+
+	// The command shares our terminal: Ctrl+C is for it, not for us
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGQUIT)
+	defer signal.Stop(sigs)
+
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	cmd.Wait()
+	return exitStatus(cmd.ProcessState), nil
+}
+
+// sameFile reports whether a and b are the same file (namespace files of
+// the same namespace are)
+func sameFile(a, b string) bool {
+	fa, errA := os.Stat(a)
+	fb, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(fa, fb)
+}
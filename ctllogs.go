@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logTailLines is how many recent lines of each service `gosv ctl logs`
+// can show
+const logTailLines = 200
+
+// logFollowerQueue is how many lines can wait for a slow `ctl logs
+// --follow` before new ones are skipped
+const logFollowerQueue = 1000
+
+// ctlLogLine is one line of `gosv ctl logs` output, one JSON line on the
+// control connection. Notes are about the connection rather than from the
+// service, like lines skipped because the client fell behind.
+type ctlLogLine struct {
+	Service string    `json:"service"`
+	Stream  string    `json:"stream,omitempty"`
+	Time    time.Time `json:"time"`
+	Line    string    `json:"line,omitempty"`
+	Note    string    `json:"note,omitempty"`
+	Exit    *int      `json:"exit,omitempty"` // Last line of `ctl run`: the job's exit code
+}
+
+// logFollower gets the lines of one pipeline as they are written
+type logFollower struct {
+	lines chan logLine // Closed when the pipeline is
+	lost  atomic.Uint64
+}
+
+// publish keeps l for `ctl logs` and hands it to followers. A follower
+// that doesn't keep up loses lines rather than slowing the pipeline.
+func (lp *logPipeline) publish(l logLine) {
+	lp.tailMu.Lock()
+	defer lp.tailMu.Unlock()
+	if len(lp.tail) < logTailLines {
+		lp.tail = append(lp.tail, l)
+	} else {
+		lp.tail[lp.tailNext] = l
+		lp.tailNext = (lp.tailNext + 1) % logTailLines
+	}
+	for f := range lp.followers {
+		select {
+		case f.lines <- l:
+		default:
+			f.lost.Add(1)
+		}
+	}
+}
+
+// follow returns the last n lines and, if follow is set, a follower for
+// the lines after them (nil if the pipeline is closed). Taking both under
+// one lock is what keeps a line from being shown twice or not at all.
+func (lp *logPipeline) follow(n int, follow bool) ([]logLine, *logFollower) {
+	lp.tailMu.Lock()
+	defer lp.tailMu.Unlock()
+	tail := append(append([]logLine(nil), lp.tail[lp.tailNext:]...), lp.tail[:lp.tailNext]...)
+	if n < len(tail) {
+		tail = tail[len(tail)-n:]
+	}
+	if !follow || lp.finished {
+		return tail, nil
+	}
+	f := &logFollower{lines: make(chan logLine, logFollowerQueue)}
+	if lp.followers == nil {
+		lp.followers = make(map[*logFollower]struct{})
+	}
+	lp.followers[f] = struct{}{}
+	return tail, f
+}
+
+// unfollow stops handing lines to f
+func (lp *logPipeline) unfollow(f *logFollower) {
+	lp.tailMu.Lock()
+	defer lp.tailMu.Unlock()
+	delete(lp.followers, f)
+}
+
+// finishFollowers tells the followers there will be no more lines
+func (lp *logPipeline) finishFollowers() {
+	lp.tailMu.Lock()
+	defer lp.tailMu.Unlock()
+	lp.finished = true
+	for f := range lp.followers {
+		close(f.lines)
+	}
+	lp.followers = nil
+}
+
+// logTargets returns the services a `ctl logs` request names, all of them
+// if it names none
+func (s *Supervisor) logTargets(req ctlRequest) ([]*Process, error) {
+	targets := req.Args
+	if req.Selector != "" {
+		names, err := s.Select(req.Selector)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no service matches %q", req.Selector)
+		}
+		targets = append(targets, names...)
+	}
+	if len(targets) == 0 {
+		procs := s.snapshot()
+		sort.Slice(procs, func(i, j int) bool { return procs[i].Name < procs[j].Name })
+		return procs, nil
+	}
+	var procs []*Process
+	seen := make(map[*Process]bool)
+	for _, t := range targets {
+		found, err := s.resolve(t)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range found {
+			if !seen[p] {
+				seen[p] = true
+				procs = append(procs, p)
+			}
+		}
+	}
+	return procs, nil
+}
+
+// serveLogs answers `gosv ctl logs`: a reply naming the services, their
+// recent lines interleaved by time and, with --follow, their lines as
+// they come until the client hangs up, gosv stops or every pipeline is
+// closed. It runs on the connection's goroutine, not in the main loop,
+// which would be blocked for as long as the client follows.
+//
+// KEY CONCEPT: Multiplexing streams
+// `tail -f a.log b.log` in tmux panes works until there are ten services,
+// and it needs the output in files to begin with. gosv already has every
+// line of every captured service in memory on its way to the console, so
+// it can hand copies to whoever asks: each service's pipeline gets a
+// follower per client, and the client's connection merges them in
+// arrival order, prefixed with the service like `docker compose logs`.
+// The copies never hold up the service - a client that reads too slowly
+// skips lines and is told how many - and a --grep filter is applied in
+// gosv, so lines nobody wants don't cross the socket.
+func (s *Supervisor) serveLogs(conn net.Conn, req ctlRequest) {
+	enc := json.NewEncoder(conn)
+	// The client checks --lines, but anything can write to the socket
+	req.Lines = min(max(req.Lines, 0), logTailLines)
+	procs, err := s.logTargets(req)
+	var grep *regexp.Regexp
+	if err == nil && req.Grep != "" {
+		grep, err = regexp.Compile(req.Grep)
+	}
+	if err != nil {
+		enc.Encode(ctlReply{Error: err.Error()})
+		return
+	}
+
+	type source struct {
+		p  *Process
+		lp *logPipeline
+		f  *logFollower
+	}
+	var sources []source
+	var history []ctlLogLine
+	var names, uncaptured []string
+	for _, p := range procs {
+		p.mu.Lock()
+		if !p.capturesOutput() {
+			p.mu.Unlock()
+			uncaptured = append(uncaptured, p.Name)
+			continue
+		}
+		p.ensureLogs()
+		lp := p.logs
+		p.mu.Unlock()
+
+		names = append(names, p.Name)
+		lines, f := lp.follow(req.Lines, req.Follow)
+		for _, l := range lines {
+			if grep == nil || grep.Match(l.text) {
+				history = append(history, ctlLogLine{Service: p.Name, Stream: l.stream, Time: l.time, Line: string(l.text)})
+			}
+		}
+		if f != nil {
+			sources = append(sources, source{p, lp, f})
+		}
+	}
+	if len(names) == 0 {
+		enc.Encode(ctlReply{Error: fmt.Sprintf("output of %s is not captured (see Output Capture)", strings.Join(uncaptured, ", "))})
+		return
+	}
+	reply := ctlReply{Services: names}
+	if len(uncaptured) > 0 {
+		reply.Output = fmt.Sprintf("gosv: output of %s is not captured, not shown\n", strings.Join(uncaptured, ", "))
+	}
+	if enc.Encode(reply) != nil {
+		return
+	}
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Time.Before(history[j].Time) })
+	for _, l := range history {
+		if enc.Encode(l) != nil {
+			return
+		}
+	}
+	if len(sources) == 0 {
+		return
+	}
+
+	// The client sends nothing more; a read returns when it hangs up
+	done := make(chan struct{})
+	var once sync.Once
+	hangUp := func() { once.Do(func() { close(done) }) }
+	go func() {
+		io.Copy(io.Discard, conn)
+		hangUp()
+	}()
+
+	var mu sync.Mutex // Serializes writes to conn
+	send := func(l ctlLogLine) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if enc.Encode(l) != nil {
+			hangUp()
+			return false
+		}
+		return true
+	}
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer src.lp.unfollow(src.f)
+			for {
+				select {
+				case l, ok := <-src.f.lines:
+					if !ok {
+						send(ctlLogLine{Service: src.p.Name, Note: "no more output (service removed or changed)"})
+						return
+					}
+					if n := src.f.lost.Swap(0); n > 0 {
+						if !send(ctlLogLine{Service: src.p.Name, Note: fmt.Sprintf("%d lines skipped, ctl logs fell behind", n)}) {
+							return
+						}
+					}
+					if grep != nil && !grep.Match(l.text) {
+						continue
+					}
+					if !send(ctlLogLine{Service: src.p.Name, Stream: l.stream, Time: l.time, Line: string(l.text)}) {
+						return
+					}
+				case <-done:
+					return
+				case <-s.stopped:
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// ctlLogs is `gosv ctl logs [-f] [-n lines] [--grep regexp]
+// [service|@group]...`: it prints the recent output of the services, and
+// with -f follows it, each line prefixed with its service. Lines a
+// service wrote to stderr go to our stderr.
+func ctlLogs(conn net.Conn, args []string) error {
+	req := ctlRequest{Command: "logs", Lines: 10}
+	for ; len(args) > 0; args = args[1:] {
+		switch arg := args[0]; {
+		case arg == "-f" || arg == "--follow":
+			req.Follow = true
+		case (arg == "-n" || arg == "--lines") && len(args) > 1:
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 0 {
+				return fmt.Errorf("logs: %s: not a count: %q", arg, args[1])
+			}
+			req.Lines = min(n, logTailLines)
+			args = args[1:]
+		case (arg == "-g" || arg == "--grep") && len(args) > 1:
+			req.Grep = args[1]
+			args = args[1:]
+		case (arg == "-l" || arg == "--selector") && len(args) > 1:
+			req.Selector = args[1]
+			args = args[1:]
+		default:
+			req.Args = append(req.Args, arg)
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	var reply ctlReply
+	if err := dec.Decode(&reply); err != nil {
+		return fmt.Errorf("no reply: %w", err)
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("%s", reply.Error)
+	}
+	fmt.Fprint(os.Stderr, reply.Output)
+
+	// Prefixes as wide as the longest name, colored on a terminal
+	width := 0
+	for _, name := range reply.Services {
+		width = max(width, len(name))
+	}
+	colors := make(map[string]int)
+	if isTerminal(os.Stdout) {
+		for i, name := range reply.Services {
+			colors[name] = 31 + i%6 // Red to cyan
+		}
+	}
+	prefix := func(name string) string {
+		if c, ok := colors[name]; ok {
+			return fmt.Sprintf("\x1b[%dm%-*s |\x1b[0m ", c, width, name)
+		}
+		return fmt.Sprintf("%-*s | ", width, name)
+	}
+	for {
+		var l ctlLogLine
+		if err := dec.Decode(&l); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("logs: %w", err)
+		}
+		switch {
+		case l.Note != "":
+			fmt.Fprintf(os.Stderr, "%s(%s)\n", prefix(l.Service), l.Note)
+		case l.Stream == "stderr":
+			fmt.Fprintf(os.Stderr, "%s%s\n", prefix(l.Service), l.Line)
+		default:
+			fmt.Fprintf(os.Stdout, "%s%s\n", prefix(l.Service), l.Line)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// daemonEnv marks the detached copy of gosv started by daemonize
+const daemonEnv = "GOSV_DAEMON"
+
+// daemonReadyFD is the pipe the detached copy reports readiness on
+const daemonReadyFD = 3
+
+// runtimeDir returns the directory for gosv's runtime files: /run/gosv as
+// root, else under the user's runtime dir
+func runtimeDir() string {
+	if os.Geteuid() == 0 {
+		return "/run/gosv"
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "gosv")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("gosv-%d", os.Getuid()))
+}
+
+// defaultPidfile returns the pidfile used when --pidfile isn't given: one
+// per config, named after it, so instances running other configs don't
+// collide
+func defaultPidfile(configPath string) string {
+	return filepath.Join(runtimeDir(), configName(configPath)+".pid")
+}
+
+// configName names a gosv instance after its config: "web" for
+// /etc/gosv/web.json, "gosv" without a local config
+func configName(configPath string) string {
+	if configPath == "" || strings.Contains(configPath, "://") {
+		return "gosv"
+	}
+	base := filepath.Base(configPath)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// daemonized is set in the detached copy started by daemonize (read
+// before detachDaemonEnv clears the marker)
+var daemonized = os.Getenv(daemonEnv) == "1"
+
+// isDaemon reports whether we are the detached copy started by daemonize
+func isDaemon() bool {
+	return daemonized
+}
+
+// daemonize starts a detached copy of gosv with the same arguments and
+// exits once it is up, or with its startup errors if it fails. Output of
+// the copy (gosv's logs and the services') goes to logPath.
+//
+// KEY CONCEPT: Daemonizing in Go
+// The classic recipe is fork(), setsid(), fork() again, and let the
+// parents exit. A Go program can't fork() without exec(): the runtime's
+// other threads don't survive into the child. So we re-execute ourselves
+// instead, in a new session (Setsid: no controlling terminal, no SIGHUP
+// when the terminal closes) with stdin on /dev/null and stdout/stderr on
+// the log file. A pipe lets the copy say when it has taken the pidfile
+// lock and loaded its config, so errors still reach the terminal and the
+// exit code of `gosv --daemon` means something.
+func daemonize(logPath string) error {
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	offset, _ := logFile.Seek(0, io.SeekEnd)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{w} // Becomes daemonReadyFD
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	w.Close()
+
+	// EOF without "ok" means the copy exited (or closed the pipe) before
+	// it got going
+	status, _ := io.ReadAll(r)
+	r.Close()
+	if string(status) == "ok" {
+		fmt.Printf("gosv running in the background (pid %d), logging to %s\n", cmd.Process.Pid, logPath)
+		os.Exit(0)
+	}
+	cmd.Wait()
+	if out, err := os.ReadFile(logPath); err == nil && int64(len(out)) > offset {
+		os.Stderr.Write(out[offset:])
+	}
+	return fmt.Errorf("gosv failed to start in the background (log: %s)", logPath)
+}
+
+// daemonReady tells the process that ran daemonize that we're up
+func daemonReady() {
+	if !isDaemon() {
+		return
+	}
+	f := os.NewFile(daemonReadyFD, "daemon-ready")
+	f.WriteString("ok")
+	f.Close()
+}
+
+// detachDaemonEnv keeps the daemon's plumbing away from services: they'd
+// otherwise inherit the readiness pipe and the daemon marker
+func detachDaemonEnv() {
+	syscall.CloseOnExec(daemonReadyFD)
+	os.Unsetenv(daemonEnv)
+}
+
+// Pidfile is a pidfile held with an exclusive lock for as long as gosv runs
+type Pidfile struct {
+	path string
+	f    *os.File
+}
+
+// lockPidfile takes the lock on the pidfile at path and writes our pid
+// to it, failing if another gosv holds it
+//
+// KEY CONCEPT: Locked pidfiles
+// A pidfile alone can't prevent a second instance: after a crash it
+// holds a stale pid, possibly reused by an unrelated process. An
+// flock() on the file can: the kernel drops it when the holder exits,
+// however it exits, so a held lock always means a live instance, and a
+// leftover file without a lock is simply taken over.
+func lockPidfile(path string) (*Pidfile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			data, _ := io.ReadAll(f)
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+				return nil, fmt.Errorf("another gosv is running with this pidfile (pid %d, %s)", pid, path)
+			}
+			return nil, fmt.Errorf("another gosv is running with this pidfile (%s)", path)
+		}
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Pidfile{path: path, f: f}, nil
+}
+
+// Release removes the pidfile and drops the lock
+func (p *Pidfile) Release() {
+	if p == nil {
+		return
+	}
+	os.Remove(p.path)
+	p.f.Close()
+}
@@ -0,0 +1,27 @@
+package main
+
+import "time"
+
+// startDelay returns how long the boot start of p, the n-th service
+// started at boot (from 0), waits: its own StartDelay plus n times the
+// stagger interval
+//
+// KEY CONCEPT: Thundering herds at boot
+// Twenty identical workers started in the same millisecond open twenty
+// database connections, run twenty cache warmups and compete for the same
+// locks at once - a load spike the database only ever sees at boot, which
+// can be enough to make the first attempts time out and crash. Spreading
+// the starts out, by a fixed delay per service or a stagger interval
+// between consecutive starts, trades a slower boot for a flat load curve.
+func (s *Supervisor) startDelay(p *Process, n int) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return p.StartDelay + time.Duration(n)*s.startStagger
+}
+
+// SetStartStagger spaces the starts at boot interval apart (0: all at once)
+func (s *Supervisor) SetStartStagger(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startStagger = interval
+}
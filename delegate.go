@@ -0,0 +1,22 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// removeChildren removes the cgroups a delegated service created below
+// c, deepest first
+func (c *Cgroup) removeChildren() {
+	var dirs []string
+	filepath.WalkDir(c.path, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && path != c.path {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
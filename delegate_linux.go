@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// prepareDelegation creates p's cgroup and sets up p.cmd to start inside
+// it, in new cgroup and mount namespaces (the exec helper mounts the new
+// view, see mountCgroupNS). It returns the cgroup directory, which must
+// stay open until the start. Caller must hold p.mu.
+//
+// KEY CONCEPT: Cgroup delegation
+// A workload that manages cgroups itself - a nested systemd, another
+// supervisor, a container runtime - needs a subtree it may write to, and
+// must not see (or depend on) where that subtree sits in the host's
+// hierarchy. A cgroup namespace does the second part: the process sees
+// the cgroup it was in when the namespace was created as "/", in
+// /proc/self/cgroup and in a cgroup2 mount made inside the namespace.
+// So the child must *start* in its cgroup, not be moved there after
+// fork like other services: clone3() with CLONE_INTO_CGROUP (Go's
+// UseCgroupFD) places it there atomically. Everything it creates stays
+// below its cgroup, bounded by the limits gosv set there.
+func (p *Process) prepareDelegation() (*os.File, error) {
+	cg, err := NewCgroup(p.cgroupName())
+	if err != nil {
+		return nil, fmt.Errorf("delegate cgroup: %w", err)
+	}
+	p.cgroup = cg
+	p.applyLimits(cg)
+
+	dir, err := os.Open(cg.path)
+	if err != nil {
+		return nil, fmt.Errorf("delegate cgroup: %w", err)
+	}
+	// The files that make a cgroup manageable belong to the service's
+	// user, like systemd does for Delegate=yes
+	if p.RunAs != nil {
+		for _, name := range []string{"", "cgroup.procs", "cgroup.subtree_control", "cgroup.threads"} {
+			os.Chown(filepath.Join(cg.path, name), int(p.RunAs.Uid), int(p.RunAs.Gid))
+		}
+	}
+
+	attr := p.cmd.SysProcAttr
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(dir.Fd())
+	attr.Cloneflags |= syscall.CLONE_NEWCGROUP | syscall.CLONE_NEWNS
+	logInfo("delegating cgroup %s to %s", cg.path, p.Name)
+	return dir, nil
+}
+
+// mountCgroupNS mounts the cgroup namespace's view of the cgroup tree on
+// /sys/fs/cgroup. It runs in the exec helper, as the service process.
+func mountCgroupNS() error {
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if err := syscall.Mount("cgroup2", cgroupRoot, "cgroup2", flags, ""); err != nil {
+		return fmt.Errorf("mount cgroup2: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultDeploySettle is how long a deployed service without a
+// ready_check must stay up to count as ready, when settle_sec is not
+// configured
+const DefaultDeploySettle = 10 * time.Second
+
+// DeployStartTimeout is how long a deploy waits for the new run of a
+// service to start, once it asked for the restart
+const DeployStartTimeout = time.Minute
+
+// deployPoll is the pause between checks on a service being deployed
+const deployPoll = 250 * time.Millisecond
+
+// DeployConfig is the top-level deploy settings
+type DeployConfig struct {
+	StateFile string `json:"state_file"` // Where deploys are kept (default: next to the pidfile)
+	SettleSec int    `json:"settle_sec"` // How long a service without ready_check must stay up
+	Listen    string `json:"listen"`     // host:port of the HTTP endpoint ("" for none)
+	TokenFile string `json:"token_file"` // Bearer token the HTTP endpoint requires
+	TLSConfig
+}
+
+func (c *DeployConfig) validate() error {
+	if c.SettleSec < 0 {
+		return fmt.Errorf("deploy: settle_sec must not be negative")
+	}
+	if c.Listen != "" && c.TokenFile == "" {
+		return fmt.Errorf("deploy: listen needs token_file")
+	}
+	if err := c.TLSConfig.validate("deploy"); err != nil {
+		return err
+	}
+	// The endpoint runs commands: its token must not cross a network in
+	// the clear
+	if c.Listen != "" && !isLoopback(c.Listen) && !c.enabled() {
+		return fmt.Errorf("deploy: listen %s is not a loopback address, and needs tls_cert and tls_key", c.Listen)
+	}
+	return nil
+}
+
+// deployRecord is a deploy or rollback in effect: the service config a
+// service runs instead of its config entry, for as long as that entry
+// stays the same
+type deployRecord struct {
+	Service  json.RawMessage `json:"service"`            // The service config it runs
+	Command  string          `json:"command"`            // Its command line, for ctl deploy
+	Config   string          `json:"config"`             // Digest of the config entry it replaces
+	Via      string          `json:"via"`                // RevisionDeploy or RevisionRollback
+	Revision int             `json:"revision,omitempty"` // The revision a rollback restored
+	At       time.Time       `json:"at"`
+	Previous string          `json:"previous"` // The command line it replaced
+}
+
+// String describes rec for logs
+func (rec deployRecord) String() string {
+	if rec.Via == RevisionRollback {
+		return fmt.Sprintf("rollback to revision %d", rec.Revision)
+	}
+	return "deploy of " + rec.Command
+}
+
+// source returns the revision source of the config rec put in place
+func (rec deployRecord) source() string {
+	if rec.Via == RevisionRollback {
+		return fmt.Sprintf("rollback to %d", rec.Revision)
+	}
+	return RevisionDeploy
+}
+
+// deployStatePath returns where a gosv with this pidfile keeps its
+// deploys, unless the config says otherwise
+func deployStatePath(pidfile string) string {
+	return strings.TrimSuffix(pidfile, ".pid") + ".deploys.json"
+}
+
+// configDigest identifies the config entry p was built from, in deploy
+// records
+func configDigest(p *Process) string {
+	sum := sha256.Sum256([]byte(p.configHash))
+	return hex.EncodeToString(sum[:8])
+}
+
+// definition returns p's command and args as configured, before a shell
+// wraps them (see shellCommand). Caller must hold p.mu.
+func (p *Process) definition() (string, []string) {
+	if p.shell {
+		return p.Args[1], p.Args[3:]
+	}
+	return p.Command, p.Args
+}
+
+// commandLine joins a command and its args for display
+func commandLine(command string, args []string) string {
+	return strings.Join(append([]string{command}, args...), " ")
+}
+
+// define replaces p's command and args, from its next start. Caller must
+// hold p.mu.
+func (p *Process) define(command string, args []string) {
+	if p.shell {
+		p.Command, p.Args = shellCommand(p.Name, command, args)
+		return
+	}
+	p.Command, p.Args = command, args
+}
+
+// applyDeploys replaces the processes of the config data that were
+// deployed or rolled back with the ones they run since, and forgets the
+// deploys of services whose config changed since, or that are gone.
+// Called before procs are registered, at start, on every reload and on
+// rollbacks.
+func (s *Supervisor) applyDeploys(procs []*Process, data []byte) {
+	var cfg Config
+	json.Unmarshal(data, &cfg) // Parsed before
+	d := DeployConfig{}
+	if cfg.Deploy != nil {
+		d = *cfg.Deploy
+	}
+	if d.StateFile == "" {
+		d.StateFile = s.DeployState
+	}
+
+	s.deployMu.Lock()
+	defer s.deployMu.Unlock()
+	records := s.deploys
+	if records == nil || d.StateFile != s.deployCfg.StateFile {
+		records = readDeploys(d.StateFile)
+	}
+	s.deployCfg = d
+	kept := make(map[string]deployRecord, len(records))
+	for i, p := range procs {
+		rec, ok := records[p.Name]
+		if !ok {
+			continue
+		}
+		if rec.Config != configDigest(p) {
+			logInfo("%s changed in the config, dropping its %s", p.Name, rec)
+			continue
+		}
+		q, err := buildService(data, rec.Service)
+		if err != nil {
+			logWarn("%s: dropping its %s: %v", p.Name, rec, err)
+			continue
+		}
+		procs[i] = q
+		kept[p.Name] = rec
+	}
+	s.deploys = kept
+	if len(kept) != len(records) {
+		s.writeDeploys()
+	}
+}
+
+// readDeploys reads the deploys kept at path (none if it's "" or missing)
+func readDeploys(path string) map[string]deployRecord {
+	records := make(map[string]deployRecord)
+	if path == "" {
+		return records
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logWarn("deploys: %v", err)
+		}
+		return records
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		logWarn("deploys: %s: %v", path, err)
+	}
+	return records
+}
+
+// writeDeploys saves the deploys in effect. Caller must hold s.deployMu.
+func (s *Supervisor) writeDeploys() {
+	path := s.deployCfg.StateFile
+	if path == "" || s.deployReadOnly {
+		return
+	}
+	data, err := json.MarshalIndent(s.deploys, "", "  ")
+	if err != nil {
+		logWarn("deploys: %v", err)
+		return
+	}
+	// Written aside and renamed, like snapshots
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		logWarn("deploys: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		logWarn("deploys: %v", err)
+	}
+}
+
+// deployStep is one service a deploy changed, and what it ran before
+type deployStep struct {
+	p       *Process
+	command string
+	args    []string
+	restart bool // It was restarted, not just redefined
+}
+
+// Deploy replaces the command of the target services (a name or
+// "@group"), and their args unless args is nil. Running services are
+// restarted one at a time, and each must get ready - answer its
+// ready_check, or else stay up for settle_sec - before the next one is
+// restarted. If one doesn't, every service the deploy changed goes back
+// to its previous command. progress gets a line for each step.
+//
+// KEY CONCEPT: Deploys that roll themselves back
+// Swapping a binary and restarting the service is easy; knowing that
+// the new release works before the old one is gone everywhere is the
+// point of a deploy tool. Restarting a group one member at a time keeps
+// the others serving, and waiting for each to get ready turns "it
+// started" into "it works" - a release that crashes at startup, or runs
+// but never answers, stops the rollout at the first member instead of
+// taking down all of them. The old command is still at hand, so gosv
+// puts it back itself: the on-call engineer learns about a failed
+// deploy from its log, not from an outage. The deployed command is kept
+// on disk and outlives restarts of gosv, but not a change to the
+// service's config: whoever edits the config is taken to mean it.
+func (s *Supervisor) Deploy(target, command string, args []string, progress func(string)) error {
+	procs, err := s.resolve(target)
+	if err != nil {
+		return err
+	}
+	for _, p := range procs {
+		switch {
+		case p.job != nil:
+			return fmt.Errorf("deploy: %s is a job", p.Name)
+		case p.Spawner != nil:
+			return fmt.Errorf("deploy: %s runs a container, whose command is not gosv's to replace", p.Name)
+		case p.isMain():
+			return fmt.Errorf("deploy: %s is the main service, its restart would end gosv", p.Name)
+		}
+	}
+	release, err := s.claimRollout(procs)
+	if err != nil {
+		return fmt.Errorf("deploy: %w", err)
+	}
+	defer release()
+
+	var steps []deployStep
+	for _, p := range procs {
+		p.mu.Lock()
+		step := deployStep{p: p}
+		step.command, step.args = p.definition()
+		newArgs := args
+		if newArgs == nil {
+			newArgs = step.args
+		}
+		p.define(command, newArgs)
+		step.restart = !p.manualStop && !p.boundDown && !p.evicted && p.state != StateWaiting &&
+			p.state != StateSkipped
+		p.mu.Unlock()
+		steps = append(steps, step)
+
+		if !step.restart {
+			progress(fmt.Sprintf("%s: not running, deployed for its next start", p.Name))
+			continue
+		}
+		progress(fmt.Sprintf("%s: restarting with %s", p.Name, command))
+		since := s.clock.Now()
+		s.restartNow(p)
+		if err := s.awaitDeployed(p, since); err != nil {
+			progress(fmt.Sprintf("%s: %v, rolling back", p.Name, err))
+			s.rollBack(steps, err)
+			return fmt.Errorf("deploy: %s: %v: %w", p.Name, err, ErrRolledBack)
+		}
+		progress(fmt.Sprintf("%s: ready", p.Name))
+	}
+
+	s.deployMu.Lock()
+	if s.deploys == nil {
+		s.deploys = make(map[string]deployRecord) // No config, no deploys read
+	}
+	s.mu.RLock()
+	keep := s.stateRevisions
+	s.mu.RUnlock()
+	now := s.clock.Now()
+	file := s.openRevisions()
+	for _, step := range steps {
+		p := step.p
+		rec := deployRecord{Config: configDigest(p), Via: RevisionDeploy, At: now,
+			Previous: commandLine(step.command, step.args)}
+		if old, ok := s.deploys[p.Name]; ok {
+			rec.Config = old.Config // p runs old, not its config entry
+		}
+		p.mu.Lock()
+		rec.Command = commandLine(p.definition())
+		if config, err := p.effectiveConfig(); err == nil {
+			// From now on p is built from what it runs, so reloads
+			// that rebuild it from the record leave it be
+			rec.Service, p.configHash = config, string(config)
+			s.deploys[p.Name] = rec
+		}
+		storeRevision(p, RevisionDeploy, keep, file)
+		p.noteEvent(EventDeploy, "deployed %s (was %s)", command, step.command)
+		p.mu.Unlock()
+		logInfo("deployed %s to %s (was %s)", command, p.Name, step.command)
+	}
+	s.writeDeploys()
+	s.saveRevisions(file)
+	s.deployMu.Unlock()
+	return nil
+}
+
+// claimRollout marks procs as being restarted one at a time, by a deploy
+// or a rolling restart, so that two of these don't restart the same
+// service at once, and returns what unmarks them
+func (s *Supervisor) claimRollout(procs []*Process) (func(), error) {
+	s.deployMu.Lock()
+	defer s.deployMu.Unlock()
+	for _, p := range procs {
+		if s.deploying[p.Name] {
+			return nil, fmt.Errorf("a deploy or rolling restart of %s is in progress", p.Name)
+		}
+	}
+	for _, p := range procs {
+		s.deploying[p.Name] = true
+	}
+	return func() {
+		s.deployMu.Lock()
+		for _, p := range procs {
+			delete(s.deploying, p.Name)
+		}
+		s.deployMu.Unlock()
+	}, nil
+}
+
+// restartNow restarts p for a deploy or a rolling restart, without
+// waiting out a restart it has scheduled
+func (s *Supervisor) restartNow(p *Process) {
+	p.mu.Lock()
+	p.cancelRestart()
+	p.mu.Unlock()
+	s.RestartProcess(p)
+}
+
+// deploySettle returns how long a service without a ready_check has to
+// stay up to count as ready, after a deploy or a handoff
+func (s *Supervisor) deploySettle() time.Duration {
+	s.deployMu.Lock()
+	defer s.deployMu.Unlock()
+	if s.deployCfg.SettleSec == 0 {
+		return DefaultDeploySettle
+	}
+	return time.Duration(s.deployCfg.SettleSec) * time.Second
+}
+
+// awaitDeployed waits for the first run of p started after since to get
+// ready (to pass its ready_check, or stay up settle_sec), and returns why
+// it didn't
+func (s *Supervisor) awaitDeployed(p *Process, since time.Time) error {
+	settle := s.deploySettle()
+	deadline := since.Add(DeployStartTimeout)
+	for {
+		if !s.registered(p) {
+			return fmt.Errorf("replaced or removed by a reload")
+		}
+		p.mu.Lock()
+		state, started, startErr := p.state, p.startTime, p.startErr
+		code, uptime := p.exitCode, p.lastUptime
+		check, limit := p.ReadyCheck, settle
+		if check != nil {
+			limit = p.ReadyTimeout
+		}
+		p.mu.Unlock()
+		now := s.clock.Now()
+		switch {
+		case started.After(since) && state == StateRunning:
+			if check == nil && now.Sub(started) >= settle {
+				return nil
+			}
+			if check != nil && check.probe() == nil {
+				return nil
+			}
+			if now.Sub(started) > limit {
+				return fmt.Errorf("not ready after %v", limit)
+			}
+		case started.After(since):
+			return fmt.Errorf("exited with code %d after %v", code, uptime)
+		case state == StateFailed && startErr != nil:
+			return startErr
+		case now.After(deadline):
+			return fmt.Errorf("didn't start within %v", DeployStartTimeout)
+		}
+		<-s.clock.After(deployPoll)
+	}
+}
+
+// rollBack puts back the commands steps replaced, last first, and
+// restarts the services that were restarted with the new one
+func (s *Supervisor) rollBack(steps []deployStep, cause error) {
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		p := step.p
+		p.mu.Lock()
+		p.define(step.command, step.args)
+		p.noteEvent(EventRollback, "rolled back to %s: %v", step.command, cause)
+		p.mu.Unlock()
+		logWarn("rolled %s back to %s: %v", p.Name, step.command, cause)
+		if step.restart {
+			s.restartNow(p)
+		}
+	}
+}
+
+// deployStatus describes what the target services run, one line each:
+// the command they were deployed with, or the one in their config
+func (s *Supervisor) deployStatus(target string) (string, error) {
+	procs, err := s.resolve(target)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	s.deployMu.Lock()
+	defer s.deployMu.Unlock()
+	for _, p := range procs {
+		p.mu.Lock()
+		command, args := p.definition()
+		p.mu.Unlock()
+		line := commandLine(command, args)
+		if rec, ok := s.deploys[p.Name]; ok && rec.Via == RevisionRollback {
+			fmt.Fprintf(&b, "%s: %s (rolled back to revision %d %s, was %s)\n", p.Name, line, rec.Revision,
+				rec.At.Local().Format("2006-01-02 15:04:05"), rec.Previous)
+		} else if ok {
+			fmt.Fprintf(&b, "%s: %s (deployed %s, was %s)\n", p.Name, line, rec.At.Local().Format("2006-01-02 15:04:05"),
+				rec.Previous)
+		} else {
+			fmt.Fprintf(&b, "%s: %s (from the config)\n", p.Name, line)
+		}
+	}
+	return b.String(), nil
+}
+
+// deployRequest is a deploy, from ctl or the HTTP endpoint. Args nil
+// keeps the services' args.
+type deployRequest struct {
+	Service string   `json:"service,omitempty"` // HTTP only; ctl has it in Args
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// serveDeploy answers `gosv ctl deploy`: it streams the progress of the
+// deploy as replies, and ends with one that has Done set. It runs on the
+// connection's goroutine, like serveJob.
+func (s *Supervisor) serveDeploy(conn net.Conn, req ctlRequest) {
+	enc := json.NewEncoder(conn)
+	if len(req.Args) != 1 {
+		enc.Encode(ctlReply{Error: "deploy: usage: deploy <service|@group> [--command path] [-- args]", Done: true})
+		return
+	}
+	if req.Deploy == nil {
+		out, err := s.deployStatus(req.Args[0])
+		reply := ctlReply{Output: out, Done: true}
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		enc.Encode(reply)
+		return
+	}
+	err := s.Deploy(req.Args[0], req.Deploy.Command, req.Deploy.Args, func(line string) {
+		enc.Encode(ctlReply{Output: line})
+	})
+	reply := ctlReply{Done: true}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	enc.Encode(reply)
+}
+
+// ctlDeploy is `gosv ctl deploy <service|@group> [--command path] [--
+// args]`: it deploys a new command to the services and prints how it
+// went, or without --command shows what they run
+func ctlDeploy(conn net.Conn, args []string) error {
+	req := ctlRequest{Command: "deploy"}
+	var deploy deployRequest
+	for len(args) > 0 {
+		switch arg := args[0]; {
+		case arg == "--":
+			deploy.Args = append([]string{}, args[1:]...)
+			args = nil
+			continue
+		case arg == "--command" && len(args) > 1:
+			deploy.Command = args[1]
+			args = args[1:]
+		default:
+			req.Args = append(req.Args, arg)
+		}
+		args = args[1:]
+	}
+	if deploy.Command != "" {
+		req.Deploy = &deploy
+	} else if deploy.Args != nil {
+		return fmt.Errorf("deploy: args need --command")
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(conn)
+	for {
+		var reply ctlReply
+		if err := dec.Decode(&reply); err != nil {
+			return fmt.Errorf("lost gosv before the deploy ended: %w", err)
+		}
+		if !reply.Done {
+			fmt.Println(reply.Output)
+			continue
+		}
+		fmt.Print(reply.Output)
+		if reply.Error != "" {
+			return fmt.Errorf("%s", reply.Error)
+		}
+		if req.Deploy != nil {
+			fmt.Println("deployed")
+		}
+		return nil
+	}
+}
+
+// deployAPI is the HTTP deploy endpoint
+type deployAPI struct {
+	addr, token string
+	tls         TLSConfig
+	srv         *http.Server
+}
+
+// startDeployAPI starts, restarts or stops the HTTP deploy endpoint to
+// match the config. Called at start and after every reload.
+func (s *Supervisor) startDeployAPI() {
+	s.deployMu.Lock()
+	cfg, old := s.deployCfg, s.deployAPI
+	s.deployMu.Unlock()
+	token := ""
+	if cfg.Listen != "" {
+		data, err := os.ReadFile(cfg.TokenFile)
+		if token = strings.TrimSpace(string(data)); err != nil || token == "" {
+			logWarn("deploy: no HTTP endpoint, token_file %s is unreadable or empty: %v", cfg.TokenFile, err)
+			cfg.Listen = ""
+		}
+	}
+	if old != nil && old.addr == cfg.Listen && old.token == token && old.tls == cfg.TLSConfig {
+		return
+	}
+	if old != nil {
+		old.srv.Close()
+	}
+	var api *deployAPI
+	if cfg.Listen != "" {
+		if l, err := cfg.listen(cfg.Listen); err != nil {
+			logWarn("deploy: %v", err)
+		} else {
+			api = &deployAPI{addr: cfg.Listen, token: token, tls: cfg.TLSConfig}
+			api.srv = &http.Server{Handler: s.deployHandler(token), ReadHeaderTimeout: 10 * time.Second}
+			go api.srv.Serve(l)
+			logInfo("deploy endpoint listening on %s://%s/deploy%s", cfg.scheme(), l.Addr(), cfg.describeClients())
+		}
+	}
+	s.deployMu.Lock()
+	s.deployAPI = api
+	s.deployMu.Unlock()
+}
+
+// stopDeployAPI closes the HTTP deploy endpoint at shutdown
+func (s *Supervisor) stopDeployAPI() {
+	s.deployMu.Lock()
+	api := s.deployAPI
+	s.deployAPI = nil
+	s.deployMu.Unlock()
+	if api != nil {
+		api.srv.Close()
+	}
+}
+
+// deployHandler serves POST /deploy with a deployRequest as its body and
+// the bearer token in its Authorization header. It answers when the
+// deploy is done, with a ctlReply: 200 if it worked, 409 if it was
+// rolled back.
+func (s *Supervisor) deployHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/deploy", func(w http.ResponseWriter, r *http.Request) {
+		reply := func(code int, out []string, err error) {
+			rep := ctlReply{Output: strings.Join(out, "\n"), Done: true}
+			if err != nil {
+				rep.Error = err.Error()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(rep)
+		}
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			reply(http.StatusUnauthorized, nil, fmt.Errorf("deploy: bad or missing bearer token"))
+			return
+		}
+		if r.Method != http.MethodPost {
+			reply(http.StatusMethodNotAllowed, nil, fmt.Errorf("deploy: POST a deploy"))
+			return
+		}
+		var req deployRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			reply(http.StatusBadRequest, nil, fmt.Errorf("deploy: bad request: %w", err))
+			return
+		}
+		if req.Service == "" || req.Command == "" {
+			reply(http.StatusBadRequest, nil, fmt.Errorf("deploy: service and command are required"))
+			return
+		}
+		logInfo("deploy of %s to %s requested from %s", req.Command, req.Service, r.RemoteAddr)
+		var out []string
+		err := s.Deploy(req.Service, req.Command, req.Args, func(line string) {
+			out = append(out, line)
+		})
+		switch {
+		case err == nil:
+			reply(http.StatusOK, out, nil)
+		case errors.Is(err, ErrUnknownService):
+			reply(http.StatusNotFound, out, err)
+		case errors.Is(err, ErrRolledBack):
+			reply(http.StatusConflict, out, err)
+		default:
+			reply(http.StatusBadRequest, out, err)
+		}
+	})
+	return mux
+}
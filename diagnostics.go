@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sizes of what a process keeps around for its diagnostics bundle
+const (
+	diagOutputLines = 200
+	diagEvents      = 50
+)
+
+// lineRing is an io.Writer that keeps the last n lines written to it
+type lineRing struct {
+	mu      sync.Mutex
+	n       int
+	lines   []string
+	partial []byte
+}
+
+func newLineRing(n int) *lineRing {
+	return &lineRing{n: n}
+}
+
+func (r *lineRing) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := append(r.partial, b...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		r.lines = append(r.lines, string(data[:i]))
+		data = data[i+1:]
+	}
+	r.partial = append([]byte(nil), data...)
+	if len(r.lines) > r.n {
+		r.lines = append([]string(nil), r.lines[len(r.lines)-r.n:]...)
+	}
+	return len(b), nil
+}
+
+// String returns the buffered lines, including an unterminated last line
+func (r *lineRing) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := strings.Join(r.lines, "\n")
+	if len(r.lines) > 0 {
+		s += "\n"
+	}
+	return s + string(r.partial)
+}
+
+// noteEvent records a lifecycle event of one of the Event kinds, in the
+// event journal and for the diagnostics bundle, and p's state in the
+// state store. Caller must hold p.mu.
+func (p *Process) noteEvent(kind, format string, args ...any) {
+	now, msg := p.now(), fmt.Sprintf(format, args...)
+	recordEvent(Event{Time: now, Service: p.Name, Kind: kind, PID: p.pid, Msg: msg})
+	storeState(p.Name, p.state, p.pid, p.restarts, now)
+	if p.DiagnosticsDir == "" {
+		return
+	}
+	line := now.Format(time.RFC3339) + " " + msg
+	p.recentEvents = append(p.recentEvents, line)
+	if len(p.recentEvents) > diagEvents {
+		p.recentEvents = p.recentEvents[1:]
+	}
+}
+
+// snapshotDiagnostics saves a ProcInfo of every running process that
+// writes diagnostics bundles - once it has failed, /proc has nothing left
+func (s *Supervisor) snapshotDiagnostics() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.processes {
+		p.mu.Lock()
+		if p.DiagnosticsDir != "" && p.state == StateRunning && p.pid != 0 {
+			if info, err := ReadProcInfo(p.pid); err == nil {
+				p.lastInfo = info
+				p.lastInfoAt = p.now()
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// writeDiagnostics writes a diagnostics bundle for a failed process and
+// returns its directory ("" if p doesn't write bundles or it failed)
+//
+// KEY CONCEPT: Post-mortem data
+// By the time a service has failed for good, the evidence is gone: its
+// /proc entry disappeared with the process and its output scrolled by
+// in a shared log. So we collect while it runs - recent output, lifecycle
+// events, periodic /proc snapshots - and dump it all, together with the
+// cgroup's counters (which outlive the processes in it) and any core
+// file, into one timestamped directory that can be attached to a ticket.
+func (p *Process) writeDiagnostics(reason string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.DiagnosticsDir == "" {
+		return ""
+	}
+
+	now := p.now()
+	dir := filepath.Join(p.DiagnosticsDir, p.Name+"-"+now.Format("20060102-150405"))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logWarn("%s: diagnostics: %v", p.Name, err)
+		return ""
+	}
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			logWarn("%s: diagnostics: %v", p.Name, err)
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Service:   %s\n", p.Name)
+	fmt.Fprintf(&sb, "Reason:    %s\n", reason)
+	fmt.Fprintf(&sb, "Time:      %s\n", now.Format(time.RFC3339))
+	fmt.Fprintf(&sb, "Command:   %s %s\n", p.Command, strings.Join(p.Args, " "))
+	fmt.Fprintf(&sb, "Exit code: %d\n", p.exitCode)
+	fmt.Fprintf(&sb, "Restarts:  %d/%s\n", p.restarts, p.maxRestarts())
+	fmt.Fprintf(&sb, "Uptime:    %v\n", p.lastUptime)
+	if p.startErr != nil {
+		fmt.Fprintf(&sb, "Error:     %v\n", p.startErr)
+	}
+	write("summary.txt", sb.String())
+
+	if p.output != nil {
+		write("output.log", p.output.String())
+	}
+	write("events.log", strings.Join(p.recentEvents, "\n")+"\n")
+	if p.lastInfo != nil {
+		write("procinfo.txt", fmt.Sprintf("Snapshot taken %s\n\n%s",
+			p.lastInfoAt.Format(time.RFC3339), p.lastInfo.String()))
+	}
+	if p.cgroup != nil {
+		write("cgroup.txt", p.cgroup.Stats())
+	}
+	if p.lastCore != "" {
+		// Keep the core with the rest of the evidence
+		if err := os.Rename(p.lastCore, filepath.Join(dir, filepath.Base(p.lastCore))); err != nil {
+			logWarn("%s: diagnostics: core file: %v", p.Name, err)
+		}
+		p.lastCore = ""
+	}
+
+	logInfo("%s: diagnostics written to %s", p.Name, dir)
+	return dir
+}
+
+// findCore looks for the core file of pid, for kernels whose
+// core_pattern writes plain files to the working directory
+func findCore(pid int) string {
+	pattern, err := os.ReadFile("/proc/sys/kernel/core_pattern")
+	if err != nil || bytes.HasPrefix(pattern, []byte("|")) {
+		return "" // Piped to a handler like systemd-coredump
+	}
+	for _, name := range []string{fmt.Sprintf("core.%d", pid), "core"} {
+		if abs, err := filepath.Abs(name); err == nil {
+			if _, err := os.Stat(abs); err == nil {
+				return abs
+			}
+		}
+	}
+	return ""
+}
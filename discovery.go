@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RegistryTTL is how long an etcd registration outlives gosv if it stops
+// renewing it (e.g. the host died); it's renewed every RegistryTTL/3
+const RegistryTTL = 30 * time.Second
+
+// Registration describes how a service is announced in a service registry
+//
+// KEY CONCEPT: Service discovery
+// Load balancers and clients find instances through a registry instead of
+// static host lists. Whoever starts an instance is best placed to
+// announce it - and to withdraw it the moment the process dies, rather
+// than waiting for health checks to notice.
+type Registration struct {
+	Registry string // "consul://host:port" or "etcd://host:port"
+	Name     string // Name in the registry
+	Address  string // Address clients should use
+	Port     int
+	Health   string // HTTP URL that answers 200 once the service is ready
+}
+
+// deregistrations tracks deregistrations in flight, so shutdown can wait
+// for them instead of leaving stale instances behind
+var deregistrations sync.WaitGroup
+
+// registrar registers one process's instances. Every start or exit bumps
+// gen, so a registration that is still waiting for readiness gives up if
+// the instance it was for has died in the meantime.
+type registrar struct {
+	reg Registration
+	p   *Process // For the supervisor's clock
+
+	mu    sync.Mutex
+	gen   int
+	id    string // Registered instance ID ("" if not registered)
+	lease int64  // etcd lease of the registration
+}
+
+// registrationHooks returns hooks that register p after each start (once
+// Health answers, if set) and deregister it when it exits
+func registrationHooks(reg Registration, p *Process) *Hooks {
+	if reg.Address == "" {
+		reg.Address, _ = os.Hostname()
+	}
+	r := &registrar{reg: reg, p: p}
+	return &Hooks{
+		OnStart: func(ev StartEvent) {
+			r.mu.Lock()
+			r.gen++
+			gen := r.gen
+			r.mu.Unlock()
+			go r.register(gen)
+		},
+		OnExit: func(ev ExitEvent) {
+			r.mu.Lock()
+			r.gen++
+			r.mu.Unlock()
+			deregistrations.Add(1)
+			go func() {
+				defer deregistrations.Done()
+				r.deregister()
+			}()
+		},
+	}
+}
+
+// current reports whether gen is still the latest start
+func (r *registrar) current(gen int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.gen == gen
+}
+
+func (r *registrar) register(gen int) {
+	if r.reg.Health != "" {
+		for !healthy(r.reg.Health) {
+			<-r.p.timeSource().After(time.Second)
+			if !r.current(gen) {
+				return
+			}
+		}
+	}
+
+	id := fmt.Sprintf("%s-%s-%d", r.reg.Name, r.reg.Address, r.reg.Port)
+	var lease int64
+	var err error
+	switch {
+	case strings.HasPrefix(r.reg.Registry, "consul://"):
+		err = r.consulRegister(id)
+	case strings.HasPrefix(r.reg.Registry, "etcd://"):
+		lease, err = r.etcdRegister(id)
+	default:
+		err = fmt.Errorf("unsupported registry %q", r.reg.Registry)
+	}
+	if err != nil {
+		logWarn("register %s: %v", r.reg.Name, err)
+		return
+	}
+
+	r.mu.Lock()
+	r.id, r.lease = id, lease
+	stale := r.gen != gen
+	r.mu.Unlock()
+	logInfo("registered %s (%s:%d) in %s", r.reg.Name, r.reg.Address, r.reg.Port, r.reg.Registry)
+
+	if stale {
+		// Exited while we were registering
+		r.deregister()
+		return
+	}
+	if lease != 0 {
+		r.etcdKeepAlive(lease)
+	}
+}
+
+func (r *registrar) deregister() {
+	r.mu.Lock()
+	id, lease := r.id, r.lease
+	r.id, r.lease = "", 0
+	r.mu.Unlock()
+	if id == "" {
+		return
+	}
+
+	var err error
+	if lease != 0 {
+		// Revoking the lease deletes the key attached to it
+		err = etcdPost(r.reg.Registry, "/v3/lease/revoke", map[string]any{"ID": lease}, nil)
+	} else {
+		err = consulPut(r.reg.Registry, "/v1/agent/service/deregister/"+id, nil, nil)
+	}
+	if err != nil {
+		logWarn("deregister %s: %v", r.reg.Name, err)
+		return
+	}
+	logInfo("deregistered %s from %s", r.reg.Name, r.reg.Registry)
+}
+
+// healthy reports whether url answers 200
+func healthy(url string) bool {
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// consulRegister registers with the local Consul agent, which then runs
+// the health check itself
+func (r *registrar) consulRegister(id string) error {
+	svc := map[string]any{
+		"ID":      id,
+		"Name":    r.reg.Name,
+		"Address": r.reg.Address,
+		"Port":    r.reg.Port,
+	}
+	if r.reg.Health != "" {
+		svc["Check"] = map[string]any{
+			"HTTP":                           r.reg.Health,
+			"Interval":                       "10s",
+			"DeregisterCriticalServiceAfter": "1m",
+		}
+	}
+	return consulPut(r.reg.Registry, "/v1/agent/service/register", svc, nil)
+}
+
+// errNotFound is returned by consulPut for 404 responses
+var errNotFound = errors.New("not found")
+
+// consulPut calls Consul's HTTP API at server ("consul://host:port") and
+// decodes the response into out, if not nil
+func consulPut(server, path string, body, out any) error {
+	data, _ := json.Marshal(body)
+	url := "http://" + strings.TrimPrefix(server, "consul://") + path
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := configClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("PUT %s: %w", path, errNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PUT %s: %s", path, resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// etcdRegister writes /services/<name>/<id> = {"address","port"} under a
+// lease, so the key disappears by itself if gosv stops renewing it
+func (r *registrar) etcdRegister(id string) (int64, error) {
+	var grant struct {
+		ID string `json:"ID"` // int64 as a JSON string
+	}
+	if err := etcdPost(r.reg.Registry, "/v3/lease/grant", map[string]any{"TTL": int(RegistryTTL / time.Second)}, &grant); err != nil {
+		return 0, err
+	}
+	var lease int64
+	fmt.Sscanf(grant.ID, "%d", &lease)
+
+	key := fmt.Sprintf("/services/%s/%s", r.reg.Name, id)
+	value, _ := json.Marshal(map[string]any{"address": r.reg.Address, "port": r.reg.Port})
+	put := map[string]any{
+		"key":   base64.StdEncoding.EncodeToString([]byte(key)),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": lease,
+	}
+	if err := etcdPost(r.reg.Registry, "/v3/kv/put", put, nil); err != nil {
+		return 0, err
+	}
+	return lease, nil
+}
+
+// etcdKeepAlive renews the lease until the instance is deregistered
+func (r *registrar) etcdKeepAlive(lease int64) {
+	for {
+		<-r.p.timeSource().After(RegistryTTL / 3)
+		r.mu.Lock()
+		done := r.lease != lease
+		r.mu.Unlock()
+		if done {
+			return
+		}
+		if err := etcdPost(r.reg.Registry, "/v3/lease/keepalive", map[string]any{"ID": lease}, nil); err != nil {
+			logWarn("renew registration of %s: %v", r.reg.Name, err)
+		}
+	}
+}
+
+// etcdPost calls etcd's v3 JSON gateway at server ("etcd://host:port")
+// and decodes the response into out, if not nil
+func etcdPost(server, path string, body, out any) error {
+	data, _ := json.Marshal(body)
+	url := "http://" + strings.TrimPrefix(server, "etcd://") + path
+	resp, err := configClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST %s: %s", path, resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
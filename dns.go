@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Host files a service's dns overrides replace
+const (
+	hostResolvConf = "/etc/resolv.conf"
+	hostHosts      = "/etc/hosts"
+)
+
+// maxNameservers is how many nameservers the resolver of glibc and musl
+// uses (MAXNS); the rest are ignored
+const maxNameservers = 3
+
+// DNSConfig overrides a service's resolver config and /etc/hosts (the
+// "dns" object of a service)
+type DNSConfig struct {
+	Nameservers []string          `json:"nameservers"` // Replace the host's
+	Search      []string          `json:"search"`      // Replace the host's search domains
+	Options     []string          `json:"options"`     // Replace the host's options, e.g. "ndots:1"
+	Hosts       map[string]string `json:"hosts"`       // Names to resolve to addresses, ahead of /etc/hosts
+}
+
+func (c *DNSConfig) validate() error {
+	if len(c.Nameservers) > maxNameservers {
+		return fmt.Errorf("dns: at most %d nameservers are used, not %d", maxNameservers, len(c.Nameservers))
+	}
+	for _, ns := range c.Nameservers {
+		if _, err := netip.ParseAddr(ns); err != nil {
+			return fmt.Errorf("dns: nameserver %q is not an IP address", ns)
+		}
+	}
+	for _, word := range slices.Concat(c.Search, c.Options) {
+		if word == "" || strings.ContainsAny(word, " \t\n#;") {
+			return fmt.Errorf("dns: invalid search domain or option %q", word)
+		}
+	}
+	for name, addr := range c.Hosts {
+		if name == "" || strings.ContainsAny(name, " \t\n#") {
+			return fmt.Errorf("dns: hosts: invalid name %q", name)
+		}
+		if _, err := netip.ParseAddr(addr); err != nil {
+			return fmt.Errorf("dns: hosts: %s: %q is not an IP address", name, addr)
+		}
+	}
+	return nil
+}
+
+// overridesResolver reports whether c changes resolv.conf
+func (c *DNSConfig) overridesResolver() bool {
+	return len(c.Nameservers) > 0 || len(c.Search) > 0 || len(c.Options) > 0
+}
+
+// String describes c for --dry-run
+func (c *DNSConfig) String() string {
+	var parts []string
+	if len(c.Nameservers) > 0 {
+		parts = append(parts, "nameservers "+strings.Join(c.Nameservers, " "))
+	}
+	if len(c.Search) > 0 {
+		parts = append(parts, "search "+strings.Join(c.Search, " "))
+	}
+	if len(c.Options) > 0 {
+		parts = append(parts, "options "+strings.Join(c.Options, " "))
+	}
+	names := make([]string, 0, len(c.Hosts))
+	for name := range c.Hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, name+" = "+c.Hosts[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// resolvConf returns host, the host's resolv.conf, with the lines c
+// replaces dropped and c's appended
+func (c *DNSConfig) resolvConf(host []byte) []byte {
+	var b bytes.Buffer
+	for _, line := range strings.SplitAfter(string(host), "\n") {
+		keyword, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+		keyword, _, _ = strings.Cut(keyword, "\t")
+		switch {
+		case keyword == "nameserver" && len(c.Nameservers) > 0,
+			(keyword == "search" || keyword == "domain") && len(c.Search) > 0,
+			keyword == "options" && len(c.Options) > 0:
+			continue
+		}
+		b.WriteString(line)
+	}
+	if b.Len() > 0 && !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	b.WriteString("# Set by gosv\n")
+	for _, ns := range c.Nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(c.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(c.Search, " "))
+	}
+	if len(c.Options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(c.Options, " "))
+	}
+	return b.Bytes()
+}
+
+// hostsFile returns c's hosts entries followed by host, the host's
+// /etc/hosts. Resolvers take the first entry of a name, so c's win.
+func (c *DNSConfig) hostsFile(host []byte) []byte {
+	byAddr := make(map[string][]string)
+	for name, addr := range c.Hosts {
+		byAddr[addr] = append(byAddr[addr], name)
+	}
+	addrs := make([]string, 0, len(byAddr))
+	for addr := range byAddr {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	var b bytes.Buffer
+	b.WriteString("# Set by gosv\n")
+	for _, addr := range addrs {
+		names := byAddr[addr]
+		sort.Strings(names)
+		fmt.Fprintf(&b, "%s\t%s\n", addr, strings.Join(names, " "))
+	}
+	b.WriteString("\n")
+	b.Write(host)
+	return b.Bytes()
+}
+
+// dnsDir returns the directory of p's resolv.conf and hosts files, in
+// gosv's runtime dir
+func (p *Process) dnsDir() string {
+	return filepath.Join(runtimeDir(), "dns", p.Name)
+}
+
+// dnsMounts returns the read-only bind mounts that put p's resolv.conf
+// and hosts files over the host's
+func (p *Process) dnsMounts() []Mount {
+	if p.DNS == nil {
+		return nil
+	}
+	var mounts []Mount
+	if p.DNS.overridesResolver() {
+		mounts = append(mounts, Mount{Type: "bind", Source: filepath.Join(p.dnsDir(), "resolv.conf"), Target: hostResolvConf, ReadOnly: true})
+	}
+	if len(p.DNS.Hosts) > 0 {
+		mounts = append(mounts, Mount{Type: "bind", Source: filepath.Join(p.dnsDir(), "hosts"), Target: hostHosts, ReadOnly: true})
+	}
+	return mounts
+}
+
+// allMounts returns p's mounts, followed by those of its dns overrides
+func (p *Process) allMounts() []Mount {
+	return append(slices.Clip(p.Mounts), p.dnsMounts()...)
+}
+
+// setupDNS writes p's resolv.conf and hosts files from the host's and
+// p.DNS. Caller must hold p.mu.
+//
+// KEY CONCEPT: Pointing one service elsewhere
+// Every resolver on the host reads the same /etc/resolv.conf and
+// /etc/hosts, so the usual ways to point a service at a test database or
+// a staging API - an /etc/hosts line, another nameserver - point every
+// service there too. A mount namespace gives a service its own view of
+// files: gosv writes a copy of the host's files with the overrides in
+// them, and bind-mounts it over /etc/resolv.conf and /etc/hosts in the
+// service's namespace only. The copies are made at each start, so a
+// restart picks up changes to the host's files.
+func (p *Process) setupDNS() error {
+	if len(p.dnsMounts()) == 0 {
+		return nil
+	}
+	dir := p.dnsDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+	files := []struct {
+		host, name string
+		render     func([]byte) []byte
+		used       bool
+	}{
+		{hostResolvConf, "resolv.conf", p.DNS.resolvConf, p.DNS.overridesResolver()},
+		{hostHosts, "hosts", p.DNS.hostsFile, len(p.DNS.Hosts) > 0},
+	}
+	for _, f := range files {
+		if !f.used {
+			continue
+		}
+		host, err := os.ReadFile(f.host)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("dns: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, f.name), f.render(host), 0644); err != nil {
+			return fmt.Errorf("dns: %w", err)
+		}
+	}
+	return nil
+}
+
+// removeDNS deletes p's resolv.conf and hosts files
+func (p *Process) removeDNS() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.DNS != nil {
+		os.RemoveAll(p.dnsDir())
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import "time"
+
+// DefaultDrainTimeout is how long a service gets to finish in-flight work
+// after its drain signal when drain_timeout_sec is not configured
+const DefaultDrainTimeout = 30 * time.Second
+
+// drain asks services to stop taking new work before a shutdown.
+//
+// Phase 0 of shutdown for rolling host maintenance:
+//  1. Stop restarting anything (a drained service that exits stays down)
+//  2. Send each service its configured drain signal (e.g. SIGUSR1)
+//  3. Wait until every drained service has exited or hit its drain timeout
+//
+// The caller then proceeds with gracefulShutdown as usual.
+func (s *Supervisor) drain() {
+	logInfo("draining: restarts disabled")
+	s.mu.Lock()
+	s.draining = true
+	procs := make([]*Process, 0, len(s.processes))
+	for _, p := range s.processes {
+		procs = append(procs, p)
+	}
+	s.mu.Unlock()
+
+	now := s.clock.Now()
+	deadlines := make(map[*Process]time.Time)
+	for _, p := range procs {
+		p.mu.Lock()
+		running := p.state == StateRunning
+		sig, timeout := p.DrainSignal, p.DrainTimeout
+		p.mu.Unlock()
+
+		if !running || sig == 0 {
+			continue
+		}
+		logInfo("sending %v to %s, waiting up to %v", sig, p.Name, timeout)
+		if err := p.Signal(sig); err != nil {
+			continue
+		}
+		deadlines[p] = now.Add(timeout)
+	}
+
+	ticker := s.clock.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for len(deadlines) > 0 {
+		<-ticker.C()
+		// Reap so exited services show up as stopped
+		s.reapZombies()
+
+		for p, deadline := range deadlines {
+			p.mu.Lock()
+			exited := p.pid == 0
+			p.mu.Unlock()
+
+			if exited {
+				logInfo("%s drained", p.Name)
+				delete(deadlines, p)
+			} else if s.clock.Now().After(deadline) {
+				logWarn("%s still running after drain timeout", p.Name)
+				delete(deadlines, p)
+			}
+		}
+	}
+}
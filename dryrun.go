@@ -0,0 +1,488 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bootOrder returns the processes in the order Run starts them: by name,
+// each after the services its After names (checkRelations ruled out
+// cycles)
+func (s *Supervisor) bootOrder() []*Process {
+	procs := s.snapshot()
+	ordered, err := startOrder(procs)
+	if err != nil {
+		// Only processes added without parseConfig can get here
+		logWarn("%v, starting services by name", err)
+		sort.Slice(procs, func(i, j int) bool { return procs[i].Name < procs[j].Name })
+		return procs
+	}
+	return ordered
+}
+
+// plannedCgroupBase returns where EnsureControllers would most likely put
+// service cgroups (see findWritableCgroupBase), without creating anything
+func plannedCgroupBase() (string, error) {
+	m, err := readCgroupMount()
+	if err != nil {
+		return "", err
+	}
+	if m.readOnly {
+		return "", fmt.Errorf("%s is mounted read-only", cgroupRoot)
+	}
+	if self, err := selfCgroupDir(m); err == nil {
+		return self, nil
+	}
+	return filepath.Join(cgroupRoot, "gosv"), nil
+}
+
+// dryRun prints what gosv would do with the services registered with s,
+// without starting, creating or changing anything
+//
+// KEY CONCEPT: Reviewable changes
+// A supervisor config is code that runs as root: a typo in a mount turns
+// a read-only bind writable, a missing user field runs a service as root.
+// Change management wants to see the effect before it happens, in terms
+// of what the kernel will be asked to do - which uid, which cgroup files
+// with which values, which namespaces - not just a diff of the JSON. The
+// dry run resolves everything the config leaves implicit (defaults,
+// group defaults, start order, derived paths) the same way a real start
+// would, and stops short of the first system call with an effect.
+func (s *Supervisor) dryRun(w io.Writer, cgroups bool) {
+	procs := s.bootOrder()
+	l := s.selfLimits
+	selfCg := l != nil && (l.MemoryMB > 0 || l.CPUPercent > 0 || l.PidsMax > 0)
+	base := ""
+	if cgroups {
+		var err error
+		if base, err = plannedCgroupBase(); err != nil {
+			fmt.Fprintf(w, "cgroups: unavailable (%v)\n", err)
+			cgroups = false
+		} else {
+			fmt.Fprintf(w, "cgroup base: %s\n", base)
+		}
+	} else if !cgroupsSupported {
+		fmt.Fprintf(w, "cgroups: not available on %s\n", runtime.GOOS)
+	} else {
+		fmt.Fprintln(w, "cgroups: disabled (--no-cgroup)")
+	}
+	if l != nil {
+		fmt.Fprintf(w, "supervisor: mem=%dMB cpu=%d%% pids=%d", l.MemoryMB, l.CPUPercent, l.PidsMax)
+		if selfCg && cgroups {
+			fmt.Fprintf(w, " in %s", filepath.Join(base, "supervisor"))
+		}
+		if l.OOMScoreAdj != nil {
+			fmt.Fprintf(w, " oom_score_adj=%d", *l.OOMScoreAdj)
+		}
+		fmt.Fprintln(w)
+	}
+	if s.throttle != nil {
+		fmt.Fprintf(w, "restarts: at most %d in flight, %v settle\n", s.throttle.max, s.throttle.settle)
+	}
+	groups := make([]string, 0, len(s.restartBudgets))
+	for g := range s.restartBudgets {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	for _, g := range groups {
+		b := s.restartBudgets[g].cfg
+		fmt.Fprintf(w, "restarts of @%s: %d, then %g per minute for the whole group\n", g, b.Burst, b.PerMinute)
+	}
+	if c := s.lokiConfig; c != nil {
+		instance := c.Instance
+		if instance == "" {
+			instance = configName(s.configSource)
+		}
+		fmt.Fprintf(w, "loki: output of all services to %s, instance %s\n", c.URL, instance)
+	}
+	if s.eventJournalPath != "" {
+		maxMB := s.eventJournalMB
+		if maxMB <= 0 {
+			maxMB = DefaultEventJournalMB
+		}
+		fmt.Fprintf(w, "events: journaled to %s (up to %d MB)\n", s.eventJournalPath, maxMB)
+	}
+	if s.stateDB != "" {
+		retention, sample := s.stateRetentionDays, s.stateSampleSec
+		if retention <= 0 {
+			retention = DefaultStateRetentionDays
+		}
+		if sample <= 0 {
+			sample = DefaultStateSampleSec
+		}
+		revisions := s.stateRevisions
+		if revisions <= 0 {
+			revisions = DefaultStateRevisions
+		}
+		fmt.Fprintf(w, "history: %s, kept %d days, memory sampled every %ds, %d revisions per service",
+			s.stateDB, retention, sample, revisions)
+		if sqliteDriver() == "" {
+			fmt.Fprint(w, " (but this gosv is built without SQLite)")
+		}
+		fmt.Fprintln(w)
+	}
+	if c := s.webhookConfig; c != nil {
+		fmt.Fprintf(w, "webhooks: on %s://%s/hooks/<action>, signed with the key in %s%s\n", c.scheme(), c.Listen, c.SecretFile, c.describeClients())
+		for _, line := range webhookActions(c) {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+	if c := s.statusPageConfig; c != nil {
+		fmt.Fprintf(w, "status page: %s://%s/ and /status.json, showing %s", c.scheme(), c.Listen, strings.Join(c.fields(), ", "))
+		if c.Selector != "" {
+			fmt.Fprintf(w, " of the services matching %s", c.Selector)
+		}
+		fmt.Fprint(w, c.describeClients())
+		fmt.Fprintln(w)
+	}
+	if c := s.agentConfig; c != nil {
+		security := "TLS"
+		switch {
+		case c.Plaintext:
+			security = "plaintext"
+		case c.CertFile != "":
+			security = "TLS with the client certificate " + c.CertFile
+		}
+		fmt.Fprintf(w, "agent: reports to the controller %s as %s (%s), status every %v; takes %s",
+			c.Controller, c.name(), security, c.statusInterval(), strings.Join(agentCommands, ", "))
+		if newAgentTransport == nil {
+			fmt.Fprint(w, " (but this gosv is built without the agent)")
+		}
+		fmt.Fprintln(w)
+	}
+	if s.networkAccounting {
+		fmt.Fprintf(w, "network accounting: TCP bytes and connections per service, sampled every %v\n", LeakSampleInterval)
+	}
+	var pools []*resourcePool
+	if m := resourcePools.Load(); m != nil {
+		for _, pl := range *m {
+			pools = append(pools, pl)
+		}
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].name < pools[j].name })
+	for _, pl := range pools {
+		fmt.Fprintf(w, "pool %s: ", pl.name)
+		if pl.memory > 0 || pl.cpu > 0 {
+			fmt.Fprintf(w, "%s for all", formatLimits(pl.memory, pl.cpu))
+			if cgroups {
+				fmt.Fprintf(w, " in %s", filepath.Join(base, pl.name+".pool"))
+			}
+		} else {
+			fmt.Fprint(w, "no budget")
+		}
+		fmt.Fprintf(w, "; jobs %d at a time", pl.concurrency)
+		if pl.maxQueued > 0 {
+			fmt.Fprintf(w, ", up to %d queued", pl.maxQueued)
+		}
+		if pw := s.pressure[pl.name]; pw != nil {
+			fmt.Fprintf(w, "; %s", pw.cfg.describe())
+		}
+		if limits := describeProfileLimits(pl.config.ProfileLimits); len(limits) > 0 {
+			fmt.Fprintf(w, "; by limit profile %s", strings.Join(limits, "; "))
+		}
+		fmt.Fprintln(w)
+	}
+	if profiles := s.describeProfiles(); profiles != "" {
+		fmt.Fprintln(w, profiles)
+	}
+	if pw := s.pressure[""]; pw != nil {
+		fmt.Fprintf(w, "memory pressure: %s\n", pw.cfg.describe())
+	}
+	fmt.Fprintln(w)
+
+	n := 0
+	for _, p := range procs {
+		fmt.Fprintf(w, "%s\n", p.Name)
+		row := func(key, format string, args ...any) {
+			if key != "" {
+				key += ":"
+			}
+			fmt.Fprintf(w, "  %-11s %s\n", key, fmt.Sprintf(format, args...))
+		}
+
+		row("command", "%s", strings.Join(append([]string{p.Command}, p.Args...), " "))
+		if rec, ok := s.deploys[p.Name]; ok && rec.Via == RevisionRollback {
+			row("rolled back", "to revision %d at %s, instead of the config entry (see ctl revisions)", rec.Revision,
+				rec.At.Local().Format("2006-01-02 15:04:05"))
+		} else if ok {
+			row("deployed", "%s at %s, instead of the config's command (see ctl deploy)", rec.Command,
+				rec.At.Local().Format("2006-01-02 15:04:05"))
+		}
+		if p.Adopt {
+			row("adopts", "the process %s names, if it runs %s", p.PIDFile, p.Command)
+		}
+		if p.Forking {
+			row("daemon", "forks; pid read from %s (within %v)", p.PIDFile, DaemonizeTimeout)
+		}
+		switch {
+		case p.Lock != nil:
+			row("start", "once holding lock %s on %s", p.Lock.Key, p.Lock.Server)
+		case len(p.ActivatePaths) > 0 && !pathsHaveContent(p.ActivatePaths):
+			row("start", "once %s has content", strings.Join(p.ActivatePaths, ", "))
+		default:
+			delay := s.startDelay(p, n)
+			n++
+			if delay > 0 {
+				row("start", "at boot, after %v", delay)
+			} else {
+				row("start", "at boot")
+			}
+		}
+		for _, t := range p.WaitFor {
+			row("waits for", "%s (up to %v)", t, waitTimeout(p))
+		}
+		if p.ReadyCheck != nil {
+			row("ready", "once %s answers, restarted if not within %v, failing readiness after %d misses in a row",
+				p.ReadyCheck, p.ReadyTimeout, p.readyFailures())
+		}
+		if p.Conditions != nil {
+			if why := p.Conditions.check(); why != "" {
+				row("conditions", "not met now, would be skipped: %s", why)
+			} else {
+				row("conditions", "met now")
+			}
+		}
+		if len(p.PartOf) > 0 {
+			row("part of", "%s", strings.Join(p.PartOf, ", "))
+		}
+		if len(p.BindsTo) > 0 {
+			row("binds to", "%s", strings.Join(p.BindsTo, ", "))
+		}
+		if len(p.After) > 0 {
+			row("after", "%s", strings.Join(p.After, ", "))
+		}
+
+		if p.RunAs != nil {
+			row("user", "%s (uid %d, gid %d, groups %v)", p.RunAs.User, p.RunAs.Uid, p.RunAs.Gid, p.RunAs.Groups)
+		} else if p.UserNS != nil {
+			row("user", "root in a user namespace, uid map %v, gid map %v", p.UserNS.UIDMap, p.UserNS.GIDMap)
+		} else {
+			row("user", "same as gosv")
+		}
+		if len(p.Env) > 0 {
+			names := make([]string, 0, len(p.Env))
+			for name := range p.Env {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			row("env", "sets %s", strings.Join(names, " "))
+		}
+		for _, name := range p.allLogSinks() {
+			sink := s.logSinkConfigs[name]
+			var streams []string
+			for _, stream := range []string{"stdout", "stderr"} {
+				if slices.Contains(p.streamOutput(stream).sinks, name) {
+					streams = append(streams, stream)
+				}
+			}
+			what := "output"
+			if len(streams) == 1 {
+				what = streams[0]
+			}
+			row("forwards", "%s to %s (%s, %s)", what, name, sink.Type, sink.address())
+		}
+		if tags := p.describeSyslog(s.logSinkConfigs); tags != "" {
+			row("syslog", "%s", tags)
+		}
+		if p.Stdout != nil || p.Stderr != nil {
+			for _, stream := range []string{"stdout", "stderr"} {
+				row(stream, "%s", p.streamOutput(stream))
+			}
+		}
+		if p.LogDedup {
+			row("output", "repeated lines collapsed")
+		}
+		if f := newLogFilter(p); f != nil && f.rate > 0 {
+			row("output", "at most %d lines/s, bursts of %g", p.LogRateLimit, f.burst)
+		}
+		if len(p.EnvDefaults) > 0 {
+			row("env", "defaults %s", formatEnvDefaults(p.EnvDefaults))
+		}
+		if p.Pool != "" {
+			row("pool", "%s", p.Pool)
+		}
+		for _, limits := range describeProfileLimits(p.ProfileLimits) {
+			row("profile", "%s", limits)
+		}
+		if p.EvictionPriority > 0 {
+			row("evict", "%s under memory pressure, priority %d", p.EvictionAction, p.EvictionPriority)
+		}
+		if cgroups && (p.needsCgroup() || selfCg) {
+			name := p.Name
+			if p.inLimitedPool() {
+				name = filepath.Join(p.Pool+".pool", p.Name)
+			}
+			row("cgroup", "%s", filepath.Join(base, name))
+			for _, limit := range plannedLimits(p) {
+				row("", "%s", limit)
+			}
+		} else if limits := p.fallbackLimits(); len(limits) > 0 {
+			for _, limit := range limits {
+				row("limits", "%s", limit)
+			}
+		} else {
+			row("cgroup", "gosv's (no limits)")
+		}
+		if iso := isolationOf(p); len(iso) > 0 {
+			row("isolation", "%s", strings.Join(iso, ", "))
+		}
+		if len(p.cpuList) > 0 {
+			row("cpus", "%s", p.describeCPUs())
+		}
+		if p.Placement != "" {
+			row("placement", "%s", p.describePlacement())
+		}
+		if p.DNS != nil {
+			row("dns", "%s", p.DNS)
+		}
+		for _, m := range p.Ports {
+			row("port", "%s (into its network namespace)", m)
+		}
+		for i, sock := range p.Sockets {
+			row("socket", "%s (fd %d)", sock, 3+i)
+		}
+		if p.RestartMode == RestartModeHandoff {
+			row("restart mode", "handoff: the new instance starts before the old one stops")
+		}
+		for _, m := range p.Mounts {
+			ro := ""
+			if m.ReadOnly {
+				ro = " (read-only)"
+			}
+			if m.Type == "tmpfs" {
+				row("mount", "tmpfs on %s%s", m.Target, ro)
+			} else {
+				row("mount", "%s on %s%s", m.Source, m.Target, ro)
+			}
+		}
+
+		restart := fmt.Sprintf("up to %d times, %v then x%g", p.MaxRestarts, p.RestartDelay, p.BackoffFactor)
+		if p.MaxRestarts == UnlimitedRestarts {
+			restart = fmt.Sprintf("without limit, %v then x%g", p.RestartDelay, p.BackoffFactor)
+		}
+		switch {
+		case p.isMain():
+			restart = "never (its exit ends gosv)"
+		case p.Restart == RestartNever:
+			restart = "never (restart is no)"
+		case p.Restart == RestartOnFailure:
+			restart += ", after failures only"
+		}
+		row("restart", "%s", restart)
+		stop := fmt.Sprintf("stage %d, kill mode %s, %v before SIGKILL", p.ShutdownPriority, killModeOrDefault(p.KillMode), stopTimeout(p))
+		if p.Critical {
+			stop += ", critical"
+		}
+		row("stop", "%s", stop)
+		fmt.Fprintln(w)
+	}
+
+	g := buildGraph(procs)
+	fmt.Fprintln(w, "shutdown order:")
+	for i, stage := range g.stages {
+		names := make([]string, len(g.nodes[stage]))
+		for j, p := range g.nodes[stage] {
+			names[j] = p.Name
+		}
+		fmt.Fprintf(w, "  %d. %s\n", i+1, strings.Join(names, ", "))
+	}
+}
+
+// plannedLimits lists the cgroup files a start of p would write
+func plannedLimits(p *Process) []string {
+	var limits []string
+	if p.MemoryLimit > 0 {
+		limits = append(limits, fmt.Sprintf("memory.max = %d (%s)", p.MemoryLimit, formatBytes(p.MemoryLimit)))
+	}
+	if p.CPUQuota > 0 {
+		limits = append(limits, fmt.Sprintf("cpu.max = %d 100000 (%d%%)", p.CPUQuota*1000, p.CPUQuota))
+	}
+	sizes := make([]string, 0, len(p.HugeTLBLimits))
+	for size := range p.HugeTLBLimits {
+		sizes = append(sizes, size)
+	}
+	sort.Strings(sizes)
+	for _, size := range sizes {
+		limits = append(limits, fmt.Sprintf("hugetlb.%s.max = %d", size, p.HugeTLBLimits[size]))
+	}
+	if len(p.GPUs) > 0 {
+		limits = append(limits, fmt.Sprintf("device filter: NVIDIA GPUs %v only, %s", p.GPUs, gpuEnv(p.GPUs)[1]))
+	}
+	if len(p.cpuList) > 0 {
+		limits = append(limits, "cpuset.cpus = "+formatCPUList(p.cpuList))
+	}
+	if len(p.memNodes) > 0 {
+		limits = append(limits, "cpuset.mems = "+formatCPUList(p.memNodes))
+	}
+	if p.EgressMbit > 0 {
+		limits = append(limits, egress.describe(p.EgressMbit))
+	}
+	if p.DelegateCgroup {
+		limits = append(limits, "delegated: the service owns the subtree (cgroup namespace)")
+	}
+	return limits
+}
+
+// isolationOf lists the sandboxing a start of p would set up
+func isolationOf(p *Process) []string {
+	var iso []string
+	if p.PrivateTmp {
+		iso = append(iso, "private /tmp")
+	}
+	if p.PrivateDevices {
+		iso = append(iso, "private /dev")
+	}
+	if p.UserNS != nil {
+		iso = append(iso, "user namespace")
+	}
+	if p.PrivateNetwork {
+		iso = append(iso, "private network (loopback only)")
+	}
+	if p.AppArmorProfile != "" {
+		iso = append(iso, "apparmor "+p.AppArmorProfile)
+	}
+	if p.SELinuxLabel != "" {
+		iso = append(iso, "selinux "+p.SELinuxLabel)
+	}
+	if len(p.Credentials) > 0 {
+		iso = append(iso, fmt.Sprintf("%d credentials on a private tmpfs", len(p.Credentials)))
+	}
+	if p.ClearEnv {
+		if len(p.PassEnv) > 0 {
+			iso = append(iso, "environment cleared but "+strings.Join(p.PassEnv, " "))
+		} else {
+			iso = append(iso, "environment cleared")
+		}
+	}
+	if p.TTY {
+		iso = append(iso, "pty")
+	}
+	return iso
+}
+
+func waitTimeout(p *Process) time.Duration {
+	if p.WaitTimeout == 0 {
+		return DefaultWaitTimeout
+	}
+	return p.WaitTimeout
+}
+
+func stopTimeout(p *Process) time.Duration {
+	if p.StopTimeout == 0 {
+		return DefaultStopTimeout
+	}
+	return p.StopTimeout
+}
+
+func killModeOrDefault(mode string) string {
+	if mode == "" {
+		return "process-group"
+	}
+	return mode
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strings"
+)
+
+// defaultPath is the PATH of a service whose environment has none
+// (systemd's default)
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// defaultLang is the LANG of a service whose environment has none: UTF-8
+// without any language's conventions, built into glibc and musl
+const defaultLang = "C.UTF-8"
+
+// envDefaultNames are the variables env_defaults may set
+var envDefaultNames = []string{"PATH", "TZ", "LANG", "HOME"}
+
+// validPassEnv checks the pass_env patterns of a service
+func validPassEnv(patterns []string) error {
+	for _, pat := range patterns {
+		if pat == "" || strings.Contains(pat, "=") {
+			return fmt.Errorf("%q is not a variable name or pattern", pat)
+		}
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("%q: %w", pat, err)
+		}
+	}
+	return nil
+}
+
+// validEnvDefaults checks env_defaults: only envDefaultNames, with values
+func validEnvDefaults(defaults map[string]string) error {
+	for name, value := range defaults {
+		known := false
+		for _, n := range envDefaultNames {
+			known = known || n == name
+		}
+		if !known {
+			return fmt.Errorf("%q can't have a default (only %s)", name, strings.Join(envDefaultNames, ", "))
+		}
+		if value == "" {
+			return fmt.Errorf("%s: empty default", name)
+		}
+	}
+	return nil
+}
+
+// mergeEnvDefaults returns the env_defaults of a service: the global
+// ones, overridden by the service's own (nil if there are neither)
+func mergeEnvDefaults(global, service map[string]string) map[string]string {
+	if len(global) == 0 && len(service) == 0 {
+		return nil
+	}
+	merged := make(map[string]string, len(global)+len(service))
+	for name, value := range global {
+		merged[name] = value
+	}
+	for name, value := range service {
+		merged[name] = value
+	}
+	return merged
+}
+
+// environ returns the environment p starts with, before gosv adds its
+// own variables
+//
+// KEY CONCEPT: Environment inheritance
+// A child gets a copy of its parent's environment, and a supervisor's
+// environment is whatever its own parent had: a login shell's variables,
+// SSH_AUTH_SOCK, cloud credentials in AWS_*, tokens exported for one tool.
+// By default every service inherits all of it, and passes it on to
+// everything it runs. With clear_env a service starts from an empty
+// environment instead, and gets only the variables pass_env lists, by
+// name or glob pattern ("LC_*"). env sets variables of the service's own,
+// over any of these. Variables gosv sets itself
+// ($CREDENTIALS_DIRECTORY, the GPU variables, USER for a user) are added
+// on top.
+//
+// The opposite problem is an environment that is too small: gosv started
+// by an init system, a container runtime or a cron job has little more
+// than PATH, if that. Without HOME, Go's os.UserHomeDir and many tools
+// fail; without LANG, programs fall back to ASCII and mangle UTF-8; without
+// PATH, a service's scripts can't find anything. So each of these gets a
+// value when the environment has none (see defaultEnv).
+func (p *Process) environ() []string {
+	var env []string
+	if p.ClearEnv {
+		for _, kv := range os.Environ() {
+			name, _, _ := strings.Cut(kv, "=")
+			if passesEnv(p.PassEnv, name) {
+				env = append(env, kv)
+			}
+		}
+	} else {
+		env = os.Environ()
+	}
+
+	have := make(map[string]bool, len(env))
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		have[name] = true
+	}
+	for _, name := range envDefaultNames {
+		// gosv's own HOME is never right for another user
+		if have[name] && !(name == "HOME" && p.RunAs != nil) {
+			continue
+		}
+		if value := p.defaultEnv(name); value != "" {
+			env = append(env, name+"="+value)
+		}
+	}
+	// Set last, so they win over inherited variables and defaults
+	names := make([]string, 0, len(p.Env))
+	for name := range p.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+p.Env[name])
+	}
+	return env
+}
+
+// defaultEnv returns the value of name for p when its environment has
+// none: the env_defaults entry, else PATH and LANG fall back to
+// defaultPath and defaultLang and HOME to the home of the service's user.
+// TZ has no fallback; without it, libc reads /etc/localtime.
+func (p *Process) defaultEnv(name string) string {
+	if value, ok := p.EnvDefaults[name]; ok {
+		return value
+	}
+	switch name {
+	case "PATH":
+		return defaultPath
+	case "LANG":
+		return defaultLang
+	case "HOME":
+		if p.RunAs != nil {
+			return p.RunAs.Home
+		}
+		if u, err := user.Current(); err == nil && u.HomeDir != "" {
+			return u.HomeDir
+		}
+		return "/"
+	}
+	return ""
+}
+
+// passesEnv reports whether name matches one of patterns
+func passesEnv(patterns []string, name string) bool {
+	for _, pat := range patterns {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// formatEnvDefaults lists env_defaults as NAME=value, for --dry-run
+func formatEnvDefaults(defaults map[string]string) string {
+	var vars []string
+	for name, value := range defaults {
+		vars = append(vars, name+"="+value)
+	}
+	sort.Strings(vars)
+	return strings.Join(vars, " ")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error classes callers can test for with errors.Is / errors.As
+var (
+	// ErrCgroupUnavailable means no writable cgroup v2 hierarchy was found
+	// (or cgroups were never initialized); resource limits can't be applied
+	ErrCgroupUnavailable = errors.New("cgroups unavailable")
+
+	// ErrRestartExhausted means a service used up MaxRestarts and gosv
+	// gave up on it
+	ErrRestartExhausted = errors.New("restart attempts exhausted")
+
+	// ErrUnknownService means no service with the given name is registered
+	ErrUnknownService = errors.New("unknown service")
+
+	// ErrDuplicateService means a service with the same name already exists
+	ErrDuplicateService = errors.New("duplicate service name")
+
+	// ErrNotRunning means the operation needs a running process
+	ErrNotRunning = errors.New("process not running")
+
+	// ErrRolledBack means a deploy failed, and the services it changed
+	// went back to their previous command
+	ErrRolledBack = errors.New("rolled back")
+)
+
+// ErrStartFailed is returned when a service could not be spawned
+type ErrStartFailed struct {
+	Service string
+	Cause   error
+}
+
+func (e *ErrStartFailed) Error() string {
+	return fmt.Sprintf("failed to start %s: %v", e.Service, e.Cause)
+}
+
+func (e *ErrStartFailed) Unwrap() error {
+	return e.Cause
+}
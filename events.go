@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// DefaultEventJournalMB bounds the event journal when
+// event_journal_max_mb is not configured
+const DefaultEventJournalMB = 16
+
+// Event kinds
+const (
+	EventStart       = "start"        // Started, or adopted
+	EventStartFailed = "start-failed" // Couldn't start, or didn't daemonize
+	EventDaemonize   = "daemonize"    // A forking service's daemon took over
+	EventSkip        = "skip"         // Skipped, a condition failed
+	EventExit        = "exit"         // Exited (code and uptime)
+	EventUsage       = "usage"        // Resources the run used
+	EventKernel      = "kernel"       // What the kernel logged about a kill
+	EventRestart     = "restart"      // Restart scheduled
+	EventExhausted   = "exhausted"    // Out of restarts, given up
+	EventUnready     = "unready"      // Not ready in time after a start, restarted
+	EventReady       = "ready"        // Ready again after failing readiness
+	EventUnstable    = "unstable"     // A group spent its restart budget
+	EventStable      = "stable"       // A group's restart budget is full again
+	EventStop        = "stop"         // Stopped on request or with a bound service
+	EventCancel      = "cancel"       // Scheduled restart canceled on request
+	EventLimits      = "limits"       // Limits changed at runtime
+	EventDeploy      = "deploy"       // A new command deployed
+	EventRollback    = "rollback"     // A failed deploy undone, or a rollback to a revision
+	EventHandoff     = "handoff"      // Restarted by handing its sockets to a new instance
+	EventEvict       = "evict"        // Stopped or frozen under memory pressure
+	EventReadmit     = "readmit"      // Back after memory pressure subsided
+	EventWebhook     = "webhook"      // A webhook triggered an action
+	EventBoot        = "boot"         // gosv started
+	EventReload      = "reload"       // gosv applied a changed config
+	EventShutdown    = "shutdown"     // gosv is stopping
+)
+
+// Event is one entry of the event journal: something that happened to a
+// service, or to gosv itself (Service empty)
+type Event struct {
+	Time    time.Time `json:"time"`
+	Service string    `json:"service,omitempty"`
+	Kind    string    `json:"kind"`
+	PID     int       `json:"pid,omitempty"`
+	Msg     string    `json:"msg"`
+}
+
+// EventQuery selects events from the journal. Zero fields match all.
+type EventQuery struct {
+	Since    time.Time
+	Until    time.Time
+	Services []string // "gosv" for gosv's own events
+	Kinds    []string
+}
+
+// matches reports whether q selects ev
+func (q EventQuery) matches(ev Event) bool {
+	service := ev.Service
+	if service == "" {
+		service = "gosv"
+	}
+	return (q.Since.IsZero() || !ev.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || ev.Time.Before(q.Until)) &&
+		(len(q.Services) == 0 || slices.Contains(q.Services, service)) &&
+		(len(q.Kinds) == 0 || slices.Contains(q.Kinds, ev.Kind))
+}
+
+// eventJournal is the open journal (nil without event_journal). Processes
+// record into it under their own lock, so it's not reached through s.
+var eventJournal atomic.Pointer[journal]
+
+// journal appends events to a file of JSON lines, one per event
+//
+// KEY CONCEPT: Bounded journals
+// "What happened to worker-3 around 02:00?" gets asked in the morning,
+// long after the terminal scrolled and maybe after gosv itself was
+// restarted - the answer has to be on disk. But a service in a crash
+// loop produces events all night, and a journal that grows without bound
+// fills the disk it's meant to help diagnose. The classic answer is
+// rotation with a fixed number of files (logrotate, journald's
+// SystemMaxUse=): when the current file reaches half the budget it
+// becomes the previous one, replacing the old previous one, so the
+// journal never takes more than its budget and always holds at least the
+// most recent half of it. JSON lines keep it greppable and let a reader
+// skip a line torn by a crash.
+type journal struct {
+	path string
+	max  int64 // Bytes per file; there are two
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	warned bool
+}
+
+// openJournal opens the journal at path, keeping it under maxMB
+func openJournal(path string, maxMB int) (*journal, error) {
+	if maxMB <= 0 {
+		maxMB = DefaultEventJournalMB
+	}
+	j := &journal{path: path, max: int64(maxMB) << 20 / 2}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// open (re)opens the current file for appending
+func (j *journal) open() error {
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("event journal: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("event journal: %w", err)
+	}
+	j.f, j.size = f, info.Size()
+	return nil
+}
+
+// record appends ev, rotating first if the current file is full
+func (j *journal) record(ev Event) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return // Closed
+	}
+	if j.size > 0 && j.size+int64(len(line)) > j.max {
+		j.f.Close()
+		err = os.Rename(j.path, j.path+".1")
+		if oerr := j.open(); oerr != nil {
+			j.f, err = nil, oerr
+		}
+	}
+	if err == nil && j.f != nil {
+		var n int
+		n, err = j.f.Write(line)
+		j.size += int64(n)
+	}
+	if err != nil && !j.warned {
+		j.warned = true
+		logWarn("event journal %s: %v", j.path, err)
+	}
+}
+
+// close closes the journal; later events are dropped
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+}
+
+// recordEvent appends ev to the journal, if there is one, and passes it
+// on to the controller, if gosv has one
+func recordEvent(ev Event) {
+	if j := eventJournal.Load(); j != nil {
+		j.record(ev)
+	}
+	if a := agentRunning.Load(); a != nil {
+		a.event(ev)
+	}
+}
+
+// noteEvent records an event of gosv itself
+func (s *Supervisor) noteEvent(kind, format string, args ...any) {
+	recordEvent(Event{Time: s.clock.Now(), Kind: kind, Msg: fmt.Sprintf(format, args...)})
+}
+
+// startEventJournal opens the journal the config asks for, unless it's
+// already open. Called at start and after every reload.
+func (s *Supervisor) startEventJournal() {
+	s.mu.RLock()
+	path, maxMB := s.eventJournalPath, s.eventJournalMB
+	s.mu.RUnlock()
+	if maxMB <= 0 {
+		maxMB = DefaultEventJournalMB
+	}
+	old := eventJournal.Load()
+	if old != nil && old.path == path && old.max == int64(maxMB)<<20/2 {
+		return
+	}
+	var j *journal
+	if path != "" {
+		var err error
+		if j, err = openJournal(path, maxMB); err != nil {
+			logWarn("%v", err)
+		}
+	}
+	eventJournal.Store(j)
+	if old != nil {
+		old.close()
+	}
+}
+
+// stopEventJournal closes the journal at shutdown
+func stopEventJournal() {
+	if j := eventJournal.Swap(nil); j != nil {
+		j.close()
+	}
+}
+
+// readEvents returns the events of the journal at path that q selects,
+// oldest first. Lines that don't parse (torn by a crash) are skipped.
+func readEvents(path string, q EventQuery) ([]Event, error) {
+	var events []Event
+	for _, name := range []string{path + ".1", path} {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			var ev Event
+			if json.Unmarshal(sc.Bytes(), &ev) == nil && q.matches(ev) {
+				events = append(events, ev)
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return events, nil
+}
+
+// Events returns the events of the journal that q selects, oldest first
+func (s *Supervisor) Events(q EventQuery) ([]Event, error) {
+	s.mu.RLock()
+	path := s.eventJournalPath
+	s.mu.RUnlock()
+	if path == "" {
+		return nil, fmt.Errorf("no event_journal configured")
+	}
+	return readEvents(path, q)
+}
+
+// parseEventTime parses a --since or --until time: a duration ago ("90m",
+// "2d"), an RFC 3339 time, a local date and time ("2026-10-16 02:00"), a
+// date, or a time of day - today's, or yesterday's if today's hasn't come
+// yet
+func parseEventTime(s string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			y, m, d := now.Date()
+			t = time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+			if t.After(now) {
+				t = t.AddDate(0, 0, -1)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("not a time: %q (want e.g. 2h, 02:00, \"2026-10-16 02:00\" or RFC 3339)", s)
+}
+
+// ctlEvents answers `gosv ctl events`. Services are matched by name, so
+// the events of a service that a reload removed can still be asked for;
+// groups and selectors match the services configured now.
+func (s *Supervisor) ctlEvents(req ctlRequest) ([]Event, error) {
+	q := EventQuery{Kinds: req.Kinds}
+	for _, t := range []struct {
+		value string
+		into  *time.Time
+	}{{req.Since, &q.Since}, {req.Until, &q.Until}} {
+		if t.value == "" {
+			continue
+		}
+		var err error
+		if *t.into, err = time.Parse(time.RFC3339Nano, t.value); err != nil {
+			return nil, err
+		}
+	}
+	if req.Selector != "" {
+		names, err := s.Select(req.Selector)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no service matches %q", req.Selector)
+		}
+		q.Services = append(q.Services, names...)
+	}
+	for _, target := range req.Args {
+		if !strings.HasPrefix(target, "@") {
+			q.Services = append(q.Services, target)
+			continue
+		}
+		procs, err := s.resolve(target)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range procs {
+			q.Services = append(q.Services, p.Name)
+		}
+	}
+	return s.Events(q)
+}
+
+// ctlEventsMain is `gosv ctl events [--since time] [--until time]
+// [--kind kind]... [--json] [service|@group]...`: it prints the events
+// the running gosv has journaled, oldest first
+func ctlEventsMain(conn net.Conn, args []string) error {
+	req := ctlRequest{Command: "events"}
+	asJSON := false
+	now := time.Now()
+	for ; len(args) > 0; args = args[1:] {
+		switch arg := args[0]; {
+		case (arg == "--since" || arg == "--until") && len(args) > 1:
+			t, err := parseEventTime(args[1], now)
+			if err != nil {
+				return fmt.Errorf("events: %s: %w", arg, err)
+			}
+			if arg == "--since" {
+				req.Since = t.Format(time.RFC3339Nano)
+			} else {
+				req.Until = t.Format(time.RFC3339Nano)
+			}
+			args = args[1:]
+		case arg == "--kind" && len(args) > 1:
+			req.Kinds = append(req.Kinds, strings.Split(args[1], ",")...)
+			args = args[1:]
+		case arg == "--json":
+			asJSON = true
+		case (arg == "-l" || arg == "--selector") && len(args) > 1:
+			req.Selector = args[1]
+			args = args[1:]
+		default:
+			req.Args = append(req.Args, arg)
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	var reply ctlReply
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&reply); err != nil {
+		return fmt.Errorf("no reply: %w", err)
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("%s", reply.Error)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, ev := range reply.Events {
+			enc.Encode(ev)
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSERVICE\tKIND\tPID\tEVENT")
+	for _, ev := range reply.Events {
+		service, pid := ev.Service, "-"
+		if service == "" {
+			service = "gosv"
+		}
+		if ev.PID != 0 {
+			pid = strconv.Itoa(ev.PID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", ev.Time.Local().Format("2006-01-02 15:04:05.000"), service, ev.Kind, pid, ev.Msg)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// execHelper is the hidden subcommand services start through when
+// something has to happen between fork and exec
+const execHelper = "__exec"
+
+// taskpolicyPath runs a program under a QoS clamp (macOS, taskpolicy(8))
+const taskpolicyPath = "/usr/sbin/taskpolicy"
+
+// helperArgs returns the exec helper's options for p, or nil if p can be
+// exec'd directly
+func (p *Process) helperArgs() []string {
+	var args []string
+	if p.DelegateCgroup {
+		args = append(args, "-cgroupns")
+	}
+	if p.PrivateTmp {
+		args = append(args, "-private-tmp")
+	}
+	if p.PrivateDevices {
+		args = append(args, "-private-devices")
+	}
+	if p.PrivateNetwork {
+		args = append(args, "-private-network")
+	}
+	if mounts := p.allMounts(); len(mounts) > 0 {
+		args = append(args, "-mounts", mountsArg(mounts))
+	}
+	if p.AppArmorProfile != "" {
+		args = append(args, "-apparmor", p.AppArmorProfile)
+	}
+	if p.SELinuxLabel != "" {
+		args = append(args, "-selinux", p.SELinuxLabel)
+	}
+	if len(p.cpuList) > 0 {
+		args = append(args, "-cpus", formatCPUList(p.cpuList))
+	}
+	if len(p.memNodes) > 0 {
+		args = append(args, "-mems", formatCPUList(p.memNodes))
+	}
+	args = append(args, p.fallbackLimitArgs()...)
+	if len(p.Sockets) > 0 {
+		// Only the service's own pid is known to it
+		args = append(args, "-listen-pid")
+	}
+	return args
+}
+
+// prepareExec applies what has to be set up right before p.cmd starts:
+// a delegated cgroup (the returned directory must stay open until the
+// start) and the exec helper. Caller must hold p.mu.
+func (p *Process) prepareExec() (*os.File, error) {
+	var cgroupDir *os.File
+	if p.DelegateCgroup {
+		dir, err := p.prepareDelegation()
+		if err != nil {
+			return nil, err
+		}
+		cgroupDir = dir
+	}
+	if p.RunAs != nil {
+		p.cmd.Env = append(p.cmd.Environ(), p.RunAs.env()...)
+	}
+	if p.UserNS != nil {
+		p.UserNS.apply(p.cmd.SysProcAttr)
+	}
+	if p.PrivateTmp || p.PrivateDevices || len(p.allMounts()) > 0 {
+		newMountNamespace(p.cmd.SysProcAttr)
+	}
+	if p.PrivateNetwork {
+		newNetworkNamespace(p.cmd.SysProcAttr)
+	}
+	if args := p.helperArgs(); len(args) > 0 {
+		// The helper's setup needs root, so it switches users itself
+		if p.RunAs != nil {
+			args = append(args, p.RunAs.helperArgs()...)
+		}
+		if err := p.wrapExec(args); err != nil {
+			if cgroupDir != nil {
+				cgroupDir.Close()
+			}
+			return nil, err
+		}
+	} else if p.RunAs != nil {
+		p.cmd.SysProcAttr.Credential = p.RunAs.credential()
+	}
+	return cgroupDir, nil
+}
+
+// wrapExec makes p.cmd run the exec helper with args, which then execs
+// the original command. Caller must hold p.mu.
+//
+// KEY CONCEPT: Work between fork and exec
+// Some setup must be done by the new process itself, after fork but
+// before exec: mounts in its fresh mount namespace, or the security
+// label its next exec should switch to. C supervisors run that code in
+// the forked child. A Go program can't - the child of a fork is just a
+// copy of the calling thread, without the runtime's other threads, so
+// os/exec only lets the kernel-level SysProcAttr settings run there. So
+// the child execs gosv itself first: a fresh, complete Go runtime, in
+// the same process (same pid, namespaces, cgroup, process group), which
+// does the setup and then execs the service in its place.
+func (p *Process) wrapExec(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// exec.Cmd keeps argv[0] separate from the resolved path; pass both
+	helper := append([]string{p.cmd.Args[0], execHelper}, args...)
+	p.cmd.Args = append(append(helper, "--", p.cmd.Path), p.cmd.Args...)
+	p.cmd.Path = exe
+	return nil
+}
+
+// execHelperMain implements the exec helper. It never returns: it execs
+// the service, or exits 127 like a shell that can't run a command.
+func execHelperMain(args []string) {
+	fs := flag.NewFlagSet(execHelper, flag.ExitOnError)
+	cgroupns := fs.Bool("cgroupns", false, "Mount the cgroup namespace's cgroup2 tree")
+	privateTmp := fs.Bool("private-tmp", false, "Mount fresh tmpfs on /tmp and /var/tmp")
+	privateDevices := fs.Bool("private-devices", false, "Mount a minimal /dev")
+	mountsJSON := fs.String("mounts", "", "Bind and tmpfs mounts, as JSON")
+	privateNetwork := fs.Bool("private-network", false, "Bring up loopback in a new network namespace")
+	apparmor := fs.String("apparmor", "", "AppArmor profile to exec under")
+	selinux := fs.String("selinux", "", "SELinux label to exec under")
+	uid := fs.Int("uid", -1, "User to switch to")
+	gid := fs.Int("gid", -1, "Group to switch to (with -uid)")
+	groups := fs.String("groups", "", "Supplementary groups, comma-separated (with -uid)")
+	rlimitData := fs.Int64("rlimit-data", 0, "RLIMIT_DATA in bytes (where there are no cgroups)")
+	nice := fs.Int("nice", 0, "Nice value")
+	cpus := fs.String("cpus", "", "CPUs to run on, as a CPU list")
+	mems := fs.String("mems", "", "NUMA nodes to allocate memory on, as a list")
+	qos := fs.String("qos", "", "QoS clamp to exec under, through taskpolicy (macOS)")
+	listenPID := fs.Bool("listen-pid", false, "Set LISTEN_PID for the sockets passed (see sockets.go)")
+	fs.Parse(args)
+	cmd := fs.Args()
+	if len(cmd) < 2 {
+		helperFail("missing command")
+	}
+
+	if *cgroupns || *privateTmp || *privateDevices || *mountsJSON != "" {
+		if err := detachMounts(); err != nil {
+			helperFail("%v", err)
+		}
+	}
+	if *cgroupns {
+		if err := mountCgroupNS(); err != nil {
+			helperFail("delegate_cgroup: %v", err)
+		}
+	}
+	if *privateTmp {
+		if err := mountPrivateTmp(); err != nil {
+			helperFail("private_tmp: %v", err)
+		}
+	}
+	if *privateDevices {
+		if err := mountPrivateDevices(); err != nil {
+			helperFail("private_devices: %v", err)
+		}
+	}
+
+	if *privateNetwork {
+		if err := bringUpLoopback(); err != nil {
+			helperFail("private_network: %v", err)
+		}
+	}
+
+	if *mountsJSON != "" {
+		var mounts []Mount
+		if err := json.Unmarshal([]byte(*mountsJSON), &mounts); err != nil {
+			helperFail("mounts: %v", err)
+		}
+		if err := setupMounts(mounts, *uid, *gid); err != nil {
+			helperFail("mounts: %v", err)
+		}
+	}
+
+	if *uid >= 0 {
+		if err := dropPrivileges(*uid, *gid, *groups); err != nil {
+			helperFail("user: %v", err)
+		}
+	}
+
+	// Labels last: they apply to the exec, and the setup above may need
+	// permissions the new label doesn't have. They are per thread, so the
+	// thread that sets them has to be the one that execs.
+	runtime.LockOSThread()
+	if *apparmor != "" {
+		if err := setAppArmorExec(*apparmor); err != nil {
+			helperFail("apparmor_profile: %v", err)
+		}
+	}
+	if *selinux != "" {
+		if err := setSELinuxExec(*selinux); err != nil {
+			helperFail("selinux_label: %v", err)
+		}
+	}
+
+	// The limits bind the helper too, so they come right before the exec
+	if *cpus != "" {
+		list, err := parseCPUList(*cpus)
+		if err == nil {
+			err = setAffinity(list)
+		}
+		if err != nil {
+			helperFail("cpus: %v", err)
+		}
+	}
+	if *mems != "" {
+		nodes, err := parseCPUList(*mems)
+		if err == nil {
+			err = bindMemory(nodes)
+		}
+		if err != nil {
+			helperFail("placement: %v", err)
+		}
+	}
+	if *nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, *nice); err != nil {
+			helperFail("nice: %v", err)
+		}
+	}
+	if *rlimitData > 0 {
+		var rl syscall.Rlimit
+		setRlim(&rl.Cur, *rlimitData)
+		setRlim(&rl.Max, *rlimitData)
+		if err := syscall.Setrlimit(syscall.RLIMIT_DATA, &rl); err != nil {
+			helperFail("memory limit: %v", err)
+		}
+	}
+	if *qos != "" {
+		if _, err := os.Stat(taskpolicyPath); err == nil {
+			cmd = append([]string{taskpolicyPath, "taskpolicy", "-c", *qos, cmd[0]}, cmd[2:]...)
+		}
+	}
+
+	if *listenPID {
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid())) // The exec keeps the pid
+	}
+
+	err := syscall.Exec(cmd[0], cmd[1:], os.Environ())
+	helperFail("exec %s: %v", cmd[0], err)
+}
+
+// setRlim sets a field of syscall.Rlimit, which is uint64 on Linux and
+// macOS but int64 on FreeBSD
+func setRlim[T int64 | uint64](field *T, n int64) {
+	*field = T(n)
+}
+
+func helperFail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "gosv: "+format+"\n", args...)
+	os.Exit(127)
+}
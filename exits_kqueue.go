@@ -0,0 +1,76 @@
+//go:build darwin || freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// exitWatcher wakes the reaper when a service's process exits, through a
+// kqueue
+type exitWatcher struct {
+	kq   int
+	wake chan os.Signal
+}
+
+// watchExits starts watching the exits of every process gosv spawns
+//
+// KEY CONCEPT: kqueue and EVFILT_PROC
+// On the BSDs and macOS, kqueue reports events about processes by pid:
+// EVFILT_PROC with NOTE_EXIT fires once when that process exits, whether
+// or not it is our child. Each exit is an event of its own, queued in the
+// kernel until we read it - unlike SIGCHLD, which is one pending bit for
+// all children, and only for children. gosv registers each pid as it is
+// indexed; the events only wake the reaper, which still calls wait4() to
+// collect the status and rusage. SIGCHLD stays registered as well, for
+// children gosv doesn't index.
+func (s *Supervisor) watchExits() {
+	kq, err := syscall.Kqueue()
+	if err != nil {
+		logWarn("kqueue: %v, noticing exits through SIGCHLD only", err)
+		return
+	}
+	syscall.CloseOnExec(kq)
+	w := &exitWatcher{kq: kq, wake: s.childChan}
+	s.pids.watch = w.watch
+	go w.run()
+}
+
+// watch arms a one-shot NOTE_EXIT event for pid
+func (w *exitWatcher) watch(pid int) {
+	var ev syscall.Kevent_t
+	syscall.SetKevent(&ev, pid, syscall.EVFILT_PROC, syscall.EV_ADD|syscall.EV_ONESHOT)
+	ev.Fflags = syscall.NOTE_EXIT
+	if _, err := syscall.Kevent(w.kq, []syscall.Kevent_t{ev}, nil, nil); err != nil {
+		// ESRCH: it is gone already, and waiting to be reaped
+		w.poke()
+	}
+}
+
+// run waits for exits and wakes the reaper for them
+func (w *exitWatcher) run() {
+	events := make([]syscall.Kevent_t, 64)
+	for {
+		n, err := syscall.Kevent(w.kq, nil, events, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			logWarn("kqueue: %v, noticing exits through SIGCHLD only", err)
+			return
+		}
+		if n > 0 {
+			w.poke()
+		}
+	}
+}
+
+// poke wakes the reaper, like a SIGCHLD: one pending wakeup covers any
+// number of exits
+func (w *exitWatcher) poke() {
+	select {
+	case w.wake <- syscall.SIGCHLD:
+	default:
+	}
+}
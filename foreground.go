@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// isTerminal reports whether f refers to a terminal (like isatty(3))
+func isTerminal(f *os.File) bool {
+	var t syscall.Termios
+	return ioctl(f.Fd(), ioctlGetTermios, uintptr(unsafe.Pointer(&t))) == nil
+}
+
+// prepareForeground configures the command of a foreground process so it
+// owns our stdio, and - if we have a terminal - the terminal itself.
+// Caller must hold p.mu.
+//
+// KEY CONCEPT: Foreground process group (tcsetpgrp)
+// A terminal delivers keyboard signals (Ctrl+C = SIGINT, Ctrl+Z = SIGTSTP,
+// Ctrl+\ = SIGQUIT) and resize notifications (SIGWINCH) to exactly one
+// process group: its foreground group. Shells hand the terminal to the job
+// they run; we do the same for the foreground service, so it behaves as if
+// it were started directly from the shell.
+func (p *Process) prepareForeground() {
+	if p.StdinFile == "" {
+		p.cmd.Stdin = os.Stdin
+	}
+
+	if !isTerminal(os.Stdin) {
+		return // Pipes/files (scripts, CI): plain stdio passthrough is enough
+	}
+
+	// When we take the terminal back we are a background process group,
+	// and tcsetpgrp() from the background raises SIGTTOU (default: stop)
+	signal.Ignore(syscall.SIGTTOU)
+
+	p.cmd.SysProcAttr.Foreground = true
+	p.cmd.SysProcAttr.Ctty = int(os.Stdin.Fd())
+}
+
+// reclaimTerminal makes our own process group the terminal's foreground
+// group again after the foreground service exited
+func reclaimTerminal() {
+	if !isTerminal(os.Stdin) {
+		return
+	}
+	pgrp := int32(syscall.Getpgrp())
+	ioctl(os.Stdin.Fd(), syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&pgrp)))
+}
+
+// forwardToForeground relays a signal to the foreground service's process
+// group. Used for SIGWINCH when the kernel didn't deliver it to them
+// directly (e.g. gosv's stdin isn't the terminal that was resized).
+func (s *Supervisor) forwardToForeground(sig syscall.Signal) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.processes {
+		if p.Foreground {
+			p.Signal(sig)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DaemonizeTimeout is how long a forking service has to daemonize: for
+// its initial process to exit and the pid file to name the daemon
+const DaemonizeTimeout = 90 * time.Second
+
+// pidFilePoll is how often the pid file is checked while it's missing
+const pidFilePoll = 50 * time.Millisecond
+
+// readPIDFile returns the pid in a pid file: a number, optionally
+// followed by a newline
+func readPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 1 {
+		return 0, fmt.Errorf("%s: no pid in %q", path, strings.TrimSpace(string(data)))
+	}
+	return pid, nil
+}
+
+// isChild reports whether pid is a child of gosv
+func isChild(pid int) bool {
+	for _, c := range childPids() {
+		if c == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareDaemonize removes p's pid file before a start, so the pid read
+// afterwards is the new daemon's and not a stale one. Caller must hold
+// p.mu.
+func (p *Process) prepareDaemonize() error {
+	if err := os.Remove(p.PIDFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stale pid file: %w", err)
+	}
+	return nil
+}
+
+// startDaemonize marks p as daemonizing once its initial process started,
+// and kills that process if it doesn't exit in time. Caller must hold
+// p.mu.
+func (p *Process) startDaemonize() {
+	p.daemonizing = true
+	p.daemonDeadline = p.now().Add(DaemonizeTimeout)
+	initial := p.pid
+	p.timeSource().AfterFunc(DaemonizeTimeout, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.daemonizing && p.pid == initial {
+			logWarn("%s did not daemonize within %v, killing it", p.Name, DaemonizeTimeout)
+			syscall.Kill(-p.pgid, syscall.SIGKILL)
+		}
+	})
+}
+
+// daemonized reports whether p runs and is done daemonizing (if it is a
+// forking service at all)
+func (p *Process) daemonized() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.daemonizing && p.pid != 0
+}
+
+// adoptDaemon takes over the daemon of p, a forking service whose
+// initial process just exited successfully
+//
+// KEY CONCEPT: Supervising a daemon
+// A traditional daemon forks, the child calls setsid() and often forks
+// again, and the process gosv started exits - "started" to a shell, but a
+// supervisor watching that process would think the service is gone. The
+// daemon's pid is in its pid file. Because gosv is a child subreaper (see
+// subreaper_linux.go), the daemon was reparented to gosv when its parent
+// exited: it is gosv's child, and wait4() reports its exit, status and
+// resource usage like any other service's. Its pid can't be reused until
+// gosv reaps it, so a pid read from the file is either the daemon or not
+// a child of gosv at all.
+//
+// A pid file may also name a process further down, whose parent is
+// another process of the service. That one gosv can't wait for; it's
+// watched through a pidfd instead (see watchDaemon), which says when it
+// exits but not how.
+func (s *Supervisor) adoptDaemon(p *Process, initial int) {
+	p.mu.Lock()
+	deadline := p.daemonDeadline
+	p.mu.Unlock()
+
+	pid, err := readPIDFile(p.PIDFile)
+	for err != nil && s.clock.Now().Before(deadline) {
+		<-s.clock.After(pidFilePoll)
+		pid, err = readPIDFile(p.PIDFile)
+	}
+	if err != nil {
+		s.daemonFailed(p, initial, err)
+		return
+	}
+
+	// The daemon can't be reaped as an orphan between the check and the
+	// pid index (see pidIndex)
+	p.pids.holdReaping()
+	if isChild(pid) {
+		p.setDaemon(pid)
+		p.pids.add(pid, p)
+		p.pids.releaseReaping()
+	} else {
+		p.pids.releaseReaping()
+		wait, err := watchDaemon(pid)
+		if err != nil {
+			s.daemonFailed(p, initial, fmt.Errorf("pid %d from %s: %w", pid, p.PIDFile, err))
+			return
+		}
+		p.setDaemon(pid)
+		go func() {
+			wait()
+			p.watchedExit(pid)
+		}()
+	}
+	logInfo("%s daemonized (pid=%d, from %s)", p.Name, pid, p.PIDFile)
+
+	// Stopped, or gosv began shutting down, while it daemonized
+	if !s.mayStart(p) {
+		p.kill(syscall.SIGTERM)
+	}
+}
+
+// setDaemon makes pid the main process of p
+func (p *Process) setDaemon(pid int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pid = pid
+	if pgid, err := syscall.Getpgid(pid); err == nil {
+		p.pgid = pgid
+	}
+	p.daemonizing = false
+	if p.cgroup != nil && !p.DelegateCgroup {
+		// In case it forked before its parent was moved into the cgroup
+		if err := p.cgroup.AddProcess(pid); err != nil {
+			logWarn("failed to add %s to cgroup: %v", p.Name, err)
+		}
+	}
+	p.noteEvent(EventDaemonize, "daemonized as pid %d", pid)
+}
+
+// daemonFailed records that p, a forking service, exited successfully
+// but left no daemon behind that gosv can supervise. Whatever is left of
+// it is killed, and it counts as a failed run.
+func (s *Supervisor) daemonFailed(p *Process, initial int, cause error) {
+	p.mu.Lock()
+	pgid, cg := p.pgid, p.cgroup
+	p.daemonizing = false
+	p.state = StateStopped
+	p.exitCode = 1
+	p.lastUptime = p.now().Sub(p.startTime)
+	p.noteEvent(EventStartFailed, "did not daemonize: %v", cause)
+	ev := ExitEvent{Name: p.Name, PID: initial, Time: p.now(), Labels: p.Labels, ExitCode: 1, Uptime: p.lastUptime}
+	p.mu.Unlock()
+
+	logError("%s did not daemonize: %v", p.Name, cause)
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	if cg != nil {
+		cg.Kill(syscall.SIGKILL)
+	}
+	storeExit(ev)
+	p.fireExit(ev)
+	s.boundExited(p)
+	s.wakeRestarts()
+}
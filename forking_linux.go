@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// watchDaemon watches pid, a descendant of gosv that isn't its child,
+// and returns a function that blocks until the process exits
+func watchDaemon(pid int) (func(), error) {
+	return watchPID(pid, func() error {
+		if !isDescendant(pid) {
+			return errors.New("not a process gosv started")
+		}
+		return nil
+	})
+}
+
+// isDescendant reports whether pid descends from gosv
+func isDescendant(pid int) bool {
+	self := os.Getpid()
+	for pid > 1 {
+		ppid, err := readPPid(pid)
+		if err != nil {
+			return false
+		}
+		if ppid == self {
+			return true
+		}
+		pid = ppid
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// generateSystemd implements `gosv generate-systemd`: it writes a systemd
+// unit that runs gosv with the given config
+//
+// KEY CONCEPT: Delegate=yes
+// systemd owns the cgroup tree. A unit's cgroup is systemd's to manage
+// unless the unit sets Delegate=yes, which hands the subtree to the
+// service: gosv may then create a cgroup per supervised service below its
+// own and turn on controllers there (see cgroup.go). KillMode=mixed sends
+// SIGTERM only to gosv, so it can stop its services in order, and SIGKILL
+// to everything left in the cgroup once TimeoutStopSec runs out.
+func generateSystemd(args []string) error {
+	fs := flag.NewFlagSet("generate-systemd", flag.ExitOnError)
+	configPath := fs.String("config", "", "Config to run (required)")
+	name := fs.String("name", "gosv", "Unit name, without .service")
+	output := fs.String("output", "", "Directory to write the unit to (default: print it)")
+	dropIns := fs.Bool("drop-ins", false, "Also write a drop-in per service (needs --output)")
+	configSync := fs.Duration("config-sync", 0, "Pass --config-sync to gosv")
+	fs.Parse(args)
+
+	if *configPath == "" {
+		return fmt.Errorf("--config is required")
+	}
+	if *dropIns && *output == "" {
+		return fmt.Errorf("--drop-ins needs --output")
+	}
+
+	data, err := readConfigSource(*configPath)
+	if err != nil {
+		return err
+	}
+	procs, err := parseConfig(data)
+	if err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	config := *configPath
+	if !strings.Contains(config, "://") && !strings.HasPrefix(config, "git+") {
+		if config, err = filepath.Abs(config); err != nil {
+			return err
+		}
+	}
+	execStart := exe + " --config " + config
+	if *configSync > 0 {
+		execStart += " --config-sync " + configSync.String()
+	}
+
+	for _, p := range procs {
+		if p.Foreground || p.TTY {
+			fmt.Fprintf(os.Stderr, "warning: %s uses foreground/tty, which has no terminal under systemd\n", p.Name)
+		}
+	}
+
+	unit := fmt.Sprintf(`# Generated by gosv generate-systemd from %s
+[Unit]
+Description=gosv process supervisor (%s)
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+WatchdogSec=%d
+Delegate=yes
+KillMode=mixed
+TimeoutStopSec=%d
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`, *configPath, filepath.Base(*configPath), execStart, int(watchdogBudget(procs)/time.Second),
+		int(stopBudget(procs)/time.Second))
+
+	if *output == "" {
+		_, err := io.WriteString(os.Stdout, unit)
+		return err
+	}
+
+	unitPath := filepath.Join(*output, *name+".service")
+	if err := os.WriteFile(unitPath, []byte(unit), 0644); err != nil {
+		return err
+	}
+	fmt.Println(unitPath)
+
+	if *dropIns {
+		dir := filepath.Join(*output, *name+".service.d")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		for _, p := range procs {
+			path := filepath.Join(dir, p.Name+".conf")
+			if err := os.WriteFile(path, []byte(dropIn(p)), 0644); err != nil {
+				return err
+			}
+			fmt.Println(path)
+		}
+	}
+	return nil
+}
+
+// stopBudget is how long gosv may take to stop everything: every shutdown
+// stage waits up to its longest stop timeout, plus some slack
+func stopBudget(procs []*Process) time.Duration {
+	stages := make(map[int]time.Duration)
+	for _, p := range procs {
+		timeout := p.StopTimeout
+		if timeout == 0 {
+			timeout = DefaultStopTimeout
+		}
+		if timeout > stages[p.ShutdownPriority] {
+			stages[p.ShutdownPriority] = timeout
+		}
+	}
+	total := 5 * time.Second
+	for _, t := range stages {
+		total += t
+	}
+	return total
+}
+
+// watchdogBudget returns the WatchdogSec for procs. gosv pings the
+// watchdog from its main loop (see sdnotify.go), which a reload keeps
+// busy while it stops the services it replaces: a stop stage must fit.
+func watchdogBudget(procs []*Process) time.Duration {
+	return max(stopBudget(procs), time.Minute)
+}
+
+// dropIn returns a drop-in for one service. It carries the mounts the
+// service needs (RequiresMountsFor= adds up across drop-ins) and is the
+// place for per-service ordering, e.g. After=postgresql.service, that
+// survives regenerating the unit.
+func dropIn(p *Process) string {
+	paths := map[string]bool{}
+	add := func(path string) {
+		if filepath.IsAbs(path) {
+			paths[path] = true
+		}
+	}
+	add(p.Command)
+	add(p.StdinFile)
+	for _, path := range append(append([]string{}, p.Watch...), p.ActivatePaths...) {
+		add(path)
+	}
+	for _, src := range p.Credentials {
+		add(src)
+	}
+	for _, m := range p.Mounts {
+		add(m.Source)
+	}
+	if c, ok := p.Spawner.(ContainerSpawner); ok {
+		if bundle, err := filepath.Abs(c.Bundle); err == nil {
+			add(bundle)
+		}
+	}
+
+	var sorted []string
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	var sb strings.Builder
+	cmdline := strings.ReplaceAll(p.Command+" "+strings.Join(p.Args, " "), "\n", " ")
+	fmt.Fprintf(&sb, "# gosv service %q: %s\n", p.Name, cmdline)
+	sb.WriteString("[Unit]\n")
+	if len(sorted) > 0 {
+		fmt.Fprintf(&sb, "RequiresMountsFor=%s\n", strings.Join(sorted, " "))
+	}
+	sb.WriteString("# Units this service needs, e.g.:\n# After=postgresql.service\n# Wants=postgresql.service\n")
+	return sb.String()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// nvidiaMajor is the character device major of /dev/nvidia0, /dev/nvidia1
+// ... (minor N is GPU N), /dev/nvidiactl (minor 255) and
+// /dev/nvidia-modeset (254)
+const nvidiaMajor = 195
+
+// maxGPUIndex is the highest minor the driver uses for a GPU
+const maxGPUIndex = 253
+
+// validGPUs checks the gpus of a service: indices as nvidia-smi lists
+// them, each at most once
+func validGPUs(gpus []int) error {
+	seen := make(map[int]bool)
+	for _, gpu := range gpus {
+		if gpu < 0 || gpu > maxGPUIndex {
+			return fmt.Errorf("GPU index %d out of range 0-%d", gpu, maxGPUIndex)
+		}
+		if seen[gpu] {
+			return fmt.Errorf("GPU %d listed twice", gpu)
+		}
+		seen[gpu] = true
+	}
+	return nil
+}
+
+// gpuEnv returns the environment that points CUDA and the NVIDIA
+// container tooling at gpus
+//
+// KEY CONCEPT: Two kinds of GPU numbering
+// /dev/nvidiaN and nvidia-smi number GPUs by PCI bus order. CUDA, by
+// default, numbers them fastest first - on a host with mixed GPUs,
+// CUDA_VISIBLE_DEVICES=0 may not be /dev/nvidia0 at all, and the
+// service would be denied the one GPU it can see. CUDA_DEVICE_ORDER=
+// PCI_BUS_ID makes CUDA use the same order as the device nodes. Inside
+// the service, CUDA renumbers the visible GPUs from 0.
+func gpuEnv(gpus []int) []string {
+	ids := make([]string, len(gpus))
+	for i, gpu := range gpus {
+		ids[i] = strconv.Itoa(gpu)
+	}
+	list := strings.Join(ids, ",")
+	return []string{
+		"CUDA_DEVICE_ORDER=PCI_BUS_ID",
+		"CUDA_VISIBLE_DEVICES=" + list,
+		"NVIDIA_VISIBLE_DEVICES=" + list,
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// sysBPF is the number of the bpf(2) system call, which the syscall
+// package lacks on most architectures
+var sysBPF = map[string]uintptr{
+	"386":     357,
+	"amd64":   321,
+	"arm":     386,
+	"arm64":   280,
+	"loong64": 280,
+	"ppc64le": 361,
+	"riscv64": 280,
+	"s390x":   351,
+}[runtime.GOARCH]
+
+// bpf(2) commands, program and attach types, from <linux/bpf.h>
+const (
+	bpfProgLoad             = 5
+	bpfProgAttach           = 8
+	bpfProgDetach           = 9
+	bpfProgTypeCgroupDevice = 15
+	bpfCgroupDevice         = 6
+	bpfDevcgDevChar         = 2
+)
+
+// bpfInsn is one eBPF instruction (struct bpf_insn)
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst_reg in the low nibble, src_reg in the high one
+	off  int16
+	imm  int32
+}
+
+// eBPF opcodes used by the device filter
+const (
+	bpfLdxMemW  = 0x61 // dst = *(u32 *)(src + off)
+	bpfAnd32K   = 0x54 // dst &= imm
+	bpfMov64K   = 0xb7 // dst = imm
+	bpfJeqK     = 0x15 // if dst == imm goto +off
+	bpfJneK     = 0x55 // if dst != imm goto +off
+	bpfJgtK     = 0x25 // if dst > imm goto +off
+	bpfExitInsn = 0x95 // return r0
+)
+
+// gpuFilter returns a device program that denies the NVIDIA GPUs other
+// than gpus, and allows every other device
+//
+// KEY CONCEPT: cgroup v2 device control
+// cgroup v1 had a devices controller with allow/deny lists. v2 has no
+// controller for it: instead, a BPF program of type
+// BPF_PROG_TYPE_CGROUP_DEVICE is attached to the cgroup, and the kernel
+// runs it on every open() or mknod() of a device node by a process in
+// the cgroup. It gets the access type, major and minor
+// (struct bpf_cgroup_dev_ctx in r1) and returns 1 to allow, 0 to deny
+// with EPERM. This is what runc and systemd's DeviceAllow= compile their
+// rules to. The device nodes stay visible; only opening them fails.
+func gpuFilter(gpus []int) []bpfInsn {
+	const ctx, devType, major, minor = 1, 2, 3, 4
+	load := func(dst uint8, off int16) bpfInsn {
+		return bpfInsn{code: bpfLdxMemW, regs: dst | ctx<<4, off: off}
+	}
+
+	// Conditions that allow the access, each one jumping to the end
+	checks := []bpfInsn{
+		{code: bpfJneK, regs: devType, imm: bpfDevcgDevChar},
+		{code: bpfJneK, regs: major, imm: nvidiaMajor},
+		{code: bpfJgtK, regs: minor, imm: maxGPUIndex}, // nvidiactl, nvidia-modeset
+	}
+	for _, gpu := range gpus {
+		checks = append(checks, bpfInsn{code: bpfJeqK, regs: minor, imm: int32(gpu)})
+	}
+	for i := range checks {
+		// Past the remaining checks and the two deny instructions
+		checks[i].off = int16(len(checks) - i - 1 + 2)
+	}
+
+	prog := []bpfInsn{
+		load(devType, 0), // access_type: access << 16 | type
+		{code: bpfAnd32K, regs: devType, imm: 0xffff},
+		load(major, 4),
+		load(minor, 8),
+	}
+	prog = append(prog, checks...)
+	return append(prog,
+		bpfInsn{code: bpfMov64K, regs: 0, imm: 0}, // deny
+		bpfInsn{code: bpfExitInsn},
+		bpfInsn{code: bpfMov64K, regs: 0, imm: 1}, // allow
+		bpfInsn{code: bpfExitInsn},
+	)
+}
+
+// bpfProgLoadAttr is union bpf_attr as BPF_PROG_LOAD reads it
+type bpfProgLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              uint64
+	license            uint64
+	logLevel           uint32
+	logSize            uint32
+	logBuf             uint64
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [16]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+}
+
+// bpfAttachAttr is union bpf_attr as BPF_PROG_ATTACH/DETACH read it
+type bpfAttachAttr struct {
+	targetFd     uint32
+	attachBpfFd  uint32
+	attachType   uint32
+	attachFlags  uint32
+	replaceBpfFd uint32
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	if sysBPF == 0 {
+		return 0, syscall.ENOSYS
+	}
+	r, _, errno := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+// RestrictGPUs lets the processes in the cgroup open only the NVIDIA
+// GPUs listed (the control devices stay open to them)
+func (c *Cgroup) RestrictGPUs(gpus []int) error {
+	return c.attachBPF("device filter", "gosv_gpus", bpfProgTypeCgroupDevice, bpfCgroupDevice, gpuFilter(gpus))
+}
+
+// unrestrictDevices detaches a device filter RestrictGPUs attached to
+// the cgroup for an earlier config. Without one, it does nothing.
+func (c *Cgroup) unrestrictDevices() {
+	if c.detachBPF(bpfCgroupDevice) {
+		logDebug("removed the device filter of %s", c.path)
+	}
+}
+
+// attachBPF loads insns as a program of progType named name, and attaches
+// it to the cgroup at attachType. what names it in errors.
+//
+// The program is attached without BPF_F_ALLOW_MULTI, so it replaces the
+// one an earlier start (or an earlier gosv) attached, and goes away with
+// the cgroup. Programs systemd attached to parent cgroups still apply.
+func (c *Cgroup) attachBPF(what, name string, progType, attachType uint32, insns []bpfInsn) error {
+	license := []byte("GPL\x00")
+	var log [4096]byte
+	load := bpfProgLoadAttr{
+		progType:           progType,
+		insnCnt:            uint32(len(insns)),
+		insns:              uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:            uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel:           1,
+		logSize:            uint32(len(log)),
+		logBuf:             uint64(uintptr(unsafe.Pointer(&log[0]))),
+		expectedAttachType: attachType,
+	}
+	copy(load.progName[:], name)
+	prog, err := bpf(bpfProgLoad, unsafe.Pointer(&load), unsafe.Sizeof(load))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		if msg := strings.TrimRight(string(log[:]), "\x00\n"); msg != "" {
+			return fmt.Errorf("load %s: %w: %s", what, err, msg)
+		}
+		return fmt.Errorf("load %s: %w", what, err)
+	}
+	defer syscall.Close(int(prog))
+
+	dir, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	attach := bpfAttachAttr{
+		targetFd:    uint32(dir.Fd()),
+		attachBpfFd: uint32(prog),
+		attachType:  attachType,
+	}
+	if _, err := bpf(bpfProgAttach, unsafe.Pointer(&attach), unsafe.Sizeof(attach)); err != nil {
+		return fmt.Errorf("attach %s: %w", what, err)
+	}
+	return nil
+}
+
+// detachBPF detaches the program attachBPF attached at attachType, and
+// reports whether there was one
+func (c *Cgroup) detachBPF(attachType uint32) bool {
+	dir, err := os.Open(c.path)
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+	detach := bpfAttachAttr{targetFd: uint32(dir.Fd()), attachType: attachType}
+	_, err = bpf(bpfProgDetach, unsafe.Pointer(&detach), unsafe.Sizeof(detach))
+	return err == nil
+}
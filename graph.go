@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// graphQueryTimeout bounds the wait for a running gosv's states
+const graphQueryTimeout = 5 * time.Second
+
+// graphEdge is a relation between two services, drawn as an arrow
+type graphEdge struct {
+	From, To string
+	Label    string
+}
+
+// serviceGraph is what `gosv graph` draws: services, grouped into the
+// stages they are stopped in, and the relations between them
+//
+// KEY CONCEPT: Ordering as a graph
+// A config lists services one by one; how they relate only shows when
+// you draw it. Stops are ordered: each shutdown_priority stage is
+// stopped before the next one starts stopping. Starts are ordered only
+// by after, and part_of and binds_to tie services together. Rendering
+// that as a graph in a runbook shows at a glance which frontends go down
+// while their backends are still up.
+type serviceGraph struct {
+	stages []int                // Shutdown priorities, in stop order
+	nodes  map[int][]*Process   // Services per stage
+	edges  []graphEdge          // part_of, binds_to and after, dependent to target
+	states map[string]liveState // Of a running gosv, by service; nil to draw the config only
+}
+
+// liveState is the state of a service in a running gosv, as `ctl status`
+// shows it, and whether it's ok (see healthy)
+type liveState struct {
+	State string
+	OK    bool
+}
+
+// color returns the fill of a node in state: green while running, yellow
+// on its way up, grey down on purpose, red when it's not ok
+func (st liveState) color() string {
+	switch {
+	case !st.OK:
+		return "#f4b0b0"
+	case strings.HasPrefix(st.State, "running"):
+		return "#b8e6b8"
+	case strings.HasPrefix(st.State, "starting"), strings.HasPrefix(st.State, "delayed"),
+		strings.HasPrefix(st.State, "waiting"), strings.HasPrefix(st.State, "queued"):
+		return "#f5e6a8"
+	}
+	return "#dddddd"
+}
+
+func buildGraph(procs []*Process) *serviceGraph {
+	g := &serviceGraph{nodes: make(map[int][]*Process)}
+	for _, p := range procs {
+		if _, ok := g.nodes[p.ShutdownPriority]; !ok {
+			g.stages = append(g.stages, p.ShutdownPriority)
+		}
+		g.nodes[p.ShutdownPriority] = append(g.nodes[p.ShutdownPriority], p)
+	}
+	sort.Ints(g.stages)
+	for _, stage := range g.stages {
+		sort.Slice(g.nodes[stage], func(i, j int) bool { return g.nodes[stage][i].Name < g.nodes[stage][j].Name })
+		for _, p := range g.nodes[stage] {
+			for _, t := range p.PartOf {
+				g.edges = append(g.edges, graphEdge{From: p.Name, To: t, Label: "part of"})
+			}
+			for _, t := range p.BindsTo {
+				g.edges = append(g.edges, graphEdge{From: p.Name, To: t, Label: "binds to"})
+			}
+			for _, t := range p.After {
+				g.edges = append(g.edges, graphEdge{From: p.Name, To: t, Label: "after"})
+			}
+		}
+	}
+	return g
+}
+
+// nodeLabel describes a service: its name and what sets it apart, and
+// its state in a running gosv on a line of its own
+func (g *serviceGraph) nodeLabel(p *Process, newline string) string {
+	label := nodeTags(p)
+	if st, ok := g.states[p.Name]; ok {
+		label += newline + st.State
+	}
+	return label
+}
+
+// nodeTags describes a service: its name and what sets it apart
+func nodeTags(p *Process) string {
+	var tags []string
+	if p.Critical {
+		tags = append(tags, "critical")
+	}
+	if p.Lock != nil {
+		tags = append(tags, "singleton")
+	}
+	if len(p.ActivatePaths) > 0 {
+		tags = append(tags, "path-activated")
+	}
+	if len(tags) == 0 {
+		return p.Name
+	}
+	return p.Name + " (" + strings.Join(tags, ", ") + ")"
+}
+
+// graphID returns a node id safe in both DOT and Mermaid
+func graphID(name string) string {
+	return "svc_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// writeDOT renders g in Graphviz DOT: one cluster per shutdown stage,
+// linked in stop order
+func (g *serviceGraph) writeDOT(w io.Writer) {
+	fmt.Fprintln(w, "digraph gosv {")
+	fmt.Fprintln(w, "  compound=true;")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [shape=box, style=rounded];")
+	for _, stage := range g.stages {
+		fmt.Fprintf(w, "  subgraph cluster_stage%s {\n", stageIndex(stage))
+		fmt.Fprintf(w, "    label=\"shutdown_priority %d\";\n", stage)
+		for _, p := range g.nodes[stage] {
+			attrs := fmt.Sprintf("label=%q", g.nodeLabel(p, "\n"))
+			if p.Critical {
+				attrs += ", penwidth=2"
+			}
+			if st, ok := g.states[p.Name]; ok {
+				attrs += fmt.Sprintf(", style=\"rounded,filled\", fillcolor=%q", st.color())
+			}
+			fmt.Fprintf(w, "    %s [%s];\n", graphID(p.Name), attrs)
+		}
+		fmt.Fprintln(w, "  }")
+	}
+	// Clusters can't be linked directly: link their first nodes and clip
+	// the arrow at the cluster borders
+	for i := 1; i < len(g.stages); i++ {
+		from, to := g.stages[i-1], g.stages[i]
+		fmt.Fprintf(w, "  %s -> %s [ltail=cluster_stage%s, lhead=cluster_stage%s, label=\"stopped before\", style=dashed];\n",
+			graphID(g.nodes[from][0].Name), graphID(g.nodes[to][0].Name), stageIndex(from), stageIndex(to))
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(w, "  %s -> %s [label=%q];\n", graphID(e.From), graphID(e.To), e.Label)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// writeMermaid renders g as a Mermaid flowchart, for Markdown runbooks
+func (g *serviceGraph) writeMermaid(w io.Writer) {
+	fmt.Fprintln(w, "flowchart LR")
+	for _, stage := range g.stages {
+		fmt.Fprintf(w, "  subgraph stage%s [\"shutdown_priority %d\"]\n", stageIndex(stage), stage)
+		for _, p := range g.nodes[stage] {
+			fmt.Fprintf(w, "    %s[\"%s\"]\n", graphID(p.Name), g.nodeLabel(p, "<br/>"))
+		}
+		fmt.Fprintln(w, "  end")
+	}
+	for i := 1; i < len(g.stages); i++ {
+		fmt.Fprintf(w, "  stage%s -. stopped before .-> stage%s\n", stageIndex(g.stages[i-1]), stageIndex(g.stages[i]))
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(w, "  %s -- %s --> %s\n", graphID(e.From), e.Label, graphID(e.To))
+	}
+	for _, stage := range g.stages {
+		for _, p := range g.nodes[stage] {
+			var style []string
+			if st, ok := g.states[p.Name]; ok {
+				style = append(style, "fill:"+st.color())
+			}
+			if p.Critical {
+				style = append(style, "stroke-width:3px")
+			}
+			if len(style) > 0 {
+				fmt.Fprintf(w, "  style %s %s\n", graphID(p.Name), strings.Join(style, ","))
+			}
+		}
+	}
+}
+
+// stageIndex turns a (possibly negative) priority into an identifier part
+func stageIndex(priority int) string {
+	if priority < 0 {
+		return fmt.Sprintf("m%d", -priority)
+	}
+	return fmt.Sprint(priority)
+}
+
+// queryStates asks the gosv listening on socket for the states of its
+// services
+func queryStates(socket string) (map[string]liveState, error) {
+	conn, err := net.DialTimeout("unix", socket, graphQueryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(graphQueryTimeout))
+	if err := json.NewEncoder(conn).Encode(ctlRequest{Command: "status", JSON: true}); err != nil {
+		return nil, err
+	}
+	var reply ctlReply
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("no reply: %w", err)
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("%s", reply.Error)
+	}
+	if reply.Status == nil {
+		return nil, fmt.Errorf("it has no states to give (an older gosv?)")
+	}
+	states := make(map[string]liveState)
+	for _, svc := range reply.Status.Services {
+		name, _ := svc["name"].(string)
+		state, _ := svc["state"].(string)
+		ok, _ := svc["ok"].(bool)
+		states[name] = liveState{State: state, OK: ok}
+	}
+	return states, nil
+}
+
+// graph implements `gosv graph`: it prints the services of a config, their
+// stop order and relations as Graphviz DOT or Mermaid. If the gosv
+// running the config answers on its control socket, the services are
+// colored by their states.
+func graph(args []string) error {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	configPath := fs.String("config", "", "Config to draw (required)")
+	format := fs.String("format", "dot", "Output format: dot or mermaid")
+	pidfilePath := fs.String("pidfile", "", "Pidfile of the gosv to show the states of (default: from --config)")
+	socket := fs.String("socket", "", "Control socket of that gosv (default: next to the pidfile)")
+	fs.Parse(args)
+
+	if *configPath == "" {
+		return fmt.Errorf("--config is required")
+	}
+	data, err := readConfigSource(*configPath)
+	if err != nil {
+		return err
+	}
+	procs, err := parseConfig(data)
+	if err != nil {
+		return err
+	}
+
+	g := buildGraph(procs)
+	if *socket == "" {
+		if *pidfilePath == "" {
+			*pidfilePath = defaultPidfile(*configPath)
+		}
+		*socket = ctlSocketPath(*pidfilePath)
+	}
+	if g.states, err = queryStates(*socket); err != nil {
+		fmt.Fprintf(os.Stderr, "gosv graph: no states from %s (%v), drawing the config only\n", *socket, err)
+	}
+	switch *format {
+	case "dot":
+		g.writeDOT(os.Stdout)
+	case "mermaid":
+		g.writeMermaid(os.Stdout)
+	default:
+		return fmt.Errorf("unknown format %q (want dot or mermaid)", *format)
+	}
+	return nil
+}
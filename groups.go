@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// groupNamePattern matches valid group names (used as "@name")
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// applyGroupDefaults rebuilds each service of cfg from its groups'
+// defaults, overlaid with its own settings
+//
+// KEY CONCEPT: Groups
+// Services often come in sets - a pool of batch workers, the frontends
+// behind a load balancer - that share limits and that operators act on
+// together. A group names such a set, the way a systemd target does: its
+// defaults are a partial service config applied before the service's own
+// fields, so "memory_mb" set on the service wins over the group's, and
+// "@batch" selects every member at once (see Supervisor.resolve).
+func applyGroupDefaults(data []byte, cfg *Config) error {
+	for name, defaults := range cfg.Groups {
+		if !groupNamePattern.MatchString(name) {
+			return fmt.Errorf("groups: invalid group name %q", name)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(defaults, &fields); err != nil {
+			return fmt.Errorf("groups: %s: %w", name, err)
+		}
+		for _, key := range []string{"name", "groups"} {
+			if _, ok := fields[key]; ok {
+				return fmt.Errorf("groups: %s: %q can't be a group default", name, key)
+			}
+		}
+	}
+	for _, svc := range cfg.Services {
+		for _, g := range svc.Groups {
+			if !groupNamePattern.MatchString(g) {
+				return fmt.Errorf("service %s: invalid group name %q", svc.Name, g)
+			}
+		}
+	}
+	if len(cfg.Groups) == 0 {
+		return nil
+	}
+
+	var raw struct {
+		Services []json.RawMessage `json:"services"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for i, svc := range cfg.Services {
+		var merged ServiceConfig
+		for _, g := range svc.Groups {
+			if defaults, ok := cfg.Groups[g]; ok {
+				if err := json.Unmarshal(defaults, &merged); err != nil {
+					return fmt.Errorf("service %s: group %s: %w", svc.Name, g, err)
+				}
+			}
+		}
+		if err := json.Unmarshal(raw.Services[i], &merged); err != nil {
+			return err
+		}
+		cfg.Services[i] = merged
+	}
+	return nil
+}
+
+// inGroup reports whether p is a member of group
+func (p *Process) inGroup(group string) bool {
+	for _, g := range p.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the processes target names: a service name, the name
+// of a service with replicas for all of them, or "@group" for every
+// member of the group, sorted by name
+func (s *Supervisor) resolve(target string) ([]*Process, error) {
+	group, isGroup := strings.CutPrefix(target, "@")
+	if !isGroup {
+		p, err := s.lookup(target)
+		if err == nil {
+			return []*Process{p}, nil
+		}
+	}
+
+	s.mu.RLock()
+	var procs []*Process
+	for _, p := range s.processes {
+		if (isGroup && p.inGroup(group)) || (!isGroup && p.ReplicaOf == target) {
+			procs = append(procs, p)
+		}
+	}
+	s.mu.RUnlock()
+	switch {
+	case len(procs) > 0:
+	case isGroup:
+		return nil, fmt.Errorf("%w: no service in group %s", ErrUnknownService, group)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownService, target)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Name < procs[j].Name })
+	return procs, nil
+}
+
+// Stop stops the target services (a name or "@group", see resolve), and
+// the services part of them, and keeps them down, outside of their
+// restart policy, until Start. It returns once they have their SIGTERM,
+// not once they're gone (see stopInBackground).
+func (s *Supervisor) Stop(target string) error {
+	procs, err := s.resolve(target)
+	if err != nil {
+		return err
+	}
+	procs = s.withPartOf(procs)
+	for _, p := range procs {
+		p.mu.Lock()
+		p.manualStop = true
+		p.pendingRestart = false
+		p.cancelRestart()
+		// A restart that is already under way won't finish (see
+		// mayStart), and a waiting service won't be activated
+		if p.state == StateStarting || p.state == StateWaiting {
+			p.state = StateStopped
+		}
+		p.noteEvent(EventStop, "stopped by request")
+		if p.job != nil && p.job.pool != nil {
+			p.job.pool.cancel(p) // If still queued, it won't run
+		}
+		p.mu.Unlock()
+		logInfo("stopping %s on request", p.Name)
+	}
+	s.stopInBackground(procs)
+	return nil
+}
+
+// Start starts the target services (a name or "@group"), and the
+// services part of them, that are down, including ones stopped by Stop or
+// that exhausted their restarts.
+// Path-activated services go back to waiting for work, and singletons to
+// waiting for their lock.
+func (s *Supervisor) Start(target string) error {
+	procs, err := s.resolve(target)
+	if err != nil {
+		return err
+	}
+	procs = s.withPartOf(procs)
+	for _, p := range procs {
+		p.mu.Lock()
+		// Still on its way down from a Stop or an eviction
+		stopping := (p.manualStop || (p.evicted && !p.frozen)) && p.state == StateRunning
+		p.manualStop = false
+		p.evicted = false // Back by hand before the pressure subsided
+		state := p.state
+		bound := p.boundDown
+		waitLock := p.Lock != nil && !p.leader
+		waitPath := len(p.ActivatePaths) > 0 && !pathsHaveContent(p.ActivatePaths)
+		if state == StateStopped && waitPath {
+			p.state = StateWaiting
+		}
+		p.mu.Unlock()
+
+		switch {
+		case stopping:
+			logInfo("%s is still stopping, starting it again once it has", p.Name)
+			s.RestartProcess(p)
+		case state == StateRunning || state == StateStarting:
+			logInfo("%s is already %s", p.Name, state)
+		case p.job != nil:
+			logInfo("%s is a job, started by its ctl run", p.Name)
+		case bound:
+			logInfo("%s waiting for %s", p.Name, strings.Join(p.BindsTo, ", "))
+		case waitLock:
+			logInfo("%s waiting for lock %s", p.Name, p.Lock.Key)
+		case waitPath:
+			logInfo("%s waiting for path activation", p.Name)
+		default:
+			s.RestartProcess(p)
+		}
+	}
+	return nil
+}
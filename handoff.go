@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Restart modes: how a requested restart replaces a running service
+const (
+	RestartModeStop    = "stop"    // Stop it, then start it (default)
+	RestartModeHandoff = "handoff" // Start the new instance on its sockets first
+)
+
+// handoff is the old instance of a service while a new one starts on its
+// sockets
+type handoff struct {
+	pid, pgid int
+	started   time.Time
+	gone      bool // It exited meanwhile
+
+	// A file ready_check's file, which the new instance has to make
+	// again: what it held, and whether it was there
+	readyData []byte
+	hadReady  bool
+}
+
+// handOff restarts p without closing its sockets for a moment: it starts
+// a new instance, which inherits them, waits for it to get ready, and
+// only then stops the old one. If the new instance exits or doesn't get
+// ready in time, it is killed and the old one goes on serving.
+//
+// KEY CONCEPT: Blue/green restarts
+// A restart that stops a service and then starts it leaves a gap in
+// which nothing answers: the old process is gone, the new one still
+// loads its config or warms its caches. Socket activation fills the gap
+// for the connections (they wait in the socket's backlog), but not for
+// their wait. Running both side by side removes it: while the new
+// instance ("green") gets ready, the old one ("blue") goes on accepting
+// on the same socket, and the kernel hands each connection to whichever
+// of them accepts it first. Once green is ready, blue gets its SIGTERM
+// and finishes the requests it has. A new release that crashes at
+// startup never takes a connection at all: blue just stays.
+func (s *Supervisor) handOff(p *Process) {
+	p.mu.Lock()
+	if p.handoff != nil || p.state != StateRunning || p.pid == 0 {
+		p.mu.Unlock()
+		return // A handoff is under way, or there is no instance to hand off from
+	}
+	h := &handoff{pid: p.pid, pgid: p.pgid, started: p.startTime}
+	if p.ReadyCheck != nil && p.ReadyCheck.Kind == "file" {
+		// Only the new instance is to pass it
+		h.readyData, h.hadReady = readReadyFile(p.ReadyCheck.Addr)
+		os.Remove(p.ReadyCheck.Addr)
+	}
+	p.handoff = h
+	p.pid = 0 // The old instance's exit is no longer p's
+	p.noteEvent(EventHandoff, "starting a new instance to hand off to (old pid=%d)", h.pid)
+	p.mu.Unlock()
+	logInfo("%s: starting a new instance on its sockets, pid %d serves meanwhile", p.Name, h.pid)
+
+	err := p.Start()
+	p.mu.Lock()
+	pid, pgid, started := p.pid, p.pgid, p.startTime
+	if p.handoff != h || pid == 0 {
+		// Start failed, or skipped it
+		restored := p.restoreHandoff(h)
+		p.mu.Unlock()
+		if restored {
+			logWarn("%s: handoff failed: %v, pid %d goes on", p.Name, err, h.pid)
+		} else {
+			s.wakeRestarts() // Both gone: up to the restart policy
+		}
+		return
+	}
+	p.mu.Unlock()
+
+	check, timeout := p.ReadyCheck, s.deploySettle()
+	if check != nil {
+		timeout = p.ReadyTimeout
+	}
+	for {
+		p.mu.Lock()
+		current := p.pid == pid
+		p.mu.Unlock()
+		if !current {
+			return // It exited: exited put the old instance back
+		}
+		now := s.clock.Now()
+		if (check == nil && now.Sub(started) >= timeout) || (check != nil && check.probe() == nil) {
+			break
+		}
+		if now.Sub(started) > timeout {
+			p.mu.Lock()
+			failed := p.pid == pid && p.handoff == h
+			restored := failed && p.restoreHandoff(h)
+			p.mu.Unlock()
+			if failed {
+				logWarn("%s: new instance (pid=%d) not ready after %v, killing it", p.Name, pid, timeout)
+				syscall.Kill(-pgid, syscall.SIGKILL)
+			}
+			if restored {
+				logWarn("%s: handoff failed, pid %d goes on", p.Name, h.pid)
+			}
+			return
+		}
+		<-s.clock.After(deployPoll)
+	}
+
+	p.mu.Lock()
+	if p.pid != pid || p.handoff != h {
+		p.mu.Unlock()
+		return
+	}
+	p.handoff = nil
+	mode, stopTimeout := p.KillMode, p.StopTimeout
+	p.noteEvent(EventHandoff, "handed off from pid %d to pid %d", h.pid, pid)
+	p.mu.Unlock()
+	logInfo("%s: pid %d is ready, stopping pid %d", p.Name, pid, h.pid)
+	if !h.gone {
+		stopOldInstance(h, mode, stopTimeout, s.clock)
+	}
+}
+
+// restoreHandoff makes the old instance of h p's again after its handoff
+// failed, and reports whether it could: not if it exited meanwhile, in
+// which case the new instance's exit goes through the restart policy.
+// Caller must hold p.mu.
+func (p *Process) restoreHandoff(h *handoff) bool {
+	if p.handoff != h {
+		return false
+	}
+	p.handoff = nil
+	if h.gone {
+		return false
+	}
+	p.pid, p.pgid, p.startTime, p.state = h.pid, h.pgid, h.started, StateRunning
+	p.ports.attach(h.pid)
+	if h.hadReady {
+		os.WriteFile(p.ReadyCheck.Addr, h.readyData, 0644)
+	}
+	p.noteEvent(EventHandoff, "handoff failed, pid %d goes on", h.pid)
+	return true
+}
+
+// readReadyFile returns what a file ready_check's file holds, and whether
+// it is there
+func readReadyFile(path string) ([]byte, bool) {
+	data, err := os.ReadFile(path)
+	return data, err == nil
+}
+
+// stopOldInstance stops the old instance of a handoff: SIGTERM, and
+// SIGKILL if it's still there after stopTimeout. Its exit is no longer
+// its service's, so nothing restarts it.
+func stopOldInstance(h *handoff, mode string, stopTimeout time.Duration, clock Clock) {
+	target := -h.pgid
+	if mode == KillProcess {
+		target = h.pid
+	}
+	if stopTimeout == 0 {
+		stopTimeout = DefaultStopTimeout
+	}
+	syscall.Kill(target, syscall.SIGTERM)
+	deadline := clock.Now().Add(stopTimeout)
+	for syscall.Kill(h.pid, 0) == nil {
+		if clock.Now().After(deadline) {
+			logWarn("sending SIGKILL to pid %d, which outlived its stop timeout after a handoff", h.pid)
+			syscall.Kill(target, syscall.SIGKILL)
+			return
+		}
+		<-clock.After(deployPoll)
+	}
+}
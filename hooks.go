@@ -0,0 +1,114 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// Hooks are callbacks for process lifecycle events, for embedders that
+// want to react to them (e.g. register with a service registry) without
+// polling. Any field may be nil.
+//
+// Hooks can be set per Process and globally on the Supervisor; when both
+// are set, the process hook runs first. Hooks run synchronously on the
+// supervisor's goroutines with no locks held, so they may call back into
+// the supervisor but should return quickly.
+type Hooks struct {
+	OnStart            func(StartEvent)
+	OnExit             func(ExitEvent)
+	OnRestartExhausted func(ExhaustedEvent)
+	OnFailingReadiness func(ReadinessEvent)
+}
+
+// StartEvent describes a successful (re)start
+type StartEvent struct {
+	Name     string
+	PID      int
+	Restarts int // Restarts so far (0 for the first start)
+	Time     time.Time
+	Labels   map[string]string // The service's labels, e.g. to route notifications
+}
+
+// ExitEvent describes a reaped process
+type ExitEvent struct {
+	Name     string
+	PID      int
+	ExitCode int            // 128+N if killed by signal N
+	Signal   syscall.Signal // Non-zero if killed by a signal
+	Uptime   time.Duration
+	Time     time.Time
+
+	// KernelReason is what the kernel logged about the kill, e.g.
+	// "killed by the OOM killer" (see kmsg.go)
+	KernelReason string
+
+	// Usage is the resources the run used (see usage.go)
+	Usage Usage
+
+	Labels map[string]string
+}
+
+// ExhaustedEvent is sent once when a process has used up MaxRestarts and
+// will not be restarted again
+type ExhaustedEvent struct {
+	Name        string
+	Restarts    int
+	ExitCode    int    // Exit code of the last run
+	Diagnostics string // Diagnostics bundle directory, if one was written
+	Labels      map[string]string
+}
+
+// ReadinessEvent is sent once when a process has missed its ready timeout
+// ReadyFailures times in a row, and is reported as failing readiness
+// from then on (see readiness.go)
+type ReadinessEvent struct {
+	Name     string
+	Failures int           // Runs in a row that never got ready
+	Timeout  time.Duration // How long each had
+	Err      string        // Why the last probe failed
+	Labels   map[string]string
+}
+
+// hookSets returns the hooks that apply to p, most specific first
+func (p *Process) hookSets() []*Hooks {
+	var sets []*Hooks
+	if p.Hooks != nil {
+		sets = append(sets, p.Hooks)
+	}
+	if p.globalHooks != nil && *p.globalHooks != nil {
+		sets = append(sets, *p.globalHooks)
+	}
+	return sets
+}
+
+func (p *Process) fireStart(ev StartEvent) {
+	for _, h := range p.hookSets() {
+		if h.OnStart != nil {
+			h.OnStart(ev)
+		}
+	}
+}
+
+func (p *Process) fireExit(ev ExitEvent) {
+	for _, h := range p.hookSets() {
+		if h.OnExit != nil {
+			h.OnExit(ev)
+		}
+	}
+}
+
+func (p *Process) fireExhausted(ev ExhaustedEvent) {
+	for _, h := range p.hookSets() {
+		if h.OnRestartExhausted != nil {
+			h.OnRestartExhausted(ev)
+		}
+	}
+}
+
+func (p *Process) fireFailingReadiness(ev ReadinessEvent) {
+	for _, h := range p.hookSets() {
+		if h.OnFailingReadiness != nil {
+			h.OnFailingReadiness(ev)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// errNotLinux is what the Linux-only isolation features fail with
+// elsewhere. dropUnsupported keeps them from being reached.
+var errNotLinux = fmt.Errorf("not supported on %s", runtime.GOOS)
+
+// dropUnsupported turns off the options of p that need Linux
+// (namespaces, cgroups, MAC labels, scheduling classes), with a warning
+// for each, so the same config still runs - without that isolation
+//
+// KEY CONCEPT: Degrading on purpose
+// A config written for production servers is also what developers run
+// on their laptops. Refusing to start a service because its private /tmp
+// can't be set up would force a second, diverging config; silently
+// starting it without the isolation would hide that it is missing. gosv
+// does the middle thing: it runs the service, and says exactly what it
+// left out.
+func (p *Process) dropUnsupported() {
+	var dropped []string
+	if p.DelegateCgroup {
+		p.DelegateCgroup = false
+		dropped = append(dropped, "delegate_cgroup")
+	}
+	if p.PrivateTmp {
+		p.PrivateTmp = false
+		dropped = append(dropped, "private_tmp")
+	}
+	if p.PrivateDevices {
+		p.PrivateDevices = false
+		dropped = append(dropped, "private_devices")
+	}
+	if len(p.Mounts) > 0 {
+		p.Mounts = nil
+		dropped = append(dropped, "mounts")
+	}
+	if p.DNS != nil {
+		p.DNS = nil
+		dropped = append(dropped, "dns")
+	}
+	if p.PrivateNetwork {
+		p.PrivateNetwork, p.Ports = false, nil
+		dropped = append(dropped, "private_network/ports")
+	}
+	if p.UserNS != nil {
+		p.UserNS = nil
+		dropped = append(dropped, "user_namespace")
+	}
+	if p.AppArmorProfile != "" {
+		p.AppArmorProfile = ""
+		dropped = append(dropped, "apparmor_profile")
+	}
+	if p.SELinuxLabel != "" {
+		p.SELinuxLabel = ""
+		dropped = append(dropped, "selinux_label")
+	}
+	if p.Sched != nil {
+		p.Sched = nil
+		dropped = append(dropped, "sched_policy/ionice")
+	}
+	if len(p.HugeTLBLimits) > 0 {
+		p.HugeTLBLimits = nil
+		dropped = append(dropped, "hugetlb_mb")
+	}
+	if len(p.GPUs) > 0 {
+		p.GPUs = nil
+		dropped = append(dropped, "gpus")
+	}
+	if p.EgressMbit > 0 {
+		p.EgressMbit = 0
+		dropped = append(dropped, "egress_mbit")
+	}
+	if p.CPUs != "" || len(p.IsolateFrom) > 0 {
+		p.CPUs, p.IsolateFrom = "", nil
+		dropped = append(dropped, "cpus/isolate_from")
+	}
+	if p.Placement != "" {
+		p.Placement = ""
+		dropped = append(dropped, "placement")
+	}
+	for _, opt := range dropped {
+		logWarn("%s: %s is not supported on %s, running without it", p.Name, opt, runtime.GOOS)
+	}
+}
+
+func detachMounts() error                            { return errNotLinux }
+func mountPrivateTmp() error                         { return errNotLinux }
+func mountPrivateDevices() error                     { return errNotLinux }
+func mountCgroupNS() error                           { return errNotLinux }
+func setupMounts(mounts []Mount, uid, gid int) error { return errNotLinux }
+func mountCredentials(dir string) error              { return errNotLinux }
+func newMountNamespace(attr *syscall.SysProcAttr)    {}
+func newNetworkNamespace(attr *syscall.SysProcAttr)  {}
+func bringUpLoopback() error                         { return errNotLinux }
+func (u *UserNS) apply(attr *syscall.SysProcAttr)    {}
+
+func (p *Process) prepareDelegation() (*os.File, error) {
+	return nil, fmt.Errorf("delegate cgroup: %w", errNotLinux)
+}
+
+func (s *Sched) apply(pid int) error { return errNotLinux }
+func setAffinity(cpus []int) error   { return errNotLinux }
+func bindMemory(nodes []int) error   { return errNotLinux }
+
+func (t *execTarget) run(argv []string) (int, error) { return 0, errNotLinux }
+
+// watchDaemon: without pidfds, gosv only supervises daemons that are its
+// children
+func watchDaemon(pid int) (func(), error) {
+	return nil, fmt.Errorf("not a child of gosv (watching other processes is %w)", errNotLinux)
+}
+
+func watchPID(pid int, check func() error) (func(), error) { return nil, errNotLinux }
+func (p *Process) runsCommand(pid int) error               { return errNotLinux }
+func descendants(pid int) []int                            { return nil }
+
+func dialInNamespace(netns *os.File, port int) (net.Conn, error) { return nil, errNotLinux }
+
+// Network accounting needs sock_diag
+func tcpSockets() (map[uint64]tcpSocket, error) { return nil, errNotLinux }
+func socketInodes(pids []int) map[uint64]bool   { return nil }
+
+func (c *Cgroup) RestrictGPUs(gpus []int) error { return errNotLinux }
+func (c *Cgroup) unrestrictDevices()            {}
+
+// Egress shaping classifies with a cgroup BPF program
+func (c *Cgroup) setEgressClass(classid uint32) error { return errNotLinux }
+func (c *Cgroup) unshapeEgress()                      {}
+func defaultRouteInterfaces() ([]string, error)       { return nil, errNotLinux }
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// job is what makes a process a one-off job (`gosv ctl run`) rather than
+// a service: it runs once, its output is piped by gosv itself so the end
+// of it can be waited for, and it's removed when it exits
+type job struct {
+	exit   chan int // Gets the exit code
+	pipes  []*os.File
+	output sync.WaitGroup // Copying the output into the pipeline
+	pool   *resourcePool  // nil if it runs right away (see pools.go)
+	slot   bool           // Holds a slot of pool
+}
+
+// pipe connects the output of cmd to lp through pipes of gosv's own.
+// With an io.Writer as cmd.Stdout, os/exec would copy the output itself,
+// and only cmd.Wait - which gosv doesn't call, it reaps children with
+// wait4 - would tell when the copy is done.
+func (j *job) pipe(cmd *exec.Cmd, lp *logPipeline) error {
+	for _, stream := range []string{"stdout", "stderr"} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			j.closePipes()
+			return err
+		}
+		if stream == "stdout" {
+			cmd.Stdout = w
+		} else {
+			cmd.Stderr = w
+		}
+		j.pipes = append(j.pipes, w)
+		j.output.Add(1)
+		go func() {
+			defer j.output.Done()
+			io.Copy(lp.writer(stream), r)
+			r.Close()
+		}()
+	}
+	return nil
+}
+
+// closePipes closes gosv's copies of the write ends, once the child has
+// its own: the reads end when the job's last process closes them
+func (j *job) closePipes() {
+	for _, w := range j.pipes {
+		w.Close()
+	}
+	j.pipes = nil
+}
+
+// addJob registers the one-off job svc (a service config), with the
+// group defaults of the current config, in the pool called pool if not
+// "" (else in the pool of its groups, if any)
+func (s *Supervisor) addJob(svc json.RawMessage, pool string) (*Process, error) {
+	s.mu.RLock()
+	stopping := s.draining || s.shuttingDown
+	s.mu.RUnlock()
+	if stopping {
+		return nil, fmt.Errorf("gosv is shutting down")
+	}
+	cfg := make(map[string]json.RawMessage)
+	if len(s.configData) > 0 {
+		if err := json.Unmarshal(s.configData, &cfg); err != nil {
+			return nil, err
+		}
+	}
+	cfg["services"] = append(append(json.RawMessage("["), svc...), ']')
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	procs, err := parseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(procs) != 1 {
+		return nil, fmt.Errorf("run: no job given")
+	}
+	p := procs[0]
+	p.MaxRestarts, p.Foreground, p.TTY = 0, false, false
+	p.job = &job{exit: make(chan int, 1)}
+	if pool == "" {
+		pool = p.Pool // From its groups
+	}
+	if pool != "" {
+		if p.job.pool = poolNamed(pool); p.job.pool == nil {
+			return nil, fmt.Errorf("run: no pool %q (see pools)", pool)
+		}
+		p.Pool = pool
+	}
+	if err := s.AddProcess(p); err != nil {
+		return nil, err
+	}
+	logInfo("running job %s: %s", p.Name, strings.Join(append([]string{p.Command}, p.Args...), " "))
+	return p, nil
+}
+
+// jobExited hands the exit code of the job p to its caller
+func (p *Process) jobExited(code int) {
+	select {
+	case p.job.exit <- code:
+	default:
+	}
+}
+
+// removeJob unregisters the job p once it's done
+func (s *Supervisor) removeJob(p *Process) {
+	s.mu.Lock()
+	if s.processes[p.Name] == p {
+		delete(s.processes, p.Name)
+	}
+	s.mu.Unlock()
+	p.mu.Lock()
+	p.removed = true
+	if p.cgroup != nil {
+		p.cgroup.Destroy()
+	}
+	slot := p.job.slot
+	p.mu.Unlock()
+	p.removeCredentials()
+	p.removeDNS()
+	p.closePorts()
+	p.closeSockets()
+	if slot {
+		p.job.pool.release()
+	}
+}
+
+// serveJob answers `gosv ctl run`: it registers the job, starts it and
+// streams its output to the client as `ctl logs -f` does, then its exit
+// code. A job of a pool waits for its turn first, and the client gets a
+// note that it's queued. The job is stopped if the client hangs up. It
+// runs on the connection's goroutine, registering the job through the
+// main loop.
+//
+// KEY CONCEPT: Jobs under supervision
+// A one-off task - a migration, a backfill, a report - started from an
+// ssh session runs outside everything the services get: no cgroup limit,
+// none of the group's user and environment, no trace of it in the event
+// journal, and it dies with the session. Starting it through the
+// supervisor instead makes it a transient service, the way `systemd-run`
+// makes a transient unit: it's configured like a service of its groups,
+// limited like one and journaled like one, but it runs once and is
+// forgotten when it exits. The caller still gets what a shell would give
+// - the output as it happens and the exit code at the end - because the
+// job's pipes are gosv's, so gosv knows when the output has ended.
+func (s *Supervisor) serveJob(conn net.Conn, req ctlRequest) {
+	enc := json.NewEncoder(conn)
+	reply := s.callMain(req)
+	if reply.Error != "" {
+		enc.Encode(reply)
+		return
+	}
+	p, err := s.lookup(reply.Services[0])
+	if err != nil || p.job == nil {
+		enc.Encode(ctlReply{Error: "run: job vanished"})
+		return
+	}
+	defer s.removeJob(p)
+
+	hungUp := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(hungUp)
+	}()
+	if p.job.pool != nil && !s.waitForPool(enc, p, hungUp) {
+		return
+	}
+
+	p.mu.Lock()
+	p.ensureLogs()
+	lp := p.logs
+	p.mu.Unlock()
+	_, f := lp.follow(0, true)
+	if err := p.Start(); err != nil {
+		p.mu.Lock()
+		p.job.closePipes()
+		p.mu.Unlock()
+		lp.close()
+		enc.Encode(ctlReply{Error: err.Error()})
+		return
+	}
+	if enc.Encode(reply) != nil {
+		s.callMain(ctlRequest{Command: "stop", Args: []string{p.Name}})
+	}
+
+	code := -1
+	go func() {
+		code = <-p.job.exit
+		p.job.output.Wait()
+		lp.close() // Ends f.lines once the last line is through
+	}()
+	for {
+		select {
+		case l, ok := <-f.lines:
+			if !ok {
+				enc.Encode(ctlLogLine{Service: p.Name, Exit: &code})
+				return
+			}
+			if n := f.lost.Swap(0); n > 0 {
+				enc.Encode(ctlLogLine{Service: p.Name, Note: fmt.Sprintf("%d lines skipped, ctl run fell behind", n)})
+			}
+			enc.Encode(ctlLogLine{Service: p.Name, Stream: l.stream, Time: l.time, Line: string(l.text)})
+		case <-hungUp:
+			logInfo("stopping job %s: its caller hung up", p.Name)
+			s.callMain(ctlRequest{Command: "stop", Args: []string{p.Name}})
+			hungUp = nil // Wait for the job to end
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+// ctlRun is `gosv ctl run [--name name] [--pool pool] [--group group]...
+// [--memory size] [--cpu percent] [--user user] [--env K=V]... --
+// <command> [args]`: it runs a one-off job under gosv, prints its output
+// and exits with its exit code
+func ctlRun(conn net.Conn, args []string) error {
+	svc := map[string]any{"name": fmt.Sprintf("job-%d", os.Getpid())}
+	req := ctlRequest{Command: "run"}
+	var groups []string
+	env := make(map[string]string)
+	for len(args) > 0 && args[0] != "--" {
+		if len(args) < 2 {
+			return fmt.Errorf("run: %s needs a value", args[0])
+		}
+		switch value := args[1]; args[0] {
+		case "--name":
+			svc["name"] = value
+		case "--pool":
+			req.Pool = value
+		case "--group":
+			groups = append(groups, value)
+		case "--memory":
+			n, err := parseMemoryLimit(value)
+			if err != nil {
+				return fmt.Errorf("run: --memory: %w", err)
+			}
+			svc["memory_mb"] = (n + 1<<20 - 1) >> 20
+		case "--cpu":
+			n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+			if err != nil || n <= 0 {
+				return fmt.Errorf("run: --cpu: not a percentage: %q", value)
+			}
+			svc["cpu_percent"] = n
+		case "--user":
+			svc["user"] = value
+		case "--env":
+			k, v, ok := strings.Cut(value, "=")
+			if !ok {
+				return fmt.Errorf("run: --env: want NAME=value, not %q", value)
+			}
+			env[k] = v
+		default:
+			return fmt.Errorf("run: unknown option %s", args[0])
+		}
+		args = args[2:]
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("run: usage: run [options] -- <command> [args]")
+	}
+	command := args[1]
+	if strings.Contains(command, "/") {
+		// gosv runs it from its own directory, not ours
+		if abs, err := filepath.Abs(command); err == nil {
+			command = abs
+		}
+	}
+	svc["command"], svc["args"] = command, args[2:]
+	if len(groups) > 0 {
+		svc["groups"] = groups
+	}
+	if len(env) > 0 {
+		svc["env"] = env
+	}
+	job, err := json.Marshal(svc)
+	if err != nil {
+		return err
+	}
+	req.Job = job
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(conn)
+	var reply ctlReply
+	for {
+		if err := dec.Decode(&reply); err != nil {
+			return fmt.Errorf("no reply: %w", err)
+		}
+		if reply.Error != "" {
+			return fmt.Errorf("%s", reply.Error)
+		}
+		if reply.Services != nil {
+			break
+		}
+		// Replies before the last say where the job is in its pool's queue
+		fmt.Fprintf(os.Stderr, "gosv: %s\n", reply.Output)
+	}
+	for {
+		var l ctlLogLine
+		if err := dec.Decode(&l); err != nil {
+			return fmt.Errorf("run: lost gosv before the job ended: %w", err)
+		}
+		switch {
+		case l.Exit != nil:
+			os.Exit(*l.Exit)
+		case l.Note != "":
+			fmt.Fprintf(os.Stderr, "gosv: %s\n", l.Note)
+		case l.Stream == "stderr":
+			fmt.Fprintln(os.Stderr, l.Line)
+		default:
+			fmt.Fprintln(os.Stdout, l.Line)
+		}
+	}
+}
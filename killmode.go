@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Kill modes: what gets signaled when gosv stops a service
+const (
+	KillProcessGroup = "process-group" // The main process's group (default)
+	KillProcess      = "process"       // Only the main process
+	KillControlGroup = "control-group" // Every process in the service's cgroup
+	KillMixed        = "mixed"         // SIGTERM to the main process, SIGKILL to the cgroup
+	KillNone         = "none"          // Nothing - the service manages its own children
+)
+
+// validKillMode reports whether mode is a known kill mode ("" = default)
+func validKillMode(mode string) bool {
+	switch mode {
+	case "", KillProcessGroup, KillProcess, KillControlGroup, KillMixed, KillNone:
+		return true
+	}
+	return false
+}
+
+// usesCgroup reports whether the kill mode needs the service in a cgroup
+// of its own
+func (p *Process) usesCgroup() bool {
+	return p.KillMode == KillControlGroup || p.KillMode == KillMixed
+}
+
+// kill sends a stop signal (SIGTERM, SIGKILL) the way p.KillMode says
+//
+// KEY CONCEPT: Who gets the signal
+// A process group catches the main process and the children it forks, but
+// anything that calls setsid() or setpgid() leaves it. A cgroup can't be
+// left: every descendant stays in it unless moved by someone with write
+// access to the hierarchy. So control-group is the thorough mode, process
+// group the traditional one, and process for services that shut down
+// their own workers and don't want them interrupted. mixed gives the main
+// process a chance to do that, but SIGKILLs anything left over.
+func (p *Process) kill(sig syscall.Signal) error {
+	p.mu.Lock()
+	pid, pgid, mode, cg := p.pid, p.pgid, p.KillMode, p.cgroup
+	h := p.handoff
+	p.mu.Unlock()
+
+	if h != nil && !h.gone && mode != KillNone {
+		// A stop stops the instance being handed off from too
+		syscall.Kill(-h.pgid, sig)
+	}
+
+	if mode == KillMixed {
+		mode = KillProcess
+		if sig == syscall.SIGKILL {
+			mode = KillControlGroup
+		}
+	}
+	if mode == KillControlGroup && cg == nil {
+		mode = KillProcessGroup // No cgroup (e.g. --no-cgroup) - best effort
+	}
+
+	switch mode {
+	case KillNone:
+		return nil
+	case KillControlGroup:
+		return cg.Kill(sig)
+	}
+	if pid == 0 {
+		return ErrNotRunning
+	}
+	if mode == KillProcess || pgid == 0 { // No group of its own (adopted)
+		return syscall.Kill(pid, sig)
+	}
+	return syscall.Kill(-pgid, sig)
+}
+
+// killForRestart sends sig to p to restart it: as p.KillMode says, but
+// with kill_mode none to the main process. A restart waits for the main
+// process to exit, and a service that signaling nothing leaves running
+// would never get it.
+//
+// During a handoff, only the new instance is restarted: the old one goes
+// on (see handoff.go).
+func (p *Process) killForRestart(sig syscall.Signal) error {
+	p.mu.Lock()
+	pid, pgid, mode, handingOff := p.pid, p.pgid, p.KillMode, p.handoff != nil
+	p.mu.Unlock()
+	switch {
+	case mode != KillNone && !handingOff:
+		return p.kill(sig)
+	case pid == 0:
+		return ErrNotRunning
+	case handingOff:
+		return syscall.Kill(-pgid, sig)
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// lingering reports whether a stop has to keep waiting for p: its main
+// process is alive or, in cgroup kill modes, its cgroup still has members
+func (p *Process) lingering() bool {
+	p.mu.Lock()
+	pid, mode, cg := p.pid, p.KillMode, p.cgroup
+	h := p.handoff
+	p.mu.Unlock()
+
+	if mode == KillNone {
+		return false // Not ours to wait for
+	}
+	if pid != 0 && syscall.Kill(pid, 0) == nil {
+		return true
+	}
+	if h != nil && !h.gone && syscall.Kill(h.pid, 0) == nil {
+		return true
+	}
+	if p.usesCgroup() && cg != nil {
+		return len(cg.Procs()) > 0
+	}
+	return false
+}
+
+// Procs returns the pids in the cgroup, including cgroups below it (which
+// a service with a delegated cgroup may create)
+func (c *Cgroup) Procs() []int {
+	var pids []int
+	filepath.WalkDir(c.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() != "cgroup.procs" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		for _, line := range strings.Fields(string(data)) {
+			if pid, err := strconv.Atoi(line); err == nil {
+				pids = append(pids, pid)
+			}
+		}
+		return nil
+	})
+	return pids
+}
+
+// Kill sends sig to every process in the cgroup
+func (c *Cgroup) Kill(sig syscall.Signal) error {
+	// cgroup.kill (Linux 5.14+) SIGKILLs the whole cgroup atomically, so
+	// nothing can fork its way out while we iterate
+	if sig == syscall.SIGKILL {
+		if err := os.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0644); err == nil {
+			return nil
+		}
+	}
+	for _, pid := range c.Procs() {
+		syscall.Kill(pid, sig)
+	}
+	return nil
+}
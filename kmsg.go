@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// kernelReasonTTL is how long a kernel message about a pid is kept around
+// for the exit it explains
+const kernelReasonTTL = 30 * time.Second
+
+// Kernel messages about killed processes, with the pid as first group
+var (
+	oomKilledRe = regexp.MustCompile(`Killed process (\d+) \(`)
+	oomKillRe   = regexp.MustCompile(`^oom-kill:.*,pid=(\d+),`)
+	segfaultRe  = regexp.MustCompile(`^\S+\[(\d+)\]: (segfault at [0-9a-f]+)`)
+	trapRe      = regexp.MustCompile(`^traps: \S+\[(\d+)\] (.+?) ip:`)
+)
+
+// kmsgWatcher tails the kernel log and remembers why the kernel killed
+// or faulted processes
+//
+// KEY CONCEPT: /dev/kmsg
+// When the OOM killer picks a victim it sends SIGKILL - the same signal
+// `kill -9` sends - so wait() alone can't tell them apart. The kernel does
+// log its reasons, though: "Out of memory: Killed process 1234 (app)",
+// "app[1234]: segfault at 0 ip ...". /dev/kmsg is the kernel's ring
+// buffer as a device: each read() returns one record
+// ("prio,seq,usec,flags;text"), and after seeking to the end, reads
+// block until new messages arrive. Reading it needs root or CAP_SYSLOG
+// when kernel.dmesg_restrict is set.
+type kmsgWatcher struct {
+	clock   Clock
+	mu      sync.Mutex
+	reasons map[int]kernelReason
+	exited  map[int]string // Recently reaped pids without a reason yet
+}
+
+type kernelReason struct {
+	text string
+	at   time.Time
+}
+
+// startKmsg starts tailing /dev/kmsg (best effort)
+func (s *Supervisor) startKmsg() {
+	f, err := os.Open("/dev/kmsg")
+	if err != nil {
+		logDebug("kernel log unavailable, kills by the kernel won't be explained: %v", err)
+		return
+	}
+	// Only new messages - the backlog is about processes long gone
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		logDebug("kernel log unavailable: %v", err)
+		return
+	}
+	s.kmsg = &kmsgWatcher{clock: s.clock, reasons: make(map[int]kernelReason), exited: make(map[int]string)}
+	go s.kmsg.run(f, s)
+}
+
+func (k *kmsgWatcher) run(f *os.File, s *Supervisor) {
+	defer f.Close()
+	buf := make([]byte, 8192)
+	for {
+		n, err := f.Read(buf)
+		if errors.Is(err, syscall.EPIPE) {
+			continue // We fell behind and records were overwritten
+		}
+		if err != nil {
+			logDebug("kernel log: %v", err)
+			return
+		}
+		pid, reason, ok := parseKmsg(string(buf[:n]))
+		if ok {
+			k.record(pid, reason, s)
+		}
+	}
+}
+
+// parseKmsg extracts the pid and reason from a kernel message about a
+// killed or faulting process
+func parseKmsg(record string) (int, string, bool) {
+	// "prio,seq,usec,flags;text\n" followed by " KEY=value" lines
+	_, text, ok := strings.Cut(record, ";")
+	if !ok {
+		return 0, "", false
+	}
+	text, _, _ = strings.Cut(text, "\n")
+
+	var m []string
+	var reason string
+	switch {
+	case strings.Contains(text, "Killed process"):
+		m = oomKilledRe.FindStringSubmatch(text)
+		reason = "killed by the OOM killer"
+		if strings.HasPrefix(text, "Memory cgroup out of memory") {
+			reason = "killed by the OOM killer (cgroup limit)"
+		}
+	case strings.HasPrefix(text, "oom-kill:"):
+		m = oomKillRe.FindStringSubmatch(text)
+		reason = "killed by the OOM killer"
+		if strings.Contains(text, "constraint=CONSTRAINT_MEMCG") {
+			reason = "killed by the OOM killer (cgroup limit)"
+		}
+	case strings.Contains(text, "segfault at"):
+		if m = segfaultRe.FindStringSubmatch(text); m != nil {
+			reason = "killed after a " + m[2]
+		}
+	case strings.HasPrefix(text, "traps: "):
+		if m = trapRe.FindStringSubmatch(text); m != nil {
+			reason = "killed after a trap (" + m[2] + ")"
+		}
+	}
+	if m == nil {
+		return 0, "", false
+	}
+	pid, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, "", false
+	}
+	return pid, reason, true
+}
+
+func (k *kmsgWatcher) record(pid int, reason string, s *Supervisor) {
+	now := k.clock.Now()
+
+	k.mu.Lock()
+	for p, r := range k.reasons {
+		if now.Sub(r.at) > kernelReasonTTL {
+			delete(k.reasons, p)
+		}
+	}
+	k.reasons[pid] = kernelReason{text: reason, at: now}
+	name, late := k.exited[pid]
+	delete(k.exited, pid)
+	k.mu.Unlock()
+
+	if late {
+		// The message came in after we reaped the process
+		logWarn("%s (pid=%d) was %s", name, pid, reason)
+		return
+	}
+
+	// Not the service's main process, but maybe one of its children
+	if svc := s.groupOf(pid); svc != "" {
+		logWarn("process %d of %s was %s", pid, svc, reason)
+	}
+}
+
+// reason returns why the kernel killed pid, if it said so. Otherwise the
+// pid is remembered so a message arriving late can still be attributed
+// to name.
+func (k *kmsgWatcher) reason(pid int, name string) string {
+	if k == nil {
+		return ""
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if r, ok := k.reasons[pid]; ok {
+		delete(k.reasons, pid)
+		return r.text
+	}
+	k.exited[pid] = name
+	k.clock.AfterFunc(kernelReasonTTL, func() {
+		k.mu.Lock()
+		delete(k.exited, pid)
+		k.mu.Unlock()
+	})
+	return ""
+}
+
+// groupOf returns the service whose process group pid belongs to, if pid
+// is not the service's main process itself (reaping covers that one)
+func (s *Supervisor) groupOf(pid int) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ""
+	}
+	// Fields after the parenthesized comm: state ppid pgrp ...
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return ""
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 3 {
+		return ""
+	}
+	pgid, _ := strconv.Atoi(fields[2])
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.processes {
+		p.mu.Lock()
+		match := p.pid == pgid && pgid != 0 && pgid != pid
+		p.mu.Unlock()
+		if match {
+			return p.Name
+		}
+	}
+	return ""
+}
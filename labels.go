@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// setAppArmorExec makes the calling thread's next exec switch to the
+// AppArmor profile, like aa_change_onexec(). It runs in the exec helper.
+//
+// KEY CONCEPT: Labels on exec
+// Mandatory access control (AppArmor, SELinux) confines a process by the
+// profile or label it runs under, and the policy usually says which
+// label a program gets when it's executed from which domain. A
+// supervisor running unconfined would start everything unconfined, so
+// systemd asks the LSM directly (AppArmorProfile=, SELinuxContext=): a
+// write to /proc/thread-self/attr/exec sets the label the *next* execve
+// of that thread transitions to. The policy still has to allow the
+// transition, and a profile must already be loaded.
+func setAppArmorExec(profile string) error {
+	data := []byte("exec " + profile)
+	// Since 5.8 each LSM has its own attr directory; the shared file is
+	// for whichever LSM came first
+	err := os.WriteFile("/proc/thread-self/attr/apparmor/exec", data, 0)
+	if os.IsNotExist(err) {
+		err = os.WriteFile("/proc/thread-self/attr/exec", data, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("change to profile %q on exec: %w", profile, err)
+	}
+	return nil
+}
+
+// setSELinuxExec makes the calling thread's next exec run under the
+// SELinux context label, like setexeccon(). It runs in the exec helper.
+func setSELinuxExec(label string) error {
+	if err := os.WriteFile("/proc/thread-self/attr/exec", []byte(label), 0); err != nil {
+		return fmt.Errorf("set exec context %q: %w", label, err)
+	}
+	return nil
+}
+
+// validLabels checks the MAC settings of a service
+func validLabels(apparmor, selinux string) error {
+	if apparmor != "" && selinux != "" {
+		return fmt.Errorf("apparmor_profile and selinux_label can't be combined")
+	}
+	// An SELinux context is user:role:type[:level]
+	if selinux != "" && strings.Count(selinux, ":") < 2 {
+		return fmt.Errorf("selinux_label %q is not a context (user:role:type[:level])", selinux)
+	}
+	if strings.ContainsAny(apparmor+selinux, " \n") {
+		return fmt.Errorf("labels can't contain whitespace")
+	}
+	return nil
+}
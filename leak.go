@@ -0,0 +1,109 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// LeakSampleInterval is how often the supervisor samples RSS of running
+// processes for the memory leak heuristic.
+const LeakSampleInterval = 10 * time.Second
+
+// rssSample is a single RSS measurement taken at a point in time
+type rssSample struct {
+	at  time.Time
+	rss int64 // KB
+}
+
+// sampleLeaks records RSS for every process with leak detection enabled
+// and reacts to processes whose memory has been growing steadily.
+//
+// KEY CONCEPT: Slow leaks vs the OOM killer
+// A memory.max limit only helps once the process is already dead. A leak
+// usually shows up much earlier as RSS that only ever goes up. We keep a
+// sliding window of samples per process; if every sample in a window of
+// LeakDuration is >= the previous one AND the overall growth rate exceeds
+// LeakRate, we flag it (and optionally restart it on our own terms).
+func (s *Supervisor) sampleLeaks() {
+	s.mu.RLock()
+	procs := make([]*Process, 0, len(s.processes))
+	for _, p := range s.processes {
+		procs = append(procs, p)
+	}
+	s.mu.RUnlock()
+
+	now := s.clock.Now()
+	for _, p := range procs {
+		p.mu.Lock()
+		pid := p.pid
+		enabled := p.LeakRate > 0 && p.state == StateRunning
+		p.mu.Unlock()
+		if !enabled || pid == 0 {
+			continue
+		}
+
+		// Read outside the lock - /proc reads can be slow under pressure
+		rss, err := readRSS(pid)
+		if err != nil {
+			continue
+		}
+
+		p.mu.Lock()
+		leaking, rate := p.recordRSS(now, rss)
+		action := p.LeakAction
+		p.mu.Unlock()
+
+		if !leaking {
+			continue
+		}
+
+		logWarn("possible memory leak in %s: RSS=%d KB, growing %.0f KB/min for %v",
+			p.Name, rss, rate, p.LeakDuration)
+		if action == "restart" {
+			logInfo("restarting %s to reclaim leaked memory", p.Name)
+			p.killForRestart(syscall.SIGTERM)
+		}
+	}
+}
+
+// recordRSS appends a sample and evaluates the window. Returns whether the
+// window looks like a leak and the observed growth rate in KB/min.
+// Caller must hold p.mu.
+func (p *Process) recordRSS(now time.Time, rss int64) (bool, float64) {
+	// A new PID means a new process - old samples are meaningless
+	if p.leakPid != p.pid {
+		p.leakPid = p.pid
+		p.rssSamples = nil
+	}
+
+	p.rssSamples = append(p.rssSamples, rssSample{at: now, rss: rss})
+
+	// Drop samples that fell out of the window, keeping one sample at or
+	// before the window start so the window can span the full duration
+	cutoff := now.Add(-p.LeakDuration)
+	for len(p.rssSamples) > 1 && !p.rssSamples[1].at.After(cutoff) {
+		p.rssSamples = p.rssSamples[1:]
+	}
+
+	first := p.rssSamples[0]
+	if now.Sub(first.at) < p.LeakDuration {
+		return false, 0 // Not enough history yet
+	}
+
+	// Growth must be monotonic across the whole window
+	for i := 1; i < len(p.rssSamples); i++ {
+		if p.rssSamples[i].rss < p.rssSamples[i-1].rss {
+			return false, 0
+		}
+	}
+
+	minutes := now.Sub(first.at).Minutes()
+	rate := float64(rss-first.rss) / minutes
+	if rate < float64(p.LeakRate) {
+		return false, rate
+	}
+
+	// Start a fresh window so we don't alert on every sample
+	p.rssSamples = nil
+	return true, rate
+}
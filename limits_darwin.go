@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// limitedNice is the nice value of services with a cpu_percent below 100
+const limitedNice = 10
+
+// fallbackLimitArgs returns the exec helper options that stand in for
+// the cgroup limits of p (nil if it has none)
+//
+// KEY CONCEPT: Limits without cgroups
+// macOS has no cgroups: nothing caps the memory or CPU time of a group of
+// processes. What it has is per process, inherited across fork and exec,
+// so the exec helper sets it right before the service's exec:
+//   - memory_mb becomes RLIMIT_DATA (ulimit -d). It bounds each process of
+//     the service, not all of them together, and macOS only counts part
+//     of what a process allocates against it - a guard rail, not a cgroup.
+//   - cpu_percent below 100 can't be a quota; it lowers the service's
+//     priority instead: nice 10, and a QoS clamp through taskpolicy(8),
+//     "utility", or "background" at 25% and below, which also throttles
+//     the service's disk I/O and, on Apple silicon, keeps it on the
+//     efficiency cores.
+//
+// Under contention such a service gets less CPU; on an idle machine it
+// may still use all of it.
+func (p *Process) fallbackLimitArgs() []string {
+	var args []string
+	if p.MemoryLimit > 0 {
+		args = append(args, "-rlimit-data", strconv.FormatInt(p.MemoryLimit, 10))
+	}
+	if p.CPUQuota > 0 && p.CPUQuota < 100 {
+		args = append(args, "-nice", strconv.Itoa(limitedNice), "-qos", qosClamp(p.CPUQuota))
+	}
+	return args
+}
+
+// fallbackLimits describes what fallbackLimitArgs sets up, for logs and
+// --dry-run
+func (p *Process) fallbackLimits() []string {
+	var limits []string
+	if p.MemoryLimit > 0 {
+		limits = append(limits, fmt.Sprintf("RLIMIT_DATA = %d (%s)", p.MemoryLimit, formatBytes(p.MemoryLimit)))
+	}
+	if p.CPUQuota > 0 && p.CPUQuota < 100 {
+		limits = append(limits, fmt.Sprintf("nice %d, taskpolicy -c %s (for cpu %d%%)", limitedNice, qosClamp(p.CPUQuota), p.CPUQuota))
+	}
+	return limits
+}
+
+// applyFallbackLimits logs the limits the exec helper set for the
+// service that just started
+func (p *Process) applyFallbackLimits() {
+	if limits := p.fallbackLimits(); len(limits) > 0 {
+		logInfo("applied limits to %s (%s)", p.Name, strings.Join(limits, "; "))
+	}
+}
+
+// qosClamp picks the taskpolicy QoS clamp for a CPU percentage
+func qosClamp(percent int) string {
+	if percent <= 25 {
+		return "background"
+	}
+	return "utility"
+}
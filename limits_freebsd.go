@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// fallbackLimitArgs: rctl rules are added from gosv, by pid, once the
+// service runs (see applyFallbackLimits)
+func (p *Process) fallbackLimitArgs() []string { return nil }
+
+// rctlRules returns the resource:action=amount part of the rctl rules
+// that stand in for the cgroup limits of p
+//
+// KEY CONCEPT: rctl(8)
+// FreeBSD accounts resource usage per process, user, login class and
+// jail (RACCT), and rctl puts limits on it: a rule such as
+// "process:1234:memoryuse:deny=1073741824" denies process 1234 resident
+// memory beyond 1GB (the kernel pages it out), "pcpu:deny=50" throttles
+// it to half a CPU - the same unit as cpu_percent. A rule on a process
+// is copied to every child it forks afterwards, so a service started
+// with its rules keeps them across its own fork and exec; each process
+// gets its own copy, though, and the limit applies to each one alone,
+// not to the service as a whole like a cgroup. Accounting is off unless
+// the kernel was booted with kern.racct.enable=1 (loader.conf).
+func (p *Process) rctlRules() []string {
+	var rules []string
+	if p.MemoryLimit > 0 {
+		rules = append(rules, fmt.Sprintf("memoryuse:deny=%d", p.MemoryLimit))
+	}
+	if p.CPUQuota > 0 {
+		rules = append(rules, fmt.Sprintf("pcpu:deny=%d", p.CPUQuota))
+	}
+	return rules
+}
+
+// fallbackLimits describes the rctl rules of p, for logs and --dry-run
+func (p *Process) fallbackLimits() []string {
+	var limits []string
+	for _, rule := range p.rctlRules() {
+		limits = append(limits, "rctl process:<pid>:"+rule)
+	}
+	return limits
+}
+
+// applyFallbackLimits adds the rctl rules of p for the process that just
+// started. They go away with it: a restart adds them again.
+func (p *Process) applyFallbackLimits() {
+	rules := p.rctlRules()
+	if len(rules) == 0 {
+		return
+	}
+	for _, rule := range rules {
+		if err := rctlAddRule(fmt.Sprintf("process:%d:%s", p.pid, rule)); err != nil {
+			if err == syscall.ENOSYS {
+				logWarn("no limits for %s: resource accounting is disabled (set kern.racct.enable=1 in /boot/loader.conf)", p.Name)
+				return
+			}
+			logWarn("failed to add rctl rule %s for %s: %v", rule, p.Name, err)
+		}
+	}
+	logInfo("applied limits to %s (rctl %s)", p.Name, strings.Join(rules, ", "))
+}
+
+// rctlAddRule adds rule with rctl_add_rule(2), what rctl -a does
+func rctlAddRule(rule string) error {
+	buf, err := syscall.ByteSliceFromString(rule)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_RCTL_ADD_RULE,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// limitOverride records that a service's limits were changed at runtime:
+// what the config says, and when they were changed
+type limitOverride struct {
+	memory int64 // Bytes, 0 for none
+	cpu    int   // Percent, 0 for none
+	at     time.Time
+}
+
+// setLimits changes p's memory (bytes) and CPU limits, 0 for none, and
+// writes them to its cgroup. It reports whether they only apply from p's
+// next start, because p has no cgroup of its own now.
+//
+// KEY CONCEPT: Live cgroup limits
+// A cgroup's limits are plain files, and the kernel enforces whatever
+// they say from the moment they're written - nothing needs to restart.
+// Raising memory.max relieves a service the OOM killer is about to hit;
+// lowering it makes the kernel reclaim the cgroup's page cache and swap
+// it out, and OOM-kill it only if that isn't enough. Writing cpu.max
+// throttles a runaway service within one 100ms period. Changing the
+// config instead would mean a reload, and a reload restarts the service:
+// the opposite of relief. The change is kept in memory, so it survives
+// the service's own restarts, and recorded next to what the config said,
+// so it's visible as an override and not mistaken for the config.
+func (p *Process) setLimits(memory int64, cpuPercent int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.override == nil {
+		p.override = &limitOverride{memory: p.MemoryLimit, cpu: p.CPUQuota}
+	}
+	p.override.at = p.now()
+	was := formatLimits(p.MemoryLimit, p.CPUQuota)
+	p.MemoryLimit, p.CPUQuota = memory, cpuPercent
+	config := formatLimits(p.override.memory, p.override.cpu)
+	if memory == p.override.memory && cpuPercent == p.override.cpu {
+		p.override = nil // Back to the config
+	}
+	p.noteEvent(EventLimits, "limits set to %s (were %s, config %s)", formatLimits(memory, cpuPercent), was, config)
+	return !p.writeLimits()
+}
+
+// writeLimits writes p's MemoryLimit and CPUQuota to its cgroup. It
+// reports false if p has no cgroup of its own now, and they only apply
+// from its next start. Caller must hold p.mu.
+func (p *Process) writeLimits() bool {
+	if p.cgroup == nil || p.DelegateCgroup {
+		return false
+	}
+	// memory.max and cpu.max take "max" for no limit
+	mem, cpu := "max", "max 100000"
+	if p.MemoryLimit > 0 {
+		mem = strconv.FormatInt(p.MemoryLimit, 10)
+	}
+	if p.CPUQuota > 0 {
+		cpu = fmt.Sprintf("%d 100000", p.CPUQuota*1000)
+	}
+	for _, f := range []struct{ file, value, controller string }{{"memory.max", mem, "memory"}, {"cpu.max", cpu, "cpu"}} {
+		if controllerMissing(f.controller) {
+			logWarn("%s of %s is not enforced: no %s controller", f.file, p.Name, f.controller)
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(p.cgroup.path, f.file), []byte(f.value), 0644); err != nil {
+			logWarn("failed to set %s of %s: %v", f.file, p.Name, err)
+		}
+	}
+	logInfo("limits of %s set to %s", p.Name, formatLimits(p.MemoryLimit, p.CPUQuota))
+	return true
+}
+
+// formatLimits describes a memory (bytes) and CPU limit
+func formatLimits(memory int64, cpuPercent int) string {
+	mem, cpu := "none", "none"
+	if memory > 0 {
+		mem = formatBytes(memory)
+	}
+	if cpuPercent > 0 {
+		cpu = fmt.Sprintf("%d%%", cpuPercent)
+	}
+	return fmt.Sprintf("memory %s, cpu %s", mem, cpu)
+}
+
+// SetLimits changes the memory (bytes) and CPU limits of the target
+// services (a name or "@group") without restarting them; nil leaves a
+// limit as it is, 0 removes it. The change lasts until a reload changes
+// the service's config, or until it's set back. It returns the limits
+// of the services afterwards, one line each.
+func (s *Supervisor) SetLimits(target string, memory *int64, cpuPercent *int) (string, error) {
+	procs, err := s.resolve(target)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, p := range procs {
+		p.mu.Lock()
+		mem, cpu := p.MemoryLimit, p.CPUQuota
+		p.mu.Unlock()
+		if memory != nil {
+			mem = *memory
+		}
+		if cpuPercent != nil {
+			cpu = *cpuPercent
+		}
+		later := false
+		if memory != nil || cpuPercent != nil {
+			later = p.setLimits(mem, cpu)
+		}
+
+		p.mu.Lock()
+		fmt.Fprintf(&b, "%s: %s", p.Name, formatLimits(p.MemoryLimit, p.CPUQuota))
+		if o := p.override; o != nil {
+			fmt.Fprintf(&b, " (set %s; config %s)", o.at.Format("15:04:05"), formatLimits(o.memory, o.cpu))
+		} else if len(p.ProfileLimits) > 0 && p.profile != "" {
+			fmt.Fprintf(&b, " (limit profile %s)", p.profile)
+		}
+		p.mu.Unlock()
+		if later {
+			b.WriteString(", from its next start")
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// parseMemoryLimit parses a --memory value: a size like 512M, 1.5G or
+// 2GiB (plain numbers are MB, like memory_mb), or "none"
+func parseMemoryLimit(s string) (int64, error) {
+	if s == "none" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix string
+		size   float64
+	}{{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"", 1 << 20}}
+	for _, u := range units {
+		if n, ok := strings.CutSuffix(s, u.suffix); ok {
+			if f, err := strconv.ParseFloat(n, 64); err == nil && f >= 0 {
+				return int64(f * u.size), nil
+			}
+			break
+		}
+	}
+	return 0, fmt.Errorf("not a memory size: %q (want e.g. 512M, 2G or none)", s)
+}
+
+// ctlSetLimit is `gosv ctl set-limit <service|@group>... [--memory size]
+// [--cpu percent]`: it changes the limits of running services, or
+// without --memory and --cpu shows them
+func ctlSetLimit(conn net.Conn, args []string) error {
+	req := ctlRequest{Command: "set-limit"}
+	for ; len(args) > 0; args = args[1:] {
+		switch arg := args[0]; {
+		case arg == "--memory" && len(args) > 1:
+			n, err := parseMemoryLimit(args[1])
+			if err != nil {
+				return fmt.Errorf("set-limit: --memory: %w", err)
+			}
+			req.Memory = &n
+			args = args[1:]
+		case arg == "--cpu" && len(args) > 1:
+			value := strings.TrimSuffix(args[1], "%")
+			if value == "none" {
+				value = "0"
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("set-limit: --cpu: not a percentage: %q (want e.g. 150 or none)", args[1])
+			}
+			req.CPU = &n
+			args = args[1:]
+		case (arg == "-l" || arg == "--selector") && len(args) > 1:
+			req.Selector = args[1]
+			args = args[1:]
+		default:
+			req.Args = append(req.Args, arg)
+		}
+	}
+	reply, err := ctlCallReply(conn, req)
+	fmt.Print(reply.Output)
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// logSummaryInterval is how long repeated or rate-limited lines are
+// counted before gosv says so, if nothing else ends the run first
+const logSummaryInterval = 10 * time.Second
+
+// logFilter collapses repeated lines and rate-limits the output of one
+// service. It's guarded by the mutex of its pipeline.
+//
+// KEY CONCEPT: Log floods
+// A service in a crash loop, or stuck retrying a dead database, prints
+// the same error again and again - thousands of lines a second that say
+// nothing new, fill the disk and push everything useful out of the log.
+// Syslog's answer is to keep the first line and replace the rest with
+// "last message repeated N times" (log_dedup): nothing is lost but the
+// repetition itself. Lines that differ slightly (a counter, a timestamp)
+// get past that, so a token bucket (log_rate_limit) caps how many lines
+// per second get through, allowing bursts up to log_rate_burst. What it
+// holds back is counted, and the count is logged in the service's output
+// where the gap is, so a reader knows lines are missing.
+type logFilter struct {
+	dedup bool
+	rate  float64 // Lines per second (0 for no limit)
+	burst float64
+
+	tokens   float64
+	refilled time.Time
+	limited  int // Lines held back since the last summary
+
+	last    map[string][]byte // Last line per stream
+	repeats map[string]int    // Repetitions of it not passed on
+
+	timer *time.Timer // Pending summary
+}
+
+// newLogFilter returns the filter p's output needs (nil for none)
+func newLogFilter(p *Process) *logFilter {
+	if !p.LogDedup && p.LogRateLimit == 0 {
+		return nil
+	}
+	burst := p.LogRateBurst
+	if burst == 0 {
+		burst = p.LogRateLimit
+	}
+	return &logFilter{
+		dedup:   p.LogDedup,
+		rate:    float64(p.LogRateLimit),
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    make(map[string][]byte),
+		repeats: make(map[string]int),
+	}
+}
+
+// filter returns what becomes of l: nothing, l, or l after summaries of
+// what was held back before it. Caller must hold lp.mu.
+func (lp *logPipeline) filter(l logLine) []logLine {
+	f := lp.logFilter
+	if f == nil {
+		return []logLine{l}
+	}
+	var out []logLine
+	if f.dedup {
+		if last, ok := f.last[l.stream]; ok && bytes.Equal(last, l.text) {
+			f.repeats[l.stream]++
+			lp.repeated.Add(1)
+			lp.armSummaries()
+			return nil
+		}
+		out = append(out, f.repeatSummary(l.stream, l.time)...)
+		f.last[l.stream] = l.text
+	}
+	if f.rate > 0 {
+		f.tokens += l.time.Sub(f.refilled).Seconds() * f.rate
+		f.refilled = l.time
+		if f.tokens > f.burst {
+			f.tokens = f.burst
+		}
+		if f.tokens < 1 {
+			f.limited++
+			lp.limited.Add(1)
+			lp.armSummaries()
+			return out
+		}
+		f.tokens--
+		out = append(out, f.limitSummary(l.time)...)
+	}
+	return append(out, l)
+}
+
+// repeatSummary says how often the last line of stream was repeated, if
+// it was
+func (f *logFilter) repeatSummary(stream string, t time.Time) []logLine {
+	n := f.repeats[stream]
+	if n == 0 {
+		return nil
+	}
+	f.repeats[stream] = 0
+	text := fmt.Sprintf("gosv: last message repeated %d times", n)
+	if n == 1 {
+		text = "gosv: last message repeated once"
+	}
+	return []logLine{{stream: stream, text: []byte(text), time: t}}
+}
+
+// limitSummary says how many lines the rate limit held back, if any
+func (f *logFilter) limitSummary(t time.Time) []logLine {
+	if f.limited == 0 {
+		return nil
+	}
+	text := fmt.Sprintf("gosv: %d lines suppressed (log_rate_limit %g/s)", f.limited, f.rate)
+	f.limited = 0
+	return []logLine{{stream: "stderr", text: []byte(text), time: t}}
+}
+
+// armSummaries makes sure pending summaries are written within
+// logSummaryInterval, even if the service writes nothing else. Caller
+// must hold lp.mu.
+func (lp *logPipeline) armSummaries() {
+	f := lp.logFilter
+	if f.timer != nil {
+		return
+	}
+	f.timer = time.AfterFunc(logSummaryInterval, func() {
+		lp.mu.Lock()
+		defer lp.mu.Unlock()
+		f.timer = nil
+		if !lp.closed {
+			lp.flushSummaries()
+		}
+	})
+}
+
+// flushSummaries writes pending summaries now. Caller must hold lp.mu.
+func (lp *logPipeline) flushSummaries() {
+	f := lp.logFilter
+	if f == nil {
+		return
+	}
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	now := time.Now()
+	streams := make([]string, 0, len(f.repeats))
+	for stream := range f.repeats {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+	for _, stream := range streams {
+		for _, l := range f.repeatSummary(stream, now) {
+			lp.put(l)
+		}
+	}
+	for _, l := range f.limitSummary(now) {
+		lp.put(l)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLogFilter(t *testing.T) {
+	type line struct {
+		stream, text string
+		at           time.Duration // After testEpoch
+	}
+	tests := []struct {
+		name        string
+		dedup       bool
+		rate, burst int
+		lines       []line
+		want        []string // "stream: text"
+	}{
+		{
+			name:  "dedup",
+			dedup: true,
+			lines: []line{{"stdout", "a", 0}, {"stdout", "a", 0}, {"stdout", "a", 0}, {"stdout", "b", 0}},
+			want:  []string{"stdout: a", "stdout: gosv: last message repeated 2 times", "stdout: b"},
+		},
+		{
+			name:  "dedup once",
+			dedup: true,
+			lines: []line{{"stdout", "a", 0}, {"stdout", "a", 0}, {"stdout", "b", 0}},
+			want:  []string{"stdout: a", "stdout: gosv: last message repeated once", "stdout: b"},
+		},
+		{
+			name:  "dedup per stream",
+			dedup: true,
+			lines: []line{{"stdout", "a", 0}, {"stderr", "a", 0}, {"stdout", "a", 0}, {"stderr", "b", 0}},
+			want:  []string{"stdout: a", "stderr: a", "stderr: b"},
+		},
+		{
+			name:  "rate limit",
+			rate:  2,
+			lines: []line{{"stdout", "1", 0}, {"stdout", "2", 0}, {"stdout", "3", 0}, {"stdout", "4", 0}, {"stdout", "5", time.Second}},
+			want:  []string{"stdout: 1", "stdout: 2", "stderr: gosv: 2 lines suppressed (log_rate_limit 2/s)", "stdout: 5"},
+		},
+		{
+			name:  "rate limit refills by line time",
+			rate:  1,
+			lines: []line{{"stdout", "1", 0}, {"stdout", "2", 500 * time.Millisecond}, {"stdout", "3", 1500 * time.Millisecond}},
+			want:  []string{"stdout: 1", "stderr: gosv: 1 lines suppressed (log_rate_limit 1/s)", "stdout: 3"},
+		},
+		{
+			name:  "burst",
+			rate:  1,
+			burst: 3,
+			lines: []line{{"stdout", "1", 0}, {"stdout", "2", 0}, {"stdout", "3", 0}, {"stdout", "4", 0}},
+			want:  []string{"stdout: 1", "stdout: 2", "stdout: 3"},
+		},
+		{
+			name:  "repeats don't use up the rate",
+			dedup: true,
+			rate:  1,
+			lines: []line{{"stdout", "a", 0}, {"stdout", "a", 0}, {"stdout", "a", 0}, {"stdout", "b", time.Second}},
+			want:  []string{"stdout: a", "stdout: gosv: last message repeated 2 times", "stdout: b"},
+		},
+	}
+	for _, tt := range tests {
+		p := testProcess("web")
+		p.LogDedup, p.LogRateLimit, p.LogRateBurst = tt.dedup, tt.rate, tt.burst
+		lp := &logPipeline{logFilter: newLogFilter(p), closed: true}
+		var got []string
+		for _, l := range tt.lines {
+			for _, out := range lp.filter(logLine{stream: l.stream, text: []byte(l.text), time: testEpoch.Add(l.at)}) {
+				got = append(got, out.stream+": "+string(out.text))
+			}
+		}
+		if f := lp.logFilter; f.timer != nil {
+			f.timer.Stop()
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewLogFilter(t *testing.T) {
+	p := testProcess("web")
+	if f := newLogFilter(p); f != nil {
+		t.Errorf("filter without log_dedup or log_rate_limit: %+v", f)
+	}
+	p.LogRateLimit = 5
+	if f := newLogFilter(p); f == nil || f.burst != 5 || f.tokens != 5 {
+		t.Errorf("burst of log_rate_limit 5 without log_rate_burst: %+v, want 5", f)
+	}
+}
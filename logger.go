@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogLevel orders log messages by importance
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	return [...]string{"debug", "info", "warn", "error"}[l]
+}
+
+// Logger receives all of gosv's own output (not the output of supervised
+// processes). Embedders can plug in their own to control verbosity and
+// destination; the default is a ConsoleLogger on stdout.
+type Logger interface {
+	Logf(level LogLevel, format string, args ...any)
+}
+
+// ConsoleLogger writes "[gosv] ..." lines, dropping anything below Level
+type ConsoleLogger struct {
+	Out   io.Writer
+	Level LogLevel
+
+	mu sync.Mutex
+}
+
+// NewConsoleLogger returns a ConsoleLogger writing to out
+func NewConsoleLogger(out io.Writer, level LogLevel) *ConsoleLogger {
+	return &ConsoleLogger{Out: out, Level: level}
+}
+
+func (c *ConsoleLogger) Logf(level LogLevel, format string, args ...any) {
+	if level < c.Level {
+		return
+	}
+
+	prefix := "[gosv] "
+	switch level {
+	case LevelWarn:
+		prefix += "warning: "
+	case LevelError:
+		prefix += "error: "
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.Out, prefix+format+"\n", args...)
+}
+
+// JSONLogger writes one JSON object per line, dropping anything below
+// Level:
+//
+//	{"time":"2026-10-16T11:28:00.123Z","level":"info","msg":"web started (pid 42)"}
+//
+// KEY CONCEPT: Logs for people vs logs for programs
+// "[gosv] warning: ..." is easy to read and hard to parse: a message may
+// contain anything, including newlines and text that looks like another
+// prefix. A log collector (journald forwarding, Fluent Bit, Loki) wants
+// records with the level and time as fields, one per line, with the
+// message escaped. Such a stream is only parseable if nothing else is
+// mixed into it, which is why --log-format json also routes the output
+// of services through their pipelines (see logpipe.go) as records of
+// their own.
+type JSONLogger struct {
+	Out   io.Writer
+	Level LogLevel
+
+	mu sync.Mutex
+}
+
+// NewJSONLogger returns a JSONLogger writing to out
+func NewJSONLogger(out io.Writer, level LogLevel) *JSONLogger {
+	return &JSONLogger{Out: out, Level: level}
+}
+
+// jsonRecord is one line of --log-format json. Service and Stream are set
+// for the output of services.
+type jsonRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level,omitempty"`
+	Service string `json:"service,omitempty"`
+	Stream  string `json:"stream,omitempty"`
+	Msg     string `json:"msg"`
+}
+
+func (j *JSONLogger) Logf(level LogLevel, format string, args ...any) {
+	if level < j.Level {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	writeJSONRecord(j.Out, jsonRecord{Level: level.String(), Msg: fmt.Sprintf(format, args...)})
+}
+
+// writeJSONRecord writes r as one line, stamped with the current time
+// unless it has one
+func writeJSONRecord(w io.Writer, r jsonRecord) {
+	if r.Time == "" {
+		r.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	b, _ := json.Marshal(r) // Only strings: can't fail
+	w.Write(append(b, '\n'))
+}
+
+// jsonOutput is set by --log-format json: gosv's stdout and stderr carry
+// JSON lines only
+var jsonOutput bool
+
+// Log formats for --log-format
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// setupLogging installs the logger for the command line flags: verbose
+// (-v) logs debug messages too, quiet (-q) only warnings and errors
+func setupLogging(format string, verbose, quiet bool) error {
+	level := LevelInfo
+	switch {
+	case verbose && quiet:
+		return fmt.Errorf("-v and -q are mutually exclusive")
+	case verbose:
+		level = LevelDebug
+	case quiet:
+		level = LevelWarn
+	}
+	switch format {
+	case LogFormatText, "":
+		SetLogger(NewConsoleLogger(os.Stdout, level))
+	case LogFormatJSON:
+		SetLogger(NewJSONLogger(os.Stdout, level))
+		jsonOutput = true
+	default:
+		return fmt.Errorf("unknown log format %q (want %s or %s)", format, LogFormatText, LogFormatJSON)
+	}
+	return nil
+}
+
+// logger is the active Logger, shared by the supervisor, processes and
+// cgroup helpers
+var logger Logger = NewConsoleLogger(os.Stdout, LevelInfo)
+
+// SetLogger replaces the active Logger
+func SetLogger(l Logger) {
+	logger = l
+}
+
+func logDebug(format string, args ...any) { logger.Logf(LevelDebug, format, args...) }
+func logInfo(format string, args ...any)  { logger.Logf(LevelInfo, format, args...) }
+func logWarn(format string, args ...any)  { logger.Logf(LevelWarn, format, args...) }
+func logError(format string, args ...any) { logger.Logf(LevelError, format, args...) }
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLogBuffer is how many lines of a service's output can wait for
+// the console when log_buffer_lines is not configured
+const DefaultLogBuffer = 1000
+
+// logDropReportInterval spaces out the warnings about dropped output
+const logDropReportInterval = 10 * time.Second
+
+// maxLogLine is where a line without a newline is cut
+const maxLogLine = 64 * 1024
+
+// Log overflow policies: what a pipeline does when its buffer is full
+const (
+	LogOverflowDrop  = "drop"  // Drop the oldest waiting line (and count it)
+	LogOverflowBlock = "block" // Stop reading until there's room: the service blocks writing
+)
+
+// Log timestamp formats: what precedes each captured line (see logStamp)
+const (
+	LogTimestampNone        = "none"
+	LogTimestampRFC3339     = "rfc3339"
+	LogTimestampRFC3339Nano = "rfc3339nano"
+	LogTimestampEpoch       = "epoch"
+	LogTimestampTAI64N      = "tai64n"
+)
+
+// tai64Epoch is the TAI64 label of 1970-01-01 00:00:10 TAI, the Unix epoch
+// as daemontools counts it (without leap seconds, like tai64nlocal)
+const tai64Epoch = 1<<62 + 10
+
+// logLine is one line of a service's output
+type logLine struct {
+	stream string    // "stdout" or "stderr"
+	text   []byte    // Without the newline
+	time   time.Time // When gosv read it
+}
+
+// validLogTimestamp reports whether s is a known timestamp format ("" for
+// the default, none)
+func validLogTimestamp(s string) bool {
+	switch s {
+	case "", LogTimestampNone, LogTimestampRFC3339, LogTimestampRFC3339Nano, LogTimestampEpoch, LogTimestampTAI64N:
+		return true
+	}
+	return false
+}
+
+// logStamp returns the function that timestamps p's output lines, or nil
+// if they aren't timestamped
+//
+// KEY CONCEPT: Timestamping output
+// A line has no time of its own; whoever writes it down adds one. An app
+// with its own log format already stamps its lines, and a second stamp
+// only gets in the way of parsers (none, the default). Everything else
+// gets its time from gosv, taken when the line is read from the pipe -
+// not when it reaches the console, which under backpressure can be much
+// later. rfc3339 is for people and most log shippers, in log_timezone
+// (local time by default). epoch is seconds since 1970 with microseconds,
+// for tools that sort and subtract. tai64n is daemontools' format: "@"
+// and 24 hex digits, what svlogd and multilog write and tai64nlocal
+// turns back into dates, so pipelines built for them keep working.
+func (p *Process) logStamp() func(time.Time) string {
+	loc := p.LogTimezone
+	if loc == nil {
+		loc = time.Local
+	}
+	switch p.LogTimestamp {
+	case LogTimestampRFC3339:
+		return func(t time.Time) string { return t.In(loc).Format(time.RFC3339) }
+	case LogTimestampRFC3339Nano:
+		return func(t time.Time) string { return t.In(loc).Format(time.RFC3339Nano) }
+	case LogTimestampEpoch:
+		return func(t time.Time) string { return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000) }
+	case LogTimestampTAI64N:
+		return func(t time.Time) string {
+			return fmt.Sprintf("@%016x%08x", uint64(tai64Epoch+t.Unix()), t.Nanosecond())
+		}
+	}
+	return nil
+}
+
+// logPipeline carries the captured output of one service, line by line,
+// from the pipes os/exec reads to the console
+//
+// KEY CONCEPT: Backpressure
+// A child writing to a pipe blocks once the pipe's 64 KiB are full and
+// nobody reads. If the reader is the same code that writes to a slow
+// terminal or log collector, one chatty service stalls itself - and every
+// service sharing that writer. A pipeline decouples the two: a reader per
+// service drains its pipes into a bounded queue right away, and a writer
+// empties the queue at whatever pace the console manages. When the queue
+// is full there are only two honest choices: push back on the service
+// ("block" - nothing is lost, the service slows down) or drop the oldest
+// lines ("drop" - the service never waits, and a counter says how much
+// was lost). Silently buffering without bound is how supervisors run
+// out of memory.
+type logPipeline struct {
+	name      string
+	overflow  string
+	queue     chan logLine
+	ring      *lineRing // Recent output for diagnostics (nil if unused)
+	console   map[string]io.Writer
+	stamp     func(time.Time) string  // Prefix of each line (nil for none)
+	labels    map[string]string       // The service's, for Loki and sinks
+	streams   map[string]streamOutput // Where each stream goes
+	files     map[string]*os.File     // By path, owned by run (nil if it failed)
+	clean     map[string]lineCleaner  // Per console stream
+	ringClean lineCleaner             // For the ring, Loki and log sinks
+	logFilter *logFilter              // Dedup and rate limit (nil for none)
+
+	lines    atomic.Uint64
+	dropped  atomic.Uint64
+	repeated atomic.Uint64
+	limited  atomic.Uint64
+
+	// Recent lines and followers, for `gosv ctl logs` (see ctllogs.go)
+	tailMu    sync.Mutex
+	tail      []logLine
+	tailNext  int // Where the next line goes once tail is full
+	followers map[*logFollower]struct{}
+	finished  bool
+
+	mu          sync.Mutex // Serializes enqueues, guards closed and logFilter
+	closed      bool
+	reported    uint64 // dropped, as of the last warning
+	reportedAt  time.Time
+	reportTimer *time.Timer
+}
+
+// newLogPipeline returns the pipeline for the output of p, which also
+// writes to ring (if not nil)
+func newLogPipeline(p *Process, ring *lineRing) *logPipeline {
+	buffer, overflow := p.LogBuffer, p.LogOverflow
+	if buffer <= 0 {
+		buffer = DefaultLogBuffer
+	}
+	if overflow == "" {
+		overflow = LogOverflowBlock
+	}
+	lp := &logPipeline{
+		name:      p.Name,
+		labels:    p.Labels,
+		streams:   map[string]streamOutput{"stdout": p.streamOutput("stdout"), "stderr": p.streamOutput("stderr")},
+		files:     make(map[string]*os.File),
+		overflow:  overflow,
+		queue:     make(chan logLine, buffer),
+		ring:      ring,
+		console:   map[string]io.Writer{"stdout": os.Stdout, "stderr": os.Stderr},
+		stamp:     p.logStamp(),
+		clean:     make(map[string]lineCleaner),
+		ringClean: p.cleanerFor(false),
+		logFilter: newLogFilter(p),
+	}
+	for stream, w := range lp.console {
+		lp.clean[stream] = p.cleanerFor(isTerminalSink(w))
+	}
+	go lp.run()
+	return lp
+}
+
+// ensureLogs gives p its pipeline, and the ring of recent output for
+// diagnostics, unless it has them. Caller must hold p.mu.
+func (p *Process) ensureLogs() {
+	if p.DiagnosticsDir != "" && p.output == nil {
+		p.output = newLineRing(diagOutputLines)
+	}
+	if p.logs == nil {
+		p.logs = newLogPipeline(p, p.output)
+	}
+}
+
+// validLogOverflow reports whether s is a known overflow policy ("" for
+// the default)
+func validLogOverflow(s string) bool {
+	return s == "" || s == LogOverflowDrop || s == LogOverflowBlock
+}
+
+// writer returns an io.Writer for one output stream of the service. Each
+// stream needs its own: it keeps the unterminated end of the last write.
+func (lp *logPipeline) writer(stream string) io.Writer {
+	return &logStream{lp: lp, stream: stream}
+}
+
+// enqueue hands a line to the writer goroutine, unless log_dedup or
+// log_rate_limit hold it back
+func (lp *logPipeline) enqueue(l logLine) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if lp.closed {
+		return
+	}
+	lp.lines.Add(1)
+	for _, l := range lp.filter(l) {
+		lp.put(l)
+	}
+}
+
+// put queues a line for the writer goroutine, applying the overflow policy
+// if the queue is full. Caller must hold lp.mu.
+func (lp *logPipeline) put(l logLine) {
+	if lp.ring != nil {
+		lp.ring.Write(append(lp.ringClean.clean(l.text), '\n'))
+	}
+	if lp.overflow == LogOverflowBlock {
+		lp.queue <- l
+		return
+	}
+	for {
+		select {
+		case lp.queue <- l:
+			return
+		default:
+		}
+		select {
+		case <-lp.queue:
+			lp.dropped.Add(1)
+		default: // The writer just made room
+		}
+	}
+}
+
+// run writes queued lines to the console until the pipeline is closed
+func (lp *logPipeline) run() {
+	defer lp.finishFollowers()
+	defer lp.closeStreamFiles()
+	for l := range lp.queue {
+		out := lp.streams[l.stream]
+		w := lp.console[l.stream]
+		raw := l.text
+		l.text = lp.clean[l.stream].clean(l.text)
+		switch {
+		case !out.console:
+		case jsonOutput:
+			// Records have a time of their own
+			writeJSONRecord(w, jsonRecord{Time: l.time.UTC().Format(time.RFC3339Nano), Level: out.level.String(), Service: lp.name, Stream: l.stream, Msg: string(l.text)})
+		case lp.stamp != nil:
+			line := append([]byte(lp.stamp(l.time)+" "), l.text...)
+			w.Write(append(line, '\n'))
+		default:
+			w.Write(append(l.text, '\n'))
+		}
+		line := lp.ringClean.clean(raw)
+		if out.file != "" {
+			if f := lp.openStreamFile(out.file); f != nil {
+				var prefix string
+				if lp.stamp != nil {
+					prefix = lp.stamp(l.time) + " "
+				}
+				f.Write(append(append([]byte(prefix), line...), '\n'))
+			}
+		}
+		lp.publish(logLine{stream: l.stream, text: line, time: l.time})
+		if sh := lokiShipping.Load(); sh != nil && out.loki {
+			sh.add(lp.name, lp.labels, l.stream, out.level, l.time, string(line))
+		}
+		for _, name := range out.sinks {
+			if sk := sinkNamed(name); sk != nil {
+				sk.send(sinkRecord{service: lp.name, labels: lp.labels, stream: l.stream, level: out.level, time: l.time, line: string(line), syslog: out.syslog})
+			}
+		}
+		if len(lp.queue) == 0 {
+			lp.reportDrops()
+		}
+	}
+}
+
+// reportDrops logs how many lines were dropped since the last report
+// (at most once per logDropReportInterval)
+func (lp *logPipeline) reportDrops() {
+	lp.mu.Lock()
+	dropped := lp.dropped.Load()
+	n := dropped - lp.reported
+	wait := logDropReportInterval - time.Since(lp.reportedAt)
+	if n == 0 || lp.reportTimer != nil {
+		lp.mu.Unlock()
+		return
+	}
+	if wait > 0 {
+		lp.reportTimer = time.AfterFunc(wait, func() {
+			lp.mu.Lock()
+			lp.reportTimer = nil
+			lp.mu.Unlock()
+			lp.reportDrops()
+		})
+		lp.mu.Unlock()
+		return
+	}
+	lp.reported, lp.reportedAt = dropped, time.Now()
+	lp.mu.Unlock()
+	logWarn("%s: dropped %d lines of output, log buffer full (%d dropped in total)", lp.name, n, dropped)
+}
+
+// close stops the pipeline; later output is discarded
+func (lp *logPipeline) close() {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if !lp.closed {
+		lp.flushSummaries()
+		lp.closed = true
+		close(lp.queue)
+	}
+}
+
+// logStream splits the writes of one stream into lines
+type logStream struct {
+	lp      *logPipeline
+	stream  string
+	partial []byte
+}
+
+func (s *logStream) Write(b []byte) (int, error) {
+	now := time.Now()
+	data := append(s.partial, b...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 && len(data) >= maxLogLine {
+			i = maxLogLine
+		}
+		if i < 0 {
+			break
+		}
+		s.lp.enqueue(logLine{stream: s.stream, text: append([]byte(nil), bytes.TrimSuffix(data[:i], []byte("\r"))...), time: now})
+		if i < len(data) && data[i] == '\n' {
+			i++
+		}
+		data = data[i:]
+	}
+	s.partial = append(s.partial[:0], data...)
+	return len(b), nil
+}
+
+// capturesOutput reports whether p's output goes through a pipeline
+// rather than straight to gosv's stdout and stderr. With --log-format json
+// all of it does, to be wrapped in records. The foreground service keeps
+// our terminal as is. Timestamps, cleaning up lines, dedup and rate
+// limits, shipping to Loki or log sinks and stdout and stderr settings
+// need capture too, and so do jobs, whose caller gets their output.
+func (p *Process) capturesOutput() bool {
+	return !p.Foreground && (p.DiagnosticsDir != "" || p.LogBuffer > 0 || p.LogOverflow != "" || p.logStamp() != nil ||
+		p.cleanerFor(false) != (lineCleaner{}) || p.LogDedup || p.LogRateLimit > 0 || lokiShipping.Load() != nil || len(p.LogSinks) > 0 || p.Stdout != nil || p.Stderr != nil || jsonOutput || p.job != nil || p.Attachable)
+}
+
+// logCounts counts what became of a service's output lines
+type logCounts struct {
+	lines    uint64 // Captured
+	dropped  uint64 // Lost to a full log buffer
+	repeated uint64 // Collapsed by log_dedup
+	limited  uint64 // Held back by log_rate_limit
+}
+
+// logStats returns the counts of p's output lines
+func (p *Process) logStats() logCounts {
+	p.mu.Lock()
+	lp := p.logs
+	p.mu.Unlock()
+	if lp == nil {
+		return logCounts{}
+	}
+	return logCounts{
+		lines:    lp.lines.Load(),
+		dropped:  lp.dropped.Load(),
+		repeated: lp.repeated.Load(),
+		limited:  lp.limited.Load(),
+	}
+}
+
+// metricsText renders the supervisor's counters in the Prometheus text
+// format, for `gosv ctl metrics`
+func (s *Supervisor) metricsText() string {
+	var b bytes.Buffer
+	procs := s.snapshot()
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Name < procs[j].Name })
+
+	fmt.Fprintln(&b, "# HELP gosv_service_up Whether the service is running.")
+	fmt.Fprintln(&b, "# TYPE gosv_service_up gauge")
+	for _, p := range procs {
+		p.mu.Lock()
+		up := 0
+		if p.state == StateRunning {
+			up = 1
+		}
+		p.mu.Unlock()
+		fmt.Fprintf(&b, "gosv_service_up{service=%q} %d\n", p.Name, up)
+	}
+	fmt.Fprintln(&b, "# HELP gosv_service_restarts Restarts of the service in its current restart cycle.")
+	fmt.Fprintln(&b, "# TYPE gosv_service_restarts gauge")
+	for _, p := range procs {
+		p.mu.Lock()
+		restarts := p.restarts
+		p.mu.Unlock()
+		fmt.Fprintf(&b, "gosv_service_restarts{service=%q} %d\n", p.Name, restarts)
+	}
+	fmt.Fprintln(&b, "# HELP gosv_service_failing_readiness Whether the service keeps missing its ready timeout after starts.")
+	fmt.Fprintln(&b, "# TYPE gosv_service_failing_readiness gauge")
+	for _, p := range procs {
+		p.mu.Lock()
+		failing := 0
+		if p.failingReadiness() {
+			failing = 1
+		}
+		p.mu.Unlock()
+		fmt.Fprintf(&b, "gosv_service_failing_readiness{service=%q} %d\n", p.Name, failing)
+	}
+	s.networkMetrics(&b, procs)
+	fmt.Fprintln(&b, "# HELP gosv_log_lines_total Lines of output captured from the service.")
+	fmt.Fprintln(&b, "# TYPE gosv_log_lines_total counter")
+	for _, p := range procs {
+		fmt.Fprintf(&b, "gosv_log_lines_total{service=%q} %d\n", p.Name, p.logStats().lines)
+	}
+	fmt.Fprintln(&b, "# HELP gosv_log_dropped_lines_total Lines of output dropped because the log buffer was full.")
+	fmt.Fprintln(&b, "# TYPE gosv_log_dropped_lines_total counter")
+	for _, p := range procs {
+		fmt.Fprintf(&b, "gosv_log_dropped_lines_total{service=%q} %d\n", p.Name, p.logStats().dropped)
+	}
+	fmt.Fprintln(&b, "# HELP gosv_log_repeated_lines_total Lines of output collapsed into \"last message repeated\" by log_dedup.")
+	fmt.Fprintln(&b, "# TYPE gosv_log_repeated_lines_total counter")
+	for _, p := range procs {
+		fmt.Fprintf(&b, "gosv_log_repeated_lines_total{service=%q} %d\n", p.Name, p.logStats().repeated)
+	}
+	fmt.Fprintln(&b, "# HELP gosv_log_rate_limited_lines_total Lines of output suppressed by log_rate_limit.")
+	fmt.Fprintln(&b, "# TYPE gosv_log_rate_limited_lines_total counter")
+	for _, p := range procs {
+		fmt.Fprintf(&b, "gosv_log_rate_limited_lines_total{service=%q} %d\n", p.Name, p.logStats().limited)
+	}
+	return b.String()
+}
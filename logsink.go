@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log sink types
+const (
+	LogSinkFluentd  = "fluentd"  // Fluentd's forward protocol (also Fluent Bit)
+	LogSinkGELF     = "gelf"     // Graylog Extended Log Format
+	LogSinkSyslog   = "syslog"   // The local syslog socket, or a syslog server
+	LogSinkJournald = "journald" // journald's native protocol
+)
+
+// logSinkQueue is how many lines can wait for a sink's connection before
+// new ones are dropped
+const logSinkQueue = 10000
+
+// Reconnects back off from logSinkBackoff up to logSinkMaxBackoff
+const (
+	logSinkBackoff    = 500 * time.Millisecond
+	logSinkMaxBackoff = 30 * time.Second
+)
+
+// gelfChunkSize is the largest UDP datagram gosv sends to a GELF input:
+// what fits an Ethernet MTU with room for headers
+const gelfChunkSize = 1420
+
+// A chunked GELF message has at most gelfMaxChunks chunks, each starting
+// with a header of gelfChunkHeader bytes
+const (
+	gelfMaxChunks   = 128
+	gelfChunkHeader = 12
+)
+
+var gelfFieldName = regexp.MustCompile(`[^\w.\-]`)
+
+// logSinks are the running sinks by name. Pipelines look them up for
+// every line, so a reload can swap them.
+var logSinks atomic.Pointer[map[string]*logSink]
+
+// LogSinkConfig is a place services can forward their output to (an
+// entry of the top-level "log_sinks" object)
+type LogSinkConfig struct {
+	Type     string `json:"type"`     // fluentd, gelf, syslog or journald
+	Address  string `json:"address"`  // tcp://host:port, udp://host:port (gelf, syslog) or unix:///path (fluentd, syslog, journald)
+	Tag      string `json:"tag"`      // fluentd: prefix of the tag, "<tag>.<service>" (default: gosv)
+	Facility string `json:"facility"` // syslog, journald: of services that don't name one (default: daemon)
+}
+
+// address returns Address, or for syslog and journald their local socket
+// by default
+func (c LogSinkConfig) address() string {
+	switch {
+	case c.Address != "":
+		return c.Address
+	case c.Type == LogSinkSyslog:
+		return DefaultSyslogAddress
+	case c.Type == LogSinkJournald:
+		return DefaultJournaldAddress
+	}
+	return ""
+}
+
+// dialAddress returns the network and address to dial. Syslog and
+// journald sockets take datagrams.
+func (c LogSinkConfig) dialAddress() (string, string) {
+	network, addr, _ := strings.Cut(c.address(), "://")
+	if network == "unix" && (c.Type == LogSinkSyslog || c.Type == LogSinkJournald) {
+		network = "unixgram"
+	}
+	return network, addr
+}
+
+// validate checks the sink named name
+func (c LogSinkConfig) validate(name string) error {
+	network, _, ok := strings.Cut(c.address(), "://")
+	if !ok {
+		return fmt.Errorf("log_sinks: %s: address must be tcp://, udp:// or unix://", name)
+	}
+	switch c.Type {
+	case LogSinkFluentd:
+		if network != "tcp" && network != "unix" {
+			return fmt.Errorf("log_sinks: %s: fluentd needs a tcp:// or unix:// address", name)
+		}
+	case LogSinkGELF:
+		if network != "tcp" && network != "udp" {
+			return fmt.Errorf("log_sinks: %s: gelf needs a tcp:// or udp:// address", name)
+		}
+	case LogSinkSyslog:
+		if network != "tcp" && network != "udp" && network != "unix" {
+			return fmt.Errorf("log_sinks: %s: syslog needs a tcp://, udp:// or unix:// address", name)
+		}
+	case LogSinkJournald:
+		if network != "unix" {
+			return fmt.Errorf("log_sinks: %s: journald needs a unix:// address", name)
+		}
+	default:
+		return fmt.Errorf("log_sinks: %s: unknown type %q (want fluentd, gelf, syslog or journald)", name, c.Type)
+	}
+	if c.Facility != "" {
+		if c.Type != LogSinkSyslog && c.Type != LogSinkJournald {
+			return fmt.Errorf("log_sinks: %s: facility is for syslog and journald", name)
+		}
+		if _, ok := syslogFacilities[c.Facility]; !ok {
+			return fmt.Errorf("log_sinks: %s: unknown facility %q", name, c.Facility)
+		}
+	}
+	return nil
+}
+
+// sinkRecord is one line for a sink
+type sinkRecord struct {
+	service string
+	labels  map[string]string
+	stream  string
+	level   LogLevel
+	time    time.Time
+	line    string
+	syslog  syslogTags
+}
+
+// logSink forwards lines to one Fluentd, GELF, syslog or journald
+// endpoint
+//
+// KEY CONCEPT: Forwarding protocols
+// Log stacks have their own ingestion protocols, and speaking them means
+// the collector gets structured records instead of text to parse. The
+// Fluentd forward protocol sends [tag, time, record] as MessagePack over
+// a TCP or Unix stream; the tag ("gosv.web") is what Fluentd routes on.
+// GELF sends a JSON object per message: over TCP each one ends with a NUL
+// byte, over UDP each one is a datagram - split into numbered chunks
+// with a common message id when it doesn't fit one, since UDP has no
+// stream to reassemble. UDP never blocks and never tells gosv that
+// Graylog is gone; TCP does both. Either way the services must not wait:
+// lines queue in memory up to logSinkQueue, a lost connection is
+// reestablished with backoff, and what doesn't fit the queue is dropped
+// and counted.
+type logSink struct {
+	name string
+	cfg  LogSinkConfig
+	host string
+
+	queue   chan sinkRecord
+	closing chan struct{}
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	mu       sync.Mutex // Guards closed
+	closed   bool
+	reported time.Time // Last warning about drops
+}
+
+func newLogSink(name string, cfg LogSinkConfig) *logSink {
+	host, _ := os.Hostname()
+	sk := &logSink{
+		name:    name,
+		cfg:     cfg,
+		host:    host,
+		queue:   make(chan sinkRecord, logSinkQueue),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go sk.run()
+	return sk
+}
+
+// startLogSinks starts the configured sinks, replacing the running ones
+// if a reload changed them
+func (s *Supervisor) startLogSinks() {
+	s.mu.RLock()
+	cfgs := s.logSinkConfigs
+	s.mu.RUnlock()
+	var old map[string]*logSink
+	if m := logSinks.Load(); m != nil {
+		old = *m
+	}
+	current := make(map[string]LogSinkConfig, len(old))
+	for name, sk := range old {
+		current[name] = sk.cfg
+	}
+	if len(cfgs) == 0 && len(current) == 0 || reflect.DeepEqual(cfgs, current) {
+		return
+	}
+
+	sinks := make(map[string]*logSink, len(cfgs))
+	for name, cfg := range cfgs {
+		sinks[name] = newLogSink(name, cfg)
+		logInfo("log sink %s: %s to %s", name, cfg.Type, cfg.address())
+	}
+	logSinks.Store(&sinks)
+	for _, sk := range old {
+		sk.close()
+	}
+}
+
+// stopLogSinks sends what is queued and stops the sinks (at shutdown)
+func stopLogSinks() {
+	if m := logSinks.Swap(nil); m != nil {
+		for _, sk := range *m {
+			sk.close()
+		}
+	}
+}
+
+// sinkNamed returns the running sink called name (nil if there is none)
+func sinkNamed(name string) *logSink {
+	if m := logSinks.Load(); m != nil {
+		return (*m)[name]
+	}
+	return nil
+}
+
+// send queues r, or drops it if the queue is full
+func (sk *logSink) send(r sinkRecord) {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	if sk.closed {
+		return
+	}
+	select {
+	case sk.queue <- r:
+	default:
+		n := sk.dropped.Add(1)
+		if time.Since(sk.reported) > logDropReportInterval {
+			sk.reported = time.Now()
+			logWarn("log sink %s: queue full, dropping lines (%d dropped in total)", sk.name, n)
+		}
+	}
+}
+
+// run writes queued lines to the sink's connection, (re)connecting as
+// needed, until the sink is closed and its queue is empty
+func (sk *logSink) run() {
+	defer close(sk.done)
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	backoff := logSinkBackoff
+	for r := range sk.queue {
+		msg, err := sk.encode(r)
+		if err != nil {
+			sk.dropped.Add(1)
+			logWarn("log sink %s: %v", sk.name, err)
+			continue
+		}
+		for {
+			if conn == nil {
+				network, addr := sk.cfg.dialAddress()
+				if conn, err = net.DialTimeout(network, addr, 5*time.Second); err != nil {
+					conn = nil
+					logWarn("log sink %s: %v (retrying in %v)", sk.name, err, backoff)
+					select {
+					case <-time.After(backoff):
+						backoff = min(2*backoff, logSinkMaxBackoff)
+						continue
+					case <-sk.closing:
+						return
+					}
+				}
+				backoff = logSinkBackoff
+			}
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err = sk.write(conn, msg); err == nil {
+				break
+			}
+			logWarn("log sink %s: %v, reconnecting", sk.name, err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// close stops taking lines and waits up to lokiCloseTimeout for the
+// queued ones to be sent
+func (sk *logSink) close() {
+	sk.mu.Lock()
+	if !sk.closed {
+		sk.closed = true
+		close(sk.queue)
+	}
+	sk.mu.Unlock()
+	select {
+	case <-sk.done:
+	case <-time.After(lokiCloseTimeout):
+		close(sk.closing)
+		<-sk.done
+	}
+}
+
+// encode turns r into what the sink's protocol sends for it
+func (sk *logSink) encode(r sinkRecord) ([]byte, error) {
+	switch sk.cfg.Type {
+	case LogSinkFluentd:
+		return sk.encodeFluentd(r), nil
+	case LogSinkSyslog:
+		return sk.encodeSyslog(r), nil
+	case LogSinkJournald:
+		return sk.encodeJournald(r), nil
+	}
+	return sk.encodeGELF(r)
+}
+
+// write sends one encoded message over conn
+func (sk *logSink) write(conn net.Conn, msg []byte) error {
+	if sk.cfg.Type == LogSinkGELF {
+		if _, ok := conn.(*net.UDPConn); ok {
+			return writeGELFChunks(conn, msg)
+		}
+		msg = append(msg, 0) // Frame delimiter over TCP
+	}
+	_, err := conn.Write(msg)
+	return err
+}
+
+// encodeFluentd encodes r in the forward protocol's message mode:
+// [tag, EventTime, record]
+func (sk *logSink) encodeFluentd(r sinkRecord) []byte {
+	tag := sk.cfg.Tag
+	if tag == "" {
+		tag = "gosv"
+	}
+	record := map[string]string{}
+	for name, value := range r.labels {
+		record[name] = value
+	}
+	record["log"], record["source"], record["level"] = r.line, r.stream, r.level.String()
+	record["service"], record["host"] = r.service, sk.host
+
+	var b bytes.Buffer
+	b.WriteByte(0x93) // fixarray of 3
+	msgpackString(&b, tag+"."+r.service)
+	// EventTime: ext type 0, seconds and nanoseconds as big-endian uint32
+	b.Write([]byte{0xd7, 0x00})
+	binary.Write(&b, binary.BigEndian, uint32(r.time.Unix()))
+	binary.Write(&b, binary.BigEndian, uint32(r.time.Nanosecond()))
+	msgpackMapHeader(&b, len(record))
+	for key, value := range record {
+		msgpackString(&b, key)
+		msgpackString(&b, value)
+	}
+	return b.Bytes()
+}
+
+// msgpackString writes s as a MessagePack str
+func msgpackString(b *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n < 32:
+		b.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		b.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		b.WriteByte(0xda)
+		binary.Write(b, binary.BigEndian, uint16(n))
+	default:
+		b.WriteByte(0xdb)
+		binary.Write(b, binary.BigEndian, uint32(n))
+	}
+	b.WriteString(s)
+}
+
+// msgpackMapHeader starts a MessagePack map of n entries
+func msgpackMapHeader(b *bytes.Buffer, n int) {
+	switch {
+	case n < 16:
+		b.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		b.WriteByte(0xde)
+		binary.Write(b, binary.BigEndian, uint16(n))
+	default:
+		b.WriteByte(0xdf)
+		binary.Write(b, binary.BigEndian, uint32(n))
+	}
+}
+
+// encodeGELF encodes r as a GELF 1.1 message, with the stream's syslog
+// severity as its level and labels as additional fields
+func (sk *logSink) encodeGELF(r sinkRecord) ([]byte, error) {
+	msg := r.line
+	if msg == "" {
+		msg = " " // short_message must not be empty
+	}
+	m := map[string]any{
+		"version":       "1.1",
+		"host":          sk.host,
+		"short_message": msg,
+		"timestamp":     float64(r.time.UnixMicro()) / 1e6,
+		"level":         r.syslog.severity,
+	}
+	for name, value := range r.labels {
+		m["_"+gelfFieldName.ReplaceAllString(name, "_")] = value
+	}
+	m["_service"], m["_stream"] = r.service, r.stream
+	b, err := json.Marshal(m)
+	if err == nil && strings.HasPrefix(sk.cfg.Address, "udp://") && len(b) > gelfMaxChunks*(gelfChunkSize-gelfChunkHeader) {
+		return nil, fmt.Errorf("message of %d bytes is too large for GELF over UDP", len(b))
+	}
+	return b, err
+}
+
+// writeGELFChunks sends msg over UDP, in chunks if it doesn't fit one
+// datagram: each with the magic bytes 0x1e 0x0f, a message id shared by
+// all chunks, its sequence number and the number of chunks (encodeGELF
+// made sure there are at most gelfMaxChunks)
+func writeGELFChunks(conn net.Conn, msg []byte) error {
+	if len(msg) <= gelfChunkSize {
+		_, err := conn.Write(msg)
+		return err
+	}
+	size := gelfChunkSize - gelfChunkHeader
+	count := (len(msg) + size - 1) / size
+	id := make([]byte, 8)
+	rand.Read(id)
+	for i := 0; i < count; i++ {
+		chunk := msg[i*size : min((i+1)*size, len(msg))]
+		datagram := append([]byte{0x1e, 0x0f}, id...)
+		datagram = append(datagram, byte(i), byte(count))
+		if _, err := conn.Write(append(datagram, chunk...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
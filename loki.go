@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the "loki" config object
+const (
+	DefaultLokiBatchLines  = 1000
+	DefaultLokiBatchWait   = time.Second
+	DefaultLokiBufferMaxMB = 100
+)
+
+// lokiAttempts is how often a batch is sent before it goes to the disk
+// buffer, with lokiBackoff doubling in between
+const (
+	lokiAttempts = 5
+	lokiBackoff  = 500 * time.Millisecond
+)
+
+// lokiReplayInterval is how often buffered batches are retried while
+// there's nothing new to send
+const lokiReplayInterval = 30 * time.Second
+
+// lokiCloseTimeout bounds the last flush at shutdown
+const lokiCloseTimeout = 5 * time.Second
+
+// lokiQueue is how many batches can wait for the sender before new ones
+// go to the disk buffer
+const lokiQueue = 4
+
+var lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var lokiClient = &http.Client{Timeout: 10 * time.Second}
+
+// lokiShipping is the running shipper (nil without a "loki" config).
+// Pipelines look it up for every line, so a reload can swap it.
+var lokiShipping atomic.Pointer[lokiShipper]
+
+// LokiConfig ships the captured output of services to Grafana Loki (the
+// top-level "loki" config object)
+type LokiConfig struct {
+	URL         string            `json:"url"`      // Loki's base URL, e.g. http://loki:3100
+	Tenant      string            `json:"tenant"`   // X-Scope-OrgID, for multi-tenant Loki
+	Instance    string            `json:"instance"` // Default: named after the config
+	Labels      map[string]string `json:"labels"`   // Added to every stream
+	BatchLines  int               `json:"batch_lines"`
+	BatchWaitMS int               `json:"batch_wait_ms"`
+	BufferDir   string            `json:"buffer_dir"` // Batches Loki didn't take ("" drops them)
+	BufferMaxMB int               `json:"buffer_max_mb"`
+}
+
+// validate checks the loki config
+func (c *LokiConfig) validate() error {
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		return fmt.Errorf("loki: url must be http:// or https://")
+	}
+	for name := range c.Labels {
+		if !lokiLabelName.MatchString(name) {
+			return fmt.Errorf("loki: invalid label name %q", name)
+		}
+	}
+	if c.BatchLines < 0 || c.BatchWaitMS < 0 || c.BufferMaxMB < 0 {
+		return fmt.Errorf("loki: batch_lines, batch_wait_ms and buffer_max_mb must not be negative")
+	}
+	if c.BufferDir != "" && !filepath.IsAbs(c.BufferDir) {
+		return fmt.Errorf("loki: buffer_dir must be absolute")
+	}
+	return nil
+}
+
+// lokiStream is one stream of a push request: a label set and its lines
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"` // Unix nanoseconds, line
+}
+
+// lokiBatch is an encoded push request
+type lokiBatch struct {
+	body  []byte
+	lines int
+}
+
+// lokiShipper batches lines and pushes them to Loki
+//
+// KEY CONCEPT: Shipping logs
+// gosv already has every line a service writes, with the time it was
+// written and which service and stream it came from - exactly what a log
+// store wants. A separate agent (promtail) would have to get the same
+// lines back out of a file or the journal and guess the labels. Pushing
+// line by line would cost a request each, so lines are batched: until
+// batch_lines are together or batch_wait has passed since the first.
+// Loki can be down or slow, and the services must never wait for it:
+// batches are handed to a sender that retries with backoff, and what it
+// can't deliver (or can't keep up with) is written to buffer_dir and
+// sent again once Loki answers - up to buffer_max_mb, beyond which the
+// oldest batches are dropped and counted. Labels are kept few and
+// bounded (service, stream, host, instance, and the services' labels):
+// Loki indexes label sets, not lines, and a label per request id would
+// create a stream per request.
+type lokiShipper struct {
+	cfg    LokiConfig
+	push   string
+	common map[string]string // host, instance and the configured labels
+	wait   time.Duration
+	max    int
+
+	mu      sync.Mutex
+	streams map[string]*lokiStream
+	lines   int
+	timer   *time.Timer
+	closed  bool
+
+	sends   chan lokiBatch
+	closing chan struct{}
+	done    chan struct{}
+	dropped atomic.Uint64 // Batches lost
+}
+
+// newLokiShipper starts a shipper for cfg; instance is the default of
+// cfg.Instance
+func newLokiShipper(cfg LokiConfig, instance string) *lokiShipper {
+	host, _ := os.Hostname()
+	common := map[string]string{"host": host, "instance": instance}
+	if cfg.Instance != "" {
+		common["instance"] = cfg.Instance
+	}
+	for name, value := range cfg.Labels {
+		common[name] = value
+	}
+	sh := &lokiShipper{
+		cfg:     cfg,
+		push:    strings.TrimSuffix(cfg.URL, "/") + "/loki/api/v1/push",
+		common:  common,
+		wait:    time.Duration(cfg.BatchWaitMS) * time.Millisecond,
+		max:     cfg.BatchLines,
+		streams: make(map[string]*lokiStream),
+		sends:   make(chan lokiBatch, lokiQueue),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if sh.wait == 0 {
+		sh.wait = DefaultLokiBatchWait
+	}
+	if sh.max == 0 {
+		sh.max = DefaultLokiBatchLines
+	}
+	go sh.run()
+	return sh
+}
+
+// startLoki starts shipping to the configured Loki, or stops or replaces
+// the shipper when a reload changed the config
+func (s *Supervisor) startLoki() {
+	s.mu.RLock()
+	cfg := s.lokiConfig
+	s.mu.RUnlock()
+	old := lokiShipping.Load()
+	if old != nil && cfg != nil && reflect.DeepEqual(old.cfg, *cfg) {
+		return
+	}
+	if cfg != nil {
+		sh := newLokiShipper(*cfg, configName(s.configSource))
+		lokiShipping.Store(sh)
+		logInfo("shipping service output to %s (instance %s)", sh.push, sh.common["instance"])
+	} else {
+		lokiShipping.Store(nil)
+	}
+	if old != nil {
+		old.close()
+	}
+}
+
+// stopLoki sends what is left and stops shipping (at shutdown)
+func stopLoki() {
+	if sh := lokiShipping.Swap(nil); sh != nil {
+		sh.close()
+	}
+}
+
+// add queues a line of service's output for Loki
+func (sh *lokiShipper) add(service string, labels map[string]string, stream string, level LogLevel, t time.Time, line string) {
+	set := make(map[string]string, len(sh.common)+len(labels)+3)
+	for name, value := range labels {
+		set[lokiSafeName(name)] = value
+	}
+	for name, value := range sh.common {
+		set[name] = value
+	}
+	set["service"], set["stream"], set["level"] = service, stream, level.String()
+	key := lokiKey(set)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.closed {
+		return
+	}
+	st := sh.streams[key]
+	if st == nil {
+		st = &lokiStream{Stream: set}
+		sh.streams[key] = st
+	}
+	st.Values = append(st.Values, [2]string{strconv.FormatInt(t.UnixNano(), 10), line})
+	sh.lines++
+	if sh.lines == 1 {
+		sh.timer = time.AfterFunc(sh.wait, func() {
+			sh.mu.Lock()
+			defer sh.mu.Unlock()
+			sh.flushLocked()
+		})
+	}
+	if sh.lines >= sh.max {
+		sh.flushLocked()
+	}
+}
+
+// flushLocked hands the lines gathered so far to the sender, or to the
+// disk buffer if the sender is behind. Caller must hold sh.mu.
+func (sh *lokiShipper) flushLocked() {
+	if sh.lines == 0 {
+		return
+	}
+	if sh.timer != nil {
+		sh.timer.Stop()
+		sh.timer = nil
+	}
+	streams := make([]*lokiStream, 0, len(sh.streams))
+	for _, st := range sh.streams {
+		streams = append(streams, st)
+	}
+	body, _ := json.Marshal(map[string]any{"streams": streams}) // Only strings: can't fail
+	b := lokiBatch{body: body, lines: sh.lines}
+	sh.streams = make(map[string]*lokiStream)
+	sh.lines = 0
+
+	select {
+	case sh.sends <- b:
+	default:
+		sh.spill(b)
+	}
+}
+
+// run sends batches as they come, and the buffered ones whenever Loki
+// took a batch or lokiReplayInterval passed
+func (sh *lokiShipper) run() {
+	defer close(sh.done)
+	replay := time.NewTicker(lokiReplayInterval)
+	defer replay.Stop()
+	for {
+		select {
+		case b, ok := <-sh.sends:
+			if !ok {
+				return
+			}
+			if sh.deliver(b) {
+				sh.replay()
+			} else {
+				sh.spill(b)
+			}
+		case <-replay.C:
+			sh.replay()
+		}
+	}
+}
+
+// deliver pushes b, retrying with backoff. It gives up early once the
+// shipper is closing.
+func (sh *lokiShipper) deliver(b lokiBatch) bool {
+	delay := lokiBackoff
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-sh.closing:
+			return false
+		default:
+		}
+		retry, err := sh.send(b.body)
+		if err == nil {
+			return true
+		}
+		if !retry {
+			sh.dropped.Add(1)
+			logWarn("loki: dropping %d lines: %v", b.lines, err)
+			return true // Sending it again won't help
+		}
+		if attempt == lokiAttempts {
+			logWarn("loki: %v (after %d attempts)", err, attempt)
+			return false
+		}
+		select {
+		case <-time.After(delay):
+		case <-sh.closing:
+			return false
+		}
+		delay *= 2
+	}
+}
+
+// send makes one push request. retry reports whether a failure might go
+// away: network errors, 429 and 5xx.
+func (sh *lokiShipper) send(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, sh.push, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sh.cfg.Tenant != "" {
+		req.Header.Set("X-Scope-OrgID", sh.cfg.Tenant)
+	}
+	resp, err := lokiClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("push: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// spill writes b to the disk buffer, or drops it without one
+func (sh *lokiShipper) spill(b lokiBatch) {
+	if sh.cfg.BufferDir == "" {
+		sh.dropped.Add(1)
+		logWarn("loki: dropping %d lines, no buffer_dir (%d batches dropped in total)", b.lines, sh.dropped.Load())
+		return
+	}
+	if err := os.MkdirAll(sh.cfg.BufferDir, 0700); err != nil {
+		sh.dropped.Add(1)
+		logWarn("loki: dropping %d lines: %v", b.lines, err)
+		return
+	}
+	path := filepath.Join(sh.cfg.BufferDir, fmt.Sprintf("%020d.json", time.Now().UnixNano()))
+	if err := os.WriteFile(path, b.body, 0600); err != nil {
+		sh.dropped.Add(1)
+		logWarn("loki: dropping %d lines: %v", b.lines, err)
+		return
+	}
+	sh.trimBuffer()
+}
+
+// buffered lists the batches in the disk buffer, oldest first
+func (sh *lokiShipper) buffered() []string {
+	if sh.cfg.BufferDir == "" {
+		return nil
+	}
+	paths, _ := filepath.Glob(filepath.Join(sh.cfg.BufferDir, "*.json"))
+	sort.Strings(paths) // Named by time
+	return paths
+}
+
+// trimBuffer drops the oldest buffered batches beyond buffer_max_mb
+func (sh *lokiShipper) trimBuffer() {
+	max := int64(sh.cfg.BufferMaxMB)
+	if max == 0 {
+		max = DefaultLokiBufferMaxMB
+	}
+	max <<= 20
+	paths := sh.buffered()
+	sizes := make([]int64, len(paths))
+	var total int64
+	for i, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			sizes[i] = fi.Size()
+			total += sizes[i]
+		}
+	}
+	n := 0
+	for i := 0; i < len(paths) && total > max; i++ {
+		if os.Remove(paths[i]) == nil {
+			total -= sizes[i]
+			n++
+		}
+	}
+	if n > 0 {
+		sh.dropped.Add(uint64(n))
+		logWarn("loki: buffer_dir is over %d MB, dropped the %d oldest batches", max>>20, n)
+	}
+}
+
+// replay sends buffered batches, oldest first, until one fails
+func (sh *lokiShipper) replay() {
+	for _, path := range sh.buffered() {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		retry, err := sh.send(body)
+		if err != nil && retry {
+			return // Still down: try again later
+		}
+		if err != nil {
+			sh.dropped.Add(1)
+			logWarn("loki: dropping buffered batch %s: %v", filepath.Base(path), err)
+		}
+		os.Remove(path)
+	}
+}
+
+// close sends the lines gathered so far and stops the shipper, waiting
+// up to lokiCloseTimeout. What can't be sent by then is buffered.
+func (sh *lokiShipper) close() {
+	sh.mu.Lock()
+	if sh.closed {
+		sh.mu.Unlock()
+		return
+	}
+	sh.flushLocked()
+	sh.closed = true
+	close(sh.sends)
+	sh.mu.Unlock()
+
+	select {
+	case <-sh.done:
+	case <-time.After(lokiCloseTimeout):
+		close(sh.closing)
+		<-sh.done
+	}
+}
+
+// lokiKey identifies a label set
+func lokiKey(set map[string]string) string {
+	pairs := make([]string, 0, len(set))
+	for name, value := range set {
+		pairs = append(pairs, name+"="+strconv.Quote(value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// lokiSafeName turns a gosv label name into a valid Loki label name
+func lokiSafeName(name string) string {
+	safe := []byte(name)
+	for i, c := range safe {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			safe[i] = '_'
+		}
+	}
+	return string(safe)
+}
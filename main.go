@@ -5,40 +5,482 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Config file format
 type Config struct {
 	Services []ServiceConfig `json:"services"`
+
+	// ExitCodeFrom names the main service (see Process.Main)
+	ExitCodeFrom string `json:"exit_code_from"`
+
+	// DiagnosticsDir receives a diagnostics bundle for every service that
+	// fails for good
+	DiagnosticsDir string `json:"diagnostics_dir"`
+
+	// LockServer holds the locks of singleton services
+	// ("consul://host:port" or "etcd://host:port")
+	LockServer string `json:"lock_server"`
+	// At most MaxConcurrentRestarts restarts in flight at once, each for
+	// RestartSettleSec after its start (see throttle.go)
+	MaxConcurrentRestarts int `json:"max_concurrent_restarts"`
+	RestartSettleSec      int `json:"restart_settle_sec"`
+	// Consecutive starts at boot are StartStaggerMS apart (see delay.go)
+	StartStaggerMS int `json:"start_stagger_ms"`
+
+	// PATH, TZ, LANG or HOME for services whose environment has none
+	// (see env.go)
+	EnvDefaults map[string]string `json:"env_defaults"`
+
+	// Limits on gosv itself (see selflimits.go)
+	Supervisor *SelfLimits `json:"supervisor"`
+
+	// Ship the output of services to Loki (see loki.go)
+	Loki *LokiConfig `json:"loki"`
+
+	// Fluentd and GELF endpoints services forward their output to, by
+	// name (see logsink.go)
+	LogSinks map[string]LogSinkConfig `json:"log_sinks"`
+
+	// EventJournal keeps the events of services in a file of at most
+	// EventJournalMaxMB, for `gosv ctl events` (see events.go)
+	EventJournal      string `json:"event_journal"`
+	EventJournalMaxMB int    `json:"event_journal_max_mb"`
+
+	// StateDB keeps service state, exits, restart decisions and memory
+	// samples in SQLite, for `gosv history` and `gosv analyze` (see
+	// store.go), and the last StateRevisions revisions of each service's
+	// config, for `gosv ctl rollback` (see revisions.go)
+	StateDB            string `json:"state_db"`
+	StateRetentionDays int    `json:"state_retention_days"`
+	StateSampleSec     int    `json:"state_sample_sec"`
+	StateRevisions     int    `json:"state_revisions"`
+
+	// Pools are budgets that the services and jobs assigned to them
+	// share, and queues for their `ctl run --pool` jobs (see pools.go)
+	Pools map[string]PoolConfig `json:"pools"`
+
+	// LimitProfiles are times of the week in which pools and services
+	// get the limits of their profile_limits (see profiles.go)
+	LimitProfiles []LimitProfile `json:"limit_profiles"`
+
+	// MemoryPressure evicts services when the host runs short of memory
+	// (see pressure.go)
+	MemoryPressure *PressureConfig `json:"memory_pressure"`
+
+	// Deploy says where deploys are kept and how they're checked, and
+	// opens an HTTP endpoint for them (see deploy.go)
+	Deploy *DeployConfig `json:"deploy"`
+
+	// Webhooks opens an HTTP endpoint for signed requests that trigger
+	// the actions it names (see webhooks.go)
+	Webhooks *WebhookConfig `json:"webhooks"`
+
+	// StatusPage serves a read-only summary of the services, as HTML and
+	// JSON, on a listener of its own (see statuspage.go)
+	StatusPage *StatusPageConfig `json:"status_page"`
+
+	// Agent connects to a central controller, which sees the status and
+	// events of the services and can start, stop and deploy them (see
+	// agent.go)
+	Agent *AgentConfig `json:"agent"`
+
+	// NetworkAccounting samples each service's TCP bytes and connections
+	// (see netacct.go)
+	NetworkAccounting bool `json:"network_accounting"`
+
+	// EgressInterfaces are the interfaces egress_mbit limits shape
+	// (default: those of the default routes; see shaping.go)
+	EgressInterfaces []string `json:"egress_interfaces"`
+
+	// Groups maps group names to defaults for their members: any service
+	// fields but name and groups (see groups.go)
+	Groups map[string]json.RawMessage `json:"groups"`
+}
+
+// restartLimit is max_restarts: a count, or "unlimited" (UnlimitedRestarts)
+type restartLimit int
+
+func (l *restartLimit) UnmarshalJSON(data []byte) error {
+	if string(data) == `"unlimited"` {
+		*l = UnlimitedRestarts
+		return nil
+	}
+	var n int
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf(`max_restarts must be a count or "unlimited", not %s`, data)
+	}
+	*l = restartLimit(n)
+	return nil
 }
 
 type ServiceConfig struct {
-	Name        string   `json:"name"`
-	Command     string   `json:"command"`
-	Args        []string `json:"args"`
-	MaxRestarts int      `json:"max_restarts"`
-	MemoryMB    int      `json:"memory_mb"`
-	CPUPercent  int      `json:"cpu_percent"`
+	Name        string       `json:"name"`
+	Command     string       `json:"command"`
+	Args        []string     `json:"args"`
+	Shell       bool         `json:"shell"`
+	Type        string       `json:"type"`
+	Bundle      string       `json:"bundle"`
+	Runtime     string       `json:"runtime"`
+	Container   string       `json:"container"`
+	PIDFile     string       `json:"pid_file"`
+	Adopt       bool         `json:"adopt"`
+	MaxRestarts restartLimit `json:"max_restarts"` // A count, or "unlimited"
+	Restart     string       `json:"restart"`      // RestartAlways (default), RestartOnFailure or RestartNever
+	MemoryMB    int          `json:"memory_mb"`
+	CPUPercent  int          `json:"cpu_percent"`
+	TTY         bool         `json:"tty"`
+	Foreground  bool         `json:"foreground"`
+	Stdin       string       `json:"stdin"`
+	Critical    bool         `json:"critical"`
+	Groups      []string     `json:"groups"`
+
+	// Run this many copies of the service (see replicas.go)
+	Replicas int `json:"replicas"`
+
+	// Free-form metadata, matched by selectors ("tier": "web")
+	Labels map[string]string `json:"labels"`
+
+	// Explicit huge pages, MB per page size ("2MB", "1GB")
+	HugeTLBMB map[string]int64 `json:"hugetlb_mb"`
+
+	// NVIDIA GPUs the service may use, by nvidia-smi index
+	GPUs []int `json:"gpus"`
+
+	// Egress bandwidth limit, in Mbit/s (see shaping.go)
+	EgressMbit int `json:"egress_mbit"`
+
+	// CPUs to run on: a CPU list or a preset, without those of
+	// isolate_from (see cpuset.go)
+	CPUs        string `json:"cpus"`
+	IsolateFrom []int  `json:"isolate_from"`
+
+	// NUMA node to run on and take memory from: spread, node:<n> or
+	// pci:<address> (see numa.go)
+	Placement string `json:"placement"`
+
+	// The pool whose budget the service shares (see pools.go)
+	Pool string `json:"pool"`
+
+	// Limits by limit profile, in place of memory_mb and cpu_percent
+	// while the profile is in effect (see profiles.go)
+	ProfileLimits map[string]ProfileLimits `json:"profile_limits"`
+
+	// Evicted under memory pressure, lowest first: stop or freeze (see
+	// pressure.go)
+	EvictionPriority int    `json:"eviction_priority"`
+	EvictionAction   string `json:"eviction_action"`
+
+	// Restart on file changes
+	Watch           []string `json:"watch"`
+	WatchDebounceMS int      `json:"watch_debounce_ms"`
+
+	// Maintenance windows
+	RestartWindows []string `json:"restart_windows"`
+	PlannedRestart string   `json:"planned_restart"`
+
+	// Path activation
+	StartOnPath   []string `json:"start_on_path"`
+	StopWhenEmpty bool     `json:"stop_when_empty"`
+
+	// Shutdown ordering
+	ShutdownPriority int `json:"shutdown_priority"`
+	StopTimeoutSec   int `json:"stop_timeout_sec"`
+
+	// Checked before each start; unmet skips the service
+	Conditions *Conditions `json:"conditions"`
+
+	// Captured output (see logpipe.go)
+	LogBufferLines int    `json:"log_buffer_lines"`
+	LogOverflow    string `json:"log_overflow"`
+	LogTimestamp   string `json:"log_timestamp"`
+	LogTimezone    string `json:"log_timezone"`
+	LogStripANSI   string `json:"log_strip_ansi"`
+	LogSquashCR    string `json:"log_squash_cr"`
+	LogDedup       bool   `json:"log_dedup"`
+	LogRateLimit   int    `json:"log_rate_limit"`
+	LogRateBurst   int    `json:"log_rate_burst"`
+
+	// Names of top-level log_sinks that get the service's output
+	LogSinks []string `json:"log_sinks"`
+
+	// Where stdout and stderr go, each on its own (see streams.go)
+	Stdout *LogStreamConfig `json:"stdout"`
+	Stderr *LogStreamConfig `json:"stderr"`
+
+	// Identifier, facility and severities for syslog and journald sinks
+	// (see syslog.go)
+	Syslog *SyslogConfig `json:"syslog"`
+
+	// Delay of the first start, at boot or when a reload adds the service
+	StartDelaySec int `json:"start_delay_sec"`
+
+	// External dependencies probed before each start (see waitfor.go)
+	WaitFor        []string `json:"wait_for"`
+	WaitTimeoutSec int      `json:"wait_timeout_sec"`
+
+	// Probed after each start: a service not ready in time is restarted,
+	// and reported as failing readiness if it keeps happening (see
+	// readiness.go)
+	ReadyCheck      string `json:"ready_check"`
+	ReadyTimeoutSec int    `json:"ready_timeout_sec"`
+	ReadyFailures   int    `json:"ready_failures"`
+
+	// Relations to other services (see relations.go)
+	PartOf  []string `json:"part_of"`
+	BindsTo []string `json:"binds_to"`
+	After   []string `json:"after"`
+
+	// What a stop signals: process-group, process, control-group, mixed, none
+	KillMode string `json:"kill_mode"`
+
+	// Run in a cgroup namespace, owning its cgroup subtree
+	DelegateCgroup bool `json:"delegate_cgroup"`
+
+	// Sandboxing
+	PrivateTmp     bool    `json:"private_tmp"`
+	PrivateDevices bool    `json:"private_devices"`
+	Mounts         []Mount `json:"mounts"`
+
+	// Resolver and /etc/hosts overrides (see dns.go)
+	DNS *DNSConfig `json:"dns"`
+
+	// A network namespace with only loopback, and the host addresses
+	// forwarded to ports on it (see portmap.go)
+	PrivateNetwork bool          `json:"private_network"`
+	Ports          []PortMapping `json:"ports"`
+
+	// Listening sockets passed to the service, "tcp://host:port" or
+	// "unix:///path" (see sockets.go), and how a restart replaces it:
+	// RestartModeStop (default) or RestartModeHandoff
+	Sockets     []string `json:"sockets"`
+	RestartMode string   `json:"restart_mode"`
+
+	// Run as root in a user namespace with these id mappings
+	UserNamespace *UserNS `json:"user_namespace"`
+
+	// User to run as
+	User                string   `json:"user"`
+	Group               string   `json:"group"`
+	SupplementaryGroups []string `json:"supplementary_groups"`
+
+	// Mandatory access control labels
+	AppArmorProfile string `json:"apparmor_profile"`
+	SELinuxLabel    string `json:"selinux_label"`
+
+	// CPU scheduling and I/O priority
+	SchedPolicy   string `json:"sched_policy"`
+	SchedPriority int    `json:"sched_priority"`
+	IONice        string `json:"ionice"`
+
+	// Drain before shutdown
+	DrainSignal     string `json:"drain_signal"`
+	DrainTimeoutSec int    `json:"drain_timeout_sec"`
+
+	// Secrets, provided as files in $CREDENTIALS_DIRECTORY
+	Credentials map[string]string `json:"credentials"`
+
+	// Variables set for the service
+	Env map[string]string `json:"env"`
+
+	// Start from an empty environment, plus the variables of gosv's that
+	// pass_env lists (see env.go)
+	ClearEnv bool     `json:"clear_env"`
+	PassEnv  []string `json:"pass_env"`
+
+	// PATH, TZ, LANG or HOME for when the environment has none, over the
+	// global env_defaults
+	EnvDefaults map[string]string `json:"env_defaults"`
+
+	// Service discovery
+	Register *RegisterConfig `json:"register"`
+
+	// Run on only one host at a time (needs lock_server)
+	Singleton  bool `json:"singleton"`
+	LockTTLSec int  `json:"lock_ttl_sec"`
+
+	// Memory leak heuristic
+	LeakRateKBPerMin int64  `json:"leak_rate_kb_per_min"`
+	LeakDurationSec  int    `json:"leak_duration_sec"`
+	LeakAction       string `json:"leak_action"`
+
+	// The service this is a replica of (set by expandReplicas)
+	replicaOf string
+}
+
+// RegisterConfig announces a service in Consul or etcd (see discovery.go)
+type RegisterConfig struct {
+	Registry string `json:"registry"`
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Health   string `json:"health"`
 }
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == execHelper {
+		execHelperMain(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		if err := analyze(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "analyze: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		if err := history(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "history: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		if err := ctlMain(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "ctl: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "graph" {
+		if err := graph(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "graph: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "generate-systemd" {
+		if err := generateSystemd(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "generate-systemd: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	configPath := flag.String("config", "", "Path to config file (JSON)")
-	singleCmd := flag.String("run", "", "Run a single command")
+	var runs runSpecs
+	flag.Var(&runs, "run", "Run a command, optionally as name=command (repeatable)")
+	flag.Var(runLimitFlag{&runs, "mem"}, "mem", "Memory limit in MB for the preceding --run")
+	flag.Var(runLimitFlag{&runs, "cpu"}, "cpu", "CPU quota in percent for the preceding --run")
+	flag.Var(runLimitFlag{&runs, "restarts"}, "restarts", "Max restarts for the preceding --run")
 	noCgroup := flag.Bool("no-cgroup", false, "Disable cgroup resource limits")
+	delegate := delegateFlag(DelegateAuto)
+	flag.Var(&delegate, "delegate", "Re-run under systemd-run with a delegated cgroup: auto (when needed), true (required), false")
+	foreground := flag.Bool("foreground", false, "Attach the first --run command to our terminal and exit with its exit code")
+	exitCodeFrom := flag.String("exit-code-from", "", "Exit with this service's exit code, shutting down when it exits")
+	configSync := flag.Duration("config-sync", 0, "Re-fetch --config at this interval and apply changes (e.g. 30s)")
+	daemon := flag.Bool("daemon", false, "Run in the background (implies a pidfile)")
+	pidfilePath := flag.String("pidfile", "", "Write our pid here and refuse to start if another gosv holds it")
+	logFile := flag.String("log-file", "", "Where --daemon sends its output (default: next to the pidfile)")
+	dryRun := flag.Bool("dry-run", false, "Print what --config would start, and how, without doing it")
+	verbose := flag.Bool("v", false, "Verbose: log debug messages too")
+	quiet := flag.Bool("q", false, "Quiet: log warnings and errors only")
+	logFormat := flag.String("log-format", LogFormatText, "Format of gosv's output: text or json (JSON lines, services' output included)")
 	flag.Parse()
 
+	if err := setupLogging(*logFormat, *verbose, *quiet); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	cgroups := !*noCgroup && cgroupsSupported
+
+	if *dryRun {
+		if *configPath == "" {
+			fmt.Fprintln(os.Stderr, "Error: --dry-run needs --config")
+			os.Exit(1)
+		}
+		sup := NewSupervisor()
+		// With the deploys a gosv of this config runs them with, read
+		// but never written back
+		sup.deployReadOnly = true
+		if *pidfilePath != "" {
+			sup.DeployState = deployStatePath(*pidfilePath)
+		} else {
+			sup.DeployState = deployStatePath(defaultPidfile(*configPath))
+		}
+		if err := loadConfig(sup, *configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+			os.Exit(1)
+		}
+		if *exitCodeFrom != "" {
+			if err := sup.SetMain(*exitCodeFrom); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --exit-code-from: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		sup.dryRun(os.Stdout, cgroups)
+		return
+	}
+
+	if *daemon && *foreground {
+		fmt.Fprintln(os.Stderr, "Error: --daemon and --foreground are mutually exclusive")
+		os.Exit(1)
+	}
+
 	// Try to get cgroup delegation via systemd-run if needed
 	// This will re-exec the process if delegation is required
-	if !*noCgroup {
-		RunWithDelegation()
+	if cgroups {
+		if err := RunWithDelegation(string(delegate)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --delegate: %v\n", err)
+			os.Exit(1)
+		}
+	} else if delegate == DelegateRequire {
+		fmt.Fprintln(os.Stderr, "Error: --delegate needs cgroups")
+		os.Exit(1)
+	}
+
+	if *daemon && *pidfilePath == "" {
+		*pidfilePath = defaultPidfile(*configPath)
+	}
+	if *daemon && !isDaemon() {
+		if *logFile == "" {
+			*logFile = strings.TrimSuffix(*pidfilePath, ".pid") + ".log"
+		}
+		if err := daemonize(*logFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if isDaemon() {
+		detachDaemonEnv()
+	}
+
+	var pidfile *Pidfile
+	if *pidfilePath != "" {
+		var err error
+		if pidfile, err = lockPidfile(*pidfilePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
 	// Show what we're about to do
-	fmt.Println("=== gosv: Process Supervisor ===")
-	fmt.Printf("PID: %d\n", os.Getpid())
+	if jsonOutput {
+		logInfo("starting, pid %d", os.Getpid())
+	} else if !*quiet {
+		fmt.Println("=== gosv: Process Supervisor ===")
+		fmt.Printf("PID: %d\n", os.Getpid())
+	}
 
 	sup := NewSupervisor()
+	// The boot report and control socket go next to the pidfile, for
+	// `gosv analyze` and `gosv ctl`
+	if *pidfilePath != "" {
+		sup.BootReport = bootReportPath(*pidfilePath)
+		sup.ControlSocket = ctlSocketPath(*pidfilePath)
+		sup.DeployState = deployStatePath(*pidfilePath)
+	} else if *configPath != "" {
+		sup.BootReport = bootReportPath(defaultPidfile(*configPath))
+		sup.ControlSocket = ctlSocketPath(defaultPidfile(*configPath))
+		sup.DeployState = deployStatePath(defaultPidfile(*configPath))
+	}
 
 	if *configPath != "" {
 		// Load from config file
@@ -46,69 +488,753 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
 			os.Exit(1)
 		}
-	} else if *singleCmd != "" {
-		// Run a single command
-		// Use "exec" so shell replaces itself with the command
-		// This ensures the command is directly in our process group
-		p := &Process{
-			Name:          "main",
-			Command:       "/bin/sh",
-			Args:          []string{"-c", "exec " + *singleCmd},
-			MaxRestarts:   10,
-			RestartDelay:  2 * time.Second,
-			BackoffFactor: 1.5,
-		}
-		sup.AddProcess(p)
+		sup.ConfigSyncInterval = *configSync
+	} else if len(runs) > 0 {
+		// Run commands given on the command line
+		for i, r := range runs {
+			// Use "exec" so shell replaces itself with the command
+			// This ensures the command is directly in our process group
+			p := &Process{
+				Name:          r.name,
+				Command:       "/bin/sh",
+				Args:          []string{"-c", "exec " + r.command},
+				MaxRestarts:   r.maxRestarts,
+				RestartDelay:  2 * time.Second,
+				BackoffFactor: 1.5,
+				MemoryLimit:   int64(r.memoryMB) * 1024 * 1024,
+				CPUQuota:      r.cpuPercent,
+				Foreground:    *foreground && i == 0,
+			}
+			if err := sup.AddProcess(p); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --run: %v\n", err)
+				os.Exit(1)
+			}
+		}
 	} else {
 		// Demo mode: run some test processes
-		fmt.Println("No config specified, running demo...")
+		logInfo("no config specified, running demo...")
 		setupDemo(sup)
 	}
 
+	if *exitCodeFrom != "" {
+		if err := sup.SetMain(*exitCodeFrom); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --exit-code-from: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// Initialize cgroups (best effort)
-	if !*noCgroup {
+	if cgroups {
 		if err := EnsureControllers(); err != nil {
-			fmt.Printf("[gosv] warning: cgroup setup failed: %v\n", err)
-			fmt.Println("[gosv] continuing without resource limits")
+			logWarn("cgroup setup failed: %v", err)
+			logWarn("continuing without cgroups: memory_mb, cpu_percent, hugetlb_mb, gpus and egress_mbit are not enforced, kill_mode control-group and mixed signal the process group")
 		}
+	} else if *noCgroup {
+		logInfo("cgroups disabled via --no-cgroup flag")
 	} else {
-		fmt.Println("[gosv] cgroups disabled via --no-cgroup flag")
+		logInfo("no cgroups on %s, memory and CPU limits are applied per process", runtime.GOOS)
 	}
 
-	if err := sup.Run(); err != nil {
+	daemonReady()
+	err := sup.Run()
+	pidfile.Release()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Supervisor error: %v\n", err)
 		os.Exit(1)
 	}
+	os.Exit(sup.ExitCode())
 }
 
-func loadConfig(sup *Supervisor, path string) error {
-	data, err := os.ReadFile(path)
+// loadConfig registers the services of the config at src (a file path or
+// a remote source, see readConfigSource) with sup
+func loadConfig(sup *Supervisor, src string) error {
+	data, err := readConfigSource(src)
+	if err != nil {
+		return err
+	}
+	procs, err := parseConfig(data)
 	if err != nil {
 		return err
 	}
+	sup.applyDeploys(procs, data)
+	for _, p := range procs {
+		if err := sup.AddProcess(p); err != nil {
+			return err
+		}
+	}
+	sup.configSource = src
+	sup.applyGlobalConfig(data)
+	sup.configData = data
+	return nil
+}
 
+// validServiceName checks that name can be used in the paths gosv makes
+// for a service (its cgroup, credentials and DNS directories), and
+// doesn't take a cgroup gosv uses itself
+func validServiceName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("a service has no name")
+	case name == "." || name == ".." || strings.ContainsAny(name, "/\x00"):
+		return fmt.Errorf("service %q: invalid name", name)
+	case name == "supervisor", strings.HasSuffix(name, ".pool"), strings.HasPrefix(name, "cgroup."):
+		// gosv's own cgroup, pool cgroups, and the kernel's cgroup files
+		return fmt.Errorf("service %q: the name is reserved", name)
+	}
+	return nil
+}
+
+// parseConfig builds the processes described by a JSON config
+func parseConfig(data []byte) ([]*Process, error) {
 	var cfg Config
 	if err := json.Unmarshal(data, &cfg); err != nil {
-		return err
+		return nil, err
+	}
+	if err := applyGroupDefaults(data, &cfg); err != nil {
+		return nil, err
+	}
+	if err := expandReplicas(&cfg); err != nil {
+		return nil, err
+	}
+	if _, err := groupRestartBudgets(cfg.Groups); err != nil {
+		return nil, err
+	}
+	if cfg.Supervisor != nil {
+		if err := cfg.Supervisor.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Loki != nil {
+		if err := cfg.Loki.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for name, sink := range cfg.LogSinks {
+		if err := sink.validate(name); err != nil {
+			return nil, err
+		}
+	}
+	if err := validEnvDefaults(cfg.EnvDefaults); err != nil {
+		return nil, fmt.Errorf("env_defaults: %w", err)
+	}
+	if cfg.EventJournalMaxMB < 0 {
+		return nil, fmt.Errorf("event_journal_max_mb must not be negative")
+	}
+	if cfg.EventJournalMaxMB > 0 && cfg.EventJournal == "" {
+		return nil, fmt.Errorf("event_journal_max_mb needs event_journal")
+	}
+	if cfg.StateRetentionDays < 0 || cfg.StateSampleSec < 0 || cfg.StateRevisions < 0 {
+		return nil, fmt.Errorf("state_retention_days, state_sample_sec and state_revisions must not be negative")
+	}
+	if (cfg.StateRetentionDays > 0 || cfg.StateSampleSec > 0) && cfg.StateDB == "" {
+		return nil, fmt.Errorf("state_retention_days and state_sample_sec need state_db")
+	}
+	if cfg.MemoryPressure != nil {
+		if err := cfg.MemoryPressure.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := parseLimitProfiles(cfg.LimitProfiles); err != nil {
+		return nil, err
+	}
+	for name, pool := range cfg.Pools {
+		if err := pool.validate(name); err != nil {
+			return nil, err
+		}
+		if err := checkProfileLimits(pool.ProfileLimits, cfg.LimitProfiles); err != nil {
+			return nil, fmt.Errorf("pools: %s: %w", name, err)
+		}
+	}
+	if cfg.Deploy != nil {
+		if err := cfg.Deploy.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Webhooks != nil {
+		if err := cfg.Webhooks.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.StatusPage != nil {
+		if err := cfg.StatusPage.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Agent != nil {
+		if err := cfg.Agent.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := validEgressInterfaces(cfg.EgressInterfaces); err != nil {
+		return nil, err
 	}
 
+	var procs []*Process
+	hasForeground := false
 	for _, svc := range cfg.Services {
+		if err := validServiceName(svc.Name); err != nil {
+			return nil, err
+		}
 		p := &Process{
 			Name:          svc.Name,
 			Command:       svc.Command,
 			Args:          svc.Args,
-			MaxRestarts:   svc.MaxRestarts,
+			MaxRestarts:   int(svc.MaxRestarts),
+			Restart:       svc.Restart,
 			RestartDelay:  time.Second,
 			BackoffFactor: 2.0,
 			MemoryLimit:   int64(svc.MemoryMB) * 1024 * 1024,
 			CPUQuota:      svc.CPUPercent,
+			TTY:           svc.TTY,
+			Foreground:    svc.Foreground,
+			Critical:      svc.Critical,
+			Groups:        svc.Groups,
+			ReplicaOf:     svc.replicaOf,
+			Labels:        svc.Labels,
+			PartOf:        svc.PartOf,
+			BindsTo:       svc.BindsTo,
+			After:         svc.After,
+
+			Watch:         svc.Watch,
+			WatchDebounce: time.Duration(svc.WatchDebounceMS) * time.Millisecond,
+			ActivatePaths: svc.StartOnPath,
+			StopWhenEmpty: svc.StopWhenEmpty,
+
+			ShutdownPriority: svc.ShutdownPriority,
+			StopTimeout:      time.Duration(svc.StopTimeoutSec) * time.Second,
+			KillMode:         svc.KillMode,
+			DelegateCgroup:   svc.DelegateCgroup,
+			PrivateTmp:       svc.PrivateTmp,
+			PrivateDevices:   svc.PrivateDevices,
+			AppArmorProfile:  svc.AppArmorProfile,
+			SELinuxLabel:     svc.SELinuxLabel,
+		}
+		if c := svc.Conditions; c != nil {
+			if err := c.validate(); err != nil {
+				return nil, fmt.Errorf("service %s: conditions: %w", svc.Name, err)
+			}
+			p.Conditions = c
+		}
+		for _, w := range svc.WaitFor {
+			t, err := parseWaitTarget(w)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: wait_for: %w", svc.Name, err)
+			}
+			p.WaitFor = append(p.WaitFor, t)
+		}
+		if svc.WaitTimeoutSec < 0 {
+			return nil, fmt.Errorf("service %s: wait_timeout_sec must not be negative", svc.Name)
+		}
+		p.WaitTimeout = time.Duration(svc.WaitTimeoutSec) * time.Second
+		switch {
+		case svc.ReadyTimeoutSec < 0 || svc.ReadyFailures < 0:
+			return nil, fmt.Errorf("service %s: ready_timeout_sec and ready_failures must not be negative", svc.Name)
+		case svc.ReadyCheck == "" && (svc.ReadyTimeoutSec != 0 || svc.ReadyFailures != 0):
+			return nil, fmt.Errorf("service %s: ready_timeout_sec and ready_failures need ready_check", svc.Name)
+		case svc.ReadyCheck != "":
+			t, err := parseWaitTarget(svc.ReadyCheck)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: ready_check: %w", svc.Name, err)
+			}
+			p.ReadyCheck = &t
+			p.ReadyTimeout = time.Duration(svc.ReadyTimeoutSec) * time.Second
+			if p.ReadyTimeout == 0 {
+				p.ReadyTimeout = DefaultReadyTimeout
+			}
+			p.ReadyFailures = svc.ReadyFailures
+		}
+		if !validLogOverflow(svc.LogOverflow) {
+			return nil, fmt.Errorf("service %s: unknown log_overflow %q", svc.Name, svc.LogOverflow)
+		}
+		if svc.LogBufferLines < 0 {
+			return nil, fmt.Errorf("service %s: log_buffer_lines must not be negative", svc.Name)
+		}
+		p.LogBuffer, p.LogOverflow = svc.LogBufferLines, svc.LogOverflow
+		if !validLogTimestamp(svc.LogTimestamp) {
+			return nil, fmt.Errorf("service %s: unknown log_timestamp %q", svc.Name, svc.LogTimestamp)
+		}
+		p.LogTimestamp = svc.LogTimestamp
+		if svc.LogTimezone != "" {
+			if svc.LogTimestamp != LogTimestampRFC3339 && svc.LogTimestamp != LogTimestampRFC3339Nano {
+				return nil, fmt.Errorf("service %s: log_timezone is for log_timestamp rfc3339 and rfc3339nano", svc.Name)
+			}
+			loc, err := time.LoadLocation(svc.LogTimezone)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: log_timezone: %w", svc.Name, err)
+			}
+			p.LogTimezone = loc
+		}
+		for field, mode := range map[string]string{"log_strip_ansi": svc.LogStripANSI, "log_squash_cr": svc.LogSquashCR} {
+			if !validLogClean(mode) {
+				return nil, fmt.Errorf("service %s: %s must be never, files or always, not %q", svc.Name, field, mode)
+			}
+		}
+		p.LogStripANSI, p.LogSquashCR = svc.LogStripANSI, svc.LogSquashCR
+		if svc.LogRateLimit < 0 || svc.LogRateBurst < 0 {
+			return nil, fmt.Errorf("service %s: log_rate_limit and log_rate_burst must not be negative", svc.Name)
+		}
+		if svc.LogRateBurst > 0 && svc.LogRateLimit == 0 {
+			return nil, fmt.Errorf("service %s: log_rate_burst needs log_rate_limit", svc.Name)
+		}
+		p.LogDedup, p.LogRateLimit, p.LogRateBurst = svc.LogDedup, svc.LogRateLimit, svc.LogRateBurst
+		for _, name := range svc.LogSinks {
+			if _, ok := cfg.LogSinks[name]; !ok {
+				return nil, fmt.Errorf("service %s: log_sinks: no sink %q in the top-level log_sinks", svc.Name, name)
+			}
+		}
+		p.LogSinks = svc.LogSinks
+		for stream, c := range map[string]*LogStreamConfig{"stdout": svc.Stdout, "stderr": svc.Stderr} {
+			if c == nil {
+				continue
+			}
+			if err := c.validate(stream, cfg.LogSinks); err != nil {
+				return nil, fmt.Errorf("service %s: %w", svc.Name, err)
+			}
+		}
+		p.Stdout, p.Stderr = svc.Stdout, svc.Stderr
+		if svc.Syslog != nil {
+			if err := svc.Syslog.validate(); err != nil {
+				return nil, fmt.Errorf("service %s: %w", svc.Name, err)
+			}
+			p.Syslog = svc.Syslog
+		}
+		if svc.StartDelaySec < 0 {
+			return nil, fmt.Errorf("service %s: start_delay_sec must not be negative", svc.Name)
+		}
+		p.StartDelay = time.Duration(svc.StartDelaySec) * time.Second
+		if err := validServiceLabels(svc.Labels); err != nil {
+			return nil, fmt.Errorf("service %s: labels: %w", svc.Name, err)
+		}
+		if !validKillMode(svc.KillMode) {
+			return nil, fmt.Errorf("service %s: unknown kill_mode %q", svc.Name, svc.KillMode)
+		}
+		for size, mb := range svc.HugeTLBMB {
+			pageSize, err := parseHugePageSize(size)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: hugetlb_mb: %w", svc.Name, err)
+			}
+			limit := mb * 1024 * 1024
+			if mb <= 0 || limit%pageSize != 0 {
+				return nil, fmt.Errorf("service %s: hugetlb_mb: %s limit must be a positive multiple of the page size", svc.Name, size)
+			}
+			if p.HugeTLBLimits == nil {
+				p.HugeTLBLimits = make(map[string]int64)
+			}
+			p.HugeTLBLimits[size] = limit
+		}
+		if err := validGPUs(svc.GPUs); err != nil {
+			return nil, fmt.Errorf("service %s: gpus: %w", svc.Name, err)
+		}
+		p.GPUs = svc.GPUs
+		if svc.EgressMbit < 0 {
+			return nil, fmt.Errorf("service %s: egress_mbit must not be negative", svc.Name)
+		}
+		p.EgressMbit = svc.EgressMbit
+		if svc.CPUs != "" || len(svc.IsolateFrom) > 0 {
+			if cpuPinning {
+				cpus, err := resolveCPUs(svc.CPUs, svc.IsolateFrom)
+				if err != nil {
+					return nil, fmt.Errorf("service %s: cpus: %w", svc.Name, err)
+				}
+				p.cpuList = cpus
+			}
+			p.CPUs, p.IsolateFrom = svc.CPUs, svc.IsolateFrom
+		}
+		if err := validPlacement(svc.Placement); err != nil {
+			return nil, fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+		p.Placement = svc.Placement
+		if _, ok := cfg.Pools[svc.Pool]; svc.Pool != "" && !ok {
+			return nil, fmt.Errorf("service %s: no pool %q (see pools)", svc.Name, svc.Pool)
+		}
+		p.Pool = svc.Pool
+		if err := checkProfileLimits(svc.ProfileLimits, cfg.LimitProfiles); err != nil {
+			return nil, fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+		p.ProfileLimits = svc.ProfileLimits
+		p.configMemory, p.configCPU = p.MemoryLimit, p.CPUQuota
+		switch {
+		case svc.EvictionPriority < 0:
+			return nil, fmt.Errorf("service %s: eviction_priority must not be negative", svc.Name)
+		case svc.EvictionAction != "" && svc.EvictionAction != EvictStop && svc.EvictionAction != EvictFreeze:
+			return nil, fmt.Errorf("service %s: eviction_action must be stop or freeze, not %q", svc.Name, svc.EvictionAction)
+		case svc.EvictionAction != "" && svc.EvictionPriority == 0:
+			return nil, fmt.Errorf("service %s: eviction_action needs eviction_priority", svc.Name)
+		}
+		p.EvictionPriority, p.EvictionAction = svc.EvictionPriority, svc.EvictionAction
+		if p.EvictionPriority > 0 && p.EvictionAction == "" {
+			p.EvictionAction = EvictStop
+		}
+		if len(svc.PassEnv) > 0 && !svc.ClearEnv {
+			return nil, fmt.Errorf("service %s: pass_env needs clear_env (without it, every variable is passed)", svc.Name)
+		}
+		if err := validPassEnv(svc.PassEnv); err != nil {
+			return nil, fmt.Errorf("service %s: pass_env: %w", svc.Name, err)
+		}
+		p.ClearEnv, p.PassEnv = svc.ClearEnv, svc.PassEnv
+		for name := range svc.Env {
+			if name == "" || strings.ContainsAny(name, "=\x00") {
+				return nil, fmt.Errorf("service %s: env: invalid variable name %q", svc.Name, name)
+			}
+		}
+		p.Env = svc.Env
+		if err := validEnvDefaults(svc.EnvDefaults); err != nil {
+			return nil, fmt.Errorf("service %s: env_defaults: %w", svc.Name, err)
+		}
+		// Merged before the fingerprint, so a change to the global
+		// defaults restarts the services it affects
+		svc.EnvDefaults = mergeEnvDefaults(cfg.EnvDefaults, svc.EnvDefaults)
+		p.EnvDefaults = svc.EnvDefaults
+		for i := range svc.Mounts {
+			if err := svc.Mounts[i].validate(); err != nil {
+				return nil, fmt.Errorf("service %s: mounts: %w", svc.Name, err)
+			}
+		}
+		p.Mounts = svc.Mounts
+		if svc.DNS != nil {
+			if err := svc.DNS.validate(); err != nil {
+				return nil, fmt.Errorf("service %s: %w", svc.Name, err)
+			}
+		}
+		p.DNS = svc.DNS
+		if len(svc.Ports) > 0 && !svc.PrivateNetwork {
+			return nil, fmt.Errorf("service %s: ports need private_network", svc.Name)
+		}
+		for i := range svc.Ports {
+			if err := svc.Ports[i].validate(); err != nil {
+				return nil, fmt.Errorf("service %s: %w", svc.Name, err)
+			}
+		}
+		p.PrivateNetwork, p.Ports = svc.PrivateNetwork, svc.Ports
+		if ns := svc.UserNamespace; ns != nil {
+			if svc.User != "" {
+				return nil, fmt.Errorf("service %s: user can't be combined with user_namespace", svc.Name)
+			}
+			if err := ns.validate(); err != nil {
+				return nil, fmt.Errorf("service %s: %w", svc.Name, err)
+			}
+			p.UserNS = ns
+		}
+		if svc.User != "" {
+			runAs, err := resolveRunAs(svc.User, svc.Group, svc.SupplementaryGroups)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %w", svc.Name, err)
+			}
+			p.RunAs = runAs
+		} else if svc.Group != "" || len(svc.SupplementaryGroups) > 0 {
+			return nil, fmt.Errorf("service %s: group and supplementary_groups need a user", svc.Name)
+		}
+		if err := validLabels(svc.AppArmorProfile, svc.SELinuxLabel); err != nil {
+			return nil, fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+		sched, err := parseSched(svc.SchedPolicy, svc.SchedPriority, svc.IONice)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+		p.Sched = sched
+		if svc.Foreground {
+			if hasForeground {
+				return nil, fmt.Errorf("service %s: only one service can be foreground", svc.Name)
+			}
+			hasForeground = true
+		}
+		switch svc.Stdin {
+		case "", "null":
+			// Default: /dev/null
+		default:
+			if svc.TTY {
+				return nil, fmt.Errorf("service %s: stdin cannot be combined with tty", svc.Name)
+			}
+			if svc.Stdin == "attachable" {
+				p.Attachable = true
+			} else {
+				p.StdinFile = svc.Stdin
+			}
+		}
+		if svc.DrainSignal != "" {
+			sig, err := parseSignal(svc.DrainSignal)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: drain_signal: %w", svc.Name, err)
+			}
+			p.DrainSignal = sig
+			p.DrainTimeout = time.Duration(svc.DrainTimeoutSec) * time.Second
+			if p.DrainTimeout == 0 {
+				p.DrainTimeout = DefaultDrainTimeout
+			}
+		}
+		for _, w := range svc.RestartWindows {
+			win, err := parseWindow(w)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: restart_windows: %w", svc.Name, err)
+			}
+			p.RestartWindows = append(p.RestartWindows, win)
+		}
+		if svc.PlannedRestart != "" {
+			if _, err := parseClock(svc.PlannedRestart); err != nil {
+				return nil, fmt.Errorf("service %s: planned_restart: %w", svc.Name, err)
+			}
+			p.PlannedRestart = svc.PlannedRestart
+		}
+		if svc.PIDFile != "" && svc.Type != "forking" && !svc.Adopt {
+			return nil, fmt.Errorf("service %s: pid_file is for type forking and adopt", svc.Name)
+		}
+		if svc.Adopt {
+			switch {
+			case !pidfdsSupported:
+				return nil, fmt.Errorf("service %s: adopt is not supported on %s (no pidfds)", svc.Name, runtime.GOOS)
+			case svc.Type != "" && svc.Type != "exec" && svc.Type != "forking":
+				return nil, fmt.Errorf("service %s: type %s can't adopt a process", svc.Name, svc.Type)
+			case svc.Shell || svc.Foreground || svc.TTY:
+				return nil, fmt.Errorf("service %s: adopt can't be combined with shell, foreground or tty", svc.Name)
+			case !filepath.IsAbs(svc.PIDFile):
+				return nil, fmt.Errorf("service %s: adopt needs an absolute pid_file", svc.Name)
+			}
+			p.PIDFile, p.Adopt = svc.PIDFile, true
+		}
+		switch svc.Type {
+		case "", "exec":
+		case "forking":
+			if !adoptsDaemons {
+				return nil, fmt.Errorf("service %s: type forking is not supported on %s (no child subreaper)", svc.Name, runtime.GOOS)
+			}
+			if svc.Foreground || svc.TTY {
+				return nil, fmt.Errorf("service %s: a forking service can't be foreground or have a tty", svc.Name)
+			}
+			if !filepath.IsAbs(svc.PIDFile) {
+				return nil, fmt.Errorf("service %s: type forking needs an absolute pid_file", svc.Name)
+			}
+			p.Forking, p.PIDFile = true, svc.PIDFile
+		case "container":
+			if svc.Bundle == "" {
+				return nil, fmt.Errorf("service %s: type container needs a bundle", svc.Name)
+			}
+			p.Spawner = ContainerSpawner{Runtime: svc.Runtime, Bundle: svc.Bundle}
+		case "podman", "docker":
+			if svc.Container == "" {
+				return nil, fmt.Errorf("service %s: type %s needs a container", svc.Name, svc.Type)
+			}
+			p.Spawner = EngineSpawner{Engine: svc.Type, Container: svc.Container}
+		default:
+			return nil, fmt.Errorf("service %s: unknown type %q", svc.Name, svc.Type)
+		}
+		for _, sock := range svc.Sockets {
+			if _, _, err := parseSocket(sock); err != nil {
+				return nil, fmt.Errorf("service %s: sockets: %w", svc.Name, err)
+			}
+		}
+		switch {
+		case len(svc.Sockets) > 0 && (svc.Type != "" && svc.Type != "exec" || svc.Adopt):
+			// A daemon or a container doesn't get our fds as its own
+			return nil, fmt.Errorf("service %s: sockets are for services of type exec", svc.Name)
+		case svc.RestartMode != "" && svc.RestartMode != RestartModeStop && svc.RestartMode != RestartModeHandoff:
+			return nil, fmt.Errorf("service %s: restart_mode must be %s or %s", svc.Name, RestartModeStop, RestartModeHandoff)
+		case svc.RestartMode != RestartModeHandoff:
+		case len(svc.Sockets) == 0:
+			return nil, fmt.Errorf("service %s: restart_mode handoff needs sockets", svc.Name)
+		case svc.TTY || svc.Foreground || svc.Stdin == "attachable":
+			return nil, fmt.Errorf("service %s: restart_mode handoff can't be combined with tty, foreground or stdin attachable", svc.Name)
+		case p.ReadyCheck != nil && p.ReadyCheck.Kind != "file":
+			// Through the shared socket, the old instance would answer
+			return nil, fmt.Errorf("service %s: restart_mode handoff needs a file:// ready_check, or none", svc.Name)
+		}
+		p.Sockets, p.RestartMode = svc.Sockets, svc.RestartMode
+		if svc.Shell {
+			p.Command, p.Args = shellCommand(svc.Name, svc.Command, svc.Args)
+			p.shell = true
 		}
 		if p.MaxRestarts == 0 {
 			p.MaxRestarts = 3
+		} else if p.MaxRestarts < 0 {
+			p.MaxRestarts = 0 // Never restarted
+		}
+		switch svc.Restart {
+		case "", RestartAlways, RestartOnFailure, RestartNever:
+		default:
+			return nil, fmt.Errorf("service %s: restart must be %s, %s or %s", svc.Name, RestartAlways, RestartOnFailure, RestartNever)
 		}
-		sup.AddProcess(p)
+		if svc.LeakRateKBPerMin > 0 {
+			p.LeakRate = svc.LeakRateKBPerMin
+			p.LeakDuration = time.Duration(svc.LeakDurationSec) * time.Second
+			if p.LeakDuration == 0 {
+				p.LeakDuration = 10 * time.Minute
+			}
+			p.LeakAction = svc.LeakAction
+			if p.LeakAction == "" {
+				p.LeakAction = "log"
+			}
+			if p.LeakAction != "log" && p.LeakAction != "restart" {
+				return nil, fmt.Errorf("service %s: leak_action must be \"log\" or \"restart\"", svc.Name)
+			}
+		}
+		if r := svc.Register; r != nil {
+			if !strings.HasPrefix(r.Registry, "consul://") && !strings.HasPrefix(r.Registry, "etcd://") {
+				return nil, fmt.Errorf("service %s: register.registry must be consul://host:port or etcd://host:port", svc.Name)
+			}
+			if r.Port <= 0 {
+				return nil, fmt.Errorf("service %s: register needs a port", svc.Name)
+			}
+			reg := Registration{Registry: r.Registry, Name: r.Name, Address: r.Address, Port: r.Port, Health: r.Health}
+			if reg.Name == "" {
+				reg.Name = svc.Name
+			}
+			p.Hooks = registrationHooks(reg, p)
+			p.HealthURL = r.Health
+		}
+		for id := range svc.Credentials {
+			if !validCredentialID(id) {
+				return nil, fmt.Errorf("service %s: invalid credential id %q", svc.Name, id)
+			}
+		}
+		p.Credentials = svc.Credentials
+		p.DiagnosticsDir = cfg.DiagnosticsDir
+		if svc.Singleton {
+			if !strings.HasPrefix(cfg.LockServer, "consul://") && !strings.HasPrefix(cfg.LockServer, "etcd://") {
+				return nil, fmt.Errorf("service %s: singleton needs lock_server (consul://host:port or etcd://host:port)", svc.Name)
+			}
+			if svc.Foreground {
+				return nil, fmt.Errorf("service %s: a foreground service cannot be a singleton", svc.Name)
+			}
+			p.Lock = &LeaderLock{
+				Server: cfg.LockServer,
+				Key:    "gosv/lock/" + svc.Name,
+				TTL:    time.Duration(svc.LockTTLSec) * time.Second,
+			}
+		}
+		p.Main = cfg.ExitCodeFrom == svc.Name
+		// Reload compares services by their config (see reload.go)
+		fingerprint, _ := json.Marshal(svc)
+		p.configHash = string(fingerprint)
+		procs = append(procs, p)
 	}
 
+	expandRelations(procs)
+	if err := checkRelations(procs); err != nil {
+		return nil, err
+	}
+	if cpuPinning {
+		if err := placeServices(procs); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.ExitCodeFrom != "" {
+		found := false
+		for _, p := range procs {
+			found = found || p.Main
+			if p.Foreground && !p.Main {
+				return nil, fmt.Errorf("exit_code_from: %s conflicts with the foreground service", cfg.ExitCodeFrom)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("exit_code_from: %w: %s", ErrUnknownService, cfg.ExitCodeFrom)
+		}
+	}
+
+	return procs, nil
+}
+
+// shellCommand wraps a command line for /bin/sh so pipes, globs and
+// variable expansion work. Extra args become the positional parameters
+// $1, $2, ... ($0 is the service name, which shows up in sh error messages).
+func shellCommand(name, cmdline string, args []string) (string, []string) {
+	shArgs := append([]string{"-c", cmdline, name}, args...)
+	return "/bin/sh", shArgs
+}
+
+// runSpec is a service defined on the command line with --run
+type runSpec struct {
+	name        string
+	command     string
+	maxRestarts int
+	memoryMB    int
+	cpuPercent  int
+}
+
+// runSpecs collects repeated --run flags
+type runSpecs []*runSpec
+
+// runNamePattern matches the optional "name=" prefix of a --run value.
+// A command that itself starts with VAR=value needs an explicit name.
+var runNamePattern = regexp.MustCompile(`^([A-Za-z0-9_.-]+)=(.+)$`)
+
+func (r *runSpecs) String() string {
+	return fmt.Sprintf("%d commands", len(*r))
+}
+
+func (r *runSpecs) Set(value string) error {
+	spec := &runSpec{command: value, maxRestarts: 10}
+	if m := runNamePattern.FindStringSubmatch(value); m != nil {
+		spec.name, spec.command = m[1], m[2]
+	}
+
+	if spec.name == "" {
+		spec.name = "main"
+		if len(*r) > 0 {
+			spec.name = fmt.Sprintf("main-%d", len(*r)+1)
+		}
+	}
+	if err := validServiceName(spec.name); err != nil {
+		return err
+	}
+	for _, other := range *r {
+		if other.name == spec.name {
+			return fmt.Errorf("duplicate service name %q", spec.name)
+		}
+	}
+
+	*r = append(*r, spec)
+	return nil
+}
+
+// delegateFlag is --delegate. A bare --delegate means true.
+type delegateFlag string
+
+func (f *delegateFlag) String() string {
+	return string(*f)
+}
+
+func (f *delegateFlag) Set(value string) error {
+	switch value {
+	case DelegateAuto, DelegateRequire, DelegateOff:
+		*f = delegateFlag(value)
+		return nil
+	}
+	return fmt.Errorf("must be auto, true or false")
+}
+
+func (f *delegateFlag) IsBoolFlag() bool {
+	return true
+}
+
+// runLimitFlag sets a limit on the most recent --run. Go's flag package
+// parses left to right, so "--run a --mem 64 --run b" limits only a.
+type runLimitFlag struct {
+	runs *runSpecs
+	kind string
+}
+
+func (f runLimitFlag) String() string {
+	return ""
+}
+
+func (f runLimitFlag) Set(value string) error {
+	if f.runs == nil || len(*f.runs) == 0 {
+		return fmt.Errorf("must follow a --run")
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid value %q", value)
+	}
+
+	spec := (*f.runs)[len(*f.runs)-1]
+	switch f.kind {
+	case "mem":
+		spec.memoryMB = n
+	case "cpu":
+		spec.cpuPercent = n
+	case "restarts":
+		spec.maxRestarts = n
+	}
 	return nil
 }
 
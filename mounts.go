@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+)
+
+// Mount is a bind or tmpfs mount set up in a service's mount namespace
+type Mount struct {
+	Type     string `json:"type"` // "bind" (default) or "tmpfs"
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"read_only"`
+	SizeMB   int    `json:"size_mb"` // tmpfs only (0 = kernel default, half of RAM)
+}
+
+// validate checks a mount from the config and fills in defaults
+func (m *Mount) validate() error {
+	if m.Type == "" {
+		m.Type = "bind"
+	}
+	if !filepath.IsAbs(m.Target) {
+		return fmt.Errorf("mount target %q must be an absolute path", m.Target)
+	}
+	switch m.Type {
+	case "bind":
+		if !filepath.IsAbs(m.Source) {
+			return fmt.Errorf("bind mount source %q must be an absolute path", m.Source)
+		}
+		if m.SizeMB != 0 {
+			return fmt.Errorf("size_mb only applies to tmpfs mounts")
+		}
+	case "tmpfs":
+		if m.Source != "" {
+			return fmt.Errorf("tmpfs mounts have no source")
+		}
+	default:
+		return fmt.Errorf("unknown mount type %q (want bind or tmpfs)", m.Type)
+	}
+	return nil
+}
+
+// mountsArg encodes mounts for the exec helper's -mounts option
+func mountsArg(mounts []Mount) string {
+	data, _ := json.Marshal(mounts)
+	return string(data)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// setupMounts performs mounts in order, in the exec helper. uid and gid
+// (if >= 0) own the root of tmpfs mounts.
+//
+// KEY CONCEPT: Bind mounts
+// A bind mount makes an existing directory (or file) appear at a second
+// place, like a hard link for a whole tree that works across filesystems.
+// In a private mount namespace it only exists for the service: the host
+// path /srv/data/app can be the service's /var/lib/app, and a read-only
+// bind keeps the service from writing even where its uid could. Read-only
+// takes a second step: MS_RDONLY is ignored when creating a bind mount
+// and only honored when remounting it.
+func setupMounts(mounts []Mount, uid, gid int) error {
+	for _, m := range mounts {
+		if err := m.mount(uid, gid); err != nil {
+			return fmt.Errorf("%s on %s: %w", m.Type, m.Target, err)
+		}
+	}
+	return nil
+}
+
+func (m Mount) mount(uid, gid int) error {
+	if m.Type == "tmpfs" {
+		if err := os.MkdirAll(m.Target, 0755); err != nil {
+			return err
+		}
+		opts := "mode=0755"
+		if m.SizeMB > 0 {
+			opts += fmt.Sprintf(",size=%dm", m.SizeMB)
+		}
+		if uid >= 0 {
+			opts += fmt.Sprintf(",uid=%d,gid=%d", uid, gid)
+		}
+		flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV)
+		if m.ReadOnly {
+			flags |= syscall.MS_RDONLY
+		}
+		return syscall.Mount("tmpfs", m.Target, "tmpfs", flags, opts)
+	}
+
+	// The target must exist, and be a file if the source is one
+	st, err := os.Stat(m.Source)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		err = os.MkdirAll(m.Target, 0755)
+	} else if _, err = os.Stat(m.Target); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(m.Target), 0755); err == nil {
+			var f *os.File
+			if f, err = os.OpenFile(m.Target, os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+				f.Close()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(m.Source, m.Target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	if m.ReadOnly {
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID)
+		return syscall.Mount("", m.Target, "", flags, "")
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// tcpSocket is what sock_diag reports of one TCP socket
+type tcpSocket struct {
+	established bool
+	sent        uint64 // Bytes the peer acknowledged
+	received    uint64
+}
+
+// socketBytes are the byte counts of a socket at the last sample
+type socketBytes struct {
+	sent, received uint64
+}
+
+// netStats is the network accounting of a service
+type netStats struct {
+	connections           int                    // Established TCP connections at the last sample
+	sent, received        uint64                 // Bytes over TCP, closed connections included
+	sendRate, receiveRate float64                // Bytes/s between the last two samples
+	sockets               map[uint64]socketBytes // Its sockets at the last sample, by inode
+	at                    time.Time              // Of the last sample
+}
+
+// String describes n for ctl status and the status page
+func (n *netStats) String() string {
+	return fmt.Sprintf("%d conns, rx %s/s, tx %s/s",
+		n.connections, formatBytes(int64(n.receiveRate)), formatBytes(int64(n.sendRate)))
+}
+
+// networkMetrics renders the network accounting of procs for ctl
+// metrics: only of the services that have been sampled
+func (s *Supervisor) networkMetrics(b *bytes.Buffer, procs []*Process) {
+	var names []string
+	var stats []netStats
+	for _, p := range procs {
+		p.mu.Lock()
+		if p.net != nil {
+			names, stats = append(names, p.Name), append(stats, *p.net)
+		}
+		p.mu.Unlock()
+	}
+	if len(stats) == 0 {
+		return
+	}
+	fmt.Fprintln(b, "# HELP gosv_service_network_receive_bytes_total Bytes the service received over TCP.")
+	fmt.Fprintln(b, "# TYPE gosv_service_network_receive_bytes_total counter")
+	for i, n := range stats {
+		fmt.Fprintf(b, "gosv_service_network_receive_bytes_total{service=%q} %d\n", names[i], n.received)
+	}
+	fmt.Fprintln(b, "# HELP gosv_service_network_transmit_bytes_total Bytes the service sent over TCP that were acknowledged.")
+	fmt.Fprintln(b, "# TYPE gosv_service_network_transmit_bytes_total counter")
+	for i, n := range stats {
+		fmt.Fprintf(b, "gosv_service_network_transmit_bytes_total{service=%q} %d\n", names[i], n.sent)
+	}
+	fmt.Fprintln(b, "# HELP gosv_service_tcp_connections Established TCP connections of the service.")
+	fmt.Fprintln(b, "# TYPE gosv_service_tcp_connections gauge")
+	for i, n := range stats {
+		fmt.Fprintf(b, "gosv_service_tcp_connections{service=%q} %d\n", names[i], n.connections)
+	}
+}
+
+// sampleNetwork updates the network accounting of the running services,
+// if network_accounting is on. Sampled with the leak samples.
+//
+// KEY CONCEPT: Who is using the network
+// Interface counters say the NIC is saturated, not by whom, and a host
+// running a dozen services needs the "whom". Giving each service a
+// network namespace of its own, with a veth pair whose counters are its
+// traffic, answers that exactly - but changes how every service reaches
+// the network, a big price for a statistic. `ss` answers it without
+// changing anything: the kernel's sock_diag netlink interface lists
+// every TCP socket with its tcp_info, which counts the bytes acknowledged
+// and received since it opened, and each socket's inode is a
+// "socket:[inode]" link in /proc/<pid>/fd of the processes holding it.
+// Summing the sockets of a service's processes gives its traffic. Each
+// sample adds what its sockets moved since the last one, so a closed
+// connection keeps counting with what it had moved by the last sample it
+// was seen in; only UDP and the last moments of short connections go
+// uncounted.
+func (s *Supervisor) sampleNetwork() {
+	s.mu.RLock()
+	enabled := s.networkAccounting
+	s.mu.RUnlock()
+	if !enabled {
+		return
+	}
+	sockets, err := tcpSockets()
+	if err != nil {
+		if !s.networkWarned {
+			logWarn("network_accounting: %v", err)
+			s.networkWarned = true
+		}
+		return
+	}
+	now := s.clock.Now()
+	for _, p := range s.snapshot() {
+		p.mu.Lock()
+		pid, cg, running := p.pid, p.cgroup, p.state == StateRunning
+		p.mu.Unlock()
+		var pids []int
+		if cg != nil {
+			pids = cg.Procs()
+		} else if running && pid != 0 {
+			pids = append([]int{pid}, descendants(pid)...)
+		}
+		inodes := socketInodes(pids)
+		p.mu.Lock()
+		p.recordNetwork(now, inodes, sockets)
+		p.mu.Unlock()
+	}
+}
+
+// recordNetwork adds what the sockets of p moved since the last sample.
+// Caller must hold p.mu.
+func (p *Process) recordNetwork(now time.Time, inodes map[uint64]bool, sockets map[uint64]tcpSocket) {
+	n := p.net
+	if n == nil {
+		n = &netStats{}
+		p.net = n
+	}
+	sent, received := n.sent, n.received
+	seen := make(map[uint64]socketBytes, len(inodes))
+	n.connections = 0
+	for inode := range inodes {
+		sock, ok := sockets[inode]
+		if !ok {
+			continue // Not TCP
+		}
+		if sock.established {
+			n.connections++
+		}
+		last := n.sockets[inode]
+		if sock.sent < last.sent || sock.received < last.received {
+			last = socketBytes{} // A new socket with an old inode
+		}
+		n.sent += sock.sent - last.sent
+		n.received += sock.received - last.received
+		seen[inode] = socketBytes{sock.sent, sock.received}
+	}
+	n.sockets = seen
+	if secs := now.Sub(n.at).Seconds(); !n.at.IsZero() && secs > 0 {
+		n.sendRate = float64(n.sent-sent) / secs
+		n.receiveRate = float64(n.received-received) / secs
+	}
+	n.at = now
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// sock_diag constants (linux/sock_diag.h, linux/inet_diag.h)
+const (
+	netlinkSockDiag  = 4  // NETLINK_SOCK_DIAG
+	sockDiagByFamily = 20 // SOCK_DIAG_BY_FAMILY
+	inetDiagInfo     = 2  // INET_DIAG_INFO: the tcp_info attribute
+	tcpEstablished   = 1
+	tcpListen        = 10
+)
+
+// inetDiagReq is struct inet_diag_req_v2, with an all-zero socket id:
+// every socket of the family
+type inetDiagReq struct {
+	family   uint8
+	protocol uint8
+	ext      uint8
+	_        uint8
+	states   uint32
+	id       [48]byte
+}
+
+// inetDiagMsgLen is the size of struct inet_diag_msg, after which the
+// attributes start. Its inode is the last field.
+const inetDiagMsgLen = 72
+
+// Offsets of tcpi_bytes_acked and tcpi_bytes_received in struct
+// tcp_info (Linux 4.1 and 4.2); older kernels send a shorter struct
+const (
+	tcpInfoBytesAcked    = 120
+	tcpInfoBytesReceived = 128
+)
+
+// tcpSockets returns the TCP sockets of the host that aren't listening,
+// IPv4 and IPv6, by inode
+func tcpSockets() (map[uint64]tcpSocket, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, netlinkSockDiag)
+	if err != nil {
+		return nil, fmt.Errorf("sock_diag: %w", err)
+	}
+	defer syscall.Close(fd)
+	sockets := make(map[uint64]tcpSocket)
+	for _, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		if err := dumpTCPSockets(fd, family, sockets); err != nil {
+			return nil, fmt.Errorf("sock_diag: %w", err)
+		}
+	}
+	return sockets, nil
+}
+
+// dumpTCPSockets asks for the sockets of family with their tcp_info, and
+// adds the replies to sockets
+func dumpTCPSockets(fd int, family uint8, sockets map[uint64]tcpSocket) error {
+	req := inetDiagReq{
+		family:   family,
+		protocol: syscall.IPPROTO_TCP,
+		ext:      1 << (inetDiagInfo - 1),
+		states:   0xfff &^ (1 << tcpListen),
+	}
+	msg := make([]byte, syscall.NLMSG_HDRLEN+int(unsafe.Sizeof(req)))
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], sockDiagByFamily)
+	binary.NativeEndian.PutUint16(msg[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	binary.NativeEndian.PutUint32(msg[8:], 1) // Sequence number
+	copy(msg[syscall.NLMSG_HDRLEN:], unsafe.Slice((*byte)(unsafe.Pointer(&req)), unsafe.Sizeof(req)))
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+						return syscall.Errno(-errno)
+					}
+				}
+				return nil
+			case sockDiagByFamily:
+				if len(m.Data) < inetDiagMsgLen {
+					continue
+				}
+				inode := uint64(binary.NativeEndian.Uint32(m.Data[68:]))
+				sock := tcpSocket{established: m.Data[1] == tcpEstablished}
+				if info := diagAttr(m.Data[inetDiagMsgLen:], inetDiagInfo); len(info) >= tcpInfoBytesReceived+8 {
+					sock.sent = binary.NativeEndian.Uint64(info[tcpInfoBytesAcked:])
+					sock.received = binary.NativeEndian.Uint64(info[tcpInfoBytesReceived:])
+				}
+				if inode != 0 { // 0: no longer held by any process
+					sockets[inode] = sock
+				}
+			}
+		}
+	}
+}
+
+// diagAttr returns the value of the attribute of type typ among attrs
+// (struct rtattr, each padded to 4 bytes), or nil
+func diagAttr(attrs []byte, typ uint16) []byte {
+	for len(attrs) >= syscall.SizeofRtAttr {
+		size := int(binary.NativeEndian.Uint16(attrs))
+		if size < syscall.SizeofRtAttr || size > len(attrs) {
+			return nil
+		}
+		if binary.NativeEndian.Uint16(attrs[2:]) == typ {
+			return attrs[syscall.SizeofRtAttr:size]
+		}
+		attrs = attrs[min((size+3)&^3, len(attrs)):]
+	}
+	return nil
+}
+
+// socketInodes returns the inodes of the sockets pids hold, from the
+// "socket:[inode]" links in /proc/<pid>/fd
+func socketInodes(pids []int) map[uint64]bool {
+	inodes := make(map[uint64]bool)
+	for _, pid := range pids {
+		dir := "/proc/" + strconv.Itoa(pid) + "/fd"
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue // Exited, or not ours to read
+		}
+		for _, e := range entries {
+			link, err := os.Readlink(dir + "/" + e.Name())
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			if inode, err := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64); err == nil {
+				inodes[inode] = true
+			}
+		}
+	}
+	return inodes
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Where the kernel describes NUMA nodes and PCI devices
+const (
+	numaNodeDir  = "/sys/devices/system/node"
+	pciDeviceDir = "/sys/bus/pci/devices"
+)
+
+// PlacementSpread spreads the services that ask for it across the NUMA
+// nodes
+const PlacementSpread = "spread"
+
+// numaNode is a NUMA node with CPUs
+type numaNode struct {
+	id   int
+	cpus []int
+}
+
+// numaNodes returns the online NUMA nodes that have CPUs. A kernel
+// without NUMA support has no node directory: the machine is one node.
+func numaNodes() ([]numaNode, error) {
+	ids, err := readCPUList(filepath.Join(numaNodeDir, "online"))
+	if os.IsNotExist(err) {
+		online, err := readCPUList(onlineCPUsPath)
+		if err != nil {
+			return nil, fmt.Errorf("online CPUs: %w", err)
+		}
+		return []numaNode{{id: 0, cpus: online}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("NUMA nodes: %w", err)
+	}
+	var nodes []numaNode
+	for _, id := range ids {
+		cpus, err := readCPUList(filepath.Join(numaNodeDir, fmt.Sprintf("node%d", id), "cpulist"))
+		if err != nil {
+			return nil, fmt.Errorf("NUMA node %d: %w", id, err)
+		}
+		if len(cpus) > 0 { // Memory-only nodes (CXL, HBM) run nothing
+			nodes = append(nodes, numaNode{id: id, cpus: cpus})
+		}
+	}
+	return nodes, nil
+}
+
+// validPlacement checks the syntax of placement: spread, node:<n> or
+// pci:<address>
+func validPlacement(placement string) error {
+	kind, arg, _ := strings.Cut(placement, ":")
+	switch {
+	case placement == "", placement == PlacementSpread:
+		return nil
+	case kind == "node":
+		if n, err := strconv.Atoi(arg); err == nil && n >= 0 {
+			return nil
+		}
+	case kind == "pci":
+		if arg != "" && !strings.ContainsAny(arg, "/ ") {
+			return nil
+		}
+	}
+	return fmt.Errorf("placement: %q is not spread, node:<n> or pci:<address>", placement)
+}
+
+// pciNode returns the NUMA node of the PCI device at addr
+// ("0000:3b:00.0"), or -1 if the machine doesn't say
+func pciNode(addr string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(pciDeviceDir, addr, "numa_node"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("no PCI device %s (see lspci -D)", addr)
+		}
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// placeServices binds the procs with a placement to a NUMA node: their
+// CPUs become those of the node (and of cpus and isolate_from, if set),
+// and their memory comes from it. Fixed placements are made first, then
+// each spread service goes to the node with the fewest placed services
+// whose CPUs it may use, in config order.
+//
+// KEY CONCEPT: NUMA placement
+// On a machine with more than one socket, each socket has memory of its
+// own; reaching the other socket's memory, or a NIC or GPU attached to
+// it, takes a hop across the interconnect, with more latency and less
+// bandwidth. A process whose threads wander between sockets, or whose
+// memory is allocated on one node while it runs on the other, pays that
+// hop all the time - and by default Linux lets both happen. Placement
+// keeps a service on one node: its affinity and cpuset hold only the
+// node's CPUs, and set_mempolicy(MPOL_BIND) and cpuset.mems only the
+// node's memory. Spreading services over the nodes uses both sockets'
+// memory bandwidth; binding a service to the node of its NIC or GPU keeps
+// its I/O local.
+func placeServices(procs []*Process) error {
+	var placed []*Process
+	for _, p := range procs {
+		if p.Placement != "" {
+			placed = append(placed, p)
+		}
+	}
+	if len(placed) == 0 {
+		return nil
+	}
+	nodes, err := numaNodes()
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(nodes))
+	for i, n := range nodes {
+		ids[i] = strconv.Itoa(n.id)
+	}
+
+	// The CPUs p may use on node n
+	cpusOn := func(p *Process, n numaNode) []int {
+		if len(p.cpuList) == 0 {
+			return n.cpus
+		}
+		return slices.DeleteFunc(slices.Clone(n.cpus), func(cpu int) bool { return !slices.Contains(p.cpuList, cpu) })
+	}
+	load := make(map[int]int)
+	place := func(p *Process, n numaNode) error {
+		cpus := cpusOn(p, n)
+		if len(cpus) == 0 {
+			return fmt.Errorf("service %s: placement: none of its CPUs is on node %d (CPUs %s)", p.Name, n.id, formatCPUList(n.cpus))
+		}
+		p.cpuList, p.memNodes = cpus, []int{n.id}
+		load[n.id]++
+		return nil
+	}
+
+	for _, p := range placed {
+		kind, arg, _ := strings.Cut(p.Placement, ":")
+		id := -1
+		switch kind {
+		case "node":
+			id, _ = strconv.Atoi(arg)
+		case "pci":
+			if id, err = pciNode(arg); err != nil {
+				return fmt.Errorf("service %s: placement: %w", p.Name, err)
+			}
+			if id < 0 && len(nodes) > 1 {
+				return fmt.Errorf("service %s: placement: the firmware gives PCI device %s no NUMA node", p.Name, arg)
+			}
+			if id < 0 {
+				id = nodes[0].id // One node: it's local to everything
+			}
+		default:
+			continue
+		}
+		i := slices.IndexFunc(nodes, func(n numaNode) bool { return n.id == id })
+		if i < 0 {
+			return fmt.Errorf("service %s: placement: no NUMA node %d with CPUs (have %s)", p.Name, id, strings.Join(ids, ", "))
+		}
+		if err := place(p, nodes[i]); err != nil {
+			return err
+		}
+	}
+	for _, p := range placed {
+		if p.Placement != PlacementSpread {
+			continue
+		}
+		best := -1
+		for i, n := range nodes {
+			if len(cpusOn(p, n)) > 0 && (best < 0 || load[n.id] < load[nodes[best].id]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return fmt.Errorf("service %s: placement: no NUMA node has any of its CPUs", p.Name)
+		}
+		place(p, nodes[best])
+	}
+	return nil
+}
+
+// describePlacement describes p's placement for --dry-run
+func (p *Process) describePlacement() string {
+	if len(p.memNodes) == 0 {
+		return p.Placement + " (not placed)"
+	}
+	return fmt.Sprintf("NUMA node %s (%s), memory allocated there only", formatCPUList(p.memNodes), p.Placement)
+}
+
+// nodeMemory returns the total and free memory of NUMA node id, in bytes
+func nodeMemory(id int) (total, free int64) {
+	f, err := os.Open(filepath.Join(numaNodeDir, fmt.Sprintf("node%d", id), "meminfo"))
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// "Node 0 MemTotal:       65536000 kB"
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		kb, _ := strconv.ParseInt(fields[3], 10, 64)
+		switch fields[2] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemFree:":
+			free = kb * 1024
+		}
+	}
+	return total, free
+}
+
+// placementTable renders the NUMA nodes and the services pinned to their
+// CPUs, for ctl placement
+func (s *Supervisor) placementTable() string {
+	if !cpuPinning {
+		return "placement: not supported on " + runtime.GOOS + "\n"
+	}
+	nodes, err := numaNodes()
+	if err != nil {
+		return "placement: " + err.Error() + "\n"
+	}
+	var pinned []*Process
+	for _, p := range s.snapshot() {
+		if len(p.cpuList) > 0 {
+			pinned = append(pinned, p)
+		}
+	}
+	// The nodes whose CPUs cpus are on
+	nodesOf := func(cpus []int) []int {
+		var ids []int
+		for _, n := range nodes {
+			if slices.ContainsFunc(n.cpus, func(cpu int) bool { return slices.Contains(cpus, cpu) }) {
+				ids = append(ids, n.id)
+			}
+		}
+		return ids
+	}
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tCPUS\tMEMORY FREE\tSERVICES")
+	for _, n := range nodes {
+		var names []string
+		for _, p := range pinned {
+			if slices.Contains(nodesOf(p.cpuList), n.id) {
+				names = append(names, p.Name)
+			}
+		}
+		mem := "-"
+		if total, free := nodeMemory(n.id); total > 0 {
+			mem = formatBytes(free) + " / " + formatBytes(total)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", n.id, formatCPUList(n.cpus), mem, strings.Join(names, ", "))
+	}
+	if len(pinned) > 0 {
+		w.Flush()
+		b.WriteString("\n")
+		fmt.Fprintln(w, "SERVICE\tPLACEMENT\tNODES\tCPUS\tMEMORY NODES")
+		for _, p := range pinned {
+			placement, mems := p.Placement, "any"
+			if placement == "" {
+				placement = "cpus"
+			}
+			if len(p.memNodes) > 0 {
+				mems = formatCPUList(p.memNodes)
+			}
+			ids := nodesOf(p.cpuList)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Name, placement, formatCPUList(ids), formatCPUList(p.cpuList), mems)
+		}
+	}
+	w.Flush()
+	return b.String()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// mpolBind is set_mempolicy(2)'s MPOL_BIND: allocate only on the given
+// nodes
+const mpolBind = 2
+
+// bindMemory makes the calling process allocate its memory only on the
+// NUMA nodes nodes, with set_mempolicy(2). Its children inherit the
+// policy, through fork and exec.
+func bindMemory(nodes []int) error {
+	mask := make([]uint64, nodes[len(nodes)-1]/64+1)
+	for _, node := range nodes {
+		mask[node/64] |= 1 << (node % 64)
+	}
+	// maxnode counts one past the last bit, as the kernel takes one off
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SET_MEMPOLICY, mpolBind, uintptr(unsafe.Pointer(&mask[0])), uintptr(len(mask)*64+1))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
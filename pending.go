@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// scheduleRestart arms p's restart to run in d. Caller must hold p.mu.
+//
+// KEY CONCEPT: Restarts as timers, not sleeping goroutines
+// A goroutine that sleeps through a backoff delay can't be reached: when
+// the service is stopped, or gosv shuts down, in the meantime, all it
+// can do is wake up and notice. A timer the supervisor keeps is state -
+// status can show when it fires, and stopping the service stops the
+// timer. The runtime keeps timers in per-P heaps, so ten thousand
+// pending restarts cost ten thousand heap entries, not ten thousand
+// goroutine stacks.
+func (s *Supervisor) scheduleRestart(p *Process, d time.Duration) {
+	p.restartSeq++
+	seq := p.restartSeq
+	p.restartAt = s.clock.Now().Add(d)
+	p.restartTimer = s.clock.AfterFunc(d, func() {
+		go s.runScheduledRestart(p, seq)
+	})
+}
+
+// runScheduledRestart runs the restart armed by scheduleRestart, unless it
+// was canceled since
+func (s *Supervisor) runScheduledRestart(p *Process, seq int) {
+	p.mu.Lock()
+	if p.restartSeq != seq || p.restartTimer == nil {
+		p.mu.Unlock()
+		return // Canceled, maybe rescheduled
+	}
+	p.restartTimer, p.restartAt = nil, time.Time{}
+	p.mu.Unlock()
+
+	if !s.mayStart(p) {
+		return // Removed by a reload, or shutting down
+	}
+	if err := s.restart(p); err != nil {
+		logError("restart failed: %v", err)
+		s.wakeRestarts() // A critical service may have failed
+	}
+}
+
+// cancelRestart cancels p's scheduled restart, and reports whether there
+// was one. Caller must hold p.mu.
+func (p *Process) cancelRestart() bool {
+	if p.restartTimer == nil {
+		return false
+	}
+	p.restartTimer.Stop()
+	p.restartTimer, p.restartAt = nil, time.Time{}
+	p.restartSeq++
+	if p.state == StateStarting {
+		p.state = StateStopped
+	}
+	return true
+}
+
+// CancelRestart cancels the scheduled restarts of the target services (a
+// name or "@group") and keeps them down until Start, like Stop does for
+// running ones
+func (s *Supervisor) CancelRestart(target string) error {
+	procs, err := s.resolve(target)
+	if err != nil {
+		return err
+	}
+	canceled := 0
+	for _, p := range procs {
+		p.mu.Lock()
+		if p.cancelRestart() {
+			p.manualStop = true
+			p.noteEvent(EventCancel, "scheduled restart canceled by request")
+			storeRestart(p, RestartCanceled, 0)
+			canceled++
+			logInfo("canceled the scheduled restart of %s", p.Name)
+		}
+		p.mu.Unlock()
+	}
+	if canceled == 0 {
+		return fmt.Errorf("%s: no restart scheduled", target)
+	}
+	return nil
+}
+
+// cancelAllRestarts cancels every scheduled restart (at shutdown)
+func (s *Supervisor) cancelAllRestarts() {
+	for _, p := range s.snapshot() {
+		p.mu.Lock()
+		p.cancelRestart()
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduledRestartFiresAtItsDelay(t *testing.T) {
+	p := testProcess("web")
+	s, c := newTestSupervisor(t, p)
+
+	s.handleRestarts()
+	p.mu.Lock()
+	timer := p.restartTimer
+	// Keep the timer's restart from spawning anything
+	p.manualStop = true
+	p.mu.Unlock()
+
+	c.Advance(time.Second - time.Nanosecond)
+	if !timer.Stop() {
+		t.Fatal("restart fired before its delay")
+	}
+	// Stop took it off the clock: arm it again and let it fire
+	p.mu.Lock()
+	s.scheduleRestart(p, time.Nanosecond)
+	timer = p.restartTimer
+	p.mu.Unlock()
+	c.Advance(time.Nanosecond)
+	if timer.Stop() {
+		t.Fatal("restart didn't fire at its delay")
+	}
+}
+
+func TestCancelRestart(t *testing.T) {
+	p := testProcess("web")
+	s, c := newTestSupervisor(t, p)
+
+	s.handleRestarts()
+	p.mu.Lock()
+	if !p.cancelRestart() {
+		t.Fatal("cancelRestart found no scheduled restart")
+	}
+	if p.restartTimer != nil || !p.restartAt.IsZero() || p.state != StateStopped {
+		t.Fatalf("after cancel: timer %v, at %v, state %s", p.restartTimer, p.restartAt, p.state)
+	}
+	if p.cancelRestart() {
+		t.Fatal("cancelRestart canceled twice")
+	}
+	p.mu.Unlock()
+
+	// The timer is gone from the clock, so nothing fires (and would try to
+	// spawn /bin/false)
+	c.Advance(time.Hour)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != StateStopped {
+		t.Fatalf("state %s after the canceled restart's time", p.state)
+	}
+}
+
+func TestCancelRestartByTarget(t *testing.T) {
+	p := testProcess("web")
+	s, _ := newTestSupervisor(t, p)
+
+	if err := s.CancelRestart("web"); err == nil {
+		t.Fatal("CancelRestart with nothing scheduled succeeded")
+	}
+	s.handleRestarts()
+	if err := s.CancelRestart("web"); err != nil {
+		t.Fatal(err)
+	}
+	// Held down, like a stopped service
+	s.handleRestarts()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.manualStop || p.restartTimer != nil {
+		t.Fatalf("manualStop = %v, restart scheduled = %v", p.manualStop, p.restartTimer != nil)
+	}
+}
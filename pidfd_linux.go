@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// sysPidfdOpen is pidfd_open(2), the same number on every architecture
+const sysPidfdOpen = 434
+
+// watchPID opens a pidfd for pid, checks the process with check, and
+// returns a function that blocks until the process exits
+//
+// KEY CONCEPT: pidfds
+// A pid is only a number: once its process is reaped, the kernel hands it
+// to the next process forked. gosv can't reap a process that isn't its
+// child, so a pid it holds on to could come to mean another process. A
+// pidfd (Linux 5.3+) is a file descriptor that refers to one process, for
+// as long as the fd is open. It becomes readable when the process exits,
+// so poll()ing it is how a process that isn't our child is waited for.
+// Checking the process after the pidfd is open makes sure the check was
+// about the process the pidfd refers to.
+func watchPID(pid int, check func() error) (func(), error) {
+	fd, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(pid), 0, 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("pidfd_open", errno)
+	}
+	pidfd := int(fd)
+	if err := check(); err != nil {
+		syscall.Close(pidfd)
+		return nil, err
+	}
+
+	ep, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		syscall.Close(pidfd)
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(pidfd)}
+	if err := syscall.EpollCtl(ep, syscall.EPOLL_CTL_ADD, pidfd, &ev); err != nil {
+		syscall.Close(ep)
+		syscall.Close(pidfd)
+		return nil, os.NewSyscallError("epoll_ctl", err)
+	}
+	return func() {
+		defer syscall.Close(pidfd)
+		defer syscall.Close(ep)
+		events := make([]syscall.EpollEvent, 1)
+		for {
+			n, err := syscall.EpollWait(ep, events, -1)
+			if n > 0 || (err != nil && err != syscall.EINTR) {
+				return
+			}
+		}
+	}, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// commandTimeout is how long a short command of gosv's own (tc, a
+	// container runtime's delete or kill) may take before it's killed
+	commandTimeout = 30 * time.Second
+
+	// commandPoll is how often run checks for the exit of its command
+	// itself, in case the reaper is busy waiting for it
+	commandPoll = 10 * time.Millisecond
+)
+
+// pidIndex maps the pids of running services to their processes, so
+// reaping a child is a map lookup instead of a scan of every service
+//
+// KEY CONCEPT: Lock order
+// The supervisor has one lock for its set of services (s.mu) and one per
+// process (p.mu). Code that needs both takes s.mu first - but holding
+// s.mu while going through every process for a long time is how a
+// supervisor with a thousand services ends up stalling on itself:
+// sync.RWMutex blocks new readers once a writer waits, so a read-locked
+// loop that calls anything taking s.mu again (lookup, dependents,
+// mayStart) deadlocks as soon as a reload or AddProcess comes along. The
+// hot paths (reaping, restart evaluation, boot) therefore work on a
+// snapshot of the services and hold no supervisor lock while they take
+// process locks. The pid index has a lock of its own that is always
+// taken last and never held while taking another.
+//
+// A child can exit before the goroutine that forked it gets to record
+// its pid. If the reaper ran in between, it would find no owner and
+// write the exit off as an orphan's, leaving the service "running"
+// forever. spawning closes the gap: forks hold it shared until the pid is
+// indexed, the reaper holds it exclusively around wait4 and the lookup.
+type pidIndex struct {
+	mu sync.Mutex
+	m  map[int]*Process
+
+	spawning sync.RWMutex
+
+	// commands are gosv's own commands in flight (see run): reap hands
+	// their exit status over instead of writing them off as orphans
+	commands map[int]chan syscall.WaitStatus
+
+	// watch, if set, is told about every pid added (see exits_kqueue.go)
+	watch func(pid int)
+}
+
+func newPIDIndex() *pidIndex {
+	return &pidIndex{m: make(map[int]*Process), commands: make(map[int]chan syscall.WaitStatus)}
+}
+
+// add records that pid belongs to p
+func (x *pidIndex) add(pid int, p *Process) {
+	x.mu.Lock()
+	x.m[pid] = p
+	x.mu.Unlock()
+	if x.watch != nil {
+		x.watch(pid)
+	}
+}
+
+// take returns the process pid belongs to and forgets it, or nil
+func (x *pidIndex) take(pid int) *Process {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	p := x.m[pid]
+	delete(x.m, pid)
+	return p
+}
+
+// holdReaping keeps reap from running until releaseReaping; a fork and
+// the add of its pid go in between. x may be nil (a process that isn't
+// supervised).
+func (x *pidIndex) holdReaping() {
+	if x != nil {
+		x.spawning.RLock()
+	}
+}
+
+func (x *pidIndex) releaseReaping() {
+	if x != nil {
+		x.spawning.RUnlock()
+	}
+}
+
+// run runs name with args in dir, a command of gosv's own (git, tc, a
+// container runtime), and returns its combined output. Reaping is held
+// only for the fork: reap hands the exit of the command's pid over, so a
+// hung command never stalls the reaper. The caller may be the reaper
+// itself (a start at boot, a kill at shutdown), so run also reaps the
+// command on its own while it waits. When ctx is done the command's
+// process group is killed. x may be nil (no supervisor reaps).
+func (x *pidIndex) run(ctx context.Context, dir, name string, args ...string) ([]byte, error) {
+	if x == nil {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Dir = dir
+		return cmd.CombinedOutput()
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	// An *os.File goes to the child as is: no copying goroutine that only
+	// cmd.Wait would end
+	cmd.Stdout, cmd.Stderr = w, w
+	// Its own group, so a timeout kills its helpers (ssh, git-remote-https)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	exit := make(chan syscall.WaitStatus, 1)
+	x.holdReaping()
+	err = cmd.Start()
+	if err == nil {
+		x.mu.Lock()
+		x.commands[cmd.Process.Pid] = exit
+		x.mu.Unlock()
+	}
+	x.releaseReaping()
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+	pid := cmd.Process.Pid
+	if x.watch != nil {
+		x.watch(pid)
+	}
+	// The reaper took (or will take) its exit, never cmd.Wait
+	defer cmd.Process.Release()
+
+	out := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- b
+	}()
+	poll := time.NewTicker(commandPoll)
+	defer poll.Stop()
+	for {
+		select {
+		case ws := <-exit:
+			b := <-out
+			switch {
+			case ws.Signaled():
+				return b, fmt.Errorf("signal: %v", ws.Signal())
+			case ws.ExitStatus() != 0:
+				return b, fmt.Errorf("exit status %d", ws.ExitStatus())
+			}
+			return b, nil
+		case <-poll.C:
+			x.reapCommand(pid)
+		case <-ctx.Done():
+			syscall.Kill(-pid, syscall.SIGKILL)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// reapCommand reaps pid, a command run is waiting for, if it exited and
+// reap hasn't taken it yet, and hands its exit status over like reap
+func (x *pidIndex) reapCommand(pid int) {
+	x.spawning.Lock()
+	defer x.spawning.Unlock()
+	x.mu.Lock()
+	exit, ok := x.commands[pid]
+	x.mu.Unlock()
+	if !ok {
+		return // reap took it: pid may be someone else's by now
+	}
+	var ws syscall.WaitStatus
+	if n, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil); n != pid || err != nil {
+		return
+	}
+	x.mu.Lock()
+	delete(x.commands, pid)
+	x.mu.Unlock()
+	exit <- ws
+}
+
+// reap reaps one exited child without blocking, like wait4(-1, WNOHANG),
+// and returns the process it belonged to (nil for other children). pid
+// is 0 when there is none left.
+func (x *pidIndex) reap(wstatus *syscall.WaitStatus, rusage *syscall.Rusage) (int, *Process, error) {
+	x.spawning.Lock()
+	defer x.spawning.Unlock()
+	pid, err := syscall.Wait4(-1, wstatus, syscall.WNOHANG, rusage)
+	if pid <= 0 || err != nil {
+		return pid, nil, err
+	}
+	x.mu.Lock()
+	exit, ok := x.commands[pid]
+	delete(x.commands, pid)
+	x.mu.Unlock()
+	if ok {
+		exit <- *wstatus // Buffered, and only ever sent once
+		return pid, nil, nil
+	}
+	return pid, x.take(pid), nil
+}
+
+// snapshot returns the supervised processes, to iterate without holding
+// s.mu (see pidIndex)
+func (s *Supervisor) snapshot() []*Process {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	procs := make([]*Process, 0, len(s.processes))
+	for _, p := range s.processes {
+		procs = append(procs, p)
+	}
+	return procs
+}
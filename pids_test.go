@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// With no reaper running (as when the reaper itself runs a command), run
+// reaps its command on its own
+func TestPIDIndexRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		want    string
+		wantErr string
+	}{
+		{"output", "echo out; echo err >&2", "out\nerr\n", ""},
+		{"exit status", "echo failed; exit 3", "failed\n", "exit status 3"},
+		{"signal", "kill -9 $$", "", "signal: killed"},
+	}
+	x := newPIDIndex()
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		out, err := x.run(ctx, "", "sh", "-c", tt.script)
+		cancel()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want one about %q", tt.name, err, tt.wantErr)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s: output %q, want %q", tt.name, out, tt.want)
+		}
+	}
+	if len(x.commands) != 0 {
+		t.Errorf("commands left over: %v", x.commands)
+	}
+}
+
+func TestPIDIndexRunTimeout(t *testing.T) {
+	x := newPIDIndex()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := x.run(ctx, "", "sleep", "10"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("run returned after %v", d)
+	}
+}
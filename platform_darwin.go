@@ -0,0 +1,30 @@
+package main
+
+import "syscall"
+
+// cgroupsSupported: macOS has no cgroups; memory_mb and cpu_percent
+// become an rlimit and scheduling hints (see limits_darwin.go)
+const cgroupsSupported = false
+
+// adoptsDaemons: without a subreaper, a forking service's daemon goes to
+// launchd, and gosv can't supervise it
+const adoptsDaemons = false
+
+// pidfdsSupported: gosv can only watch its own children
+const pidfdsSupported = false
+
+// cpuPinning: macOS only takes affinity hints, and has no CPU lists
+const cpuPinning = false
+
+// ioctlGetTermios is the ioctl behind tcgetattr(3)
+const ioctlGetTermios = syscall.TIOCGETA
+
+// becomeSubreaper: macOS has no child subreapers. Orphans of services go
+// to launchd, and gosv can't stop them at shutdown.
+func becomeSubreaper() {
+	logDebug("no child subreaper on darwin, orphaned descendants are adopted by launchd")
+}
+
+// childPids: without a subreaper, the only children of gosv are the
+// services it started itself
+func childPids() []int { return nil }
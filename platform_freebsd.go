@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// cgroupsSupported: FreeBSD has no cgroups; memory_mb and cpu_percent
+// become rctl rules (see limits_freebsd.go)
+const cgroupsSupported = false
+
+// adoptsDaemons: as the reaper (procctl(PROC_REAP_ACQUIRE)), gosv
+// becomes the parent of a forking service's daemon (see forking.go)
+const adoptsDaemons = true
+
+// pidfdsSupported: gosv can only watch its own children
+const pidfdsSupported = false
+
+// cpuPinning: cpus and isolate_from are Linux's (FreeBSD pins with
+// cpuset(1))
+const cpuPinning = false
+
+// ioctlGetTermios is the ioctl behind tcgetattr(3)
+const ioctlGetTermios = syscall.TIOCGETA
+
+// procctl(2) arguments, from <sys/procctl.h> and <sys/wait.h>
+const (
+	pPID               = 0 // P_PID
+	procReapAcquire    = 2 // PROC_REAP_ACQUIRE
+	procReapStatus     = 4 // PROC_REAP_STATUS
+	procReapGetPids    = 5 // PROC_REAP_GETPIDS
+	reaperPidinfoChild = 2 // REAPER_PIDINFO_CHILD
+)
+
+// reaperStatus is struct procctl_reaper_status
+type reaperStatus struct {
+	flags       uint32
+	children    uint32
+	descendants uint32
+	reaper      int32
+	pid         int32
+	_           [15]uint32
+}
+
+// reaperPidinfo is struct procctl_reaper_pidinfo
+type reaperPidinfo struct {
+	pid     int32
+	subtree int32
+	flags   uint32
+	_       [15]uint32
+}
+
+// reaperPids is struct procctl_reaper_pids
+type reaperPids struct {
+	count uint32
+	_     [15]uint32
+	pids  *reaperPidinfo
+}
+
+// procctl runs procctl(2) on gosv itself. Its id argument is a 64-bit
+// id_t, passed in one register only on 64-bit platforms.
+func procctl(cmd int, data unsafe.Pointer) error {
+	if unsafe.Sizeof(uintptr(0)) < 8 {
+		return syscall.ENOSYS
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_PROCCTL, pPID, uintptr(os.Getpid()), uintptr(cmd), uintptr(data), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// becomeSubreaper makes gosv the reaper of its descendants (see
+// subreaper_linux.go). FreeBSD's procctl(PROC_REAP_ACQUIRE) is the same
+// idea as Linux's child subreaper: orphans below gosv are reparented to
+// it instead of to init.
+func becomeSubreaper() {
+	if os.Getpid() == 1 {
+		return
+	}
+	if err := procctl(procReapAcquire, nil); err != nil {
+		logWarn("could not become a reaper: %v", err)
+		return
+	}
+	logDebug("acquired reaper status")
+}
+
+// childPids returns the pids of gosv's children, as the reaper lists
+// them: every descendant, flagged when it is a direct child
+func childPids() []int {
+	var st reaperStatus
+	if err := procctl(procReapStatus, unsafe.Pointer(&st)); err != nil || st.descendants == 0 {
+		return nil
+	}
+	// Room for a few more, in case some were forked since
+	infos := make([]reaperPidinfo, st.descendants+16)
+	rp := reaperPids{count: uint32(len(infos)), pids: &infos[0]}
+	if err := procctl(procReapGetPids, unsafe.Pointer(&rp)); err != nil {
+		return nil
+	}
+	var pids []int
+	for _, info := range infos {
+		if info.flags&reaperPidinfoChild != 0 {
+			pids = append(pids, int(info.pid))
+		}
+	}
+	return pids
+}
@@ -0,0 +1,28 @@
+package main
+
+// cgroupsSupported: resource limits are cgroup v2 files (see cgroup.go)
+const cgroupsSupported = true
+
+// adoptsDaemons: as a child subreaper, gosv becomes the parent of a
+// forking service's daemon (see forking.go)
+const adoptsDaemons = true
+
+// pidfdsSupported: gosv can watch processes that aren't its children
+// (see pidfd_linux.go)
+const pidfdsSupported = true
+
+// cpuPinning: cpus and isolate_from are checked against the kernel's CPU
+// lists (see cpuset.go)
+const cpuPinning = true
+
+// dropUnsupported: every option works on Linux (see isolation_other.go)
+func (p *Process) dropUnsupported() {}
+
+// watchExits: SIGCHLD is all it takes on Linux (see setupSignals)
+func (s *Supervisor) watchExits() {}
+
+// fallbackLimitArgs, fallbackLimits and applyFallbackLimits: cgroups
+// enforce the limits on Linux (see limits_darwin.go, limits_freebsd.go)
+func (p *Process) fallbackLimitArgs() []string { return nil }
+func (p *Process) fallbackLimits() []string    { return nil }
+func (p *Process) applyFallbackLimits()        {}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+// PoolConfig is a named resource pool (pools): a budget that the
+// services and jobs assigned to it share, and a queue for its jobs
+type PoolConfig struct {
+	MemoryMB   int64 `json:"memory_mb"`   // For all its members together
+	CPUPercent int   `json:"cpu_percent"` // For all its members together (100 = 1 CPU)
+
+	// The same as shares of the host: of its memory, and of the CPUs gosv
+	// may use. With memory_mb or cpu_percent too, the smaller limit holds.
+	HostMemoryPercent int `json:"host_memory_percent"`
+	HostCPUPercent    int `json:"host_cpu_percent"`
+
+	Concurrency int `json:"concurrency"` // `ctl run --pool` jobs running at once (default 1)
+	MaxQueued   int `json:"max_queued"`  // Jobs waiting at most (0: no limit)
+
+	// Evict members when the pool is under memory pressure (see
+	// pressure.go)
+	MemoryPressure *PressureConfig `json:"memory_pressure"`
+
+	// Budgets by limit profile, in place of memory_mb and cpu_percent
+	// (and their host shares) while the profile is in effect (see
+	// profiles.go)
+	ProfileLimits map[string]ProfileLimits `json:"profile_limits"`
+}
+
+func (c PoolConfig) validate(name string) error {
+	if name == "" || name[0] == '.' || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("pools: bad pool name %q", name)
+	}
+	if c.Concurrency < 0 || c.MaxQueued < 0 || c.MemoryMB < 0 || c.CPUPercent < 0 {
+		return fmt.Errorf("pools: %s: concurrency, max_queued, memory_mb and cpu_percent must not be negative", name)
+	}
+	if c.HostMemoryPercent < 0 || c.HostMemoryPercent > 100 || c.HostCPUPercent < 0 || c.HostCPUPercent > 100 {
+		return fmt.Errorf("pools: %s: host_memory_percent and host_cpu_percent must be between 0 and 100", name)
+	}
+	if c.MemoryPressure != nil {
+		if err := c.MemoryPressure.validate(); err != nil {
+			return fmt.Errorf("pools: %s: %w", name, err)
+		}
+		if c.MemoryPressure.AvailablePercent > 0 && c.MemoryMB == 0 && c.HostMemoryPercent == 0 {
+			return fmt.Errorf("pools: %s: memory_pressure.available_percent needs a memory budget", name)
+		}
+	}
+	return nil
+}
+
+// budget returns the pool's memory (bytes) and CPU (percent) limits, 0
+// for none
+func (c PoolConfig) budget(name string) (int64, int) {
+	memory, cpu := c.MemoryMB*1024*1024, c.CPUPercent
+	if c.HostMemoryPercent > 0 {
+		if total, err := meminfo("MemTotal"); err != nil {
+			logWarn("pool %s: host_memory_percent not applied: %v", name, err)
+		} else if share := total / 100 * int64(c.HostMemoryPercent); memory == 0 || share < memory {
+			memory = share
+		}
+	}
+	if c.HostCPUPercent > 0 {
+		if share := runtime.NumCPU() * c.HostCPUPercent; cpu == 0 || share < cpu {
+			cpu = share
+		}
+	}
+	return memory, cpu
+}
+
+// profileBudget returns the pool's budget while profile is in effect
+// ("" for none)
+func (c PoolConfig) profileBudget(name, profile string) (int64, int) {
+	if l, ok := c.ProfileLimits[profile]; ok {
+		if l.MemoryMB > 0 {
+			c.MemoryMB, c.HostMemoryPercent = l.MemoryMB, 0
+		}
+		if l.CPUPercent > 0 {
+			c.CPUPercent, c.HostCPUPercent = l.CPUPercent, 0
+		}
+	}
+	return c.budget(name)
+}
+
+// meminfo returns a field of /proc/meminfo in bytes, like "MemTotal"
+func meminfo(field string) (int64, error) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(line, field+":"); ok {
+			kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(rest), " kB"), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("/proc/meminfo: %w", err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("/proc/meminfo: no %s", field)
+}
+
+// resourcePool is the runtime side of a pool: its budget, the cgroup its
+// members share, and the queue of its jobs
+//
+// KEY CONCEPT: Resource pools
+// Per-service limits bound each service, not what they add up to: ten
+// batch workers at 2 GB each are 20 GB, and ten `ctl run` jobs started
+// by a crontab are ten times whatever one job takes. A pool is a parent
+// cgroup with a budget for all its members together - the services
+// assigned to it and the jobs run in it - the way systemd puts units in
+// a slice, or Kubernetes bounds a namespace with a ResourceQuota. The
+// kernel enforces memory.max and cpu.max of a cgroup over its whole
+// subtree, so the batch work as a whole never takes more than its share
+// of the host however many members it has, while each member's own
+// limits still apply below. Jobs also queue: at most concurrency of them
+// run at once, the rest wait their turn in order - the queue that a
+// crontab of `flock -n` lines doesn't have, where a job that finds the
+// lock taken is simply skipped.
+type resourcePool struct {
+	name string
+
+	mu          sync.Mutex
+	concurrency int
+	maxQueued   int
+	memory      int64 // Bytes, 0 for none
+	cpu         int   // Percent, 0 for none
+	running     int   // Jobs
+	queue       []*poolWaiter
+	cgroup      *Cgroup // Once a member started, if the pool has limits
+	config      PoolConfig
+	profile     string // The limit profile in effect
+}
+
+// poolWaiter is a job queued in a pool
+type poolWaiter struct {
+	p    *Process
+	done chan bool // true once admitted, false if canceled
+}
+
+// resourcePools are the configured pools, by name
+var resourcePools atomic.Pointer[map[string]*resourcePool]
+
+// poolNamed returns the pool called name (nil if there is none)
+func poolNamed(name string) *resourcePool {
+	if m := resourcePools.Load(); m != nil {
+		return (*m)[name]
+	}
+	return nil
+}
+
+// configure applies c to the pool, also to the members already running,
+// and starts queued jobs if there's room now
+func (pl *resourcePool) configure(c PoolConfig) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.concurrency, pl.maxQueued = max(c.Concurrency, 1), c.MaxQueued
+	pl.config = c
+	pl.memory, pl.cpu = c.profileBudget(pl.name, pl.profile)
+	if pl.cgroup != nil {
+		pl.writeLimits()
+	}
+	pl.admit()
+}
+
+// setProfile switches the pool to its budget for the limit profile
+// profile ("" for none)
+func (pl *resourcePool) setProfile(profile string) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.profile = profile
+	memory, cpu := pl.config.profileBudget(pl.name, profile)
+	if memory == pl.memory && cpu == pl.cpu {
+		return
+	}
+	pl.memory, pl.cpu = memory, cpu
+	if profile == "" {
+		logInfo("pool %s: budget back to %s as configured", pl.name, formatLimits(memory, cpu))
+	} else {
+		logInfo("pool %s: budget set to %s by limit profile %s", pl.name, formatLimits(memory, cpu), profile)
+	}
+	if pl.cgroup != nil {
+		pl.writeLimits()
+	}
+}
+
+// enqueue takes a slot of the pool for the job p, or queues it. It
+// returns the waiter to wait on and its position, or nil if p got a slot
+// right away.
+func (pl *resourcePool) enqueue(p *Process) (*poolWaiter, int, error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.running < pl.concurrency && len(pl.queue) == 0 {
+		pl.running++
+		return nil, 0, nil
+	}
+	if pl.maxQueued > 0 && len(pl.queue) >= pl.maxQueued {
+		return nil, 0, fmt.Errorf("run: pool %s is full (%d jobs queued)", pl.name, len(pl.queue))
+	}
+	w := &poolWaiter{p: p, done: make(chan bool, 1)}
+	pl.queue = append(pl.queue, w)
+	return w, len(pl.queue), nil
+}
+
+// cancel takes the job p out of the queue. It reports false if p isn't
+// queued, having got its slot already (or never having asked for one).
+func (pl *resourcePool) cancel(p *Process) bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	for i, w := range pl.queue {
+		if w.p == p {
+			pl.queue = append(pl.queue[:i:i], pl.queue[i+1:]...)
+			w.done <- false
+			return true
+		}
+	}
+	return false
+}
+
+// release frees the slot of a job that ended, for the next one queued
+func (pl *resourcePool) release() {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.running--
+	pl.admit()
+}
+
+// admit hands free slots to queued jobs, in order. pl.mu must be held.
+func (pl *resourcePool) admit() {
+	for len(pl.queue) > 0 && pl.running < pl.concurrency {
+		w := pl.queue[0]
+		pl.queue = pl.queue[1:]
+		pl.running++
+		w.done <- true
+	}
+}
+
+// position returns the place of the job p in the queue (1 = next), or 0
+// if it isn't queued
+func (pl *resourcePool) position(p *Process) int {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	for i, w := range pl.queue {
+		if w.p == p {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// limited reports whether the pool has a budget
+func (pl *resourcePool) limited() bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.memory > 0 || pl.cpu > 0 || pl.scheduled()
+}
+
+// scheduled reports whether the pool has a budget in some limit profile,
+// so its members share a cgroup even while it has none. pl.mu must be
+// held.
+func (pl *resourcePool) scheduled() bool {
+	for _, l := range pl.config.ProfileLimits {
+		if l.MemoryMB > 0 || l.CPUPercent > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// cgroupName returns the cgroup the pool's members go below, relative
+// to the cgroup base, making it on first use, or "" if they don't share
+// one: the pool has no budget, or no cgroup could be made
+func (pl *resourcePool) cgroupName() string {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.ensureCgroup()
+	if pl.cgroup == nil {
+		return ""
+	}
+	return pl.cgroup.name
+}
+
+// ensureCgroup makes the pool's cgroup, if it has limits and there is
+// none yet. It's kept while gosv runs, like the services' cgroups.
+// pl.mu must be held.
+func (pl *resourcePool) ensureCgroup() {
+	if pl.cgroup != nil || (pl.memory == 0 && pl.cpu == 0 && !pl.scheduled()) || !cgroupsSupported || baseCgroupPath == "" {
+		return
+	}
+	cg, err := NewCgroup(pl.name + ".pool")
+	if err != nil {
+		logWarn("pool %s: limits not enforced: %v", pl.name, err)
+		return
+	}
+	// The members' cgroups are children of this one, and can only use the
+	// controllers it enables for them
+	control := filepath.Join(cg.path, "cgroup.subtree_control")
+	if err := os.WriteFile(control, []byte("+cpu +memory +pids"), 0644); err != nil {
+		logDebug("pool %s: could not enable all controllers: %v", pl.name, err)
+	}
+	// cpuset on its own, as at the base: members pinned with cpus need it,
+	// and it may not be there
+	if !controllerMissing("cpuset") {
+		if err := os.WriteFile(control, []byte("+cpuset"), 0644); err != nil {
+			logWarn("pool %s: cpus of its members are only affinities: %v", pl.name, err)
+		}
+	}
+	pl.cgroup = cg
+	pl.writeLimits()
+}
+
+// writeLimits writes the pool's limits to its cgroup. pl.mu must be held.
+func (pl *resourcePool) writeLimits() {
+	mem, cpu := "max", "max 100000"
+	if pl.memory > 0 {
+		mem = strconv.FormatInt(pl.memory, 10)
+	}
+	if pl.cpu > 0 {
+		cpu = fmt.Sprintf("%d 100000", pl.cpu*1000)
+	}
+	for _, f := range []struct{ file, value, controller string }{{"memory.max", mem, "memory"}, {"cpu.max", cpu, "cpu"}} {
+		if controllerMissing(f.controller) {
+			logWarn("%s of pool %s is not enforced: no %s controller", f.file, pl.name, f.controller)
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(pl.cgroup.path, f.file), []byte(f.value), 0644); err != nil {
+			logWarn("failed to set %s of pool %s: %v", f.file, pl.name, err)
+		}
+	}
+}
+
+// setPools configures the pools. Jobs queued in or running in a pool the
+// config doesn't have anymore still run, with its old settings; services
+// assigned to it are restarted by the reload, as their config changed.
+func setPools(cfgs map[string]PoolConfig) {
+	var old map[string]*resourcePool
+	if m := resourcePools.Load(); m != nil {
+		old = *m
+	}
+	pools := make(map[string]*resourcePool, len(cfgs))
+	for name, c := range cfgs {
+		pl := old[name]
+		if pl == nil {
+			pl = &resourcePool{name: name}
+		}
+		pl.configure(c)
+		pools[name] = pl
+	}
+	resourcePools.Store(&pools)
+	for name, pl := range old {
+		if pools[name] != nil {
+			continue
+		}
+		pl.mu.Lock()
+		if pl.cgroup != nil && pl.cgroup.Destroy() == nil {
+			pl.cgroup = nil // Else left for the members still in it
+		}
+		pl.mu.Unlock()
+	}
+}
+
+// waitForPool waits for the job p's turn in its pool, telling the client
+// where it is in the queue. It reports false if the job won't run: it
+// was stopped, its caller hung up, or gosv is stopping.
+func (s *Supervisor) waitForPool(enc *json.Encoder, p *Process, hungUp <-chan struct{}) bool {
+	pl := p.job.pool
+	w, pos, err := pl.enqueue(p)
+	if err != nil {
+		enc.Encode(ctlReply{Error: err.Error()})
+		return false
+	}
+	if w != nil {
+		pl.mu.Lock()
+		running := pl.running
+		pl.mu.Unlock()
+		logInfo("job %s queued in pool %s at position %d", p.Name, pl.name, pos)
+		enc.Encode(ctlReply{Output: fmt.Sprintf("queued in pool %s at position %d (%d running)", pl.name, pos, running)})
+		select {
+		case admitted := <-w.done:
+			if !admitted {
+				enc.Encode(ctlReply{Error: "run: job stopped while queued"})
+				return false
+			}
+		case <-hungUp:
+			if !pl.cancel(p) {
+				pl.release() // Admitted just now
+			}
+			logInfo("job %s left pool %s: its caller hung up", p.Name, pl.name)
+			return false
+		case <-s.stopped:
+			pl.cancel(p)
+			return false
+		}
+	}
+	p.mu.Lock()
+	p.job.slot = true // removeJob releases it
+	p.mu.Unlock()
+	if !s.mayStart(p) {
+		enc.Encode(ctlReply{Error: "run: job stopped while queued"})
+		return false
+	}
+	return true
+}
+
+// poolsTable lists the pools, like:
+//
+//	POOL   SERVICES  JOBS  QUEUED  MEMORY             CPU
+//	batch  4         2/2   3       1.2 GiB / 4.0 GiB  200%
+func (s *Supervisor) poolsTable() string {
+	var pools []*resourcePool
+	if m := resourcePools.Load(); m != nil {
+		for _, pl := range *m {
+			pools = append(pools, pl)
+		}
+	}
+	if len(pools) == 0 {
+		return "no pools configured (see pools)\n"
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].name < pools[j].name })
+	services := make(map[string]int)
+	for _, p := range s.snapshot() {
+		if p.Pool != "" && p.job == nil {
+			services[p.Pool]++
+		}
+	}
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POOL\tSERVICES\tJOBS\tQUEUED\tMEMORY\tCPU")
+	for _, pl := range pools {
+		pl.mu.Lock()
+		mem, cpu := "-", "-"
+		if pl.memory > 0 {
+			mem = formatBytes(pl.memory)
+			if pl.cgroup != nil {
+				if used, err := pl.cgroup.GetMemoryUsage(); err == nil {
+					mem = formatBytes(used) + " / " + mem
+				}
+			}
+		}
+		if pl.cpu > 0 {
+			cpu = fmt.Sprintf("%d%%", pl.cpu)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d/%d\t%d\t%s\t%s\n", pl.name, services[pl.name], pl.running, pl.concurrency, len(pl.queue), mem, cpu)
+		pl.mu.Unlock()
+	}
+	w.Flush()
+	if profiles := s.describeProfiles(); profiles != "" {
+		b.WriteString(profiles + "\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// PortMapping forwards a host address to a port on the loopback of a
+// service with private_network
+type PortMapping struct {
+	Listen string `json:"listen"` // Host address, e.g. ":8080" or "127.0.0.1:8080"
+	Port   int    `json:"port"`   // The service's port (default: the listen port)
+}
+
+// validate checks a port mapping from the config and fills in defaults
+func (m *PortMapping) validate() error {
+	_, port, err := net.SplitHostPort(m.Listen)
+	if err != nil {
+		return fmt.Errorf("ports: listen %q: %w", m.Listen, err)
+	}
+	hostPort, err := strconv.Atoi(port)
+	if err != nil || hostPort < 1 || hostPort > 65535 {
+		return fmt.Errorf("ports: listen %q: invalid port", m.Listen)
+	}
+	if m.Port == 0 {
+		m.Port = hostPort
+	}
+	if m.Port < 1 || m.Port > 65535 {
+		return fmt.Errorf("ports: invalid port %d", m.Port)
+	}
+	return nil
+}
+
+// String describes m for --dry-run
+func (m PortMapping) String() string {
+	return fmt.Sprintf("%s -> %d", m.Listen, m.Port)
+}
+
+// portProxy forwards the connections to a service's host ports into its
+// network namespace
+//
+// KEY CONCEPT: Publishing ports of a network namespace
+// A service in a network namespace of its own has a loopback interface
+// and nothing else: it can listen, but no one outside can reach it, and
+// it can't reach anyone - the isolation is the point. Container runtimes
+// connect the namespace with a veth pair, NAT and firewall rules, which
+// change the host's network config and need cleaning up. A proxy needs
+// none of that. gosv listens on the host, and for each connection makes
+// a socket inside the service's namespace: a thread that joins the
+// namespace with setns(2) creates it, and a socket stays in the
+// namespace it was created in. Connected to the service's loopback, it
+// is spliced to the host connection, like docker-proxy does for
+// published ports. The listeners stay open while the service restarts,
+// so no other program can take its ports; connections that arrive while
+// it is down are closed.
+type portProxy struct {
+	mu        sync.Mutex
+	service   string
+	listeners []net.Listener
+	netns     *os.File // The service's network namespace; nil while it's down
+}
+
+// openPorts starts listening on p's host ports, the first time p starts.
+// Caller must hold p.mu.
+func (p *Process) openPorts() error {
+	if len(p.Ports) == 0 || p.ports != nil {
+		return nil
+	}
+	pp := &portProxy{service: p.Name}
+	for _, m := range p.Ports {
+		ln, err := net.Listen("tcp", m.Listen)
+		if err != nil {
+			pp.close()
+			return fmt.Errorf("ports: %w", err)
+		}
+		pp.listeners = append(pp.listeners, ln)
+		go pp.serve(ln, m.Port)
+	}
+	p.ports = pp
+	return nil
+}
+
+// closePorts stops listening on p's host ports
+func (p *Process) closePorts() {
+	p.mu.Lock()
+	pp := p.ports
+	p.ports = nil
+	p.mu.Unlock()
+	pp.close()
+}
+
+// attach forwards connections into the network namespace of pid
+func (pp *portProxy) attach(pid int) {
+	if pp == nil {
+		return
+	}
+	netns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		logWarn("ports of %s: %v", pp.service, err)
+	}
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.netns != nil {
+		pp.netns.Close()
+	}
+	pp.netns = netns
+}
+
+// detach closes the connections that arrive from now on, until the next
+// attach. Called when the service exits.
+func (pp *portProxy) detach() {
+	if pp == nil {
+		return
+	}
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.netns != nil {
+		pp.netns.Close()
+		pp.netns = nil
+	}
+}
+
+func (pp *portProxy) close() {
+	if pp == nil {
+		return
+	}
+	for _, ln := range pp.listeners {
+		ln.Close()
+	}
+	pp.detach()
+}
+
+// serve forwards the connections ln accepts to port in the service
+func (pp *portProxy) serve(ln net.Listener, port int) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // Closed
+		}
+		go pp.forward(conn, port)
+	}
+}
+
+// forward connects conn to port on the service's loopback, and copies
+// between them until both sides are done
+func (pp *portProxy) forward(conn net.Conn, port int) {
+	defer conn.Close()
+	pp.mu.Lock()
+	var upstream net.Conn
+	err := fmt.Errorf("%s is not running", pp.service)
+	if pp.netns != nil {
+		upstream, err = dialInNamespace(pp.netns, port)
+	}
+	pp.mu.Unlock()
+	if err != nil {
+		logDebug("ports of %s: %s: %v", pp.service, conn.RemoteAddr(), err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{})
+	go func() {
+		splice(upstream, conn)
+		close(done)
+	}()
+	splice(conn, upstream)
+	<-done
+}
+
+// splice copies from src to dst, then closes dst for writing so the
+// other side sees the end of the stream
+func splice(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
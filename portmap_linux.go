@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// newNetworkNamespace makes a start with attr create a network namespace
+// of its own; the exec helper brings its loopback up
+func newNetworkNamespace(attr *syscall.SysProcAttr) {
+	attr.Cloneflags |= syscall.CLONE_NEWNET
+}
+
+// ifreqFlags is struct ifreq for SIOCGIFFLAGS and SIOCSIFFLAGS, padded to
+// the size of the union on 64-bit systems
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// bringUpLoopback sets lo up, as `ip link set lo up` does. In a new
+// network namespace it starts down, and 127.0.0.1 with it.
+func bringUpLoopback() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifr ifreqFlags
+	copy(ifr.name[:], "lo")
+	for _, req := range []uintptr{syscall.SIOCGIFFLAGS, syscall.SIOCSIFFLAGS} {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+			return fmt.Errorf("lo: %w", errno)
+		}
+		ifr.flags |= syscall.IFF_UP
+	}
+	return nil
+}
+
+// dialInNamespace connects to port on the loopback of the network
+// namespace netns. The socket is created on a thread that joined the
+// namespace, and connected once the thread is back in gosv's.
+func dialInNamespace(netns *os.File, port int) (net.Conn, error) {
+	if sysSetns == 0 {
+		return nil, syscall.ENOSYS
+	}
+	fd, err := socketInNamespace(netns)
+	if err != nil {
+		return nil, err
+	}
+	sa := &syscall.SockaddrInet4{Port: port, Addr: [4]byte{127, 0, 0, 1}}
+	if err := syscall.Connect(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("connect to port %d: %w", port, err)
+	}
+	f := os.NewFile(uintptr(fd), "ports")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// socketInNamespace creates a TCP socket in netns
+func socketInNamespace(netns *os.File) (int, error) {
+	runtime.LockOSThread()
+	own, err := syscall.Open("/proc/thread-self/ns/net", syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return 0, err
+	}
+	defer syscall.Close(own)
+	if _, _, errno := syscall.RawSyscall(sysSetns, netns.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+		runtime.UnlockOSThread()
+		return 0, fmt.Errorf("setns: %w", errno)
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if _, _, errno := syscall.RawSyscall(sysSetns, uintptr(own), syscall.CLONE_NEWNET, 0); errno != 0 {
+		// Still in the service's namespace: the thread must not run
+		// anything else, so it stays locked and exits with the goroutine
+		if err == nil {
+			syscall.Close(fd)
+		}
+		return 0, fmt.Errorf("setns back: %w", errno)
+	}
+	runtime.UnlockOSThread()
+	if err != nil {
+		return 0, fmt.Errorf("socket: %w", err)
+	}
+	return fd, nil
+}
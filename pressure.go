@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PressureCheckInterval is how often memory pressure is checked for
+// evictions: the span of the PSI average it reads, so each check sees
+// the effect of the last eviction
+const PressureCheckInterval = 10 * time.Second
+
+// DefaultPressureRecover is how long memory pressure must stay away
+// before an evicted service comes back, when recover_sec is not
+// configured
+const DefaultPressureRecover = time.Minute
+
+// Eviction actions (eviction_action)
+const (
+	EvictStop   = "stop"   // Stop the service, start it again later (default)
+	EvictFreeze = "freeze" // Freeze its cgroup, thaw it later
+)
+
+// PressureConfig says when services are evicted to relieve memory
+// pressure (memory_pressure, of the host or of a pool). Either threshold
+// triggers an eviction.
+type PressureConfig struct {
+	// Share of the last 10s in which some task stalled waiting for
+	// memory (the "some avg10" of PSI), in percent
+	PSIAvg10 float64 `json:"psi_avg10"`
+	// Memory left, in percent of the host's memory (MemAvailable) or of
+	// the pool's memory budget
+	AvailablePercent float64 `json:"available_percent"`
+	// How long pressure must stay away before an evicted service comes
+	// back (default 60)
+	RecoverSec int `json:"recover_sec"`
+}
+
+func (c *PressureConfig) validate() error {
+	if c.PSIAvg10 == 0 && c.AvailablePercent == 0 {
+		return fmt.Errorf("memory_pressure needs psi_avg10 or available_percent")
+	}
+	if c.PSIAvg10 < 0 || c.PSIAvg10 > 100 || c.AvailablePercent < 0 || c.AvailablePercent > 100 {
+		return fmt.Errorf("memory_pressure: psi_avg10 and available_percent must be between 0 and 100")
+	}
+	if c.RecoverSec < 0 {
+		return fmt.Errorf("memory_pressure: recover_sec must not be negative")
+	}
+	return nil
+}
+
+// recoverAfter returns how long pressure must stay away before an
+// evicted service comes back
+func (c *PressureConfig) recoverAfter() time.Duration {
+	if c.RecoverSec == 0 {
+		return DefaultPressureRecover
+	}
+	return time.Duration(c.RecoverSec) * time.Second
+}
+
+// describe says when c evicts, for the dry run
+func (c *PressureConfig) describe() string {
+	var when []string
+	if c.PSIAvg10 > 0 {
+		when = append(when, fmt.Sprintf("memory PSI reaches %g%%", c.PSIAvg10))
+	}
+	if c.AvailablePercent > 0 {
+		when = append(when, fmt.Sprintf("less than %g%% is available", c.AvailablePercent))
+	}
+	return fmt.Sprintf("evict when %s, bring back after %v without pressure", strings.Join(when, " or "), c.recoverAfter())
+}
+
+// pressureWatch watches the memory pressure of the host, or of one pool,
+// and what it evicted
+//
+// KEY CONCEPT: Eviction under memory pressure
+// When memory runs out, the kernel's OOM killer picks a victim by size,
+// not by importance: the database goes before the report generator
+// because it's bigger. Long before that, the host slows down - tasks
+// stall in reclaim, waiting for pages to be written out and read back -
+// and PSI (pressure stall information, /proc/pressure/memory and
+// memory.pressure of a cgroup) measures exactly that: the share of
+// recent time in which some task was stalled on memory. A supervisor
+// knows what the kernel doesn't, which services matter, so it can act
+// first: like the kubelet evicting BestEffort pods before Guaranteed ones,
+// it stops the least important service, waits for the pressure to show
+// the effect, and goes on only if it has to. Freezing (cgroup.freeze)
+// instead of stopping keeps a batch job's progress: a frozen cgroup uses
+// no CPU, and its memory becomes the first the kernel reclaims. Once
+// pressure has stayed away long enough, the services come back one by
+// one, the last evicted first.
+type pressureWatch struct {
+	pool      string // "" for the host
+	cfg       *PressureConfig
+	evicted   []*Process // In order of eviction
+	calmSince time.Time
+	stuck     bool // Under pressure with nothing left to evict (logged once)
+	failed    bool // Couldn't read the pressure (logged once)
+}
+
+// configurePressure sets up the memory pressure watches of the host and
+// of the pools. Services evicted by a watch the config doesn't have
+// anymore come back.
+func (s *Supervisor) configurePressure(host *PressureConfig, pools map[string]PoolConfig) {
+	watches := make(map[string]*pressureWatch)
+	if host != nil {
+		watches[""] = &pressureWatch{cfg: host}
+	}
+	for name, c := range pools {
+		if c.MemoryPressure != nil {
+			watches[name] = &pressureWatch{pool: name, cfg: c.MemoryPressure}
+		}
+	}
+	for key, w := range s.pressure {
+		if nw, ok := watches[key]; ok {
+			nw.evicted, nw.calmSince = w.evicted, w.calmSince
+			continue
+		}
+		for i := len(w.evicted) - 1; i >= 0; i-- {
+			s.readmit(w.evicted[i], "memory_pressure was removed")
+		}
+	}
+	s.pressure = watches
+}
+
+// checkPressure evicts a service for each watch under memory pressure,
+// or brings one back where pressure has stayed away long enough. It runs
+// in the main loop every PressureCheckInterval.
+func (s *Supervisor) checkPressure() {
+	keys := make([]string, 0, len(s.pressure))
+	for key := range s.pressure {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // The host first
+	now := s.clock.Now()
+	for _, key := range keys {
+		w := s.pressure[key]
+		why, err := w.pressed()
+		if err != nil {
+			if !w.failed {
+				logWarn("%s: memory pressure not watched: %v", w.where(), err)
+				w.failed = true
+			}
+			continue
+		}
+		w.failed = false
+		if why != "" {
+			w.calmSince = now
+			if p := s.evictionCandidate(w); p != nil {
+				s.evict(w, p, why)
+			} else if !w.stuck {
+				logWarn("%s: %s, and no service left to evict", w.where(), why)
+				w.stuck = true
+			}
+			continue
+		}
+		w.stuck = false
+		if len(w.evicted) > 0 && now.Sub(w.calmSince) >= w.cfg.recoverAfter() {
+			p := w.evicted[len(w.evicted)-1]
+			w.evicted = w.evicted[:len(w.evicted)-1]
+			w.calmSince = now // The next one waits for this one to settle
+			s.readmit(p, "memory pressure subsided")
+		}
+	}
+}
+
+// where names what w watches, for messages
+func (w *pressureWatch) where() string {
+	if w.pool == "" {
+		return "host"
+	}
+	return "pool " + w.pool
+}
+
+// pressed returns why w is under memory pressure, "" if it isn't
+func (w *pressureWatch) pressed() (string, error) {
+	psiFile := "/proc/pressure/memory"
+	var available float64 = -1 // Percent, -1 if not checked
+	if w.pool == "" {
+		if w.cfg.AvailablePercent > 0 {
+			total, err := meminfo("MemTotal")
+			if err != nil {
+				return "", err
+			}
+			free, err := meminfo("MemAvailable")
+			if err != nil {
+				return "", err
+			}
+			available = float64(free) * 100 / float64(total)
+		}
+	} else {
+		pl := poolNamed(w.pool)
+		if pl == nil {
+			return "", nil
+		}
+		pl.mu.Lock()
+		cg, budget := pl.cgroup, pl.memory
+		pl.mu.Unlock()
+		if cg == nil {
+			return "", nil // No member started yet
+		}
+		psiFile = filepath.Join(cg.path, "memory.pressure")
+		if w.cfg.AvailablePercent > 0 && budget > 0 {
+			used, err := cg.GetMemoryUsage()
+			if err != nil {
+				return "", err
+			}
+			available = float64(budget-used) * 100 / float64(budget)
+		}
+	}
+	if available >= 0 && available < w.cfg.AvailablePercent {
+		return fmt.Sprintf("%.1f%% of memory available", available), nil
+	}
+	if w.cfg.PSIAvg10 > 0 {
+		stall, err := readPSI(psiFile)
+		if err != nil {
+			return "", err
+		}
+		if stall >= w.cfg.PSIAvg10 {
+			return fmt.Sprintf("memory pressure at %.1f%%", stall), nil
+		}
+	}
+	return "", nil
+}
+
+// readPSI returns the "some avg10" of a PSI file: the share of the last
+// 10 seconds in which some task stalled, in percent. The file reads like
+//
+//	some avg10=1.53 avg60=0.87 avg300=0.21 total=1837421
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=402817
+func readPSI(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		if v, ok := strings.CutPrefix(fields[1], "avg10="); ok {
+			return strconv.ParseFloat(v, 64)
+		}
+	}
+	return 0, fmt.Errorf("%s: no some avg10", path)
+}
+
+// evictionCandidate returns the service w should evict next: the running
+// one with the lowest eviction_priority, the one using the most memory
+// of those; nil if there is none
+func (s *Supervisor) evictionCandidate(w *pressureWatch) *Process {
+	var best *Process
+	var bestPriority int
+	var bestMemory int64
+	for _, p := range s.snapshot() {
+		p.mu.Lock()
+		ok := p.EvictionPriority > 0 && p.job == nil && !p.isMain() && !p.evicted && !p.manualStop &&
+			p.state == StateRunning && (w.pool == "" || p.Pool == w.pool)
+		priority, pid, cg := p.EvictionPriority, p.pid, p.cgroup
+		p.mu.Unlock()
+		if !ok {
+			continue
+		}
+		var memory int64
+		if cg != nil {
+			memory, _ = cg.GetMemoryUsage()
+		} else if rss, err := readRSS(pid); err == nil {
+			memory = rss * 1024
+		}
+		if best == nil || priority < bestPriority || priority == bestPriority && memory > bestMemory {
+			best, bestPriority, bestMemory = p, priority, memory
+		}
+	}
+	return best
+}
+
+// evict stops or freezes p to relieve the memory pressure of w
+func (s *Supervisor) evict(w *pressureWatch, p *Process, why string) {
+	p.mu.Lock()
+	action, cg := p.EvictionAction, p.cgroup
+	if action == EvictFreeze && cg == nil {
+		logWarn("%s can't be frozen without a cgroup of its own, stopping it", p.Name)
+		action = EvictStop
+	}
+	p.evicted = true
+	p.cancelRestart()
+	if action == EvictFreeze {
+		if err := cg.Freeze(true); err != nil {
+			logWarn("failed to freeze %s: %v, stopping it", p.Name, err)
+			action = EvictStop
+		} else {
+			p.frozen = true
+		}
+	}
+	if action == EvictFreeze {
+		p.noteEvent(EventEvict, "frozen: %s (%s)", why, w.where())
+	} else {
+		p.noteEvent(EventEvict, "stopped: %s (%s)", why, w.where())
+	}
+	p.mu.Unlock()
+
+	w.evicted = append(w.evicted, p)
+	logWarn("%s: %s, evicting %s (eviction_priority %d, %s)", w.where(), why, p.Name, p.EvictionPriority, action)
+	if action == EvictStop {
+		// Not waited for: checkPressure runs in the main loop, which
+		// reaps the service once it's gone
+		s.stopInBackground([]*Process{p})
+	}
+}
+
+// readmit brings back p, evicted under memory pressure, unless it was
+// started or stopped on request since
+func (s *Supervisor) readmit(p *Process, why string) {
+	p.mu.Lock()
+	evicted, frozen, held, cg := p.evicted, p.frozen, p.manualStop, p.cgroup
+	p.evicted, p.frozen = false, false
+	if evicted {
+		p.noteEvent(EventReadmit, "back: %s", why)
+	}
+	p.mu.Unlock()
+	if !evicted {
+		return
+	}
+	logInfo("%s, bringing back %s", why, p.Name)
+	if frozen {
+		if err := cg.Freeze(false); err != nil {
+			logWarn("failed to thaw %s: %v", p.Name, err)
+		}
+		return
+	}
+	if !held {
+		s.RestartProcess(p)
+	}
+}
+
+// thaw unfreezes p if it was frozen under memory pressure, so it can be
+// stopped: a frozen process doesn't handle SIGTERM. It stays evicted, so
+// it isn't restarted.
+func (p *Process) thaw() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.frozen {
+		return
+	}
+	p.frozen = false
+	if p.cgroup != nil {
+		if err := p.cgroup.Freeze(false); err != nil {
+			logWarn("failed to thaw %s: %v", p.Name, err)
+		}
+	}
+}
+
+// Freeze freezes (or thaws) every process in the cgroup
+//
+// KEY CONCEPT: cgroup.freeze
+// Writing 1 to cgroup.freeze stops all tasks of the cgroup (and of the
+// cgroups below) in the kernel, where they can't run or be woken by
+// signals - SIGKILL aside - until 0 is written. Unlike SIGSTOP, which a
+// process sees and its parent is told about, the processes don't notice.
+func (c *Cgroup) Freeze(frozen bool) error {
+	value := "0"
+	if frozen {
+		value = "1"
+	}
+	return os.WriteFile(filepath.Join(c.path, "cgroup.freeze"), []byte(value), 0644)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// detachMounts stops mounts made in the exec helper's mount namespace
+// from propagating back to the host. It runs before any of them.
+//
+// KEY CONCEPT: Mount propagation
+// A new mount namespace starts as a copy of the parent's mounts, but on
+// systemd systems they are "shared": a mount made below a shared mount
+// shows up in every peer, including the host. Making our copy a slave
+// keeps receiving the host's mount events (a USB stick mounted later
+// still appears) while our own mounts stay private to the service.
+func detachMounts() error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_SLAVE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+	return nil
+}
+
+// mountPrivateTmp mounts an empty tmpfs on /tmp and /var/tmp
+//
+// Shared /tmp is a classic cross-service leak: predictable file names,
+// world-readable temp files, symlink races. With its own /tmp a service
+// only sees files it created, and they're gone when it exits (the mount
+// namespace, and the tmpfs with it, dies with the last process in it).
+func mountPrivateTmp() error {
+	for _, dir := range []string{"/tmp", "/var/tmp"} {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+		if err != nil {
+			return fmt.Errorf("mount tmpfs on %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// oPath is O_PATH from <fcntl.h>: an fd naming a file without opening it
+// for reading or writing (the syscall package lacks it)
+const oPath = 0x200000
+
+// privateDeviceNodes are the device nodes in a private /dev
+var privateDeviceNodes = []struct {
+	name         string
+	major, minor uint32
+}{
+	{"null", 1, 3},
+	{"zero", 1, 5},
+	{"full", 1, 7},
+	{"random", 1, 8},
+	{"urandom", 1, 9},
+	{"tty", 5, 0},
+}
+
+// mountPrivateDevices replaces /dev with a minimal one: the pseudo
+// devices every program expects, a private devpts and /dev/shm, but no
+// disks, no /dev/mem, no hardware
+func mountPrivateDevices() error {
+	// In a user namespace mknod() of devices is denied; the host's nodes
+	// are bind-mounted instead. They're hidden once the tmpfs is on /dev,
+	// so keep a handle on each first.
+	hostNodes := make(map[string]int)
+	for _, n := range privateDeviceNodes {
+		if fd, err := syscall.Open(filepath.Join("/dev", n.name), oPath|syscall.O_CLOEXEC, 0); err == nil {
+			hostNodes[n.name] = fd
+			defer syscall.Close(fd)
+		}
+	}
+
+	if err := syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=755"); err != nil {
+		return fmt.Errorf("mount tmpfs on /dev: %w", err)
+	}
+
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+	for _, n := range privateDeviceNodes {
+		path := filepath.Join("/dev", n.name)
+		dev := int(n.major<<8 | n.minor)
+		err := syscall.Mknod(path, syscall.S_IFCHR|0666, dev)
+		if err == syscall.EPERM {
+			if fd, ok := hostNodes[n.name]; ok {
+				err = bindNode(fd, path)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("create /dev/%s: %w", n.name, err)
+		}
+	}
+
+	for _, dir := range []string{"/dev/pts", "/dev/shm"} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+	}
+	// A new devpts instance: ptys opened here aren't visible outside, and
+	// outside ptys (including one passed as stdio) aren't visible here
+	if err := syscall.Mount("devpts", "/dev/pts", "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC,
+		"newinstance,ptmxmode=0666,mode=0620"); err != nil {
+		return fmt.Errorf("mount devpts: %w", err)
+	}
+	if err := syscall.Mount("tmpfs", "/dev/shm", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mount tmpfs on /dev/shm: %w", err)
+	}
+
+	links := map[string]string{
+		"ptmx":   "pts/ptmx",
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join("/dev", name)); err != nil {
+			return err
+		}
+	}
+
+	// Like a read-only bind: nothing can add device nodes later
+	return syscall.Mount("", "/dev", "", syscall.MS_REMOUNT|syscall.MS_NOSUID|syscall.MS_NOEXEC|syscall.MS_RDONLY, "")
+}
+
+// bindNode bind-mounts the file open as fd (an O_PATH handle) on path
+func bindNode(fd int, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	// /proc/self/fd/N resolves to the file itself, even if its path is
+	// no longer reachable
+	return syscall.Mount(fmt.Sprintf("/proc/self/fd/%d", fd), path, "", syscall.MS_BIND, "")
+}
+
+// newMountNamespace makes a start with attr create a mount namespace of
+// its own, for the exec helper to mount in
+func newMountNamespace(attr *syscall.SysProcAttr) {
+	attr.Cloneflags |= syscall.CLONE_NEWNS
+}
@@ -123,6 +123,16 @@ func (p *ProcInfo) readStatus(procPath string) error {
 	return nil
 }
 
+// readRSS returns just the resident set size (KB) of a process.
+// Cheaper than ReadProcInfo when we only need memory for periodic sampling.
+func readRSS(pid int) (int64, error) {
+	info := &ProcInfo{PID: pid}
+	if err := info.readStatus(fmt.Sprintf("/proc/%d", pid)); err != nil {
+		return 0, err
+	}
+	return info.VmRSS, nil
+}
+
 // readFDs reads /proc/[pid]/fd/*
 func readFDs(procPath string) []FDInfo {
 	fdPath := filepath.Join(procPath, "fd")
@@ -240,12 +250,11 @@ func (s *Supervisor) Introspect() {
 			continue
 		}
 
-		fmt.Printf("\n=== Process: %s ===\n", p.Name)
 		info, err := ReadProcInfo(p.pid)
 		if err != nil {
-			fmt.Printf("Error reading proc info: %v\n", err)
+			logWarn("%s: reading proc info: %v", p.Name, err)
 			continue
 		}
-		fmt.Println(info.String())
+		logInfo("=== Process: %s ===\n%s", p.Name, info.String())
 	}
 }
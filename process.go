@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -17,10 +19,12 @@ const (
 	StateStarting
 	StateRunning
 	StateFailed
+	StateWaiting // Path-activated, waiting for work (see activate.go)
+	StateSkipped // A start condition wasn't met (see conditions.go)
 )
 
 func (s ProcessState) String() string {
-	return [...]string{"stopped", "starting", "running", "failed"}[s]
+	return [...]string{"stopped", "starting", "running", "failed", "waiting", "skipped"}[s]
 }
 
 // Process represents a supervised process
@@ -29,39 +33,516 @@ type Process struct {
 	Command string
 	Args    []string
 
+	// Spawner builds the command to run (nil = ExecSpawner)
+	Spawner Spawner
+
+	// Forking services daemonize: the process started exits, and the
+	// daemon's pid is read from PIDFile (see forking.go)
+	Forking        bool
+	PIDFile        string
+	daemonizing    bool
+	daemonDeadline time.Time
+
+	// Adopt makes the first start take over the process PIDFile names,
+	// if it runs, instead of starting one (see adopt.go)
+	Adopt      bool
+	adoptTried bool
+	adopted    bool // The process running is one gosv adopted
+	// watchedExit reports the exit of a process gosv watched but can't
+	// wait for (set by Supervisor.AddProcess)
+	watchedExit func(pid int)
+
 	// Runtime state
 	cmd        *exec.Cmd
 	pid        int
+	pgid       int // The process group signals go to
 	state      ProcessState
 	exitCode   int
 	startTime  time.Time
 	lastUptime time.Duration // How long process ran before last exit
 	restarts   int
 
+	// pendingRestart is set by Supervisor.RestartProcess
+	pendingRestart bool
+
+	// manualStop is set by Supervisor.Stop: the process stays down until
+	// Supervisor.Start (see groups.go)
+	manualStop bool
+
+	// Groups the process belongs to, selected as "@group"
+	Groups []string
+
+	// ReplicaOf names the service the process is a replica of, which
+	// selects it along with the other replicas (see replicas.go)
+	ReplicaOf string
+
+	// Labels are free-form metadata, matched by selectors (see selector.go)
+	Labels map[string]string
+
+	// Conditions are checked before each start; if one isn't met the
+	// process is skipped (see conditions.go)
+	Conditions *Conditions
+	skipReason string
+
+	// StartDelay postpones the first start (see delay.go); delayedUntil
+	// is when a delayed start is due
+	StartDelay   time.Duration
+	delayedUntil time.Time
+
+	// WaitFor targets must answer before each start, within WaitTimeout
+	// (see waitfor.go); waitingFor is the one being probed
+	WaitFor     []WaitTarget
+	WaitTimeout time.Duration
+	waitingFor  string
+
+	// ReadyCheck is probed after each start until it answers, within
+	// ReadyTimeout; after ReadyFailures runs in a row that didn't, the
+	// process is failing readiness (see readiness.go). unready counts
+	// those runs.
+	ReadyCheck    *WaitTarget
+	ReadyTimeout  time.Duration
+	ReadyFailures int
+	unready       int
+
+	// PartOf: stopping, starting or restarting one of these services on
+	// request does the same to this one. BindsTo: this process is stopped
+	// whenever one of these exits, and started again once all of them
+	// run (boundDown meanwhile; see relations.go).
+	PartOf    []string
+	BindsTo   []string
+	boundDown bool
+
+	// After: at boot, this process is started after these services (see
+	// bootOrder)
+	After []string
+
 	// Restart policy
 	MaxRestarts   int
+	Restart       string // Which exits restart it (see wantsRestart)
 	RestartDelay  time.Duration
 	BackoffFactor float64
 
+	// TTY runs the process under a pseudo-terminal instead of plain pipes
+	TTY bool
+
+	// Foreground gives the process our stdio and terminal. It is never
+	// restarted; when it exits gosv shuts down with its exit code.
+	Foreground bool
+
+	// Main is never restarted either; when it exits gosv shuts down and
+	// exits with its exit code (128+N if killed by signal N), like a
+	// foreground service that leaves the terminal alone
+	Main bool
+
+	// StdinFile is opened read-only as the process's stdin on every start.
+	// Empty means /dev/null.
+	StdinFile string
+
+	// Attachable gives the process a pipe as stdin, which `gosv ctl
+	// attach` writes to (see attach.go)
+	Attachable bool
+
+	// Critical shuts gosv down (exiting non-zero) when the process fails
+	// for good
+	Critical bool
+
+	// KillMode is what a stop signals: KillProcessGroup (default),
+	// KillProcess, KillControlGroup, KillMixed or KillNone (see killmode.go)
+	KillMode string
+
+	// DelegateCgroup starts the process in its own cgroup namespace,
+	// rooted at its cgroup, which it may manage (see delegate.go)
+	DelegateCgroup bool
+
+	// PrivateTmp and PrivateDevices give the process its own /tmp and
+	// /var/tmp, and a minimal /dev, in a mount namespace (see private.go)
+	PrivateTmp     bool
+	PrivateDevices bool
+
+	// Mounts are set up in the process's mount namespace, in order, after
+	// the private /tmp and /dev (see mounts.go)
+	Mounts []Mount
+
+	// DNS overrides the resolver config and /etc/hosts the process sees,
+	// with bind mounts after its own (see dns.go)
+	DNS *DNSConfig
+
+	// PrivateNetwork starts the process in a network namespace with only
+	// loopback; Ports forwards host addresses into it (see portmap.go)
+	PrivateNetwork bool
+	Ports          []PortMapping
+	ports          *portProxy
+
+	// Sockets gosv listens on and passes to the process (see sockets.go);
+	// with RestartMode handoff, a restart starts a new instance on them
+	// before it stops the old one (see handoff.go)
+	Sockets     []string
+	sockets     []*os.File
+	RestartMode string
+	handoff     *handoff
+
+	// UserNS runs the process as root in a user namespace of its own
+	// (see userns.go)
+	UserNS *UserNS
+
+	// RunAs is the user the process runs as (nil: gosv's own, see runas.go)
+	RunAs *RunAs
+
+	// AppArmorProfile and SELinuxLabel are the MAC labels the process
+	// runs under (see labels.go)
+	AppArmorProfile string
+	SELinuxLabel    string
+
+	// Sched sets the CPU scheduling policy and I/O priority after each
+	// start (nil: inherit gosv's)
+	Sched *Sched
+
+	// Maintenance windows: crash restarts only happen inside
+	// RestartWindows (if any); PlannedRestart ("HH:MM") restarts the
+	// process every day at that time
+	RestartWindows  []timeWindow
+	PlannedRestart  string
+	restartDeferred bool
+
+	// A restart scheduled for restartAt (see pending.go); restartSeq
+	// tells a canceled timer that fires anyway from the current one
+	restartTimer Timer
+	restartAt    time.Time
+	restartSeq   int
+
+	// Watch lists files/directories whose changes restart the process
+	Watch         []string
+	WatchDebounce time.Duration
+
+	// ActivatePaths delays starting the process until one of the paths has
+	// content; StopWhenEmpty stops it again once they're empty
+	ActivatePaths []string
+	StopWhenEmpty bool
+	deactivating  bool
+
+	// Shutdown ordering: lower priorities are stopped first, and each
+	// stage waits up to the longest StopTimeout before SIGKILL
+	ShutdownPriority int
+	StopTimeout      time.Duration
+
+	// Drain: signal sent before shutdown so the service stops taking new
+	// work, and how long to wait for it to exit on its own (0 = no drain)
+	DrainSignal  syscall.Signal
+	DrainTimeout time.Duration
+
+	// Credentials maps credential IDs to sources (a file path, or
+	// "env:NAME"), copied into $CREDENTIALS_DIRECTORY (see credentials.go)
+	Credentials map[string]string
+	credMounted bool
+
+	// ClearEnv starts the process from an empty environment, plus the
+	// variables of gosv's matching a PassEnv pattern (see env.go)
+	ClearEnv bool
+	PassEnv  []string
+
+	// Env is set for the process, over what it inherits
+	Env map[string]string
+
+	// EnvDefaults are the values of PATH, TZ, LANG and HOME when the
+	// environment has none (see env.go)
+	EnvDefaults map[string]string
+
+	// Lock makes the process a singleton across gosv instances: it only
+	// runs while this instance holds the lock (see singleton.go)
+	Lock   *LeaderLock
+	leader bool
+
 	// Resource limits (cgroup)
 	MemoryLimit int64 // bytes
 	CPUQuota    int   // percentage (100 = 1 core)
 
+	// Pool is the pool whose budget the process shares: its cgroup goes
+	// below the pool's (see pools.go)
+	Pool string
+
+	// Under memory pressure, processes with an EvictionPriority are
+	// evicted (EvictStop or EvictFreeze), lowest priority first (see
+	// pressure.go)
+	EvictionPriority int
+	EvictionAction   string
+	evicted          bool
+	frozen           bool
+
+	// override is set while `ctl set-limit` or `ctl restore` has changed
+	// MemoryLimit or CPUQuota from the config (see livelimits.go)
+	override *limitOverride
+
+	// ProfileLimits replace MemoryLimit and CPUQuota while a limit
+	// profile is in effect; configMemory and configCPU are the limits
+	// without one, and profile is the one applied (see profiles.go)
+	ProfileLimits map[string]ProfileLimits
+	configMemory  int64
+	configCPU     int
+	profile       string
+
+	// job is set for a one-off job of `ctl run` (see jobs.go)
+	job *job
+
+	// HugeTLBLimits caps explicit huge pages, in bytes per page size
+	// ("2MB", "1GB")
+	HugeTLBLimits map[string]int64
+
+	// GPUs are the only NVIDIA GPUs the service may open (see gpu.go)
+	GPUs []int
+	// EgressMbit limits what the service sends, in Mbit/s (see shaping.go)
+	EgressMbit int
+	// CPUs and IsolateFrom are as configured; cpuList is the CPUs they
+	// resolved to when the config loaded (see cpuset.go)
+	CPUs        string
+	IsolateFrom []int
+	cpuList     []int
+	// Placement is as configured; memNodes is the NUMA node it placed
+	// the service on (see numa.go)
+	Placement string
+	memNodes  []int
+
+	// Memory leak heuristic (0 LeakRate disables)
+	LeakRate     int64         // KB/min of sustained RSS growth
+	LeakDuration time.Duration // How long growth must be sustained
+	LeakAction   string        // "log" or "restart"
+
+	// RSS samples for leak detection (see leak.go)
+	rssSamples []rssSample
+	leakPid    int
+
+	// TCP traffic and connections, with network_accounting (see
+	// netacct.go; nil until sampled)
+	net *netStats
+
 	// Cgroup for this process (nil if cgroups unavailable)
 	cgroup *Cgroup
 
+	// memory.peak of the cgroup, reset at start (see usage.go)
+	peakFile *os.File
+
+	// Hooks for lifecycle events of this process (optional)
+	Hooks *Hooks
+
+	// HealthURL answers 200 once the service is ready (optional; see
+	// discovery.go and boot.go)
+	HealthURL string
+
+	// clock, globalHooks, onStarted, mayStart and pids are set by
+	// Supervisor.AddProcess
+	clock       Clock
+	globalHooks **Hooks
+	onStarted   func(*Process)
+	mayStart    func(*Process) bool
+	pids        *pidIndex
+
+	// exhausted is set once OnRestartExhausted has fired
+	exhausted bool
+
+	// shell is set if Command and Args run a command line through
+	// /bin/sh (see shellCommand)
+	shell bool
+
+	// configHash identifies the config the process was built from, so a
+	// reload can tell changed services from unchanged ones; removed is set
+	// while a reload stops the process for good
+	configHash string
+	removed    bool
+
+	// startErr is the error of the last Start (nil on success)
+	startErr error
+
+	// DiagnosticsDir receives a diagnostics bundle when the process fails
+	// for good (see diagnostics.go); the rest is collected for it
+	DiagnosticsDir string
+	output         *lineRing
+	recentEvents   []string
+	lastInfo       *ProcInfo
+	lastInfoAt     time.Time
+	lastCore       string
+
+	// Captured output: LogBuffer lines may wait for the console, and
+	// LogOverflow says what happens when they can't (see logpipe.go)
+	LogBuffer   int
+	LogOverflow string
+	logs        *logPipeline
+
+	// LogTimestamp is the format of the timestamp before each captured
+	// line, in LogTimezone (nil for local time)
+	LogTimestamp string
+	LogTimezone  *time.Location
+
+	// Where escape sequences are stripped from captured lines and
+	// carriage-return rewrites squashed (see sanitize.go)
+	LogStripANSI string
+	LogSquashCR  string
+
+	// LogDedup collapses repeated lines, and LogRateLimit caps lines per
+	// second, with bursts of LogRateBurst (see logfilter.go)
+	LogDedup     bool
+	LogRateLimit int
+	LogRateBurst int
+
+	// LogSinks name the log sinks that get the output (see logsink.go)
+	LogSinks []string
+
+	// Stdout and Stderr override where each stream goes (see streams.go)
+	Stdout *LogStreamConfig
+	Stderr *LogStreamConfig
+
+	// Syslog tags the output for syslog and journald sinks (see syslog.go)
+	Syslog *SyslogConfig
+
+	// PTY master for TTY processes (nil otherwise)
+	pty *os.File
+
+	// The write end of an attachable process's stdin while it runs, and
+	// whether an operator is attached (see attach.go)
+	stdin    *os.File
+	attached bool
+
 	mu sync.Mutex
 }
 
 // Start spawns the process with proper isolation
 func (p *Process) Start() error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	if p.Conditions != nil {
+		if why := p.Conditions.check(); why != "" {
+			p.state, p.skipReason = StateSkipped, why
+			p.noteEvent(EventSkip, "skipped: %s", why)
+			p.mu.Unlock()
+			logInfo("skipping %s: %s", p.Name, why)
+			return nil
+		}
+		p.skipReason = ""
+	}
+	if len(p.WaitFor) > 0 {
+		// Probes can take a while - don't hold the lock meanwhile
+		p.mu.Unlock()
+		proceed, err := p.waitForDeps()
+		p.mu.Lock()
+		if !proceed {
+			p.mu.Unlock()
+			return nil
+		}
+		if err != nil {
+			p.state = StateFailed
+			p.startErr = &ErrStartFailed{Service: p.Name, Cause: err}
+			p.noteEvent(EventStartFailed, "start failed: %v", err)
+			p.mu.Unlock()
+			p.writeDiagnostics("start failed")
+			return p.startErr
+		}
+	}
+	err := p.start()
+	p.startErr = err
+	if err != nil {
+		p.noteEvent(EventStartFailed, "start failed: %v", err)
+	} else {
+		p.noteEvent(EventStart, "started (pid=%d)", p.pid)
+	}
+	ev := StartEvent{Name: p.Name, PID: p.pid, Restarts: p.restarts, Time: p.startTime, Labels: p.Labels}
+	p.mu.Unlock()
 
-	p.cmd = exec.Command(p.Command, p.Args...)
+	if err != nil {
+		p.writeDiagnostics("start failed")
+		return err
+	}
+	p.fireStart(ev)
+	if p.onStarted != nil {
+		p.onStarted(p)
+	}
+	if p.ReadyCheck != nil {
+		go p.watchReadiness(ev.Time)
+	}
+	return nil
+}
+
+// start does the work of Start. Caller must hold p.mu.
+func (p *Process) start() error {
+	if p.Adopt && !p.adoptTried {
+		p.adoptTried = true
+		if p.adoptRunning() {
+			return nil
+		}
+	}
+
+	cmd, err := p.spawner().Command(p)
+	if err != nil {
+		p.state = StateFailed
+		return &ErrStartFailed{Service: p.Name, Cause: err}
+	}
+	p.cmd = cmd
 	p.cmd.Stdout = os.Stdout
 	p.cmd.Stderr = os.Stderr
 
+	// Captured output goes through a pipeline (see logpipe.go), which
+	// also keeps the recent output for diagnostics
+	var stdout io.Writer = os.Stdout
+	if p.capturesOutput() {
+		p.ensureLogs()
+		stdout = p.logs.writer("stdout")
+		p.cmd.Stdout = stdout
+		p.cmd.Stderr = p.logs.writer("stderr")
+	}
+	// A job's output goes through pipes of gosv's own (see jobs.go)
+	if p.job != nil {
+		if err := p.job.pipe(p.cmd, p.logs); err != nil {
+			p.state = StateFailed
+			return &ErrStartFailed{Service: p.Name, Cause: err}
+		}
+	}
+
+	// Stdin: a nil cmd.Stdin makes os/exec open /dev/null for the child,
+	// so a service never competes with us for the terminal by accident
+	if p.StdinFile != "" && !p.TTY {
+		f, err := os.Open(p.StdinFile)
+		if err != nil {
+			p.state = StateFailed
+			return &ErrStartFailed{Service: p.Name, Cause: fmt.Errorf("open stdin: %w", err)}
+		}
+		// The child gets its own dup of the fd; ours is not needed after start
+		defer f.Close()
+		p.cmd.Stdin = f
+	}
+	if p.Attachable && !p.TTY {
+		r, err := p.openStdin()
+		if err != nil {
+			p.state = StateFailed
+			return &ErrStartFailed{Service: p.Name, Cause: fmt.Errorf("stdin pipe: %w", err)}
+		}
+		defer r.Close()
+		p.cmd.Stdin = r
+	}
+
+	p.cmd.Env = p.environ()
+
+	// Secrets go in files; only their location goes in the environment
+	credDir, err := p.setupCredentials()
+	if err != nil {
+		p.state = StateFailed
+		return &ErrStartFailed{Service: p.Name, Cause: err}
+	}
+	if credDir != "" {
+		p.cmd.Env = append(p.cmd.Environ(), "CREDENTIALS_DIRECTORY="+credDir)
+	}
+	if len(p.GPUs) > 0 {
+		p.cmd.Env = append(p.cmd.Environ(), gpuEnv(p.GPUs)...)
+	}
+	if err := p.setupDNS(); err != nil {
+		p.state = StateFailed
+		return &ErrStartFailed{Service: p.Name, Cause: err}
+	}
+	if err := p.openPorts(); err != nil {
+		p.state = StateFailed
+		return &ErrStartFailed{Service: p.Name, Cause: err}
+	}
+	if err := p.openSockets(); err != nil {
+		p.state = StateFailed
+		return &ErrStartFailed{Service: p.Name, Cause: err}
+	}
+	p.passSockets()
+
 	// KEY CONCEPT: SysProcAttr controls how the kernel creates the child
 	p.cmd.SysProcAttr = &syscall.SysProcAttr{
 		// Setpgid: Create new process group with child as leader
@@ -77,59 +558,262 @@ func (p *Process) Start() error {
 		// of controlling terminal (we're a supervisor, not a shell)
 	}
 
+	if p.Foreground {
+		p.prepareForeground()
+	}
+
+	var slave *os.File
+	if p.TTY && !p.Foreground {
+		master, pts, err := openPTY()
+		if err != nil {
+			p.state = StateFailed
+			return &ErrStartFailed{Service: p.Name, Cause: fmt.Errorf("allocate pty: %w", err)}
+		}
+		slave = pts
+		copyWinsize(master, os.Stdin)
+		p.pty = master
+
+		p.cmd.Stdin = slave
+		p.cmd.Stdout = slave
+		p.cmd.Stderr = slave
+
+		// KEY CONCEPT: Controlling terminal
+		// A process can only acquire a controlling terminal if it is a
+		// session leader without one. So instead of Setpgid we create a
+		// new session (setsid also makes the child a process group leader,
+		// so kill(-pid) keeps working) and make the slave - fd 0 in the
+		// child - its controlling tty via TIOCSCTTY.
+		p.cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setsid:  true,
+			Setctty: true,
+			Ctty:    0,
+		}
+	}
+
+	cgroupDir, err := p.prepareExec()
+	if err != nil {
+		if slave != nil {
+			slave.Close()
+			p.pty.Close()
+			p.pty = nil
+		}
+		p.state = StateFailed
+		return &ErrStartFailed{Service: p.Name, Cause: err}
+	}
+	if cgroupDir != nil {
+		defer cgroupDir.Close()
+	}
+	if p.Forking {
+		if err := p.prepareDaemonize(); err != nil {
+			p.state = StateFailed
+			return &ErrStartFailed{Service: p.Name, Cause: err}
+		}
+	}
+
+	p.pids.holdReaping()
 	if err := p.cmd.Start(); err != nil {
+		p.pids.releaseReaping()
+		if slave != nil {
+			slave.Close()
+			p.pty.Close()
+			p.pty = nil
+		}
 		p.state = StateFailed
-		return fmt.Errorf("failed to start %s: %w", p.Name, err)
+		return &ErrStartFailed{Service: p.Name, Cause: err}
+	}
+
+	if slave != nil {
+		// The child has its own copy; ours would keep the master from
+		// ever seeing EIO when the child exits
+		slave.Close()
+		go copyPTYOutput(p.pty, stdout)
+	}
+	if p.job != nil {
+		p.job.closePipes()
 	}
 
 	p.pid = p.cmd.Process.Pid
+	p.pgid = p.pid
+	if p.pids != nil {
+		p.pids.add(p.pid, p)
+	}
+	p.pids.releaseReaping()
+	p.ports.attach(p.pid)
 	p.state = StateRunning
-	p.startTime = time.Now()
+	p.exhausted = false
+	p.startTime = p.now()
+	if p.Forking {
+		p.startDaemonize()
+	}
 
-	// Apply cgroup resource limits if configured
-	if p.MemoryLimit > 0 || p.CPUQuota > 0 {
-		cg, err := NewCgroup(p.Name)
+	// Apply cgroup resource limits if configured. Kill modes that signal
+	// the cgroup need one even without limits. A delegated cgroup is
+	// already set up: the child started in it.
+	if p.needsCgroup() && !p.DelegateCgroup {
+		cg, err := NewCgroup(p.cgroupName())
 		if err != nil {
-			fmt.Printf("[gosv] warning: failed to create cgroup for %s: %v\n", p.Name, err)
+			logWarn("failed to create cgroup for %s: %v", p.Name, err)
 		} else {
 			p.cgroup = cg
-			if p.MemoryLimit > 0 {
-				if err := cg.SetMemoryLimit(p.MemoryLimit); err != nil {
-					fmt.Printf("[gosv] warning: failed to set memory limit for %s: %v\n", p.Name, err)
-				}
-			}
-			if p.CPUQuota > 0 {
-				if err := cg.SetCPUQuota(p.CPUQuota); err != nil {
-					fmt.Printf("[gosv] warning: failed to set CPU quota for %s: %v\n", p.Name, err)
-				}
-			}
+			p.applyLimits(cg)
 			if err := cg.AddProcess(p.pid); err != nil {
-				fmt.Printf("[gosv] warning: failed to add %s to cgroup: %v\n", p.Name, err)
+				logWarn("failed to add %s to cgroup: %v", p.Name, err)
 			} else {
-				fmt.Printf("[gosv] applied cgroup limits to %s (mem=%dMB, cpu=%d%%)\n",
+				logInfo("applied cgroup limits to %s (mem=%dMB, cpu=%d%%)",
 					p.Name, p.MemoryLimit/(1024*1024), p.CPUQuota)
 			}
 		}
 	}
 
-	fmt.Printf("[gosv] started %s (pid=%d, pgid=%d)\n", p.Name, p.pid, p.pid)
+	p.applyFallbackLimits()
+
+	p.trackPeak()
+	resetOOMScoreAdj(p.pid)
+
+	if p.Sched != nil {
+		if err := p.Sched.apply(p.pid); err != nil {
+			logWarn("failed to set scheduling for %s: %v", p.Name, err)
+		}
+	}
+
+	logInfo("started %s (pid=%d, pgid=%d)", p.Name, p.pid, p.pid)
 	return nil
 }
 
+// applyLimits sets p's resource limits on cg
+func (p *Process) applyLimits(cg *Cgroup) {
+	if p.MemoryLimit > 0 && controllerMissing("memory") {
+		logWarn("memory_mb of %s is not enforced: no memory controller", p.Name)
+	} else if p.MemoryLimit > 0 {
+		if err := cg.SetMemoryLimit(p.MemoryLimit); err != nil {
+			logWarn("failed to set memory limit for %s: %v", p.Name, err)
+		}
+	}
+	if p.CPUQuota > 0 && controllerMissing("cpu") {
+		logWarn("cpu_percent of %s is not enforced: no cpu controller", p.Name)
+	} else if p.CPUQuota > 0 {
+		if err := cg.SetCPUQuota(p.CPUQuota); err != nil {
+			logWarn("failed to set CPU quota for %s: %v", p.Name, err)
+		}
+	}
+	for size, limit := range p.HugeTLBLimits {
+		if err := cg.SetHugeTLBMax(size, limit); err != nil {
+			logWarn("failed to set %s hugetlb limit for %s: %v", size, p.Name, err)
+		}
+	}
+	if len(p.GPUs) > 0 {
+		if err := cg.RestrictGPUs(p.GPUs); err != nil {
+			logWarn("failed to restrict %s to GPUs %v: %v", p.Name, p.GPUs, err)
+		}
+	} else {
+		cg.unrestrictDevices()
+	}
+	if len(p.cpuList) > 0 && controllerMissing("cpuset") {
+		logWarn("cpus of %s is only an affinity, which it may change: no cpuset controller", p.Name)
+	} else if len(p.cpuList) > 0 {
+		if err := cg.SetCPUs(formatCPUList(p.cpuList)); err != nil {
+			logWarn("failed to set CPUs for %s: %v", p.Name, err)
+		}
+		if len(p.memNodes) > 0 {
+			if err := cg.SetMems(formatCPUList(p.memNodes)); err != nil {
+				logWarn("failed to set memory nodes for %s: %v", p.Name, err)
+			}
+		}
+	}
+	if p.EgressMbit > 0 {
+		if err := p.shapeEgress(cg); err != nil {
+			logWarn("failed to limit egress of %s to %d Mbit/s: %v", p.Name, p.EgressMbit, err)
+		}
+	} else {
+		cg.unshapeEgress()
+	}
+}
+
+// needsCgroup reports whether p gets a cgroup of its own
+func (p *Process) needsCgroup() bool {
+	return cgroupsSupported && (p.MemoryLimit > 0 || p.CPUQuota > 0 || len(p.ProfileLimits) > 0 || len(p.HugeTLBLimits) > 0 || len(p.GPUs) > 0 || p.EgressMbit > 0 || len(p.cpuList) > 0 || p.usesCgroup() || selfLimited || p.inLimitedPool() || p.EvictionAction == EvictFreeze)
+}
+
+// inLimitedPool reports whether p is assigned to a pool with a budget
+func (p *Process) inLimitedPool() bool {
+	pl := poolNamed(p.Pool)
+	return pl != nil && pl.limited()
+}
+
+// cgroupName returns where p's cgroup goes, relative to the cgroup base:
+// below its pool's, if it's in a pool with a budget (see pools.go)
+func (p *Process) cgroupName() string {
+	if pl := poolNamed(p.Pool); pl != nil {
+		if pool := pl.cgroupName(); pool != "" {
+			return pool + "/" + p.Name
+		}
+	}
+	return p.Name
+}
+
+// isMain reports whether the process's exit ends gosv
+func (p *Process) isMain() bool {
+	return p.Main || p.Foreground
+}
+
+// now returns the current time from the supervisor's clock
+func (p *Process) now() time.Time {
+	return p.timeSource().Now()
+}
+
+// timeSource returns the supervisor's clock, or the real one if p isn't
+// supervised yet. Waits go through it rather than time.Sleep, so they
+// follow a ManualClock.
+func (p *Process) timeSource() Clock {
+	if p.clock == nil {
+		return realClock{}
+	}
+	return p.clock
+}
+
 // Signal sends a signal to the process group
 func (p *Process) Signal(sig syscall.Signal) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	if p.pid == 0 {
-		return fmt.Errorf("process not running")
+		return ErrNotRunning
 	}
 
 	// KEY CONCEPT: Negative PID means signal the entire process group
 	// This ensures children of children also receive the signal
 	// Compare: kill(pid, sig) vs kill(-pgid, sig)
-	pgid := -p.pid
-	return syscall.Kill(pgid, sig)
+	if p.pgid == 0 {
+		return syscall.Kill(p.pid, sig) // No group of its own (adopted)
+	}
+	return syscall.Kill(-p.pgid, sig)
+}
+
+// signalNames maps the signals that make sense to configure by name
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// parseSignal accepts "SIGUSR1", "USR1" or a number like "10"
+func parseSignal(name string) (syscall.Signal, error) {
+	var n int
+	if _, err := fmt.Sscanf(name, "%d", &n); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", name)
 }
 
 // Wait blocks until process exits, returns exit code
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LimitProfile is a named time of the week (limit_profiles) in which the
+// pools and services that list it in profile_limits get other limits,
+// e.g. "business-hours" on weekdays from 08:00 to 18:00
+type LimitProfile struct {
+	Name    string   `json:"name"`
+	Windows []string `json:"windows"` // Daily, "HH:MM-HH:MM" in local time
+	Days    []string `json:"days"`    // "mon".."sun" or ranges like "mon-fri" (default: every day)
+}
+
+// ProfileLimits are the limits of a pool or service while a profile is
+// active. 0 keeps the configured limit.
+type ProfileLimits struct {
+	MemoryMB   int64 `json:"memory_mb"`
+	CPUPercent int   `json:"cpu_percent"`
+}
+
+// limitProfile is a parsed LimitProfile
+type limitProfile struct {
+	name    string
+	windows []timeWindow
+	days    [7]bool // By time.Weekday
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseDays parses days like ["mon-fri", "sun"] into a set by weekday
+func parseDays(days []string) ([7]bool, error) {
+	var set [7]bool
+	if len(days) == 0 {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, d := range days {
+		first, last, isRange := strings.Cut(strings.ToLower(d), "-")
+		if !isRange {
+			last = first
+		}
+		lo, hi := slices.Index(weekdays, first), slices.Index(weekdays, last)
+		if lo < 0 || hi < 0 {
+			return set, fmt.Errorf("invalid day %q (want mon..sun, or a range like mon-fri)", d)
+		}
+		for i := lo; ; i = (i + 1) % 7 { // "sat-sun" wraps the week
+			set[i] = true
+			if i == hi {
+				break
+			}
+		}
+	}
+	return set, nil
+}
+
+// parseLimitProfiles parses and checks limit_profiles
+func parseLimitProfiles(cfgs []LimitProfile) ([]limitProfile, error) {
+	var profiles []limitProfile
+	for _, c := range cfgs {
+		if c.Name == "" || slices.ContainsFunc(profiles, func(lp limitProfile) bool { return lp.name == c.Name }) {
+			return nil, fmt.Errorf("limit_profiles: missing or duplicate name %q", c.Name)
+		}
+		if len(c.Windows) == 0 {
+			return nil, fmt.Errorf("limit_profiles: %s: no windows", c.Name)
+		}
+		lp := limitProfile{name: c.Name}
+		for _, s := range c.Windows {
+			w, err := parseWindow(s)
+			if err != nil {
+				return nil, fmt.Errorf("limit_profiles: %s: %w", c.Name, err)
+			}
+			lp.windows = append(lp.windows, w)
+		}
+		var err error
+		if lp.days, err = parseDays(c.Days); err != nil {
+			return nil, fmt.Errorf("limit_profiles: %s: %w", c.Name, err)
+		}
+		profiles = append(profiles, lp)
+	}
+	return profiles, nil
+}
+
+// checkProfileLimits checks the profile_limits of a pool or service
+// against the profiles there are
+func checkProfileLimits(limits map[string]ProfileLimits, cfgs []LimitProfile) error {
+	for name, l := range limits {
+		if !slices.ContainsFunc(cfgs, func(c LimitProfile) bool { return c.Name == name }) {
+			return fmt.Errorf("profile_limits: no limit profile %q (see limit_profiles)", name)
+		}
+		if l.MemoryMB < 0 || l.CPUPercent < 0 {
+			return fmt.Errorf("profile_limits: %s: memory_mb and cpu_percent must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// activeAt reports whether the profile is active at t. A window that
+// wraps midnight belongs to the day it opens on: "fri" with 22:00-06:00
+// includes Saturday until 06:00.
+func (lp limitProfile) activeAt(t time.Time) bool {
+	for _, w := range lp.windows {
+		if !w.contains(t) {
+			continue
+		}
+		day := t.Weekday()
+		if w.start > w.end && minuteOfDay(t) < w.end {
+			day = (day + 6) % 7
+		}
+		if lp.days[day] {
+			return true
+		}
+	}
+	return false
+}
+
+// activeProfile returns the first of profiles active at t, or ""
+func activeProfile(profiles []limitProfile, t time.Time) string {
+	for _, lp := range profiles {
+		if lp.activeAt(t) {
+			return lp.name
+		}
+	}
+	return ""
+}
+
+// nextProfileChange returns the next time after now that a window of
+// profiles opens or closes (zero if there are no profiles)
+func nextProfileChange(profiles []limitProfile, now time.Time) time.Time {
+	var next time.Time
+	for _, lp := range profiles {
+		for _, w := range lp.windows {
+			for _, m := range []int{w.start, w.end} {
+				if t := nextAt(now, m); next.IsZero() || t.Before(next) {
+					next = t
+				}
+			}
+		}
+	}
+	return next
+}
+
+// profileLimits returns p's memory (bytes) and CPU limits while profile
+// is active ("" for none): the configured ones, with those of its
+// profile_limits for the profile in their place
+func (p *Process) profileLimits(profile string) (int64, int) {
+	memory, cpu := p.configMemory, p.configCPU
+	if l, ok := p.ProfileLimits[profile]; ok {
+		if l.MemoryMB > 0 {
+			memory = l.MemoryMB * 1024 * 1024
+		}
+		if l.CPUPercent > 0 {
+			cpu = l.CPUPercent
+		}
+	}
+	return memory, cpu
+}
+
+// applyProfile switches p to its limits for profile, writing them to
+// its cgroup. Limits set with `ctl set-limit` stay until they're set
+// back, and then it's the profile's that they go back to.
+func (p *Process) applyProfile(profile string) {
+	if len(p.ProfileLimits) == 0 {
+		return
+	}
+	memory, cpu := p.profileLimits(profile)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.profile = profile
+	if p.override != nil {
+		p.override.memory, p.override.cpu = memory, cpu
+		return
+	}
+	if memory == p.MemoryLimit && cpu == p.CPUQuota {
+		return
+	}
+	p.MemoryLimit, p.CPUQuota = memory, cpu
+	if profile == "" {
+		p.noteEvent(EventLimits, "limits back to %s as configured", formatLimits(memory, cpu))
+	} else {
+		p.noteEvent(EventLimits, "limits set to %s by limit profile %s", formatLimits(memory, cpu), profile)
+	}
+	p.writeLimits()
+}
+
+// profileName names profile in messages, where "" is none
+func profileName(profile string) string {
+	if profile == "" {
+		return "none"
+	}
+	return profile
+}
+
+// setLimitProfiles configures the limit profiles and applies the one in
+// effect now
+func (s *Supervisor) setLimitProfiles(profiles []limitProfile) {
+	s.mu.Lock()
+	s.limitProfiles = profiles
+	s.mu.Unlock()
+	s.applyLimitProfiles()
+}
+
+// applyLimitProfiles switches the pools and services with profile_limits
+// to the limits of the profile in effect now, and arms a timer for the
+// next time a profile window opens or closes.
+//
+// KEY CONCEPT: Scheduled limits
+// The right budget for batch work often depends on the hour: during
+// business hours the interactive services need the CPUs, and a report
+// build may have 20% of them; at night the same build may take 80%. The
+// usual answer is a crontab that writes numbers into /sys/fs/cgroup -
+// which knows nothing of the cgroups gosv makes and remakes as services
+// restart, writes to paths that may not exist yet, and is undone by the
+// next restart or reload, which writes the config's limits again. gosv
+// owns those cgroups, so it applies the schedule itself: the limits of
+// the profile in effect are what a (re)start writes, and a timer rewrites
+// memory.max and cpu.max of the running services and pools when a profile
+// window opens or closes. The kernel applies the new limits at once.
+func (s *Supervisor) applyLimitProfiles() {
+	now := s.clock.Now()
+	s.mu.Lock()
+	profiles := s.limitProfiles
+	was := s.activeProfile
+	s.activeProfile = activeProfile(profiles, now)
+	active := s.activeProfile
+	if s.profileTimer != nil {
+		s.profileTimer.Stop()
+		s.profileTimer = nil
+	}
+	if next := nextProfileChange(profiles, now); !next.IsZero() {
+		s.profileTimer = s.clock.AfterFunc(next.Sub(now), func() {
+			select {
+			case <-s.stopped:
+			default:
+				s.applyLimitProfiles()
+			}
+		})
+	}
+	s.mu.Unlock()
+
+	switch {
+	case active == was:
+	case active == "":
+		logInfo("limit profile %s over, configured limits in effect", was)
+	default:
+		logInfo("limit profile %s in effect", active)
+	}
+	if m := resourcePools.Load(); m != nil {
+		for _, pl := range *m {
+			pl.setProfile(active)
+		}
+	}
+	for _, p := range s.snapshot() {
+		p.applyProfile(active)
+	}
+}
+
+// describeProfiles describes the limit profile in effect and the next
+// change, for --dry-run and ctl pools
+func (s *Supervisor) describeProfiles() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.limitProfiles) == 0 {
+		return ""
+	}
+	now := s.clock.Now()
+	next := nextProfileChange(s.limitProfiles, now)
+	return fmt.Sprintf("limit profile: %s in effect, next window change at %s", profileName(s.activeProfile), next.Format("Mon 15:04"))
+}
+
+// describeProfileLimits lists limits by profile, like "night: cpu 80%",
+// for --dry-run
+func describeProfileLimits(limits map[string]ProfileLimits) []string {
+	var lines []string
+	for name, l := range limits {
+		var parts []string
+		if l.MemoryMB > 0 {
+			parts = append(parts, "memory "+formatBytes(l.MemoryMB*1024*1024))
+		}
+		if l.CPUPercent > 0 {
+			parts = append(parts, fmt.Sprintf("cpu %d%%", l.CPUPercent))
+		}
+		if len(parts) == 0 {
+			parts = append(parts, "as configured")
+		}
+		lines = append(lines, name+": "+strings.Join(parts, ", "))
+	}
+	sort.Strings(lines)
+	return lines
+}
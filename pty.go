@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// winsize mirrors struct winsize from <sys/ioctl.h>
+type winsize struct {
+	Rows   uint16
+	Cols   uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+// copyWinsize copies the terminal size of src (our own terminal) to dst
+// (a PTY master). Silently does nothing if src is not a terminal.
+func copyWinsize(dst, src *os.File) error {
+	var ws winsize
+	if err := ioctl(src.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); err != nil {
+		return nil // Not a terminal - nothing to forward
+	}
+	return ioctl(dst.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// copyPTYOutput forwards everything the child writes to its terminal into
+// our output, then closes the master once the child side is gone.
+//
+// When the last slave fd is closed (child exited), reads on the master
+// fail with EIO - that is the PTY equivalent of EOF.
+func copyPTYOutput(master *os.File, dst io.Writer) {
+	io.Copy(dst, master)
+	master.Close()
+}
+
+// ResizePTYs forwards our terminal size to every TTY-enabled process.
+// Called on SIGWINCH.
+func (s *Supervisor) ResizePTYs() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.processes {
+		p.mu.Lock()
+		if p.pty != nil {
+			copyWinsize(p.pty, os.Stdin)
+			// The kernel sends SIGWINCH to the PTY's foreground process group
+		}
+		p.mu.Unlock()
+	}
+}
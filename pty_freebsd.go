@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// openPTY allocates a pseudo-terminal pair (see pty_linux.go). On FreeBSD
+// posix_openpt(2) is a system call of its own, a fresh pair needs no
+// unlocking, and TIOCGPTN gives the slave's number under /dev/pts.
+func openPTY() (master, slave *os.File, err error) {
+	fd, _, errno := syscall.Syscall(syscall.SYS_POSIX_OPENPT, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0, 0)
+	if errno != 0 {
+		return nil, nil, fmt.Errorf("posix_openpt: %w", errno)
+	}
+	master = os.NewFile(fd, "/dev/ptmx")
+
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("ptsname: %w", err)
+	}
+
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	return master, slave, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ioctlGetTermios is the ioctl behind tcgetattr(3)
+const ioctlGetTermios = syscall.TCGETS
+
+// openPTY allocates a pseudo-terminal pair
+//
+// KEY CONCEPT: Pseudo-terminals (man 7 pty)
+// A PTY is a pair of character devices: the "master" side (held by us)
+// and the "slave" side (handed to the child as its stdin/stdout/stderr).
+// Anything the child writes to the slave can be read from the master.
+// To the child the slave looks like a real terminal, so isatty() returns
+// true and programs enable line editing, colors, progress bars, etc.
+//
+// Allocation via the Unix 98 interface:
+//  1. open("/dev/ptmx")           - kernel creates a new master/slave pair
+//  2. ioctl(TIOCSPTLCK, 0)        - unlock the slave (unlockpt)
+//  3. ioctl(TIOCGPTN)             - get the slave number N (ptsname)
+//  4. open("/dev/pts/N")          - open the slave side
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlockpt: %w", err)
+	}
+
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("ptsname: %w", err)
+	}
+
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	return master, slave, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// DefaultReadyTimeout is how long a started service has to answer its
+// ready_check when ready_timeout_sec is not configured
+const DefaultReadyTimeout = time.Minute
+
+// DefaultReadyFailures is how many runs in a row may miss their ready
+// timeout before the readiness breaker trips, when ready_failures is not
+// configured
+const DefaultReadyFailures = 3
+
+// ReadinessBackoffFactor multiplies the restart delay of a service with
+// a tripped readiness breaker, once more for each further failure, up to
+// MaxReadinessBackoff
+const (
+	ReadinessBackoffFactor = 4
+	MaxReadinessBackoff    = 30 * time.Minute
+)
+
+// watchReadiness probes the ReadyCheck of the run of p started at
+// started until it answers. A run that is still not ready after
+// ReadyTimeout is stopped, and counts against the readiness breaker.
+//
+// KEY CONCEPT: Failing readiness vs. crashing
+// A service that crashes an hour into its run has usually met something
+// outside itself: a full disk, a database failover, the OOM killer. One
+// that runs but never answers its health check after a restart - and
+// again after the next - is usually broken itself: a bad deploy, a
+// config that points nowhere. Restarting the second kind every few
+// seconds fixes nothing and buries the cause in restart noise, and
+// reporting both as "crashing" leaves whoever is paged to guess which
+// it is. So gosv counts the runs that never got ready separately, like
+// Kubernetes' startup probes do. After ready_failures of them in a row
+// the breaker trips: the service is reported as failing readiness, and
+// each further restart waits ReadinessBackoffFactor times longer, until
+// a run answers and closes the breaker again.
+func (p *Process) watchReadiness(started time.Time) {
+	p.mu.Lock()
+	check, timeout := *p.ReadyCheck, p.ReadyTimeout
+	p.mu.Unlock()
+	deadline := p.now().Add(timeout)
+	for {
+		err := check.probe()
+		p.mu.Lock()
+		if !p.startTime.Equal(started) || p.state != StateRunning {
+			p.mu.Unlock()
+			return // Exited before it got ready: a crash, not a readiness failure
+		}
+		if err == nil {
+			if p.unready > 0 {
+				logInfo("%s is ready again after %d failed starts", p.Name, p.unready)
+				p.noteEvent(EventReady, "ready again after %d failed starts", p.unready)
+				p.unready = 0
+			}
+			p.mu.Unlock()
+			return
+		}
+		if p.now().After(deadline) {
+			p.unready++
+			n, tripped := p.unready, p.unready == p.readyFailures()
+			if n >= p.readyFailures() {
+				logWarn("%s failing readiness: %s not ready after %v (%d starts in a row): %v, restarting",
+					p.Name, check, timeout, n, err)
+				p.noteEvent(EventUnready, "failing readiness: not ready after %v (%d starts in a row): %v", timeout, n, err)
+			} else {
+				logWarn("%s: %s not ready after %v: %v, restarting", p.Name, check, timeout, err)
+				p.noteEvent(EventUnready, "not ready after %v: %v", timeout, err)
+			}
+			ev := ReadinessEvent{Name: p.Name, Failures: n, Timeout: timeout, Err: err.Error(), Labels: p.Labels}
+			p.mu.Unlock()
+			if tripped {
+				p.fireFailingReadiness(ev)
+			}
+			p.killForRestart(syscall.SIGTERM) // Restarted by its restart policy
+			return
+		}
+		p.mu.Unlock()
+		<-p.timeSource().After(waitInterval)
+	}
+}
+
+// readyFailures returns ReadyFailures or its default
+func (p *Process) readyFailures() int {
+	if p.ReadyFailures == 0 {
+		return DefaultReadyFailures
+	}
+	return p.ReadyFailures
+}
+
+// failingReadiness reports whether p's readiness breaker is tripped.
+// Caller must hold p.mu.
+func (p *Process) failingReadiness() bool {
+	return p.ReadyCheck != nil && p.unready >= p.readyFailures()
+}
+
+// readinessBackoff returns the restart delay of p, escalated while its
+// readiness breaker is tripped. Caller must hold p.mu.
+func (p *Process) readinessBackoff(delay time.Duration) time.Duration {
+	if !p.failingReadiness() {
+		return delay
+	}
+	escalated := max(delay, time.Second)
+	for i := p.readyFailures(); i <= p.unready && escalated < MaxReadinessBackoff; i++ {
+		escalated *= ReadinessBackoffFactor
+	}
+	return max(delay, min(escalated, MaxReadinessBackoff))
+}
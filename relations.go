@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// checkRelations verifies that part_of, binds_to and after name other
+// services of the config, and that after has no cycles
+func checkRelations(procs []*Process) error {
+	names := make(map[string]bool, len(procs))
+	for _, p := range procs {
+		names[p.Name] = true
+	}
+	for _, p := range procs {
+		for field, targets := range map[string][]string{"part_of": p.PartOf, "binds_to": p.BindsTo, "after": p.After} {
+			for _, t := range targets {
+				if t == p.Name {
+					return fmt.Errorf("service %s: %s can't name itself", p.Name, field)
+				}
+				if !names[t] {
+					return fmt.Errorf("service %s: %s: %w: %s", p.Name, field, ErrUnknownService, t)
+				}
+			}
+		}
+	}
+	if _, err := startOrder(procs); err != nil {
+		return err
+	}
+	return nil
+}
+
+// startOrder sorts procs so that every process comes after the ones its
+// After names, by name otherwise. It fails on a cycle.
+func startOrder(procs []*Process) ([]*Process, error) {
+	sorted := append([]*Process(nil), procs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	byName := make(map[string]*Process, len(sorted))
+	for _, p := range sorted {
+		byName[p.Name] = p
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[*Process]int, len(sorted))
+	order := make([]*Process, 0, len(sorted))
+	var visit func(p *Process, path []string) error
+	visit = func(p *Process, path []string) error {
+		switch state[p] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("after: cycle %s -> %s", strings.Join(path, " -> "), p.Name)
+		}
+		state[p] = visiting
+		for _, name := range p.After {
+			// Services outside procs (removed by a reload) don't order
+			if dep, ok := byName[name]; ok {
+				if err := visit(dep, append(path, p.Name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[p] = done
+		order = append(order, p)
+		return nil
+	}
+	for _, p := range sorted {
+		if err := visit(p, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// dependents returns the processes that list name in their PartOf (or
+// BindsTo, if binds)
+func (s *Supervisor) dependents(name string, binds bool) []*Process {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var deps []*Process
+	for _, p := range s.processes {
+		targets := p.PartOf
+		if binds {
+			targets = p.BindsTo
+		}
+		for _, t := range targets {
+			if t == name {
+				deps = append(deps, p)
+				break
+			}
+		}
+	}
+	return deps
+}
+
+// withPartOf returns procs plus, transitively, every process that is
+// part of one of them
+//
+// KEY CONCEPT: PartOf and BindsTo
+// Some services only make sense together: workers that talk to a local
+// cache process, a sidecar that ships one service's logs. systemd names
+// the two useful relations. PartOf=X: when an operator stops or restarts
+// X, the same happens to this service - one command acts on the unit as
+// a whole. BindsTo=X: this service can't run without X, whatever the
+// reason X went down - a crash included. It's stopped as soon as X exits
+// and started again once X is back, instead of crash-looping against a
+// missing dependency in the meantime.
+func (s *Supervisor) withPartOf(procs []*Process) []*Process {
+	seen := make(map[*Process]bool)
+	var all []*Process
+	var add func(p *Process)
+	add = func(p *Process) {
+		if seen[p] {
+			return // part_of cycles are allowed
+		}
+		seen[p] = true
+		all = append(all, p)
+		for _, dep := range s.dependents(p.Name, false) {
+			add(dep)
+		}
+	}
+	for _, p := range procs {
+		add(p)
+	}
+	return all
+}
+
+// boundExited stops the processes bound to p, which just exited. They
+// stay down until p is started again (see boundStarted).
+func (s *Supervisor) boundExited(p *Process) {
+	s.mu.RLock()
+	stopping := s.shuttingDown
+	s.mu.RUnlock()
+	if stopping {
+		return
+	}
+	for _, dep := range s.dependents(p.Name, true) {
+		dep.mu.Lock()
+		dep.boundDown = true
+		dep.pendingRestart = false
+		dep.cancelRestart()
+		if dep.state == StateStarting || dep.state == StateWaiting {
+			dep.state = StateStopped
+		}
+		running := dep.state == StateRunning
+		dep.noteEvent(EventStop, "stopped: bound to %s, which exited", p.Name)
+		dep.mu.Unlock()
+		if running {
+			logInfo("stopping %s: bound to %s, which exited", dep.Name, p.Name)
+			dep.kill(syscall.SIGTERM)
+		}
+	}
+}
+
+// boundStarted starts the processes bound to p, which just started, once
+// everything they are bound to runs
+func (s *Supervisor) boundStarted(p *Process) {
+	for _, dep := range s.dependents(p.Name, true) {
+		if !s.bindsUp(dep) {
+			continue
+		}
+		dep.mu.Lock()
+		wasDown := dep.boundDown
+		dep.boundDown = false
+		dep.mu.Unlock()
+		if wasDown {
+			logInfo("starting %s: %s is back", dep.Name, p.Name)
+			s.RestartProcess(dep)
+		}
+	}
+}
+
+// bindsUp reports whether every process p is bound to is running
+func (s *Supervisor) bindsUp(p *Process) bool {
+	for _, name := range p.BindsTo {
+		target, err := s.lookup(name)
+		if err != nil {
+			return false
+		}
+		target.mu.Lock()
+		running := target.state == StateRunning
+		target.mu.Unlock()
+		if !running {
+			return false
+		}
+	}
+	return true
+}
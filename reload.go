@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// configFetchTimeout bounds a single fetch from a remote config source
+const configFetchTimeout = 30 * time.Second
+
+var configClient = &http.Client{Timeout: configFetchTimeout}
+
+// readConfigSource returns the raw config from src, which is one of:
+//
+//	/etc/gosv.json                       a local file
+//	https://example.com/gosv.json        an HTTP(S) URL
+//	consul://127.0.0.1:8500/gosv/web     a Consul KV key
+//	etcd://127.0.0.1:2379/gosv/web       an etcd v3 key (via its JSON gateway)
+//	git+https://host/fleet.git#web.json  a file in a git repository
+//	/etc/gosv/units                      a directory of systemd units (see unitfile.go)
+func readConfigSource(src string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(src, "http://"), strings.HasPrefix(src, "https://"):
+		return httpGet(src)
+	case strings.HasPrefix(src, "consul://"):
+		// ?raw returns the value itself instead of a JSON envelope
+		return httpGet("http://" + strings.TrimPrefix(src, "consul://") + "?raw")
+	case strings.HasPrefix(src, "etcd://"):
+		return etcdGet(strings.TrimPrefix(src, "etcd://"))
+	case strings.HasPrefix(src, "git+"):
+		return gitRead(strings.TrimPrefix(src, "git+"), nil)
+	}
+	if fi, err := os.Stat(src); err == nil && fi.IsDir() {
+		return readUnitDir(src)
+	}
+	return os.ReadFile(src)
+}
+
+func httpGet(url string) ([]byte, error) {
+	resp, err := configClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// etcdGet reads a key through etcd's v3 JSON gateway. hostKey is
+// "host:port/key"; keys and values are base64 encoded on the wire.
+func etcdGet(hostKey string) ([]byte, error) {
+	host, key, ok := strings.Cut(hostKey, "/")
+	if !ok {
+		return nil, fmt.Errorf("etcd source needs a key: etcd://%s", hostKey)
+	}
+	req, _ := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte("/" + key))})
+	resp, err := configClient.Post("http://"+host+"/v3/kv/range", "application/json", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("etcd range /%s: %s", key, resp.Status)
+	}
+
+	var out struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("etcd range /%s: %w", key, err)
+	}
+	if len(out.Kvs) == 0 {
+		return nil, fmt.Errorf("etcd key /%s not found", key)
+	}
+	return base64.StdEncoding.DecodeString(out.Kvs[0].Value)
+}
+
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// gitRead returns a file from the tip of a repository's default branch.
+// repoFile is "URL#path". The repository is cloned shallowly on first use
+// and fetched again on every read, so polling it picks up new commits.
+// Each git command gets configFetchTimeout, and runs through pids (nil
+// outside the supervisor) so the reaper hands its exit over.
+func gitRead(repoFile string, pids *pidIndex) ([]byte, error) {
+	repo, file, ok := strings.Cut(repoFile, "#")
+	if !ok || file == "" {
+		return nil, fmt.Errorf("git source needs a file: git+%s#path/to/config.json", repoFile)
+	}
+	git := func(dir string, args ...string) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), configFetchTimeout)
+		defer cancel()
+		return pids.run(ctx, dir, "git", args...)
+	}
+
+	dir := filepath.Join(os.TempDir(), "gosv-config", unsafePathChars.ReplaceAllString(repo, "_"))
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		os.RemoveAll(dir)
+		if out, err := git("", "clone", "--quiet", "--depth", "1", repo, dir); err != nil {
+			return nil, fmt.Errorf("git clone %s: %w: %s", repo, err, out)
+		}
+	} else {
+		for _, args := range [][]string{
+			{"fetch", "--quiet", "--depth", "1", "origin", "HEAD"},
+			{"reset", "--quiet", "--hard", "FETCH_HEAD"},
+		} {
+			if out, err := git(dir, args...); err != nil {
+				return nil, fmt.Errorf("git %s %s: %w: %s", args[0], repo, err, out)
+			}
+		}
+	}
+	return os.ReadFile(filepath.Join(dir, file))
+}
+
+// readConfig reads the config source, like readConfigSource. git runs as
+// gosv's child, so the supervisor's reaper has to hand its exit over.
+func (s *Supervisor) readConfig() ([]byte, error) {
+	if repoFile, ok := strings.CutPrefix(s.configSource, "git+"); ok {
+		return gitRead(repoFile, s.pids)
+	}
+	return readConfigSource(s.configSource)
+}
+
+// reloadConfig re-reads the config source and hands it to the supervisor
+// loop to apply (SIGHUP). It runs on a goroutine of its own: a remote
+// source can take up to configFetchTimeout to answer.
+func (s *Supervisor) reloadConfig() {
+	if s.configSource == "" {
+		logInfo("reload: there is no config file to reload")
+		return
+	}
+	data, err := s.readConfig()
+	if err != nil {
+		logError("reload: %v", err)
+		return
+	}
+	select {
+	case s.configCh <- data:
+	case <-s.stopped:
+	}
+}
+
+// pollConfig re-fetches the config source every ConfigSyncInterval and
+// hands changed configs to the supervisor loop
+func (s *Supervisor) pollConfig() {
+	ticker := s.clock.NewTicker(s.ConfigSyncInterval)
+	defer ticker.Stop()
+
+	last := s.configData
+	for {
+		select {
+		case <-ticker.C():
+		case <-s.shutdownCh:
+			return
+		}
+		data, err := s.readConfig()
+		if err != nil {
+			logWarn("config sync: %v", err)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+		select {
+		case s.configCh <- data:
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+// applyConfig reconciles the running services with a new config
+//
+// KEY CONCEPT: Diff-based reload
+// Restarting everything on reload would make every config change an
+// outage. Instead each service is compared with the config it was started
+// from: services that disappeared are stopped, changed ones are stopped
+// and started again with the new settings, new ones are started, and
+// everything else keeps running untouched.
+func (s *Supervisor) applyConfig(data []byte) {
+	if bytes.Equal(data, s.configData) {
+		logInfo("reload: config unchanged")
+		return
+	}
+	procs, err := parseConfig(data)
+	if err != nil {
+		// Keep running the old config rather than half of a broken one
+		logError("reload: invalid config, keeping the current one: %v", err)
+		return
+	}
+	s.applyDeploys(procs, data)
+
+	s.applyGlobalConfig(data)
+	s.applySelfLimits()
+	s.startLoki()
+	s.startLogSinks()
+	s.startEventJournal()
+	s.startStore()
+	s.startDeployAPI()
+	s.startWebhooks()
+	s.startStatusPage()
+	s.startAgent()
+
+	stopped, started := s.replaceServices(procs, "reload")
+	s.configData = data
+	s.storeRevisions(s.snapshot())
+	if stopped == 0 && started == 0 {
+		logInfo("reload: no service changes")
+		s.noteEvent(EventReload, "config reloaded, no service changes")
+		return
+	}
+	logInfo("reload: config applied (%d stopped, %d started)", stopped, started)
+	s.noteEvent(EventReload, "config reloaded (%d stopped, %d started)", stopped, started)
+}
+
+// replaceServices makes the services procs: it stops the ones that are
+// gone or changed, and starts the new and changed ones. why prefixes its
+// logs. It returns how many it stops and starts; it doesn't wait for the
+// stops, and changed services start again once their old process is gone.
+func (s *Supervisor) replaceServices(procs []*Process, why string) (stopped, started int) {
+	want := make(map[string]*Process, len(procs))
+	for _, p := range procs {
+		want[p.Name] = p
+	}
+
+	s.mu.RLock()
+	var stop []*Process
+	for name, old := range s.processes {
+		p, ok := want[name]
+		switch {
+		case ok && p.configHash == old.configHash:
+			delete(want, name) // Unchanged
+		case old.job != nil:
+			// Jobs aren't in the config, they end on their own (see
+			// jobs.go)
+			if ok {
+				logWarn("%s: a job is running as %s, not adding the service until it ends", why, name)
+				delete(want, name)
+			}
+		case old.isMain() || (ok && p.Foreground):
+			// The main service's exit ends gosv, so it can't be swapped
+			// out (or from under the terminal, if foreground)
+			logWarn("%s: ignoring changes to main service %s", why, name)
+			delete(want, name)
+		default:
+			stop = append(stop, old)
+		}
+	}
+	s.mu.RUnlock()
+	for _, p := range want {
+		if p.Foreground {
+			logWarn("%s: ignoring new foreground service %s", why, p.Name)
+			delete(want, p.Name)
+		}
+	}
+
+	if len(stop) == 0 && len(want) == 0 {
+		return 0, 0
+	}
+
+	// Mark the old processes first so nothing restarts them while they
+	// stop (see registered)
+	for _, p := range stop {
+		p.mu.Lock()
+		p.removed = true
+		p.cancelRestart()
+		p.mu.Unlock()
+		if _, ok := want[p.Name]; ok {
+			logInfo("%s: %s changed, restarting it", why, p.Name)
+		} else {
+			logInfo("%s: %s removed, stopping it", why, p.Name)
+		}
+	}
+	// Swap the old processes out now, so status shows the new ones, but
+	// start a changed service's new process only once the old one is
+	// gone: they share the cgroup, ports and credentials. The stop runs in
+	// the background, like ctl stop's, so the main loop goes on reaping.
+	var later []*Process
+	s.mu.Lock()
+	for _, p := range stop {
+		delete(s.processes, p.Name)
+	}
+	s.mu.Unlock()
+	for _, p := range want {
+		if err := s.AddProcess(p); err != nil {
+			logError("%s: %v", why, err)
+			delete(want, p.Name)
+			continue
+		}
+		if p.PlannedRestart != "" {
+			s.schedulePlannedRestart(p)
+		}
+		if slices.ContainsFunc(stop, func(old *Process) bool { return old.Name == p.Name }) {
+			// Not restarted by handleRestarts in the meantime
+			p.mu.Lock()
+			p.state = StateStarting
+			p.mu.Unlock()
+			later = append(later, p)
+			continue
+		}
+		s.startNew(p, why)
+	}
+	if len(stop) > 0 {
+		s.retire(stop, func() {
+			for _, p := range stop {
+				if p.cgroup != nil {
+					p.cgroup.Destroy()
+				}
+				if p.logs != nil {
+					p.logs.close()
+				}
+				// Before the new process starts, which listens on them again
+				p.closePorts()
+				p.closeSockets()
+				if _, ok := want[p.Name]; !ok {
+					p.removeCredentials()
+					p.removeDNS()
+				}
+			}
+			for _, p := range later {
+				if s.mayStart(p) {
+					s.startNew(p, why)
+				}
+			}
+		})
+	}
+
+	// The watcher holds on to the old processes - rebuild it
+	if s.watcher != nil {
+		s.watcher.Close()
+		s.watcher = nil
+	}
+	s.startWatcher()
+	return len(stop), len(want)
+}
+
+// startNew starts p, which replaceServices just added: singletons wait for
+// their lock and path-activated services for work
+func (s *Supervisor) startNew(p *Process, why string) {
+	if p.Lock != nil {
+		s.startLeading(p)
+		return
+	}
+	if len(p.ActivatePaths) > 0 && !pathsHaveContent(p.ActivatePaths) {
+		logInfo("%s waiting for path activation", p.Name)
+		p.mu.Lock()
+		p.state = StateWaiting
+		p.mu.Unlock()
+		return
+	}
+	if p.StartDelay > 0 || len(p.WaitFor) > 0 {
+		s.startAsync(p, p.StartDelay, nil)
+	} else if err := p.Start(); err != nil {
+		logError("%s: %v", why, err)
+		s.wakeRestarts() // A critical service may have failed
+	}
+}
+
+// registered reports whether p is still supervised (a reload may have
+// replaced or removed it)
+func (s *Supervisor) registered(p *Process) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return s.processes[p.Name] == p && !p.removed
+}
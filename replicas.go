@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// replicaName is the name of the i-th replica (from 1) of service name
+func replicaName(name string, i int) string {
+	return name + "-" + strconv.Itoa(i)
+}
+
+// isReplicaName reports whether name could be a replica of service
+func isReplicaName(name, service string) bool {
+	n, ok := strings.CutPrefix(name, service+"-")
+	if !ok {
+		return false
+	}
+	i, err := strconv.Atoi(n)
+	return err == nil && i > 0 && replicaName(service, i) == name
+}
+
+// expandReplicas replaces each service of cfg that has replicas with its
+// replicas: copies of it named <name>-1, <name>-2... that tell which
+// they are by $GOSV_REPLICA
+//
+// KEY CONCEPT: Replicas
+// One process of a worker or a stateless frontend is seldom enough, and
+// a second entry in the config that only differs by its name drifts from
+// the first one the day someone edits just one. A service with replicas
+// is one entry that gosv runs several times over, each copy a service of
+// its own: it restarts, logs and shows up in ctl status on its own, so
+// one crashing copy leaves the others serving. The name of the entry
+// still selects them all, which is what `gosv ctl restart --rolling`
+// needs to restart them one at a time without ever stopping them all.
+// A replica is built from its own copy of the entry, so a reload that
+// only changes the count starts or stops the replicas that come or go
+// and leaves the others running.
+func expandReplicas(cfg *Config) error {
+	var services []ServiceConfig
+	for _, svc := range cfg.Services {
+		switch {
+		case svc.Replicas < 0:
+			return fmt.Errorf("service %s: replicas must not be negative", svc.Name)
+		case svc.Replicas <= 1:
+			services = append(services, svc)
+			continue
+		case svc.Foreground || svc.Singleton:
+			return fmt.Errorf("service %s: a foreground service or a singleton can't have replicas", svc.Name)
+		case svc.PIDFile != "":
+			return fmt.Errorf("service %s: replicas would share the pid_file", svc.Name)
+		case len(svc.Ports) > 0 || len(svc.Sockets) > 0 || svc.Register != nil:
+			// Each replica would listen on, or register, the same port
+			return fmt.Errorf("service %s: replicas would share the host ports of ports, sockets or register", svc.Name)
+		case cfg.ExitCodeFrom == svc.Name:
+			return fmt.Errorf("service %s: exit_code_from can't name a service with replicas", svc.Name)
+		}
+		if err := validServiceName(svc.Name); err != nil {
+			return err
+		}
+		for i := 1; i <= svc.Replicas; i++ {
+			replica := svc
+			replica.Name, replica.Replicas, replica.replicaOf = replicaName(svc.Name, i), 0, svc.Name
+			replica.Env = maps.Clone(svc.Env)
+			if replica.Env == nil {
+				replica.Env = make(map[string]string)
+			}
+			replica.Env["GOSV_REPLICA"] = strconv.Itoa(i)
+			services = append(services, replica)
+		}
+	}
+	cfg.Services = services
+	return nil
+}
+
+// expandRelations makes part_of, binds_to and after that name a service
+// with replicas name all of its replicas
+func expandRelations(procs []*Process) {
+	replicas := make(map[string][]string)
+	for _, p := range procs {
+		if p.ReplicaOf != "" {
+			replicas[p.ReplicaOf] = append(replicas[p.ReplicaOf], p.Name)
+		}
+	}
+	if len(replicas) == 0 {
+		return
+	}
+	expand := func(targets []string) []string {
+		var out []string
+		for _, t := range targets {
+			if names, ok := replicas[t]; ok {
+				out = append(out, names...)
+			} else {
+				out = append(out, t)
+			}
+		}
+		return out
+	}
+	for _, p := range procs {
+		p.PartOf, p.BindsTo, p.After = expand(p.PartOf), expand(p.BindsTo), expand(p.After)
+	}
+}
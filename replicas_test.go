@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandReplicas(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    []string // Names after expansion
+		wantErr string
+	}{
+		{"no replicas", Config{Services: []ServiceConfig{{Name: "web"}}}, []string{"web"}, ""},
+		{"one replica", Config{Services: []ServiceConfig{{Name: "web", Replicas: 1}}}, []string{"web"}, ""},
+		{"three", Config{Services: []ServiceConfig{{Name: "web", Replicas: 3}, {Name: "db"}}},
+			[]string{"web-1", "web-2", "web-3", "db"}, ""},
+		{"negative", Config{Services: []ServiceConfig{{Name: "web", Replicas: -1}}}, nil, "must not be negative"},
+		{"foreground", Config{Services: []ServiceConfig{{Name: "web", Replicas: 2, Foreground: true}}}, nil, "can't have replicas"},
+		{"singleton", Config{Services: []ServiceConfig{{Name: "web", Replicas: 2, Singleton: true}}}, nil, "can't have replicas"},
+		{"pid_file", Config{Services: []ServiceConfig{{Name: "web", Replicas: 2, PIDFile: "/run/web.pid"}}}, nil, "pid_file"},
+		{"ports", Config{Services: []ServiceConfig{{Name: "web", Replicas: 2, PrivateNetwork: true,
+			Ports: []PortMapping{{Listen: ":8080"}}}}}, nil, "host ports"},
+		{"register", Config{Services: []ServiceConfig{{Name: "web", Replicas: 2,
+			Register: &RegisterConfig{Registry: "consul://127.0.0.1:8500", Port: 8080}}}}, nil, "host ports"},
+		{"exit_code_from", Config{ExitCodeFrom: "web", Services: []ServiceConfig{{Name: "web", Replicas: 2}}}, nil, "exit_code_from"},
+		{"reserved name", Config{Services: []ServiceConfig{{Name: "supervisor", Replicas: 2}}}, nil, "reserved"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			err := expandReplicas(&cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expandReplicas() error = %v, want one about %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, svc := range cfg.Services {
+				names = append(names, svc.Name)
+			}
+			if strings.Join(names, " ") != strings.Join(tt.want, " ") {
+				t.Fatalf("services %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandReplicasEnv(t *testing.T) {
+	env := map[string]string{"MODE": "prod"}
+	cfg := Config{Services: []ServiceConfig{{Name: "web", Replicas: 2, Env: env}}}
+	if err := expandReplicas(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	for i, svc := range cfg.Services {
+		if svc.replicaOf != "web" || svc.Replicas != 0 {
+			t.Errorf("%s: replicaOf %q, replicas %d", svc.Name, svc.replicaOf, svc.Replicas)
+		}
+		if want := string(rune('1' + i)); svc.Env["GOSV_REPLICA"] != want || svc.Env["MODE"] != "prod" {
+			t.Errorf("%s: env %v, want GOSV_REPLICA=%s and MODE=prod", svc.Name, svc.Env, want)
+		}
+	}
+	if _, ok := env["GOSV_REPLICA"]; ok {
+		t.Error("the service's own env was changed")
+	}
+}
+
+func TestIsReplicaName(t *testing.T) {
+	tests := []struct {
+		name, service string
+		want          bool
+	}{
+		{"web-1", "web", true},
+		{"web-12", "web", true},
+		{"web-0", "web", false},
+		{"web-01", "web", false},
+		{"web-+1", "web", false},
+		{"web-x", "web", false},
+		{"web", "web", false},
+		{"webapp-1", "web", false},
+		{"my-web-2", "my-web", true},
+	}
+	for _, tt := range tests {
+		if got := isReplicaName(tt.name, tt.service); got != tt.want {
+			t.Errorf("isReplicaName(%q, %q) = %v, want %v", tt.name, tt.service, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// DefaultStateRevisions is how many revisions of each service's config
+// the state store keeps when state_revisions is not configured
+const DefaultStateRevisions = 10
+
+// Revision sources: what put a revision of a service's config in place
+const (
+	RevisionConfig   = "config"   // The config file, at start or on reload
+	RevisionDeploy   = "deploy"   // A deploy (see deploy.go)
+	RevisionRollback = "rollback" // A rollback to an earlier revision
+)
+
+// errNoRevisions is returned when revisions are asked of a gosv without
+// a state store or a deploy state file to keep them next to
+var errNoRevisions = errors.New("revisions are kept in the state store or next to the deploys, and there is neither (see state_db)")
+
+// revision is a revision of a service's config, as the store keeps it
+type revision struct {
+	Number int
+	Time   time.Time
+	Source string
+	Config json.RawMessage
+}
+
+// command returns the command line the revision runs
+func (r revision) command() string {
+	var svc ServiceConfig
+	if json.Unmarshal(r.Config, &svc) != nil {
+		return "?"
+	}
+	return commandLine(svc.Command, svc.Args)
+}
+
+// effectiveConfig returns the service config p runs: the one it was
+// built from, with the command it was deployed with. Caller must hold
+// p.mu.
+func (p *Process) effectiveConfig() (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(p.configHash), &fields); err != nil {
+		return nil, err
+	}
+	command, args := p.definition()
+	fields["command"], _ = json.Marshal(command)
+	fields["args"], _ = json.Marshal(args)
+	return json.Marshal(fields)
+}
+
+// buildService builds the process of the service config svc as if it
+// were the entry of its name in the config data (or, for a replica, one
+// more entry next to its service's), so it's checked against the rest of
+// the config and gets the group defaults that svc doesn't set. The
+// process is taken to be built from svc, for reloads.
+func buildService(data []byte, svc json.RawMessage) (*Process, error) {
+	var cfg map[string]json.RawMessage
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	var services []json.RawMessage
+	if err := json.Unmarshal(cfg["services"], &services); err != nil {
+		return nil, err
+	}
+	type named struct {
+		Name string `json:"name"`
+	}
+	var want named
+	if err := json.Unmarshal(svc, &want); err != nil {
+		return nil, err
+	}
+	found := false
+	for i, raw := range services {
+		var n named
+		if json.Unmarshal(raw, &n) == nil && n.Name == want.Name {
+			services[i], found = svc, true
+		}
+	}
+	replicaOf := ""
+	for _, raw := range services {
+		var n named
+		if !found && json.Unmarshal(raw, &n) == nil && isReplicaName(want.Name, n.Name) {
+			replicaOf, found = n.Name, true
+		}
+	}
+	if replicaOf != "" {
+		services = append(services, svc)
+	}
+	if !found {
+		return nil, fmt.Errorf("%s is not in the config", want.Name)
+	}
+	cfg["services"], _ = json.Marshal(services)
+	merged, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	procs, err := parseConfig(merged)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(procs) - 1; i >= 0; i-- {
+		if p := procs[i]; p.Name == want.Name {
+			p.configHash = string(svc)
+			if replicaOf != "" {
+				p.ReplicaOf = replicaOf
+			}
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not in the config", want.Name)
+}
+
+// revisionsPath returns where a gosv without a state store keeps its
+// revisions: next to its deploys at deployState
+func revisionsPath(deployState string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(deployState, ".json"), ".deploys") + ".revisions.json"
+}
+
+// fileRevision is a revision as the revisions file keeps it
+type fileRevision struct {
+	Revision int             `json:"revision"`
+	Time     time.Time       `json:"time"`
+	Source   string          `json:"source"`
+	Config   json.RawMessage `json:"config"`
+}
+
+// revisionFile is the revisions file, by service and oldest first, while
+// revisions are recorded into it
+type revisionFile struct {
+	path    string
+	revs    map[string][]fileRevision
+	changed bool
+}
+
+// readRevisions reads the revisions kept at path (none if it's missing)
+func readRevisions(path string) map[string][]fileRevision {
+	revs := make(map[string][]fileRevision)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logWarn("revisions: %v", err)
+		}
+		return revs
+	}
+	if err := json.Unmarshal(data, &revs); err != nil {
+		logWarn("revisions: %s: %v", path, err)
+	}
+	return revs
+}
+
+// openRevisions returns the revisions file to record revisions into: nil
+// with a state store, which keeps them instead, or without a deploy state
+// file to keep them next to. Caller must hold s.deployMu.
+func (s *Supervisor) openRevisions() *revisionFile {
+	if stateStore.Load() != nil || s.deployCfg.StateFile == "" || s.deployReadOnly {
+		return nil
+	}
+	path := revisionsPath(s.deployCfg.StateFile)
+	return &revisionFile{path: path, revs: readRevisions(path)}
+}
+
+// saveRevisions writes f, if revisions were recorded into it. Caller must
+// hold s.deployMu.
+func (s *Supervisor) saveRevisions(f *revisionFile) {
+	if f == nil || !f.changed {
+		return
+	}
+	// Not indented: configs are compared byte for byte
+	data, err := json.Marshal(f.revs)
+	if err != nil {
+		logWarn("revisions: %v", err)
+		return
+	}
+	// Written aside and renamed, like deploys
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		logWarn("revisions: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		os.Remove(tmp)
+		logWarn("revisions: %v", err)
+	}
+}
+
+// storeRevision records the config p runs as the newest revision of its
+// service, unless it's that already, and forgets the revisions before the
+// last keep: in the state store if there is one, or else in file (if not
+// nil). Caller must hold p.mu.
+//
+// KEY CONCEPT: Revisions of a service
+// "It worked yesterday" is only useful if yesterday's definition of the
+// service can be found again. Between config edits, reloads and deploys,
+// the one that ran last week is in nobody's editor, and git holds the
+// config file, not what gosv made of it once deploys replaced commands.
+// So gosv keeps what each service actually ran - its config entry with
+// the group defaults applied and the deployed command in place - as
+// numbered revisions, like Kubernetes keeps ReplicaSets for `kubectl
+// rollout undo`. A revision is only added when that definition changes,
+// so restarts and reloads that change nothing don't push the good ones
+// out, and the store keeps the last state_revisions of them per service.
+func storeRevision(p *Process, source string, keep int, file *revisionFile) {
+	st := stateStore.Load()
+	if (st == nil && file == nil) || p.job != nil || p.configHash == "" {
+		return
+	}
+	config, err := p.effectiveConfig()
+	if err != nil {
+		return
+	}
+	if keep <= 0 {
+		keep = DefaultStateRevisions
+	}
+	if st == nil {
+		revs := file.revs[p.Name]
+		number := 1
+		if n := len(revs); n > 0 {
+			if string(revs[n-1].Config) == string(config) {
+				return
+			}
+			number = revs[n-1].Revision + 1
+		}
+		revs = append(revs, fileRevision{Revision: number, Time: p.now(), Source: source, Config: config})
+		file.revs[p.Name], file.changed = revs[max(len(revs)-keep, 0):], true
+		return
+	}
+	// Numbered and compared with the newest in SQL, since what's queued
+	// before it isn't written yet
+	st.add(`INSERT INTO revisions (service, revision, time, source, config)
+SELECT ?, COALESCE((SELECT MAX(revision) FROM revisions WHERE service = ?), 0) + 1, ?, ?, ?
+WHERE NOT EXISTS (SELECT 1 FROM revisions WHERE service = ? AND config = ?
+	AND revision = (SELECT MAX(revision) FROM revisions WHERE service = ?))`,
+		p.Name, p.Name, p.now().UnixMilli(), source, string(config), p.Name, string(config), p.Name)
+	st.add("DELETE FROM revisions WHERE service = ? AND revision <= (SELECT MAX(revision) FROM revisions WHERE service = ?) - ?",
+		p.Name, p.Name, keep)
+}
+
+// storeRevisions records the configs procs run as revisions: from the
+// config, unless a deploy or rollback put them in place. Called at start,
+// once the store is open, and after every reload.
+func (s *Supervisor) storeRevisions(procs []*Process) {
+	s.mu.RLock()
+	keep := s.stateRevisions
+	s.mu.RUnlock()
+	s.deployMu.Lock()
+	defer s.deployMu.Unlock()
+	file := s.openRevisions()
+	for _, p := range procs {
+		source := RevisionConfig
+		if rec, ok := s.deploys[p.Name]; ok {
+			source = rec.source()
+		}
+		p.mu.Lock()
+		storeRevision(p, source, keep, file)
+		p.mu.Unlock()
+	}
+	s.saveRevisions(file)
+}
+
+// revisions returns the revisions of service kept in the state store, or
+// else in the revisions file, newest first
+func (s *Supervisor) revisions(service string) ([]revision, error) {
+	st := stateStore.Load()
+	if st == nil {
+		s.deployMu.Lock()
+		path := s.deployCfg.StateFile
+		s.deployMu.Unlock()
+		if path == "" {
+			return nil, errNoRevisions
+		}
+		var revs []revision
+		for _, r := range slices.Backward(readRevisions(revisionsPath(path))[service]) {
+			revs = append(revs, revision{Number: r.Revision, Time: r.Time, Source: r.Source, Config: r.Config})
+		}
+		return revs, nil
+	}
+	rows, err := st.db.Query("SELECT revision, time, source, config FROM revisions WHERE service = ? ORDER BY revision DESC",
+		service)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var revs []revision
+	for rows.Next() {
+		var r revision
+		var t int64
+		var config string
+		if err := rows.Scan(&r.Number, &t, &r.Source, &config); err != nil {
+			return nil, err
+		}
+		r.Time, r.Config = time.UnixMilli(t), json.RawMessage(config)
+		revs = append(revs, r)
+	}
+	return revs, rows.Err()
+}
+
+// runningRevision returns the index in revs of the revision p runs, -1
+// if it's not among them
+func runningRevision(p *Process, revs []revision) int {
+	p.mu.Lock()
+	config, err := p.effectiveConfig()
+	p.mu.Unlock()
+	if err != nil {
+		return -1
+	}
+	for i, r := range revs {
+		if string(r.Config) == string(config) {
+			return i
+		}
+	}
+	return -1
+}
+
+// rollbackTarget returns the revision of p to roll back to: number, or
+// with 0 the newest one before the revision it runs
+func rollbackTarget(p *Process, revs []revision, number int) (revision, error) {
+	running := runningRevision(p, revs)
+	if number == 0 {
+		for i := running + 1; i < len(revs); i++ {
+			if running < 0 || string(revs[i].Config) != string(revs[running].Config) {
+				return revs[i], nil
+			}
+		}
+		return revision{}, fmt.Errorf("rollback: %s has no earlier revision", p.Name)
+	}
+	for i, r := range revs {
+		if r.Number != number {
+			continue
+		}
+		if i == running {
+			return revision{}, fmt.Errorf("rollback: %s runs revision %d already", p.Name, number)
+		}
+		return r, nil
+	}
+	if len(revs) == 0 {
+		return revision{}, fmt.Errorf("rollback: no revisions of %s kept", p.Name)
+	}
+	return revision{}, fmt.Errorf("rollback: no revision %d of %s, kept are %d to %d", number, p.Name,
+		revs[len(revs)-1].Number, revs[0].Number)
+}
+
+// restoreRevision puts revision number of the service name, whose config
+// is svc, in place of the one it runs, restarting it like a reload would.
+// It stays in place, like a deploy, until the service's config entry
+// changes - unless it's what that entry says, which then takes over
+// again. It runs in the main loop.
+func (s *Supervisor) restoreRevision(name string, number int, svc json.RawMessage) error {
+	p, err := s.lookup(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case p.job != nil:
+		return fmt.Errorf("rollback: %s is a job", p.Name)
+	case p.isMain() || p.Foreground:
+		return fmt.Errorf("rollback: %s is the main or a foreground service, which reloads leave alone", p.Name)
+	}
+	if _, err := buildService(s.configData, svc); err != nil {
+		return fmt.Errorf("rollback: revision %d of %s doesn't fit the config: %w", number, p.Name, err)
+	}
+	procs, err := parseConfig(s.configData)
+	if err != nil {
+		return fmt.Errorf("rollback: %w", err)
+	}
+	fromConfig := false
+	for _, q := range procs {
+		if q.Name == p.Name {
+			config, err := q.effectiveConfig() // Not shared yet, no lock needed
+			fromConfig = err == nil && string(config) == string(svc)
+		}
+	}
+
+	s.deployMu.Lock()
+	if s.deploying[p.Name] {
+		s.deployMu.Unlock()
+		return fmt.Errorf("rollback: a deploy or rolling restart of %s is in progress", p.Name)
+	}
+	if s.deploys == nil {
+		s.deploys = make(map[string]deployRecord)
+	}
+	rec := deployRecord{Service: svc, Config: configDigest(p), Via: RevisionRollback, Revision: number,
+		At: s.clock.Now()}
+	if old, ok := s.deploys[p.Name]; ok {
+		rec.Config = old.Config // p runs old, not its config entry
+	}
+	rec.Command = revision{Config: svc}.command()
+	p.mu.Lock()
+	rec.Previous = commandLine(p.definition())
+	p.mu.Unlock()
+	if fromConfig {
+		delete(s.deploys, p.Name)
+	} else {
+		s.deploys[p.Name] = rec
+	}
+	s.deployMu.Unlock()
+
+	s.applyDeploys(procs, s.configData)
+	s.deployMu.Lock()
+	s.writeDeploys()
+	s.deployMu.Unlock()
+	s.replaceServices(procs, "rollback")
+
+	logInfo("rolled %s back to revision %d (%s)", p.Name, number, rec.Command)
+	if q, err := s.lookup(p.Name); err == nil {
+		s.mu.RLock()
+		keep := s.stateRevisions
+		s.mu.RUnlock()
+		s.deployMu.Lock()
+		file := s.openRevisions()
+		q.mu.Lock()
+		storeRevision(q, rec.source(), keep, file)
+		q.noteEvent(EventRollback, "rolled back to revision %d (%s)", number, rec.Command)
+		q.mu.Unlock()
+		s.saveRevisions(file)
+		s.deployMu.Unlock()
+	}
+	return nil
+}
+
+// serveRevisions answers `gosv ctl revisions` and `gosv ctl rollback`.
+// Revisions are read from the store on the connection's goroutine, and a
+// rollback is then done in the main loop.
+func (s *Supervisor) serveRevisions(conn net.Conn, req ctlRequest) {
+	reply := func() ctlReply {
+		if len(req.Args) != 1 {
+			if req.Command == "rollback" {
+				return ctlReply{Error: "rollback: usage: rollback <service> [revision]"}
+			}
+			return ctlReply{Error: "revisions: usage: revisions <service>"}
+		}
+		p, err := s.lookup(req.Args[0])
+		if err != nil {
+			return ctlReply{Error: err.Error()}
+		}
+		revs, err := s.revisions(p.Name)
+		if err != nil {
+			return ctlReply{Error: req.Command + ": " + err.Error()}
+		}
+		if req.Command == "revisions" {
+			return ctlReply{Output: revisionsTable(p, revs)}
+		}
+		target, err := rollbackTarget(p, revs, req.Revision)
+		if err != nil {
+			return ctlReply{Error: err.Error()}
+		}
+		reply := s.callMain(ctlRequest{Command: "rollback", Args: req.Args, Revision: target.Number,
+			Service: target.Config})
+		if reply.Error == "" {
+			reply.Output = fmt.Sprintf("%s: rolled back to revision %d (%s), restarted\n", p.Name, target.Number,
+				target.command())
+		}
+		return reply
+	}()
+	json.NewEncoder(conn).Encode(reply)
+}
+
+// revisionsTable lists revs, marking the one p runs, like:
+//
+//	REV  TIME                 SOURCE  COMMAND
+//	3    2026-10-16 02:00:00  deploy  /srv/app/v2 --port 80  (running)
+func revisionsTable(p *Process, revs []revision) string {
+	if len(revs) == 0 {
+		return fmt.Sprintf("no revisions of %s kept yet\n", p.Name)
+	}
+	running := runningRevision(p, revs)
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REV\tTIME\tSOURCE\tCOMMAND")
+	for i, r := range revs {
+		line := r.command()
+		if i == running {
+			line += "  (running)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", r.Number, r.Time.Local().Format("2006-01-02 15:04:05"), r.Source, line)
+	}
+	w.Flush()
+	return b.String()
+}
+
+// ctlRollback is `gosv ctl rollback <service> [revision]` and `gosv ctl
+// revisions <service>`
+func ctlRollback(conn net.Conn, command string, args []string) error {
+	req := ctlRequest{Command: command, Args: args}
+	if command == "rollback" && len(args) == 2 {
+		n, err := strconv.Atoi(strings.TrimPrefix(args[1], "r"))
+		if err != nil || n < 1 {
+			return fmt.Errorf("rollback: bad revision %q", args[1])
+		}
+		req.Args, req.Revision = args[:1], n
+	}
+	reply, err := ctlCallReply(conn, req)
+	if err != nil {
+		return err
+	}
+	fmt.Print(reply.Output)
+	return nil
+}
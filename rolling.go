@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// RollingRestart restarts the target services (names, or "@group", see
+// resolve) and the services part of them one at a time: each must get
+// ready again, as for a deploy, before the next one goes down. It stops
+// at the first that doesn't, and leaves the others as they are. Services
+// that aren't running are left down.
+//
+// Named by the service they copy, replicas restart this way without
+// ever all being down at once (see replicas.go).
+func (s *Supervisor) RollingRestart(targets []string, progress func(string)) error {
+	var procs []*Process
+	seen := make(map[*Process]bool)
+	for _, target := range targets {
+		resolved, err := s.resolve(target)
+		if err != nil {
+			return fmt.Errorf("restart: %w", err)
+		}
+		for _, p := range s.withPartOf(resolved) {
+			if !seen[p] {
+				seen[p] = true
+				procs = append(procs, p)
+			}
+		}
+	}
+	for _, p := range procs {
+		switch {
+		case p.job != nil:
+			return fmt.Errorf("restart: %s is a job", p.Name)
+		case p.isMain():
+			return fmt.Errorf("restart: %s is the main service, its restart would end gosv", p.Name)
+		}
+	}
+	release, err := s.claimRollout(procs)
+	if err != nil {
+		return fmt.Errorf("restart: %w", err)
+	}
+	defer release()
+
+	for i, p := range procs {
+		p.mu.Lock()
+		running := p.state == StateRunning && !p.manualStop && !p.evicted && !p.frozen
+		p.mu.Unlock()
+		if !running {
+			progress(fmt.Sprintf("%s: not running, left down", p.Name))
+			continue
+		}
+		progress(fmt.Sprintf("%s: restarting", p.Name))
+		since := s.clock.Now()
+		s.restartNow(p)
+		if err := s.awaitDeployed(p, since); err != nil {
+			progress(fmt.Sprintf("%s: %v, stopping here", p.Name, err))
+			return fmt.Errorf("restart: %s: %v (%d more not restarted)", p.Name, err, len(procs)-i-1)
+		}
+		progress(fmt.Sprintf("%s: ready", p.Name))
+	}
+	return nil
+}
+
+// serveRollingRestart answers `gosv ctl restart --rolling`: it streams
+// the progress of the restart as replies, and ends with one that has
+// Done set. It runs on the connection's goroutine, like serveDeploy.
+func (s *Supervisor) serveRollingRestart(conn net.Conn, req ctlRequest) {
+	enc := json.NewEncoder(conn)
+	targets, err := s.rollingTargets(req.Args, req.Selector)
+	if err == nil {
+		err = s.RollingRestart(targets, func(line string) {
+			enc.Encode(ctlReply{Output: line})
+		})
+	}
+	reply := ctlReply{Done: true}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	enc.Encode(reply)
+}
+
+// rollingTargets returns the targets of a rolling restart: args, and the
+// services that match selector
+func (s *Supervisor) rollingTargets(args []string, selector string) ([]string, error) {
+	if selector != "" {
+		names, err := s.Select(selector)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no service matches %q", selector)
+		}
+		args = append(args, names...)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("restart: no service given")
+	}
+	return args, nil
+}
+
+// ctlRollingRestart is `gosv ctl restart --rolling <service|@group>...`:
+// it prints how the restart goes until it's over
+func ctlRollingRestart(conn net.Conn, req ctlRequest) error {
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(conn)
+	for {
+		var reply ctlReply
+		if err := dec.Decode(&reply); err != nil {
+			return fmt.Errorf("lost gosv before the restart ended: %w", err)
+		}
+		if !reply.Done {
+			fmt.Println(reply.Output)
+			continue
+		}
+		if reply.Error != "" {
+			return fmt.Errorf("%s", reply.Error)
+		}
+		return nil
+	}
+}
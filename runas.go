@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// RunAs is the user a process runs as, resolved from the user and group
+// databases
+type RunAs struct {
+	User   string
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32 // Supplementary groups
+	Home   string
+	Shell  string
+}
+
+// resolveRunAs looks up the user (a name or uid) a service runs as. group
+// overrides the user's primary group; extraGroups are added to the
+// supplementary groups the group database lists for the user.
+//
+// KEY CONCEPT: What a login sets up
+// A process's identity is more than a uid: it has a primary gid and a
+// list of supplementary gids, and file access checks any of them. A login
+// (or su -, or systemd's User=) calls initgroups(), which collects every
+// group in /etc/group (or NSS) naming the user as a member. Switching
+// only the uid and gid, as many supervisors do, silently drops those
+// memberships - the service then can't read the socket or log directory
+// its group was given. Programs also expect HOME, USER, LOGNAME and
+// SHELL to describe the user they run as, not the root that started them.
+func resolveRunAs(name, group string, extraGroups []string) (*RunAs, error) {
+	u, err := lookupUser(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &RunAs{User: u.Username, Home: u.HomeDir, Shell: loginShell(u.Username)}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: bad uid %q", name, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: bad gid %q", name, u.Gid)
+	}
+	r.Uid, r.Gid = uint32(uid), uint32(gid)
+
+	if group != "" {
+		if r.Gid, err = lookupGroup(group); err != nil {
+			return nil, err
+		}
+	}
+
+	// initgroups(): the primary group and every group listing the user
+	seen := map[uint32]bool{}
+	add := func(gid uint32) {
+		if !seen[gid] {
+			seen[gid] = true
+			r.Groups = append(r.Groups, gid)
+		}
+	}
+	add(r.Gid)
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if gid, err := strconv.ParseUint(id, 10, 32); err == nil {
+				add(uint32(gid))
+			}
+		}
+	}
+	for _, g := range extraGroups {
+		gid, err := lookupGroup(g)
+		if err != nil {
+			return nil, err
+		}
+		add(gid)
+	}
+	return r, nil
+}
+
+// lookupUser finds a user by name or uid. A uid without an entry in the
+// user database is allowed, as with systemd's User=.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		return &user.User{Uid: name, Gid: name, Username: name, HomeDir: "/"}, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: %w", name, err)
+	}
+	return u, nil
+}
+
+// lookupGroup finds a group by name or gid
+func lookupGroup(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("group %s: %w", name, err)
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("group %s: bad gid %q", name, g.Gid)
+	}
+	return uint32(gid), nil
+}
+
+// loginShell returns the user's shell from /etc/passwd (os/user doesn't
+// expose it), or /bin/sh
+func loginShell(name string) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return "/bin/sh"
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// name:passwd:uid:gid:gecos:home:shell
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == name && fields[6] != "" {
+			return fields[6]
+		}
+	}
+	return "/bin/sh"
+}
+
+// credential returns r as the credential a child is started with
+func (r *RunAs) credential() *syscall.Credential {
+	return &syscall.Credential{Uid: r.Uid, Gid: r.Gid, Groups: r.Groups}
+}
+
+// env returns the login environment variables for r (HOME comes with
+// the other defaults, see Process.environ)
+func (r *RunAs) env() []string {
+	return []string{"USER=" + r.User, "LOGNAME=" + r.User, "SHELL=" + r.Shell}
+}
+
+// helperArgs returns the exec helper options that switch to r
+func (r *RunAs) helperArgs() []string {
+	groups := make([]string, len(r.Groups))
+	for i, gid := range r.Groups {
+		groups[i] = strconv.FormatUint(uint64(gid), 10)
+	}
+	return []string{"-uid", strconv.FormatUint(uint64(r.Uid), 10),
+		"-gid", strconv.FormatUint(uint64(r.Gid), 10), "-groups", strings.Join(groups, ",")}
+}
+
+// dropPrivileges switches the exec helper to the user given by its
+// options. Groups go first: once the uid isn't 0, setgroups is denied.
+func dropPrivileges(uid, gid int, groups string) error {
+	var gids []int
+	for _, g := range strings.Split(groups, ",") {
+		if g == "" {
+			continue
+		}
+		n, err := strconv.Atoi(g)
+		if err != nil {
+			return fmt.Errorf("bad group %q", g)
+		}
+		gids = append(gids, n)
+	}
+	if err := syscall.Setgroups(gids); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	return nil
+}
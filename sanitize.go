@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// Where log_strip_ansi and log_squash_cr clean up output lines
+const (
+	LogCleanNever  = "never"  // Nowhere (the default)
+	LogCleanFiles  = "files"  // Sinks that aren't a terminal
+	LogCleanAlways = "always" // Terminals too
+)
+
+// validLogClean reports whether s is a known log_strip_ansi or
+// log_squash_cr value ("" for the default)
+func validLogClean(s string) bool {
+	return s == "" || s == LogCleanNever || s == LogCleanFiles || s == LogCleanAlways
+}
+
+// lineCleaner says how the lines of one sink are cleaned up
+type lineCleaner struct {
+	stripANSI bool
+	squashCR  bool
+}
+
+// cleanerFor returns the cleaning of p's output for a sink that is a
+// terminal or not
+//
+// KEY CONCEPT: Terminal output in files
+// Programs write for the terminal they assume they have: colors and
+// cursor movements as ANSI escape sequences (ESC [ ... m), progress bars
+// that redraw a line by going back to its start with a carriage return.
+// A terminal interprets both, and its user sees a green "ok" and one
+// progress bar at 100%. Written to a file, the same bytes are "^[[32mok"
+// and every intermediate state of the bar on one line, which grep, log
+// shippers and people reading the file all trip over. Cleaning up is a
+// question of where the line goes, not of the service: the same line can
+// go to an interactive console and to a file. With "files" gosv only
+// cleans up lines for sinks that aren't terminals - a console redirected
+// to a file (like --daemon's log) or a pipe, and the output in a
+// diagnostics bundle - and the console keeps its colors.
+func (p *Process) cleanerFor(terminal bool) lineCleaner {
+	applies := func(mode string) bool {
+		return mode == LogCleanAlways || mode == LogCleanFiles && !terminal
+	}
+	return lineCleaner{stripANSI: applies(p.LogStripANSI), squashCR: applies(p.LogSquashCR)}
+}
+
+// isTerminalSink reports whether w is a terminal
+func isTerminalSink(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && isTerminal(f)
+}
+
+// clean returns line cleaned up. squashCR keeps what follows the last
+// carriage return, which is what a terminal ends up showing of a line
+// that is redrawn. stripANSI removes escape sequences (CSI, like colors
+// and cursor movements; OSC, like window titles; and two-byte ones) and
+// every other control character but tab.
+func (c lineCleaner) clean(line []byte) []byte {
+	if !c.stripANSI && !c.squashCR {
+		return line
+	}
+	if c.squashCR {
+		for i := len(line) - 1; i >= 0; i-- {
+			if line[i] == '\r' {
+				line = line[i+1:]
+				break
+			}
+		}
+	}
+	if !c.stripANSI {
+		return line
+	}
+
+	out := make([]byte, 0, len(line))
+	for i := 0; i < len(line); i++ {
+		b := line[i]
+		switch {
+		case b == 0x1b && i+1 < len(line) && line[i+1] == '[':
+			// CSI: parameters and intermediates, up to a final byte
+			i += 2
+			for i < len(line) && (line[i] < 0x40 || line[i] > 0x7e) {
+				i++
+			}
+		case b == 0x1b && i+1 < len(line) && line[i+1] == ']':
+			// OSC: up to BEL or ESC \
+			i += 2
+			for i < len(line) && line[i] != 0x07 && !(line[i] == 0x1b && i+1 < len(line) && line[i+1] == '\\') {
+				i++
+			}
+			if i < len(line) && line[i] == 0x1b {
+				i++
+			}
+		case b == 0x1b:
+			i++ // Two-byte sequence, like ESC 7 (save cursor)
+		case b == '\t':
+			out = append(out, b)
+		case b < 0x20 || b == 0x7f:
+			// Other control characters, \r if not squashed included
+		default:
+			out = append(out, b)
+		}
+	}
+	return out
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestLineCleanerClean(t *testing.T) {
+	strip := lineCleaner{stripANSI: true}
+	squash := lineCleaner{squashCR: true}
+	both := lineCleaner{stripANSI: true, squashCR: true}
+	tests := []struct {
+		name    string
+		cleaner lineCleaner
+		line    string
+		want    string
+	}{
+		{"nothing to do", lineCleaner{}, "\x1b[32mok\x1b[0m\r", "\x1b[32mok\x1b[0m\r"},
+		{"color", strip, "\x1b[32mok\x1b[0m done", "ok done"},
+		{"cursor movement", strip, "\x1b[2K\x1b[1Gloading", "loading"},
+		{"OSC ended by BEL", strip, "\x1b]0;my title\x07text", "text"},
+		{"OSC ended by ST", strip, "\x1b]0;my title\x1b\\text", "text"},
+		{"two-byte sequence", strip, "\x1b7saved\x1b8", "saved"},
+		{"tab kept", strip, "a\tb", "a\tb"},
+		{"control characters", strip, "a\x00b\x07c\x7fd\re", "abcde"},
+		{"truncated CSI", strip, "text\x1b[3", "text"},
+		{"trailing ESC", strip, "text\x1b", "text"},
+		{"progress bar", squash, "10%\r50%\r100%", "100%"},
+		{"no carriage return", squash, "plain", "plain"},
+		{"squash keeps colors", squash, "0%\r\x1b[32m100%\x1b[0m", "\x1b[32m100%\x1b[0m"},
+		{"both", both, "\x1b[33m10%\x1b[0m\r\x1b[32m100%\x1b[0m", "100%"},
+		{"ends in carriage return", both, "100%\r", ""},
+	}
+	for _, tt := range tests {
+		if got := string(tt.cleaner.clean([]byte(tt.line))); got != tt.want {
+			t.Errorf("%s: clean(%q) = %q, want %q", tt.name, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestCleanerFor(t *testing.T) {
+	tests := []struct {
+		mode     string
+		terminal bool
+		want     bool
+	}{
+		{"", false, false},
+		{LogCleanNever, false, false},
+		{LogCleanFiles, false, true},
+		{LogCleanFiles, true, false},
+		{LogCleanAlways, true, true},
+	}
+	for _, tt := range tests {
+		p := &Process{LogStripANSI: tt.mode, LogSquashCR: tt.mode}
+		c := p.cleanerFor(tt.terminal)
+		if c.stripANSI != tt.want || c.squashCR != tt.want {
+			t.Errorf("mode %q, terminal %v: cleaner %+v, want both %v", tt.mode, tt.terminal, c, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Scheduling policies from <linux/sched.h>
+const (
+	schedOther = 0
+	schedFIFO  = 1
+	schedRR    = 2
+	schedBatch = 3
+	schedIdle  = 5
+)
+
+// I/O priority classes from <linux/ioprio.h>
+const (
+	ioprioClassRT   = 1
+	ioprioClassBE   = 2
+	ioprioClassIdle = 3
+
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1
+)
+
+var schedPolicies = map[string]int{
+	"other": schedOther,
+	"fifo":  schedFIFO,
+	"rr":    schedRR,
+	"batch": schedBatch,
+	"idle":  schedIdle,
+}
+
+// Sched is a CPU scheduling policy and I/O priority for a process
+//
+// KEY CONCEPT: Scheduling classes
+// The default policy (SCHED_OTHER, CFS/EEVDF) shares the CPU fairly,
+// weighted by nice value. SCHED_BATCH is the same but assumes the task is
+// CPU-bound and not interactive, so it is preempted less eagerly and never
+// gets a wakeup boost. SCHED_IDLE only runs when nothing else wants the
+// CPU - right for backups. SCHED_FIFO and SCHED_RR are real-time: a
+// runnable RT task always preempts every normal task, so a busy-looping
+// one can starve the machine (the kernel keeps 5% back for others via
+// sched_rt_runtime_us). Disk I/O has separate classes (ionice): idle only
+// gets the disk when no one else uses it; realtime always goes first.
+type Sched struct {
+	Policy   int // schedOther, schedBatch, ...; -1 leaves it alone
+	Priority int // 1-99 for fifo and rr
+
+	IOClass int // ioprioClass*; 0 leaves it alone
+	IOLevel int // 0 (highest) - 7 for realtime and best-effort
+}
+
+// parseSched builds a Sched from the sched_policy, sched_priority and
+// ionice settings of a service. It returns nil if none is set.
+func parseSched(policy string, priority int, ionice string) (*Sched, error) {
+	if policy == "" && priority == 0 && ionice == "" {
+		return nil, nil
+	}
+	s := &Sched{Policy: -1}
+	if policy != "" {
+		pol, ok := schedPolicies[policy]
+		if !ok {
+			return nil, fmt.Errorf("unknown sched_policy %q (want other, batch, idle, fifo or rr)", policy)
+		}
+		s.Policy = pol
+	}
+	realtime := s.Policy == schedFIFO || s.Policy == schedRR
+	switch {
+	case realtime && (priority < 1 || priority > 99):
+		return nil, fmt.Errorf("sched_policy %s needs a sched_priority of 1-99", policy)
+	case !realtime && priority != 0:
+		return nil, fmt.Errorf("sched_priority only applies to fifo and rr")
+	}
+	s.Priority = priority
+
+	if ionice != "" {
+		class, level, hasLevel := strings.Cut(ionice, ":")
+		switch class {
+		case "realtime":
+			s.IOClass = ioprioClassRT
+		case "best-effort":
+			s.IOClass = ioprioClassBE
+		case "idle":
+			s.IOClass = ioprioClassIdle
+		default:
+			return nil, fmt.Errorf("unknown ionice class %q (want idle, best-effort[:N] or realtime[:N])", class)
+		}
+		s.IOLevel = 4 // The kernel's default level
+		if hasLevel {
+			n, err := strconv.Atoi(level)
+			if err != nil || n < 0 || n > 7 || s.IOClass == ioprioClassIdle {
+				return nil, fmt.Errorf("invalid ionice %q: the level is 0-7, and idle has none", ionice)
+			}
+			s.IOLevel = n
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// apply sets the policy and I/O priority on every thread of pid
+//
+// Both syscalls act on a single thread (a tid), and only threads created
+// afterwards inherit the setting, so we go through /proc/<pid>/task to
+// catch threads started before we got here.
+func (s *Sched) apply(pid int) error {
+	tids := []int{pid}
+	if entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid)); err == nil {
+		tids = tids[:0]
+		for _, e := range entries {
+			if tid, err := strconv.Atoi(e.Name()); err == nil {
+				tids = append(tids, tid)
+			}
+		}
+	}
+
+	for _, tid := range tids {
+		if s.Policy >= 0 {
+			param := struct{ priority int32 }{int32(s.Priority)}
+			_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER,
+				uintptr(tid), uintptr(s.Policy), uintptr(unsafe.Pointer(&param)))
+			if errno != 0 && errno != syscall.ESRCH {
+				return fmt.Errorf("sched_setscheduler: %w", errno)
+			}
+		}
+		if s.IOClass != 0 {
+			ioprio := s.IOClass<<ioprioClassShift | s.IOLevel
+			_, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET,
+				ioprioWhoProcess, uintptr(tid), uintptr(ioprio))
+			if errno != 0 && errno != syscall.ESRCH {
+				return fmt.Errorf("ioprio_set: %w", errno)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// timeWindow is a daily window in local time, e.g. "02:00-04:30".
+// A window whose end is before its start wraps around midnight.
+type timeWindow struct {
+	start, end int // minutes since midnight
+}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (want HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseWindow parses "HH:MM-HH:MM"
+func parseWindow(s string) (timeWindow, error) {
+	var w timeWindow
+	if len(s) != len("00:00-00:00") || s[5] != '-' {
+		return w, fmt.Errorf("invalid window %q (want HH:MM-HH:MM)", s)
+	}
+	var err error
+	if w.start, err = parseClock(s[:5]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(s[6:]); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+func minuteOfDay(t time.Time) int {
+	return t.Hour()*60 + t.Minute()
+}
+
+// contains reports whether t falls inside the window
+func (w timeWindow) contains(t time.Time) bool {
+	m := minuteOfDay(t)
+	if w.start <= w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end // Wraps midnight
+}
+
+// nextAt returns the next time after now that the clock shows minute m
+func nextAt(now time.Time, m int) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	next := midnight.Add(time.Duration(m) * time.Minute)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// inWindow reports whether t is inside any of the windows
+func inWindow(windows []timeWindow, t time.Time) bool {
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextWindowOpen returns when the earliest of the windows opens next
+func nextWindowOpen(windows []timeWindow, now time.Time) time.Time {
+	var next time.Time
+	for _, w := range windows {
+		t := nextAt(now, w.start)
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// deferRestart checks p's restart windows. If now is outside all of them,
+// it queues the restart for when the next window opens and returns true.
+// Caller must hold p.mu.
+//
+// Restart windows are for services where an unplanned restart during
+// business hours is worse than staying down (e.g. a batch importer that
+// would lock tables) - crash restarts only happen inside a window.
+func (s *Supervisor) deferRestart(p *Process, now time.Time) bool {
+	if len(p.RestartWindows) == 0 || inWindow(p.RestartWindows, now) {
+		p.restartDeferred = false
+		return false
+	}
+	if p.restartDeferred {
+		return true // Already queued
+	}
+	p.restartDeferred = true
+
+	open := nextWindowOpen(p.RestartWindows, now)
+	logInfo("restart of %s deferred until %s (outside restart window)",
+		p.Name, open.Format("15:04"))
+	s.clock.AfterFunc(open.Sub(now), s.wakeRestarts)
+	return true
+}
+
+// wakeRestarts makes the supervisor loop re-evaluate restarts
+func (s *Supervisor) wakeRestarts() {
+	select {
+	case s.reapChan <- struct{}{}:
+	default:
+	}
+}
+
+// schedulePlannedRestarts arms a daily timer for every process with a
+// PlannedRestart time (e.g. a nightly restart at 03:00)
+func (s *Supervisor) schedulePlannedRestarts() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.processes {
+		if p.PlannedRestart != "" {
+			s.schedulePlannedRestart(p)
+		}
+	}
+}
+
+func (s *Supervisor) schedulePlannedRestart(p *Process) {
+	m, err := parseClock(p.PlannedRestart)
+	if err != nil {
+		logWarn("%s: planned restart: %v", p.Name, err)
+		return
+	}
+	now := s.clock.Now()
+	next := nextAt(now, m)
+	s.clock.AfterFunc(next.Sub(now), func() {
+		s.mu.RLock()
+		stopping := s.shuttingDown
+		s.mu.RUnlock()
+		if stopping || !s.registered(p) {
+			return // Replaced or removed by a reload, or shutting down
+		}
+		// Stopped, evicted or bound down: skip today's restart, but keep
+		// the schedule for when it is started again
+		if s.mayStart(p) {
+			logInfo("planned restart of %s", p.Name)
+			s.RestartProcess(p)
+		} else {
+			logInfo("skipping the planned restart of %s, it is held down", p.Name)
+		}
+		s.schedulePlannedRestart(p)
+	})
+}
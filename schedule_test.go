@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		clock   string
+		want    int
+		wantErr bool
+	}{
+		{"00:00", 0, false},
+		{"02:30", 150, false},
+		{"23:59", 23*60 + 59, false},
+		{"24:00", 0, true},
+		{"12:60", 0, true},
+		{"2:30", 150, false},
+		{"02:30:00", 0, true},
+		{"noon", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseClock(tt.clock)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseClock(%q) error = %v, want error %v", tt.clock, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseClock(%q) = %d, want %d", tt.clock, got, tt.want)
+		}
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		window  string
+		want    timeWindow
+		wantErr string
+	}{
+		{"02:00-04:30", timeWindow{start: 120, end: 270}, ""},
+		{"22:00-02:00", timeWindow{start: 22 * 60, end: 120}, ""},
+		{"02:00 04:30", timeWindow{}, "want HH:MM-HH:MM"},
+		{"2:00-4:30", timeWindow{}, "want HH:MM-HH:MM"},
+		{"02:00-25:00", timeWindow{}, "invalid time"},
+		{"", timeWindow{}, "want HH:MM-HH:MM"},
+	}
+	for _, tt := range tests {
+		got, err := parseWindow(tt.window)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseWindow(%q) error = %v, want one about %q", tt.window, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseWindow(%q) = %+v, %v, want %+v", tt.window, got, err, tt.want)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2026, 1, 1, hour, min, 0, 0, time.UTC)
+	}
+	night := timeWindow{start: 120, end: 270}       // 02:00-04:30
+	wrapped := timeWindow{start: 22 * 60, end: 120} // 22:00-02:00
+	tests := []struct {
+		w    timeWindow
+		t    time.Time
+		want bool
+	}{
+		{night, at(2, 0), true}, // The start is inside
+		{night, at(4, 29), true},
+		{night, at(4, 30), false}, // The end isn't
+		{night, at(1, 59), false},
+		{wrapped, at(23, 0), true},
+		{wrapped, at(0, 30), true},
+		{wrapped, at(2, 0), false},
+		{wrapped, at(12, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.w.contains(tt.t); got != tt.want {
+			t.Errorf("%+v contains %s = %v, want %v", tt.w, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestNextWindowOpen(t *testing.T) {
+	windows := []timeWindow{{start: 22 * 60, end: 120}, {start: 13 * 60, end: 14 * 60}}
+	tests := []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{testEpoch, testEpoch.Add(time.Hour)},                          // 12:00: today's 13:00
+		{testEpoch.Add(time.Hour), testEpoch.Add(10 * time.Hour)},      // 13:00 itself: 22:00 comes next
+		{testEpoch.Add(11 * time.Hour), testEpoch.Add(25 * time.Hour)}, // 23:00: tomorrow's 13:00
+	}
+	for _, tt := range tests {
+		if got := nextWindowOpen(windows, tt.now); !got.Equal(tt.want) {
+			t.Errorf("nextWindowOpen at %v = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestDeferRestart(t *testing.T) {
+	p := testProcess("importer")
+	p.RestartWindows = []timeWindow{{start: 13 * 60, end: 14 * 60}} // 13:00-14:00
+	s, c := newTestSupervisor(t, p)
+
+	p.mu.Lock()
+	deferred := s.deferRestart(p, c.Now())
+	again := s.deferRestart(p, c.Now())
+	p.mu.Unlock()
+	if !deferred || !again {
+		t.Fatalf("restart at 12:00 not deferred (%v, then %v)", deferred, again)
+	}
+
+	c.Advance(59 * time.Minute)
+	select {
+	case <-s.reapChan:
+		t.Fatal("woken before the window opened")
+	default:
+	}
+	c.Advance(time.Minute)
+	select {
+	case <-s.reapChan:
+	default:
+		t.Fatal("not woken when the window opened")
+	}
+	p.mu.Lock()
+	deferred = s.deferRestart(p, c.Now())
+	p.mu.Unlock()
+	if deferred || p.restartDeferred {
+		t.Error("restart at 13:00 deferred")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NotifyStatusInterval is how often gosv updates its STATUS= with
+// systemd, when it runs under a Type=notify unit
+const NotifyStatusInterval = 5 * time.Second
+
+// sdNotifier talks to the systemd that started gosv, over the socket in
+// NOTIFY_SOCKET. A nil *sdNotifier (not started by systemd) does nothing.
+type sdNotifier struct {
+	conn     *net.UnixConn
+	watchdog time.Duration // WATCHDOG_USEC, 0 without a watchdog
+	status   string        // Last STATUS= sent
+}
+
+// newSdNotifier connects to NOTIFY_SOCKET, or returns nil if systemd
+// didn't set it. It clears NOTIFY_SOCKET and the watchdog variables
+// either way, so services don't inherit them: systemd would take their
+// READY=1 or WATCHDOG=1 for gosv's.
+//
+// KEY CONCEPT: sd_notify
+// With Type=simple, systemd counts a service as started the moment it
+// has forked, and as healthy for as long as it hasn't exited. For a
+// supervisor that says little: gosv may still be starting its services,
+// or be running with half of them crash-looping, and `systemctl status`
+// shows "active (running)" all along. With Type=notify systemd passes a
+// datagram socket in NOTIFY_SOCKET, and the service reports on it in
+// lines of KEY=VALUE: READY=1 once it is up (until then `systemctl start`
+// waits, and units ordered After= it do too), STATUS= for a line that
+// `systemctl status` shows, STOPPING=1 when it begins to shut down, and
+// WATCHDOG=1 every so often if the unit has WatchdogSec=: systemd kills
+// a service whose watchdog goes quiet, and restarts it per Restart=.
+// libsystemd's sd_notify() does no more than that, so gosv speaks the
+// protocol itself.
+func newSdNotifier() *sdNotifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	usec := os.Getenv("WATCHDOG_USEC")
+	watchdogPid := os.Getenv("WATCHDOG_PID")
+	for _, env := range []string{"NOTIFY_SOCKET", "WATCHDOG_USEC", "WATCHDOG_PID"} {
+		os.Unsetenv(env)
+	}
+	if path == "" {
+		return nil
+	}
+	// An "@" address is in the abstract namespace; net takes it as is
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		logWarn("sd_notify: %v", err)
+		return nil
+	}
+	n := &sdNotifier{conn: conn}
+	// WATCHDOG_PID names the process the watchdog is meant for
+	if us, err := strconv.ParseInt(usec, 10, 64); err == nil && us > 0 &&
+		(watchdogPid == "" || watchdogPid == strconv.Itoa(os.Getpid())) {
+		n.watchdog = time.Duration(us) * time.Microsecond
+	}
+	logDebug("sd_notify: reporting to systemd on %s (watchdog %v)", path, n.watchdog)
+	return n
+}
+
+// send sends the state lines, e.g. "READY=1", in one datagram
+func (n *sdNotifier) send(state ...string) {
+	if n == nil {
+		return
+	}
+	if _, err := n.conn.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		logDebug("sd_notify: %v", err)
+	}
+}
+
+// interval returns how often update must be called: every
+// NotifyStatusInterval, or every half watchdog timeout if that's sooner
+func (n *sdNotifier) interval() time.Duration {
+	if n.watchdog > 0 && n.watchdog/2 < NotifyStatusInterval {
+		return n.watchdog / 2
+	}
+	return NotifyStatusInterval
+}
+
+// update pets the watchdog, and sends status if it changed
+func (n *sdNotifier) update(status string) {
+	if n == nil {
+		return
+	}
+	var state []string
+	if n.watchdog > 0 {
+		state = append(state, "WATCHDOG=1")
+	}
+	if status != n.status {
+		state = append(state, "STATUS="+status)
+		n.status = status
+	}
+	if len(state) > 0 {
+		n.send(state...)
+	}
+}
+
+// ready tells systemd that gosv has started its services
+func (n *sdNotifier) ready(status string) {
+	if n == nil {
+		return
+	}
+	n.status = status
+	n.send("READY=1", "STATUS="+status)
+}
+
+// close closes the socket
+func (n *sdNotifier) close() {
+	if n != nil {
+		n.conn.Close()
+	}
+}
+
+// healthSummary is the one line gosv reports as its STATUS=, e.g. "12/12
+// services running", followed by the services that aren't healthy. Jobs
+// are left out.
+func (s *Supervisor) healthSummary() string {
+	running, total := 0, 0
+	var unhealthy []string
+	for _, p := range s.snapshot() {
+		p.mu.Lock()
+		if p.job == nil {
+			total++
+			if p.state == StateRunning {
+				running++
+			}
+			if !p.healthy() {
+				unhealthy = append(unhealthy, p.Name)
+			}
+		}
+		p.mu.Unlock()
+	}
+	summary := fmt.Sprintf("%d/%d services running", running, total)
+	if len(unhealthy) > 0 {
+		sort.Strings(unhealthy)
+		summary += ", not healthy: " + strings.Join(unhealthy, ", ")
+	}
+	return summary
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// labelKeyPattern matches valid label keys, e.g. "tier" or "team.io/owner"
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_./-]+$`)
+
+// validServiceLabels checks the labels of a service
+func validServiceLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("invalid label key %q", k)
+		}
+		if strings.ContainsAny(v, ",=") {
+			return fmt.Errorf("label %s: value %q can't contain ',' or '='", k, v)
+		}
+	}
+	return nil
+}
+
+// selectorTerm is one condition of a Selector
+type selectorTerm struct {
+	key, value string
+	op         string // "=", "!=", "exists" or "!exists"
+}
+
+// Selector picks services by their labels. All terms must match.
+//
+// KEY CONCEPT: Labels and selectors
+// Names identify one service and groups are fixed in the config, but
+// questions about a fleet cut across both: "everything team payments
+// owns", "all canaries". Labels are free-form key/value pairs attached
+// to a service; a selector is a query over them, in the syntax
+// Kubernetes made familiar: "tier=web,env!=staging,canary" (has the
+// label), "!canary" (doesn't).
+type Selector []selectorTerm
+
+// parseSelector parses a comma-separated selector
+func parseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		var t selectorTerm
+		switch {
+		case term == "":
+			return nil, fmt.Errorf("selector %q: empty term", s)
+		case strings.Contains(term, "!="):
+			t.key, t.value, _ = strings.Cut(term, "!=")
+			t.op = "!="
+		case strings.Contains(term, "="):
+			t.key, t.value, _ = strings.Cut(term, "=")
+			t.op = "="
+		case strings.HasPrefix(term, "!"):
+			t.key, t.op = term[1:], "!exists"
+		default:
+			t.key, t.op = term, "exists"
+		}
+		t.key, t.value = strings.TrimSpace(t.key), strings.TrimSpace(t.value)
+		if !labelKeyPattern.MatchString(t.key) {
+			return nil, fmt.Errorf("selector %q: invalid label key %q", s, t.key)
+		}
+		sel = append(sel, t)
+	}
+	return sel, nil
+}
+
+// Matches reports whether labels satisfy every term of sel
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, t := range sel {
+		v, ok := labels[t.key]
+		switch t.op {
+		case "=":
+			if !ok || v != t.value {
+				return false
+			}
+		case "!=":
+			if ok && v == t.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Select returns the names of the services whose labels match selector,
+// sorted
+func (s *Supervisor) Select(selector string) ([]string, error) {
+	sel, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var names []string
+	for name, p := range s.processes {
+		if sel.Matches(p.Labels) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// formatLabels returns labels as "k=v,k2=v2", sorted by key
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + labels[k]
+	}
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     Selector
+		wantErr  string
+	}{
+		{"tier=web", Selector{{key: "tier", value: "web", op: "="}}, ""},
+		{"env!=staging", Selector{{key: "env", value: "staging", op: "!="}}, ""},
+		{"canary", Selector{{key: "canary", op: "exists"}}, ""},
+		{"!canary", Selector{{key: "canary", op: "!exists"}}, ""},
+		{" tier = web , team.io/owner ", Selector{{key: "tier", value: "web", op: "="}, {key: "team.io/owner", op: "exists"}}, ""},
+		{"tier=", Selector{{key: "tier", value: "", op: "="}}, ""},
+		{"", nil, "empty term"},
+		{"tier=web,", nil, "empty term"},
+		{"=web", nil, "invalid label key"},
+		{"ti er=web", nil, "invalid label key"},
+		{"!", nil, "invalid label key"},
+	}
+	for _, tt := range tests {
+		got, err := parseSelector(tt.selector)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseSelector(%q) error = %v, want one about %q", tt.selector, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSelector(%q): unexpected error: %v", tt.selector, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseSelector(%q) = %v, want %v", tt.selector, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseSelector(%q)[%d] = %+v, want %+v", tt.selector, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"tier": "web", "env": "prod", "canary": ""}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"tier=web", true},
+		{"tier=db", false},
+		{"env!=staging", true},
+		{"env!=prod", false},
+		{"team!=payments", true}, // A missing label isn't equal to anything
+		{"canary", true},
+		{"!canary", false},
+		{"owner", false},
+		{"!owner", true},
+		{"tier=web,env=prod,canary", true},
+		{"tier=web,env=staging", false},
+	}
+	for _, tt := range tests {
+		sel, err := parseSelector(tt.selector)
+		if err != nil {
+			t.Fatalf("parseSelector(%q): %v", tt.selector, err)
+		}
+		if got := sel.Matches(labels); got != tt.want {
+			t.Errorf("%q matches %v = %v, want %v", tt.selector, labels, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SelfLimits bound gosv's own resource use (the top-level "supervisor"
+// config object)
+//
+// KEY CONCEPT: Protecting the workloads from their supervisor
+// gosv is one more process on the host, and it can misbehave like any
+// other: a log pipeline that buffers too much, a leak in a long-running
+// loop. Unbounded, it competes with the services it supervises for
+// memory - and when the kernel's OOM killer picks a victim it goes by
+// size, so a big service may die for gosv's leak. Putting gosv in a
+// cgroup of its own with limits contains the damage to gosv. A low
+// oom_score_adj keeps the OOM killer away from gosv when the host runs
+// out of memory, since killing the supervisor orphans every service. The
+// two don't contradict: the cgroup limit is enforced inside gosv's own
+// cgroup, where gosv is the only candidate.
+type SelfLimits struct {
+	MemoryMB    int64 `json:"memory_mb"`
+	CPUPercent  int   `json:"cpu_percent"`
+	PidsMax     int   `json:"pids_max"`
+	OOMScoreAdj *int  `json:"oom_score_adj"` // -1000..1000; unset leaves it alone
+}
+
+var (
+	// supervisorCgroupPath is the leaf cgroup gosv moved itself into
+	// ("" if it didn't; see findWritableCgroupBase)
+	supervisorCgroupPath string
+
+	// selfLimited is set once gosv runs under cgroup limits of its own.
+	// Every service then gets a cgroup of its own too, so none is
+	// counted against the supervisor's limits.
+	selfLimited bool
+
+	// inheritedOOMScoreAdj is gosv's oom_score_adj before it lowered its
+	// own, restored on each child ("" while unchanged)
+	inheritedOOMScoreAdj string
+)
+
+// validate checks the limits from the config
+func (l *SelfLimits) validate() error {
+	if l.MemoryMB < 0 || l.CPUPercent < 0 || l.PidsMax < 0 {
+		return fmt.Errorf("supervisor: limits must not be negative")
+	}
+	if adj := l.OOMScoreAdj; adj != nil && (*adj < -1000 || *adj > 1000) {
+		return fmt.Errorf("supervisor: oom_score_adj %d is out of range -1000..1000", *adj)
+	}
+	return nil
+}
+
+// applySelfLimits puts gosv under the configured SelfLimits. Failures are
+// logged, not fatal: gosv still works without them.
+func (s *Supervisor) applySelfLimits() {
+	s.mu.RLock()
+	l := s.selfLimits
+	s.mu.RUnlock()
+	if l == nil {
+		return
+	}
+
+	if adj := l.OOMScoreAdj; adj != nil {
+		if err := setSelfOOMScoreAdj(*adj); err != nil {
+			logWarn("supervisor oom_score_adj: %v", err)
+		}
+	}
+
+	if l.MemoryMB == 0 && l.CPUPercent == 0 && l.PidsMax == 0 {
+		return
+	}
+	cg, err := selfCgroup()
+	if err != nil {
+		logWarn("supervisor limits not applied: %v", err)
+		return
+	}
+	limits := map[string]string{
+		"memory.max": "max",
+		"cpu.max":    "max 100000",
+		"pids.max":   "max",
+	}
+	if l.MemoryMB > 0 {
+		limits["memory.max"] = strconv.FormatInt(l.MemoryMB*1024*1024, 10)
+	}
+	if l.CPUPercent > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d 100000", l.CPUPercent*1000)
+	}
+	if l.PidsMax > 0 {
+		limits["pids.max"] = strconv.Itoa(l.PidsMax)
+	}
+	for file, value := range limits {
+		if err := os.WriteFile(filepath.Join(cg.path, file), []byte(value), 0644); err != nil {
+			logWarn("supervisor limits: %s: %v", file, err)
+		}
+	}
+	selfLimited = true
+	logInfo("supervisor limited to mem=%dMB, cpu=%d%%, pids=%d in %s", l.MemoryMB, l.CPUPercent, l.PidsMax, cg.path)
+}
+
+// selfCgroup returns gosv's own leaf cgroup, moving gosv into
+// <base>/supervisor first if findWritableCgroupBase didn't
+func selfCgroup() (*Cgroup, error) {
+	if supervisorCgroupPath != "" {
+		return &Cgroup{name: "supervisor", path: supervisorCgroupPath}, nil
+	}
+	cg, err := NewCgroup("supervisor")
+	if err != nil {
+		return nil, err
+	}
+	if err := cg.AddProcess(os.Getpid()); err != nil {
+		return nil, fmt.Errorf("move gosv to %s: %w", cg.path, err)
+	}
+	supervisorCgroupPath = cg.path
+	return cg, nil
+}
+
+// setSelfOOMScoreAdj sets gosv's oom_score_adj, remembering the old value
+// for its children (see resetOOMScoreAdj). Lowering it needs
+// CAP_SYS_RESOURCE.
+func setSelfOOMScoreAdj(adj int) error {
+	old, err := os.ReadFile("/proc/self/oom_score_adj")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(adj)), 0644); err != nil {
+		return err
+	}
+	if inheritedOOMScoreAdj == "" {
+		inheritedOOMScoreAdj = strings.TrimSpace(string(old))
+	}
+	logInfo("supervisor oom_score_adj set to %d", adj)
+	return nil
+}
+
+// resetOOMScoreAdj gives a child the oom_score_adj gosv had before
+// lowering its own - children inherit it, and a service must not be
+// shielded from the OOM killer along with its supervisor
+func resetOOMScoreAdj(pid int) {
+	if inheritedOOMScoreAdj == "" {
+		return
+	}
+	path := fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+	if err := os.WriteFile(path, []byte(inheritedOOMScoreAdj), 0644); err != nil {
+		logWarn("reset oom_score_adj of pid %d: %v", pid, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// egressHandle is the major number of the HTB qdisc gosv puts on the
+// egress interfaces, "6057:", and of the services' classes under it
+const egressHandle = 0x6057
+
+// egressShaper keeps the tc setup of egress_mbit: the interfaces it
+// shapes and the class of each service
+//
+// KEY CONCEPT: Shaping a service's traffic
+// Linux shapes outgoing traffic per interface: the queueing discipline
+// (qdisc) of eth0 decides which packet leaves next, and HTB's decides by
+// classes, each with a rate it may not exceed. What HTB needs to know is
+// which class a packet belongs to. With cgroup v1 the net_cls controller
+// tagged the packets of a cgroup's processes with a class id; cgroup v2
+// has no such controller, but lets a BPF program attached to the cgroup
+// see each packet its processes send (BPF_CGROUP_INET_EGRESS). gosv's
+// program writes the service's class id into the packet's priority,
+// which HTB takes as the class when it names one of its own. The service
+// needs no network namespace of its own, and its packets are limited
+// however many processes and sockets it has.
+type egressShaper struct {
+	mu         sync.Mutex
+	interfaces []string          // egress_interfaces; nil for those of the default routes
+	qdiscs     map[string]bool   // Interfaces gosv put its qdisc on
+	classes    map[string]uint16 // Class minor numbers, by service name
+}
+
+var egress = &egressShaper{qdiscs: make(map[string]bool), classes: make(map[string]uint16)}
+
+// validEgressInterfaces checks the names of egress_interfaces
+func validEgressInterfaces(ifaces []string) error {
+	for _, name := range ifaces {
+		if name == "" || len(name) > 15 || strings.ContainsAny(name, "/: \t\n") {
+			return fmt.Errorf("egress_interfaces: invalid interface name %q", name)
+		}
+	}
+	return nil
+}
+
+// configure sets the interfaces to shape. Services started from then on
+// are shaped on them; the running ones keep their classes until they
+// restart.
+func (sh *egressShaper) configure(ifaces []string) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.interfaces = ifaces
+}
+
+// devices returns the interfaces to shape. Caller must hold sh.mu.
+func (sh *egressShaper) devices() ([]string, error) {
+	if len(sh.interfaces) > 0 {
+		return sh.interfaces, nil
+	}
+	devs, err := defaultRouteInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	if len(devs) == 0 {
+		return nil, fmt.Errorf("no default route: set egress_interfaces")
+	}
+	return devs, nil
+}
+
+// shape limits the class of the service name to mbit on each interface,
+// putting gosv's HTB qdisc on the interfaces that don't have it yet, and
+// returns the class id. tc runs with reaping held by pids.
+func (sh *egressShaper) shape(pids *pidIndex, name string, mbit int) (uint32, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	devs, err := sh.devices()
+	if err != nil {
+		return 0, err
+	}
+	minor, ok := sh.classes[name]
+	if !ok {
+		if len(sh.classes) >= 0xfffe {
+			return 0, fmt.Errorf("out of HTB classes")
+		}
+		minor = uint16(len(sh.classes) + 1)
+		sh.classes[name] = minor
+	}
+	handle := fmt.Sprintf("%x:", egressHandle)
+	classid := fmt.Sprintf("%x:%x", egressHandle, minor)
+	rate := fmt.Sprintf("%dmbit", mbit)
+	for _, dev := range devs {
+		if !sh.qdiscs[dev] {
+			// One an earlier gosv left behind can't be replaced by
+			// another HTB qdisc: remove it. Without a default class,
+			// packets no service class claims are sent unshaped.
+			tc(pids, "qdisc", "del", "dev", dev, "root", "handle", handle)
+			if err := tc(pids, "qdisc", "replace", "dev", dev, "root", "handle", handle, "htb"); err != nil {
+				return 0, err
+			}
+			sh.qdiscs[dev] = true
+			logInfo("shaping egress of %s", dev)
+		}
+		if err := tc(pids, "class", "replace", "dev", dev, "parent", handle, "classid", classid, "htb", "rate", rate, "ceil", rate); err != nil {
+			return 0, err
+		}
+	}
+	return egressHandle<<16 | uint32(minor), nil
+}
+
+// teardown removes gosv's qdiscs, giving the interfaces back their
+// default ones. Called at shutdown.
+func (sh *egressShaper) teardown(pids *pidIndex) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for dev := range sh.qdiscs {
+		if err := tc(pids, "qdisc", "del", "dev", dev, "root", "handle", fmt.Sprintf("%x:", egressHandle)); err != nil {
+			logWarn("failed to remove the egress qdisc of %s: %v", dev, err)
+		}
+	}
+	clear(sh.qdiscs)
+	clear(sh.classes)
+}
+
+// describe returns the limit of mbit for --dry-run
+func (sh *egressShaper) describe(mbit int) string {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	devs, err := sh.devices()
+	if err != nil {
+		return fmt.Sprintf("egress: %d Mbit/s (not shaped: %v)", mbit, err)
+	}
+	return fmt.Sprintf("egress: %d Mbit/s out of %s (tc HTB)", mbit, strings.Join(devs, ", "))
+}
+
+// shapeEgress limits what p's processes in cg send to p.EgressMbit
+func (p *Process) shapeEgress(cg *Cgroup) error {
+	classid, err := egress.shape(p.pids, p.Name, p.EgressMbit)
+	if err != nil {
+		return err
+	}
+	return cg.setEgressClass(classid)
+}
+
+// tc runs tc(8) with args through pids
+func tc(pids *pidIndex, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	if out, err := pids.run(ctx, "", "tc", args...); err != nil {
+		return fmt.Errorf("tc %s: %w: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	bpfProgTypeCgroupSKB = 8    // BPF_PROG_TYPE_CGROUP_SKB
+	bpfCgroupInetEgress  = 1    // BPF_CGROUP_INET_EGRESS
+	bpfStxMemW           = 0x63 // *(u32 *)(dst + off) = src
+	skbPriority          = 32   // offsetof(struct __sk_buff, priority)
+)
+
+// egressClassifier returns a program that sets the priority of every
+// packet to classid, for HTB to put it in that class, and lets it through
+func egressClassifier(classid uint32) []bpfInsn {
+	const ctx, class = 1, 2
+	return []bpfInsn{
+		{code: bpfMov64K, regs: class, imm: int32(classid)},
+		{code: bpfStxMemW, regs: ctx | class<<4, off: skbPriority},
+		{code: bpfMov64K, regs: 0, imm: 1}, // allow
+		{code: bpfExitInsn},
+	}
+}
+
+// setEgressClass puts the packets the processes in the cgroup send in the
+// HTB class classid
+func (c *Cgroup) setEgressClass(classid uint32) error {
+	return c.attachBPF("egress classifier", "gosv_egress", bpfProgTypeCgroupSKB, bpfCgroupInetEgress, egressClassifier(classid))
+}
+
+// unshapeEgress detaches a classifier setEgressClass attached to the
+// cgroup for an earlier config. Without one, it does nothing.
+func (c *Cgroup) unshapeEgress() {
+	if c.detachBPF(bpfCgroupInetEgress) {
+		logDebug("removed the egress classifier of %s", c.path)
+	}
+}
+
+// defaultRouteInterfaces returns the interfaces of the IPv4 and IPv6
+// default routes of the main routing table
+func defaultRouteInterfaces() ([]string, error) {
+	var devs []string
+	add := func(dev string) {
+		if dev != "lo" && !slices.Contains(devs, dev) {
+			devs = append(devs, dev)
+		}
+	}
+
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if fields := strings.Fields(sc.Text()); len(fields) >= 8 && fields[1] == "00000000" && fields[7] == "00000000" {
+			add(fields[0])
+		}
+	}
+
+	// Destination PrefixLen Source PrefixLen NextHop Metric RefCnt Use Flags Iface
+	if f6, err := os.Open("/proc/net/ipv6_route"); err == nil {
+		defer f6.Close()
+		sc := bufio.NewScanner(f6)
+		for sc.Scan() {
+			if fields := strings.Fields(sc.Text()); len(fields) >= 10 && fields[0] == strings.Repeat("0", 32) && fields[1] == "00" {
+				add(fields[9])
+			}
+		}
+	}
+	return devs, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultLockTTL is how long a singleton's lock survives without renewal,
+// i.e. how long failover takes when the holder's host dies
+const DefaultLockTTL = 15 * time.Second
+
+// LeaderLock makes a service a fleet-wide singleton: of all the gosv
+// instances configured with the same lock, only the holder runs it
+//
+// KEY CONCEPT: Leases
+// A plain lock would stay taken forever if its holder crashed. Both Consul
+// (sessions) and etcd (leases) tie keys to a TTL that the holder must keep
+// renewing; when the holder stops renewing - crash, network partition -
+// the key goes away and another instance can take it. The holder must
+// stop the service as soon as it can't renew, before the TTL runs out,
+// or two instances could briefly run it at the same time.
+type LeaderLock struct {
+	Server string        // "consul://host:port" or "etcd://host:port"
+	Key    string        // Lock key, shared by all instances of the service
+	TTL    time.Duration // 0 = DefaultLockTTL
+}
+
+// leaderLock is the backend-specific part of holding a LeaderLock
+type leaderLock interface {
+	// acquire takes or renews the lock and reports whether we hold it
+	acquire() (bool, error)
+	// release gives the lock up so another instance can take over now
+	release()
+}
+
+func (l *LeaderLock) backend() leaderLock {
+	if strings.HasPrefix(l.Server, "etcd://") {
+		return &etcdLock{LeaderLock: l}
+	}
+	return &consulLock{LeaderLock: l}
+}
+
+func (l *LeaderLock) ttl() time.Duration {
+	if l.TTL > 0 {
+		return l.TTL
+	}
+	return DefaultLockTTL
+}
+
+// startLeading starts contending for p's lock
+func (s *Supervisor) startLeading(p *Process) {
+	logInfo("%s waiting for lock %s", p.Name, p.Lock.Key)
+	p.mu.Lock()
+	p.state = StateWaiting
+	p.mu.Unlock()
+	s.wg.Add(1)
+	go s.lead(p)
+}
+
+// lead contends for p's lock until p is removed or gosv shuts down. The
+// process is started when the lock is acquired and stopped when it's
+// lost; in between it waits in StateWaiting (see settleLeadership).
+func (s *Supervisor) lead(p *Process) {
+	defer s.wg.Done()
+	lock := p.Lock.backend()
+	ttl := p.Lock.ttl()
+	var lastRenew time.Time
+
+	for {
+		held, err := lock.acquire()
+		now := s.clock.Now()
+		if err != nil {
+			logWarn("%s: lock: %v", p.Name, err)
+		}
+
+		p.mu.Lock()
+		was := p.leader
+		if err != nil {
+			// Keep running until the lock could have expired
+			held = was && now.Sub(lastRenew) < ttl*2/3
+		} else if held {
+			lastRenew = now
+		}
+		p.leader = held
+		p.mu.Unlock()
+
+		switch {
+		case held && !was:
+			logInfo("%s: acquired lock %s, starting", p.Name, p.Lock.Key)
+			s.RestartProcess(p)
+		case !held && was:
+			logWarn("%s: lost lock %s, stopping", p.Name, p.Lock.Key)
+			p.kill(syscall.SIGTERM)
+		}
+
+		select {
+		case <-s.clock.After(ttl / 3):
+			if s.registered(p) {
+				continue
+			}
+		case <-s.stopped:
+		}
+		lock.release()
+		return
+	}
+}
+
+// settleLeadership keeps a stopped singleton waiting while another
+// instance holds its lock. Returns true if it was handled. Caller must
+// hold p.mu.
+func (p *Process) settleLeadership() bool {
+	if p.Lock == nil || p.leader {
+		return false
+	}
+	if p.state == StateStopped || p.state == StateFailed {
+		p.state = StateWaiting
+		p.restarts = 0
+	}
+	p.pendingRestart = false
+	return p.state == StateWaiting
+}
+
+// consulLock holds a Consul KV key through a session
+type consulLock struct {
+	*LeaderLock
+	session string
+}
+
+func (l *consulLock) acquire() (bool, error) {
+	if l.session != "" {
+		err := consulPut(l.Server, "/v1/session/renew/"+l.session, nil, nil)
+		if errors.Is(err, errNotFound) {
+			l.session = "" // Expired - start over with a new session
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if l.session == "" {
+		var out struct{ ID string }
+		err := consulPut(l.Server, "/v1/session/create", map[string]any{
+			"Name":      "gosv-" + l.Key,
+			"TTL":       l.ttl().String(),
+			"Behavior":  "delete",
+			"LockDelay": "0s",
+		}, &out)
+		if err != nil {
+			return false, err
+		}
+		l.session = out.ID
+	}
+
+	// Acquiring a key we already hold succeeds again
+	host, _ := os.Hostname()
+	var held bool
+	err := consulPut(l.Server, "/v1/kv/"+l.Key+"?acquire="+l.session, host, &held)
+	return held, err
+}
+
+func (l *consulLock) release() {
+	if l.session == "" {
+		return
+	}
+	consulPut(l.Server, "/v1/kv/"+l.Key+"?release="+l.session, nil, nil)
+	consulPut(l.Server, "/v1/session/destroy/"+l.session, nil, nil)
+	l.session = ""
+}
+
+// etcdLock holds an etcd key attached to a lease
+type etcdLock struct {
+	*LeaderLock
+	lease int64
+}
+
+func (l *etcdLock) acquire() (bool, error) {
+	if l.lease != 0 {
+		var out struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		err := etcdPost(l.Server, "/v3/lease/keepalive", map[string]any{"ID": l.lease}, &out)
+		if err != nil || out.Result.TTL == "" || out.Result.TTL == "0" {
+			l.lease = 0 // Expired - our key is gone with it
+		}
+	}
+	if l.lease == 0 {
+		var grant struct {
+			ID string `json:"ID"`
+		}
+		err := etcdPost(l.Server, "/v3/lease/grant", map[string]any{"TTL": int(l.ttl() / time.Second)}, &grant)
+		if err != nil {
+			return false, err
+		}
+		fmt.Sscanf(grant.ID, "%d", &l.lease)
+	}
+
+	// Create the key only if it doesn't exist; otherwise read it to see
+	// whether it is ours
+	key := base64.StdEncoding.EncodeToString([]byte(l.Key))
+	host, _ := os.Hostname()
+	txn := map[string]any{
+		"compare": []any{map[string]any{"target": "CREATE", "key": key, "create_revision": "0"}},
+		"success": []any{map[string]any{"request_put": map[string]any{
+			"key": key, "value": base64.StdEncoding.EncodeToString([]byte(host)), "lease": l.lease,
+		}}},
+		"failure": []any{map[string]any{"request_range": map[string]any{"key": key}}},
+	}
+	var out struct {
+		Succeeded bool `json:"succeeded"`
+		Responses []struct {
+			ResponseRange struct {
+				Kvs []struct {
+					Lease string `json:"lease"`
+				} `json:"kvs"`
+			} `json:"response_range"`
+		} `json:"responses"`
+	}
+	if err := etcdPost(l.Server, "/v3/kv/txn", txn, &out); err != nil {
+		return false, err
+	}
+	if out.Succeeded {
+		return true, nil
+	}
+	if len(out.Responses) > 0 && len(out.Responses[0].ResponseRange.Kvs) > 0 {
+		return out.Responses[0].ResponseRange.Kvs[0].Lease == fmt.Sprint(l.lease), nil
+	}
+	return false, nil
+}
+
+func (l *etcdLock) release() {
+	if l.lease != 0 {
+		etcdPost(l.Server, "/v3/lease/revoke", map[string]any{"ID": l.lease}, nil)
+		l.lease = 0
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot is the desired state of the services of a gosv at one time
+// (`gosv ctl snapshot`), to be reapplied later with `gosv ctl restore`
+type Snapshot struct {
+	Taken    time.Time         `json:"taken"`
+	Config   string            `json:"config,omitempty"`
+	Services []ServiceSnapshot `json:"services"`
+}
+
+// ServiceSnapshot is the desired state of one service: whether it should
+// be up, and the limits in effect
+type ServiceSnapshot struct {
+	Name       string `json:"name"`
+	Enabled    bool   `json:"enabled"` // False if stopped on request
+	MemoryMB   int64  `json:"memory_mb,omitempty"`
+	CPUPercent int    `json:"cpu_percent,omitempty"`
+}
+
+// Snapshot returns the desired state of every service, by name
+//
+// KEY CONCEPT: Desired state vs. actual state
+// A supervisor tracks two things about a service: what it is doing
+// (running, crashed, restarting in 5s) and what it should be doing. Only
+// the second is worth saving - the first changes by itself, and the
+// supervisor's whole job is to drive it towards the second. Before risky
+// maintenance an operator changes the second by hand: stops the workers
+// that write to the database being migrated, squeezes a batch job's CPU.
+// Undoing that from memory afterwards is where mistakes happen, so the
+// desired state is saved first and reapplied at the end, the way
+// Kubernetes reconciles against a manifest: restore compares each
+// service with its saved state and changes only what differs.
+func (s *Supervisor) Snapshot() Snapshot {
+	snap := Snapshot{Taken: s.clock.Now(), Config: s.configSource}
+	for _, p := range s.snapshot() {
+		if p.job != nil {
+			continue // Not part of the desired state
+		}
+		p.mu.Lock()
+		snap.Services = append(snap.Services, ServiceSnapshot{
+			Name:       p.Name,
+			Enabled:    !p.manualStop,
+			MemoryMB:   p.MemoryLimit >> 20,
+			CPUPercent: p.CPUQuota,
+		})
+		p.mu.Unlock()
+	}
+	sort.Slice(snap.Services, func(i, j int) bool { return snap.Services[i].Name < snap.Services[j].Name })
+	return snap
+}
+
+// Restore brings the services back to the desired state of snap and
+// returns what it changed (with dryRun, what it would change). Services
+// not configured anymore are skipped, and services not in snap are left
+// alone. Limits apply to the service's cgroup right away, and last until
+// a reload changes the service's config.
+func (s *Supervisor) Restore(snap Snapshot, dryRun bool) ([]string, error) {
+	var changes, stop, start []string
+	for _, want := range snap.Services {
+		p, err := s.lookup(want.Name)
+		if err != nil {
+			changes = append(changes, fmt.Sprintf("%s: not configured anymore, skipped", want.Name))
+			continue
+		}
+		p.mu.Lock()
+		enabled := !p.manualStop
+		memoryMB, cpuPercent := p.MemoryLimit>>20, p.CPUQuota
+		p.mu.Unlock()
+
+		if want.MemoryMB != memoryMB || want.CPUPercent != cpuPercent {
+			change := fmt.Sprintf("%s: memory_mb %d -> %d, cpu_percent %d -> %d", p.Name, memoryMB, want.MemoryMB,
+				cpuPercent, want.CPUPercent)
+			if !dryRun {
+				if later := p.setLimits(want.MemoryMB<<20, want.CPUPercent); later {
+					change += " (from its next start)"
+				}
+			}
+			changes = append(changes, change)
+		}
+		switch {
+		case enabled && !want.Enabled:
+			stop = append(stop, p.Name)
+			changes = append(changes, p.Name+": stop")
+		case !enabled && want.Enabled:
+			start = append(start, p.Name)
+			changes = append(changes, p.Name+": start")
+		}
+	}
+	if dryRun {
+		return changes, nil
+	}
+	// Stops first, so a service both part of a stopped one and enabled
+	// ends up started. Stop returns once they have their SIGTERM, and
+	// Start brings back one still on its way down once it's gone.
+	for _, name := range stop {
+		if err := s.Stop(name); err != nil {
+			return changes, err
+		}
+	}
+	for _, name := range start {
+		if err := s.Start(name); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+// ctlSnapshot is `gosv ctl snapshot [file]`: it saves the desired state
+// of the services to file, or prints it
+func ctlSnapshot(conn net.Conn, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("snapshot: usage: snapshot [file]")
+	}
+	reply, err := ctlCallReply(conn, ctlRequest{Command: "snapshot"})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(reply.Snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if len(args) == 0 || args[0] == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	// Written aside and renamed, so a failed write can't leave half a
+	// snapshot in place of a good one
+	tmp := args[0] + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, args[0]); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	fmt.Printf("saved the state of %d services to %s\n", len(reply.Snapshot.Services), args[0])
+	return nil
+}
+
+// ctlRestore is `gosv ctl restore [-n] <file>`: it reapplies a snapshot
+// and prints what changed, with -n only what would
+func ctlRestore(conn net.Conn, args []string) error {
+	req := ctlRequest{Command: "restore"}
+	if len(args) > 0 && (args[0] == "-n" || args[0] == "--dry-run") {
+		req.DryRun = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("restore: usage: restore [-n] <file>")
+	}
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	req.Snapshot = &Snapshot{}
+	if err := json.Unmarshal(data, req.Snapshot); err != nil {
+		return fmt.Errorf("restore: %s: %w", args[0], err)
+	}
+	reply, err := ctlCallReply(conn, req)
+	fmt.Print(reply.Output)
+	return err
+}
+
+// ctlCallReply sends req and returns the reply, its error as an error
+func ctlCallReply(conn net.Conn, req ctlRequest) (ctlReply, error) {
+	var reply ctlReply
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return reply, err
+	}
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return reply, fmt.Errorf("no reply: %w", err)
+	}
+	if reply.Error != "" {
+		return reply, fmt.Errorf("%s", reply.Error)
+	}
+	return reply, nil
+}
+
+// restoreOutput describes the changes of a restore for ctl
+func restoreOutput(snap *Snapshot, changes []string, dryRun bool) string {
+	var b strings.Builder
+	verb := "restored"
+	if dryRun {
+		verb = "would restore"
+	}
+	fmt.Fprintf(&b, "%s the snapshot of %s", verb, snap.Taken.Local().Format("2006-01-02 15:04:05"))
+	if len(changes) == 0 {
+		b.WriteString(": nothing to change\n")
+		return b.String()
+	}
+	b.WriteString(":\n")
+	for _, c := range changes {
+		fmt.Fprintf(&b, "  %s\n", c)
+	}
+	return b.String()
+}
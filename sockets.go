@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parseSocket splits an entry of sockets, "tcp://host:port" or
+// "unix:///path", into the network and the address to listen on
+func parseSocket(s string) (network, addr string, err error) {
+	network, addr, ok := strings.Cut(s, "://")
+	switch {
+	case !ok || addr == "":
+		return "", "", fmt.Errorf("%q: want tcp://host:port or unix:///path", s)
+	case network == "tcp":
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", "", fmt.Errorf("%q: %w", s, err)
+		}
+	case network == "unix":
+		if !filepath.IsAbs(addr) {
+			return "", "", fmt.Errorf("%q: socket path must be absolute", s)
+		}
+	default:
+		return "", "", fmt.Errorf("%q: unknown kind %q", s, network)
+	}
+	return network, addr, nil
+}
+
+// openSockets listens on p's sockets, the first time p starts, and keeps
+// them open for its later starts. Caller must hold p.mu.
+//
+// KEY CONCEPT: Socket activation
+// A service that opens its own listening socket closes it when it exits,
+// and until the next run opens it again, connecting clients are refused.
+// With socket activation the supervisor opens the socket and the service
+// inherits it, already listening, as fd 3 and up: LISTEN_FDS says how
+// many, and LISTEN_PID which process they are for, so a child that
+// inherits the environment doesn't take them for its own (the protocol of
+// systemd's sd_listen_fds(3), which many servers speak). The socket
+// outlives the service: connections that arrive during a restart wait in
+// its backlog instead of being refused. And since any number of
+// processes can accept on one socket, a new instance can take over from
+// the old one without a moment in which no one listens (see handoff.go).
+func (p *Process) openSockets() error {
+	if len(p.Sockets) == 0 || p.sockets != nil {
+		return nil
+	}
+	var files []*os.File
+	for _, s := range p.Sockets {
+		network, addr, _ := parseSocket(s) // Checked by parseConfig
+		f, err := listenFile(network, addr)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return fmt.Errorf("sockets: %w", err)
+		}
+		files = append(files, f)
+	}
+	p.sockets = files
+	return nil
+}
+
+// listenFile listens on addr and returns the listening socket as a file
+// to pass on
+func listenFile(network, addr string) (*os.File, error) {
+	if network == "unix" {
+		// Left over by an earlier run, it would fail the bind
+		if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := ln.(*net.UnixListener); ok {
+		u.SetUnlinkOnClose(false) // The file below still listens on it
+	}
+	// File returns a dup, which stays listening once ln is closed
+	f, err := ln.(interface{ File() (*os.File, error) }).File()
+	ln.Close()
+	return f, err
+}
+
+// passSockets gives p's sockets to the command about to start, as fds 3
+// and up. The exec helper sets LISTEN_PID (see helperArgs). Caller must
+// hold p.mu.
+func (p *Process) passSockets() {
+	if len(p.sockets) == 0 {
+		return
+	}
+	p.cmd.ExtraFiles = p.sockets
+	p.cmd.Env = append(p.cmd.Environ(), "LISTEN_FDS="+strconv.Itoa(len(p.sockets)))
+}
+
+// closeSockets closes p's sockets and removes its socket files
+func (p *Process) closeSockets() {
+	p.mu.Lock()
+	files := p.sockets
+	p.sockets = nil
+	p.mu.Unlock()
+	if files == nil {
+		return
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	for _, s := range p.Sockets {
+		if network, addr, err := parseSocket(s); err == nil && network == "unix" {
+			os.Remove(addr)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "os/exec"
+
+// Spawner builds the command that runs a Process. It lets alternative
+// runtimes (a container runtime, an ssh session, ...) reuse gosv's restart,
+// logging and shutdown machinery.
+//
+// gosv configures the returned command's stdio, process group, terminal
+// and environment, starts it, and places it in the service's cgroup. The
+// started process must stay a direct child of gosv for its whole life:
+// exit status is collected by reapZombies via wait4(), and stop signals
+// go to its process group.
+type Spawner interface {
+	Command(p *Process) (*exec.Cmd, error)
+}
+
+// Killer is implemented by spawners whose process is only a client of the
+// real workload, like a container runtime or engine CLI. SIGTERM is
+// forwarded by the client, but SIGKILL can't be, so gosv calls Kill after
+// SIGKILLing a straggler to make sure the workload doesn't outlive it.
+type Killer interface {
+	Kill(p *Process)
+}
+
+// ExecSpawner is the default Spawner: fork/exec of Command with Args
+type ExecSpawner struct{}
+
+func (ExecSpawner) Command(p *Process) (*exec.Cmd, error) {
+	return exec.Command(p.Command, p.Args...), nil
+}
+
+// spawner returns the Spawner for p
+func (p *Process) spawner() Spawner {
+	if p.Spawner == nil {
+		return ExecSpawner{}
+	}
+	return p.Spawner
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// statusFields are the fields of a service the status page can show,
+// besides its name
+var statusFields = []string{"state", "uptime", "restarts", "pid", "groups", "labels", "last_exit", "network"}
+
+// DefaultStatusFields are the fields the status page shows when fields
+// is not configured
+var DefaultStatusFields = []string{"state", "uptime", "restarts"}
+
+// StatusPageConfig is the top-level status_page settings
+type StatusPageConfig struct {
+	Listen   string   `json:"listen"`   // host:port of the page
+	Title    string   `json:"title"`    // Its heading (default: the host name)
+	Fields   []string `json:"fields"`   // What it shows of each service (see statusFields)
+	Selector string   `json:"selector"` // Only the services whose labels match
+	TLSConfig
+}
+
+func (c *StatusPageConfig) validate() error {
+	if c.Listen == "" {
+		return fmt.Errorf("status_page: listen is required")
+	}
+	if err := c.TLSConfig.validate("status_page"); err != nil {
+		return err
+	}
+	for _, f := range c.Fields {
+		if !slices.Contains(statusFields, f) {
+			return fmt.Errorf("status_page: unknown field %q (have %s)", f, strings.Join(statusFields, ", "))
+		}
+	}
+	if c.Selector != "" {
+		if _, err := parseSelector(c.Selector); err != nil {
+			return fmt.Errorf("status_page: %w", err)
+		}
+	}
+	return nil
+}
+
+// fields returns Fields or their default
+func (c *StatusPageConfig) fields() []string {
+	if len(c.Fields) == 0 {
+		return DefaultStatusFields
+	}
+	return c.Fields
+}
+
+// statusReport is what the status page shows, and /status.json is
+type statusReport struct {
+	Title    string           `json:"title"`
+	Time     time.Time        `json:"time"`
+	Status   string           `json:"status"` // "ok", or "degraded" if a service is
+	Running  int              `json:"running"`
+	Total    int              `json:"total"`
+	Fields   []string         `json:"-"`
+	Services []map[string]any `json:"services"` // "name", "ok" and the fields
+}
+
+// statusPageServer is the running status page
+type statusPageServer struct {
+	addr string
+	tls  TLSConfig
+	srv  *http.Server
+}
+
+// startStatusPage starts, moves or stops the status page to match the
+// config. What it shows is looked up per request, so a reload that only
+// changes that leaves the listener be. Called at start and after every
+// reload.
+func (s *Supervisor) startStatusPage() {
+	s.mu.RLock()
+	addr, tlsCfg := "", TLSConfig{}
+	if s.statusPageConfig != nil {
+		addr, tlsCfg = s.statusPageConfig.Listen, s.statusPageConfig.TLSConfig
+	}
+	s.mu.RUnlock()
+	s.statusPageMu.Lock()
+	defer s.statusPageMu.Unlock()
+	old := s.statusPage
+	if old != nil && old.addr == addr && old.tls == tlsCfg {
+		return
+	}
+	if old != nil {
+		old.srv.Close()
+	}
+	s.statusPage = nil
+	if addr == "" {
+		return
+	}
+	l, err := tlsCfg.listen(addr)
+	if err != nil {
+		logWarn("status_page: %v", err)
+		return
+	}
+	page := &statusPageServer{addr: addr, tls: tlsCfg}
+	page.srv = &http.Server{Handler: s.statusPageHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go page.srv.Serve(l)
+	s.statusPage = page
+	logInfo("status page on %s://%s/", tlsCfg.scheme(), l.Addr())
+}
+
+// stopStatusPage closes the status page at shutdown
+func (s *Supervisor) stopStatusPage() {
+	s.statusPageMu.Lock()
+	page := s.statusPage
+	s.statusPage = nil
+	s.statusPageMu.Unlock()
+	if page != nil {
+		page.srv.Close()
+	}
+}
+
+// statusReport collects what the status page shows: the services that
+// match its selector, with its fields. A service is ok if it's healthy.
+// Jobs are left out.
+func (s *Supervisor) statusReport(cfg StatusPageConfig) statusReport {
+	title := cfg.Title
+	if title == "" {
+		title, _ = os.Hostname()
+	}
+	now := s.clock.Now()
+	report := statusReport{Title: title, Time: now, Status: "ok", Fields: cfg.fields()}
+	sel, _ := parseSelector(cfg.Selector) // Checked with the config
+	s.mu.RLock()
+	throttle := s.throttle
+	s.mu.RUnlock()
+	procs := s.snapshot()
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Name < procs[j].Name })
+	for _, p := range procs {
+		p.mu.Lock()
+		if p.job != nil || (cfg.Selector != "" && !sel.Matches(p.Labels)) {
+			p.mu.Unlock()
+			continue
+		}
+		ok := p.healthy()
+		svc := map[string]any{"name": p.Name, "ok": ok}
+		for _, f := range report.Fields {
+			switch f {
+			case "state":
+				svc[f] = p.statusState(now, throttle)
+			case "uptime":
+				if p.state == StateRunning {
+					svc[f] = now.Sub(p.startTime).Round(time.Second).String()
+				}
+			case "restarts":
+				svc[f] = p.restarts
+			case "pid":
+				if p.state == StateRunning && p.pid != 0 {
+					svc[f] = p.pid
+				}
+			case "groups":
+				svc[f] = p.Groups
+			case "labels":
+				svc[f] = p.Labels
+			case "last_exit":
+				if p.lastUptime > 0 {
+					svc[f] = fmt.Sprintf("code %d after %v", p.exitCode, p.lastUptime.Round(time.Second))
+				}
+			case "network":
+				if p.net != nil {
+					svc[f] = p.net.String()
+				}
+			}
+		}
+		if p.state == StateRunning {
+			report.Running++
+		}
+		p.mu.Unlock()
+		if !ok {
+			report.Status = "degraded"
+		}
+		report.Total++
+		report.Services = append(report.Services, svc)
+	}
+	return report
+}
+
+// statusPageHandler serves the status page: HTML at / and JSON at
+// /status.json. Only reads, and no authentication.
+//
+// KEY CONCEPT: A status page apart from the management API
+// The people who want to know whether a host's services are up - a team
+// dashboard, a NOC wall, a monitor that pings every minute - are many
+// more than those who may restart them, and often can't be handed a
+// token at all. Giving them the control socket or the deploy endpoint
+// "read-only" means trusting every handler there to check it. A separate
+// listener that only ever reads leaves nothing to check: it has no
+// actions, so there is nothing to exploit but what it shows, and what it
+// shows is chosen in the config - which services, and which of their
+// fields. Commands, environments and paths never appear on it, since
+// they are where secrets and internals tend to live.
+func (s *Supervisor) statusPageHandler() http.Handler {
+	mux := http.NewServeMux()
+	serve := func(w http.ResponseWriter, r *http.Request, write func(statusReport) error) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		s.mu.RLock()
+		cfg := s.statusPageConfig
+		s.mu.RUnlock()
+		if cfg == nil {
+			http.Error(w, "no status page", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		write(s.statusReport(*cfg))
+	}
+	mux.HandleFunc("/status.json", func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, func(report statusReport) error {
+			w.Header().Set("Content-Type", "application/json")
+			return json.NewEncoder(w).Encode(report)
+		})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		serve(w, r, func(report statusReport) error {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			return statusPageTemplate.Execute(w, report)
+		})
+	})
+	return mux
+}
+
+// statusPageTemplate renders a statusReport as a page that reloads
+// itself
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"field": func(svc map[string]any, f string) string {
+		switch v := svc[f].(type) {
+		case nil:
+			return "-"
+		case []string:
+			if len(v) == 0 {
+				return "-"
+			}
+			return strings.Join(v, ", ")
+		case map[string]string:
+			if len(v) == 0 {
+				return "-"
+			}
+			return formatLabels(v)
+		default:
+			return fmt.Sprint(v)
+		}
+	},
+	"heading": func(f string) string { return strings.ReplaceAll(f, "_", " ") },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="30">
+<title>{{.Title}}: {{.Status}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.3em 1em; border-bottom: 1px solid #ddd; }
+.ok { color: #1a7f37; } .degraded { color: #cf222e; }
+</style></head>
+<body>
+<h1>{{.Title}} <span class="{{.Status}}">{{.Status}}</span></h1>
+<p>{{.Running}} of {{.Total}} services running, as of {{.Time.Format "2006-01-02 15:04:05 MST"}}</p>
+<table>
+<tr><th>service</th>{{range .Fields}}<th>{{heading .}}</th>{{end}}</tr>
+{{- $fields := .Fields}}
+{{range .Services}}<tr><td class="{{if .ok}}ok{{else}}degraded{{end}}">{{.name}}</td>{{$svc := .}}{{range $fields}}<td>{{field $svc .}}</td>{{end}}</tr>
+{{end}}</table>
+</body></html>
+`))
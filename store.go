@@ -0,0 +1,731 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// DefaultStateRetentionDays is how long the state store keeps history
+// when state_retention_days is not configured
+const DefaultStateRetentionDays = 30
+
+// DefaultStateSampleSec is how often the state store samples the memory
+// of running services when state_sample_sec is not configured
+const DefaultStateSampleSec = 60
+
+// storeQueue is how many writes can wait for the store's writer before
+// new ones are dropped
+const storeQueue = 4096
+
+// storeSchema creates the tables of the state store. Times are Unix
+// milliseconds, durations milliseconds.
+const storeSchema = `
+CREATE TABLE IF NOT EXISTS services (
+	name     TEXT PRIMARY KEY,
+	state    TEXT NOT NULL,
+	pid      INTEGER NOT NULL,
+	restarts INTEGER NOT NULL,
+	updated  INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS exits (
+	time       INTEGER NOT NULL,
+	service    TEXT NOT NULL,
+	pid        INTEGER NOT NULL,
+	code       INTEGER NOT NULL,
+	signal     INTEGER NOT NULL,
+	uptime_ms  INTEGER NOT NULL,
+	kernel     TEXT NOT NULL,
+	user_ms    INTEGER NOT NULL,
+	sys_ms     INTEGER NOT NULL,
+	max_rss_kb INTEGER NOT NULL,
+	peak_bytes INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS exits_service ON exits (service, time);
+CREATE TABLE IF NOT EXISTS restarts (
+	time     INTEGER NOT NULL,
+	service  TEXT NOT NULL,
+	decision TEXT NOT NULL,
+	attempt  INTEGER NOT NULL,
+	max      INTEGER NOT NULL,
+	delay_ms INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS restarts_service ON restarts (service, time);
+CREATE TABLE IF NOT EXISTS samples (
+	time         INTEGER NOT NULL,
+	service      TEXT NOT NULL,
+	pid          INTEGER NOT NULL,
+	rss_kb       INTEGER NOT NULL,
+	cgroup_bytes INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS samples_service ON samples (service, time);
+CREATE TABLE IF NOT EXISTS boots (
+	time   INTEGER PRIMARY KEY,
+	report TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS revisions (
+	service  TEXT NOT NULL,
+	revision INTEGER NOT NULL,
+	time     INTEGER NOT NULL,
+	source   TEXT NOT NULL,
+	config   TEXT NOT NULL,
+	PRIMARY KEY (service, revision)
+);
+`
+
+// Restart decisions
+const (
+	RestartScheduled = "scheduled" // Backoff restart after an exit
+	RestartRequested = "requested" // Restarted on request, not counted
+	RestartExhausted = "exhausted" // Out of restarts, given up
+	RestartCanceled  = "canceled"  // Scheduled restart canceled on request
+)
+
+// stateStore is the open store (nil without state_db). Processes record
+// into it under their own lock, so it's not reached through s.
+var stateStore atomic.Pointer[store]
+
+// storeWrite is one statement waiting for the writer
+type storeWrite struct {
+	query string
+	args  []any
+}
+
+// store keeps service state, exits, restart decisions and memory samples
+// in SQLite
+//
+// KEY CONCEPT: A database for history
+// An event journal answers "what happened around 02:00"; it can't answer
+// "which service crashed most this month" or "how did worker's memory
+// grow over the week" without reading every line. Those are queries over
+// rows - group by service, filter by time - which is what SQL is for, and
+// SQLite gives it in a single file with no server, crash-safe through its
+// write-ahead log. The supervisor must never wait on it, though: a disk
+// stall would freeze restarts. So services only queue their rows, and one
+// writer goroutine commits them in batches (a transaction per batch, not
+// per row, is what makes SQLite fast) and drops rows rather than block
+// when it falls behind. The same writer samples memory and prunes rows
+// older than the retention, so the file stays bounded.
+type store struct {
+	path        string
+	db          *sql.DB
+	retention   time.Duration
+	sampleEvery time.Duration
+	sample      func() []storeWrite // Memory samples of running services
+
+	mu      sync.Mutex
+	writes  chan storeWrite
+	closed  bool
+	dropped bool // Warned about dropped writes
+
+	warned bool // Warned about a failed write (writer only)
+	done   chan struct{}
+}
+
+// sqliteDriver returns the name of the linked SQLite driver, "" if gosv
+// was built without one (see store_sqlite.go)
+func sqliteDriver() string {
+	for _, name := range sql.Drivers() {
+		if name == "sqlite" || name == "sqlite3" {
+			return name
+		}
+	}
+	return ""
+}
+
+// errNoSQLite is returned when a store is asked of a gosv built without
+// SQLite
+var errNoSQLite = errors.New("built without SQLite (build with -tags sqlite, see Building)")
+
+// openStoreDB opens the SQLite database at path, creating the tables
+func openStoreDB(path string) (*sql.DB, error) {
+	driver := sqliteDriver()
+	if driver == "" {
+		return nil, errNoSQLite
+	}
+	db, err := sql.Open(driver, path)
+	if err != nil {
+		return nil, err
+	}
+	// One connection: SQLite has one writer anyway, and the pragmas
+	// below are per connection
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", storeSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return db, nil
+}
+
+// openStore opens the store at path and starts its writer. sample
+// returns the rows of a memory sample, taken every sampleSec seconds.
+func openStore(path string, retentionDays, sampleSec int, sample func() []storeWrite) (*store, error) {
+	if retentionDays <= 0 {
+		retentionDays = DefaultStateRetentionDays
+	}
+	if sampleSec <= 0 {
+		sampleSec = DefaultStateSampleSec
+	}
+	db, err := openStoreDB(path)
+	if err != nil {
+		return nil, fmt.Errorf("state store: %w", err)
+	}
+	st := &store{
+		path:        path,
+		db:          db,
+		retention:   time.Duration(retentionDays) * 24 * time.Hour,
+		sampleEvery: time.Duration(sampleSec) * time.Second,
+		sample:      sample,
+		writes:      make(chan storeWrite, storeQueue),
+		done:        make(chan struct{}),
+	}
+	go st.run()
+	return st, nil
+}
+
+// add queues a statement for the writer, dropping it if the writer has
+// fallen behind
+func (st *store) add(query string, args ...any) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return
+	}
+	select {
+	case st.writes <- storeWrite{query, args}:
+	default:
+		if !st.dropped {
+			st.dropped = true
+			logWarn("state store %s: falling behind, dropping rows", st.path)
+		}
+	}
+}
+
+// run is the writer: it commits queued statements in batches, samples
+// memory and prunes old rows, until the store is closed
+func (st *store) run() {
+	defer close(st.done)
+	sample := time.NewTicker(st.sampleEvery)
+	defer sample.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	st.prune(time.Now())
+	for {
+		select {
+		case w, ok := <-st.writes:
+			if !ok {
+				return
+			}
+			batch := []storeWrite{w}
+			more := true
+			for more && len(batch) < 500 {
+				select {
+				case w, ok := <-st.writes:
+					if !ok {
+						st.commit(batch)
+						return
+					}
+					batch = append(batch, w)
+				default:
+					more = false
+				}
+			}
+			st.commit(batch)
+		case <-sample.C:
+			if st.sample != nil {
+				st.commit(st.sample())
+			}
+		case now := <-prune.C:
+			st.prune(now)
+		}
+	}
+}
+
+// commit runs batch in one transaction
+func (st *store) commit(batch []storeWrite) {
+	if len(batch) == 0 {
+		return
+	}
+	err := func() error {
+		tx, err := st.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, w := range batch {
+			if _, err := tx.Exec(w.query, w.args...); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil && !st.warned {
+		st.warned = true
+		logWarn("state store %s: %v", st.path, err)
+	}
+}
+
+// prune deletes the history that's older than the retention. Revisions
+// are kept by count instead (see storeRevision).
+func (st *store) prune(now time.Time) {
+	cutoff := now.Add(-st.retention).UnixMilli()
+	var batch []storeWrite
+	for _, table := range []string{"exits", "restarts", "samples", "boots"} {
+		batch = append(batch, storeWrite{"DELETE FROM " + table + " WHERE time < ?", []any{cutoff}})
+	}
+	st.commit(batch)
+}
+
+// close commits what's queued and closes the database; later rows are
+// dropped
+func (st *store) close() {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return
+	}
+	st.closed = true
+	close(st.writes)
+	st.mu.Unlock()
+	<-st.done
+	st.db.Close()
+}
+
+// storeState records the state a service is in now, if there is a store
+func storeState(name string, state ProcessState, pid, restarts int, t time.Time) {
+	if st := stateStore.Load(); st != nil {
+		st.add("INSERT OR REPLACE INTO services (name, state, pid, restarts, updated) VALUES (?, ?, ?, ?, ?)",
+			name, state.String(), pid, restarts, t.UnixMilli())
+	}
+}
+
+// storeExit records an exit, if there is a store
+func storeExit(ev ExitEvent) {
+	if st := stateStore.Load(); st != nil {
+		st.add("INSERT INTO exits (time, service, pid, code, signal, uptime_ms, kernel, user_ms, sys_ms, max_rss_kb, peak_bytes) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			ev.Time.UnixMilli(), ev.Name, ev.PID, ev.ExitCode, int(ev.Signal), ev.Uptime.Milliseconds(), ev.KernelReason,
+			ev.Usage.UserCPU.Milliseconds(), ev.Usage.SystemCPU.Milliseconds(), ev.Usage.MaxRSS, ev.Usage.PeakMemory)
+	}
+}
+
+// storeRestart records a restart decision about p, if there is a store.
+// Caller must hold p.mu.
+func storeRestart(p *Process, decision string, delay time.Duration) {
+	if st := stateStore.Load(); st != nil {
+		st.add("INSERT INTO restarts (time, service, decision, attempt, max, delay_ms) VALUES (?, ?, ?, ?, ?, ?)",
+			p.now().UnixMilli(), p.Name, decision, p.restarts, p.MaxRestarts, delay.Milliseconds())
+	}
+}
+
+// storeBoot records a boot report, if there is a store, and reports
+// whether it did
+func storeBoot(report BootReport) bool {
+	st := stateStore.Load()
+	if st == nil {
+		return false
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return false
+	}
+	st.add("INSERT OR REPLACE INTO boots (time, report) VALUES (?, ?)", report.Boot.UnixMilli(), string(data))
+	return true
+}
+
+// usageSamples returns the memory sample rows of the running services
+func (s *Supervisor) usageSamples() []storeWrite {
+	now := s.clock.Now().UnixMilli()
+	var rows []storeWrite
+	for _, p := range s.snapshot() {
+		p.mu.Lock()
+		pid, cg, running := p.pid, p.cgroup, p.state == StateRunning
+		p.mu.Unlock()
+		if !running || pid == 0 {
+			continue
+		}
+		rss, err := readRSS(pid)
+		if err != nil {
+			continue // Exited since
+		}
+		var cgBytes int64
+		if cg != nil {
+			cgBytes, _ = cg.GetMemoryUsage()
+		}
+		rows = append(rows, storeWrite{"INSERT INTO samples (time, service, pid, rss_kb, cgroup_bytes) VALUES (?, ?, ?, ?, ?)",
+			[]any{now, p.Name, pid, rss, cgBytes}})
+	}
+	return rows
+}
+
+// startStore opens the store the config asks for, unless it's already
+// open. Called at start and after every reload.
+func (s *Supervisor) startStore() {
+	s.mu.RLock()
+	path, retention, sample := s.stateDB, s.stateRetentionDays, s.stateSampleSec
+	s.mu.RUnlock()
+	if retention <= 0 {
+		retention = DefaultStateRetentionDays
+	}
+	if sample <= 0 {
+		sample = DefaultStateSampleSec
+	}
+	old := stateStore.Load()
+	if old != nil && old.path == path && old.retention == time.Duration(retention)*24*time.Hour &&
+		old.sampleEvery == time.Duration(sample)*time.Second {
+		return
+	}
+	var st *store
+	if path != "" {
+		var err error
+		if st, err = openStore(path, retention, sample, s.usageSamples); err != nil {
+			logWarn("%v", err)
+		}
+	}
+	stateStore.Store(st)
+	if old != nil {
+		old.close()
+	}
+}
+
+// stopStore commits what's queued and closes the store at shutdown
+func stopStore() {
+	if st := stateStore.Swap(nil); st != nil {
+		st.close()
+	}
+}
+
+// openStoreReader opens an existing store for queries
+func openStoreReader(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return openStoreDB(path)
+}
+
+// latestBoot returns the most recent boot report in the store at path
+func latestBoot(path string) (BootReport, error) {
+	var report BootReport
+	db, err := openStoreReader(path)
+	if err != nil {
+		return report, err
+	}
+	defer db.Close()
+	var data string
+	if err := db.QueryRow("SELECT report FROM boots ORDER BY time DESC LIMIT 1").Scan(&data); err != nil {
+		if err == sql.ErrNoRows {
+			return report, fmt.Errorf("%s: no boot recorded yet", path)
+		}
+		return report, err
+	}
+	if err := json.Unmarshal([]byte(data), &report); err != nil {
+		return report, fmt.Errorf("%s: %w", path, err)
+	}
+	return report, nil
+}
+
+// configStateDB returns the state_db of the config at configPath, ""
+// if it has none
+func configStateDB(configPath string) (string, error) {
+	if configPath == "" {
+		return "", nil
+	}
+	data, err := readConfigSource(configPath)
+	if err != nil {
+		return "", err
+	}
+	var cfg Config
+	if json.Unmarshal(data, &cfg) != nil {
+		return "", nil // Unit directories and the like have none
+	}
+	return cfg.StateDB, nil
+}
+
+// historyFilter returns the WHERE clause and arguments selecting rows
+// between since and until of the given services (zero values select all)
+func historyFilter(since, until time.Time, services []string) (string, []any) {
+	var conds []string
+	var args []any
+	if !since.IsZero() {
+		conds = append(conds, "time >= ?")
+		args = append(args, since.UnixMilli())
+	}
+	if !until.IsZero() {
+		conds = append(conds, "time < ?")
+		args = append(args, until.UnixMilli())
+	}
+	if len(services) > 0 {
+		conds = append(conds, "service IN (?"+strings.Repeat(", ?", len(services)-1)+")")
+		for _, name := range services {
+			args = append(args, name)
+		}
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// history implements `gosv history`: it prints the exits and restart
+// decisions the state store of a config holds, or with --summary a line
+// per service. It reads the database directly, so it works whether or
+// not gosv is running.
+func history(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	configPath := fs.String("config", "", "Config whose state_db to read")
+	dbPath := fs.String("db", "", "State database to read (default: state_db of --config)")
+	sinceFlag := fs.String("since", "", "Only since this time (e.g. 2d, 02:00, \"2026-10-16 02:00\")")
+	untilFlag := fs.String("until", "", "Only until this time")
+	summary := fs.Bool("summary", false, "One line per service: state, exits, restarts and memory")
+	fs.Parse(args)
+
+	if *dbPath == "" {
+		var err error
+		if *dbPath, err = configStateDB(*configPath); err != nil {
+			return err
+		}
+		if *dbPath == "" {
+			return fmt.Errorf("no state_db configured (give --config or --db)")
+		}
+	}
+	var since, until time.Time
+	now := time.Now()
+	for _, t := range []struct {
+		value string
+		into  *time.Time
+	}{{*sinceFlag, &since}, {*untilFlag, &until}} {
+		if t.value == "" {
+			continue
+		}
+		var err error
+		if *t.into, err = parseEventTime(t.value, now); err != nil {
+			return err
+		}
+	}
+
+	db, err := openStoreReader(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	where, whereArgs := historyFilter(since, until, fs.Args())
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if *summary {
+		err = printSummary(w, db, where, whereArgs, fs.Args())
+	} else {
+		err = printHistory(w, db, where, whereArgs)
+	}
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// printHistory writes exits and restart decisions, oldest first
+func printHistory(w *tabwriter.Writer, db *sql.DB, where string, args []any) error {
+	type entry struct {
+		time    int64
+		service string
+		pid     string
+		what    string
+	}
+	var entries []entry
+
+	rows, err := db.Query("SELECT time, service, pid, code, signal, uptime_ms, kernel, max_rss_kb FROM exits"+where, args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var t, uptime, maxRSS int64
+		var pid, code, sig int
+		var service, kernel string
+		if err := rows.Scan(&t, &service, &pid, &code, &sig, &uptime, &kernel, &maxRSS); err != nil {
+			rows.Close()
+			return err
+		}
+		what := fmt.Sprintf("exited with code %d after %v", code, time.Duration(uptime)*time.Millisecond)
+		if sig != 0 {
+			what = fmt.Sprintf("killed by signal %d (%v) after %v", sig, syscall.Signal(sig), time.Duration(uptime)*time.Millisecond)
+		}
+		if kernel != "" {
+			what += ", " + kernel
+		}
+		if maxRSS > 0 {
+			what += ", max RSS " + formatBytes(maxRSS<<10)
+		}
+		entries = append(entries, entry{t, service, fmt.Sprint(pid), what})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query("SELECT time, service, decision, attempt, max, delay_ms FROM restarts"+where, args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var t, delay int64
+		var attempt, limit int
+		var service, decision string
+		if err := rows.Scan(&t, &service, &decision, &attempt, &limit, &delay); err != nil {
+			rows.Close()
+			return err
+		}
+		var what string
+		switch decision {
+		case RestartScheduled:
+			what = fmt.Sprintf("restart %d/%d in %v", attempt, limit, time.Duration(delay)*time.Millisecond)
+		case RestartExhausted:
+			what = fmt.Sprintf("gave up after %d restarts", attempt)
+		default:
+			what = "restart " + decision
+		}
+		entries = append(entries, entry{t, service, "-", what})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].time < entries[j].time })
+	fmt.Fprintln(w, "TIME\tSERVICE\tPID\tEVENT")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", time.UnixMilli(e.time).Format("2006-01-02 15:04:05.000"), e.service, e.pid, e.what)
+	}
+	return nil
+}
+
+// printSummary writes one line per service: its last recorded state,
+// how often it exited and failed, the restart decisions about it and its
+// sampled memory
+func printSummary(w *tabwriter.Writer, db *sql.DB, where string, args []any, services []string) error {
+	type summary struct {
+		state              string
+		exits, failed      int
+		meanUptime         float64
+		restarts, gaveUp   int
+		rssMean, rssMax    float64
+		hasExits, hasUsage bool
+	}
+	byName := make(map[string]*summary)
+	get := func(name string) *summary {
+		if byName[name] == nil {
+			byName[name] = &summary{state: "-"}
+		}
+		return byName[name]
+	}
+
+	queries := []struct {
+		query string
+		scan  func(*sql.Rows) error
+	}{
+		{"SELECT service, COUNT(*), SUM(code != 0), AVG(uptime_ms) FROM exits" + where + " GROUP BY service",
+			func(rows *sql.Rows) error {
+				var name string
+				var exits, failed int
+				var uptime float64
+				if err := rows.Scan(&name, &exits, &failed, &uptime); err != nil {
+					return err
+				}
+				s := get(name)
+				s.exits, s.failed, s.meanUptime, s.hasExits = exits, failed, uptime, true
+				return nil
+			}},
+		{"SELECT service, SUM(decision = 'scheduled'), SUM(decision = 'exhausted') FROM restarts" + where + " GROUP BY service",
+			func(rows *sql.Rows) error {
+				var name string
+				var restarts, gaveUp int
+				if err := rows.Scan(&name, &restarts, &gaveUp); err != nil {
+					return err
+				}
+				s := get(name)
+				s.restarts, s.gaveUp = restarts, gaveUp
+				return nil
+			}},
+		{"SELECT service, AVG(rss_kb), MAX(rss_kb) FROM samples" + where + " GROUP BY service",
+			func(rows *sql.Rows) error {
+				var name string
+				var mean, peak float64
+				if err := rows.Scan(&name, &mean, &peak); err != nil {
+					return err
+				}
+				s := get(name)
+				s.rssMean, s.rssMax, s.hasUsage = mean, peak, true
+				return nil
+			}},
+	}
+	for _, q := range queries {
+		rows, err := db.Query(q.query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			if err := q.scan(rows); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	// The last recorded state is current, not bound by --since
+	rows, err := db.Query("SELECT name, state FROM services")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name, state string
+		if err := rows.Scan(&name, &state); err != nil {
+			rows.Close()
+			return err
+		}
+		if len(services) == 0 || slices.Contains(services, name) {
+			get(name).state = state
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "SERVICE\tSTATE\tEXITS\tFAILED\tMEAN UPTIME\tRESTARTS\tGAVE UP\tRSS MEAN\tRSS MAX")
+	for _, name := range names {
+		s := byName[name]
+		uptime, rssMean, rssMax := "-", "-", "-"
+		if s.hasExits {
+			d := time.Duration(s.meanUptime) * time.Millisecond
+			if d < time.Minute {
+				uptime = d.Round(time.Millisecond).String()
+			} else {
+				uptime = d.Round(time.Second).String()
+			}
+		}
+		if s.hasUsage {
+			rssMean, rssMax = formatBytes(int64(s.rssMean)<<10), formatBytes(int64(s.rssMax)<<10)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%d\t%d\t%s\t%s\n", name, s.state, s.exits, s.failed, uptime,
+			s.restarts, s.gaveUp, rssMean, rssMax)
+	}
+	return nil
+}
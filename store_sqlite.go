@@ -0,0 +1,7 @@
+//go:build sqlite
+
+package main
+
+// Links the SQLite driver the state store uses (see store.go). It's
+// pure Go, so gosv still cross-compiles without a C toolchain.
+import _ "modernc.org/sqlite"
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// LogStreamConfig is where one output stream of a service goes (the
+// "stdout" and "stderr" objects of a service). Unset fields keep the
+// default, which is what gosv does without the object.
+type LogStreamConfig struct {
+	Console  *bool    `json:"console"`   // To gosv's own stdout or stderr (default: true)
+	File     string   `json:"file"`      // Also appended to this file
+	Loki     *bool    `json:"loki"`      // To the top-level loki, if any (default: true)
+	LogSinks []string `json:"log_sinks"` // Instead of the service's log_sinks ([] for none)
+	Level    string   `json:"level"`     // debug, info, warn or error
+}
+
+// streamOutput is where the lines of one stream go, defaults resolved
+type streamOutput struct {
+	console bool
+	file    string
+	loki    bool
+	sinks   []string
+	level   LogLevel
+	syslog  syslogTags // For syslog and journald sinks
+}
+
+// String describes o for --dry-run
+func (o streamOutput) String() string {
+	var where []string
+	if o.console {
+		where = append(where, "console")
+	}
+	if o.file != "" {
+		where = append(where, o.file)
+	}
+	s := "not to the console"
+	if len(where) > 0 {
+		s = "to " + strings.Join(where, " and ")
+	}
+	s += ", level " + o.level.String()
+	if !o.loki {
+		s += ", not to loki"
+	}
+	return s
+}
+
+// parseLogLevel returns the level named s
+func parseLogLevel(s string) (LogLevel, bool) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if s == l.String() {
+			return l, true
+		}
+	}
+	return 0, false
+}
+
+// validate checks the config of stream against the top-level log_sinks
+func (c *LogStreamConfig) validate(stream string, sinks map[string]LogSinkConfig) error {
+	if c.Level != "" {
+		if _, ok := parseLogLevel(c.Level); !ok {
+			return fmt.Errorf("%s: level must be debug, info, warn or error, not %q", stream, c.Level)
+		}
+	}
+	for _, name := range c.LogSinks {
+		if _, ok := sinks[name]; !ok {
+			return fmt.Errorf("%s: log_sinks: no sink %q in the top-level log_sinks", stream, name)
+		}
+	}
+	return nil
+}
+
+// streamOutput returns where p's lines on stream go
+//
+// KEY CONCEPT: Two streams, two audiences
+// Unix gives every process two output streams so that errors stay
+// visible when the output proper is redirected: `cmd > out.txt` still
+// shows errors on the terminal. Services keep that split - a web server
+// writes its access log to stdout and its warnings to stderr - but a
+// supervisor that merges both into one log throws it away. Keeping them
+// apart lets each go where it's wanted: a high-volume stdout to a file,
+// stderr additionally to the collector that alerts someone, each with a
+// level (GELF's severity, Loki's level label) a collector can filter on.
+// By default stdout is info and stderr error, and both go everywhere the
+// service's output goes.
+func (p *Process) streamOutput(stream string) streamOutput {
+	out := streamOutput{console: true, loki: true, sinks: p.LogSinks, level: LevelInfo}
+	c := p.Stdout
+	if stream == "stderr" {
+		out.level, c = LevelError, p.Stderr
+	}
+	if c == nil {
+		out.syslog = p.syslogTags(stream, out.level)
+		return out
+	}
+	if c.Console != nil {
+		out.console = *c.Console
+	}
+	if c.Loki != nil {
+		out.loki = *c.Loki
+	}
+	if c.LogSinks != nil {
+		out.sinks = c.LogSinks
+	}
+	if l, ok := parseLogLevel(c.Level); ok {
+		out.level = l
+	}
+	out.file = c.File
+	out.syslog = p.syslogTags(stream, out.level)
+	return out
+}
+
+// allLogSinks returns the log sinks that get any of p's output
+func (p *Process) allLogSinks() []string {
+	var names []string
+	for _, stream := range []string{"stdout", "stderr"} {
+		for _, name := range p.streamOutput(stream).sinks {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// openStreamFile opens the file a stream is appended to. Both streams
+// can name the same file; they share one descriptor, so their lines
+// don't overwrite each other.
+func (lp *logPipeline) openStreamFile(path string) *os.File {
+	if f, ok := lp.files[path]; ok {
+		return f
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		// Warned about once; the stream's other sinks still get the line
+		logWarn("%s: %v", lp.name, err)
+	}
+	lp.files[path] = f
+	return f
+}
+
+// closeStreamFiles closes the files opened by openStreamFile
+func (lp *logPipeline) closeStreamFiles() {
+	for _, f := range lp.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// orphanStopTimeout is how long orphaned descendants get between SIGTERM
+// and SIGKILL when gosv shuts down
+const orphanStopTimeout = 2 * time.Second
+
+// orphans returns our children that aren't services: descendants that
+// were reparented to us after their parent died
+func (s *Supervisor) orphans() []int {
+	s.mu.RLock()
+	services := make(map[int]bool)
+	for _, p := range s.processes {
+		p.mu.Lock()
+		if p.pid != 0 {
+			services[p.pid] = true
+		}
+		p.mu.Unlock()
+	}
+	s.mu.RUnlock()
+
+	var pids []int
+	for _, pid := range childPids() {
+		if !services[pid] {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// stopOrphans terminates orphaned descendants left after the services
+// stopped, so they don't outlive gosv by escaping to init
+func (s *Supervisor) stopOrphans() {
+	pids := s.orphans()
+	if len(pids) == 0 {
+		return
+	}
+	logInfo("stopping %d orphaned process(es): %v", len(pids), pids)
+	for _, pid := range pids {
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+
+	deadline := s.clock.After(orphanStopTimeout)
+	ticker := s.clock.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-deadline:
+			for _, pid := range s.orphans() {
+				logWarn("sending SIGKILL to orphan %d", pid)
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+			s.reapZombies()
+			return
+		case <-ticker.C():
+			s.reapZombies()
+			if len(s.orphans()) == 0 {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER from <linux/prctl.h>
+const prSetChildSubreaper = 36
+
+// becomeSubreaper marks gosv as a child subreaper
+//
+// KEY CONCEPT: Subreapers
+// When a process dies, its children are reparented to the nearest
+// ancestor marked as a "child subreaper", or to PID 1 if there is none.
+// A daemon that double-forks (fork, setsid, fork again, parent exits)
+// normally escapes to init that way, and gosv loses track of it: it
+// isn't our child, wait() never returns it, and it survives our shutdown.
+// As a subreaper, such orphans are reparented to gosv instead, so we reap
+// them and can stop them. PID 1 already gets every orphan.
+func becomeSubreaper() {
+	if os.Getpid() == 1 {
+		return
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0)
+	if errno != 0 {
+		logWarn("could not become a child subreaper: %v", errno)
+		return
+	}
+	logDebug("registered as child subreaper")
+}
+
+// childPids returns the pids of gosv's children, from /proc
+func childPids() []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	self := os.Getpid()
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if ppid, err := readPPid(pid); err == nil && ppid == self {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// readPPid returns the parent pid from /proc/<pid>/stat
+func readPPid(pid int) (int, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// "pid (comm) state ppid ..." - comm may contain spaces and parens
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	return strconv.Atoi(fields[1])
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"fmt"
 	"math"
+	"net"
 	"os"
 	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -15,29 +19,252 @@ type Supervisor struct {
 	processes map[string]*Process
 	mu        sync.RWMutex
 
-	// Channels for event handling
+	// pids finds the process of a reaped child (see pids.go)
+	pids *pidIndex
+
+	// Channels for event handling. childChan and reapChan hold at most one
+	// pending wakeup each: one is as good as many (see setupSignals).
 	sigChan    chan os.Signal
+	childChan  chan os.Signal
 	reapChan   chan struct{}
 	shutdownCh chan struct{}
 
-	wg sync.WaitGroup
+	// stopped is closed once shutdown has stopped every service; wg tracks
+	// the goroutines that must finish after that (see singleton.go)
+	stopped chan struct{}
+	wg      sync.WaitGroup
+
+	// exitCode is what gosv should exit with (see ExitCode)
+	exitCode int
+
+	// watcher restarts processes when watched files change (nil if unused)
+	watcher *Watcher
+
+	// kmsg explains kills by the kernel (nil if /dev/kmsg is unreadable)
+	kmsg *kmsgWatcher
+
+	// draining disables restarts while services wind down (see drain.go);
+	// shuttingDown also cancels restarts that were already scheduled
+	draining     bool
+	shuttingDown bool
+
+	// clock is the source of time for all scheduling (see clock.go)
+	clock Clock
+
+	// hooks apply to every process (see hooks.go)
+	hooks *Hooks
+
+	// Where the config came from and what it contained, for reloads (see
+	// reload.go). ConfigSyncInterval > 0 polls the source for changes.
+	configSource       string
+	configData         []byte
+	configCh           chan []byte
+	ConfigSyncInterval time.Duration
+
+	// BootReport is where the boot timing report is written for
+	// `gosv analyze` ("" to only log the total; see boot.go)
+	BootReport string
+	// throttle limits restarts in flight (nil: no limit; see throttle.go)
+	throttle *restartThrottle
+	// startStagger spaces out the starts at boot (see delay.go)
+	startStagger time.Duration
+	// selfLimits bound gosv itself (see selflimits.go)
+	selfLimits *SelfLimits
+
+	// lokiConfig says where service output is shipped (see loki.go)
+	lokiConfig *LokiConfig
+
+	// logSinkConfigs are the configured log sinks (see logsink.go)
+	logSinkConfigs map[string]LogSinkConfig
+
+	// Where events are journaled, and its size limit (see events.go)
+	eventJournalPath string
+	eventJournalMB   int
+
+	// restartBudgets are the restart budgets of groups, by group (see
+	// budget.go). Only the main loop uses them.
+	restartBudgets map[string]*restartBudget
+
+	// pressure watches the memory pressure of the host and of pools, by
+	// pool name ("" for the host; see pressure.go). Only the main loop
+	// uses it.
+	pressure map[string]*pressureWatch
+
+	// The limit profiles, the one in effect, and the timer for the next
+	// window to open or close (see profiles.go)
+	limitProfiles []limitProfile
+	activeProfile string
+	profileTimer  Timer
+
+	// The SQLite state store and its settings (see store.go)
+	stateDB            string
+	stateRetentionDays int
+	stateSampleSec     int
+	stateRevisions     int
+
+	// DeployState is where deploys are kept unless the config says
+	// otherwise; deployCfg are the deploy settings, deploys the deploys
+	// in effect by service, deploying the services a deploy or a rolling
+	// restart is changing (see deploy.go). deployReadOnly keeps a dry run
+	// from saving them.
+	DeployState    string
+	deployReadOnly bool
+	deployMu       sync.Mutex
+	deployCfg      DeployConfig
+	deploys        map[string]deployRecord
+	deploying      map[string]bool
+	deployAPI      *deployAPI
+
+	// The webhook settings, and the endpoint serving them (see
+	// webhooks.go)
+	webhookConfig *WebhookConfig
+	webhookMu     sync.Mutex
+	webhooks      *webhookServer
+
+	// The status page settings, and the page's listener (see
+	// statuspage.go)
+	statusPageConfig *StatusPageConfig
+	statusPageMu     sync.Mutex
+	statusPage       *statusPageServer
+
+	// The controller gosv reports to, if any (see agent.go)
+	agentConfig *AgentConfig
+
+	// Whether services' TCP traffic is sampled (see netacct.go), and
+	// whether sampling failed and was warned about
+	networkAccounting bool
+	networkWarned     bool
+
+	// systemd's notification socket, when gosv runs in a Type=notify
+	// unit (see sdnotify.go). Only the main loop uses it.
+	notify *sdNotifier
+
+	// ControlSocket is where `gosv ctl` connects ("" for none; see
+	// control.go)
+	ControlSocket string
+	ctl           net.Listener
+	ctlCh         chan ctlCall
 }
 
 // NewSupervisor creates a supervisor ready to manage processes
 func NewSupervisor() *Supervisor {
 	return &Supervisor{
 		processes:  make(map[string]*Process),
+		pids:       newPIDIndex(),
 		sigChan:    make(chan os.Signal, 10),
-		reapChan:   make(chan struct{}, 10),
+		childChan:  make(chan os.Signal, 1),
+		reapChan:   make(chan struct{}, 1),
 		shutdownCh: make(chan struct{}),
+		stopped:    make(chan struct{}),
+		configCh:   make(chan []byte, 1),
+		ctlCh:      make(chan ctlCall),
+		deploying:  make(map[string]bool),
+		clock:      realClock{},
 	}
 }
 
+// SetHooks sets lifecycle hooks that apply to every process, in addition
+// to each process's own Hooks
+func (s *Supervisor) SetHooks(h *Hooks) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = h
+}
+
+// SetClock replaces the supervisor's clock, e.g. with a ManualClock to
+// simulate time. Must be called before processes are added.
+func (s *Supervisor) SetClock(c Clock) {
+	s.clock = c
+}
+
 // AddProcess registers a process to be supervised
-func (s *Supervisor) AddProcess(p *Process) {
+func (s *Supervisor) AddProcess(p *Process) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if _, exists := s.processes[p.Name]; exists {
+		return fmt.Errorf("%w: %s", ErrDuplicateService, p.Name)
+	}
+	p.dropUnsupported()
+	if s.activeProfile != "" && len(p.ProfileLimits) > 0 {
+		p.profile = s.activeProfile
+		p.MemoryLimit, p.CPUQuota = p.profileLimits(p.profile)
+	}
+	p.clock = s.clock
+	p.globalHooks = &s.hooks
+	p.onStarted = s.boundStarted
+	p.mayStart = s.mayStart
+	p.pids = s.pids
+	p.watchedExit = func(pid int) {
+		if s.exited(p, pid, nil, nil) {
+			s.wakeRestarts()
+		}
+	}
 	s.processes[p.Name] = p
+	return nil
+}
+
+// lookup returns the named process or ErrUnknownService
+func (s *Supervisor) lookup(name string) (*Process, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.processes[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownService, name)
+	}
+	return p, nil
+}
+
+// Restart restarts the target services (a name or "@group", see
+// resolve), and the services part of them, outside their restart policy
+// (see RestartProcess). Services stopped by Stop are started again.
+func (s *Supervisor) Restart(target string) error {
+	procs, err := s.resolve(target)
+	if err != nil {
+		return err
+	}
+	procs = s.withPartOf(procs)
+	for _, p := range procs {
+		p.mu.Lock()
+		p.manualStop = false
+		p.mu.Unlock()
+		s.RestartProcess(p)
+	}
+	return nil
+}
+
+// SignalService sends sig to the process group of the target services
+// (a name or "@group")
+func (s *Supervisor) SignalService(target string, sig syscall.Signal) error {
+	procs, err := s.resolve(target)
+	if err != nil {
+		return err
+	}
+	for _, p := range procs {
+		if err := p.Signal(sig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServiceErr reports why the named service is not running, if it's not
+// going to come back on its own: ErrRestartExhausted if gosv gave up on
+// it, or the start error if it failed to spawn. nil means it is running
+// or a restart is on its way.
+func (s *Supervisor) ServiceErr(name string) error {
+	p, err := s.lookup(name)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.exhausted:
+		return fmt.Errorf("%w: %s after %d restarts", ErrRestartExhausted, name, p.restarts)
+	case p.state == StateFailed:
+		return p.startErr
+	}
+	return nil
 }
 
 // setupSignals configures signal handling
@@ -46,10 +273,22 @@ func (s *Supervisor) AddProcess(p *Process) {
 // Go's runtime already handles some signals (SIGURG for preemption).
 // We use signal.Notify to receive signals on a channel rather than
 // using raw sigaction. This plays nice with Go's scheduler.
+//
+// KEY CONCEPT: Losing SIGCHLD
+// signal.Notify never blocks: when the channel is full, the signal is
+// dropped. For SIGCHLD that is fine as long as one notification is still
+// pending - reapZombies loops wait4() until no child is left, so a
+// single wakeup reaps a thousand exits. It only goes wrong if SIGCHLD
+// shares a channel with other signals (a burst of exits crowds out a
+// SIGTERM) or if reaping itself can block. So SIGCHLD gets a channel of
+// its own with room for exactly one wakeup, and reaping only ever wakes
+// the restart logic without waiting.
+// (signalfd would need SIGCHLD blocked in every thread, and Go's runtime
+// creates threads with its own signal masks, so it isn't an option here.)
 func (s *Supervisor) setupSignals() {
 	// SIGCHLD: Child process state changed (exited, stopped, continued)
 	// This is THE signal that tells us to call wait() and reap zombies
-	signal.Notify(s.sigChan, syscall.SIGCHLD)
+	signal.Notify(s.childChan, syscall.SIGCHLD)
 
 	// SIGTERM: Graceful termination request
 	// We'll propagate this to children before exiting
@@ -58,12 +297,18 @@ func (s *Supervisor) setupSignals() {
 	// SIGINT: Interrupt (Ctrl+C)
 	signal.Notify(s.sigChan, syscall.SIGINT)
 
-	// SIGHUP: Traditionally means "reload config"
-	// We could use this to restart processes or reload config
+	// SIGHUP: Traditionally means "reload config" - we re-read the config
+	// and apply the differences (see reload.go)
 	signal.Notify(s.sigChan, syscall.SIGHUP)
 
 	// SIGUSR1: User-defined signal - we use it to dump process info
 	signal.Notify(s.sigChan, syscall.SIGUSR1)
+
+	// SIGTSTP: Drain services, then shut down (host maintenance)
+	signal.Notify(s.sigChan, syscall.SIGTSTP)
+
+	// SIGWINCH: Our terminal was resized - forward to TTY processes
+	signal.Notify(s.sigChan, syscall.SIGWINCH)
 }
 
 // reapZombies handles SIGCHLD by calling wait() on all children
@@ -78,124 +323,401 @@ func (s *Supervisor) setupSignals() {
 // Since SIGCHLD can be coalesced (multiple children die, one signal),
 // we must loop until wait() returns no more children.
 func (s *Supervisor) reapZombies() {
+	reaped := false
+	defer func() {
+		if reaped {
+			// Trigger restart evaluation, once for all of them. This may
+			// run outside the main loop (shutdown, drain), so it must not
+			// block.
+			s.wakeRestarts()
+		}
+	}()
 	for {
 		// Wait for ANY child, non-blocking
 		var wstatus syscall.WaitStatus
-		pid, err := syscall.Wait4(-1, &wstatus, syscall.WNOHANG, nil)
+		var rusage syscall.Rusage
+		pid, found, err := s.pids.reap(&wstatus, &rusage)
 
 		if pid <= 0 || err != nil {
 			// No more zombies to reap
 			break
 		}
 
-		// Find which of our processes this was
-		s.mu.RLock()
-		var found *Process
-		for _, p := range s.processes {
-			if p.pid == pid {
-				found = p
-				break
-			}
-		}
-		s.mu.RUnlock()
-
+		// found is which of our processes this was
 		if found != nil {
-			found.mu.Lock()
-			found.state = StateStopped
-			if wstatus.Exited() {
-				found.exitCode = wstatus.ExitStatus()
-			} else if wstatus.Signaled() {
-				found.exitCode = 128 + int(wstatus.Signal())
-			}
-			// Record how long process ran before dying (for stability check)
-			found.lastUptime = time.Since(found.startTime)
-			fmt.Printf("[gosv] process %s (pid=%d) exited with code %d\n",
-				found.Name, pid, found.exitCode)
-			// Zero the PID to prevent stale PID issues
-			found.pid = 0
-			found.mu.Unlock()
-
-			// Trigger restart evaluation
-			s.reapChan <- struct{}{}
+			reaped = s.exited(found, pid, &wstatus, &rusage) || reaped
 		} else {
-			// Unknown child - could be grandchild if we're init
-			fmt.Printf("[gosv] reaped unknown pid %d\n", pid)
+			// Not a service: an orphaned descendant reparented to us
+			// (we're a subreaper, or init), or a command of gosv's own
+			// whose exit reap handed over (see pidIndex.run)
+			logDebug("reaped pid %d, not a service", pid)
 		}
 	}
 }
 
+// exited records the exit of pid, the main process of p, with wstatus
+// and rusage (both nil if gosv only knows that it exited, see
+// watchPID). It reports whether p is now down.
+func (s *Supervisor) exited(p *Process, pid int, wstatus *syscall.WaitStatus, rusage *syscall.Rusage) bool {
+	p.mu.Lock()
+	if p.pid != pid {
+		if h := p.handoff; h != nil && h.pid == pid {
+			h.gone = true // See handoff.go
+		}
+		p.mu.Unlock()
+		logDebug("reaped stale pid %d of %s", pid, p.Name)
+		return false
+	}
+	if h := p.handoff; h != nil && p.restoreHandoff(h) {
+		// The new instance of a handoff: the old one goes on
+		p.mu.Unlock()
+		logWarn("%s: new instance (pid=%d) exited during its handoff, pid %d goes on", p.Name, pid, h.pid)
+		return false
+	}
+	if p.daemonizing && wstatus != nil && wstatus.Exited() && wstatus.ExitStatus() == 0 {
+		// A forking service's initial process is done; its daemon takes
+		// over (see forking.go)
+		p.pid = 0
+		p.mu.Unlock()
+		go s.adoptDaemon(p, pid)
+		return false
+	}
+	p.daemonizing, p.adopted = false, false
+	p.state = StateStopped
+	p.ports.detach()
+	ev := ExitEvent{Name: p.Name, PID: pid, Time: s.clock.Now(), Labels: p.Labels}
+	switch {
+	case wstatus == nil:
+		p.exitCode = 0
+	case wstatus.Exited():
+		p.exitCode = wstatus.ExitStatus()
+	case wstatus.Signaled():
+		p.exitCode = 128 + int(wstatus.Signal())
+		ev.Signal = wstatus.Signal()
+		if wstatus.CoreDump() && p.DiagnosticsDir != "" {
+			p.lastCore = findCore(pid)
+		}
+		ev.KernelReason = s.kmsg.reason(pid, p.Name)
+	}
+	// Record how long process ran before dying (for stability check)
+	p.lastUptime = s.clock.Now().Sub(p.startTime)
+	if wstatus == nil {
+		logInfo("process %s (pid=%d) exited, status unknown (not a child of gosv)", p.Name, pid)
+		p.noteEvent(EventExit, "exited after %v, status unknown", p.lastUptime)
+	} else {
+		ev.Usage = usageFrom(rusage)
+		ev.Usage.PeakMemory = p.readPeak()
+		logInfo("process %s (pid=%d) exited with code %d",
+			p.Name, pid, p.exitCode)
+		logInfo("%s used %s", p.Name, ev.Usage)
+		p.noteEvent(EventExit, "exited with code %d after %v", p.exitCode, p.lastUptime)
+		p.noteEvent(EventUsage, "usage: %s", ev.Usage)
+	}
+	if ev.KernelReason != "" {
+		logWarn("%s (pid=%d) was %s", p.Name, pid, ev.KernelReason)
+		p.noteEvent(EventKernel, "kernel: %s", ev.KernelReason)
+	}
+	// Zero the PID to prevent stale PID issues
+	p.pid = 0
+	p.closeStdin()
+	ev.ExitCode, ev.Uptime = p.exitCode, p.lastUptime
+	p.mu.Unlock()
+
+	storeExit(ev)
+	p.fireExit(ev)
+	if p.job != nil {
+		p.jobExited(ev.ExitCode)
+	}
+	s.boundExited(p)
+	return true
+}
+
 // StableAfter is how long a process must run before we consider it "stable"
 // and reset the restart counter. This prevents a long-running service from
 // being permanently marked as "exhausted" after a few crashes.
 const StableAfter = 60 * time.Second
 
+// UnlimitedRestarts is the MaxRestarts of a service gosv never gives up on
+const UnlimitedRestarts = math.MaxInt
+
+// MaxRestartDelay caps the backoff between restarts, which would otherwise
+// grow without bound for a service with many (or unlimited) restarts
+const MaxRestartDelay = time.Hour
+
+// maxRestarts returns p.MaxRestarts for messages: a count, or "unlimited"
+func (p *Process) maxRestarts() string {
+	if p.MaxRestarts == UnlimitedRestarts {
+		return "unlimited"
+	}
+	return strconv.Itoa(p.MaxRestarts)
+}
+
+// Restart policies: which exits of a service restart it
+const (
+	RestartAlways    = "always"     // Any exit
+	RestartOnFailure = "on-failure" // A non-zero exit code, or a signal
+	RestartNever     = "no"         // None
+)
+
+// wantsRestart reports whether p's restart policy restarts it after its
+// last exit. An exit whose status gosv doesn't know (of an adopted
+// process, say) counts as clean. Caller must hold p.mu.
+func (p *Process) wantsRestart() bool {
+	switch p.Restart {
+	case RestartNever:
+		return false
+	case RestartOnFailure:
+		return p.exitCode != 0
+	}
+	return true
+}
+
 // handleRestarts checks for dead processes and restarts them
 func (s *Supervisor) handleRestarts() {
+	// Hooks fire after all locks are released (deferred calls run LIFO)
+	var exhausted []*Process
+	var events []ExhaustedEvent
+	defer func() {
+		for i, p := range exhausted {
+			events[i].Diagnostics = p.writeDiagnostics("restarts exhausted")
+			p.fireExhausted(events[i])
+		}
+	}()
+
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	draining := s.draining
+	s.mu.RUnlock()
+	if draining {
+		return
+	}
 
-	for _, p := range s.processes {
+	for _, p := range s.snapshot() {
 		p.mu.Lock()
 
-		// If process ran long enough before dying, it was stable - reset counter
+		// If process ran long enough before dying (and got ready, if it has
+		// a ready_check), it was stable - reset counter
 		// We check lastUptime (how long it ran) not time.Since(startTime)
-		if p.lastUptime > StableAfter && p.restarts > 0 {
-			fmt.Printf("[gosv] %s was stable for %v before exit, resetting restart counter\n",
+		if p.lastUptime > StableAfter && p.restarts > 0 && p.unready == 0 {
+			logInfo("%s was stable for %v before exit, resetting restart counter",
 				p.Name, p.lastUptime)
 			p.restarts = 0
 		}
 
+		// Stopped on request, bound to a service that is down, or evicted
+		// under memory pressure: stays down until started again. Jobs run
+		// once.
+		if p.manualStop || p.boundDown || p.job != nil || p.evicted {
+			p.mu.Unlock()
+			continue
+		}
+
+		// Path-activated services go back to waiting when done, and
+		// singletons while another instance holds their lock
+		if p.settleActivation() || p.settleLeadership() {
+			p.mu.Unlock()
+			continue
+		}
+
+		// Restart requested by us (see RestartProcess): immediate, and not
+		// counted against MaxRestarts
+		down := p.state == StateStopped || p.state == StateFailed || p.state == StateWaiting ||
+			p.state == StateSkipped
+		if down && p.pendingRestart && !p.isMain() {
+			p.pendingRestart = false
+			p.restarts = 0
+			p.state = StateStarting
+			logInfo("restarting %s", p.Name)
+			storeRestart(p, RestartRequested, 0)
+			p.mu.Unlock()
+
+			go func(proc *Process) {
+				if !s.mayStart(proc) {
+					return // Removed by a reload, or shutting down
+				}
+				if err := s.restart(proc); err != nil {
+					logError("restart failed: %v", err)
+					s.wakeRestarts() // A critical service may have failed
+				}
+			}(p)
+			continue
+		}
+
+		// Done for good, by its restart policy: down, but not given up
+		if p.state == StateStopped && !p.isMain() && !p.wantsRestart() {
+			p.mu.Unlock()
+			continue
+		}
+
 		shouldRestart := p.state == StateStopped &&
-			p.restarts < p.MaxRestarts
+			!p.isMain() &&
+			p.restarts < p.MaxRestarts &&
+			!s.deferRestart(p, s.clock.Now())
 
 		if shouldRestart {
 			p.restarts++
-			delay := time.Duration(float64(p.RestartDelay) *
-				math.Pow(p.BackoffFactor, float64(p.restarts-1)))
+			// Mark the restart as scheduled, otherwise the next reaped
+			// child would schedule this process a second time
+			p.state = StateStarting
+			delay := time.Duration(min(float64(p.RestartDelay)*
+				math.Pow(p.BackoffFactor, float64(p.restarts-1)), float64(max(MaxRestartDelay, p.RestartDelay))))
+			delay = p.readinessBackoff(delay) // See readiness.go
+			delay = s.budgetRestart(p, delay) // See budget.go
 
-			fmt.Printf("[gosv] restarting %s in %v (attempt %d/%d)\n",
-				p.Name, delay, p.restarts, p.MaxRestarts)
+			logInfo("restarting %s in %v (attempt %d/%s)",
+				p.Name, delay, p.restarts, p.maxRestarts())
+			p.noteEvent(EventRestart, "restart %d/%s scheduled in %v", p.restarts, p.maxRestarts(), delay)
+			storeRestart(p, RestartScheduled, delay)
 
+			// Restart after delay (see pending.go)
+			s.scheduleRestart(p, delay)
 			p.mu.Unlock()
-
-			// Restart after delay
-			go func(proc *Process, d time.Duration) {
-				time.Sleep(d)
-				if err := proc.Start(); err != nil {
-					fmt.Printf("[gosv] restart failed: %v\n", err)
-				}
-			}(p, delay)
 		} else {
+			if p.state == StateStopped && !p.isMain() && !p.exhausted &&
+				p.restarts >= p.MaxRestarts {
+				p.exhausted = true
+				logWarn("%s exhausted its %d restarts, giving up", p.Name, p.MaxRestarts)
+				p.noteEvent(EventExhausted, "gave up after %d restarts", p.restarts)
+				storeRestart(p, RestartExhausted, 0)
+				exhausted = append(exhausted, p)
+				events = append(events, ExhaustedEvent{Name: p.Name, Restarts: p.restarts, ExitCode: p.exitCode, Labels: p.Labels})
+			}
 			p.mu.Unlock()
 		}
 	}
 }
 
+// RestartProcess restarts p right away, outside of its restart policy:
+// the restart doesn't count against MaxRestarts, and a process that
+// already exhausted its restarts is started again.
+func (s *Supervisor) RestartProcess(p *Process) {
+	s.mu.RLock()
+	draining := s.draining
+	s.mu.RUnlock()
+	if draining {
+		return // Would only stop it - nothing gets restarted while draining
+	}
+	if !s.mayStart(p) {
+		return // Replaced or removed by a reload, or shutting down
+	}
+
+	p.mu.Lock()
+	state := p.state
+	handoff := state == StateRunning && p.RestartMode == RestartModeHandoff
+	if !handoff {
+		// A restart that is already scheduled will pick up any changes
+		p.pendingRestart = state != StateStarting
+	}
+	p.mu.Unlock()
+
+	if handoff {
+		go s.handOff(p)
+		return
+	}
+	if state == StateRunning {
+		// Reaping the old instance triggers the restart
+		p.killForRestart(syscall.SIGTERM)
+		return
+	}
+
+	// Already down - wake the loop so handleRestarts sees the request
+	s.wakeRestarts()
+}
+
+// mayStart reports whether a (re)start of p that was scheduled earlier
+// should still happen (not if it was stopped on request since, or what
+// it is bound to went down)
+func (s *Supervisor) mayStart(p *Process) bool {
+	s.mu.RLock()
+	stopping := s.shuttingDown
+	s.mu.RUnlock()
+	p.mu.Lock()
+	held := p.manualStop || p.boundDown || p.evicted
+	p.mu.Unlock()
+	return !stopping && !held && s.registered(p)
+}
+
+// DefaultStopTimeout is how long a service gets between SIGTERM and SIGKILL
+// when stop_timeout_sec is not configured
+const DefaultStopTimeout = 10 * time.Second
+
 // gracefulShutdown stops all processes with SIGTERM, then SIGKILL
+//
+// Services are stopped in stages ordered by ShutdownPriority (lowest
+// first), so frontends can be stopped before the databases they use.
+// Each stage waits for the longest StopTimeout among its services before
+// moving on.
 func (s *Supervisor) gracefulShutdown() {
-	fmt.Println("[gosv] initiating graceful shutdown...")
+	logInfo("initiating graceful shutdown...")
+	s.noteEvent(EventShutdown, "shutting down")
+	s.notify.send("STOPPING=1", "STATUS=stopping services")
+
+	// Restarts that are already scheduled must not fire from here on
+	s.mu.Lock()
+	s.shuttingDown = true
+	s.mu.Unlock()
+	s.cancelAllRestarts()
+
+	// No more change-triggered restarts
+	if s.watcher != nil {
+		s.watcher.Close()
+	}
 
 	s.mu.RLock()
-	procs := make([]*Process, 0, len(s.processes))
+	stages := make(map[int][]*Process)
 	for _, p := range s.processes {
-		procs = append(procs, p)
+		stages[p.ShutdownPriority] = append(stages[p.ShutdownPriority], p)
 	}
 	s.mu.RUnlock()
 
-	// Phase 1: SIGTERM to all
-	for _, p := range procs {
-		p.mu.Lock()
-		state := p.state
-		p.mu.Unlock()
-		if state == StateRunning {
-			fmt.Printf("[gosv] sending SIGTERM to %s\n", p.Name)
-			p.Signal(syscall.SIGTERM)
+	priorities := make([]int, 0, len(stages))
+	for prio := range stages {
+		priorities = append(priorities, prio)
+	}
+	sort.Ints(priorities)
+
+	for _, prio := range priorities {
+		if len(priorities) > 1 {
+			logInfo("stopping shutdown stage %d", prio)
+		}
+		s.stopStage(stages[prio])
+	}
+
+	// Daemons that double-forked away from their service were reparented
+	// to us (see subreaper.go) - stop them too
+	s.stopOrphans()
+
+	for _, stage := range stages {
+		for _, p := range stage {
+			p.removeCredentials()
+			p.removeDNS()
+			p.closePorts()
+			p.closeSockets()
 		}
 	}
 
-	// Wait up to 10 seconds for graceful exit
-	deadline := time.After(10 * time.Second)
-	ticker := time.NewTicker(100 * time.Millisecond)
+	// Don't leave stopped instances in service registries, and hand
+	// singleton locks over to other instances
+	deregistrations.Wait()
+	egress.teardown(s.pids)
+	stopLoki()
+	stopLogSinks()
+	stopEventJournal()
+	stopStore()
+	close(s.stopped)
+	s.wg.Wait()
+	logInfo("shutdown complete")
+}
+
+// stopStage sends SIGTERM to procs, waits for them to exit, and SIGKILLs
+// whatever is left after the stage timeout. Each process's KillMode
+// decides what gets signaled.
+func (s *Supervisor) stopStage(procs []*Process) {
+	// Phase 1: SIGTERM to all
+	timeout := s.terminate(procs)
+
+	// Wait up to the stage timeout for graceful exit
+	deadline := s.clock.After(timeout)
+	ticker := s.clock.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
 
 	for {
@@ -203,84 +725,380 @@ func (s *Supervisor) gracefulShutdown() {
 		case <-deadline:
 			// Phase 2: SIGKILL stragglers
 			for _, p := range procs {
-				p.mu.Lock()
-				pid := p.pid
-				p.mu.Unlock()
-				if pid != 0 {
-					fmt.Printf("[gosv] sending SIGKILL to %s\n", p.Name)
-					p.Signal(syscall.SIGKILL)
+				if p.lingering() {
+					p.killStraggler()
 				}
 			}
 			// Final reap
 			s.reapZombies()
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			// Reap any dead children to update state
 			s.reapZombies()
 
 			allDead := true
 			for _, p := range procs {
-				// Check if process is actually alive using kill(pid, 0)
-				if p.pid != 0 {
-					err := syscall.Kill(p.pid, 0)
-					if err == nil {
-						// Process still exists
-						allDead = false
-					}
+				// Check if anything is actually alive using kill(pid, 0)
+				// (and the cgroup, for kill modes that signal it)
+				if p.lingering() {
+					allDead = false
 				}
 			}
 			if allDead {
-				fmt.Println("[gosv] all processes terminated gracefully")
+				logInfo("all processes terminated gracefully")
+				return
+			}
+		}
+	}
+}
+
+// stopInBackground stops procs like stopStage, but returns once they have
+// their SIGTERM. It's for stops the main loop asks for (ctl stop, a
+// restore, an eviction): the loop must not wait out their stop timeout,
+// and it goes on reaping them as usual. A goroutine SIGKILLs whatever is
+// left after the timeout, but leaves a service that was started again
+// since be.
+func (s *Supervisor) stopInBackground(procs []*Process) {
+	s.retire(procs, nil)
+}
+
+// retire is stopInBackground for procs a reload took out of the
+// supervisor: the shutdown won't stop them, so they are seen down even if
+// it comes first. then, if not nil, runs once they're gone or SIGKILLed.
+func (s *Supervisor) retire(procs []*Process, then func()) {
+	started := make(map[*Process]time.Time, len(procs))
+	for _, p := range procs {
+		p.mu.Lock()
+		started[p] = p.startTime
+		p.mu.Unlock()
+	}
+	timeout := s.terminate(procs)
+	// Still running the instance that got the SIGTERM
+	lingering := func(p *Process) bool {
+		p.mu.Lock()
+		same := p.startTime.Equal(started[p])
+		p.mu.Unlock()
+		return same && p.lingering()
+	}
+
+	// The shutdown stops the services it supervises itself
+	stopped := s.stopped
+	if then != nil {
+		stopped = nil
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if then != nil {
+			defer then()
+		}
+		deadline := s.clock.After(timeout)
+		ticker := s.clock.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-deadline:
+				for _, p := range procs {
+					if lingering(p) {
+						p.killStraggler()
+					}
+				}
 				return
+			case <-ticker.C():
+				if !slices.ContainsFunc(procs, lingering) {
+					return
+				}
+			case <-stopped:
+				return
+			}
+		}
+	}()
+}
+
+// terminate sends SIGTERM to procs, as their KillMode says, and returns
+// how long the longest of their stop timeouts is
+func (s *Supervisor) terminate(procs []*Process) time.Duration {
+	timeout := time.Duration(0)
+	for _, p := range procs {
+		p.thaw()
+		p.mu.Lock()
+		state := p.state
+		if p.StopTimeout > timeout {
+			timeout = p.StopTimeout
+		}
+		p.mu.Unlock()
+		if state == StateRunning && p.KillMode == KillNone {
+			logInfo("not signaling %s (kill_mode none)", p.Name)
+		} else if state == StateRunning {
+			logInfo("sending SIGTERM to %s", p.Name)
+			p.kill(syscall.SIGTERM)
+		}
+	}
+	if timeout == 0 {
+		timeout = DefaultStopTimeout
+	}
+	return timeout
+}
+
+// killStraggler SIGKILLs p, which outlived its stop timeout, and has its
+// spawner kill what it runs if it can
+func (p *Process) killStraggler() {
+	logWarn("sending SIGKILL to %s", p.Name)
+	p.kill(syscall.SIGKILL)
+	if k, ok := p.spawner().(Killer); ok {
+		k.Kill(p)
+	}
+}
+
+// ExitCode returns the exit code gosv should terminate with after Run
+// returns: the foreground service's exit code, or 0
+func (s *Supervisor) ExitCode() int {
+	return s.exitCode
+}
+
+// SetMain makes the named service the main service: when it exits, gosv
+// shuts down and exits with its exit code (see Process.Main)
+func (s *Supervisor) SetMain(name string) error {
+	p, err := s.lookup(name)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, other := range s.processes {
+		if other != p && other.isMain() {
+			return fmt.Errorf("%s: %s is already the main service", name, other.Name)
+		}
+	}
+	p.mu.Lock()
+	p.Main = true
+	p.mu.Unlock()
+	return nil
+}
+
+// mainExited reports whether the main service (if any) has ended, and
+// with which exit code
+func (s *Supervisor) mainExited() (bool, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.processes {
+		if !p.isMain() {
+			continue
+		}
+		p.mu.Lock()
+		done := p.state == StateStopped || p.state == StateFailed
+		code := p.exitCode
+		p.mu.Unlock()
+		return done, code
+	}
+	return false, 0
+}
+
+// criticalFailure returns the first critical service that failed for good
+// (exhausted its restarts, or could not be restarted), and the exit code
+// gosv should exit with
+//
+// A critical service is one the whole supervisor is pointless without.
+// Instead of idling with it dead, gosv shuts down and exits non-zero, so
+// whatever runs gosv (a container runtime, systemd) notices and recovers
+// at the host level.
+func (s *Supervisor) criticalFailure() (*Process, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.processes {
+		if !p.Critical {
+			continue
+		}
+		p.mu.Lock()
+		failed := p.exhausted || p.state == StateFailed
+		code := p.exitCode
+		p.mu.Unlock()
+		if failed {
+			if code == 0 {
+				code = 1
 			}
+			return p, code
 		}
 	}
+	return nil, 0
 }
 
 // Run starts all processes and enters the supervisor loop
 func (s *Supervisor) Run() error {
+	s.notify = newSdNotifier() // Before any service inherits NOTIFY_SOCKET
+	defer s.notify.close()
 	s.setupSignals()
+	s.watchExits()
+	becomeSubreaper()
+	s.applySelfLimits()
+	s.startLoki()
+	s.startLogSinks()
+	s.startEventJournal()
+	s.startStore()
+	s.storeRevisions(s.snapshot())
+	s.noteEvent(EventBoot, "gosv started (pid %d)", os.Getpid())
 
 	// Start all registered processes
-	s.mu.RLock()
-	for _, p := range s.processes {
+	boot := newBootTracker(s.BootReport, s.clock)
+	n := 0
+	for _, p := range s.bootOrder() {
+		if p.Lock != nil {
+			s.startLeading(p)
+			boot.skipped(p.Name, "singleton, started once leading")
+			continue
+		}
+		if len(p.ActivatePaths) > 0 && !pathsHaveContent(p.ActivatePaths) {
+			logInfo("%s waiting for path activation", p.Name)
+			p.mu.Lock()
+			p.state = StateWaiting
+			p.mu.Unlock()
+			boot.skipped(p.Name, "waiting for path activation")
+			continue
+		}
+		queued := s.clock.Now()
+		delay := s.startDelay(p, n)
+		n++
+		if delay > 0 || len(p.WaitFor) > 0 {
+			boot.wg.Add(1)
+			s.startAsync(p, delay, func(err error) {
+				defer boot.wg.Done()
+				if err == nil {
+					boot.record(p, queued)
+				}
+			})
+			continue
+		}
 		if err := p.Start(); err != nil {
-			s.mu.RUnlock()
 			return err
 		}
+		boot.record(p, queued)
+	}
+	boot.finish()
+
+	logInfo("supervisor running, press Ctrl+C to stop")
+
+	if s.ControlSocket != "" {
+		if err := s.listenControl(); err != nil {
+			logWarn("%v", err)
+		}
+		defer s.closeControl()
+	}
+	s.startDeployAPI()
+	defer s.stopDeployAPI()
+	s.startWebhooks()
+	defer s.stopWebhooks()
+	s.startStatusPage()
+	defer s.stopStatusPage()
+	s.startAgent()
+	defer stopAgent()
+
+	s.startWatcher()
+	s.startKmsg()
+	s.schedulePlannedRestarts()
+	if s.ConfigSyncInterval > 0 && s.configSource != "" {
+		go s.pollConfig()
 	}
-	s.mu.RUnlock()
 
-	fmt.Println("[gosv] supervisor running, press Ctrl+C to stop")
+	// Periodic RSS sampling for the memory leak heuristic
+	leakTicker := s.clock.NewTicker(LeakSampleInterval)
+	defer leakTicker.Stop()
+
+	// Memory pressure checks for evictions
+	pressureTicker := s.clock.NewTicker(PressureCheckInterval)
+	defer pressureTicker.Stop()
+
+	// Status updates and watchdog pings for systemd. From the main loop,
+	// so the watchdog goes quiet if it hangs.
+	var notifyTick <-chan time.Time
+	if s.notify != nil {
+		t := s.clock.NewTicker(s.notify.interval())
+		defer t.Stop()
+		notifyTick = t.C()
+		s.notify.ready(s.healthSummary())
+	}
 
 	// Main supervisor loop
 	for {
 		select {
+		case <-s.childChan:
+			// Child state changed - reap zombies
+			s.reapZombies()
+
 		case sig := <-s.sigChan:
 			switch sig {
-			case syscall.SIGCHLD:
-				// Child state changed - reap zombies
-				s.reapZombies()
-
 			case syscall.SIGTERM, syscall.SIGINT:
 				// Shutdown requested
 				s.gracefulShutdown()
+				if done, code := s.mainExited(); done {
+					s.exitCode = code
+				}
+				return nil
+
+			case syscall.SIGTSTP:
+				// Drain, then shut down
+				s.drain()
+				s.gracefulShutdown()
 				return nil
 
 			case syscall.SIGHUP:
-				// Could reload config here
-				fmt.Println("[gosv] received SIGHUP (reload not implemented)")
+				logInfo("received SIGHUP - reloading config")
+				go s.reloadConfig()
 
 			case syscall.SIGUSR1:
 				// Dump process introspection
-				fmt.Println("[gosv] received SIGUSR1 - dumping process info")
+				logInfo("received SIGUSR1 - dumping process info")
 				s.Introspect()
+
+			case syscall.SIGWINCH:
+				s.ResizePTYs()
+				// If we got it, the foreground service (which may not own
+				// the resized terminal) did not
+				s.forwardToForeground(syscall.SIGWINCH)
 			}
 
 		case <-s.reapChan:
 			// A child was reaped - check if we need to restart
 			s.handleRestarts()
 
+			// The main (or foreground) service ending ends the supervisor
+			if done, code := s.mainExited(); done {
+				reclaimTerminal()
+				logInfo("main service exited with code %d", code)
+				s.gracefulShutdown()
+				s.exitCode = code
+				return nil
+			}
+
+			// So does a critical service failing for good
+			if p, code := s.criticalFailure(); p != nil {
+				logError("critical service %s failed, shutting down", p.Name)
+				s.gracefulShutdown()
+				s.exitCode = code
+				return nil
+			}
+
+		case <-leakTicker.C():
+			s.sampleLeaks()
+			s.sampleNetwork()
+			s.snapshotDiagnostics()
+			s.settleRestartBudgets()
+
+		case <-pressureTicker.C():
+			s.checkPressure()
+
+		case <-notifyTick:
+			s.notify.update(s.healthSummary())
+
+		case data := <-s.configCh:
+			logInfo("config read - reloading")
+			s.applyConfig(data)
+
+		case call := <-s.ctlCh:
+			call.reply <- s.handleControl(call.req)
+
 		case <-s.shutdownCh:
 			s.gracefulShutdown()
 			return nil
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestSupervisor returns a supervisor on a ManualClock with procs
+// added, each down after an exit, as reapZombies leaves them
+func newTestSupervisor(t *testing.T, procs ...*Process) (*Supervisor, *ManualClock) {
+	t.Helper()
+	s := NewSupervisor()
+	c := NewManualClock(testEpoch)
+	s.SetClock(c)
+	for _, p := range procs {
+		if err := s.AddProcess(p); err != nil {
+			t.Fatal(err)
+		}
+		p.state = StateStopped
+		p.exitCode = 1
+	}
+	return s, c
+}
+
+func testProcess(name string) *Process {
+	return &Process{
+		Name:          name,
+		Command:       "/bin/false",
+		MaxRestarts:   5,
+		RestartDelay:  time.Second,
+		BackoffFactor: 2,
+	}
+}
+
+// restartDelay returns how far out p's scheduled restart is
+func restartDelay(t *testing.T, c *ManualClock, p *Process) time.Duration {
+	t.Helper()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.restartTimer == nil {
+		t.Fatalf("%s has no restart scheduled (state %s)", p.Name, p.state)
+	}
+	return p.restartAt.Sub(c.Now())
+}
+
+func TestHandleRestartsBackoff(t *testing.T) {
+	p := testProcess("web")
+	s, c := newTestSupervisor(t, p)
+
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		s.handleRestarts()
+		if got := restartDelay(t, c, p); got != want {
+			t.Fatalf("attempt %d: restart in %v, want %v", attempt+1, got, want)
+		}
+		// The restart is under way: a second pass must not schedule it again
+		s.handleRestarts()
+		p.mu.Lock()
+		if p.restarts != attempt+1 {
+			t.Fatalf("attempt %d: restarts = %d", attempt+1, p.restarts)
+		}
+		// It started and crashed right away
+		p.cancelRestart()
+		p.mu.Unlock()
+	}
+}
+
+func TestHandleRestartsGivesUp(t *testing.T) {
+	p := testProcess("web")
+	p.MaxRestarts = 2
+	s, _ := newTestSupervisor(t, p)
+
+	for range 2 {
+		s.handleRestarts()
+		p.mu.Lock()
+		p.cancelRestart()
+		p.mu.Unlock()
+	}
+	s.handleRestarts()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.exhausted || p.restartTimer != nil {
+		t.Fatalf("exhausted = %v, restart scheduled = %v; want gave up", p.exhausted, p.restartTimer != nil)
+	}
+}
+
+func TestHandleRestartsStableAfter(t *testing.T) {
+	p := testProcess("web")
+	s, c := newTestSupervisor(t, p)
+	p.restarts = 3
+
+	// Started, ran past StableAfter on the clock, and exited
+	const pid = 4242
+	p.mu.Lock()
+	p.state, p.pid, p.startTime = StateRunning, pid, c.Now()
+	p.mu.Unlock()
+	c.Advance(StableAfter + time.Second)
+	if !s.exited(p, pid, nil, nil) {
+		t.Fatal("exit not recorded")
+	}
+
+	s.handleRestarts()
+	if got := restartDelay(t, c, p); got != time.Second {
+		t.Fatalf("restart in %v, want the first delay (1s)", got)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.restarts != 1 {
+		t.Fatalf("restarts = %d, want 1 (counter reset)", p.restarts)
+	}
+}
+
+func TestHandleRestartsNotStable(t *testing.T) {
+	p := testProcess("web")
+	s, c := newTestSupervisor(t, p)
+	p.restarts = 3
+
+	const pid = 4242
+	p.mu.Lock()
+	p.state, p.pid, p.startTime = StateRunning, pid, c.Now()
+	p.mu.Unlock()
+	c.Advance(StableAfter - time.Second)
+	s.exited(p, pid, nil, nil)
+
+	s.handleRestarts()
+	if got := restartDelay(t, c, p); got != 8*time.Second {
+		t.Fatalf("restart in %v, want 8s (4th attempt)", got)
+	}
+}
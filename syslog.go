@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Default addresses of the local syslog and journald sockets
+const (
+	DefaultSyslogAddress   = "unix:///dev/log"
+	DefaultJournaldAddress = "unix:///run/systemd/journal/socket"
+)
+
+// DefaultSyslogFacility is the facility of services whose sink and
+// syslog settings don't name one, as for systemd's services
+const DefaultSyslogFacility = "daemon"
+
+// syslogFacilities are the syslog facilities by name (RFC 5424)
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities are the syslog severities, by their number
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// levelSeverities are the syslog severities of gosv's levels
+var levelSeverities = map[LogLevel]int{LevelDebug: 7, LevelInfo: 6, LevelWarn: 4, LevelError: 3}
+
+// journaldFieldName is what journald takes as a field name
+var journaldFieldName = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// SyslogConfig is how a service's lines are tagged for syslog and
+// journald sinks (the "syslog" object of a service)
+type SyslogConfig struct {
+	Identifier string            `json:"identifier"` // The program name (default: the service's name)
+	Facility   string            `json:"facility"`   // daemon, local0...local7... (default: the sink's)
+	Priority   map[string]string `json:"priority"`   // Severity by stream, e.g. "stderr": "err"
+}
+
+func (c *SyslogConfig) validate() error {
+	if c.Facility != "" {
+		if _, ok := syslogFacilities[c.Facility]; !ok {
+			return fmt.Errorf("syslog: unknown facility %q", c.Facility)
+		}
+	}
+	if strings.ContainsAny(c.Identifier, " \n:[") {
+		return fmt.Errorf("syslog: identifier %q has spaces, colons, brackets or newlines", c.Identifier)
+	}
+	for stream, severity := range c.Priority {
+		if stream != "stdout" && stream != "stderr" {
+			return fmt.Errorf("syslog: priority: %q is not stdout or stderr", stream)
+		}
+		if !slices.Contains(syslogSeverities, severity) {
+			return fmt.Errorf("syslog: priority: unknown severity %q (have %s)", severity, strings.Join(syslogSeverities, ", "))
+		}
+	}
+	return nil
+}
+
+// syslogTags are what a syslog or journald sink tags a line of a stream
+// with
+type syslogTags struct {
+	identifier string
+	facility   string // "" for the sink's
+	severity   int
+}
+
+// syslogTags returns the tags of p's lines on stream, whose level is
+// level: the service's syslog settings, or its name and the syslog
+// severity of the level
+func (p *Process) syslogTags(stream string, level LogLevel) syslogTags {
+	t := syslogTags{identifier: p.Name, severity: levelSeverities[level]}
+	if c := p.Syslog; c != nil {
+		if c.Identifier != "" {
+			t.identifier = c.Identifier
+		}
+		t.facility = c.Facility
+		if severity, ok := c.Priority[stream]; ok {
+			t.severity = slices.Index(syslogSeverities, severity)
+		}
+	}
+	return t
+}
+
+// describeSyslog describes for --dry-run how p's lines are tagged for
+// syslog and journald sinks, or returns "" if it has none and no syslog
+// settings
+func (p *Process) describeSyslog(sinks map[string]LogSinkConfig) string {
+	used := false
+	for _, name := range p.allLogSinks() {
+		if t := sinks[name].Type; t == LogSinkSyslog || t == LogSinkJournald {
+			used = true
+		}
+	}
+	if !used && p.Syslog == nil {
+		return ""
+	}
+	out, err := p.streamOutput("stdout").syslog, p.streamOutput("stderr").syslog
+	facility := out.facility
+	if facility == "" {
+		facility = "the sink's facility"
+	}
+	s := fmt.Sprintf("as %s, %s, stdout %s, stderr %s",
+		out.identifier, facility, syslogSeverities[out.severity], syslogSeverities[err.severity])
+	if !used {
+		s += " (unused: no syslog or journald sink)"
+	}
+	return s
+}
+
+// facility returns the facility of r
+func (sk *logSink) facility(r sinkRecord) int {
+	name := r.syslog.facility
+	if name == "" {
+		name = sk.cfg.Facility
+	}
+	if name == "" {
+		name = DefaultSyslogFacility
+	}
+	return syslogFacilities[name]
+}
+
+// encodeSyslog encodes r as a syslog message. To the local socket it is
+// what glibc's syslog() sends, "<PRI>Mmm dd hh:mm:ss ident: message";
+// over the network it is RFC 5424, which has the year, the time zone and
+// the host. Over TCP messages are framed by their length (RFC 6587's
+// octet counting), so multi-line messages stay one.
+//
+// KEY CONCEPT: Facility and severity
+// Every syslog message starts with its priority, <PRI>: the facility
+// times 8 plus the severity. The severity (emerg 0 through debug 7) says
+// how bad it is; the facility says what kind of program it comes from -
+// mail, cron, auth, or one of local0 to local7, which sites hand out to
+// their own applications. Decades of rsyslog and syslog-ng configs route
+// on the pair: "local3.* to the app servers' log host", "*.err to the
+// pager". A supervisor that sends everything as daemon.info breaks those
+// rules the day services move under it, so each service can name its
+// facility and identifier and map its streams to severities, as
+// SyslogIdentifier=, SyslogFacility= and SyslogLevel= do for systemd's.
+func (sk *logSink) encodeSyslog(r sinkRecord) []byte {
+	pri := sk.facility(r)*8 + r.syslog.severity
+	network, _, _ := strings.Cut(sk.cfg.address(), "://")
+	if network == "unix" {
+		return fmt.Appendf(nil, "<%d>%s %s: %s", pri, r.time.Format("Jan _2 15:04:05"), r.syslog.identifier, r.line)
+	}
+	host := sk.host
+	if host == "" {
+		host = "-"
+	}
+	msg := fmt.Appendf(nil, "<%d>1 %s %s %s - - - %s",
+		pri, r.time.Format("2006-01-02T15:04:05.000000Z07:00"), host, r.syslog.identifier, r.line)
+	if network == "tcp" {
+		msg = append(strconv.AppendInt(nil, int64(len(msg)), 10), append([]byte(" "), msg...)...)
+	}
+	return msg
+}
+
+// encodeJournald encodes r in journald's native protocol: fields as
+// NAME=value lines, or for values with a newline the name, a newline,
+// the value's length as a little-endian uint64, the value and a newline.
+// Labels become fields, with names upper-cased as journald wants them.
+func (sk *logSink) encodeJournald(r sinkRecord) []byte {
+	fields := map[string]string{
+		"MESSAGE":           r.line,
+		"PRIORITY":          strconv.Itoa(r.syslog.severity),
+		"SYSLOG_FACILITY":   strconv.Itoa(sk.facility(r)),
+		"SYSLOG_IDENTIFIER": r.syslog.identifier,
+		"GOSV_SERVICE":      r.service,
+		"GOSV_STREAM":       r.stream,
+	}
+	for name, value := range r.labels {
+		field := strings.TrimLeft(journaldFieldName.ReplaceAllString(strings.ToUpper(name), "_"), "_0123456789")
+		if _, taken := fields[field]; field != "" && !taken {
+			fields[field] = value
+		}
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		value := fields[name]
+		b.WriteString(name)
+		if strings.Contains(value, "\n") {
+			b.WriteByte('\n')
+			binary.Write(&b, binary.LittleEndian, uint64(len(value)))
+		} else {
+			b.WriteByte('=')
+		}
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// DefaultRestartSettle is how long a restart holds its throttle slot
+// when restart_settle_sec is not configured
+const DefaultRestartSettle = 5 * time.Second
+
+// restartThrottle lets at most max restarts be in flight at once
+//
+// KEY CONCEPT: Restart storms
+// When something many services share fails - a database, a DNS server,
+// a mounted volume - they all crash at once and, with independent
+// restart policies, all come back at once: dozens of processes loading
+// code, opening connections and warming caches in the same second,
+// hammering the very dependency that is trying to recover. A throttle
+// turns the stampede into a queue: a restart takes one of max slots and
+// keeps it until the process has had settle time to get going; the rest
+// wait their turn in order.
+type restartThrottle struct {
+	max    int
+	settle time.Duration
+	clock  Clock
+
+	mu     sync.Mutex
+	active int
+	queue  []*throttleWaiter
+}
+
+type throttleWaiter struct {
+	p     *Process
+	ready chan struct{}
+}
+
+func newRestartThrottle(max int, settle time.Duration, clock Clock) *restartThrottle {
+	return &restartThrottle{max: max, settle: settle, clock: clock}
+}
+
+// acquire waits for a slot for p's restart
+func (t *restartThrottle) acquire(p *Process) {
+	t.mu.Lock()
+	if t.active < t.max && len(t.queue) == 0 {
+		t.active++
+		t.mu.Unlock()
+		return
+	}
+	w := &throttleWaiter{p: p, ready: make(chan struct{})}
+	t.queue = append(t.queue, w)
+	pos, active := len(t.queue), t.active
+	t.mu.Unlock()
+
+	logInfo("restart of %s queued at position %d (%d restarts in flight, at most %d)", p.Name, pos, active, t.max)
+	<-w.ready
+}
+
+// releaseLater frees a slot once the restarted process had time to settle
+func (t *restartThrottle) releaseLater() {
+	t.clock.AfterFunc(t.settle, t.release)
+}
+
+// release frees a slot, handing it to the next queued restart if any
+func (t *restartThrottle) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) > 0 {
+		w := t.queue[0]
+		t.queue = t.queue[1:]
+		close(w.ready) // The slot passes on; active stays the same
+		return
+	}
+	t.active--
+}
+
+// position returns p's place in the queue (1 = next), or 0 if not queued
+func (t *restartThrottle) position(p *Process) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, w := range t.queue {
+		if w.p == p {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// SetRestartThrottle lets at most max restarts be in flight at once, each
+// holding its slot for settle after the process starts (0 max: no limit)
+func (s *Supervisor) SetRestartThrottle(max int, settle time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max <= 0 {
+		s.throttle = nil
+		return
+	}
+	if settle <= 0 {
+		settle = DefaultRestartSettle
+	}
+	if s.throttle != nil && s.throttle.max == max && s.throttle.settle == settle {
+		return
+	}
+	s.throttle = newRestartThrottle(max, settle, s.clock)
+}
+
+// applyGlobalConfig applies the supervisor-wide settings of a config that
+// parseConfig accepted
+func (s *Supervisor) applyGlobalConfig(data []byte) {
+	var cfg Config
+	if json.Unmarshal(data, &cfg) != nil {
+		return
+	}
+	s.SetRestartThrottle(cfg.MaxConcurrentRestarts, time.Duration(cfg.RestartSettleSec)*time.Second)
+	s.SetStartStagger(time.Duration(cfg.StartStaggerMS) * time.Millisecond)
+	setPools(cfg.Pools)
+	profiles, _ := parseLimitProfiles(cfg.LimitProfiles)
+	s.setLimitProfiles(profiles)
+	budgets, _ := groupRestartBudgets(cfg.Groups)
+	s.SetRestartBudgets(budgets)
+	s.configurePressure(cfg.MemoryPressure, cfg.Pools)
+	egress.configure(cfg.EgressInterfaces)
+	s.mu.Lock()
+	s.selfLimits = cfg.Supervisor
+	s.lokiConfig = cfg.Loki
+	s.logSinkConfigs = cfg.LogSinks
+	s.eventJournalPath, s.eventJournalMB = cfg.EventJournal, cfg.EventJournalMaxMB
+	s.stateDB, s.stateRetentionDays, s.stateSampleSec = cfg.StateDB, cfg.StateRetentionDays, cfg.StateSampleSec
+	s.stateRevisions = cfg.StateRevisions
+	s.webhookConfig = cfg.Webhooks
+	s.statusPageConfig = cfg.StatusPage
+	s.agentConfig = cfg.Agent
+	s.networkAccounting = cfg.NetworkAccounting
+	s.mu.Unlock()
+}
+
+// restart starts p for a restart that is due, waiting for a throttle slot
+// first if restarts are throttled
+func (s *Supervisor) restart(p *Process) error {
+	s.mu.RLock()
+	t := s.throttle
+	s.mu.RUnlock()
+	if t != nil {
+		t.acquire(p)
+		if !s.mayStart(p) {
+			t.release() // Stopped or removed while queued
+			return nil
+		}
+		defer t.releaseLater()
+	}
+	return p.Start()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig is the TLS settings of an HTTP listener (deploy, webhooks,
+// status_page). Without tls_cert it serves plain HTTP.
+type TLSConfig struct {
+	CertFile string `json:"tls_cert"`  // PEM certificate chain of the listener
+	KeyFile  string `json:"tls_key"`   // Its PEM private key
+	ClientCA string `json:"client_ca"` // PEM CAs that client certificates must chain to
+}
+
+// enabled reports whether the listener serves HTTPS
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != ""
+}
+
+// validate checks the TLS settings of the listener named what
+func (c TLSConfig) validate(what string) error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("%s: tls_cert and tls_key go together", what)
+	}
+	if c.ClientCA != "" && !c.enabled() {
+		return fmt.Errorf("%s: client_ca needs tls_cert and tls_key", what)
+	}
+	return nil
+}
+
+// isLoopback reports whether the listen address addr can only be reached
+// from this host. An address without a host listens on every interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// scheme returns the URL scheme of the listener, for logs
+func (c TLSConfig) scheme() string {
+	if c.enabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// describeClients describes which clients the listener accepts, for
+// --dry-run: "" for any, or those with a certificate from client_ca
+func (c TLSConfig) describeClients() string {
+	if c.ClientCA == "" {
+		return ""
+	}
+	return ", clients with a certificate from " + c.ClientCA + " only"
+}
+
+// certLoader serves a certificate from its files, and loads it again when
+// the certificate file changes, so that a renewed certificate needs no
+// reload
+type certLoader struct {
+	certFile, keyFile string
+	mu                sync.Mutex
+	modTime           time.Time
+	cert              *tls.Certificate
+}
+
+func (l *certLoader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fi, err := os.Stat(l.certFile)
+	if err == nil && l.cert != nil && fi.ModTime().Equal(l.modTime) {
+		return l.cert, nil
+	}
+	var cert tls.Certificate
+	if err == nil {
+		cert, err = tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	}
+	if err != nil {
+		if l.cert != nil {
+			// Halfway through a renewal, most likely: keep the old one
+			logWarn("tls: keeping the loaded certificate: %v", err)
+			return l.cert, nil
+		}
+		return nil, err
+	}
+	l.cert, l.modTime = &cert, fi.ModTime()
+	return l.cert, nil
+}
+
+// listen opens a TCP listener on addr, with TLS if configured. A client
+// CA makes it require and verify client certificates (mTLS).
+//
+// KEY CONCEPT: TLS and client certificates
+// Plain HTTP across a network can be read and changed by anything on the
+// path: a bearer token sent once can be replayed forever, and a request
+// body rewritten. TLS encrypts and authenticates the server to the
+// client. With client_ca it also authenticates the client to the server:
+// the handshake fails unless the client presents a certificate signed by
+// one of those CAs, so a stolen token is useless without the matching
+// key, and nothing reaches the handler from a peer that isn't trusted.
+func (c TLSConfig) listen(addr string) (net.Listener, error) {
+	if !c.enabled() {
+		return net.Listen("tcp", addr)
+	}
+	loader := &certLoader{certFile: c.CertFile, keyFile: c.KeyFile}
+	if _, err := loader.get(nil); err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	cfg := &tls.Config{GetCertificate: loader.get, MinVersion: tls.VersionTLS12}
+	if c.ClientCA != "" {
+		data, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("tls: no certificates in client_ca %s", c.ClientCA)
+		}
+		cfg.ClientCAs, cfg.ClientAuth = pool, tls.RequireAndVerifyClientCert
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, cfg), nil
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unitGlobalConfig is the file in a unit directory with the settings that
+// aren't per service (the config without "services")
+const unitGlobalConfig = "gosv.json"
+
+// unitDirective is one Key=value line of a unit file
+type unitDirective struct {
+	Section, Key, Value string
+	Line                int
+}
+
+// readUnitDir turns a directory of systemd .service files into a gosv
+// config: one service per unit, named after the file without .service
+//
+// KEY CONCEPT: Unit files as a config source
+// Teams evaluating gosv on a host without systemd (a container, an
+// embedded board, FreeBSD) often already describe their services as
+// systemd units. Rather than translating them by hand, gosv reads the
+// directives that have a direct counterpart: ExecStart, Type and PIDFile,
+// Restart and StartLimitBurst, User and Group, MemoryMax, CPUQuota and
+// CPUAffinity, Environment, After, KillMode, TimeoutStopSec, PrivateTmp and
+// PrivateDevices. Everything else is listed in a warning, not silently
+// dropped - a unit that relies on ProtectSystem= or
+// AmbientCapabilities= does not get that protection here. Drop-in
+// directories, templates (foo@.service) and EnvironmentFile= are not
+// read.
+//
+// Settings that aren't per service (env_defaults, groups, supervisor...)
+// come from gosv.json in the same directory, if there is one; its
+// "services", if any, come before the units'.
+func readUnitDir(dir string) ([]byte, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.service"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	inDir := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		inDir[filepath.Base(path)] = true
+	}
+
+	var services []json.RawMessage
+	cfg := map[string]json.RawMessage{}
+	data, err := os.ReadFile(filepath.Join(dir, unitGlobalConfig))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", unitGlobalConfig, err)
+		}
+		if raw, ok := cfg["services"]; ok {
+			if err := json.Unmarshal(raw, &services); err != nil {
+				return nil, fmt.Errorf("%s: services: %w", unitGlobalConfig, err)
+			}
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	for _, path := range paths {
+		unit := filepath.Base(path)
+		if strings.Contains(unit, "@") {
+			logWarn("%s: skipping %s, templates are not supported", dir, unit)
+			continue
+		}
+		directives, err := parseUnitFile(path)
+		if err != nil {
+			return nil, err
+		}
+		svc, err := unitService(unit, directives, inDir)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		raw, err := json.Marshal(svc)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, raw)
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("%s: no .service files", dir)
+	}
+
+	if cfg["services"], err = json.Marshal(services); err != nil {
+		return nil, err
+	}
+	return json.Marshal(cfg)
+}
+
+// parseUnitFile reads the directives of a unit file: "[Section]" headers,
+// Key=value lines, "#" and ";" comments, and lines continued with a
+// trailing backslash
+func parseUnitFile(path string) ([]unitDirective, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var directives []unitDirective
+	section, pending, start := "", "", 0
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if pending == "" && (line == "" || line[0] == '#' || line[0] == ';') {
+			continue
+		}
+		if pending == "" {
+			start = n
+		}
+		if strings.HasSuffix(line, "\\") {
+			pending += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		line, pending = pending+line, ""
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: bad section header %q", path, start, line)
+			}
+			section = line[1 : len(line)-1]
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: not Key=value: %q", path, start, line)
+		}
+		if section == "" {
+			return nil, fmt.Errorf("%s:%d: %s outside a section", path, start, key)
+		}
+		directives = append(directives, unitDirective{
+			Section: section,
+			Key:     strings.TrimSpace(key),
+			Value:   strings.TrimSpace(value),
+			Line:    start,
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if pending != "" {
+		return nil, fmt.Errorf("%s: ends in a continued line", path)
+	}
+	return directives, nil
+}
+
+// unitService maps the directives of unit onto the fields of a gosv
+// service. Only fields a directive sets are in the result, so group
+// defaults still apply to the rest. inDir holds the units of the
+// directory; After= on anything else (network.target...) is dropped.
+func unitService(unit string, directives []unitDirective, inDir map[string]bool) (map[string]any, error) {
+	name := strings.TrimSuffix(unit, ".service")
+	svc := map[string]any{"name": name}
+
+	// Later lines override earlier ones, and an empty value resets a list
+	var execStart []string
+	env := map[string]string{}
+	var after, groups, unsupported []string
+	restart, burst := "no", 5
+	streams := map[string]map[string]any{}
+	syslog := map[string]any{}
+	for _, d := range directives {
+		where := fmt.Sprintf("line %d: %s", d.Line, d.Key)
+		switch d.Section + "." + d.Key {
+		case "Unit.Description", "Unit.Documentation":
+		case "Unit.After":
+			if d.Value == "" {
+				after = nil
+			}
+			for _, dep := range strings.Fields(d.Value) {
+				if dep != unit && inDir[dep] {
+					after = append(after, strings.TrimSuffix(dep, ".service"))
+				}
+			}
+		case "Service.ExecStart":
+			if d.Value == "" {
+				execStart = nil
+			} else {
+				execStart = append(execStart, d.Value)
+			}
+		case "Service.Type":
+			switch d.Value {
+			case "simple", "exec", "notify", "idle":
+				// gosv doesn't wait for readiness: notify is started as exec
+				svc["type"] = "exec"
+			case "forking":
+				svc["type"] = "forking"
+			default:
+				return nil, fmt.Errorf("%s: type %q is not supported", where, d.Value)
+			}
+		case "Service.PIDFile":
+			svc["pid_file"] = d.Value
+		case "Service.Restart":
+			switch d.Value {
+			case "no", "always", "on-failure", "on-abnormal", "on-watchdog", "on-abort":
+				restart = d.Value
+			case "on-success":
+				// The opposite of on-failure, which gosv has no policy for
+				return nil, fmt.Errorf("%s: on-success is not supported (restart: always, on-failure or no)", where)
+			default:
+				return nil, fmt.Errorf("%s: unknown value %q", where, d.Value)
+			}
+		case "Service.StartLimitBurst", "Unit.StartLimitBurst":
+			n, err := strconv.Atoi(d.Value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s: not a count: %q", where, d.Value)
+			}
+			burst = n
+		case "Service.User":
+			svc["user"] = d.Value
+		case "Service.Group":
+			svc["group"] = d.Value
+		case "Service.SupplementaryGroups":
+			if d.Value == "" {
+				groups = nil
+			}
+			groups = append(groups, strings.Fields(d.Value)...)
+		case "Service.MemoryMax", "Service.MemoryLimit":
+			mb, err := unitMemoryMB(d.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", where, err)
+			}
+			svc["memory_mb"] = mb
+		case "Service.CPUQuota":
+			percent, err := strconv.Atoi(strings.TrimSuffix(d.Value, "%"))
+			if err != nil || !strings.HasSuffix(d.Value, "%") || percent <= 0 {
+				return nil, fmt.Errorf("%s: not a percentage: %q", where, d.Value)
+			}
+			svc["cpu_percent"] = percent
+		case "Service.CPUAffinity", "Service.AllowedCPUs":
+			// Ranges separated by spaces or commas
+			svc["cpus"] = strings.Join(strings.Fields(strings.ReplaceAll(d.Value, ",", " ")), ",")
+		case "Service.Environment":
+			if d.Value == "" {
+				env = map[string]string{}
+			}
+			words, err := splitUnitWords(d.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", where, err)
+			}
+			for _, w := range words {
+				k, v, ok := strings.Cut(w, "=")
+				if !ok || k == "" {
+					return nil, fmt.Errorf("%s: not NAME=value: %q", where, w)
+				}
+				env[k] = v
+			}
+		case "Service.KillMode":
+			switch d.Value {
+			case "control-group", "process", "mixed", "none":
+				svc["kill_mode"] = d.Value
+			default:
+				return nil, fmt.Errorf("%s: unknown value %q", where, d.Value)
+			}
+		case "Service.TimeoutStopSec":
+			// Seconds, or a duration Go can parse ("90s", "1m30s")
+			value := d.Value
+			if _, err := strconv.Atoi(value); err == nil {
+				value += "s"
+			}
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout < time.Second {
+				return nil, fmt.Errorf("%s: not a duration of a second or more: %q", where, d.Value)
+			}
+			svc["stop_timeout_sec"] = int(timeout / time.Second)
+		case "Service.PrivateTmp", "Service.PrivateDevices":
+			on, err := unitBool(d.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", where, err)
+			}
+			if d.Key == "PrivateTmp" {
+				svc["private_tmp"] = on
+			} else {
+				svc["private_devices"] = on
+			}
+		case "Service.StandardOutput", "Service.StandardError":
+			stream := "stdout"
+			if d.Key == "StandardError" {
+				stream = "stderr"
+			}
+			out, err := unitOutput(d.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", where, err)
+			}
+			streams[stream] = out
+		case "Service.SyslogIdentifier":
+			syslog["identifier"] = d.Value
+		case "Service.SyslogFacility":
+			syslog["facility"] = d.Value
+		case "Service.SyslogLevel":
+			// The level of lines without a <N> prefix, on both streams
+			syslog["priority"] = map[string]string{"stdout": d.Value, "stderr": d.Value}
+		default:
+			if d.Section != "Install" {
+				unsupported = append(unsupported, d.Key)
+			}
+		}
+	}
+	if len(unsupported) > 0 {
+		logWarn("%s: ignoring unsupported directives: %s", unit, strings.Join(unsupported, ", "))
+	}
+
+	switch len(execStart) {
+	case 0:
+		return nil, fmt.Errorf("no ExecStart")
+	case 1:
+	default:
+		return nil, fmt.Errorf("%d ExecStart lines; gosv runs one command per service", len(execStart))
+	}
+	argv, err := unitCommand(execStart[0], unit, env)
+	if err != nil {
+		return nil, fmt.Errorf("ExecStart: %w", err)
+	}
+	svc["command"] = argv[0]
+	if len(argv) > 1 {
+		svc["args"] = argv[1:]
+	}
+
+	switch restart {
+	case "no":
+		svc["restart"] = RestartNever
+	case "always", "on-failure":
+		svc["restart"] = restart
+	case "on-abnormal", "on-abort", "on-watchdog":
+		// Signals and timeouts are failures in gosv, and so is any
+		// non-zero exit code
+		logWarn("%s: Restart=%s becomes on-failure, which also restarts after non-zero exit codes", unit, restart)
+		svc["restart"] = RestartOnFailure
+	}
+	if restart != "no" {
+		if burst == 0 {
+			// StartLimitBurst=0 turns the limit off
+			svc["max_restarts"] = "unlimited"
+		} else {
+			svc["max_restarts"] = burst
+		}
+	}
+	if len(env) > 0 {
+		svc["env"] = env
+	}
+	if len(after) > 0 {
+		svc["after"] = after
+	}
+	if len(groups) > 0 {
+		svc["supplementary_groups"] = groups
+	}
+	// StandardError= defaults to (and "inherit" means) StandardOutput=
+	if out, ok := streams["stderr"]; (!ok || out == nil) && streams["stdout"] != nil {
+		streams["stderr"] = streams["stdout"]
+	}
+	for stream, out := range streams {
+		if out != nil {
+			svc[stream] = out
+		}
+	}
+	if len(syslog) > 0 {
+		svc["syslog"] = syslog
+	}
+	return svc, nil
+}
+
+// unitOutput maps a StandardOutput= or StandardError= value onto a stream
+// config, nil for "inherit" and for the journal, syslog, kmsg and the
+// console, which all end up where gosv's own output goes. file:, append:
+// and truncate: all append to the file.
+func unitOutput(value string) (map[string]any, error) {
+	kind, path, _ := strings.Cut(value, ":")
+	switch kind {
+	case "", "inherit", "journal", "syslog", "kmsg", "tty", "journal+console", "syslog+console", "kmsg+console":
+		return nil, nil
+	case "null":
+		return map[string]any{"console": false}, nil
+	case "file", "append", "truncate":
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("%q is not an absolute path", path)
+		}
+		return map[string]any{"console": false, "file": path}, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %q", value)
+	}
+}
+
+// unitCommand splits an ExecStart= value into a command and arguments.
+// It drops the prefixes systemd allows ("-", "@", "+", "!", ":"),
+// expands the specifiers %n, %N, %p and %%, and substitutes ${NAME} and
+// $NAME with the unit's Environment= (a lone $NAME splits into words).
+func unitCommand(value, unit string, env map[string]string) ([]string, error) {
+	expand, argv0 := true, false
+	for len(value) > 0 && strings.ContainsRune("-@+!:", rune(value[0])) {
+		switch value[0] {
+		case ':':
+			expand = false
+		case '@':
+			argv0 = true
+		}
+		value = value[1:]
+	}
+
+	value, err := expandSpecifiers(value, unit)
+	if err != nil {
+		return nil, err
+	}
+	words, err := splitUnitWords(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var argv []string
+	for _, w := range words {
+		switch {
+		case !expand:
+			argv = append(argv, w)
+		case strings.HasPrefix(w, "$") && unitVarName(w[1:]):
+			argv = append(argv, strings.Fields(env[w[1:]])...)
+		default:
+			argv = append(argv, expandUnitVars(w, env))
+		}
+	}
+	// "@" means the second word is argv[0], which gosv can't set
+	if argv0 && len(argv) > 1 {
+		argv = append(argv[:1], argv[2:]...)
+	}
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return argv, nil
+}
+
+// expandSpecifiers expands the unit specifiers that make sense outside
+// systemd: %n (the unit name), %N and %p (without .service) and %%
+func expandSpecifiers(s, unit string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+1 == len(s) {
+			return "", fmt.Errorf("trailing %% in %q", s)
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			sb.WriteString(unit)
+		case 'N', 'p':
+			sb.WriteString(strings.TrimSuffix(unit, ".service"))
+		case '%':
+			sb.WriteByte('%')
+		default:
+			return "", fmt.Errorf("unsupported specifier %%%c", s[i])
+		}
+	}
+	return sb.String(), nil
+}
+
+// expandUnitVars substitutes ${NAME} in a word with its value in env
+// (empty if unset), and $$ with $
+func expandUnitVars(w string, env map[string]string) string {
+	var sb strings.Builder
+	for i := 0; i < len(w); i++ {
+		switch {
+		case strings.HasPrefix(w[i:], "$$"):
+			sb.WriteByte('$')
+			i++
+		case strings.HasPrefix(w[i:], "${"):
+			end := strings.IndexByte(w[i:], '}')
+			if end < 0 || !unitVarName(w[i+2:i+end]) {
+				sb.WriteByte('$')
+				continue
+			}
+			sb.WriteString(env[w[i+2:i+end]])
+			i += end
+		default:
+			sb.WriteByte(w[i])
+		}
+	}
+	return sb.String()
+}
+
+// unitVarName reports whether s is a variable name as $NAME expands it
+func unitVarName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if !(r == '_' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// splitUnitWords splits s at whitespace like systemd does: "double" and
+// 'single' quotes group words, and backslash escapes the next character
+// (\n, \t and \s are newline, tab and space)
+func splitUnitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			if i+1 == len(s) {
+				return nil, fmt.Errorf("trailing backslash in %q", s)
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				word.WriteByte('\n')
+			case 't':
+				word.WriteByte('\t')
+			case 's':
+				word.WriteByte(' ')
+			default:
+				word.WriteByte(s[i])
+			}
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// unitMemoryMB converts a MemoryMax= value (bytes with an optional K, M,
+// G or T suffix, base 1024, or "infinity") to memory_mb, rounding up
+func unitMemoryMB(value string) (int64, error) {
+	if value == "infinity" || value == "" {
+		return 0, nil
+	}
+	shift := map[byte]uint{'K': 10, 'M': 20, 'G': 30, 'T': 40}
+	num, unit := value, uint(0)
+	if s, ok := shift[value[len(value)-1]]; ok {
+		num, unit = value[:len(value)-1], s
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("not a size: %q (percentages are not supported)", value)
+	}
+	bytes := n << unit
+	if bytes>>unit != n {
+		return 0, fmt.Errorf("size out of range: %q", value)
+	}
+	return (bytes + 1<<20 - 1) >> 20, nil
+}
+
+// unitBool parses a systemd boolean
+func unitBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "1", "yes", "y", "true", "t", "on":
+		return true, nil
+	case "0", "no", "n", "false", "f", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("not a boolean: %q", value)
+}
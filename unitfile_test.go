@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUnitFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		unit    string
+		want    []unitDirective
+		wantErr string
+	}{
+		{
+			name: "sections and comments",
+			unit: "# web\n[Unit]\nDescription = Web server\n\n; old\n[Service]\nExecStart=/usr/bin/web --port 80\n",
+			want: []unitDirective{
+				{Section: "Unit", Key: "Description", Value: "Web server", Line: 3},
+				{Section: "Service", Key: "ExecStart", Value: "/usr/bin/web --port 80", Line: 7},
+			},
+		},
+		{
+			name: "continued line",
+			unit: "[Service]\nExecStart=/usr/bin/web \\\n  --port 80 \\\n  --verbose\nUser=web\n",
+			want: []unitDirective{
+				{Section: "Service", Key: "ExecStart", Value: "/usr/bin/web  --port 80  --verbose", Line: 2},
+				{Section: "Service", Key: "User", Value: "web", Line: 5},
+			},
+		},
+		{
+			name: "value with =",
+			unit: "[Service]\nEnvironment=OPTS=a=b\n",
+			want: []unitDirective{{Section: "Service", Key: "Environment", Value: "OPTS=a=b", Line: 2}},
+		},
+		{
+			name: "empty value",
+			unit: "[Service]\nEnvironment=\n",
+			want: []unitDirective{{Section: "Service", Key: "Environment", Value: "", Line: 2}},
+		},
+		{name: "outside a section", unit: "ExecStart=/bin/true\n", wantErr: "outside a section"},
+		{name: "bad header", unit: "[Service\n", wantErr: "bad section header"},
+		{name: "not a directive", unit: "[Service]\nExecStart\n", wantErr: "not Key=value"},
+		{name: "continued at the end", unit: "[Service]\nExecStart=/bin/true \\\n", wantErr: "ends in a continued line"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "web.service")
+		if err := os.WriteFile(path, []byte(tt.unit), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseUnitFile(path)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want one about %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnitService(t *testing.T) {
+	inDir := map[string]bool{"db.service": true, "web.service": true}
+	tests := []struct {
+		name       string
+		directives []unitDirective
+		want       map[string]any // Fields to check
+		wantErr    string
+	}{
+		{
+			name: "limits and order",
+			directives: []unitDirective{
+				{Section: "Unit", Key: "After", Value: "network.target db.service"},
+				{Section: "Service", Key: "ExecStart", Value: "/usr/bin/web --port 80"},
+				{Section: "Service", Key: "MemoryMax", Value: "512M"},
+				{Section: "Service", Key: "CPUQuota", Value: "150%"},
+				{Section: "Service", Key: "KillMode", Value: "mixed"},
+				{Section: "Service", Key: "TimeoutStopSec", Value: "1m30s"},
+			},
+			want: map[string]any{"name": "web", "command": "/usr/bin/web", "args": []string{"--port", "80"},
+				"after": []string{"db"}, "memory_mb": int64(512), "cpu_percent": 150, "kill_mode": "mixed",
+				"stop_timeout_sec": 90, "restart": RestartNever},
+		},
+		{
+			name: "restart with an unlimited burst",
+			directives: []unitDirective{
+				{Section: "Service", Key: "ExecStart", Value: "/usr/bin/web"},
+				{Section: "Service", Key: "Restart", Value: "always"},
+				{Section: "Service", Key: "StartLimitBurst", Value: "0"},
+			},
+			want: map[string]any{"restart": "always", "max_restarts": "unlimited"},
+		},
+		{
+			name: "an empty ExecStart resets it",
+			directives: []unitDirective{
+				{Section: "Service", Key: "ExecStart", Value: "/usr/bin/old"},
+				{Section: "Service", Key: "ExecStart", Value: ""},
+				{Section: "Service", Key: "ExecStart", Value: "/usr/bin/new"},
+			},
+			want: map[string]any{"command": "/usr/bin/new"},
+		},
+		{name: "no ExecStart", directives: []unitDirective{{Section: "Service", Key: "User", Value: "web"}}, wantErr: "no ExecStart"},
+		{
+			name: "two ExecStart lines",
+			directives: []unitDirective{
+				{Section: "Service", Key: "ExecStart", Value: "/usr/bin/a"},
+				{Section: "Service", Key: "ExecStart", Value: "/usr/bin/b"},
+			},
+			wantErr: "2 ExecStart lines",
+		},
+		{
+			name: "on-success",
+			directives: []unitDirective{
+				{Section: "Service", Key: "ExecStart", Value: "/usr/bin/web"},
+				{Section: "Service", Key: "Restart", Value: "on-success"},
+			},
+			wantErr: "on-success is not supported",
+		},
+		{
+			name: "memory percentage",
+			directives: []unitDirective{
+				{Section: "Service", Key: "ExecStart", Value: "/usr/bin/web"},
+				{Section: "Service", Key: "MemoryMax", Value: "50%"},
+			},
+			wantErr: "percentages are not supported",
+		},
+	}
+	for _, tt := range tests {
+		svc, err := unitService("web.service", tt.directives, inDir)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want one about %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		for field, want := range tt.want {
+			if got := svc[field]; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s = %#v, want %#v", tt.name, field, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Usage is what a process used over one run
+//
+// KEY CONCEPT: rusage
+// wait4() returns more than the exit status: the kernel hands over the
+// child's resource usage, summed with that of every descendant the child
+// itself waited for. It's the only moment this is available - once
+// reaped, the process is gone. MaxRSS is the high-water mark of resident
+// memory of the largest single process, not the total; the cgroup's
+// memory.peak covers the whole service, page cache included.
+type Usage struct {
+	UserCPU             time.Duration
+	SystemCPU           time.Duration
+	MaxRSS              int64 // KB, largest single process
+	PeakMemory          int64 // Bytes, whole cgroup (0 if unknown)
+	ReadBlocks          int64 // 512-byte blocks read from storage
+	WriteBlocks         int64 // 512-byte blocks written to storage
+	VoluntarySwitches   int64 // Waited for I/O, locks, sleep...
+	InvoluntarySwitches int64 // Preempted while runnable
+}
+
+func usageFrom(ru *syscall.Rusage) Usage {
+	maxRSS := int64(ru.Maxrss)
+	if runtime.GOOS == "darwin" {
+		maxRSS /= 1024 // Bytes there, KB elsewhere
+	}
+	return Usage{
+		UserCPU:             time.Duration(ru.Utime.Nano()),
+		SystemCPU:           time.Duration(ru.Stime.Nano()),
+		MaxRSS:              maxRSS,
+		ReadBlocks:          int64(ru.Inblock),
+		WriteBlocks:         int64(ru.Oublock),
+		VoluntarySwitches:   int64(ru.Nvcsw),
+		InvoluntarySwitches: int64(ru.Nivcsw),
+	}
+}
+
+func (u Usage) String() string {
+	s := fmt.Sprintf("cpu %v user + %v sys, max rss %s",
+		u.UserCPU.Round(time.Millisecond), u.SystemCPU.Round(time.Millisecond), formatBytes(u.MaxRSS*1024))
+	if u.PeakMemory > 0 {
+		s += ", cgroup peak " + formatBytes(u.PeakMemory)
+	}
+	return s + fmt.Sprintf(", io %s read / %s written, %d voluntary / %d involuntary context switches",
+		formatBytes(u.ReadBlocks*512), formatBytes(u.WriteBlocks*512),
+		u.VoluntarySwitches, u.InvoluntarySwitches)
+}
+
+// formatBytes formats n bytes with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// trackPeak starts measuring the peak memory of this run in p's cgroup.
+// Caller must hold p.mu.
+//
+// memory.peak is the cgroup's all-time high, and a service's cgroup lives
+// across restarts. Since Linux 6.12 writing to it resets the peak seen
+// through that open file only, which gives a per-run peak; on older
+// kernels we report the all-time one.
+func (p *Process) trackPeak() {
+	if p.peakFile != nil {
+		p.peakFile.Close()
+		p.peakFile = nil
+	}
+	if p.cgroup == nil {
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(p.cgroup.path, "memory.peak"), os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	f.WriteString("reset") // Fails harmlessly before 6.12
+	p.peakFile = f
+}
+
+// readPeak returns the peak memory of p's cgroup since trackPeak (0 if
+// unknown) and stops tracking. Caller must hold p.mu.
+func (p *Process) readPeak() int64 {
+	if p.peakFile == nil {
+		return 0
+	}
+	defer func() {
+		p.peakFile.Close()
+		p.peakFile = nil
+	}()
+	if _, err := p.peakFile.Seek(0, io.SeekStart); err != nil {
+		return 0
+	}
+	data, err := io.ReadAll(p.peakFile)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return n
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// IDMap maps Count ids starting at Inside (in the namespace) to ids
+// starting at Outside (on the host)
+type IDMap struct {
+	Inside  int `json:"inside"`
+	Outside int `json:"outside"`
+	Count   int `json:"count"`
+}
+
+// UserNS runs a process in a user namespace of its own
+type UserNS struct {
+	UIDMap []IDMap `json:"uid_map"`
+	GIDMap []IDMap `json:"gid_map"`
+}
+
+// validate fills in default mappings and checks that gosv may set them up
+//
+// KEY CONCEPT: User namespaces
+// A user namespace has its own uids and gids, mapped onto ranges of host
+// ids, and its own set of capabilities: a process can be uid 0 with
+// CAP_SYS_ADMIN inside - mount things, bind low ports, run a nested
+// supervisor - while the kernel treats it as an ordinary host user
+// everywhere else. Without a mapping, ids show up as the overflow uid
+// (65534). Writing /proc/<pid>/uid_map is restricted: an unprivileged
+// process may only map its own uid (with setgroups denied), while root
+// may map any range. Only distinct host ranges keep services apart from
+// each other - permission checks for kill() and ptrace() compare host
+// ids, so two services mapped onto the same uid can still signal each
+// other, whatever their namespaces.
+func (u *UserNS) validate() error {
+	if len(u.UIDMap) == 0 {
+		u.UIDMap = []IDMap{{Inside: 0, Outside: os.Getuid(), Count: 1}}
+	}
+	if len(u.GIDMap) == 0 {
+		if u.UIDMap[0].Outside == os.Getuid() && len(u.UIDMap) == 1 && u.UIDMap[0].Count == 1 {
+			u.GIDMap = []IDMap{{Inside: u.UIDMap[0].Inside, Outside: os.Getgid(), Count: 1}}
+		} else {
+			u.GIDMap = u.UIDMap // Subordinate uid and gid ranges usually match
+		}
+	}
+	for _, maps := range [][]IDMap{u.UIDMap, u.GIDMap} {
+		for _, m := range maps {
+			if m.Inside < 0 || m.Outside < 0 || m.Count < 1 {
+				return fmt.Errorf("user_namespace: invalid mapping %+v", m)
+			}
+		}
+	}
+	if !u.mapsRoot() {
+		return fmt.Errorf("user_namespace: uid_map and gid_map must map id 0 (services run as root inside)")
+	}
+	if os.Geteuid() != 0 {
+		own := len(u.UIDMap) == 1 && u.UIDMap[0].Count == 1 && u.UIDMap[0].Outside == os.Getuid() &&
+			len(u.GIDMap) == 1 && u.GIDMap[0].Count == 1 && u.GIDMap[0].Outside == os.Getgid()
+		if !own {
+			return fmt.Errorf("user_namespace: without root gosv can only map its own uid and gid")
+		}
+	}
+	return nil
+}
+
+// mapsRoot reports whether uid and gid 0 are mapped
+func (u *UserNS) mapsRoot() bool {
+	has0 := func(maps []IDMap) bool {
+		for _, m := range maps {
+			if m.Inside == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	return has0(u.UIDMap) && has0(u.GIDMap)
+}
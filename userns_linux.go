@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// apply sets up attr to start the process in a new user namespace, as
+// root there. The kernel applies the mappings (written by the parent
+// while the child waits) before the exec.
+func (u *UserNS) apply(attr *syscall.SysProcAttr) {
+	attr.Cloneflags |= syscall.CLONE_NEWUSER
+	for _, m := range u.UIDMap {
+		attr.UidMappings = append(attr.UidMappings, syscall.SysProcIDMap{ContainerID: m.Inside, HostID: m.Outside, Size: m.Count})
+	}
+	for _, m := range u.GIDMap {
+		attr.GidMappings = append(attr.GidMappings, syscall.SysProcIDMap{ContainerID: m.Inside, HostID: m.Outside, Size: m.Count})
+	}
+	// Unprivileged gid maps require setgroups to be denied, or a process
+	// could drop a group that was denying it access
+	attr.GidMappingsEnableSetgroups = os.Geteuid() == 0
+	attr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: os.Geteuid() != 0}
+}
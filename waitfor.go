@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultWaitTimeout is how long a start waits for wait_for targets when
+// wait_timeout_sec is not configured
+const DefaultWaitTimeout = time.Minute
+
+// waitInterval is the pause between probe rounds
+const waitInterval = time.Second
+
+// WaitTarget is an external dependency a start waits for
+type WaitTarget struct {
+	Kind string // "tcp", "dns", "file" or "http"
+	Addr string // host:port, name, path or URL
+}
+
+func (t WaitTarget) String() string {
+	if t.Kind == "http" {
+		return t.Addr
+	}
+	return t.Kind + "://" + t.Addr
+}
+
+// parseWaitTarget parses "tcp://host:port", "dns://name", "file:///path"
+// or an http(s):// URL
+func parseWaitTarget(s string) (WaitTarget, error) {
+	kind, addr, ok := strings.Cut(s, "://")
+	if !ok || addr == "" {
+		return WaitTarget{}, fmt.Errorf("%q: want tcp://host:port, dns://name, file:///path or an http(s) URL", s)
+	}
+	switch kind {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return WaitTarget{}, fmt.Errorf("%q: %w", s, err)
+		}
+	case "dns":
+	case "file":
+		if !strings.HasPrefix(addr, "/") {
+			return WaitTarget{}, fmt.Errorf("%q: file path must be absolute", s)
+		}
+	case "http", "https":
+		return WaitTarget{Kind: "http", Addr: s}, nil
+	default:
+		return WaitTarget{}, fmt.Errorf("%q: unknown kind %q", s, kind)
+	}
+	return WaitTarget{Kind: kind, Addr: addr}, nil
+}
+
+// probe checks the target once
+func (t WaitTarget) probe() error {
+	switch t.Kind {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", t.Addr, 2*time.Second)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	case "dns":
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err := net.DefaultResolver.LookupHost(ctx, t.Addr)
+		return err
+	case "file":
+		_, err := os.Stat(t.Addr)
+		return err
+	default:
+		client := http.Client{Timeout: 2 * time.Second}
+		resp, err := client.Get(t.Addr)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// waitForDeps blocks until every WaitFor target answers, in order. It
+// returns false if the start was called off meanwhile (stopped, removed
+// or shutting down), and an error if WaitTimeout ran out.
+//
+// KEY CONCEPT: Waiting for what gosv doesn't manage
+// A service whose database isn't up yet typically crashes on its first
+// query, burning through restarts with backoff that grows while the
+// database is already back. Probing the dependency first - can we
+// connect to the port, does the name resolve, does the socket file
+// exist - turns that crash loop into a quiet wait. It's a start gate,
+// not a health check: once the service runs, losing the dependency is
+// the service's problem again.
+func (p *Process) waitForDeps() (bool, error) {
+	timeout := p.WaitTimeout
+	if timeout == 0 {
+		timeout = DefaultWaitTimeout
+	}
+	deadline := p.now().Add(timeout)
+	defer p.setWaitingFor("")
+
+	for _, t := range p.WaitFor {
+		p.setWaitingFor(t.String())
+		logged := false
+		for {
+			err := t.probe()
+			if err == nil {
+				if logged {
+					logInfo("%s: %s is up", p.Name, t)
+				}
+				break
+			}
+			if !logged {
+				logInfo("%s waiting for %s (%v)", p.Name, t, err)
+				logged = true
+			}
+			if p.now().After(deadline) {
+				return true, fmt.Errorf("gave up waiting for %s after %v: %w", t, timeout, err)
+			}
+			<-p.timeSource().After(waitInterval)
+			if p.mayStart != nil && !p.mayStart(p) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+func (p *Process) setWaitingFor(target string) {
+	p.mu.Lock()
+	p.waitingFor = target
+	p.mu.Unlock()
+}
+
+// startAsync starts p after delay on a goroutine of its own, so the delay
+// and waiting for its wait_for targets don't hold up the caller. done (if
+// set) gets the result of Start, nil if the start was called off.
+func (s *Supervisor) startAsync(p *Process, delay time.Duration, done func(error)) {
+	p.mu.Lock()
+	p.state = StateStarting
+	if delay > 0 {
+		p.delayedUntil = s.clock.Now().Add(delay)
+	}
+	p.mu.Unlock()
+	go func() {
+		if delay > 0 {
+			<-s.clock.After(delay)
+			p.mu.Lock()
+			p.delayedUntil = time.Time{}
+			p.mu.Unlock()
+			if !s.mayStart(p) {
+				if done != nil {
+					done(nil) // Stopped meanwhile
+				}
+				return
+			}
+		}
+		err := p.Start()
+		if err != nil {
+			logError("%v", err)
+			s.wakeRestarts() // A critical service may have failed
+		}
+		if done != nil {
+			done(err)
+		}
+	}()
+}
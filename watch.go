@@ -0,0 +1,86 @@
+package main
+
+import "time"
+
+// DefaultWatchDebounce is how long a watched path must be quiet before
+// the service is restarted. Editors and deploy tools usually touch several
+// files (or the same file several times) in quick succession.
+const DefaultWatchDebounce = 500 * time.Millisecond
+
+// watchSub is a subscriber: fn is called, debounced, after any of the
+// paths it was added for changes
+type watchSub struct {
+	proc     *Process
+	debounce time.Duration
+	fn       func(p *Process)
+}
+
+// watchTarget is one subscription to a watched directory
+type watchTarget struct {
+	sub  *watchSub
+	name string // basename to match, "" matches anything in the directory
+}
+
+// trigger (re)arms the debounce timer of sub. Each platform's Watcher
+// has the mu and timers it uses.
+func (w *Watcher) trigger(sub *watchSub) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if t, ok := w.timers[sub]; ok {
+		t.Reset(sub.debounce)
+		return
+	}
+	w.timers[sub] = time.AfterFunc(sub.debounce, func() {
+		w.mu.Lock()
+		delete(w.timers, sub)
+		w.mu.Unlock()
+		sub.fn(sub.proc)
+	})
+}
+
+// startWatcher sets up watches for every process with Watch or
+// ActivatePaths
+func (s *Supervisor) startWatcher() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var subs []*watchSub
+	var paths [][]string
+	for _, p := range s.processes {
+		if len(p.Watch) > 0 {
+			debounce := p.WatchDebounce
+			if debounce == 0 {
+				debounce = DefaultWatchDebounce
+			}
+			subs = append(subs, &watchSub{proc: p, debounce: debounce, fn: func(p *Process) {
+				logInfo("watched files of %s changed", p.Name)
+				s.RestartProcess(p)
+			}})
+			paths = append(paths, p.Watch)
+		}
+		if len(p.ActivatePaths) > 0 {
+			subs = append(subs, &watchSub{proc: p, debounce: DefaultWatchDebounce, fn: s.pathEvent})
+			paths = append(paths, p.ActivatePaths)
+		}
+	}
+	if len(subs) == 0 {
+		return
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		logWarn("watch mode unavailable: %v", err)
+		return
+	}
+	for i, sub := range subs {
+		for _, path := range paths[i] {
+			if err := w.Add(sub, path); err != nil {
+				logWarn("%s: %v", sub.proc.Name, err)
+			}
+		}
+	}
+
+	s.watcher = w
+	go w.Run()
+}
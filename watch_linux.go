@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// watchMask is what we care about in a watched directory
+//
+// KEY CONCEPT: inotify (man 7 inotify)
+// The kernel queues events for watched inodes on an inotify fd, which we
+// read() like a stream of struct inotify_event. We always watch the
+// *directory* containing a file rather than the file itself: deploys and
+// editors usually replace files atomically with rename(), which would
+// silently drop a watch placed on the old inode.
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_ATTRIB | syscall.IN_MODIFY
+
+// Watcher calls back into the supervisor when watched files change
+type Watcher struct {
+	fd      int
+	targets map[int32][]watchTarget // wd -> subscriptions
+
+	mu     sync.Mutex
+	timers map[*watchSub]*time.Timer
+}
+
+// NewWatcher creates an inotify instance
+func NewWatcher() (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %w", err)
+	}
+	return &Watcher{
+		fd:      fd,
+		targets: make(map[int32][]watchTarget),
+		timers:  make(map[*watchSub]*time.Timer),
+	}, nil
+}
+
+// Add watches path for sub. Directories match any entry inside them
+// (non-recursively); files match only themselves.
+func (w *Watcher) Add(sub *watchSub, path string) error {
+	dir, name := path, ""
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		// A file, or something that doesn't exist yet: watch its parent
+		dir, name = filepath.Dir(path), filepath.Base(path)
+	}
+
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		return fmt.Errorf("watch %s: %w", dir, err)
+	}
+	// inotify returns the same wd when a directory is added twice
+	w.targets[int32(wd)] = append(w.targets[int32(wd)], watchTarget{sub: sub, name: name})
+	return nil
+}
+
+// Run reads events until the inotify fd is closed. Meant to run in its
+// own goroutine; read() on an inotify fd blocks until events arrive.
+func (w *Watcher) Run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			return
+		}
+
+		// Events are variable length: a fixed header followed by Len
+		// bytes of NUL-padded name
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			for _, t := range w.targets[ev.Wd] {
+				if t.name == "" || t.name == name {
+					w.trigger(t.sub)
+				}
+			}
+		}
+	}
+}
+
+// Close stops the watcher; Run returns once the fd is closed
+func (w *Watcher) Close() error {
+	return syscall.Close(w.fd)
+}
@@ -0,0 +1,117 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchPollInterval is how often watched paths are checked
+const watchPollInterval = time.Second
+
+// Watcher calls back into the supervisor when watched files change
+//
+// KEY CONCEPT: Polling instead of inotify
+// inotify is Linux-only. The BSDs and macOS have kqueue's EVFILT_VNODE,
+// but it needs an open fd per watched file, and for a directory it only
+// says that an entry changed, not which one - so gosv would have to
+// rescan anyway. For the handful of config files and spool directories
+// a supervisor watches, stat()ing them once a second costs next to
+// nothing and sees atomic renames like any other change. The debounce
+// absorbs the extra second of latency.
+type Watcher struct {
+	targets []*polledTarget
+	done    chan struct{}
+	closing sync.Once
+
+	mu     sync.Mutex
+	timers map[*watchSub]*time.Timer
+}
+
+// polledTarget is a watchTarget with the state it was last seen in
+type polledTarget struct {
+	watchTarget
+	dir  string
+	last string
+}
+
+// NewWatcher creates a polling watcher
+func NewWatcher() (*Watcher, error) {
+	return &Watcher{
+		done:   make(chan struct{}),
+		timers: make(map[*watchSub]*time.Timer),
+	}, nil
+}
+
+// Add watches path for sub. Directories match any entry inside them
+// (non-recursively); files match only themselves.
+func (w *Watcher) Add(sub *watchSub, path string) error {
+	t := &polledTarget{watchTarget: watchTarget{sub: sub}, dir: path}
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		t.dir, t.name = filepath.Dir(path), filepath.Base(path)
+	}
+	if _, err := os.Stat(t.dir); err != nil {
+		return fmt.Errorf("watch %s: %w", t.dir, err)
+	}
+	t.last = t.state()
+	w.targets = append(w.targets, t)
+	return nil
+}
+
+// state summarizes what the target looks like now: name, size, mode and
+// modification time of the file, or of every entry of the directory
+func (t *polledTarget) state() string {
+	names := []string{t.name}
+	if t.name == "" {
+		entries, err := os.ReadDir(t.dir)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		names = names[:0]
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		sort.Strings(names)
+	}
+	var b strings.Builder
+	for _, name := range names {
+		fi, err := os.Stat(filepath.Join(t.dir, name))
+		if err != nil {
+			fmt.Fprintf(&b, "%s -\n", name)
+			continue
+		}
+		fmt.Fprintf(&b, "%s %d %v %d\n", name, fi.Size(), fi.Mode(), fi.ModTime().UnixNano())
+	}
+	return b.String()
+}
+
+// Run polls the targets until Close. Meant to run in its own goroutine.
+func (w *Watcher) Run() {
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		for _, t := range w.targets {
+			if state := t.state(); state != t.last {
+				t.last = state
+				w.trigger(t.sub)
+			}
+		}
+	}
+}
+
+// Close stops the watcher; Run returns at its next poll
+func (w *Watcher) Close() error {
+	w.closing.Do(func() { close(w.done) })
+	return nil
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The headers of a webhook: when it was signed, in Unix seconds, and the
+// HMAC of that time, the action and the body, as "sha256=<hex>"
+const (
+	webhookTimestampHeader = "X-Gosv-Timestamp"
+	webhookSignatureHeader = "X-Gosv-Signature"
+)
+
+// WebhookWindow is how far a webhook's timestamp may be from gosv's
+// clock. Older requests are refused, and a request is taken once within
+// it.
+const WebhookWindow = 5 * time.Minute
+
+// webhookActionPattern is what action names may look like: they're part
+// of the URL
+var webhookActionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// WebhookConfig is the top-level webhooks settings: an HTTP endpoint that
+// triggers the configured actions
+type WebhookConfig struct {
+	Listen     string                   `json:"listen"`      // host:port of the endpoint
+	SecretFile string                   `json:"secret_file"` // Key of the HMAC signatures
+	Actions    map[string]WebhookAction `json:"actions"`     // By name, the last part of the URL
+	TLSConfig
+}
+
+// WebhookAction is what a webhook does: one of reload, restart or job
+type WebhookAction struct {
+	Reload  bool            `json:"reload"`  // Reload the config
+	Restart string          `json:"restart"` // Restart a service or "@group"
+	Job     json.RawMessage `json:"job"`     // Run a service config once, as ctl run does
+	Pool    string          `json:"pool"`    // The pool the job queues in, as ctl run --pool
+}
+
+func (c *WebhookConfig) validate() error {
+	if c.Listen == "" || c.SecretFile == "" {
+		return fmt.Errorf("webhooks: listen and secret_file are required")
+	}
+	if len(c.Actions) == 0 {
+		return fmt.Errorf("webhooks: no actions")
+	}
+	if err := c.TLSConfig.validate("webhooks"); err != nil {
+		return err
+	}
+	if !isLoopback(c.Listen) && !c.enabled() {
+		return fmt.Errorf("webhooks: listen %s is not a loopback address, and needs tls_cert and tls_key", c.Listen)
+	}
+	for name, a := range c.Actions {
+		if !webhookActionPattern.MatchString(name) {
+			return fmt.Errorf("webhooks: invalid action name %q", name)
+		}
+		n := 0
+		for _, set := range []bool{a.Reload, a.Restart != "", a.Job != nil} {
+			if set {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("webhooks: %s: needs exactly one of reload, restart and job", name)
+		}
+		if a.Pool != "" && a.Job == nil {
+			return fmt.Errorf("webhooks: %s: pool is for jobs", name)
+		}
+		if a.Job != nil {
+			var svc ServiceConfig
+			if err := json.Unmarshal(a.Job, &svc); err != nil {
+				return fmt.Errorf("webhooks: %s: job: %w", name, err)
+			}
+			if svc.Command == "" {
+				return fmt.Errorf("webhooks: %s: job needs a command", name)
+			}
+		}
+	}
+	return nil
+}
+
+// webhookServer is the running webhook endpoint
+type webhookServer struct {
+	addr, secret string
+	tls          TLSConfig
+	srv          *http.Server
+}
+
+// startWebhooks starts, restarts or stops the webhook endpoint to match
+// the config. Its actions are looked up per request, so a reload that
+// only changes them leaves the endpoint be. Called at start and after
+// every reload.
+func (s *Supervisor) startWebhooks() {
+	s.mu.RLock()
+	cfg := s.webhookConfig
+	s.mu.RUnlock()
+	addr, secret, tlsCfg := "", "", TLSConfig{}
+	if cfg != nil {
+		addr, tlsCfg = cfg.Listen, cfg.TLSConfig
+		data, err := os.ReadFile(cfg.SecretFile)
+		if secret = strings.TrimSpace(string(data)); err != nil || secret == "" {
+			logWarn("webhooks: no endpoint, secret_file %s is unreadable or empty: %v", cfg.SecretFile, err)
+			addr = ""
+		}
+	}
+	s.webhookMu.Lock()
+	defer s.webhookMu.Unlock()
+	old := s.webhooks
+	if old != nil && old.addr == addr && old.secret == secret && old.tls == tlsCfg {
+		return
+	}
+	if old != nil {
+		old.srv.Close()
+	}
+	s.webhooks = nil
+	if addr == "" {
+		return
+	}
+	l, err := tlsCfg.listen(addr)
+	if err != nil {
+		logWarn("webhooks: %v", err)
+		return
+	}
+	w := &webhookServer{addr: addr, secret: secret, tls: tlsCfg}
+	w.srv = &http.Server{Handler: s.webhookHandler(secret), ReadHeaderTimeout: 10 * time.Second}
+	go w.srv.Serve(l)
+	s.webhooks = w
+	logInfo("webhooks listening on %s://%s/hooks/%s", tlsCfg.scheme(), l.Addr(), tlsCfg.describeClients())
+}
+
+// stopWebhooks closes the webhook endpoint at shutdown
+func (s *Supervisor) stopWebhooks() {
+	s.webhookMu.Lock()
+	w := s.webhooks
+	s.webhooks = nil
+	s.webhookMu.Unlock()
+	if w != nil {
+		w.srv.Close()
+	}
+}
+
+// validSignature reports whether signature (the header's "sha256=<hex>")
+// is the HMAC-SHA256 under secret of "<timestamp>.<action>.<body>"
+func validSignature(secret, timestamp, action string, body []byte, signature string) bool {
+	given, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s.%s.", timestamp, action)
+	mac.Write(body)
+	return hmac.Equal(given, mac.Sum(nil))
+}
+
+// webhookReplays remembers the signatures of the webhooks taken within
+// the last WebhookWindow, so that each is taken once
+type webhookReplays struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // MAC, in lower-case hex, to when it was signed
+}
+
+// first records signature, signed at signed, and reports whether it is
+// new. Signatures too old to be accepted again are forgotten.
+func (r *webhookReplays) first(signature string, signed, now time.Time) bool {
+	// Hex digits of either case decode to the same MAC: a captured
+	// signature re-cased is the same signature
+	mac := strings.ToLower(strings.TrimPrefix(signature, "sha256="))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for sig, t := range r.seen {
+		if now.Sub(t) > WebhookWindow {
+			delete(r.seen, sig)
+		}
+	}
+	if _, ok := r.seen[mac]; ok {
+		return false
+	}
+	r.seen[mac] = signed
+	return true
+}
+
+// webhookHandler serves POST /hooks/<action>. The body can be anything,
+// a CI system's notification for one, but it must be signed: the
+// webhookSignatureHeader has the HMAC-SHA256 under the secret of the
+// webhookTimestampHeader, the action and the body. The action is
+// started, not waited for: the answer is a ctlReply with status 202.
+//
+// KEY CONCEPT: Signed webhooks
+// A CI pipeline that just published a release needs a way to tell the
+// host about it, and handing it ssh keys to run `gosv ctl` gives it a
+// shell on every server it deploys to. A webhook gives it one narrow
+// door instead: it can ask for actions the config names - reload,
+// restart this group, run that migration - and nothing else, whatever
+// the request says. The request is signed with a shared secret (HMAC)
+// rather than carrying a password, so the secret never crosses the
+// wire. The signature covers the action and the time as well as the
+// body: a captured request can't be sent to another action, is refused
+// once it is older than WebhookWindow, and is taken only once within it.
+// Without TLS its body can still be read on the way, so it must not
+// carry secrets of its own.
+func (s *Supervisor) webhookHandler(secret string) http.Handler {
+	replays := &webhookReplays{seen: make(map[string]time.Time)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hooks/", func(w http.ResponseWriter, r *http.Request) {
+		reply := func(code int, out string, err error) {
+			rep := ctlReply{Output: out, Done: true}
+			if err != nil {
+				rep.Error = err.Error()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(rep)
+		}
+		if r.Method != http.MethodPost {
+			reply(http.StatusMethodNotAllowed, "", fmt.Errorf("webhooks: POST a webhook"))
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			reply(http.StatusBadRequest, "", fmt.Errorf("webhooks: %w", err))
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/hooks/")
+		timestamp, signature := r.Header.Get(webhookTimestampHeader), r.Header.Get(webhookSignatureHeader)
+		if !validSignature(secret, timestamp, name, body, signature) {
+			logWarn("webhooks: bad or missing signature from %s", r.RemoteAddr)
+			reply(http.StatusUnauthorized, "", fmt.Errorf("webhooks: bad or missing %s", webhookSignatureHeader))
+			return
+		}
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		now := s.clock.Now()
+		signed := time.Unix(unix, 0)
+		if err != nil || signed.Before(now.Add(-WebhookWindow)) || signed.After(now.Add(WebhookWindow)) {
+			logWarn("webhooks: %s from %s signed at %s, not within %v of now", name, r.RemoteAddr, timestamp, WebhookWindow)
+			reply(http.StatusUnauthorized, "", fmt.Errorf("webhooks: %s is not within %v of the server's time", webhookTimestampHeader, WebhookWindow))
+			return
+		}
+		if !replays.first(signature, signed, now) {
+			logWarn("webhooks: %s from %s was taken already", name, r.RemoteAddr)
+			reply(http.StatusConflict, "", fmt.Errorf("webhooks: this request was taken already"))
+			return
+		}
+		s.mu.RLock()
+		var action WebhookAction
+		ok := false
+		if s.webhookConfig != nil {
+			action, ok = s.webhookConfig.Actions[name]
+		}
+		s.mu.RUnlock()
+		if !ok {
+			reply(http.StatusNotFound, "", fmt.Errorf("webhooks: no action %q", name))
+			return
+		}
+		out, code, err := s.triggerWebhook(name, action)
+		if err != nil {
+			logWarn("%v (from %s)", err, r.RemoteAddr)
+			reply(code, "", err)
+			return
+		}
+		logInfo("webhook %s from %s: %s", name, r.RemoteAddr, out)
+		s.noteEvent(EventWebhook, "webhook %s from %s: %s", name, r.RemoteAddr, out)
+		reply(http.StatusAccepted, out, nil)
+	})
+	return mux
+}
+
+// triggerWebhook starts the action called name, and returns what it did
+// or the HTTP status of why it couldn't
+func (s *Supervisor) triggerWebhook(name string, action WebhookAction) (string, int, error) {
+	switch {
+	case action.Reload:
+		// A reload may stop services and take a while: not waited for
+		go s.callMain(ctlRequest{Command: "reload"})
+		return "reloading the config", 0, nil
+	case action.Restart != "":
+		if reply := s.callMain(ctlRequest{Command: "restart", Args: []string{action.Restart}}); reply.Error != "" {
+			return "", http.StatusInternalServerError, fmt.Errorf("webhooks: %s: %s", name, reply.Error)
+		}
+		return "restarting " + action.Restart, 0, nil
+	}
+
+	var svc map[string]json.RawMessage
+	if err := json.Unmarshal(action.Job, &svc); err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	if _, ok := svc["name"]; !ok {
+		svc["name"], _ = json.Marshal("hook-" + name)
+	}
+	job, _ := json.Marshal(svc)
+	var jobName string
+	json.Unmarshal(svc["name"], &jobName)
+	if _, err := s.lookup(jobName); err == nil {
+		return "", http.StatusConflict, fmt.Errorf("webhooks: %s: job %s is still running", name, jobName)
+	}
+	reply := s.callMain(ctlRequest{Command: "run", Job: job, Pool: action.Pool})
+	if reply.Error != "" {
+		return "", http.StatusInternalServerError, fmt.Errorf("webhooks: %s: %s", name, reply.Error)
+	}
+	p, err := s.lookup(reply.Services[0])
+	if err != nil || p.job == nil {
+		return "", http.StatusInternalServerError, fmt.Errorf("webhooks: %s: job vanished", name)
+	}
+	go s.runDetachedJob(p)
+	return "running job " + p.Name, 0, nil
+}
+
+// runDetachedJob runs the registered job p as `ctl run` does, but with no
+// client to wait for it: its output goes where services' output goes,
+// its exit is logged and journaled like theirs, and it's removed when it
+// exits. A job of a pool waits for its turn first.
+func (s *Supervisor) runDetachedJob(p *Process) {
+	defer s.removeJob(p)
+	if p.job.pool != nil && !s.waitForPool(json.NewEncoder(io.Discard), p, nil) {
+		return
+	}
+	p.mu.Lock()
+	p.ensureLogs()
+	lp := p.logs
+	p.mu.Unlock()
+	if err := p.Start(); err != nil {
+		p.mu.Lock()
+		p.job.closePipes()
+		p.mu.Unlock()
+		lp.close()
+		logError("job %s: %v", p.Name, err)
+		return
+	}
+	select {
+	case code := <-p.job.exit:
+		p.job.output.Wait()
+		lp.close()
+		if code != 0 {
+			logWarn("job %s failed with exit code %d", p.Name, code)
+		} else {
+			logInfo("job %s done", p.Name)
+		}
+	case <-s.stopped:
+	}
+}
+
+// webhookActions describes the actions of cfg, one per line, for the dry
+// run
+func webhookActions(cfg *WebhookConfig) []string {
+	names := make([]string, 0, len(cfg.Actions))
+	for name := range cfg.Actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		a := cfg.Actions[name]
+		switch {
+		case a.Reload:
+			lines = append(lines, name+": reload the config")
+		case a.Restart != "":
+			lines = append(lines, name+": restart "+a.Restart)
+		default:
+			var svc ServiceConfig
+			json.Unmarshal(a.Job, &svc)
+			line := name + ": run " + commandLine(svc.Command, svc.Args)
+			if a.Pool != "" {
+				line += " in pool " + a.Pool
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSignature signs a webhook the way a sender does
+func testSignature(secret, timestamp, action, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + action + "." + body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidSignature(t *testing.T) {
+	sig := testSignature("s3cret", "1767268800", "deploy", `{"ref":"main"}`)
+	tests := []struct {
+		name                      string
+		secret, timestamp, action string
+		body, signature           string
+		want                      bool
+	}{
+		{"valid", "s3cret", "1767268800", "deploy", `{"ref":"main"}`, sig, true},
+		{"upper-case hex", "s3cret", "1767268800", "deploy", `{"ref":"main"}`, "sha256=" + strings.ToUpper(sig[7:]), true},
+		{"other secret", "other", "1767268800", "deploy", `{"ref":"main"}`, sig, false},
+		{"other time", "s3cret", "1767268801", "deploy", `{"ref":"main"}`, sig, false},
+		{"other action", "s3cret", "1767268800", "reload", `{"ref":"main"}`, sig, false},
+		{"other body", "s3cret", "1767268800", "deploy", `{"ref":"dev"}`, sig, false},
+		{"no prefix", "s3cret", "1767268800", "deploy", `{"ref":"main"}`, sig[7:], false},
+		{"not hex", "s3cret", "1767268800", "deploy", `{"ref":"main"}`, "sha256=zz", false},
+		{"empty", "s3cret", "1767268800", "deploy", `{"ref":"main"}`, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := validSignature(tt.secret, tt.timestamp, tt.action, []byte(tt.body), tt.signature)
+			if got != tt.want {
+				t.Errorf("validSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookReplays(t *testing.T) {
+	c := NewManualClock(testEpoch)
+	r := &webhookReplays{seen: make(map[string]time.Time)}
+	sig := testSignature("s3cret", "1767268800", "deploy", "")
+	recased := "sha256=" + strings.ToUpper(sig[7:])
+
+	if !r.first(sig, c.Now(), c.Now()) {
+		t.Fatal("a new signature was taken as a replay")
+	}
+	if r.first(sig, c.Now(), c.Now()) {
+		t.Fatal("a replayed signature was taken")
+	}
+	if r.first(recased, c.Now(), c.Now()) {
+		t.Fatal("a re-cased replay was taken")
+	}
+	other := testSignature("s3cret", "1767268800", "reload", "")
+	if !r.first(other, c.Now(), c.Now()) {
+		t.Fatal("another signature was taken as a replay")
+	}
+
+	// Forgotten once too old to be accepted anyway
+	signed := c.Now()
+	c.Advance(WebhookWindow + time.Second)
+	if !r.first(sig, signed, c.Now()) {
+		t.Fatal("a signature past WebhookWindow is still remembered")
+	}
+}